@@ -0,0 +1,163 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// Tee is a DataPointQueuer which passes every data point on to all
+// of its members, e.g. to both store and forward the aggregated
+// series.
+type Tee []DataPointQueuer
+
+func (t Tee) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	for _, q := range t {
+		q.QueueDataPoint(ident, ts, v)
+	}
+}
+
+type fwdPoint struct {
+	name string
+	ts   time.Time
+	v    float64
+}
+
+// Forwarder is a DataPointQueuer which sends the data points to a
+// remote endpoint speaking the Graphite text protocol, such as
+// another tgres. Using it as (or in a Tee with) the output of an
+// aggregator makes hierarchical aggregation possible, e.g. edge ->
+// regional -> global. Points are queued and sent asynchronously
+// over a single connection which is reestablished as needed. When
+// the queue is full or the endpoint is unreachable, points are
+// dropped (see Dropped()) rather than blocking the aggregator.
+type Forwarder struct {
+	Addr string // host:port
+	ch   chan *fwdPoint
+	done chan struct{}
+	once sync.Once
+
+	dropped uint64 // atomic
+}
+
+var (
+	fwdDialTimeout  = 5 * time.Second
+	fwdRetryDelay   = 5 * time.Second
+	fwdCloseTimeout = 5 * time.Second
+)
+
+// NewForwarder returns a Forwarder sending to addr (host:port) which
+// queues up to queueSize points.
+func NewForwarder(addr string, queueSize int) *Forwarder {
+	f := &Forwarder{Addr: addr, ch: make(chan *fwdPoint, queueSize), done: make(chan struct{})}
+	go f.run()
+	return f
+}
+
+// QueueDataPoint queues a data point for sending, the name of the
+// series is the "name" of ident.
+func (f *Forwarder) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	select {
+	case f.ch <- &fwdPoint{name: ident["name"], ts: ts, v: v}:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+// Dropped returns the number of data points that could not be sent.
+func (f *Forwarder) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// Close sends whatever is queued (giving up after a few seconds) and
+// closes the connection. The Forwarder cannot be used afterwards.
+func (f *Forwarder) Close() error {
+	f.once.Do(func() { close(f.ch) })
+	select {
+	case <-f.done:
+	case <-time.After(fwdCloseTimeout):
+		log.Printf("Forwarder: %d data points to %s not sent on close.", len(f.ch), f.Addr)
+	}
+	return nil
+}
+
+func (f *Forwarder) run() {
+	defer close(f.done)
+
+	var (
+		conn    net.Conn
+		w       *bufio.Writer
+		pending uint64 // points in w
+		err     error
+	)
+	defer func() {
+		if conn != nil {
+			w.Flush()
+			conn.Close()
+		}
+	}()
+
+	for p := range f.ch {
+		if conn == nil {
+			if conn, err = net.DialTimeout("tcp", f.Addr, fwdDialTimeout); err != nil {
+				log.Printf("Forwarder: cannot connect to %s, dropping data points for %v: %v", f.Addr, fwdRetryDelay, err)
+				conn = nil
+				f.dropUntil(time.Now().Add(fwdRetryDelay))
+				continue
+			}
+			w = bufio.NewWriter(conn)
+		}
+
+		fmt.Fprintf(w, "%s %v %d\n", p.name, p.v, p.ts.Unix())
+		pending++
+		if len(f.ch) > 0 {
+			continue // more to come, let the buffer fill up
+		}
+		if err = w.Flush(); err != nil {
+			log.Printf("Forwarder: error sending to %s, will reconnect: %v", f.Addr, err)
+			atomic.AddUint64(&f.dropped, pending)
+			conn.Close()
+			conn = nil
+		}
+		pending = 0
+	}
+}
+
+// dropUntil discards the queued points until t, or until Close().
+func (f *Forwarder) dropUntil(t time.Time) {
+	atomic.AddUint64(&f.dropped, 1) // the current one
+	tmr := time.NewTimer(time.Until(t))
+	defer tmr.Stop()
+	for {
+		select {
+		case _, ok := <-f.ch:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&f.dropped, 1)
+		case <-tmr.C:
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// How often the progress of acquires is logged while a transition
+// waits for them.
+var acquireProgressInterval = 5 * time.Second
+
+// AcquireProgress is the progress of the Acquire() calls of the
+// current (or last) transition, see Cluster.AcquireProgress().
+type AcquireProgress struct {
+	Total   int // DistDatums moving to this node
+	Done    int // Acquire() returned, including Failed
+	Failed  int // Acquire() returned an error
+	Started time.Time
+}
+
+// acquirer calls Acquire() on the DistDatums moving to this node
+// during a transition. Acquire() may need to load state from the
+// database, so doing them one at a time delays readiness, while
+// doing them all at once may overload the database, therefore up to
+// workers of them run concurrently, independently of Relinquish()
+// (which runs for every DistDatum moving away at once).
+type acquirer struct {
+	sync.Mutex
+	workers  int // zero means 1
+	progress AcquireProgress
+	ch       chan DistDatum
+	wg       sync.WaitGroup
+}
+
+// setWorkers sets the number of concurrent Acquire() calls, it takes
+// effect with the next transition.
+func (a *acquirer) setWorkers(n int) {
+	a.Lock()
+	defer a.Unlock()
+	a.workers = n
+}
+
+// begin starts the workers for a transition with total DistDatums to
+// acquire.
+func (a *acquirer) begin(total int) {
+	a.Lock()
+	defer a.Unlock()
+	a.progress = AcquireProgress{Total: total, Started: time.Now()}
+	workers := a.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > total {
+		workers = total
+	}
+	a.ch = make(chan DistDatum, total)
+	for i := 0; i < workers; i++ {
+		a.wg.Add(1)
+		go a.worker(a.ch)
+	}
+}
+
+func (a *acquirer) worker(ch chan DistDatum) {
+	defer a.wg.Done()
+	for dd := range ch {
+		log.Printf("Transition(): Calling Acquire for %s:%d (%s).", dd.Type(), dd.Id(), dd.GetName())
+		err := dd.Acquire()
+		if err != nil {
+			log.Printf("Transition(): Warning: Acquire() failed for id %s:%d (%s) with: %v", dd.Type(), dd.Id(), dd.GetName(), err)
+		}
+		a.Lock()
+		a.progress.Done++
+		if err != nil {
+			a.progress.Failed++
+		}
+		a.Unlock()
+	}
+}
+
+// acquire queues dd, it does not block.
+func (a *acquirer) acquire(dd DistDatum) {
+	a.ch <- dd
+}
+
+// finish waits for the queued acquires to complete, logging the
+// progress every acquireProgressInterval.
+func (a *acquirer) finish() {
+	close(a.ch)
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	tick := time.NewTicker(acquireProgressInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			if p := a.current(); p.Total > 0 {
+				log.Printf("Transition(): Acquired %d DistDatums (%d failed) in %v.", p.Done, p.Failed, time.Since(p.Started))
+			}
+			return
+		case <-tick.C:
+			p := a.current()
+			log.Printf("Transition(): Acquired %d of %d DistDatums (%d failed) so far...", p.Done, p.Total, p.Failed)
+		}
+	}
+}
+
+func (a *acquirer) current() AcquireProgress {
+	a.Lock()
+	defer a.Unlock()
+	return a.progress
+}
+
+// AcquireProgress returns the progress of the Acquire() calls of the
+// current (or last) transition, see ClusterConfig.AcquireConcurrency.
+func (c *Cluster) AcquireProgress() AcquireProgress {
+	return c.acquire.current()
+}
+
+// AcquireProgress is the FakeCluster version of
+// Cluster.AcquireProgress().
+func (fc *FakeCluster) AcquireProgress() AcquireProgress {
+	return fc.acquire.current()
+}
+
+// SetAcquireConcurrency is the FakeCluster equivalent of
+// ClusterConfig.AcquireConcurrency.
+func (fc *FakeCluster) SetAcquireConcurrency(n int) {
+	fc.acquire.setWorkers(n)
+}
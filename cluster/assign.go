@@ -0,0 +1,148 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The version of the ExportAssignments() format.
+const assignmentsVersion = 1
+
+// assignmentTable is what ExportAssignments() returns, the node names
+// assigned to every DistDatum (by "Type:Id"), the first being the
+// lead.
+type assignmentTable struct {
+	Version     int                 `json:"version"`
+	Assignments map[string][]string `json:"assignments"`
+}
+
+func exportAssignments(dds map[string]*ddEntry) ([]byte, error) {
+	at := assignmentTable{Version: assignmentsVersion, Assignments: make(map[string][]string, len(dds))}
+	for key, dde := range dds {
+		names := make([]string, 0, len(dde.nodes))
+		for _, n := range dde.nodes {
+			if n != nil {
+				names = append(names, n.Name())
+			}
+		}
+		at.Assignments[key] = names
+	}
+	return json.Marshal(&at)
+}
+
+func importAssignments(data []byte) (map[string][]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var at assignmentTable
+	if err := json.Unmarshal(data, &at); err != nil {
+		return nil, fmt.Errorf("ImportAssignments(): %v", err)
+	}
+	if at.Version != assignmentsVersion {
+		return nil, fmt.Errorf("ImportAssignments(): unsupported version %d", at.Version)
+	}
+	return at.Assignments, nil
+}
+
+// assignNodes is selectNodes() unless there are pinned nodes for dd
+// (see ImportAssignments()) and its pinned lead node is among nodes,
+// in which case the pinned nodes (those that are among nodes) come
+// first and the remaining copies are filled from selectNodes().
+func assignNodes(nodes []*Node, dd DistDatum, copies int, pins map[string][]string) []*Node {
+	selected := selectNodes(nodes, dd.Id(), copies)
+	names := pins[ddKey(dd)]
+	if len(names) == 0 || len(selected) == 0 {
+		return selected
+	}
+
+	byName := make(map[string]*Node, len(nodes))
+	for _, n := range nodes {
+		byName[n.Name()] = n
+	}
+	if byName[names[0]] == nil {
+		return selected
+	}
+	result := make([]*Node, 0, copies)
+	seen := make(map[string]bool, copies)
+	for _, name := range names {
+		if n := byName[name]; n != nil && !seen[name] && len(result) < copies {
+			result = append(result, n)
+			seen[name] = true
+		}
+	}
+	for _, n := range selected {
+		if len(result) == copies {
+			break
+		}
+		if !seen[n.Name()] {
+			result = append(result, n)
+			seen[n.Name()] = true
+		}
+	}
+	for i := 0; len(result) < copies; i++ { // fewer nodes than copies
+		result = append(result, selected[i])
+	}
+	return result
+}
+
+// ExportAssignments returns the current DistDatum to node assignments
+// in a form which ImportAssignments() accepts, e.g. to seed a new
+// cluster during a blue-green migration with the assignments of the
+// old one, so that every node keeps the data it has cached.
+func (c *Cluster) ExportAssignments() ([]byte, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return exportAssignments(c.dds)
+}
+
+// ImportAssignments pins DistDatums to the nodes they were assigned
+// to in data, as returned by ExportAssignments() of this or another
+// cluster. The nodes are matched by name, so the new cluster needs to
+// reuse the node names of the old one. A pin only applies while its
+// lead node is ready, otherwise the usual assignment is used. Pins
+// take effect at the next LoadDistData() or Transition(), empty data
+// removes them.
+func (c *Cluster) ImportAssignments(data []byte) error {
+	pins, err := importAssignments(data)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.pins = pins
+	return nil
+}
+
+// ExportAssignments is the same as Cluster.ExportAssignments().
+func (fc *FakeCluster) ExportAssignments() ([]byte, error) {
+	fc.RLock()
+	defer fc.RUnlock()
+	return exportAssignments(fc.dds)
+}
+
+// ImportAssignments is the same as Cluster.ImportAssignments().
+func (fc *FakeCluster) ImportAssignments(data []byte) error {
+	pins, err := importAssignments(data)
+	if err != nil {
+		return err
+	}
+	fc.Lock()
+	defer fc.Unlock()
+	fc.pins = pins
+	return nil
+}
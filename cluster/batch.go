@@ -0,0 +1,195 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// The most messages the sender of a message type takes off its
+// channel at once to send as a batch.
+var maxBatchMsgs = 1024
+
+// BatchArgs and BatchReply are what is passed by the ClusterRPC.Batch
+// call, they are only exported because net/rpc requires it. Data is a
+// flate compressed stream of gob encoded Msgs, all from Src.
+type BatchArgs struct {
+	Src  *Node
+	Data []byte
+}
+
+type BatchReply struct {
+	Delivered int
+}
+
+// SendBatch sends all the messages to dst with a single RPC call. The
+// messages are compressed together, which is much cheaper than
+// sending them one by one when there are many small ones. The Id of
+// every message must be set to that of its type, i.e. the order in
+// which RegisterMsgType() was called (the first type is the
+// cluster's own). Messages sent via the channels returned by
+// RegisterMsgType() are batched automatically when they queue up.
+// The destination must speak protocol version 4 or later.
+func (c *Cluster) SendBatch(dst *Node, msgs []*Msg) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	z, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	enc := gob.NewEncoder(z)
+	for _, m := range msgs {
+		// Src and Dst are the same for all, no need to repeat them
+		if err := enc.Encode(&Msg{Id: m.Id, Body: m.Body, Codec: m.Codec}); err != nil {
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	var reply BatchReply
+	if err := c.call(dst, "ClusterRPC.Batch", &BatchArgs{Src: c.LocalNode(), Data: buf.Bytes()}, &reply); err != nil {
+		return &batchError{n: len(msgs), dst: dst.Name(), err: err}
+	}
+	return nil
+}
+
+// batchError is returned by SendBatch, err is the error of the call.
+type batchError struct {
+	n   int
+	dst string
+	err error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("error sending %d messages to %s: %v", e.n, e.dst, e.err)
+}
+
+func (rpc *ClusterRPC) Batch(args BatchArgs, reply *BatchReply) error {
+	srv := rpc.c.rpcSrv
+	if err := srv.beginCall(); err != nil {
+		return err
+	}
+	defer srv.endCall()
+
+	dst := rpc.c.LocalNode()
+	dec := gob.NewDecoder(flate.NewReader(bytes.NewReader(args.Data)))
+	for {
+		msg := &Msg{}
+		if err := dec.Decode(msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error decoding message %d of batch: %v", reply.Delivered, err)
+		}
+		msg.Src, msg.Dst = args.Src, dst
+		if err := rpc.c.deliver(msg); err != nil {
+			return err
+		}
+		reply.Delivered++
+	}
+}
+
+// sendQueued sends the messages, those to the same node as a batch
+// if it understands batches, keeping the order for each node.
+func (c *Cluster) sendQueued(msgs []*Msg) {
+	var dsts []*Node
+	byDst := make(map[*Node][]*Msg)
+	for _, msg := range msgs {
+		if msg.Dst == nil {
+			log.Printf("Cluster: cannot send message when Dst is not set, ignoring.")
+			continue
+		}
+		if byDst[msg.Dst] == nil {
+			dsts = append(dsts, msg.Dst)
+		}
+		byDst[msg.Dst] = append(byDst[msg.Dst], msg)
+	}
+
+	for _, dst := range dsts {
+		msgs := byDst[dst]
+		if c.offline != nil {
+			// whatever is still queued goes first, to keep the order
+			if queued := c.offline.take(dst.Name(), time.Now()); len(queued) > 0 {
+				for _, m := range queued {
+					m.Dst = dst
+				}
+				msgs = append(queued, msgs...)
+			}
+		}
+		if len(msgs) > 1 && dst.ProtocolVersion() >= 4 {
+			err := c.SendBatch(dst, msgs)
+			if err == nil {
+				c.redelivered(msgs)
+			} else if be, ok := err.(*batchError); ok && c.queueOffline(dst, msgs, be.err) {
+				log.Printf("Cluster: %v, queuing these messages.", err)
+			} else {
+				log.Printf("Cluster: %v, dropping these messages.", err)
+			}
+			continue
+		}
+		for i, msg := range msgs {
+			if err := c.send(msg); c.queueOffline(dst, msgs[i:], err) {
+				log.Printf("Cluster: error sending message to %s, queuing it and the %d after it: %v", dst.Name(), len(msgs)-i-1, err)
+				break
+			} else if err != nil {
+				log.Printf("Cluster: error sending message to %s, dropping it: %v", dst.Name(), err)
+			} else {
+				c.redelivered(msgs[i : i+1])
+			}
+		}
+	}
+}
+
+// queueOffline queues the messages if offline queuing is enabled and
+// err means the node could not be reached. It returns true if the
+// messages were queued.
+func (c *Cluster) queueOffline(dst *Node, msgs []*Msg, err error) bool {
+	if c.offline == nil || !isOffline(err) {
+		return false
+	}
+	c.offline.add(dst.Name(), msgs, time.Now())
+	return true
+}
+
+// redelivered counts the messages which were queued before.
+func (c *Cluster) redelivered(msgs []*Msg) {
+	if c.offline == nil {
+		return
+	}
+	n := 0
+	for _, m := range msgs {
+		if !m.queuedAt.IsZero() {
+			n++
+		}
+	}
+	if n > 0 {
+		c.offline.delivered(n)
+	}
+}
+
+// send sends a single message.
+func (c *Cluster) send(msg *Msg) error {
+	msg.Src = c.LocalNode()
+
+	var resp Msg
+	return c.call(msg.Dst, "ClusterRPC.Message", msg, &resp)
+}
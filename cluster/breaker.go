@@ -0,0 +1,210 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNodeUnreachable is returned for RPC calls to a node which has
+// failed repeatedly, until breakerCooldown has passed.
+var ErrNodeUnreachable = errors.New("cluster: node is unreachable")
+
+var (
+	// How long an RPC call may take, unless set in ClusterConfig.
+	rpcCallTimeout = 10 * time.Second
+	// How many consecutive failures mark a node unreachable.
+	breakerThreshold = 3
+	// How long a node stays unreachable before a call is tried again.
+	breakerCooldown = 10 * time.Second
+)
+
+// circuit breaker state for a node
+type breakerState struct {
+	failures int
+	openedAt time.Time // zero if closed
+	probing  bool      // a call is being tried after the cooldown
+}
+
+// breaker keeps track of nodes that fail RPC calls, so that a dead or
+// hung node does not cost every caller a timeout. After
+// breakerThreshold consecutive failures the node is considered
+// unreachable and calls to it fail immediately. Once breakerCooldown
+// has passed, a single call is let through: if it succeeds, the node
+// is reachable again, otherwise the cooldown starts over.
+type breaker struct {
+	sync.Mutex
+	nodes    map[string]*breakerState
+	timeouts uint64 // calls which timed out, since start
+	errors   uint64 // calls which failed otherwise, since start
+}
+
+func (b *breaker) allow(name string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	st := b.nodes[name]
+	if st == nil || st.openedAt.IsZero() {
+		return true
+	}
+	if st.probing || now.Sub(st.openedAt) < breakerCooldown {
+		return false
+	}
+	st.probing = true
+	return true
+}
+
+func (b *breaker) done(name string, ok, timedOut bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if timedOut {
+		b.timeouts++
+	} else if !ok {
+		b.errors++
+	}
+	if ok {
+		if st := b.nodes[name]; st != nil && !st.openedAt.IsZero() {
+			log.Printf("Cluster: node %s is reachable again.", name)
+		}
+		delete(b.nodes, name)
+		return
+	}
+	if b.nodes == nil {
+		b.nodes = make(map[string]*breakerState)
+	}
+	st := b.nodes[name]
+	if st == nil {
+		st = &breakerState{}
+		b.nodes[name] = st
+	}
+	st.failures++
+	st.probing = false
+	if st.failures >= breakerThreshold {
+		if st.openedAt.IsZero() {
+			log.Printf("Cluster: node %s failed %d calls in a row, marking it unreachable for %v.", name, st.failures, breakerCooldown)
+		}
+		st.openedAt = now
+	}
+}
+
+func (b *breaker) stats() (unreachable []string, timeouts, errors uint64) {
+	b.Lock()
+	defer b.Unlock()
+	for name, st := range b.nodes {
+		if !st.openedAt.IsZero() {
+			unreachable = append(unreachable, name)
+		}
+	}
+	sort.Strings(unreachable)
+	return unreachable, b.timeouts, b.errors
+}
+
+// call makes an RPC call to the node, giving up after the RPC timeout
+// (in which case the connection is closed). Failures other than errors
+// returned by the remote method count towards the node's circuit
+// breaker.
+func (c *Cluster) call(n *Node, method string, args, reply interface{}) error {
+	if !c.breaker.allow(n.Name(), time.Now()) {
+		return ErrNodeUnreachable
+	}
+	client, err := c.rpcClient(n)
+	if err != nil {
+		c.breaker.done(n.Name(), false, false, time.Now())
+		return err
+	}
+
+	timeout := c.rpcTimeout
+	if timeout == 0 {
+		timeout = rpcCallTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case cl := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		err = cl.Error
+	case <-t.C:
+		c.dropRPCClient(n, client) // this also fails the call
+		c.breaker.done(n.Name(), false, true, time.Now())
+		return fmt.Errorf("%s to %s timed out after %v", method, n.Name(), timeout)
+	}
+
+	if _, ok := err.(rpc.ServerError); ok || err == nil {
+		// the node did respond
+		c.breaker.done(n.Name(), true, false, time.Now())
+		return err
+	}
+	c.dropRPCClient(n, client)
+	c.breaker.done(n.Name(), false, false, time.Now())
+	return err
+}
+
+// Stats is a snapshot of the state of the cluster as seen by this
+// node.
+type Stats struct {
+	Members     int
+	CachedNodes int      // see NodeCacheSize()
+	RPCConns    int      // open RPC connections to other nodes
+	Unreachable []string // names of nodes marked unreachable
+	Unhealthy   []string // names of nodes failing the health check
+	RPCTimeouts uint64   // RPC calls which timed out, since start
+	RPCErrors   uint64   // RPC calls which failed otherwise, since start
+	UnsafeMoves uint64   // DistDatums moved while Relinquish() was stuck, since start
+
+	// See ClusterConfig.AcquireConcurrency, of the current or last
+	// transition.
+	AcquireTotal  int // DistDatums moving to this node
+	AcquireDone   int // Acquire() returned
+	AcquireFailed int // Acquire() returned an error
+
+	// See ClusterConfig.OfflineQueueSize.
+	OfflineQueued      int    // messages currently queued
+	OfflineDropped     uint64 // dropped because a queue was full, since start
+	OfflineExpired     uint64 // dropped because they were queued too long, since start
+	OfflineRedelivered uint64 // queued messages which were sent, since start
+}
+
+// Stats returns the current Stats.
+func (c *Cluster) Stats() Stats {
+	nodes, conns := c.NodeCacheSize()
+	unreachable, timeouts, errors := c.breaker.stats()
+	queued, dropped, expired, redelivered := c.offline.stats()
+	acq := c.acquire.current()
+	return Stats{
+		Members:     c.NumMembers(),
+		CachedNodes: nodes,
+		RPCConns:    conns,
+		Unreachable: unreachable,
+		Unhealthy:   c.Unhealthy(),
+		RPCTimeouts: timeouts,
+		RPCErrors:   errors,
+		UnsafeMoves: c.unsafe.total(),
+
+		AcquireTotal:  acq.Total,
+		AcquireDone:   acq.Done,
+		AcquireFailed: acq.Failed,
+
+		OfflineQueued:      queued,
+		OfflineDropped:     dropped,
+		OfflineExpired:     expired,
+		OfflineRedelivered: redelivered,
+	}
+}
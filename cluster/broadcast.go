@@ -0,0 +1,81 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// MaxBroadcastSize is the largest a broadcast can be once encoded
+// (see Broadcast()). Broadcasts are piggybacked onto gossip packets,
+// which are limited in size by the UDP buffer size.
+const MaxBroadcastSize = 1024
+
+// broadcastMsgId is the Msg.Id of broadcasts. It is negative so as
+// not to clash with the ids assigned by RegisterMsgType().
+const broadcastMsgId = -1
+
+// broadcast implements memberlist.Broadcast
+type broadcast []byte
+
+func (b broadcast) Invalidates(memberlist.Broadcast) bool { return false }
+func (b broadcast) Message() []byte                       { return []byte(b) }
+func (b broadcast) Finished()                             {}
+
+// Broadcast sends payload to all the other nodes of the cluster.
+// Unlike messages sent via RegisterMsgType(), a broadcast requires no
+// connection to every node: it is queued and piggybacked onto the
+// gossip, which makes it suitable for small cluster-wide
+// announcements such as "flush now" or "config reloaded". Delivery is
+// best-effort, the order of broadcasts is not guaranteed and a
+// broadcast may be received more than once. The payload is encoded
+// with the codec of the cluster and once encoded must not exceed
+// MaxBroadcastSize.
+func (c *Cluster) Broadcast(payload interface{}) error {
+	msg, err := c.NewMsg(nil, payload)
+	if err != nil {
+		return err
+	}
+	msg.Src, msg.Id = c.LocalNode(), broadcastMsgId
+	b := msg.bytes()
+	if b == nil {
+		return fmt.Errorf("Broadcast(): unable to encode message")
+	}
+	if len(b) > MaxBroadcastSize {
+		return fmt.Errorf("Broadcast(): message too large: %d bytes (max %d)", len(b), MaxBroadcastSize)
+	}
+	c.bcastQ.QueueBroadcast(broadcast(b))
+	return nil
+}
+
+// Broadcasts returns the channel on which broadcasts from other nodes
+// arrive. If the channel is full, broadcasts are dropped.
+func (c *Cluster) Broadcasts() <-chan *Msg {
+	return c.bcastCh
+}
+
+// deliverBroadcast passes the broadcast to the application without
+// blocking, as it is called from the memberlist gossip.
+func deliverBroadcast(ch chan *Msg, m *Msg) {
+	select {
+	case ch <- m:
+	default:
+		log.Printf("Cluster: broadcast channel full, dropping broadcast from %s", m.Src.Name())
+	}
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Faults describes the faults to inject for testing. The zero value
+// injects nothing. This is meant for tests only, see
+// FakeNetwork.InjectFaults() and ChaosTransport.
+type Faults struct {
+	Drop      float64       // Probability (0 to 1) that a delivery is dropped
+	Duplicate float64       // Probability that a delivery happens twice
+	Delay     time.Duration // Deliveries are delayed randomly by up to this much (and thus may be reordered)
+}
+
+type faultInjector struct {
+	sync.Mutex
+	faults Faults
+	down   bool
+	rnd    *rand.Rand
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (fi *faultInjector) set(f Faults) {
+	fi.Lock()
+	defer fi.Unlock()
+	fi.faults = f
+}
+
+func (fi *faultInjector) setDown(down bool) {
+	fi.Lock()
+	defer fi.Unlock()
+	fi.down = down
+}
+
+func (fi *faultInjector) isDown() bool {
+	fi.Lock()
+	defer fi.Unlock()
+	return fi.down
+}
+
+// plan decides the fate of a delivery: how many times it should
+// happen (0, 1 or 2) and the delay for each.
+func (fi *faultInjector) plan() (n int, delays [2]time.Duration) {
+	fi.Lock()
+	defer fi.Unlock()
+	if fi.down || fi.rnd.Float64() < fi.faults.Drop {
+		return 0, delays
+	}
+	n = 1
+	if fi.rnd.Float64() < fi.faults.Duplicate {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		if fi.faults.Delay > 0 {
+			delays[i] = time.Duration(fi.rnd.Int63n(int64(fi.faults.Delay)))
+		}
+	}
+	return n, delays
+}
+
+// deliver calls send according to the plan. Delayed deliveries
+// happen in a separate goroutine.
+func (fi *faultInjector) deliver(send func()) {
+	n, delays := fi.plan()
+	for i := 0; i < n; i++ {
+		if delays[i] == 0 {
+			send()
+		} else {
+			go func(d time.Duration) {
+				time.Sleep(d)
+				send()
+			}(delays[i])
+		}
+	}
+}
+
+// ChaosTransport wraps a memberlist.Transport injecting Faults into
+// outgoing packets, and can simulate the node going down (all packets
+// and connections in either direction fail). Use it via
+// ClusterConfig.Transport in tests, e.g.:
+//
+//	tr, _ := memberlist.NewNetTransport(&memberlist.NetTransportConfig{...})
+//	ct := NewChaosTransport(tr)
+//	ct.InjectFaults(Faults{Drop: 0.1})
+//	c, _ := NewClusterWithConfig(&ClusterConfig{Transport: ct, ...})
+type ChaosTransport struct {
+	memberlist.Transport
+	fi       *faultInjector
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+}
+
+// NewChaosTransport wraps t. No faults are injected until
+// InjectFaults() or SetDown() is called.
+func NewChaosTransport(t memberlist.Transport) *ChaosTransport {
+	ct := &ChaosTransport{
+		Transport: t,
+		fi:        newFaultInjector(),
+		packetCh:  make(chan *memberlist.Packet),
+		streamCh:  make(chan net.Conn),
+	}
+	go func() {
+		for p := range t.PacketCh() {
+			if !ct.fi.isDown() {
+				ct.packetCh <- p
+			}
+		}
+	}()
+	go func() {
+		for conn := range t.StreamCh() {
+			if ct.fi.isDown() {
+				conn.Close()
+				continue
+			}
+			ct.streamCh <- conn
+		}
+	}()
+	return ct
+}
+
+// InjectFaults sets the faults for outgoing packets.
+func (ct *ChaosTransport) InjectFaults(f Faults) { ct.fi.set(f) }
+
+// SetDown simulates the node being (un)reachable. Alternating
+// SetDown(true) and SetDown(false) makes the node flap.
+func (ct *ChaosTransport) SetDown(down bool) { ct.fi.setDown(down) }
+
+func (ct *ChaosTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	ct.fi.deliver(func() { ct.Transport.WriteTo(b, addr) })
+	return time.Now(), nil
+}
+
+func (ct *ChaosTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if ct.fi.isDown() {
+		return nil, fmt.Errorf("ChaosTransport: node is down")
+	}
+	return ct.Transport.DialTimeout(addr, timeout)
+}
+
+func (ct *ChaosTransport) PacketCh() <-chan *memberlist.Packet { return ct.packetCh }
+func (ct *ChaosTransport) StreamCh() <-chan net.Conn           { return ct.streamCh }
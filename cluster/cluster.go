@@ -44,6 +44,7 @@ import (
 	"net/rpc"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -66,23 +67,56 @@ const updateNodeTO = 30 * time.Second
 type ddEntry struct {
 	dd    DistDatum
 	nodes []*Node
+	token uint64 // fencing token, non-zero only while we own dd
+	epoch uint64 // membership epoch in which nodes were assigned
+}
+
+// nextToken returns a fencing token greater than prev. Tokens are
+// based on the wall clock so that they keep increasing across nodes
+// even when the previous owner could not pass its token on (see
+// FencingToken()).
+func nextToken(prev uint64) uint64 {
+	t := uint64(time.Now().UnixNano())
+	if t <= prev {
+		t = prev + 1
+	}
+	return t
 }
 
 // Cluster is based on Memberlist and adds some functionality on top
 // of it such as the notion of a node being "ready".
 type Cluster struct {
+	eventHub // first, its epoch is accessed atomically
 	*memberlist.Memberlist
 	sync.RWMutex
-	rcvChs    []chan *Msg
-	chgNotify []chan bool
-	meta      []byte
-	dds       map[string]*ddEntry
-	snd, rcv  chan *Msg // dds messages
-	copies    int
-	rpcPort   int
-	rpc       net.Listener
-	joined    bool
-	ncache    map[*memberlist.Node]*Node
+	transitionHooks
+	rcvChs     []chan *Msg
+	meta       []byte
+	dds        map[string]*ddEntry
+	snd, rcv   chan *Msg // dds messages
+	copies     int
+	rpcPort    int
+	rpcSrv     *rpcServer
+	stop       chan struct{} // closed by Shutdown
+	stopOnce   sync.Once
+	dial       func(network, addr string, timeout time.Duration) (net.Conn, error)
+	codec      Codec
+	bcastQ     *memberlist.TransmitLimitedQueue
+	bcastCh    chan *Msg
+	joined     bool
+	ncache     map[*memberlist.Node]*Node
+	nlock      sync.Mutex // for ncache and the rpc of its nodes
+	locks      lockTable  // if we are the lock master
+	health     replicaHealth
+	place      NodeFilter // which nodes DistDatums can be placed on
+	breaker    breaker
+	rpcTimeout time.Duration
+	unsafe     unsafeMoves
+	pins       map[string][]string // see ImportAssignments()
+	rpcHealth  rpcHealth
+	offline    *offlineQueue // nil if disabled
+	compress   bool          // ClusterConfig.CompressMeta
+	acquire    acquirer      // see ClusterConfig.AcquireConcurrency
 }
 
 // NewCluster creates a new Cluster with reasonable defaults.
@@ -97,66 +131,279 @@ func NewCluster() (*Cluster, error) {
 // container where it is impossible to figure out the outside IP
 // addresses and the hostname can be the same).
 func NewClusterBind(baddr string, bport int, aaddr string, aport int, rpcport int, name string) (*Cluster, error) {
-	c := &Cluster{
-		rcvChs:    make([]chan *Msg, 0),
-		chgNotify: make([]chan bool, 0),
-		dds:       make(map[string]*ddEntry),
-		copies:    1,
-		ncache:    make(map[*memberlist.Node]*Node),
+	cfg := DefaultLANClusterConfig()
+	cfg.BindAddr, cfg.BindPort = baddr, bport
+	cfg.AdvertiseAddr, cfg.AdvertisePort = aaddr, aport
+	cfg.RPCPort = rpcport
+	cfg.Name = name
+	return NewClusterWithConfig(cfg)
+}
+
+// ClusterConfig contains the settings with which a Cluster is
+// created. Zero values for addresses, ports and name mean the
+// memberlist default, zero values for the tunables mean the default
+// of the profile (LAN or WAN).
+type ClusterConfig struct {
+	BindAddr      string
+	BindPort      int
+	AdvertiseAddr string
+	AdvertisePort int
+	RPCPort       int
+	Name          string
+
+	// The RPC address/port advertised to other nodes, for when the
+	// RPC listener is not reachable at the gossip address and
+	// RPCPort (e.g. behind NAT). Zero values mean the gossip
+	// advertise address and RPCPort respectively.
+	AdvertiseRPCAddr string
+	AdvertiseRPCPort int
+
+	// WAN selects the memberlist WAN profile as the base
+	// configuration. It has longer timeouts and less frequent
+	// probing and is meant for nodes in different data centers.
+	WAN bool
+
+	TCPTimeout       time.Duration // Timeout for establishing a TCP connection to a node
+	SuspicionMult    int           // Multiplier for the time a suspect node is considered alive
+	PushPullInterval time.Duration // How often to do a full state sync with a random node
+	ProbeInterval    time.Duration // How often to probe a random node
+	ProbeTimeout     time.Duration // How long to wait for an ack from a probed node
+	GossipInterval   time.Duration // How often to gossip to random nodes
+
+	// Transport, if not nil, is used by memberlist for all gossip
+	// instead of the default UDP/TCP transport (BindAddr and
+	// BindPort are then ignored by memberlist). This makes it
+	// possible to run the cluster over e.g. an existing mesh
+	// network. Note that DistDatum messages are not gossip, see
+	// RPCListener and RPCDialer.
+	Transport memberlist.Transport
+
+	// RPCListener, if not nil, is used to accept RPC connections
+	// from other nodes instead of listening on RPCPort. RPCDialer,
+	// if not nil, is used to connect to the RPC address of other
+	// nodes instead of net.DialTimeout.
+	RPCListener net.Listener
+	RPCDialer   func(network, addr string, timeout time.Duration) (net.Conn, error)
+
+	// RPCTimeout is how long an RPC call to another node may take
+	// before it is abandoned (and the connection closed), zero
+	// means 10s.
+	RPCTimeout time.Duration
+
+	// HealthCheckInterval is how often the RPC endpoint of the
+	// other nodes is pinged, zero means 5s, negative disables the
+	// health check. Nodes which fail the health check are not
+	// assigned DistDatums, even if gossip says they are alive.
+	HealthCheckInterval time.Duration
+
+	// OfflineQueueSize, if not zero, enables queuing of messages
+	// (sent via the channels returned by RegisterMsgType()) to a
+	// node which cannot be reached, instead of dropping them. Up to
+	// this many messages per node are kept for OfflineQueueTTL (zero
+	// means 1 minute) and sent when the node is reachable again.
+	// Messages may then arrive out of order with respect to those
+	// sent in the meantime by other nodes.
+	OfflineQueueSize int
+	OfflineQueueTTL  time.Duration
+
+	// Codec is used to encode messages created with Cluster.NewMsg,
+	// nil means GobCodec. If the codec is an RPCCodec, it is also
+	// used for the RPC connections between nodes, in which case all
+	// nodes in the cluster must use the same codec.
+	Codec Codec
+
+	// Tags are arbitrary key/value pairs gossiped to the other
+	// nodes, e.g. role=ingest, see Node.Tags().
+	Tags map[string]string
+
+	// SortBy determines the order of the nodes in SortedNodes(),
+	// and thereby which DistDatums each node is assigned and which
+	// node is the lock master. With SortByStartTime (the default)
+	// the longest running nodes always come first, so a restarted
+	// node moves to the end and the assignments of the others shift.
+	// With SortByNodeID nodes are ordered by a hash of NodeID, which
+	// should persist across restarts (see LoadNodeID()), so that a
+	// node keeps its position. All nodes should use the same SortBy.
+	SortBy int
+	NodeID string
+
+	// CompressMeta flate compresses the user part of the node
+	// metadata (see SetMetaData()) when that makes it smaller, so
+	// that more fits within memberlist.MetaMaxSize. Nodes older than
+	// protocol version 6 cannot read compressed metadata, therefore
+	// it should only be enabled once all nodes have been upgraded.
+	CompressMeta bool
+
+	// AcquireConcurrency is how many Acquire() calls (of the
+	// DistDatums moving to this node) a transition makes at once,
+	// zero means 1, i.e. one at a time. Relinquish() is not
+	// affected. See also AcquireProgress().
+	AcquireConcurrency int
+}
+
+// DefaultLANClusterConfig returns a ClusterConfig suitable for nodes
+// on the same local network. These are the values Cluster has
+// always used.
+func DefaultLANClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		TCPTimeout:       30 * time.Second,
+		SuspicionMult:    6,
+		PushPullInterval: 15 * time.Second,
+	}
+}
+
+// DefaultWANClusterConfig returns a ClusterConfig suitable for nodes
+// spread across data centers, where the LAN timeouts would cause
+// nodes to flap in and out of the cluster. The tunables are left at
+// zero, which means the memberlist WAN defaults.
+func DefaultWANClusterConfig() *ClusterConfig {
+	return &ClusterConfig{WAN: true}
+}
+
+// memberlistConfig translates the ClusterConfig into a
+// memberlist.Config.
+func (cc *ClusterConfig) memberlistConfig() *memberlist.Config {
+	var cfg *memberlist.Config
+	if cc.WAN {
+		cfg = memberlist.DefaultWANConfig()
+	} else {
+		cfg = memberlist.DefaultLANConfig()
 	}
-	cfg := memberlist.DefaultLANConfig()
-	cfg.TCPTimeout = 30 * time.Second
-	cfg.SuspicionMult = 6
-	cfg.PushPullInterval = 15 * time.Second
 
-	if baddr != "" {
-		cfg.BindAddr = baddr
+	if cc.BindAddr != "" {
+		cfg.BindAddr = cc.BindAddr
 	}
-	if bport != 0 {
-		cfg.BindPort = bport
+	if cc.BindPort != 0 {
+		cfg.BindPort = cc.BindPort
 	}
-	if aaddr != "" {
-		cfg.AdvertiseAddr = aaddr
+	if cc.AdvertiseAddr != "" {
+		cfg.AdvertiseAddr = cc.AdvertiseAddr
+	}
+	if cc.AdvertisePort != 0 {
+		cfg.AdvertisePort = cc.AdvertisePort
+	}
+	if cc.Name != "" {
+		cfg.Name = cc.Name
+	}
+
+	if cc.TCPTimeout != 0 {
+		cfg.TCPTimeout = cc.TCPTimeout
+	}
+	if cc.SuspicionMult != 0 {
+		cfg.SuspicionMult = cc.SuspicionMult
+	}
+	if cc.PushPullInterval != 0 {
+		cfg.PushPullInterval = cc.PushPullInterval
+	}
+	if cc.ProbeInterval != 0 {
+		cfg.ProbeInterval = cc.ProbeInterval
+	}
+	if cc.ProbeTimeout != 0 {
+		cfg.ProbeTimeout = cc.ProbeTimeout
+	}
+	if cc.GossipInterval != 0 {
+		cfg.GossipInterval = cc.GossipInterval
+	}
+	if cc.Transport != nil {
+		cfg.Transport = cc.Transport
+	}
+	return cfg
+}
+
+// NewClusterWithConfig creates a new Cluster given a ClusterConfig.
+func NewClusterWithConfig(cc *ClusterConfig) (*Cluster, error) {
+	if cc.SortBy == SortByNodeID && cc.NodeID == "" {
+		return nil, fmt.Errorf("NewClusterWithConfig(): SortByNodeID requires a NodeID")
 	}
-	if aport != 0 {
-		cfg.AdvertisePort = aport
+	c := &Cluster{
+		rcvChs:  make([]chan *Msg, 0),
+		dds:     make(map[string]*ddEntry),
+		copies:  1,
+		ncache:  make(map[*memberlist.Node]*Node),
+		stop:    make(chan struct{}),
+		bcastCh: make(chan *Msg, 128),
 	}
-	if name != "" {
-		cfg.Name = name
+	c.codec = GobCodec
+	if cc.Codec != nil {
+		c.codec = cc.Codec
 	}
+	cfg := cc.memberlistConfig()
 	cfg.LogOutput = &logger{}
-	cfg.Delegate, cfg.Events = c, c
+	cfg.Delegate, cfg.Events, cfg.Alive = c, c, c
+	c.bcastQ = &memberlist.TransmitLimitedQueue{
+		NumNodes:       func() int { return c.NumMembers() },
+		RetransmitMult: cfg.RetransmitMult,
+	}
 	var err error
 	if c.Memberlist, err = memberlist.Create(cfg); err != nil {
 		return nil, err
 	}
-	md := &nodeMeta{sortBy: startTime.UnixNano()}
-	c.saveMeta(md)
+	if cc.RPCPort == 0 {
+		c.rpcPort = 12354
+	} else {
+		c.rpcPort = cc.RPCPort
+	}
+
+	md := &nodeMeta{sortBy: startTime.UnixNano(), rpcAddr: cc.AdvertiseRPCAddr, rpcPort: c.rpcPort}
+	if cc.SortBy == SortByNodeID {
+		md.sortBy = nodeIDSortKey(cc.NodeID)
+	}
+	if cc.AdvertiseRPCPort != 0 {
+		md.rpcPort = cc.AdvertiseRPCPort
+	}
+	if len(md.rpcAddr) > 255 {
+		c.Memberlist.Shutdown()
+		return nil, fmt.Errorf("NewClusterWithConfig(): AdvertiseRPCAddr too long: %q", md.rpcAddr)
+	}
+	md.tags = cc.Tags
+	c.compress = cc.CompressMeta
+	c.acquire.setWorkers(cc.AcquireConcurrency)
+	if err := c.saveMeta(md); err != nil {
+		c.Memberlist.Shutdown()
+		return nil, fmt.Errorf("NewClusterWithConfig(): %v", err)
+	}
 	if err = c.UpdateNode(updateNodeTO); err != nil {
-		log.Printf("NewClusterBind(): UpdateNode() failed: %v", err)
+		log.Printf("NewClusterWithConfig(): UpdateNode() failed: %v", err)
 		return nil, err
 	}
 
-	if rpcport == 0 {
-		c.rpcPort = 12354
-	} else {
-		c.rpcPort = rpcport
+	if cc.OfflineQueueSize > 0 {
+		c.offline = newOfflineQueue(cc.OfflineQueueSize, cc.OfflineQueueTTL)
 	}
-
 	c.snd, c.rcv = c.RegisterMsgType()
 
-	rpc.Register(&ClusterRPC{c})
-	if c.rpc, err = net.Listen("tcp", fmt.Sprintf("%s:%d", baddr, c.rpcPort)); err != nil {
+	c.dial = net.DialTimeout
+	c.rpcTimeout = cc.RPCTimeout
+	if cc.RPCDialer != nil {
+		c.dial = cc.RPCDialer
+	}
+
+	ln := cc.RPCListener
+	if ln == nil {
+		if ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cc.BindAddr, c.rpcPort)); err != nil {
+			c.Memberlist.Shutdown()
+			return nil, err
+		}
+	}
+	if c.rpcSrv, err = newRPCServer(&ClusterRPC{c}, ln, c.codec); err != nil {
+		ln.Close()
 		c.Memberlist.Shutdown()
 		return nil, err
 	}
 
 	// Serve RPC Requests
-	go func() {
-		for {
-			rpc.Accept(c.rpc)
-		}
-	}()
+	c.rpcSrv.start()
+
+	interval := cc.HealthCheckInterval
+	if interval == 0 {
+		interval = healthCheckInterval
+	}
+	if interval > 0 {
+		go c.healthCheck(interval)
+	}
+	if c.offline != nil {
+		go c.retryOffline(offlineRetryInterval)
+	}
 
 	return c, nil
 }
@@ -167,13 +414,28 @@ type ClusterRPC struct {
 
 func (rpc *ClusterRPC) Message(msg Msg, reply *Msg) error {
 
-	if msg.Id < len(rpc.c.rcvChs) {
-		rpc.c.rcvChs[msg.Id] <- &msg
-	} else {
-		log.Printf("Cluster.Message() (via RPC): unknown msg Id: %d, dropping message.", msg.Id)
+	srv := rpc.c.rpcSrv
+	if err := srv.beginCall(); err != nil {
+		return err
 	}
+	defer srv.endCall()
 
 	//*reply = Msg{Id: 495, Body: []byte("HELLO")}
+	return rpc.c.deliver(&msg)
+}
+
+// deliver passes a message received via RPC to the channel of its
+// type. Must be called between rpcSrv.beginCall() and endCall().
+func (c *Cluster) deliver(msg *Msg) error {
+	if msg.Id >= 0 && msg.Id < len(c.rcvChs) {
+		select {
+		case c.rcvChs[msg.Id] <- msg:
+		case <-c.rpcSrv.aborted():
+			return fmt.Errorf("cluster RPC server shut down before the message could be delivered")
+		}
+	} else {
+		log.Printf("Cluster.Message() (via RPC): unknown msg Id: %d, dropping message.", msg.Id)
+	}
 	return nil
 }
 
@@ -197,7 +459,7 @@ func (c *Cluster) readyNodes() ([]*Node, error) {
 	}
 	readyNodes := make([]*Node, 0, len(nodes))
 	for _, node := range nodes {
-		if node.Ready() {
+		if node.Ready() && !c.rpcHealth.isDown(node.Name()) {
 			readyNodes = append(readyNodes, node)
 		}
 	}
@@ -236,17 +498,34 @@ func (c *Cluster) LoadDistData(f func() ([]DistDatum, error)) error {
 		return err
 	}
 
+	epoch := c.Epoch() // before readyNodes, so that a change in between is seen as stale
 	readyNodes, err := c.readyNodes()
 	if err != nil {
 		return err
 	}
 
-	for _, dd := range dds {
-		key := fmt.Sprintf("%s:%d", dd.Type(), dd.Id())
-		c.dds[key] = &ddEntry{dd: dd, nodes: selectNodes(readyNodes, dd.Id(), c.copies)}
+	addDistData(c.dds, dds, filterNodes(readyNodes, c.place), c.LocalNode(), c.copies, epoch, c.pins)
+	return nil
+}
+
+// addDistData assigns nodes to the DistDatums and adds them to the
+// dds map. The caller must hold the lock protecting dds.
+func addDistData(dds map[string]*ddEntry, newDds []DistDatum, readyNodes []*Node, ln *Node, copies int, epoch uint64, pins map[string][]string) {
+	for _, dd := range newDds {
+		key := ddKey(dd)
+		dde := &ddEntry{dd: dd, nodes: assignNodes(readyNodes, dd, copies, pins), epoch: epoch}
+		if old := dds[key]; old != nil {
+			dde.token = old.token
+		}
+		if dde.token == 0 && dde.Node() != nil && dde.Node().Name() == ln.Name() {
+			dde.token = nextToken(0)
+		}
+		dds[key] = dde
 	}
+}
 
-	return nil
+func ddKey(dd DistDatum) string {
+	return fmt.Sprintf("%s:%d", dd.Type(), dd.Id())
 }
 
 // Join joins a cluster given at least one node address/port. NB: You
@@ -266,6 +545,8 @@ func (c *Cluster) LocalNode() *Node {
 }
 
 func (c *Cluster) checkNodeCache(mNode *memberlist.Node) *Node {
+	c.nlock.Lock()
+	defer c.nlock.Unlock()
 	if c.ncache[mNode] == nil {
 		c.ncache[mNode] = &Node{Node: mNode}
 	}
@@ -282,7 +563,8 @@ func (c *Cluster) Members() []*Node {
 	return result
 }
 
-// SortedNodes returns nodes ordered by process start time
+// SortedNodes returns nodes ordered by process start time or node id
+// hash, see ClusterConfig.SortBy.
 func (c *Cluster) SortedNodes() ([]*Node, error) {
 	ms := c.Members()
 	sn := sortableNodes{ms, make([]string, len(ms))}
@@ -320,8 +602,8 @@ func (sn sortableNodes) Swap(i, j int) {
 // structure. The nodes of the cluster must call RegisterMsgType in
 // exact same order because that is what determines the internal
 // message id and the channel to which it will be passed. The message
-// is sent to the destination specified in Msg.Dst. Messages are
-// compressed using flate.
+// is sent to the destination specified in Msg.Dst. Messages which
+// queue up in snd are sent together, see SendBatch().
 func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 
 	snd, rcv = make(chan *Msg, 128), make(chan *Msg, 128)
@@ -331,61 +613,197 @@ func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 
 	go func(id int) {
 		for {
-			msg := <-snd
-
-			if msg.Dst == nil {
-				log.Printf("Cluster: cannot send message when Dst is not set, ignoring.")
-				continue
+			var msg *Msg
+			select {
+			case msg = <-snd:
+			case <-c.stop:
+				return
 			}
 
-			if msg.Dst.rpc == nil {
-				addr := fmt.Sprintf("%s:%d", msg.Dst.Addr, c.rpcPort)
-				log.Printf("Cluster: establishing RPC connection to node %s via %s", msg.Dst.Name(), addr)
-				conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-				if err != nil {
-					log.Printf("Cluster: cannot establish connection to %s: %v, dropping this message.", addr, err)
-					continue
+			// pipeline whatever else is already queued
+			batch := []*Msg{msg}
+		drain:
+			for len(batch) < maxBatchMsgs {
+				select {
+				case msg = <-snd:
+					batch = append(batch, msg)
+				default:
+					break drain
 				}
-				msg.Dst.rpc = rpc.NewClient(conn)
 			}
-
-			msg.Src = c.LocalNode()
-			msg.Id = id
-
-			var resp Msg
-			if err := msg.Dst.rpc.Call("ClusterRPC.Message", msg, &resp); err != nil {
-				log.Printf("Cluster: error sending message to %s", msg.Dst.Name())
-				msg.Dst.rpc = nil
+			for _, msg := range batch {
+				msg.Id = id
 			}
+			c.sendQueued(batch)
 		}
 	}(id)
 
 	return snd, rcv
 }
 
-// NotifyClusterChanges returns a bool channel which will be sent true
-// any time a cluster change happens (nodes join or leave, or node
-// metadata changes).
-func (c *Cluster) NotifyClusterChanges() chan bool {
-	ch := make(chan bool, 1)
-	c.chgNotify = append(c.chgNotify, ch)
-	return ch
+// rpcClient returns the RPC client connected to the node, connecting
+// if there isn't one.
+func (c *Cluster) rpcClient(n *Node) (*rpc.Client, error) {
+	c.nlock.Lock()
+	client := n.rpc
+	c.nlock.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	addr := n.rpcAddr(c.rpcPort)
+	log.Printf("Cluster: establishing RPC connection to node %s via %s", n.Name(), addr)
+	conn, err := c.dial("tcp", addr, 3*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cannot establish connection to %s: %v", addr, err)
+	}
+	if rc, ok := c.codec.(RPCCodec); ok {
+		client = rpc.NewClientWithCodec(rc.ClientCodec(conn))
+	} else {
+		client = rpc.NewClient(conn)
+	}
+
+	c.nlock.Lock()
+	defer c.nlock.Unlock()
+	if n.rpc != nil { // another sender got there first
+		client.Close()
+		return n.rpc, nil
+	}
+	n.rpc = client
+	return client, nil
+}
+
+// dropRPCClient closes the client (e.g. after an error), the next
+// message to the node will establish a new connection.
+func (c *Cluster) dropRPCClient(n *Node, client *rpc.Client) {
+	c.nlock.Lock()
+	if n.rpc == client {
+		n.rpc = nil
+	}
+	c.nlock.Unlock()
+	client.Close()
+}
+
+// evictNodes removes the matching nodes from the node cache and
+// closes their RPC connections, if any. This is done to the nodes
+// which leave the cluster, should one rejoin, it will be cached (and
+// connected to) again as needed.
+func (c *Cluster) evictNodes(match func(*memberlist.Node) bool) {
+	var clients []*rpc.Client
+	c.nlock.Lock()
+	for mNode, n := range c.ncache {
+		if match(mNode) {
+			if n.rpc != nil {
+				clients = append(clients, n.rpc)
+				n.rpc = nil
+			}
+			delete(c.ncache, mNode)
+		}
+	}
+	c.nlock.Unlock()
+	for _, client := range clients {
+		client.Close()
+	}
 }
 
-// This is what we store in Node metadata
+// NodeCacheSize returns the number of nodes in the node cache and how
+// many of them have an RPC connection. Nodes are cached as they are
+// encountered and evicted when they leave the cluster.
+func (c *Cluster) NodeCacheSize() (nodes, conns int) {
+	c.nlock.Lock()
+	defer c.nlock.Unlock()
+	for _, n := range c.ncache {
+		if n.rpc != nil {
+			conns++
+		}
+	}
+	return len(c.ncache), conns
+}
+
+// ProtocolVersion is the version of the protocol (including the
+// metadata layout) spoken by this node. MinProtocolVersion is the
+// oldest version this node is compatible with. Nodes whose version
+// ranges do not overlap refuse to see each other as peers.
+//
+// Version history:
+//
+//	0 - unversioned metadata (ready, sortBy and user part only)
+//	1 - versioned metadata
+//	2 - fencing tokens in relinquish messages
+//	3 - node tags in metadata
+//	4 - batched messages (ClusterRPC.Batch)
+//	5 - batched relinquish messages
+//	6 - metadata flags, compressed user metadata
+const (
+	ProtocolVersion    = 6
+	MinProtocolVersion = 0
+)
+
+// This is what we store in Node metadata. The layout is:
+//
+//	[0]      ready (1 or 0)
+//	[1:11]   sortBy (varint)
+//	[11]     protocol version
+//	[12]     min compatible protocol version
+//	[13:15]  header length (big endian uint16), i.e. where the user part starts
+//	[15:17]  rpc port (big endian uint16)
+//	[17]     length of rpc address (0 means use the gossip address)
+//	[18:...] rpc address
+//	[..+2]   length of tags (big endian uint16), since version 3
+//	[...]    tags, sorted by key, each being a uvarint length
+//	         prefixed key followed by a uvarint length prefixed value
+//	[..+1]   flags (mdFlag*), since version 6
+//	         (fields added in later protocol versions go here)
+//	[hdr:]   user part, flate compressed if mdFlagCompressed is set
+//
+// Nodes skip over fields they do not know about using the header
+// length, which is how a newer node can add metadata without
+// breaking older ones during a rolling upgrade. A header length of
+// 0 means the header ends right after the rpc address.
+//
+// Version 0 metadata has no header, the user part starts at [11].
+// It is recognized by its length or a zero version byte, or, if the
+// user part happens to look like a header, by the header not
+// parsing.
 type nodeMeta struct {
-	ready  bool
-	sortBy int64
-	user   []byte
+	ready      bool
+	sortBy     int64
+	version    int
+	minVersion int
+	rpcAddr    string
+	rpcPort    int
+	tags       map[string]string
+	user       []byte // always uncompressed
+	compress   bool   // compress user in bytes(), if it helps
 }
 
-const minMdLen = 1 + binary.MaxVarintLen64
+const (
+	mdVersionOff    = 1 + binary.MaxVarintLen64
+	mdMinVersionOff = mdVersionOff + 1
+	mdHdrLenOff     = mdMinVersionOff + 1
+	mdRPCPortOff    = mdHdrLenOff + 2
+	mdRPCAddrOff    = mdRPCPortOff + 2
+	minMdLen        = mdRPCAddrOff + 1
+	legacyMdLen     = mdVersionOff // version 0
+)
 
 func (c *Cluster) extractMeta() (*nodeMeta, error) {
 	return c.LocalNode().extractMeta()
 }
 
-func (c *Cluster) saveMeta(md *nodeMeta) {
+// saveMeta stores the metadata to be gossiped, unless it is too
+// large, in which case a *MetaSizeError is returned.
+func (c *Cluster) saveMeta(md *nodeMeta) error {
+	md.compress = c.compress
+	meta := md.bytes()
+	if err := checkMetaSize(meta); err != nil {
+		return err
+	}
+	c.meta = meta
+	return nil
+}
+
+func (md *nodeMeta) bytes() []byte {
 	meta := make([]byte, minMdLen)
 	if md.ready {
 		meta[0] = 1
@@ -393,8 +811,25 @@ func (c *Cluster) saveMeta(md *nodeMeta) {
 		meta[0] = 0
 	}
 	binary.PutVarint(meta[1:], md.sortBy)
-	meta = append(meta, md.user...)
-	c.meta = meta
+	meta[mdVersionOff] = ProtocolVersion
+	meta[mdMinVersionOff] = MinProtocolVersion
+	binary.BigEndian.PutUint16(meta[mdRPCPortOff:], uint16(md.rpcPort))
+	meta[mdRPCAddrOff] = byte(len(md.rpcAddr))
+	meta = append(meta, md.rpcAddr...)
+	tags := encodeTags(md.tags)
+	meta = append(meta, 0, 0)
+	binary.BigEndian.PutUint16(meta[len(meta)-2:], uint16(len(tags)))
+	meta = append(meta, tags...)
+	user, flags := md.user, byte(0)
+	if md.compress {
+		if b := compressMeta(md.user); b != nil {
+			user, flags = b, flags|mdFlagCompressed
+		}
+	}
+	meta = append(meta, flags)
+	binary.BigEndian.PutUint16(meta[mdHdrLenOff:], uint16(len(meta)))
+	meta = append(meta, user...)
+	return meta
 }
 
 // Meta() will return the user part of the node metadata. (Cluster
@@ -419,7 +854,8 @@ func (n *Node) Name() string {
 }
 
 // Sets the metadata and broadcasts an UpdateNode message to the
-// cluster.
+// cluster. If the metadata does not fit (see UserMetaBudget()), a
+// *MetaSizeError is returned and the metadata is left as it was.
 func (c *Cluster) SetMetaData(b []byte) error {
 	// To set it, we must first get it.
 	md, err := c.LocalNode().extractMeta()
@@ -427,7 +863,9 @@ func (c *Cluster) SetMetaData(b []byte) error {
 		return err
 	}
 	md.user = b
-	c.saveMeta(md)
+	if err = c.saveMeta(md); err != nil {
+		return err
+	}
 	if err = c.UpdateNode(updateNodeTO); err != nil {
 		log.Printf("Cluster.SetMetaData(): UpdateNode() failed: %v", err)
 	}
@@ -447,7 +885,9 @@ func (c *Cluster) NotifyMsg(b []byte) {
 		log.Printf("NotifyMsg(): error decoding: %#v", err)
 	}
 
-	if m.Id < len(c.rcvChs) {
+	if m.Id == broadcastMsgId {
+		deliverBroadcast(c.bcastCh, m)
+	} else if m.Id >= 0 && m.Id < len(c.rcvChs) {
 		c.rcvChs[m.Id] <- m
 	} else {
 		log.Printf("NotifyMsg(): unknown msg Id: %d, dropping message", m.Id)
@@ -455,31 +895,70 @@ func (c *Cluster) NotifyMsg(b []byte) {
 }
 
 func (c *Cluster) GetBroadcasts(overhead, limit int) [][]byte {
-	return nil
+	return c.bcastQ.GetBroadcasts(overhead, limit)
 }
 
 func (c *Cluster) LocalState(join bool) []byte            { return []byte{} }
 func (c *Cluster) MergeRemoteState(buf []byte, join bool) {}
 
+// END memberlist.Delegate interface
+
+// BEGIN memberlist.AliveDelegate interface
+
+// NotifyAlive is the protocol negotiation: a node whose version range
+// does not overlap with ours is not considered a peer. Nodes whose
+// metadata cannot be parsed (e.g. it has not been set yet) are let
+// through.
+func (c *Cluster) NotifyAlive(peer *memberlist.Node) error {
+	md, err := (&Node{Node: peer}).extractMeta()
+	if err != nil {
+		return nil
+	}
+	return checkProtocolVersion(md.version, md.minVersion)
+}
+
+// END memberlist.AliveDelegate interface
+
+// BEGIN memberlist.EventDelegate interface
+
 func (c *Cluster) NotifyJoin(n *memberlist.Node) {
+	c.publish(EventNodeJoin, n, nil)
 	c.notifyAll()
 }
 func (c *Cluster) NotifyLeave(n *memberlist.Node) {
+	c.evictNodes(func(mNode *memberlist.Node) bool { return mNode.Name == n.Name })
+	c.publish(EventNodeLeave, n, nil)
 	c.notifyAll()
 }
 func (c *Cluster) NotifyUpdate(n *memberlist.Node) {
+	c.publish(EventNodeUpdate, n, nil)
 	c.notifyAll()
 }
 
-// END memberlist.Delegate interface
+// END memberlist.EventDelegate interface
 
-func (c *Cluster) notifyAll() {
-	defer func() { recover() }() // in case ch is now closed
-	for _, ch := range c.chgNotify {
-		if len(ch) < cap(ch) {
-			ch <- true
+func checkProtocolVersion(version, minVersion int) error {
+	if version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is older than our minimum %d", version, MinProtocolVersion)
+	}
+	if minVersion > ProtocolVersion {
+		return fmt.Errorf("protocol version %d requires at least %d, we are %d", version, minVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// ProtocolVersion returns the protocol version negotiated by the
+// cluster, which is the lowest version spoken by any member. Features
+// of newer versions should only be used once every member speaks
+// them, i.e. once a rolling upgrade is complete.
+func (c *Cluster) ProtocolVersion() int {
+	version := ProtocolVersion
+	for _, n := range c.Members() {
+		if md, err := n.extractMeta(); err == nil && md.version < version {
+			version = md.version
 		}
 	}
+	return version
 }
 
 type Node struct {
@@ -496,6 +975,31 @@ func (n *Node) SanitizedAddr() string {
 }
 
 func (n *Node) extractMeta() (*nodeMeta, error) {
+	meta := n.Node.Meta
+	if len(meta) >= legacyMdLen && (len(meta) < minMdLen || meta[mdVersionOff] == 0) {
+		return extractLegacyMeta(meta)
+	}
+	md, err := n.extractVersionedMeta()
+	if err != nil && len(meta) >= legacyMdLen {
+		if lmd, lerr := extractLegacyMeta(meta); lerr == nil {
+			return lmd, nil
+		}
+	}
+	return md, err
+}
+
+// extractLegacyMeta parses version 0 metadata.
+func extractLegacyMeta(meta []byte) (*nodeMeta, error) {
+	md := &nodeMeta{ready: meta[0] == 1}
+	var err error
+	if md.sortBy, err = binary.ReadVarint(bytes.NewReader(meta[1:legacyMdLen])); err != nil {
+		return nil, fmt.Errorf("extractMeta(): sortBy: %v", err)
+	}
+	md.user = meta[legacyMdLen:]
+	return md, nil
+}
+
+func (n *Node) extractVersionedMeta() (*nodeMeta, error) {
 	md := &nodeMeta{}
 	if len(n.Node.Meta) < minMdLen {
 		return nil, fmt.Errorf("Not enough bytes to extract metadata")
@@ -507,11 +1011,80 @@ func (n *Node) extractMeta() (*nodeMeta, error) {
 	if md.sortBy, err = binary.ReadVarint(bytes.NewReader(n.Node.Meta[1:])); err != nil {
 		return nil, fmt.Errorf("extractMeta(): sortBy: %v", err)
 	}
+	// versions
+	md.version = int(n.Node.Meta[mdVersionOff])
+	md.minVersion = int(n.Node.Meta[mdMinVersionOff])
+	// rpc port and address
+	md.rpcPort = int(binary.BigEndian.Uint16(n.Node.Meta[mdRPCPortOff:]))
+	addrEnd := minMdLen + int(n.Node.Meta[mdRPCAddrOff])
+	if len(n.Node.Meta) < addrEnd {
+		return nil, fmt.Errorf("extractMeta(): Not enough bytes for rpc address")
+	}
+	md.rpcAddr = string(n.Node.Meta[minMdLen:addrEnd])
+	// skip fields from newer versions, if any
+	userOff := int(binary.BigEndian.Uint16(n.Node.Meta[mdHdrLenOff:]))
+	if userOff == 0 {
+		userOff = addrEnd
+	} else if userOff < addrEnd || userOff > len(n.Node.Meta) {
+		return nil, fmt.Errorf("extractMeta(): Invalid header length: %d", userOff)
+	}
+	// tags
+	var flags byte
+	if md.version >= 3 {
+		if userOff < addrEnd+2 {
+			return nil, fmt.Errorf("extractMeta(): Not enough bytes for tags length")
+		}
+		tagsEnd := addrEnd + 2 + int(binary.BigEndian.Uint16(n.Node.Meta[addrEnd:]))
+		if tagsEnd > userOff {
+			return nil, fmt.Errorf("extractMeta(): Not enough bytes for tags")
+		}
+		if md.tags, err = decodeTags(n.Node.Meta[addrEnd+2 : tagsEnd]); err != nil {
+			return nil, fmt.Errorf("extractMeta(): tags: %v", err)
+		}
+		// flags
+		if md.version >= 6 {
+			if tagsEnd >= userOff {
+				return nil, fmt.Errorf("extractMeta(): Not enough bytes for flags")
+			}
+			flags = n.Node.Meta[tagsEnd]
+		}
+	}
 	// user
-	md.user = n.Node.Meta[minMdLen:]
+	md.user = n.Node.Meta[userOff:]
+	if flags&mdFlagCompressed != 0 {
+		if md.user, err = decompressMeta(md.user); err != nil {
+			return nil, fmt.Errorf("extractMeta(): user: %v", err)
+		}
+	}
 	return md, nil
 }
 
+// ProtocolVersion returns the protocol version the node speaks, or 0
+// if it is not known (yet) or the node predates versioned metadata.
+func (n *Node) ProtocolVersion() int {
+	md, err := n.extractMeta()
+	if err != nil {
+		return 0
+	}
+	return md.version
+}
+
+// rpcAddr returns the address to which RPC connections to this node
+// should be made. Nodes that do not advertise an RPC port are assumed
+// to listen on dftPort.
+func (n *Node) rpcAddr(dftPort int) string {
+	host, port := n.Addr.String(), dftPort
+	if md, err := n.extractMeta(); err == nil {
+		if md.rpcAddr != "" {
+			host = md.rpcAddr
+		}
+		if md.rpcPort != 0 {
+			port = md.rpcPort
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // Ready sets the Node status in the metadata and broadcasts a change
 // notification to the cluster.
 func (c *Cluster) Ready(status bool) error {
@@ -520,7 +1093,9 @@ func (c *Cluster) Ready(status bool) error {
 		return err
 	}
 	md.ready = status
-	c.saveMeta(md)
+	if err = c.saveMeta(md); err != nil {
+		return err
+	}
 	if err = c.UpdateNode(updateNodeTO); err != nil {
 		log.Printf("Ready(): UpdateNode() failed: %v", err)
 		return err
@@ -528,9 +1103,25 @@ func (c *Cluster) Ready(status bool) error {
 	return nil
 }
 
+// Shutdown stops the RPC server (allowing in-flight calls some time
+// to complete) and the message senders, then shuts down memberlist.
+// Once Shutdown returns, the RPC address is free to be bound again,
+// e.g. by a new process after a graceful restart.
 func (c *Cluster) Shutdown() error {
-	//c.rpc.Close() // seems like Closing it only causes errors
-	return c.Memberlist.Shutdown()
+	var err error
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		if c.rpcSrv != nil {
+			if err = c.rpcSrv.shutdown(rpcDrainTimeout); err != nil {
+				log.Printf("Cluster.Shutdown(): error closing RPC listener: %v", err)
+			}
+		}
+		c.evictNodes(func(*memberlist.Node) bool { return true })
+	})
+	if mErr := c.Memberlist.Shutdown(); mErr != nil {
+		return mErr
+	}
+	return err
 }
 
 // Ready returns the status of a node.
@@ -548,16 +1139,29 @@ type Msg struct {
 	Id       int
 	Dst, Src *Node
 	Body     []byte
+	Codec    string // name of the Codec of Body, blank means gob
+
+	queuedAt time.Time // when first queued for an offline node
 }
 
 // NewMsg creates a Msg from a payload which is gob-encodable
 func NewMsg(dest *Node, payload interface{}) (*Msg, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(payload); err != nil {
+	return NewMsgWithCodec(dest, payload, GobCodec)
+}
+
+// NewMsgWithCodec creates a Msg from a payload using the given codec.
+func NewMsgWithCodec(dest *Node, payload interface{}, codec Codec) (*Msg, error) {
+	body, err := codec.Marshal(payload)
+	if err != nil {
 		return nil, err
 	}
-	return &Msg{Dst: dest, Body: buf.Bytes()}, nil
+	return &Msg{Dst: dest, Body: body, Codec: codec.Name()}, nil
+}
+
+// NewMsg creates a Msg from a payload using the codec of the cluster
+// (see ClusterConfig.Codec).
+func (c *Cluster) NewMsg(dest *Node, payload interface{}) (*Msg, error) {
+	return NewMsgWithCodec(dest, payload, c.codec)
 }
 
 // represent out message as bytes
@@ -573,9 +1177,15 @@ func (m *Msg) bytes() []byte {
 	return buf.Bytes()
 }
 
-// implement gob.GobDecoder interface.
+// Decode the body of the message into dst using the codec it was
+// encoded with.
 func (m *Msg) Decode(dst interface{}) error {
-	if err := gob.NewDecoder(bytes.NewBuffer(m.Body)).Decode(dst); err != nil {
+	codec, err := codecByName(m.Codec)
+	if err != nil {
+		log.Printf("Msg.Decode() decoding error: %v", err)
+		return err
+	}
+	if err := codec.Unmarshal(m.Body, dst); err != nil {
 		log.Printf("Msg.Decode() decoding error: %v", err)
 		return err
 	}
@@ -635,12 +1245,58 @@ type DistDatum interface {
 func (c *Cluster) NodesForDistDatum(dd DistDatum) []*Node {
 	c.RLock()
 	defer c.RUnlock()
-	if dde, ok := c.dds[fmt.Sprintf("%s:%d", dd.Type(), dd.Id())]; ok {
+	if dde, ok := c.dds[ddKey(dd)]; ok {
 		return dde.nodes
 	}
 	return nil
 }
 
+// NodesForDistDatumChecked is like NodesForDistDatum, but also
+// returns whether the assignment is stale, i.e. the cluster has
+// changed since it was computed and Transition() has not been run
+// yet. The nodes of a stale assignment may no longer be members, so
+// rather than forwarding data to them, the application may want to
+// hold on to it until after the Transition().
+func (c *Cluster) NodesForDistDatumChecked(dd DistDatum) (nodes []*Node, stale bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if dde, ok := c.dds[ddKey(dd)]; ok {
+		return dde.nodes, dde.epoch != c.Epoch()
+	}
+	return nil, false
+}
+
+// parseRelinquishMsg splits a relinquish message body of the form
+// "Type:Id[:token]" into the DistDatum key and the fencing token of
+// the previous owner (0 if it was not sent).
+func parseRelinquishMsg(body []byte) (key string, token uint64) {
+	parts := strings.SplitN(string(body), ":", 3)
+	if len(parts) < 3 {
+		return string(body), 0
+	}
+	token, _ = strconv.ParseUint(parts[2], 10, 64)
+	return parts[0] + ":" + parts[1], token
+}
+
+// FencingToken returns the fencing token for the DistDatum, or 0 if
+// this node is not its owner. The token changes every time the
+// ownership of the DistDatum changes and is always greater than the
+// token of any previous owner (tokens are derived from the wall clock
+// when the previous token is not known, so this assumes reasonably
+// synchronized clocks). Applications should include the token in
+// writes to shared storage and have the storage reject writes with a
+// token lower than the highest seen, so that an ex-owner which was
+// paused (e.g. by GC) through a transition cannot overwrite the data
+// written by the new owner.
+func (c *Cluster) FencingToken(dd DistDatum) uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	if dde, ok := c.dds[ddKey(dd)]; ok {
+		return dde.token
+	}
+	return 0
+}
+
 func (c *Cluster) List() map[string]*ddEntry {
 	return c.dds
 }
@@ -663,28 +1319,54 @@ func (dde *ddEntry) DD() DistDatum {
 // all DistDatums that are transferring to other nodes and wait for
 // confirmation of Relinquish() from other nodes for DistDatums
 // transferring to this node. Generally a node should be buffering all
-// the data it receives during a transition.
-func (c *Cluster) Transition(timeout time.Duration) error {
+// the data it receives during a transition. Subscribers (see
+// Subscribe()) receive an event when the transition starts and ends,
+// see also OnBeforeTransition() and OnAfterTransition().
+func (c *Cluster) Transition(timeout time.Duration) (err error) {
+	ln := c.LocalNode()
+	c.publish(EventTransitionStart, ln.Node, nil)
+	c.RLock()
+	types := ddTypes(c.dds)
+	c.RUnlock()
+	c.runBefore(types)
 	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("WARNING: Transition panic!")
-		}
+		c.runAfter(types, err)
+		c.publish(EventTransitionEnd, ln.Node, err)
 	}()
-	var wg sync.WaitGroup
 
 	c.Lock()
 	defer c.Unlock()
 	log.Printf("Transition(): Starting...")
 
+	epoch := c.Epoch()
 	readyNodes, err := c.readyNodes()
 	if err != nil {
 		return err
 	}
 
+	// Only send fencing tokens if every node understands them
+	withToken := c.ProtocolVersion() >= 2
+
+	return transition(c.dds, filterNodes(readyNodes, c.place), ln, c.copies, withToken, epoch, c.snd, c.rcv, timeout, &c.unsafe, &c.acquire, c.pins)
+}
+
+// transition is the guts of Transition(), separated from Cluster so
+// that FakeCluster can share it. The caller must hold the lock
+// protecting dds.
+func transition(dds map[string]*ddEntry, readyNodes []*Node, ln *Node, copies int, withToken bool, epoch uint64, snd, rcv chan *Msg, timeout time.Duration, um *unsafeMoves, acq *acquirer, pins map[string][]string) error {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("WARNING: Transition panic!")
+		}
+	}()
+	var wg sync.WaitGroup
+
 	var waitDdsLock sync.RWMutex
 	waitDds := make(map[string]DistDatum)
 
-	for _, dde := range c.dds {
+	rb := newRelinquishBatcher(snd)
+
+	for _, dde := range dds {
 		wg.Add(1)
 		go func(dde *ddEntry) {
 			defer wg.Done()
@@ -693,7 +1375,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			// "lead" responsible for saving the data. What happens
 			// with the rest is up to the userland to deal with.
 			var newNode, oldNode *Node
-			newNodes := selectNodes(readyNodes, dde.dd.Id(), c.copies)
+			newNodes := assignNodes(readyNodes, dde.dd, copies, pins)
 			if len(newNodes) > 0 {
 				newNode = newNodes[0]
 			}
@@ -701,7 +1383,6 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 				oldNode = dde.nodes[0]
 			}
 			if newNode == nil || oldNode.Name() != newNode.Name() {
-				ln := c.LocalNode()
 				if ln.Name() == oldNode.Name() { // we are the ex-node
 					if newNode != nil && debug {
 						log.Printf("Transition(): Id %s:%d (%s) is moving away to node %s", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), newNode.Name())
@@ -709,16 +1390,28 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 					if debug {
 						log.Printf("Transition(): Calling Relinquish for %s:%d (%s).", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName())
 					}
-					if err = dde.dd.Relinquish(); err != nil {
+					stuck, err := relinquish(dde.dd, relinquishTimeout)
+					if stuck {
+						// Better to move it than to stall the transition forever.
+						log.Printf("Transition(): WARNING: Relinquish() for id %s:%d (%s) did not return within %v, moving it anyway (unsafely).", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), relinquishTimeout)
+						um.add(ddKey(dde.dd), time.Now())
+					}
+					if err != nil {
 						log.Printf("Transition(): Warning: Relinquish() failed for id %s:%d (%s) with: %v", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), err)
 					} else if newNode != nil {
 						// Notify the new node expecting this dd of Relinquish completion
 						body := []byte(fmt.Sprintf("%s:%d", dde.dd.Type(), dde.dd.Id()))
-						m := &Msg{Dst: newNode, Body: body}
-						log.Printf("Transition(): Sending relinquish of id %s:%d to node %s", dde.dd.Type(), dde.dd.Id(), newNode.Name())
-						c.snd <- m
+						if withToken {
+							body = append(body, fmt.Sprintf(":%d", dde.token)...)
+						}
+						if debug {
+							log.Printf("Transition(): Sending relinquish of id %s:%d to node %s", dde.dd.Type(), dde.dd.Id(), newNode.Name())
+						}
+						rb.add(newNode, body)
 					}
+					dde.token = 0 // we no longer own it
 				} else if oldNode != nil && newNode != nil && ln.Name() == newNode.Name() { // we are the new node
+					dde.token = nextToken(dde.token)
 					if debug {
 						log.Printf("Transition(): Id %s:%d (%s) is moving to this node from node %s", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), oldNode.Name())
 					}
@@ -730,14 +1423,20 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 					waitDdsLock.Unlock()
 				}
 			}
+			if dde.token == 0 && newNode != nil && newNode.Name() == ln.Name() {
+				dde.token = nextToken(0) // we own it, e.g. it had no previous owner
+			}
 			dde.nodes = newNodes // Assign the correct nodes in the end
+			dde.epoch = epoch
 		}(dde)
 	}
 
 	// Wait for this phase to finish
 	wg.Wait()
+	rb.flush()
 
-	// Now wait on the reqinquishes
+	// Now wait on the reqinquishes, acquiring as they arrive
+	acq.begin(len(waitDds))
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -757,31 +1456,33 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 
 			var m *Msg
 			select {
-			case m = <-c.rcv:
+			case m = <-rcv:
 			case <-tmout:
 				log.Printf("Transition(): WARNING: Relinquish wait timeout! Continuing. Some data is likely lost.")
 				// We should still call Acquire on the ones we've been waiting for as we are ultimately taking them over
 				for _, dd := range waitDds {
-					log.Printf("Transition(): Calling Acquire for %s:%d (%s).", dd.Type(), dd.Id(), dd.GetName())
-					if err := dd.Acquire(); err != nil {
-						log.Printf("Transition(): Warning: Acquire() failed for id %s:%d (%s) with: %v", dd.Type(), dd.Id(), dd.GetName(), err)
-					}
+					acq.acquire(dd)
 				}
 				return
 			}
 
-			key := string(m.Body)
-			log.Printf("Transition(): Got relinquish message for %s from %s.", key, m.Src.Name())
-			if waitDds[key] != nil {
-				dd := waitDds[key]
-				log.Printf("Transition(): Calling Acquire for %s:%d (%s).", dd.Type(), dd.Id(), dd.GetName())
-				if err := dd.Acquire(); err != nil {
-					log.Printf("Transition(): Warning: Acquire() failed for id %s:%d (%s) with: %v", dd.Type(), dd.Id(), dd.GetName(), err)
+			entries := splitRelinquishMsg(m.Body)
+			log.Printf("Transition(): Got %d relinquish(es) from %s.", len(entries), m.Src.Name())
+			for _, entry := range entries {
+				key, token := parseRelinquishMsg(entry)
+				if debug {
+					log.Printf("Transition(): Got relinquish message for %s from %s.", key, m.Src.Name())
+				}
+				if dde := dds[key]; dde != nil && token != 0 && dde.token <= token {
+					dde.token = nextToken(token)
+				}
+				if dd := waitDds[key]; dd != nil {
+					acq.acquire(dd)
 				}
+				waitDdsLock.Lock()
+				delete(waitDds, key)
+				waitDdsLock.Unlock()
 			}
-			waitDdsLock.Lock()
-			delete(waitDds, key)
-			waitDdsLock.Unlock()
 			if len(waitDds) > 0 {
 				log.Printf("Transition(): Still waiting on %d relinquish messages: %v", len(waitDds), waitDds)
 			}
@@ -790,6 +1491,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 	}()
 
 	wg.Wait()
+	acq.finish()
 	log.Printf("Transition(): Complete!")
 	return nil
 }
@@ -1,9 +1,27 @@
 package cluster
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"testing"
 	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/hashicorp/memberlist"
 )
 
 // This example joins a sole node cluster, and shows how to watch
@@ -48,3 +66,1546 @@ func ExampleCluster_output() {
 
 	// Output: A cluster change occurred, running a transition.
 }
+
+func TestClusterConfig_memberlistConfig(t *testing.T) {
+	cfg := DefaultLANClusterConfig().memberlistConfig()
+	if cfg.TCPTimeout != 30*time.Second || cfg.SuspicionMult != 6 || cfg.PushPullInterval != 15*time.Second {
+		t.Errorf("LAN config: unexpected tunables: %v %v %v", cfg.TCPTimeout, cfg.SuspicionMult, cfg.PushPullInterval)
+	}
+
+	wan := memberlist.DefaultWANConfig()
+	cfg = DefaultWANClusterConfig().memberlistConfig()
+	if cfg.TCPTimeout != wan.TCPTimeout || cfg.ProbeInterval != wan.ProbeInterval {
+		t.Errorf("WAN config: expected memberlist WAN defaults, got %v %v", cfg.TCPTimeout, cfg.ProbeInterval)
+	}
+
+	cc := DefaultWANClusterConfig()
+	cc.ProbeTimeout = 7 * time.Second
+	cc.Name = "foo"
+	cfg = cc.memberlistConfig()
+	if cfg.ProbeTimeout != 7*time.Second || cfg.Name != "foo" {
+		t.Errorf("WAN config: overrides not applied: %v %q", cfg.ProbeTimeout, cfg.Name)
+	}
+	if cfg.Transport != nil {
+		t.Errorf("Transport: expected nil (default) transport")
+	}
+
+	tr := &memberlist.MockTransport{}
+	cc.Transport = tr
+	if cfg = cc.memberlistConfig(); cfg.Transport != tr {
+		t.Errorf("Transport: custom transport not applied")
+	}
+}
+
+func TestNode_rpcAddr(t *testing.T) {
+	c := &Cluster{}
+	c.saveMeta(&nodeMeta{ready: true, sortBy: 42, user: []byte("hello")})
+	n := &Node{Node: &memberlist.Node{Meta: c.meta, Addr: net.ParseIP("10.0.0.1")}}
+	if addr := n.rpcAddr(12354); addr != "10.0.0.1:12354" {
+		t.Errorf("rpcAddr: expected default port, got %q", addr)
+	}
+
+	c.saveMeta(&nodeMeta{ready: true, sortBy: 42, rpcAddr: "192.168.1.1", rpcPort: 5555, user: []byte("hello")})
+	n.Node.Meta = c.meta
+	if addr := n.rpcAddr(12354); addr != "192.168.1.1:5555" {
+		t.Errorf("rpcAddr: expected advertised addr/port, got %q", addr)
+	}
+	md, err := n.extractMeta()
+	if err != nil || !md.ready || md.sortBy != 42 || string(md.user) != "hello" {
+		t.Errorf("extractMeta: unexpected result: %#v, %v", md, err)
+	}
+}
+
+func TestCluster_Subscribe(t *testing.T) {
+	c := &Cluster{}
+	ch := c.Subscribe()
+	n := &memberlist.Node{Name: "foo", Addr: net.ParseIP("10.0.0.1"), Port: 7946}
+
+	c.NotifyJoin(n)
+	c.NotifyLeave(n)
+	e := <-ch
+	if e.Type != EventNodeJoin || e.NodeName != "foo" || e.NodePort != 7946 || e.Time.IsZero() {
+		t.Errorf("Subscribe: unexpected join event: %v", e)
+	}
+	if e = <-ch; e.Type != EventNodeLeave {
+		t.Errorf("Subscribe: expected leave event, got %v", e.Type)
+	}
+
+	// a full channel must not block
+	for i := 0; i < eventChanSize+1; i++ {
+		c.NotifyUpdate(n)
+	}
+	if len(ch) != eventChanSize {
+		t.Errorf("Subscribe: expected %d buffered events, got %d", eventChanSize, len(ch))
+	}
+}
+
+func TestNode_ProtocolVersion(t *testing.T) {
+	c := &Cluster{}
+	c.saveMeta(&nodeMeta{ready: true, sortBy: 42, rpcAddr: "10.0.0.2", user: []byte("hello")})
+	n := &Node{Node: &memberlist.Node{Meta: c.meta}}
+	if v := n.ProtocolVersion(); v != ProtocolVersion {
+		t.Errorf("ProtocolVersion: expected %d, got %d", ProtocolVersion, v)
+	}
+	if err := c.NotifyAlive(n.Node); err != nil {
+		t.Errorf("NotifyAlive: unexpected error: %v", err)
+	}
+
+	// A newer node with an extra field in the header (after the
+	// empty tags and the flags)
+	meta := append([]byte{}, c.meta[:minMdLen+8+2+1]...)
+	meta[mdVersionOff] = ProtocolVersion + 1
+	meta = append(meta, "extra"...)
+	binary.BigEndian.PutUint16(meta[mdHdrLenOff:], uint16(len(meta)))
+	meta = append(meta, "hello"...)
+	n.Node.Meta = meta
+	md, err := n.extractMeta()
+	if err != nil || md.rpcAddr != "10.0.0.2" || string(md.user) != "hello" {
+		t.Errorf("extractMeta: unknown fields not skipped: %#v, %v", md, err)
+	}
+	if err := c.NotifyAlive(n.Node); err != nil {
+		t.Errorf("NotifyAlive: a compatible newer node should be accepted: %v", err)
+	}
+
+	// A node that is no longer compatible with us
+	meta[mdMinVersionOff] = ProtocolVersion + 1
+	if err := c.NotifyAlive(n.Node); err == nil {
+		t.Errorf("NotifyAlive: an incompatible node should be rejected")
+	}
+}
+
+func TestNode_extractMeta_legacy(t *testing.T) {
+	// Encoded the way nodes before versioned metadata do it
+	legacy := func(ready bool, sortBy int64, user []byte) []byte {
+		meta := make([]byte, 1+binary.MaxVarintLen64)
+		if ready {
+			meta[0] = 1
+		}
+		binary.PutVarint(meta[1:], sortBy)
+		return append(meta, user...)
+	}
+
+	c := &Cluster{}
+	for _, user := range [][]byte{nil, []byte("hello"), {6, 1, 0xff, 0xff, 0, 0, 3, 'x'}} {
+		n := &Node{Node: &memberlist.Node{Meta: legacy(true, 42, user), Addr: net.ParseIP("10.0.0.1")}}
+		md, err := n.extractMeta()
+		if err != nil || !md.ready || md.sortBy != 42 || md.version != 0 || !bytes.Equal(md.user, user) {
+			t.Errorf("extractMeta: legacy metadata with user %q: %#v, %v", user, md, err)
+			continue
+		}
+		if err := c.NotifyAlive(n.Node); err != nil {
+			t.Errorf("NotifyAlive: a legacy node should be accepted: %v", err)
+		}
+		if v := n.ProtocolVersion(); v != 0 {
+			t.Errorf("ProtocolVersion: expected 0 for a legacy node, got %d", v)
+		}
+		if addr := n.rpcAddr(12354); addr != "10.0.0.1:12354" {
+			t.Errorf("rpcAddr: expected default port for a legacy node, got %q", addr)
+		}
+	}
+
+	// and legacy nodes can still read ready and sortBy from ours
+	c.saveMeta(&nodeMeta{ready: true, sortBy: 42, rpcPort: 5555})
+	if sortBy, err := binary.ReadVarint(bytes.NewReader(c.meta[1:])); c.meta[0] != 1 || sortBy != 42 || err != nil {
+		t.Errorf("bytes: legacy fields not where they were: %v", c.meta)
+	}
+
+	if _, err := (&Node{Node: &memberlist.Node{Meta: []byte{1, 2}}}).extractMeta(); err == nil {
+		t.Errorf("extractMeta: expected an error for short metadata")
+	}
+}
+
+func TestCluster_SetMetaData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := DefaultLANClusterConfig()
+	cc.Name = "a"
+	cc.Transport = (&memberlist.MockNetwork{}).NewTransport("a")
+	cc.RPCListener = ln
+	c, err := NewClusterWithConfig(cc)
+	if err != nil {
+		t.Fatalf("NewClusterWithConfig: %v", err)
+	}
+	defer c.Shutdown()
+
+	budget := c.UserMetaBudget()
+	if budget <= 0 || budget >= memberlist.MetaMaxSize {
+		t.Fatalf("UserMetaBudget: unexpected %d", budget)
+	}
+	if err := c.SetMetaData(make([]byte, budget)); err != nil {
+		t.Errorf("SetMetaData: %d bytes should fit: %v", budget, err)
+	}
+	big := bytes.Repeat([]byte("abcd"), budget)
+	err = c.SetMetaData(big)
+	if serr, ok := err.(*MetaSizeError); !ok || serr.Max != memberlist.MetaMaxSize {
+		t.Errorf("SetMetaData: expected a *MetaSizeError, got %v", err)
+	}
+	if b, _ := c.LocalNode().Meta(); len(b) != budget {
+		t.Errorf("SetMetaData: the metadata should be unchanged when too large")
+	}
+
+	// compressed, it fits
+	c.compress = true
+	if err := c.SetMetaData(big); err != nil {
+		t.Errorf("SetMetaData: compressed: %v", err)
+	}
+	if b, err := c.LocalNode().Meta(); err != nil || !bytes.Equal(b, big) {
+		t.Errorf("Meta: compressed metadata not restored: %v", err)
+	}
+	if md, err := c.extractMeta(); err != nil || len(md.user) != len(big) {
+		t.Errorf("extractMeta: compressed: %v", err)
+	}
+	if err := c.Ready(true); err != nil {
+		t.Errorf("Ready: %v", err)
+	}
+
+	// short or incompressible user metadata is not compressed
+	if compressMeta([]byte("hello")) != nil {
+		t.Errorf("compressMeta: short metadata should not be compressed")
+	}
+}
+
+func TestNode_Tags(t *testing.T) {
+	c := &Cluster{}
+	tags := map[string]string{"role": "ingest", "weight": "3", "ssd": "true", "": "blank"}
+	c.saveMeta(&nodeMeta{rpcAddr: "10.0.0.2", tags: tags, user: []byte("hello")})
+	n := &Node{Node: &memberlist.Node{Meta: c.meta}}
+	if got := n.Tags(); !reflect.DeepEqual(got, tags) {
+		t.Errorf("Tags: expected %v, got %v", tags, got)
+	}
+	if md, err := n.extractMeta(); err != nil || md.rpcAddr != "10.0.0.2" || string(md.user) != "hello" {
+		t.Errorf("extractMeta: with tags: %#v, %v", md, err)
+	}
+	if v, ok := n.Tag("role"); !ok || v != "ingest" {
+		t.Errorf("Tag: expected ingest, got %q %v", v, ok)
+	}
+	if v, ok := n.TagInt("weight"); !ok || v != 3 {
+		t.Errorf("TagInt: expected 3, got %d %v", v, ok)
+	}
+	if _, ok := n.TagInt("role"); ok {
+		t.Errorf("TagInt: not an int")
+	}
+	if v, ok := n.TagBool("ssd"); !ok || !v {
+		t.Errorf("TagBool: expected true, got %v %v", v, ok)
+	}
+	if _, ok := n.Tag("nope"); ok {
+		t.Errorf("Tag: not set")
+	}
+	if !TagFilter("role", "query", "ingest")(n) || TagFilter("role", "query")(n) {
+		t.Errorf("TagFilter: unexpected result")
+	}
+
+	// a version 2 node has no tags
+	md := &nodeMeta{rpcAddr: "10.0.0.2"}
+	meta := md.bytes()[:minMdLen+8]
+	meta[mdVersionOff] = 2
+	binary.BigEndian.PutUint16(meta[mdHdrLenOff:], uint16(len(meta)))
+	n.Node.Meta = meta
+	if md, err := n.extractMeta(); err != nil || md.tags != nil {
+		t.Errorf("extractMeta: version 2: %#v, %v", md, err)
+	}
+
+	if err := checkMetaSize((&nodeMeta{tags: map[string]string{"big": strings.Repeat("x", memberlist.MetaMaxSize)}}).bytes()); err == nil {
+		t.Errorf("checkMetaSize: expected an error")
+	}
+}
+
+func TestFakeCluster_SetPlacementFilter(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	a.SetTags(map[string]string{"role": "query"})
+	b.SetTags(map[string]string{"role": "ingest"})
+	a.Ready(true)
+	b.Ready(true)
+	a.SetPlacementFilter(TagFilter("role", "ingest"))
+
+	dds := []DistDatum{&fakeDistDatum{id: 0}, &fakeDistDatum{id: 1}}
+	a.LoadDistData(func() ([]DistDatum, error) { return dds, nil })
+	for _, dd := range dds {
+		if nodes := a.NodesForDistDatum(dd); len(nodes) != 1 || nodes[0].Name() != "b" {
+			t.Errorf("LoadDistData: expected only the ingest node b, got %v", nodes)
+		}
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	s := NewSingleNodeBind("standalone", "10.1.2.3")
+	if ln := s.LocalNode(); ln.Name() != "standalone" || ln.SanitizedAddr() != "10_1_2_3" || s.NumMembers() != 1 {
+		t.Errorf("NewSingleNodeBind: unexpected node %v (%s), %d members", ln.Name(), ln.SanitizedAddr(), s.NumMembers())
+	}
+	s.Ready(true)
+
+	dd := &fakeDistDatum{id: 0}
+	s.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{dd}, nil })
+	if nodes := s.NodesForDistDatum(dd); len(nodes) != 1 || nodes[0] != s.LocalNode() || s.FencingToken(dd) == 0 {
+		t.Errorf("LoadDistData: expected the local node with a token, got %v %d", nodes, s.FencingToken(dd))
+	}
+
+	// not ready, e.g. shutting down, the data is relinquished
+	s.Ready(false)
+	if err := s.Transition(time.Second); err != nil || dd.relinquished != 1 {
+		t.Errorf("Transition: expected Relinquish, got %d (%v)", dd.relinquished, err)
+	}
+}
+
+func TestCluster_parseRelinquishMsg(t *testing.T) {
+	if key, token := parseRelinquishMsg([]byte("DataSource:123")); key != "DataSource:123" || token != 0 {
+		t.Errorf("parseRelinquishMsg: without token: %q %d", key, token)
+	}
+	if key, token := parseRelinquishMsg([]byte("DataSource:123:456")); key != "DataSource:123" || token != 456 {
+		t.Errorf("parseRelinquishMsg: with token: %q %d", key, token)
+	}
+	if t1 := nextToken(0); t1 == 0 || nextToken(t1) <= t1 || nextToken(1<<63) != 1<<63+1 {
+		t.Errorf("nextToken: tokens must increase")
+	}
+}
+
+type fakeDistDatum struct {
+	id                     int64
+	relinquished, acquired int
+}
+
+func (dd *fakeDistDatum) Id() int64         { return dd.id }
+func (dd *fakeDistDatum) Type() string      { return "fake" }
+func (dd *fakeDistDatum) GetName() string   { return fmt.Sprintf("fake%d", dd.id) }
+func (dd *fakeDistDatum) Relinquish() error { dd.relinquished++; return nil }
+func (dd *fakeDistDatum) Acquire() error    { dd.acquired++; return nil }
+
+func TestFakeCluster_Transition(t *testing.T) {
+	fn := NewFakeNetwork()
+	a := fn.NewCluster("a")
+	chg := a.NotifyClusterChanges()
+	a.Ready(true)
+
+	// with a single node, a owns everything
+	ddA, ddB := &fakeDistDatum{id: 0}, &fakeDistDatum{id: 0}
+	a.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddA}, nil })
+	if nodes := a.NodesForDistDatum(ddA); len(nodes) != 1 || nodes[0].Name() != "a" || a.FencingToken(ddA) == 0 {
+		t.Errorf("LoadDistData: expected node a with a token, got %v %d", nodes, a.FencingToken(ddA))
+	}
+	tokenA := a.FencingToken(ddA)
+
+	// b joins, but is not ready yet
+	b := fn.NewCluster("b")
+	b.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddB}, nil })
+	select {
+	case <-chg:
+	default:
+		t.Errorf("NewCluster: a was not notified of the join")
+	}
+	if a.NumMembers() != 2 || len(b.Members()) != 2 {
+		t.Errorf("NumMembers: expected 2, got %d", a.NumMembers())
+	}
+
+	// a leaves, b takes over
+	b.Ready(true)
+	a.Leave(0)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a.Transition(time.Second) }()
+	go func() { defer wg.Done(); b.Transition(time.Second) }()
+	wg.Wait()
+
+	if ddA.relinquished != 1 {
+		t.Errorf("Transition: expected Relinquish on a, got %d", ddA.relinquished)
+	}
+	if ddB.acquired != 1 {
+		t.Errorf("Transition: expected Acquire on b, got %d", ddB.acquired)
+	}
+	if a.FencingToken(ddA) != 0 || b.FencingToken(ddB) <= tokenA {
+		t.Errorf("Transition: fencing tokens not handed over: a: %d b: %d (was %d)", a.FencingToken(ddA), b.FencingToken(ddB), tokenA)
+	}
+}
+
+// slowDistDatum records how many Acquire() calls run at once.
+type slowDistDatum struct {
+	fakeDistDatum
+	mu              *sync.Mutex
+	running, maxRun *int
+}
+
+func (dd *slowDistDatum) Acquire() error {
+	dd.mu.Lock()
+	if *dd.running++; *dd.running > *dd.maxRun {
+		*dd.maxRun = *dd.running
+	}
+	dd.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	dd.mu.Lock()
+	*dd.running--
+	dd.mu.Unlock()
+	return nil
+}
+
+func TestFakeCluster_TransitionAcquireConcurrency(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	a.Ready(true)
+
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+		ddsA, ddsB      []DistDatum
+	)
+	for i := int64(0); i < 20; i++ {
+		ddsA = append(ddsA, &fakeDistDatum{id: i})
+		ddsB = append(ddsB, &slowDistDatum{fakeDistDatum: fakeDistDatum{id: i}, mu: &mu, running: &running, maxRun: &maxRun})
+	}
+	a.LoadDistData(func() ([]DistDatum, error) { return ddsA, nil })
+	b.LoadDistData(func() ([]DistDatum, error) { return ddsB, nil })
+	b.SetAcquireConcurrency(4)
+
+	// a leaves, b takes over
+	b.Ready(true)
+	a.Leave(0)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a.Transition(time.Second) }()
+	go func() { defer wg.Done(); b.Transition(time.Second) }()
+	wg.Wait()
+
+	if maxRun < 2 || maxRun > 4 {
+		t.Errorf("Transition: expected 2 to 4 concurrent acquires, got %d", maxRun)
+	}
+	if p := b.AcquireProgress(); p.Total != 20 || p.Done != 20 || p.Failed != 0 {
+		t.Errorf("AcquireProgress: unexpected %+v", p)
+	}
+}
+
+type stuckDistDatum struct {
+	fakeDistDatum
+	unblock chan bool
+}
+
+func (dd *stuckDistDatum) Relinquish() error { <-dd.unblock; return nil }
+
+func TestFakeCluster_TransitionStuckRelinquish(t *testing.T) {
+	save := relinquishTimeout
+	relinquishTimeout = 50 * time.Millisecond
+	defer func() { relinquishTimeout = save }()
+
+	fn := NewFakeNetwork()
+	a := fn.NewCluster("a")
+	a.Ready(true)
+	ddA, ddB := &stuckDistDatum{unblock: make(chan bool)}, &fakeDistDatum{id: 0}
+	defer close(ddA.unblock)
+	a.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddA}, nil })
+
+	b := fn.NewCluster("b")
+	b.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddB}, nil })
+	b.Ready(true)
+	a.Leave(0)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a.Transition(time.Second) }()
+	go func() { defer wg.Done(); b.Transition(time.Second) }()
+	wg.Wait()
+
+	if moved := a.UnsafelyMoved(); len(moved) != 1 || moved[0] != "fake:0" {
+		t.Errorf("Transition: expected fake:0 to be unsafely moved, got %v", moved)
+	}
+	if ddB.acquired != 1 || b.FencingToken(ddB) == 0 {
+		t.Errorf("Transition: expected b to acquire despite the stuck Relinquish, got %d", ddB.acquired)
+	}
+}
+
+func TestChaosTransport(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	t1, t2 := mn.NewTransport("t1"), mn.NewTransport("t2")
+	ip, port, _ := t2.FinalAdvertiseAddr("", 0)
+	addr := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+
+	received := func() bool {
+		select {
+		case <-t2.PacketCh():
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	ct := NewChaosTransport(t1)
+	go ct.WriteTo([]byte("hello"), addr)
+	if !received() {
+		t.Errorf("ChaosTransport: packet not delivered without faults")
+	}
+	ct.InjectFaults(Faults{Drop: 1})
+	go ct.WriteTo([]byte("hello"), addr)
+	if received() {
+		t.Errorf("ChaosTransport: packet delivered with Drop: 1")
+	}
+	ct.InjectFaults(Faults{Duplicate: 1})
+	go ct.WriteTo([]byte("hello"), addr)
+	if !received() || !received() {
+		t.Errorf("ChaosTransport: packet not duplicated with Duplicate: 1")
+	}
+	ct.InjectFaults(Faults{})
+	ct.SetDown(true)
+	if _, err := ct.DialTimeout(addr, time.Second); err == nil {
+		t.Errorf("ChaosTransport: DialTimeout should fail when down")
+	}
+}
+
+func TestFakeNetwork_InjectFaults(t *testing.T) {
+	fn := NewFakeNetwork()
+	a := fn.NewCluster("a")
+	a.Ready(true)
+	ddA, ddB := &fakeDistDatum{id: 0}, &fakeDistDatum{id: 0}
+	a.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddA}, nil })
+	b := fn.NewCluster("b")
+	b.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{ddB}, nil })
+	b.Ready(true)
+
+	// the relinquish message is lost, b still acquires after the timeout
+	fn.InjectFaults(Faults{Drop: 1})
+	fn.Flap(a, time.Hour)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a.Transition(100 * time.Millisecond) }()
+	go func() { defer wg.Done(); b.Transition(100 * time.Millisecond) }()
+	wg.Wait()
+
+	if ddA.relinquished != 1 || ddB.acquired != 1 {
+		t.Errorf("Transition: expected Relinquish on a and Acquire on b, got %d %d", ddA.relinquished, ddB.acquired)
+	}
+	if b.NumMembers() != 1 {
+		t.Errorf("Flap: a should be down, members: %d", b.NumMembers())
+	}
+}
+
+func TestCodec(t *testing.T) {
+	type payload struct {
+		Name  string
+		Value float64
+	}
+	for _, codec := range []Codec{GobCodec, MsgpackCodec} {
+		m, err := NewMsgWithCodec(nil, &payload{"foo", 1.5}, codec)
+		if err != nil || m.Codec != codec.Name() {
+			t.Errorf("NewMsgWithCodec(%s): %v %q", codec.Name(), err, m.Codec)
+			continue
+		}
+		var p payload
+		if err := m.Decode(&p); err != nil || p.Name != "foo" || p.Value != 1.5 {
+			t.Errorf("Decode(%s): %v %v", codec.Name(), p, err)
+		}
+	}
+
+	if _, err := NewMsgWithCodec(nil, &payload{}, ProtobufCodec); err == nil {
+		t.Errorf("ProtobufCodec: expected error on a non-proto payload")
+	}
+	m, err := NewMsgWithCodec(nil, &wrappers.StringValue{Value: "foo"}, ProtobufCodec)
+	if err != nil {
+		t.Fatalf("ProtobufCodec: %v", err)
+	}
+	var sv wrappers.StringValue
+	if err := m.Decode(&sv); err != nil || sv.Value != "foo" {
+		t.Errorf("ProtobufCodec: Decode: %v %v", sv.Value, err)
+	}
+
+	if err := (&Msg{Codec: "bogus"}).Decode(&sv); err == nil {
+		t.Errorf("Decode: expected error on unknown codec")
+	}
+}
+
+func TestCodec_rpc(t *testing.T) {
+	rcv := make(chan *Msg, 1)
+	c := &Cluster{rcvChs: []chan *Msg{rcv}}
+	c.rpcSrv, _ = newRPCServer(&ClusterRPC{c}, nil, MsgpackCodec)
+
+	rc := MsgpackCodec.(RPCCodec)
+	p1, p2 := net.Pipe()
+	go c.rpcSrv.srv.ServeCodec(rc.ServerCodec(p1))
+	client := rpc.NewClientWithCodec(rc.ClientCodec(p2))
+	defer p1.Close() // not client.Close(), which races with the reader in go-msgpack
+
+	msg, _ := NewMsgWithCodec(nil, "hello", MsgpackCodec)
+	msg.Src = &Node{Node: &memberlist.Node{Name: "a", Addr: net.ParseIP("10.0.0.1"), Port: 7946}}
+	var resp Msg
+	if err := client.Call("ClusterRPC.Message", msg, &resp); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	m := <-rcv
+	var s string
+	if err := m.Decode(&s); err != nil || s != "hello" || m.Src.Name() != "a" || !m.Src.Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("msgpack RPC: unexpected message: %#v %q %v", m.Src.Node, s, err)
+	}
+}
+
+func TestCluster_Shutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	cc := DefaultLANClusterConfig()
+	cc.Name = "a"
+	cc.Transport = (&memberlist.MockNetwork{}).NewTransport("a")
+	cc.RPCListener = ln
+	c, err := NewClusterWithConfig(cc)
+	if err != nil {
+		t.Fatalf("NewClusterWithConfig: %v", err)
+	}
+	blocked := make(chan *Msg) // nobody reads this
+	c.rcvChs = append(c.rcvChs, blocked)
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	var resp Msg
+	if err := client.Call("ClusterRPC.Message", &Msg{Id: 0, Body: []byte("hi")}, &resp); err != nil {
+		t.Errorf("Call: %v", err)
+	}
+	if m := <-c.rcv; string(m.Body) != "hi" {
+		t.Errorf("Message: unexpected body %q", m.Body)
+	}
+
+	// a call that cannot complete must not hold up Shutdown forever
+	save := rpcDrainTimeout
+	rpcDrainTimeout = 50 * time.Millisecond
+	defer func() { rpcDrainTimeout = save }()
+	call := client.Go("ClusterRPC.Message", &Msg{Id: len(c.rcvChs) - 1}, &resp, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	if err := c.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if <-call.Done; call.Error == nil {
+		t.Errorf("Shutdown: the blocked call should have failed")
+	}
+	if err := c.Shutdown(); err != nil {
+		t.Errorf("Shutdown: second call should be a noop: %v", err)
+	}
+
+	// the address can be bound again
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Shutdown: cannot rebind RPC address: %v", err)
+	}
+	ln.Close()
+}
+
+func TestFakeCluster_NodesForDistDatumChecked(t *testing.T) {
+	fn := NewFakeNetwork()
+	a := fn.NewCluster("a")
+	a.Ready(true)
+	dd := &fakeDistDatum{id: 0}
+	a.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{dd}, nil })
+	if nodes, stale := a.NodesForDistDatumChecked(dd); len(nodes) != 1 || stale {
+		t.Errorf("NodesForDistDatumChecked: expected a fresh assignment, got %v %v", nodes, stale)
+	}
+
+	epoch := a.Epoch()
+	b := fn.NewCluster("b")
+	b.Ready(true)
+	if a.Epoch() <= epoch {
+		t.Errorf("Epoch: expected the epoch to increase on changes")
+	}
+	if _, stale := a.NodesForDistDatumChecked(dd); !stale {
+		t.Errorf("NodesForDistDatumChecked: assignment should be stale after a change")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a.Transition(100 * time.Millisecond) }()
+	go func() { defer wg.Done(); b.Transition(100 * time.Millisecond) }()
+	wg.Wait()
+	if _, stale := a.NodesForDistDatumChecked(dd); stale {
+		t.Errorf("NodesForDistDatumChecked: assignment should not be stale after Transition")
+	}
+	if nodes, stale := a.NodesForDistDatumChecked(&fakeDistDatum{id: 42}); nodes != nil || stale {
+		t.Errorf("NodesForDistDatumChecked: unknown datum: %v %v", nodes, stale)
+	}
+}
+
+func TestFakeCluster_Broadcast(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b, c := fn.NewCluster("a"), fn.NewCluster("b"), fn.NewCluster("c")
+	if err := a.Broadcast("flush now"); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	for _, fc := range []*FakeCluster{b, c} {
+		select {
+		case m := <-fc.Broadcasts():
+			var s string
+			if err := m.Decode(&s); err != nil || s != "flush now" || m.Src.Name() != "a" {
+				t.Errorf("Broadcast: unexpected message on %s: %q from %s (%v)", fc.LocalNode().Name(), s, m.Src.Name(), err)
+			}
+		default:
+			t.Errorf("Broadcast: nothing received by %s", fc.LocalNode().Name())
+		}
+	}
+	select {
+	case <-a.Broadcasts():
+		t.Errorf("Broadcast: must not be delivered to the sender")
+	default:
+	}
+}
+
+func TestCluster_Broadcast(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+	if _, err := b.Memberlist.Join([]string{a.Memberlist.LocalNode().Address()}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	big := make([]byte, MaxBroadcastSize*2)
+	rand.Read(big) // so that it does not compress
+	if err := a.Broadcast(big); err == nil {
+		t.Errorf("Broadcast: expected an error for an oversized message")
+	}
+	if err := a.Broadcast("config reloaded"); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	select {
+	case m := <-b.Broadcasts():
+		var s string
+		if err := m.Decode(&s); err != nil || s != "config reloaded" {
+			t.Errorf("Broadcast: unexpected message %q (%v)", s, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Broadcast: not received via gossip")
+	}
+}
+
+func TestCluster_evictNodes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := DefaultLANClusterConfig()
+	cc.Name = "a"
+	cc.Transport = (&memberlist.MockNetwork{}).NewTransport("a")
+	cc.RPCListener = ln
+	c, err := NewClusterWithConfig(cc)
+	if err != nil {
+		t.Fatalf("NewClusterWithConfig: %v", err)
+	}
+	defer c.Shutdown()
+
+	nodes, _ := c.NodeCacheSize()
+	b := c.checkNodeCache(&memberlist.Node{Name: "b"})
+	client, server := net.Pipe()
+	defer server.Close()
+	b.rpc = rpc.NewClient(client)
+	if n, conns := c.NodeCacheSize(); n != nodes+1 || conns != 1 {
+		t.Errorf("NodeCacheSize: expected %d nodes 1 conn, got %d %d", nodes+1, n, conns)
+	}
+
+	c.NotifyLeave(&memberlist.Node{Name: "b"}) // a different pointer, same name
+	if n, conns := c.NodeCacheSize(); n != nodes || conns != 0 {
+		t.Errorf("NodeCacheSize: expected %d nodes 0 conns after leave, got %d %d", nodes, n, conns)
+	}
+	if b.rpc != nil {
+		t.Errorf("NotifyLeave: rpc client not cleared")
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("NotifyLeave: connection not closed: %v", err)
+	}
+}
+
+func Test_lockTable(t *testing.T) {
+	var lt lockTable
+	now := time.Now()
+	r := lt.do(&LockArgs{Op: lockAcquire, Name: "foo", Holder: "a", TTL: time.Minute}, now)
+	if !r.Ok || r.Token == 0 {
+		t.Fatalf("lockTable: acquire failed: %#v", r)
+	}
+	token := r.Token
+	if r := lt.do(&LockArgs{Op: lockAcquire, Name: "foo", Holder: "b", TTL: time.Minute}, now); r.Ok || r.Holder != "a" {
+		t.Errorf("lockTable: acquire of a held lock: %#v", r)
+	}
+	if r := lt.do(&LockArgs{Op: lockRefresh, Name: "foo", Holder: "a", TTL: time.Minute, Token: token + 1}, now); r.Ok {
+		t.Errorf("lockTable: refresh with a wrong token: %#v", r)
+	}
+	if r := lt.do(&LockArgs{Op: lockRefresh, Name: "foo", Holder: "a", TTL: time.Minute, Token: token}, now.Add(30*time.Second)); !r.Ok {
+		t.Errorf("lockTable: refresh failed: %#v", r)
+	}
+	// expired
+	r = lt.do(&LockArgs{Op: lockAcquire, Name: "foo", Holder: "b", TTL: time.Minute}, now.Add(2*time.Minute))
+	if !r.Ok || r.Token <= token {
+		t.Errorf("lockTable: acquire of an expired lock: %#v", r)
+	}
+	if r := lt.do(&LockArgs{Op: lockRelease, Name: "foo", Holder: "a", Token: token}, now.Add(2*time.Minute)); r.Ok {
+		t.Errorf("lockTable: release by the previous holder: %#v", r)
+	}
+	if r := lt.do(&LockArgs{Op: lockRelease, Name: "foo", Holder: "b", Token: r.Token}, now.Add(2*time.Minute)); !r.Ok {
+		t.Errorf("lockTable: release failed: %#v", r)
+	}
+}
+
+func TestFakeCluster_AcquireLock(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	l, err := a.AcquireLock("migrate", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	if _, err := b.AcquireLock("migrate", time.Minute); err != ErrLocked {
+		t.Errorf("AcquireLock: expected ErrLocked, got %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Errorf("Unlock: %v", err)
+	}
+	if _, err := b.AcquireLock("migrate", time.Minute); err != nil {
+		t.Errorf("AcquireLock: after Unlock: %v", err)
+	}
+}
+
+func TestCluster_AcquireLock(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		cc.AdvertiseRPCAddr = "127.0.0.1"
+		cc.AdvertiseRPCPort = ln.Addr().(*net.TCPAddr).Port
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+	if _, err := b.Memberlist.Join([]string{a.Memberlist.LocalNode().Address()}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	if master, _ := b.lockMaster(); master.Name() != "a" {
+		t.Fatalf("lockMaster: expected a, got %s", master.Name())
+	}
+
+	// via RPC
+	l, err := b.AcquireLock("migrate", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	if err := l.Refresh(); err != nil {
+		t.Errorf("Refresh: %v", err)
+	}
+	// locally on the master
+	if _, err := a.AcquireLock("migrate", time.Minute); err != ErrLocked {
+		t.Errorf("AcquireLock: expected ErrLocked, got %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Errorf("Unlock: %v", err)
+	}
+	if _, err := a.AcquireLock("migrate", time.Minute); err != nil {
+		t.Errorf("AcquireLock: after Unlock: %v", err)
+	}
+}
+
+// switchDialer is an RPCDialer whose behavior a test can change
+// while the cluster is running.
+type switchDialer struct {
+	sync.Mutex
+	dial func(network, addr string, timeout time.Duration) (net.Conn, error)
+}
+
+func (d *switchDialer) set(dial func(network, addr string, timeout time.Duration) (net.Conn, error)) {
+	d.Lock()
+	defer d.Unlock()
+	d.dial = dial
+}
+
+func (d *switchDialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	d.Lock()
+	dial := d.dial
+	d.Unlock()
+	return dial(network, addr, timeout)
+}
+
+func TestCluster_pingNodes(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	dialer := &switchDialer{dial: net.DialTimeout}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		cc.AdvertiseRPCAddr = "127.0.0.1"
+		cc.AdvertiseRPCPort = ln.Addr().(*net.TCPAddr).Port
+		cc.RPCTimeout = 100 * time.Millisecond
+		cc.RPCDialer = dialer.Dial
+		cc.HealthCheckInterval = -1 // we ping explicitly
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		c.Ready(true)
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+	if _, err := b.Memberlist.Join([]string{a.Memberlist.LocalNode().Address()}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	for i := 0; ; i++ { // wait for b to be ready as far as a knows
+		if nodes, _ := a.readyNodes(); len(nodes) == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("readyNodes: b never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// b is alive as far as gossip is concerned, but its RPC is wedged
+	wedged, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wedged.Close()
+	go func() {
+		for { // accept, but never read or respond
+			conn, err := wedged.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	dialer.set(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, wedged.Addr().String(), timeout)
+	})
+	chg := a.NotifyClusterChanges()
+	a.pingNodes()
+	if u := a.Unhealthy(); len(u) != 0 {
+		t.Errorf("Unhealthy: expected none after one failure, got %v", u)
+	}
+	a.pingNodes()
+	if u := a.Unhealthy(); len(u) != 1 || u[0] != "b" {
+		t.Errorf("Unhealthy: expected [b], got %v", u)
+	}
+	if nodes, _ := a.readyNodes(); len(nodes) != 1 || nodes[0].Name() != "a" {
+		t.Errorf("readyNodes: expected only a, got %v", nodes)
+	}
+	select {
+	case <-chg:
+	default:
+		t.Errorf("pingNodes: no cluster change notification")
+	}
+
+	dialer.set(net.DialTimeout)
+	a.pingNodes()
+	if u := a.Unhealthy(); len(u) != 0 {
+		t.Errorf("Unhealthy: expected none after a successful ping, got %v", u)
+	}
+	if nodes, _ := a.readyNodes(); len(nodes) != 2 {
+		t.Errorf("readyNodes: expected 2 nodes, got %d", len(nodes))
+	}
+}
+
+func TestFakeCluster_AnyNodeForDistDatum(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	a.Copies(2)
+	b.Copies(2)
+	a.Ready(true)
+	b.Ready(true)
+	dd := &fakeDistDatum{id: 0}
+	b.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{dd}, nil })
+
+	if n := b.AnyNodeForDistDatum(dd, false); n == nil || n.Name() != "a" {
+		t.Errorf("AnyNodeForDistDatum: expected the lead a, got %v", n)
+	}
+	if n := b.AnyNodeForDistDatum(dd, true); n == nil || n.Name() != "b" {
+		t.Errorf("AnyNodeForDistDatum: expected local b, got %v", n)
+	}
+
+	// the lead is slow, reads rotate to the next copy
+	b.ReportNodeFailure(a.LocalNode())
+	if n := b.AnyNodeForDistDatum(dd, false); n == nil || n.Name() != "b" {
+		t.Errorf("AnyNodeForDistDatum: expected b after a failed, got %v", n)
+	}
+
+	// all copies have failed, the first live one is better than none
+	b.ReportNodeFailure(b.LocalNode())
+	if n := b.AnyNodeForDistDatum(dd, true); n == nil || n.Name() != "a" {
+		t.Errorf("AnyNodeForDistDatum: expected fallback to a, got %v", n)
+	}
+
+	// the penalty expires
+	b.health.report("a", time.Now().Add(-time.Second))
+	b.health.report("b", time.Now().Add(-time.Second))
+	if n := b.AnyNodeForDistDatum(dd, false); n == nil || n.Name() != "a" {
+		t.Errorf("AnyNodeForDistDatum: expected a after the penalty, got %v", n)
+	}
+
+	// the lead is gone
+	a.Leave(0)
+	if n := b.AnyNodeForDistDatum(dd, false); n == nil || n.Name() != "b" {
+		t.Errorf("AnyNodeForDistDatum: expected b after a left, got %v", n)
+	}
+	b.Ready(false)
+	if n := b.AnyNodeForDistDatum(dd, false); n != nil {
+		t.Errorf("AnyNodeForDistDatum: expected nil with no live copies, got %v", n)
+	}
+}
+
+func TestFakeCluster_SendBatch(t *testing.T) {
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	a.RegisterMsgType()
+	_, rcv := b.RegisterMsgType()
+	var msgs []*Msg
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &Msg{Id: 1, Body: []byte{byte(i)}})
+	}
+	if err := a.SendBatch(b.LocalNode(), msgs); err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if m := <-rcv; m.Body[0] != byte(i) || m.Src.Name() != "a" {
+			t.Errorf("SendBatch: unexpected message %d: %#v", i, m)
+		}
+	}
+}
+
+func TestCluster_SendBatch(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		cc.AdvertiseRPCAddr = "127.0.0.1"
+		cc.AdvertiseRPCPort = ln.Addr().(*net.TCPAddr).Port
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+	if _, err := b.Memberlist.Join([]string{a.Memberlist.LocalNode().Address()}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	snd, _ := a.RegisterMsgType()
+	_, rcv := b.RegisterMsgType()
+	var dst *Node
+	for i := 0; dst == nil && i < 500; i++ {
+		for _, n := range a.Members() {
+			if n.Name() == "b" {
+				dst = n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dst == nil {
+		t.Fatalf("Members: a does not know about b")
+	}
+
+	var msgs []*Msg
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &Msg{Id: 1, Dst: dst, Body: []byte{byte(i)}})
+	}
+	if err := a.SendBatch(dst, msgs); err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if m := <-rcv; m.Body[0] != byte(i) || m.Src.Name() != "a" || m.Dst.Name() != "b" {
+			t.Errorf("SendBatch: unexpected message %d: %#v", i, m)
+		}
+	}
+
+	// messages queued up in snd arrive in order, whether batched or not
+	const n = 500
+	go func() {
+		for i := 0; i < n; i++ {
+			snd <- &Msg{Dst: dst, Body: []byte(fmt.Sprint(i))}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-rcv:
+			if string(m.Body) != fmt.Sprint(i) {
+				t.Fatalf("RegisterMsgType: expected message %d, got %q", i, m.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("RegisterMsgType: timed out waiting for message %d", i)
+		}
+	}
+}
+
+func Test_offlineQueue(t *testing.T) {
+	q := newOfflineQueue(3, time.Minute)
+	now := time.Now()
+	msg := func(i int) *Msg { return &Msg{Body: []byte{byte(i)}} }
+
+	q.add("b", []*Msg{msg(0), msg(1)}, now.Add(-2*time.Minute))
+	q.add("b", []*Msg{msg(2), msg(3)}, now)
+	if queued, dropped, _, _ := q.stats(); queued != 3 || dropped != 1 {
+		t.Errorf("add: expected 3 queued and 1 dropped, got %d and %d", queued, dropped)
+	}
+	msgs := q.take("b", now)
+	if len(msgs) != 2 || msgs[0].Body[0] != 2 || msgs[1].Body[0] != 3 {
+		t.Errorf("take: expected messages 2 and 3, got %v", msgs)
+	}
+	if queued, _, expired, _ := q.stats(); queued != 0 || expired != 1 {
+		t.Errorf("take: expected 0 queued and 1 expired, got %d and %d", queued, expired)
+	}
+
+	// requeued messages keep their time
+	q.add("b", msgs, now.Add(time.Hour))
+	if msgs := q.take("b", now.Add(2*time.Minute)); len(msgs) != 0 {
+		t.Errorf("add: requeued messages should keep their original time")
+	}
+
+	if isOffline(rpc.ServerError("nope")) || !isOffline(ErrNodeUnreachable) || isOffline(nil) {
+		t.Errorf("isOffline: unexpected result")
+	}
+}
+
+func TestCluster_offlineQueue(t *testing.T) {
+	defer func(i, c time.Duration) { offlineRetryInterval, breakerCooldown = i, c }(offlineRetryInterval, breakerCooldown)
+	offlineRetryInterval, breakerCooldown = 50*time.Millisecond, 50*time.Millisecond
+
+	mn := &memberlist.MockNetwork{}
+	dialer := &switchDialer{dial: net.DialTimeout}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		cc.RPCDialer = dialer.Dial
+		cc.AdvertiseRPCAddr = "127.0.0.1"
+		cc.AdvertiseRPCPort = ln.Addr().(*net.TCPAddr).Port
+		cc.HealthCheckInterval = -1
+		cc.OfflineQueueSize = 100
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+	if _, err := b.Memberlist.Join([]string{a.Memberlist.LocalNode().Address()}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	snd, _ := a.RegisterMsgType()
+	_, rcv := b.RegisterMsgType()
+	var dst *Node
+	for i := 0; dst == nil && i < 500; i++ {
+		for _, n := range a.Members() {
+			if n.Name() == "b" {
+				dst = n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dst == nil {
+		t.Fatalf("Members: a does not know about b")
+	}
+
+	// b cannot be reached
+	dialer.set(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		return nil, fmt.Errorf("unreachable")
+	})
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		snd <- &Msg{Dst: dst, Body: []byte(fmt.Sprint(i))}
+	}
+	for i := 0; a.Stats().OfflineQueued < n && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q := a.Stats().OfflineQueued; q != n {
+		t.Fatalf("offline: expected %d queued messages, got %d", n, q)
+	}
+
+	// and it is back
+	dialer.set(net.DialTimeout)
+
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-rcv:
+			if string(m.Body) != fmt.Sprint(i) {
+				t.Fatalf("offline: expected message %d, got %q", i, m.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("offline: timed out waiting for message %d", i)
+		}
+	}
+	// counted once the call returns
+	for i := 0; a.Stats().OfflineRedelivered < n && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := a.Stats(); st.OfflineQueued != 0 || st.OfflineRedelivered != n {
+		t.Errorf("offline: expected nothing queued and %d redelivered, got %+v", n, st)
+	}
+}
+
+func TestLoadNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-nodeid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node-id")
+
+	id, err := LoadNodeID(path)
+	if err != nil || len(id) != 36 {
+		t.Fatalf("LoadNodeID: expected a new UUID, got %q %v", id, err)
+	}
+	if id2, err := LoadNodeID(path); err != nil || id2 != id {
+		t.Errorf("LoadNodeID: expected the same id %q, got %q %v", id, id2, err)
+	}
+
+	if k := nodeIDSortKey(id); k < 0 || k != nodeIDSortKey(id) || k == nodeIDSortKey("other") {
+		t.Errorf("nodeIDSortKey: unexpected key %d", k)
+	}
+	if _, err := NewClusterWithConfig(&ClusterConfig{SortBy: SortByNodeID}); err == nil {
+		t.Errorf("NewClusterWithConfig: SortByNodeID without NodeID should be an error")
+	}
+}
+
+func Test_breaker(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	for i := 0; i < breakerThreshold; i++ {
+		if !b.allow("a", now) {
+			t.Fatalf("breaker: call %d should be allowed", i)
+		}
+		b.done("a", false, false, now)
+	}
+	if b.allow("a", now) {
+		t.Errorf("breaker: should be open after %d failures", breakerThreshold)
+	}
+	if u, _, errs := b.stats(); len(u) != 1 || u[0] != "a" || errs != uint64(breakerThreshold) {
+		t.Errorf("breaker: unexpected stats %v %d", u, errs)
+	}
+
+	// after the cooldown, only one call is let through
+	later := now.Add(breakerCooldown)
+	if !b.allow("a", later) || b.allow("a", later) {
+		t.Errorf("breaker: expected exactly one probe after the cooldown")
+	}
+	b.done("a", false, true, later)
+	if b.allow("a", later) {
+		t.Errorf("breaker: a failed probe should reopen the breaker")
+	}
+	later = later.Add(breakerCooldown)
+	if !b.allow("a", later) {
+		t.Errorf("breaker: expected a probe")
+	}
+	b.done("a", true, false, later)
+	if !b.allow("a", later) || !b.allow("a", later) {
+		t.Errorf("breaker: should be closed after a successful probe")
+	}
+	if u, timeouts, _ := b.stats(); len(u) != 0 || timeouts != 1 {
+		t.Errorf("breaker: unexpected stats %v %d", u, timeouts)
+	}
+}
+
+func TestCluster_callTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := DefaultLANClusterConfig()
+	cc.Name = "a"
+	cc.Transport = (&memberlist.MockNetwork{}).NewTransport("a")
+	cc.RPCListener = ln
+	cc.RPCTimeout = 10 * time.Millisecond
+	cc.RPCDialer = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(ioutil.Discard, server) // a hung node, reads but never responds
+		return client, nil
+	}
+	c, err := NewClusterWithConfig(cc)
+	if err != nil {
+		t.Fatalf("NewClusterWithConfig: %v", err)
+	}
+	defer c.Shutdown()
+
+	b := c.checkNodeCache(&memberlist.Node{Name: "b"})
+	for i := 0; i < breakerThreshold; i++ {
+		if err := c.call(b, "ClusterRPC.Message", &Msg{}, &Msg{}); err == nil || err == ErrNodeUnreachable {
+			t.Errorf("call: expected a timeout, got %v", err)
+		}
+	}
+	if err := c.call(b, "ClusterRPC.Message", &Msg{}, &Msg{}); err != ErrNodeUnreachable {
+		t.Errorf("call: expected ErrNodeUnreachable, got %v", err)
+	}
+	st := c.Stats()
+	if len(st.Unreachable) != 1 || st.Unreachable[0] != "b" || st.RPCTimeouts != uint64(breakerThreshold) || st.RPCConns != 0 {
+		t.Errorf("Stats: unexpected %#v", st)
+	}
+}
+
+func TestDNSDiscoverer(t *testing.T) {
+	saveSRV, saveHost := lookupSRV, lookupHost
+	defer func() { lookupSRV, lookupHost = saveSRV, saveHost }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{{Target: "a.example.com.", Port: 7946}, {Target: "b.example.com.", Port: 7947}}, nil
+	}
+	lookupHost = func(host string) ([]string, error) { return []string{"10.0.0.1", "10.0.0.2"}, nil }
+
+	if addrs, err := (&DNSDiscoverer{Name: "_tgres._tcp.example.com", SRV: true}).Discover(); err != nil || !reflect.DeepEqual(addrs, []string{"a.example.com:7946", "b.example.com:7947"}) {
+		t.Errorf("Discover: SRV: %v %v", addrs, err)
+	}
+	if addrs, err := (&DNSDiscoverer{Name: "tgres.example.com", Port: 7946}).Discover(); err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1:7946", "10.0.0.2:7946"}) {
+		t.Errorf("Discover: A: %v %v", addrs, err)
+	}
+}
+
+func TestKubernetesDiscoverer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/tsdb/pods" || r.URL.Query().Get("labelSelector") != "app=tgres" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"metadata": {}, "status": {"phase": "Running", "podIP": "10.1.0.1"}},
+			{"metadata": {}, "status": {"phase": "Pending"}},
+			{"metadata": {"deletionTimestamp": "2017-01-01T00:00:00Z"}, "status": {"phase": "Running", "podIP": "10.1.0.3"}}
+		]}`)
+	}))
+	defer srv.Close()
+
+	d := &KubernetesDiscoverer{APIServer: srv.URL, Namespace: "tsdb", LabelSelector: "app=tgres", Port: 7946}
+	if addrs, err := d.Discover(); err != nil || !reflect.DeepEqual(addrs, []string{"10.1.0.1:7946"}) {
+		t.Errorf("Discover: %v %v", addrs, err)
+	}
+}
+
+func Test_signV4(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	creds := &awsCredentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, "us-east-1", "service", creds, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expect := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expect {
+		t.Errorf("signV4: expected\n%s\ngot\n%s", expect, got)
+	}
+}
+
+func TestEC2Discoverer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Filter.1.Name") != "tag:role" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("NextToken") == "" {
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+				<item><privateIpAddress>10.2.0.1</privateIpAddress><networkInterfaceSet><item><privateIpAddress>10.2.9.9</privateIpAddress></item></networkInterfaceSet></item>
+				<item><privateIpAddress>10.2.0.2</privateIpAddress></item>
+			</instancesSet></item></reservationSet><nextToken>more</nextToken></DescribeInstancesResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+			<item><privateIpAddress>10.2.0.3</privateIpAddress></item>
+		</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+	}))
+	defer srv.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	d := &EC2Discoverer{Region: "us-east-1", TagKey: "role", TagValue: "tgres", Endpoint: srv.URL}
+	if addrs, err := d.Discover(); err != nil || !reflect.DeepEqual(addrs, []string{"10.2.0.1", "10.2.0.2", "10.2.0.3"}) {
+		t.Errorf("Discover: %v %v", addrs, err)
+	}
+}
+
+func TestCluster_AutoJoin(t *testing.T) {
+	mn := &memberlist.MockNetwork{}
+	var cs []*Cluster
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := DefaultLANClusterConfig()
+		cc.Name = name
+		cc.Transport = mn.NewTransport(name)
+		cc.RPCListener = ln
+		c, err := NewClusterWithConfig(cc)
+		if err != nil {
+			t.Fatalf("NewClusterWithConfig: %v", err)
+		}
+		defer c.Shutdown()
+		cs = append(cs, c)
+	}
+	a, b := cs[0], cs[1]
+
+	addrs := []string{a.Memberlist.LocalNode().Address(), b.Memberlist.LocalNode().Address()}
+	b.AutoJoin(DiscovererFunc(func() ([]string, error) { return addrs, nil }), 10*time.Millisecond)
+	for i := 0; i < 100 && a.NumMembers() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.NumMembers() != 2 || b.NumMembers() != 2 {
+		t.Errorf("AutoJoin: expected 2 members, got %d %d", a.NumMembers(), b.NumMembers())
+	}
+}
+
+func TestFakeCluster_ImportAssignments(t *testing.T) {
+	load := func(c *FakeCluster) []DistDatum {
+		dds := []DistDatum{&fakeDistDatum{id: 0}, &fakeDistDatum{id: 1}, &fakeDistDatum{id: 2}}
+		c.LoadDistData(func() ([]DistDatum, error) { return dds, nil })
+		return dds
+	}
+	lead := func(c *FakeCluster, dd DistDatum) string {
+		if nodes := c.NodesForDistDatum(dd); len(nodes) > 0 {
+			return nodes[0].Name()
+		}
+		return ""
+	}
+
+	// the old cluster
+	fn := NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+	a.Ready(true)
+	b.Ready(true)
+	dds := load(a)
+	data, err := a.ExportAssignments()
+	if err != nil {
+		t.Fatalf("ExportAssignments: %v", err)
+	}
+
+	// the new cluster, nodes join in a different order and there is
+	// a third one
+	fn2 := NewFakeNetwork()
+	c, b2, a2 := fn2.NewCluster("c"), fn2.NewCluster("b"), fn2.NewCluster("a")
+	for _, n := range []*FakeCluster{c, b2, a2} {
+		n.Ready(true)
+	}
+	if err := a2.ImportAssignments(data); err != nil {
+		t.Fatalf("ImportAssignments: %v", err)
+	}
+	dds2 := load(a2)
+	for i := range dds {
+		if lead(a, dds[i]) != lead(a2, dds2[i]) {
+			t.Errorf("ImportAssignments: %s: expected node %s, got %s", ddKey(dds[i]), lead(a, dds[i]), lead(a2, dds2[i]))
+		}
+	}
+
+	// a pin whose lead node is not in the cluster is ignored
+	if err := a2.ImportAssignments([]byte(`{"version": 1, "assignments": {"fake:0": ["zz"]}}`)); err != nil {
+		t.Fatalf("ImportAssignments: %v", err)
+	}
+	dds2 = load(a2)
+	if lead(a2, dds2[0]) != "c" {
+		t.Errorf("ImportAssignments: expected an unknown pinned node to be ignored, got %s", lead(a2, dds2[0]))
+	}
+	if err := a2.ImportAssignments([]byte(`{"version": 99}`)); err == nil {
+		t.Errorf("ImportAssignments: expected an error for an unknown version")
+	}
+}
+
+func Test_relinquishBatcher(t *testing.T) {
+	save := relinquishBatchSize
+	relinquishBatchSize = 2
+	defer func() { relinquishBatchSize = save }()
+
+	node := func(name string, version int) *Node {
+		meta := (&nodeMeta{}).bytes()
+		meta[mdVersionOff] = byte(version)
+		return &Node{Node: &memberlist.Node{Name: name, Meta: meta}}
+	}
+	a, old := node("a", ProtocolVersion), node("old", 4)
+
+	snd := make(chan *Msg, 10)
+	rb := newRelinquishBatcher(snd)
+	for i := 0; i < 3; i++ {
+		rb.add(a, []byte(fmt.Sprintf("fake:%d:%d", i, i+100)))
+		rb.add(old, []byte(fmt.Sprintf("fake:%d", i)))
+	}
+	if len(snd) != 4 { // 3 to old, 1 full batch to a
+		t.Errorf("add: expected 4 messages, got %d", len(snd))
+	}
+	rb.flush()
+
+	var keys []string
+	for len(snd) > 0 {
+		m := <-snd
+		entries := splitRelinquishMsg(m.Body)
+		if m.Dst.Name() == "old" && len(entries) != 1 {
+			t.Errorf("add: expected no batching for an old node, got %q", m.Body)
+		}
+		for _, e := range entries {
+			key, _ := parseRelinquishMsg(e)
+			keys = append(keys, m.Dst.Name()+"/"+key)
+		}
+	}
+	sort.Strings(keys)
+	expect := []string{"a/fake:0", "a/fake:1", "a/fake:2", "old/fake:0", "old/fake:1", "old/fake:2"}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Errorf("relinquishBatcher: expected %v, got %v", expect, keys)
+	}
+}
+
+func TestFakeCluster_OnBeforeTransition(t *testing.T) {
+	fn := NewFakeNetwork()
+	a := fn.NewCluster("a")
+	a.Ready(true)
+	a.LoadDistData(func() ([]DistDatum, error) { return []DistDatum{&fakeDistDatum{id: 0}}, nil })
+
+	var calls []string
+	a.OnBeforeTransition("fake", func() {
+		if nodes := a.NodesForDistDatum(&fakeDistDatum{id: 0}); len(nodes) == 0 { // must not deadlock
+			t.Errorf("OnBeforeTransition: expected fake:0 to be assigned")
+		}
+		calls = append(calls, "before")
+	})
+	a.OnAfterTransition("fake", func(err error) { calls = append(calls, fmt.Sprintf("after %v", err)) })
+	a.OnBeforeTransition("DataSource", func() { calls = append(calls, "no DataSources, not called") })
+
+	a.Transition(time.Second)
+	if strings.Join(calls, ",") != "before,after <nil>" {
+		t.Errorf("Transition: unexpected hook calls: %v", calls)
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// Codec encodes and decodes Msg payloads. The name of the codec
+// travels with every Msg, so that the receiving end knows how to
+// decode the body regardless of its own configuration.
+//
+// A codec may also implement RPCCodec, in which case the whole RPC
+// conversation between nodes (not just the payload) is framed using
+// it. This is what makes it possible for a non-Go process to take
+// part in the message protocol.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RPCCodec is implemented by codecs that can be used to frame RPC
+// connections.
+type RPCCodec interface {
+	Codec
+	ServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec
+	ClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec
+}
+
+// The built-in codecs. GobCodec is the default and the only one
+// older nodes understand.
+var (
+	GobCodec      Codec = gobCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	GobCodec.Name():      GobCodec,
+	MsgpackCodec.Name():  MsgpackCodec,
+	ProtobufCodec.Name(): ProtobufCodec,
+}}
+
+// RegisterCodec makes a codec available for decoding by name. The
+// built-in codecs are always registered.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.Name()] = c
+}
+
+// codecByName returns the codec by its name, blank name means gob.
+func codecByName(name string) (Codec, error) {
+	if name == "" {
+		return GobCodec, nil
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	if c, ok := codecs.m[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown codec: %q", name)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+// msgpackCodec uses the msgpack implementation memberlist already
+// depends on. Structs are encoded by their exported fields, same as
+// with gob, but types implementing gob.GobEncoder are not
+// special-cased, their exported fields must be sufficient.
+type msgpackCodec struct{}
+
+var msgpackHandle = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(v); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// The RPC framing is the msgpack-rpc spec, for which there are
+// client libraries in most languages.
+func (msgpackCodec) ServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return codec.MsgpackSpecRpc.ServerCodec(conn, msgpackHandle)
+}
+
+func (msgpackCodec) ClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return codec.MsgpackSpecRpc.ClientCodec(conn, msgpackHandle)
+}
+
+// protobufCodec can only encode payloads which are protocol buffer
+// messages (i.e. generated by protoc). The RPC framing stays gob.
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
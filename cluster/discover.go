@@ -0,0 +1,122 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Discoverer finds the addresses of cluster nodes, e.g. to Join()
+// them without having to list them explicitly. Addresses are
+// "host:port", or just "host" for the default gossip port.
+type Discoverer interface {
+	Discover() ([]string, error)
+}
+
+// DiscovererFunc allows an ordinary function to be a Discoverer.
+type DiscovererFunc func() ([]string, error)
+
+func (f DiscovererFunc) Discover() ([]string, error) { return f() }
+
+var (
+	lookupSRV  = net.LookupSRV
+	lookupHost = net.LookupHost
+)
+
+// DNSDiscoverer discovers nodes by looking up Name in DNS. If SRV is
+// true, Name is an SRV record such as "_tgres._tcp.example.com" whose
+// targets and ports are the nodes, otherwise Name resolves (via A or
+// AAAA records) to the node addresses and Port is the gossip port (0
+// means the default).
+type DNSDiscoverer struct {
+	Name string
+	Port int
+	SRV  bool
+}
+
+func (d *DNSDiscoverer) Discover() ([]string, error) {
+	if d.SRV {
+		_, srvs, err := lookupSRV("", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]string, 0, len(srvs))
+		for _, srv := range srvs {
+			result = append(result, joinAddr(strings.TrimSuffix(srv.Target, "."), int(srv.Port)))
+		}
+		return result, nil
+	}
+	hosts, err := lookupHost(d.Name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		result = append(result, joinAddr(h, d.Port))
+	}
+	return result, nil
+}
+
+func joinAddr(host string, port int) string {
+	if port == 0 {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// AutoJoin asks d for node addresses every interval and joins them
+// whenever there are more addresses than cluster members, i.e. some
+// nodes are not in our cluster. The first attempt is made right
+// away. This takes care of the initial join as well as of rejoining
+// after a restart of the whole cluster, when each node may have come
+// up as a cluster of one because no other node was reachable. It
+// returns immediately, discovery stops on Shutdown().
+func (c *Cluster) AutoJoin(d Discoverer, interval time.Duration) {
+	go func() {
+		for {
+			if err := c.discoverAndJoin(d); err != nil {
+				log.Printf("Cluster: discovery: %v", err)
+			}
+			select {
+			case <-time.After(interval):
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Cluster) discoverAndJoin(d Discoverer) error {
+	addrs, err := d.Discover()
+	if err != nil {
+		return err
+	}
+	if len(addrs) <= c.NumMembers() {
+		return nil
+	}
+	log.Printf("Cluster: discovered %d node addresses, but only %d members, joining %v", len(addrs), c.NumMembers(), addrs)
+	n, err := c.Memberlist.Join(addrs)
+	if err != nil {
+		return fmt.Errorf("unable to join any of %v: %v", addrs, err)
+	}
+	log.Printf("Cluster: discovery: contacted %d nodes, now %d members.", n, c.NumMembers())
+	return nil
+}
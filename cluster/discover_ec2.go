@@ -0,0 +1,267 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The EC2 instance metadata service, which provides the region and
+// the instance role credentials.
+var ec2MetadataURL = "http://169.254.169.254"
+
+// EC2Discoverer discovers nodes by listing the running EC2 instances
+// tagged with TagKey=TagValue. The node addresses are the private IPs
+// of the instances and Port is the gossip port (0 means the
+// default).
+//
+// The credentials are taken from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+// if set, otherwise from the instance role. Region defaults to
+// AWS_REGION, or the region of the instance.
+type EC2Discoverer struct {
+	Region   string
+	TagKey   string
+	TagValue string
+	Port     int
+	Endpoint string // default is https://ec2.<Region>.amazonaws.com
+	Client   *http.Client
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+}
+
+// The part of the DescribeInstances response we need.
+type ec2DescribeInstancesResponse struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+func (d *EC2Discoverer) Discover() ([]string, error) {
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	region := d.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		r, err := ec2Metadata(client, "/latest/meta-data/placement/region")
+		if err != nil {
+			return nil, fmt.Errorf("ec2: no region given and unable to determine it: %v", err)
+		}
+		region = r
+	}
+	creds, err := ec2Credentials(client)
+	if err != nil {
+		return nil, fmt.Errorf("ec2: no credentials: %v", err)
+	}
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com", region)
+	}
+
+	var result []string
+	var nextToken string
+	for {
+		form := url.Values{
+			"Action":           {"DescribeInstances"},
+			"Version":          {"2016-11-15"},
+			"Filter.1.Name":    {"tag:" + d.TagKey},
+			"Filter.1.Value.1": {d.TagValue},
+			"Filter.2.Name":    {"instance-state-name"},
+			"Filter.2.Value.1": {"running"},
+		}
+		if nextToken != "" {
+			form.Set("NextToken", nextToken)
+		}
+		body := []byte(form.Encode())
+		req, err := http.NewRequest("POST", endpoint+"/", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		signV4(req, body, region, "ec2", creds, time.Now())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		rbody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ec2: DescribeInstances: %s: %s", resp.Status, strings.TrimSpace(string(rbody)))
+		}
+		var dir ec2DescribeInstancesResponse
+		if err := xml.Unmarshal(rbody, &dir); err != nil {
+			return nil, fmt.Errorf("ec2: DescribeInstances: %v", err)
+		}
+		for _, r := range dir.Reservations {
+			for _, i := range r.Instances {
+				if i.PrivateIP != "" {
+					result = append(result, joinAddr(i.PrivateIP, d.Port))
+				}
+			}
+		}
+		if nextToken = dir.NextToken; nextToken == "" {
+			return result, nil
+		}
+	}
+}
+
+// ec2Metadata returns an item of the instance metadata, using an
+// IMDSv2 session token.
+func ec2Metadata(client *http.Client, path string) (string, error) {
+	req, err := http.NewRequest("PUT", ec2MetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := ec2MetadataDo(client, req)
+	if err != nil {
+		return "", err
+	}
+	if req, err = http.NewRequest("GET", ec2MetadataURL+path, nil); err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return ec2MetadataDo(client, req)
+}
+
+func ec2MetadataDo(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func ec2Credentials(client *http.Client) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyId:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	const path = "/latest/meta-data/iam/security-credentials/"
+	role, err := ec2Metadata(client, path)
+	if err != nil {
+		return nil, err
+	}
+	role = strings.SplitN(role, "\n", 2)[0]
+	js, err := ec2Metadata(client, path+role)
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(js), &creds); err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+// signV4 signs req (whose body is body) with AWS Signature Version 4.
+func signV4(req *http.Request, body []byte, region, service string, creds *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	// Canonical headers: host plus every header set above, sorted
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		names = append(names, lk)
+	}
+	sort.Strings(names)
+	var ch bytes.Buffer
+	for _, n := range names {
+		fmt.Fprintf(&ch, "%s:%s\n", n, headers[n])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	creq := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		ch.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	sts := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(creq))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyId, scope, signedHeaders, sig))
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
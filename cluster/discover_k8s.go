@@ -0,0 +1,137 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The service account credentials of a pod running in Kubernetes.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesDiscoverer discovers nodes by listing the running pods
+// matching LabelSelector in Namespace via the Kubernetes API. The
+// node addresses are the pod IPs and Port is the gossip port (0
+// means the default).
+type KubernetesDiscoverer struct {
+	APIServer     string // e.g. "https://10.0.0.1:443"
+	Namespace     string
+	LabelSelector string // e.g. "app=tgres"
+	Port          int
+	TokenFile     string // bearer token, read on every Discover() as it may be rotated
+	Client        *http.Client
+}
+
+// NewKubernetesDiscoverer returns a KubernetesDiscoverer which uses
+// the API server and service account of the pod it is running
+// in. An empty namespace means the namespace of the pod.
+func NewKubernetesDiscoverer(namespace, labelSelector string, port int) (*KubernetesDiscoverer, error) {
+	host, hport := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || hport == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT not set, not running in Kubernetes?")
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	return &KubernetesDiscoverer{
+		APIServer:     "https://" + net.JoinHostPort(host, hport),
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+		Port:          port,
+		TokenFile:     filepath.Join(serviceAccountDir, "token"),
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// The part of the Kubernetes PodList we need.
+type k8sPodList struct {
+	Items []struct {
+		Metadata struct {
+			DeletionTimestamp *string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func (d *KubernetesDiscoverer) Discover() ([]string, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods?labelSelector=%s", d.APIServer, url.PathEscape(d.Namespace), url.QueryEscape(d.LabelSelector))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.TokenFile != "" {
+		token, err := ioutil.ReadFile(d.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("kubernetes: listing pods: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var pods k8sPodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("kubernetes: listing pods: %v", err)
+	}
+	var result []string
+	for _, p := range pods.Items {
+		if p.Status.Phase != "Running" || p.Status.PodIP == "" || p.Metadata.DeletionTimestamp != nil {
+			continue
+		}
+		result = append(result, joinAddr(p.Status.PodIP, d.Port))
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ClusterEventType identifies the kind of a ClusterEvent.
+type ClusterEventType int
+
+const (
+	EventNodeJoin ClusterEventType = iota
+	EventNodeLeave
+	EventNodeUpdate
+	EventTransitionStart
+	EventTransitionEnd
+)
+
+func (t ClusterEventType) String() string {
+	switch t {
+	case EventNodeJoin:
+		return "join"
+	case EventNodeLeave:
+		return "leave"
+	case EventNodeUpdate:
+		return "update"
+	case EventTransitionStart:
+		return "transition-start"
+	case EventTransitionEnd:
+		return "transition-end"
+	}
+	return fmt.Sprintf("ClusterEventType(%d)", int(t))
+}
+
+// ClusterEvent describes something that happened in the
+// cluster. Node events carry the name and address of the node in
+// question, transition events carry the local node. Err is only set
+// on EventTransitionEnd if the transition failed.
+type ClusterEvent struct {
+	Type     ClusterEventType
+	Time     time.Time
+	NodeName string
+	NodeAddr net.IP
+	NodePort uint16
+	Err      error
+}
+
+func (e ClusterEvent) String() string {
+	s := fmt.Sprintf("%s %s node %s (%s)", e.Time.Format(time.RFC3339), e.Type, e.NodeName, net.JoinHostPort(e.NodeAddr.String(), fmt.Sprint(e.NodePort)))
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+const eventChanSize = 64
+
+// eventHub keeps track of the channels returned by
+// NotifyClusterChanges() and Subscribe(), as well as the membership
+// epoch. It is shared by Cluster and FakeCluster.
+type eventHub struct {
+	epoch     uint64 // accessed atomically, must be first (64-bit alignment)
+	mu        sync.Mutex
+	chgNotify []chan bool
+	subs      []chan ClusterEvent
+}
+
+// Epoch returns the membership epoch, a number which is incremented
+// on every cluster change (i.e. every time NotifyClusterChanges()
+// channels are notified). DistDatum assignments record the epoch
+// they were computed in, see NodesForDistDatumChecked().
+func (h *eventHub) Epoch() uint64 {
+	return atomic.LoadUint64(&h.epoch)
+}
+
+// NotifyClusterChanges returns a bool channel which will be sent true
+// any time a cluster change happens (nodes join or leave, or node
+// metadata changes).
+func (h *eventHub) NotifyClusterChanges() chan bool {
+	ch := make(chan bool, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.chgNotify = append(h.chgNotify, ch)
+	return ch
+}
+
+func (h *eventHub) notifyAll() {
+	atomic.AddUint64(&h.epoch, 1)
+	defer func() { recover() }() // in case ch is now closed
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.chgNotify {
+		if len(ch) < cap(ch) {
+			ch <- true
+		}
+	}
+}
+
+// Subscribe returns a channel of ClusterEvents. Unlike
+// NotifyClusterChanges(), every event is delivered as long as the
+// subscriber keeps up; if the channel buffer is full, events are
+// dropped rather than block the cluster.
+func (h *eventHub) Subscribe() <-chan ClusterEvent {
+	ch := make(chan ClusterEvent, eventChanSize)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs = append(h.subs, ch)
+	return ch
+}
+
+func (h *eventHub) publish(t ClusterEventType, n *memberlist.Node, err error) {
+	e := ClusterEvent{Type: t, Time: time.Now(), Err: err}
+	if n != nil {
+		e.NodeName, e.NodeAddr, e.NodePort = n.Name, n.Addr, n.Port
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,462 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Clusterer is the interface to the cluster as seen by the
+// application. It is implemented by Cluster and FakeCluster, code
+// which uses Clusterer rather than *Cluster can be unit tested
+// without real sockets.
+type Clusterer interface {
+	RegisterMsgType() (snd, rcv chan *Msg)
+	SendBatch(dst *Node, msgs []*Msg) error
+	LoadDistData(f func() ([]DistDatum, error)) error
+	NodesForDistDatum(dd DistDatum) []*Node
+	NodesForDistDatumChecked(dd DistDatum) (nodes []*Node, stale bool)
+	AnyNodeForDistDatum(dd DistDatum, preferLocal bool) *Node
+	ReportNodeFailure(n *Node)
+	FencingToken(dd DistDatum) uint64
+	Transition(timeout time.Duration) error
+	OnBeforeTransition(typ string, f func())
+	OnAfterTransition(typ string, f func(err error))
+	Ready(status bool) error
+	SetTags(tags map[string]string) error
+	SetPlacementFilter(f NodeFilter)
+	LocalNode() *Node
+	Members() []*Node
+	NumMembers() int
+	NotifyClusterChanges() chan bool
+	Subscribe() <-chan ClusterEvent
+	Broadcast(payload interface{}) error
+	Broadcasts() <-chan *Msg
+	AcquireLock(name string, ttl time.Duration) (*Lock, error)
+	ExportAssignments() ([]byte, error)
+	ImportAssignments(data []byte) error
+	Leave(timeout time.Duration) error
+	Shutdown() error
+}
+
+var (
+	_ Clusterer = &Cluster{}
+	_ Clusterer = &FakeCluster{}
+)
+
+// FakeNetwork connects FakeClusters within a single process. Each
+// FakeCluster is a node, messages between them are passed via
+// channels and membership is controlled by the test: nodes join when
+// created with NewCluster() and leave with Leave() (or, to simulate
+// a failure, Shutdown()). As with a real cluster, every membership
+// or readiness change is announced to all the members, and it is up
+// to the application to call Transition() on each.
+type FakeNetwork struct {
+	sync.Mutex
+	nodes []*FakeCluster // in the order of joining
+	fi    *faultInjector
+	locks lockTable
+}
+
+// NewFakeNetwork returns an empty FakeNetwork.
+func NewFakeNetwork() *FakeNetwork {
+	return &FakeNetwork{fi: newFaultInjector()}
+}
+
+// InjectFaults sets the faults for all Msg deliveries between nodes
+// of the network, e.g. to verify that transitions cope with lost
+// relinquish messages.
+func (fn *FakeNetwork) InjectFaults(f Faults) {
+	fn.fi.set(f)
+}
+
+// Flap simulates a node flapping: it leaves the network (as far as
+// the other members are concerned) and rejoins after down. It returns
+// immediately.
+func (fn *FakeNetwork) Flap(fc *FakeCluster, down time.Duration) {
+	if !fn.remove(fc) {
+		return
+	}
+	fn.announce(EventNodeLeave, fc.node)
+	go func() {
+		time.Sleep(down)
+		fn.Lock()
+		fn.nodes = append(fn.nodes, fc)
+		// keep the original order, as SortedNodes() would
+		sort.SliceStable(fn.nodes, func(i, j int) bool {
+			mi, _ := fn.nodes[i].node.extractMeta()
+			mj, _ := fn.nodes[j].node.extractMeta()
+			return mi.sortBy < mj.sortBy
+		})
+		fn.Unlock()
+		fn.announce(EventNodeJoin, fc.node)
+	}()
+}
+
+// NewCluster creates a FakeCluster which is a member of the network.
+// Names must be unique within the network.
+func (fn *FakeNetwork) NewCluster(name string) *FakeCluster {
+	return fn.newCluster(name, net.IPv4(127, 0, 0, 1))
+}
+
+func (fn *FakeNetwork) newCluster(name string, addr net.IP) *FakeCluster {
+	fn.Lock()
+	md := &nodeMeta{sortBy: int64(len(fn.nodes)), version: ProtocolVersion, minVersion: MinProtocolVersion}
+	fc := &FakeCluster{
+		fn:      fn,
+		node:    &Node{Node: &memberlist.Node{Name: name, Addr: addr, Meta: md.bytes()}},
+		dds:     make(map[string]*ddEntry),
+		copies:  1,
+		bcastCh: make(chan *Msg, 128),
+	}
+	fn.nodes = append(fn.nodes, fc)
+	fn.Unlock()
+
+	fc.snd, fc.rcv = fc.RegisterMsgType()
+	fn.announce(EventNodeJoin, fc.node)
+	return fc
+}
+
+func (fn *FakeNetwork) members() []*FakeCluster {
+	fn.Lock()
+	defer fn.Unlock()
+	return append([]*FakeCluster{}, fn.nodes...)
+}
+
+func (fn *FakeNetwork) find(name string) *FakeCluster {
+	for _, fc := range fn.members() {
+		if fc.node.Name() == name {
+			return fc
+		}
+	}
+	return nil
+}
+
+func (fn *FakeNetwork) remove(fc *FakeCluster) bool {
+	fn.Lock()
+	defer fn.Unlock()
+	for i, n := range fn.nodes {
+		if n == fc {
+			fn.nodes = append(fn.nodes[:i], fn.nodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// announce tells every member about a change concerning node n.
+func (fn *FakeNetwork) announce(t ClusterEventType, n *Node) {
+	for _, fc := range fn.members() {
+		fc.publish(t, n.Node, nil)
+		fc.notifyAll()
+	}
+}
+
+// FakeCluster is an in-memory implementation of Clusterer. It shares
+// the DistDatum assignment and transition logic with Cluster, so
+// Relinquish() and Acquire() are called exactly as they would be in
+// a real cluster.
+type FakeCluster struct {
+	eventHub // first, its epoch is accessed atomically
+	sync.RWMutex
+	transitionHooks
+	fn       *FakeNetwork
+	node     *Node
+	rcvChs   []chan *Msg
+	rcvLock  sync.RWMutex // for rcvChs, fc is locked during Transition()
+	dds      map[string]*ddEntry
+	snd, rcv chan *Msg // dds messages
+	copies   int
+	bcastCh  chan *Msg
+	health   replicaHealth
+	place    NodeFilter
+	unsafe   unsafeMoves
+	acquire  acquirer            // see SetAcquireConcurrency()
+	pins     map[string][]string // see ImportAssignments()
+}
+
+// Copies sets the number of copies (only possible while no data is
+// loaded) and returns it. See Cluster.Copies().
+func (fc *FakeCluster) Copies(n ...int) int {
+	if len(n) > 0 && len(fc.dds) == 0 {
+		fc.copies = n[0]
+	}
+	return fc.copies
+}
+
+// RegisterMsgType works the same way as Cluster.RegisterMsgType(),
+// except that messages are delivered via channels.
+func (fc *FakeCluster) RegisterMsgType() (snd, rcv chan *Msg) {
+	snd, rcv = make(chan *Msg, 128), make(chan *Msg, 128)
+
+	fc.rcvLock.Lock()
+	fc.rcvChs = append(fc.rcvChs, rcv)
+	id := len(fc.rcvChs) - 1
+	fc.rcvLock.Unlock()
+
+	go func() {
+		for msg := range snd {
+			if msg.Dst == nil {
+				log.Printf("FakeCluster: cannot send message when Dst is not set, ignoring.")
+				continue
+			}
+			dst := fc.fn.find(msg.Dst.Name())
+			if dst == nil {
+				log.Printf("FakeCluster: node %s is not a member, dropping this message.", msg.Dst.Name())
+				continue
+			}
+			dst.rcvLock.RLock()
+			var ch chan *Msg
+			if id < len(dst.rcvChs) {
+				ch = dst.rcvChs[id]
+			}
+			dst.rcvLock.RUnlock()
+			if ch == nil {
+				log.Printf("FakeCluster: unknown msg Id: %d, dropping message", id)
+				continue
+			}
+			msg.Src, msg.Id = fc.node, id
+			fc.fn.fi.deliver(func() { ch <- msg })
+		}
+	}()
+
+	return snd, rcv
+}
+
+// SendBatch delivers the messages to dst, subject to the faults
+// injected into the network. See Cluster.SendBatch().
+func (fc *FakeCluster) SendBatch(dst *Node, msgs []*Msg) error {
+	m := fc.fn.find(dst.Name())
+	if m == nil {
+		return fmt.Errorf("node %s is not a member", dst.Name())
+	}
+	m.rcvLock.RLock()
+	chs := m.rcvChs
+	m.rcvLock.RUnlock()
+	for _, msg := range msgs {
+		if msg.Id < 0 || msg.Id >= len(chs) {
+			log.Printf("FakeCluster: unknown msg Id: %d, dropping message", msg.Id)
+			continue
+		}
+		msg.Src, msg.Dst = fc.node, m.node
+		ch, msg := chs[msg.Id], msg
+		fc.fn.fi.deliver(func() { ch <- msg })
+	}
+	return nil
+}
+
+// Broadcast delivers the payload to all the other members, subject
+// to the faults injected into the network. See Cluster.Broadcast().
+func (fc *FakeCluster) Broadcast(payload interface{}) error {
+	for _, m := range fc.fn.members() {
+		if m == fc {
+			continue
+		}
+		msg, err := NewMsg(m.node, payload)
+		if err != nil {
+			return err
+		}
+		msg.Src, msg.Id = fc.node, broadcastMsgId
+		ch := m.bcastCh
+		fc.fn.fi.deliver(func() { deliverBroadcast(ch, msg) })
+	}
+	return nil
+}
+
+// AcquireLock is the same as Cluster.AcquireLock(), the locks are
+// kept by the network.
+func (fc *FakeCluster) AcquireLock(name string, ttl time.Duration) (*Lock, error) {
+	call := func(a *LockArgs) (*LockReply, error) {
+		return fc.fn.locks.do(a, time.Now()), nil
+	}
+	return acquireLock(call, name, fc.node.Name(), ttl)
+}
+
+// Broadcasts is the same as Cluster.Broadcasts().
+func (fc *FakeCluster) Broadcasts() <-chan *Msg {
+	return fc.bcastCh
+}
+
+func (fc *FakeCluster) readyNodes() []*Node {
+	fc.fn.Lock() // Ready() modifies node metadata under this lock
+	defer fc.fn.Unlock()
+	var nodes []*Node
+	for _, m := range fc.fn.nodes {
+		if m.node.Ready() {
+			nodes = append(nodes, m.node)
+		}
+	}
+	return nodes
+}
+
+// LoadDistData is the same as Cluster.LoadDistData().
+func (fc *FakeCluster) LoadDistData(f func() ([]DistDatum, error)) error {
+	fc.Lock()
+	defer fc.Unlock()
+
+	dds, err := f()
+	if err != nil {
+		return err
+	}
+	epoch := fc.Epoch()
+	addDistData(fc.dds, dds, filterNodes(fc.readyNodes(), fc.place), fc.node, fc.copies, epoch, fc.pins)
+	return nil
+}
+
+// NodesForDistDatum is the same as Cluster.NodesForDistDatum().
+func (fc *FakeCluster) NodesForDistDatum(dd DistDatum) []*Node {
+	fc.RLock()
+	defer fc.RUnlock()
+	if dde, ok := fc.dds[ddKey(dd)]; ok {
+		return dde.nodes
+	}
+	return nil
+}
+
+// NodesForDistDatumChecked is the same as Cluster.NodesForDistDatumChecked().
+func (fc *FakeCluster) NodesForDistDatumChecked(dd DistDatum) (nodes []*Node, stale bool) {
+	fc.RLock()
+	defer fc.RUnlock()
+	if dde, ok := fc.dds[ddKey(dd)]; ok {
+		return dde.nodes, dde.epoch != fc.Epoch()
+	}
+	return nil, false
+}
+
+// AnyNodeForDistDatum is the same as Cluster.AnyNodeForDistDatum().
+func (fc *FakeCluster) AnyNodeForDistDatum(dd DistDatum, preferLocal bool) *Node {
+	ready := make(map[string]bool)
+	for _, n := range fc.readyNodes() {
+		ready[n.Name()] = true
+	}
+	live := func(n *Node) bool {
+		return ready[n.Name()]
+	}
+	return pickReplica(fc.NodesForDistDatum(dd), live, &fc.health, fc.node, preferLocal, time.Now())
+}
+
+// ReportNodeFailure is the same as Cluster.ReportNodeFailure().
+func (fc *FakeCluster) ReportNodeFailure(n *Node) {
+	fc.health.report(n.Name(), time.Now().Add(replicaPenalty))
+}
+
+// FencingToken is the same as Cluster.FencingToken().
+func (fc *FakeCluster) FencingToken(dd DistDatum) uint64 {
+	fc.RLock()
+	defer fc.RUnlock()
+	if dde, ok := fc.dds[ddKey(dd)]; ok {
+		return dde.token
+	}
+	return 0
+}
+
+// Transition is the same as Cluster.Transition(). Note that for the
+// transition to complete without a timeout, every member must
+// transition concurrently.
+func (fc *FakeCluster) Transition(timeout time.Duration) (err error) {
+	fc.publish(EventTransitionStart, fc.node.Node, nil)
+	fc.RLock()
+	types := ddTypes(fc.dds)
+	fc.RUnlock()
+	fc.runBefore(types)
+	defer func() {
+		fc.runAfter(types, err)
+		fc.publish(EventTransitionEnd, fc.node.Node, err)
+	}()
+
+	fc.Lock()
+	defer fc.Unlock()
+	epoch := fc.Epoch()
+	return transition(fc.dds, filterNodes(fc.readyNodes(), fc.place), fc.node, fc.copies, true, epoch, fc.snd, fc.rcv, timeout, &fc.unsafe, &fc.acquire, fc.pins)
+}
+
+// Ready sets the readiness of the node and announces it to the
+// members.
+func (fc *FakeCluster) Ready(status bool) error {
+	md, err := fc.node.extractMeta()
+	if err != nil {
+		return err
+	}
+	md.ready = status
+	fc.fn.Lock()
+	fc.node.Node.Meta = md.bytes()
+	fc.fn.Unlock()
+	fc.fn.announce(EventNodeUpdate, fc.node)
+	return nil
+}
+
+// SetTags is the same as Cluster.SetTags().
+func (fc *FakeCluster) SetTags(tags map[string]string) error {
+	md, err := fc.node.extractMeta()
+	if err != nil {
+		return err
+	}
+	md.tags = tags
+	meta := md.bytes()
+	if err := checkMetaSize(meta); err != nil {
+		return err
+	}
+	fc.fn.Lock()
+	fc.node.Node.Meta = meta
+	fc.fn.Unlock()
+	fc.fn.announce(EventNodeUpdate, fc.node)
+	return nil
+}
+
+// SetPlacementFilter is the same as Cluster.SetPlacementFilter().
+func (fc *FakeCluster) SetPlacementFilter(f NodeFilter) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.place = f
+}
+
+func (fc *FakeCluster) LocalNode() *Node { return fc.node }
+
+func (fc *FakeCluster) Members() []*Node {
+	var nodes []*Node
+	for _, m := range fc.fn.members() {
+		nodes = append(nodes, m.node)
+	}
+	return nodes
+}
+
+func (fc *FakeCluster) NumMembers() int { return len(fc.fn.members()) }
+
+// Leave removes the node from the network and announces it to the
+// remaining members.
+func (fc *FakeCluster) Leave(timeout time.Duration) error {
+	if !fc.fn.remove(fc) {
+		return fmt.Errorf("FakeCluster: node %s is not a member", fc.node.Name())
+	}
+	fc.fn.announce(EventNodeLeave, fc.node)
+	return nil
+}
+
+// Shutdown is the same as Leave() if the node has not left yet, which
+// simulates a node failure.
+func (fc *FakeCluster) Shutdown() error {
+	if fc.fn.remove(fc) {
+		fc.fn.announce(EventNodeLeave, fc.node)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"log"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// How often the RPC endpoint of the other nodes is pinged,
+	// unless set in ClusterConfig.
+	healthCheckInterval = 5 * time.Second
+	// How many consecutive failed pings mark a node unhealthy.
+	healthCheckFailures = 2
+)
+
+// rpcHealth keeps track of nodes whose RPC endpoint does not answer
+// pings. Gossip only tells us that a node is alive, not that it can
+// receive data: its RPC listener could be wedged, firewalled or
+// overloaded. Unhealthy nodes are left out of readyNodes() so that
+// no DistDatums are assigned to them.
+type rpcHealth struct {
+	sync.Mutex
+	failures map[string]int
+	down     map[string]bool
+}
+
+// report records the result of a ping and returns true if this
+// changed whether the node is healthy.
+func (h *rpcHealth) report(name string, ok bool) bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.failures == nil {
+		h.failures, h.down = make(map[string]int), make(map[string]bool)
+	}
+	if ok {
+		delete(h.failures, name)
+		if h.down[name] {
+			delete(h.down, name)
+			return true
+		}
+		return false
+	}
+	h.failures[name]++
+	if h.failures[name] >= healthCheckFailures && !h.down[name] {
+		h.down[name] = true
+		return true
+	}
+	return false
+}
+
+func (h *rpcHealth) isDown(name string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.down[name]
+}
+
+// forget drops the state of nodes which are no longer members.
+func (h *rpcHealth) forget(members map[string]bool) {
+	h.Lock()
+	defer h.Unlock()
+	for name := range h.failures {
+		if !members[name] {
+			delete(h.failures, name)
+		}
+	}
+	for name := range h.down {
+		if !members[name] {
+			delete(h.down, name)
+		}
+	}
+}
+
+func (h *rpcHealth) list() []string {
+	h.Lock()
+	defer h.Unlock()
+	var result []string
+	for name := range h.down {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Unhealthy returns the names of the nodes which are members of the
+// cluster, but whose RPC endpoint failed the last health checks.
+func (c *Cluster) Unhealthy() []string {
+	return c.rpcHealth.list()
+}
+
+// healthCheck pings the other nodes every interval until Shutdown.
+func (c *Cluster) healthCheck(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.pingNodes()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// pingNodes pings all the other nodes (in parallel) and waits for the
+// results. If any node became healthy or unhealthy, cluster change
+// notifications are sent so that DistDatums are reassigned.
+func (c *Cluster) pingNodes() {
+	nodes, err := c.SortedNodes()
+	if err != nil {
+		log.Printf("Cluster: health check: %v", err)
+		return
+	}
+	local := c.LocalNode().Name()
+	members := make(map[string]bool, len(nodes))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		changed bool
+	)
+	for _, n := range nodes {
+		members[n.Name()] = true
+		if n.Name() == local {
+			continue
+		}
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			var reply string
+			err := c.call(n, "ClusterRPC.Ping", local, &reply)
+			if _, ok := err.(rpc.ServerError); ok {
+				// it responded, e.g. an older node without Ping
+				err = nil
+			}
+			if c.rpcHealth.report(n.Name(), err == nil) {
+				if err != nil {
+					log.Printf("Cluster: node %s failed %d health checks in a row, it will not be assigned data: %v", n.Name(), healthCheckFailures, err)
+				} else {
+					log.Printf("Cluster: node %s passed a health check, it can be assigned data again.", n.Name())
+				}
+				c.publish(EventNodeUpdate, n.Node, err)
+				mu.Lock()
+				changed = true
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	c.rpcHealth.forget(members)
+	if changed {
+		c.notifyAll()
+	}
+}
+
+// Ping is the RPC used by the health check, it replies with the name
+// of this node.
+func (rpc *ClusterRPC) Ping(from string, reply *string) error {
+	srv := rpc.c.rpcSrv
+	if err := srv.beginCall(); err != nil {
+		return err
+	}
+	defer srv.endCall()
+	*reply = rpc.c.LocalNode().Name()
+	return nil
+}
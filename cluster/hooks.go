@@ -0,0 +1,99 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"sort"
+	"sync"
+)
+
+// transitionHooks keeps the callbacks registered with
+// OnBeforeTransition() and OnAfterTransition() by DistDatum type. It
+// is shared by Cluster and FakeCluster.
+type transitionHooks struct {
+	hmu    sync.Mutex
+	before map[string][]func()
+	after  map[string][]func(error)
+}
+
+// OnBeforeTransition registers f to be called at the start of every
+// Transition() if there are DistDatums of type typ (as returned by
+// their Type()), before any of them are relinquished or acquired.
+// This way the application can e.g. pause processing the DistDatums
+// of a type while their assignment is changing, rather than guess it
+// from NotifyClusterChanges(). Callbacks run in the goroutine calling
+// Transition() with no cluster locks held, so they may use the
+// cluster, but should not block for long.
+func (h *transitionHooks) OnBeforeTransition(typ string, f func()) {
+	h.hmu.Lock()
+	defer h.hmu.Unlock()
+	if h.before == nil {
+		h.before = make(map[string][]func())
+	}
+	h.before[typ] = append(h.before[typ], f)
+}
+
+// OnAfterTransition registers f to be called at the end of every
+// Transition() for which the OnBeforeTransition() callbacks of typ
+// were called, once the DistDatums are assigned to their new nodes,
+// with the error Transition() returns, if any.
+func (h *transitionHooks) OnAfterTransition(typ string, f func(err error)) {
+	h.hmu.Lock()
+	defer h.hmu.Unlock()
+	if h.after == nil {
+		h.after = make(map[string][]func(error))
+	}
+	h.after[typ] = append(h.after[typ], f)
+}
+
+func (h *transitionHooks) runBefore(types []string) {
+	h.hmu.Lock()
+	var fns []func()
+	for _, typ := range types {
+		fns = append(fns, h.before[typ]...)
+	}
+	h.hmu.Unlock()
+	for _, f := range fns {
+		f()
+	}
+}
+
+func (h *transitionHooks) runAfter(types []string, err error) {
+	h.hmu.Lock()
+	var fns []func(error)
+	for _, typ := range types {
+		fns = append(fns, h.after[typ]...)
+	}
+	h.hmu.Unlock()
+	for _, f := range fns {
+		f(err)
+	}
+}
+
+// ddTypes returns the sorted distinct types of the DistDatums in
+// dds. The caller must hold the lock protecting dds.
+func ddTypes(dds map[string]*ddEntry) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, dde := range dds {
+		if typ := dde.dd.Type(); !seen[typ] {
+			seen[typ] = true
+			types = append(types, typ)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,212 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLocked is returned by AcquireLock() when the lock is held by
+// another node.
+var ErrLocked = errors.New("cluster: lock is held by another node")
+
+// Operations of a LockArgs
+const (
+	lockAcquire = iota
+	lockRefresh
+	lockRelease
+)
+
+// LockArgs and LockReply are what is passed by the ClusterRPC.Lock
+// call, they are only exported because net/rpc requires it.
+type LockArgs struct {
+	Op     int
+	Name   string
+	Holder string
+	TTL    time.Duration
+	Token  uint64
+}
+
+type LockReply struct {
+	Ok     bool
+	Holder string
+	Token  uint64
+}
+
+type lockEntry struct {
+	holder  string
+	token   uint64
+	expires time.Time
+}
+
+// lockTable is where the lock master keeps the locks.
+type lockTable struct {
+	sync.Mutex
+	locks map[string]*lockEntry
+	token uint64 // last issued
+}
+
+func (lt *lockTable) do(a *LockArgs, now time.Time) *LockReply {
+	lt.Lock()
+	defer lt.Unlock()
+	if lt.locks == nil {
+		lt.locks = make(map[string]*lockEntry)
+	}
+
+	e := lt.locks[a.Name]
+	if e != nil && now.After(e.expires) {
+		delete(lt.locks, a.Name)
+		e = nil
+	}
+
+	switch a.Op {
+	case lockAcquire:
+		if e != nil {
+			return &LockReply{Holder: e.holder}
+		}
+		lt.token = nextToken(lt.token)
+		lt.locks[a.Name] = &lockEntry{holder: a.Holder, token: lt.token, expires: now.Add(a.TTL)}
+		return &LockReply{Ok: true, Holder: a.Holder, Token: lt.token}
+	case lockRefresh:
+		if e == nil || e.token != a.Token {
+			return &LockReply{}
+		}
+		e.expires = now.Add(a.TTL)
+		return &LockReply{Ok: true, Holder: e.holder, Token: e.token}
+	case lockRelease:
+		if e == nil || e.token != a.Token {
+			return &LockReply{}
+		}
+		delete(lt.locks, a.Name)
+		return &LockReply{Ok: true, Holder: e.holder, Token: e.token}
+	}
+	return &LockReply{}
+}
+
+// Lock is a cluster-wide lock acquired with AcquireLock().
+type Lock struct {
+	call  func(*LockArgs) (*LockReply, error)
+	name  string
+	node  string
+	ttl   time.Duration
+	token uint64
+}
+
+func acquireLock(call func(*LockArgs) (*LockReply, error), name, node string, ttl time.Duration) (*Lock, error) {
+	reply, err := call(&LockArgs{Op: lockAcquire, Name: name, Holder: node, TTL: ttl})
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Ok {
+		return nil, ErrLocked
+	}
+	return &Lock{call: call, name: name, node: node, ttl: ttl, token: reply.Token}, nil
+}
+
+// Token returns the fencing token of the lock. Tokens increase with
+// every grant, see FencingToken() for how they can be used.
+func (l *Lock) Token() uint64 { return l.token }
+
+// Refresh extends the lock by its ttl. It returns an error if the
+// lock is no longer held, i.e. it expired and was acquired by
+// another node, or the lock master changed.
+func (l *Lock) Refresh() error {
+	reply, err := l.call(&LockArgs{Op: lockRefresh, Name: l.name, Holder: l.node, TTL: l.ttl, Token: l.token})
+	if err != nil {
+		return err
+	}
+	if !reply.Ok {
+		return fmt.Errorf("cluster: lock %q is no longer held", l.name)
+	}
+	return nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	reply, err := l.call(&LockArgs{Op: lockRelease, Name: l.name, Holder: l.node, Token: l.token})
+	if err != nil {
+		return err
+	}
+	if !reply.Ok {
+		return fmt.Errorf("cluster: lock %q is no longer held", l.name)
+	}
+	return nil
+}
+
+// AcquireLock acquires a cluster-wide lock by name, e.g. so that a
+// task such as a schema migration runs on only one node at a time. It
+// does not wait: if the lock is held by another node (or this one),
+// it returns ErrLocked. Unless refreshed, the lock expires after ttl,
+// so that it is not held forever by a node that died.
+//
+// The locks are kept by the lock master, which is the first of
+// SortedNodes() (normally the oldest node), the other nodes ask it
+// via RPC. If the lock master leaves the cluster, the locks it
+// granted are lost and can be acquired again before their ttl
+// expires. Use Token() for fencing if this matters.
+func (c *Cluster) AcquireLock(name string, ttl time.Duration) (*Lock, error) {
+	return acquireLock(c.lockCall, name, c.LocalNode().Name(), ttl)
+}
+
+func (c *Cluster) lockMaster() (*Node, error) {
+	nodes, err := c.SortedNodes()
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("cluster: no nodes")
+	}
+	return nodes[0], nil
+}
+
+func (c *Cluster) lockCall(args *LockArgs) (*LockReply, error) {
+	master, err := c.lockMaster()
+	if err != nil {
+		return nil, err
+	}
+	if master.Name() == c.LocalNode().Name() {
+		return c.locks.do(args, time.Now()), nil
+	}
+	var reply LockReply
+	if err := c.call(master, "ClusterRPC.Lock", args, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Lock is the RPC used by AcquireLock() and Lock methods.
+func (rpc *ClusterRPC) Lock(args LockArgs, reply *LockReply) error {
+	srv := rpc.c.rpcSrv
+	if err := srv.beginCall(); err != nil {
+		return err
+	}
+	defer srv.endCall()
+
+	// The requester's view of the cluster may differ from ours, in
+	// which case it should retry later.
+	master, err := rpc.c.lockMaster()
+	if err != nil {
+		return err
+	}
+	if master.Name() != rpc.c.LocalNode().Name() {
+		return fmt.Errorf("cluster: %s is not the lock master, %s is", rpc.c.LocalNode().Name(), master.Name())
+	}
+	*reply = *rpc.c.locks.do(&args, time.Now())
+	return nil
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// MetaSizeError is returned when the node metadata (the internal
+// part, including tags, plus the user part) would exceed what
+// memberlist allows, MetaMaxSize bytes.
+type MetaSizeError struct {
+	Size, Max int
+}
+
+func (e *MetaSizeError) Error() string {
+	return fmt.Sprintf("node metadata too large (%d bytes, max is %d), use less user metadata or fewer or shorter tags", e.Size, e.Max)
+}
+
+func checkMetaSize(meta []byte) error {
+	if len(meta) > memberlist.MetaMaxSize {
+		return &MetaSizeError{Size: len(meta), Max: memberlist.MetaMaxSize}
+	}
+	return nil
+}
+
+// Metadata flags, since version 6.
+const (
+	mdFlagCompressed = 1 << iota // the user part is flate compressed
+)
+
+// The user part is only compressed if it is at least this long,
+// shorter ones rarely get any smaller.
+const minCompressMetaLen = 64
+
+// The most a compressed user part may decompress to, which is
+// generous given MetaMaxSize, but keeps a broken or malicious node
+// from making us allocate without bounds.
+const maxDecompressedMetaLen = 64 * 1024
+
+// compressMeta returns the compressed user metadata, or nil if it is
+// too short or compressing it does not make it smaller.
+func compressMeta(user []byte) []byte {
+	if len(user) < minCompressMetaLen {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(user)
+	w.Close()
+	if buf.Len() >= len(user) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompressMeta(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	user, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedMetaLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(user) > maxDecompressedMetaLen {
+		return nil, fmt.Errorf("decompressed user metadata exceeds %d bytes", maxDecompressedMetaLen)
+	}
+	return user, nil
+}
+
+// UserMetaBudget returns how many bytes of user metadata can be set
+// with SetMetaData() given the internal metadata (including tags) of
+// the local node. With ClusterConfig.CompressMeta more may fit,
+// depending on how well it compresses.
+func (c *Cluster) UserMetaBudget() int {
+	md, err := c.extractMeta()
+	if err != nil {
+		return 0
+	}
+	md.user, md.compress = nil, false
+	if n := memberlist.MetaMaxSize - len(md.bytes()); n > 0 {
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var (
+	// How long queued messages are kept, unless set in
+	// ClusterConfig.
+	offlineQueueTTL = time.Minute
+	// How often sending the queued messages is retried.
+	offlineRetryInterval = time.Second
+)
+
+// offlineQueue keeps the messages which could not be sent to a node
+// because it was unreachable, so that they can be sent once it is
+// back, rather than dropped. It is bounded: at most size messages are
+// kept per node (the oldest are dropped first) and for at most ttl.
+type offlineQueue struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	nodes map[string][]*Msg // by node name, oldest first
+
+	dropped, expired, redelivered uint64 // since start
+}
+
+func newOfflineQueue(size int, ttl time.Duration) *offlineQueue {
+	if ttl <= 0 {
+		ttl = offlineQueueTTL
+	}
+	return &offlineQueue{size: size, ttl: ttl, nodes: make(map[string][]*Msg)}
+}
+
+// add queues msgs for the node. Messages which were queued before
+// keep their original time, so that retrying does not extend their
+// life.
+func (q *offlineQueue) add(name string, msgs []*Msg, now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	for _, m := range msgs {
+		if m.queuedAt.IsZero() {
+			m.queuedAt = now
+		}
+	}
+	queued := append(q.nodes[name], msgs...)
+	if n := len(queued) - q.size; n > 0 {
+		q.dropped += uint64(n)
+		queued = queued[n:]
+	}
+	q.nodes[name] = queued
+}
+
+// take removes and returns the unexpired messages for the node.
+func (q *offlineQueue) take(name string, now time.Time) []*Msg {
+	q.Lock()
+	defer q.Unlock()
+	queued := q.nodes[name]
+	delete(q.nodes, name)
+	result := make([]*Msg, 0, len(queued))
+	for _, m := range queued {
+		if now.Sub(m.queuedAt) > q.ttl {
+			q.expired++
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// names returns the names of the nodes with queued messages.
+func (q *offlineQueue) names() []string {
+	q.Lock()
+	defer q.Unlock()
+	names := make([]string, 0, len(q.nodes))
+	for name := range q.nodes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (q *offlineQueue) delivered(n int) {
+	q.Lock()
+	q.redelivered += uint64(n)
+	q.Unlock()
+}
+
+func (q *offlineQueue) stats() (queued int, dropped, expired, redelivered uint64) {
+	if q == nil {
+		return 0, 0, 0, 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	for _, msgs := range q.nodes {
+		queued += len(msgs)
+	}
+	return queued, q.dropped, q.expired, q.redelivered
+}
+
+// isOffline returns true if err means that the node could not be
+// reached, as opposed to an error returned by the node itself, in
+// which case retrying would not help.
+func isOffline(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return err != nil && !ok
+}
+
+// retryOffline periodically sends the queued messages of the nodes
+// which are members of the cluster, until c.stop is closed. Messages
+// which fail again are queued again.
+func (c *Cluster) retryOffline(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-tick.C:
+		}
+
+		members := make(map[string]*Node)
+		for _, n := range c.Members() {
+			members[n.Name()] = n
+		}
+		for _, name := range c.offline.names() {
+			dst := members[name]
+			if dst == nil {
+				// not (yet) back, let them expire
+				continue
+			}
+			msgs := c.offline.take(name, time.Now())
+			if len(msgs) == 0 {
+				continue
+			}
+			for _, m := range msgs {
+				m.Dst = dst // the node may have rejoined
+			}
+			log.Printf("Cluster: retrying %d queued messages to %s.", len(msgs), name)
+			c.sendQueued(msgs)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+// How many relinquish notifications go in one message at most.
+var relinquishBatchSize = 1024
+
+// relinquishBatcher collects the relinquish notifications (see
+// Transition()) for each destination node and sends them as messages
+// of up to relinquishBatchSize newline separated entries, instead of
+// one message per DistDatum. Nodes older than protocol version 5 are
+// sent one message per DistDatum as before.
+type relinquishBatcher struct {
+	sync.Mutex
+	snd     chan *Msg
+	pending map[string]*relinquishBatch // by node name
+}
+
+type relinquishBatch struct {
+	dst     *Node
+	entries [][]byte
+}
+
+func newRelinquishBatcher(snd chan *Msg) *relinquishBatcher {
+	return &relinquishBatcher{snd: snd, pending: make(map[string]*relinquishBatch)}
+}
+
+// add queues entry for dst, sending the batch if it is full.
+func (b *relinquishBatcher) add(dst *Node, entry []byte) {
+	if dst.ProtocolVersion() < 5 {
+		b.snd <- &Msg{Dst: dst, Body: entry}
+		return
+	}
+	b.Lock()
+	rb := b.pending[dst.Name()]
+	if rb == nil {
+		rb = &relinquishBatch{dst: dst}
+		b.pending[dst.Name()] = rb
+	}
+	rb.entries = append(rb.entries, entry)
+	if len(rb.entries) < relinquishBatchSize {
+		b.Unlock()
+		return
+	}
+	delete(b.pending, dst.Name())
+	b.Unlock()
+	b.send(rb)
+}
+
+// flush sends whatever is pending.
+func (b *relinquishBatcher) flush() {
+	b.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*relinquishBatch)
+	b.Unlock()
+	for _, rb := range pending {
+		b.send(rb)
+	}
+}
+
+func (b *relinquishBatcher) send(rb *relinquishBatch) {
+	log.Printf("Transition(): Sending %d relinquishes to node %s", len(rb.entries), rb.dst.Name())
+	b.snd <- &Msg{Dst: rb.dst, Body: bytes.Join(rb.entries, []byte("\n"))}
+}
+
+// splitRelinquishMsg returns the entries of a (possibly batched)
+// relinquish message body, see parseRelinquishMsg() for their format.
+func splitRelinquishMsg(body []byte) [][]byte {
+	return bytes.Split(body, []byte("\n"))
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a node reported with ReportNodeFailure() is passed over
+// by AnyNodeForDistDatum() when another replica is available.
+var replicaPenalty = 30 * time.Second
+
+// replicaHealth keeps track of the nodes which have recently failed
+// (or been too slow) to serve a read. It is local to a node, every
+// node forms its own opinion.
+type replicaHealth struct {
+	sync.Mutex
+	failed map[string]time.Time // node name -> until when to avoid it
+}
+
+func (rh *replicaHealth) report(name string, until time.Time) {
+	rh.Lock()
+	defer rh.Unlock()
+	if rh.failed == nil {
+		rh.failed = make(map[string]time.Time)
+	}
+	rh.failed[name] = until
+}
+
+func (rh *replicaHealth) ok(name string, now time.Time) bool {
+	rh.Lock()
+	defer rh.Unlock()
+	until, ok := rh.failed[name]
+	if !ok {
+		return true
+	}
+	if now.After(until) {
+		delete(rh.failed, name)
+		return true
+	}
+	return false
+}
+
+// pickReplica selects a node to read from among the replicas (lead
+// first). Only nodes for which live() is true are considered. The
+// local node is returned if preferLocal and it is a healthy replica,
+// otherwise the first healthy replica in order, so that when the
+// lead has failed reads rotate to the next copy. If all live replicas
+// have recently failed, the first live one is returned anyway, a
+// slow answer being better than none. Returns nil when no replica is
+// live.
+func pickReplica(nodes []*Node, live func(*Node) bool, rh *replicaHealth, local *Node, preferLocal bool, now time.Time) *Node {
+	var first, fallback *Node
+	for _, n := range nodes {
+		if n == nil || !live(n) {
+			continue
+		}
+		if fallback == nil {
+			fallback = n
+		}
+		if !rh.ok(n.Name(), now) {
+			continue
+		}
+		if preferLocal && local != nil && n.Name() == local.Name() {
+			return n
+		}
+		if first == nil {
+			first = n
+		}
+	}
+	if first != nil {
+		return first
+	}
+	return fallback
+}
+
+// AnyNodeForDistDatum returns a node from which data for dd can be
+// read: one of the nodes returned by NodesForDistDatum() which is a
+// ready member and has not recently been reported with
+// ReportNodeFailure(). With copies > 1 this lets the query side keep
+// serving reads while the lead node is down or slow. If preferLocal
+// is true and this node holds a copy, it is returned. Returns nil if
+// none of the replicas is available.
+func (c *Cluster) AnyNodeForDistDatum(dd DistDatum, preferLocal bool) *Node {
+	members := make(map[string]bool)
+	for _, n := range c.Members() {
+		members[n.Name()] = true
+	}
+	live := func(n *Node) bool {
+		return members[n.Name()] && n.Ready()
+	}
+	return pickReplica(c.NodesForDistDatum(dd), live, &c.health, c.LocalNode(), preferLocal, time.Now())
+}
+
+// ReportNodeFailure tells the cluster that a read from n failed or
+// took too long. AnyNodeForDistDatum() will prefer other replicas
+// for a while.
+func (c *Cluster) ReportNodeFailure(n *Node) {
+	c.health.report(n.Name(), time.Now().Add(replicaPenalty))
+}
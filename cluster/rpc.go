@@ -0,0 +1,177 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// How long Shutdown waits for in-flight RPC calls to complete before
+// closing the connections regardless.
+var rpcDrainTimeout = 5 * time.Second
+
+// rpcServer serves the cluster RPC on a listener. Unlike rpc.Accept,
+// it can be stopped: shutdown closes the listener (so that the
+// address can be bound again, e.g. by the new process after a
+// graceful restart), waits for the calls in progress to finish, then
+// closes all connections.
+type rpcServer struct {
+	sync.Mutex
+	srv      *rpc.Server
+	ln       net.Listener
+	codec    Codec
+	stop     chan struct{} // closed when no longer accepting
+	abort    chan struct{} // closed when no longer waiting for calls
+	conns    map[net.Conn]bool
+	connWg   sync.WaitGroup
+	calls    sync.WaitGroup
+	stopping bool
+}
+
+// newRPCServer registers rcvr with a new rpc.Server (not the
+// rpc.DefaultServer, so that more than one Cluster can exist in a
+// process). Call start() to begin serving.
+func newRPCServer(rcvr interface{}, ln net.Listener, codec Codec) (*rpcServer, error) {
+	s := &rpcServer{
+		srv:   rpc.NewServer(),
+		ln:    ln,
+		codec: codec,
+		stop:  make(chan struct{}),
+		abort: make(chan struct{}),
+		conns: make(map[net.Conn]bool),
+	}
+	if err := s.srv.Register(rcvr); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rpcServer) start() {
+	go s.serve()
+}
+
+func (s *rpcServer) serve() {
+	var delay time.Duration
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off like net/http does
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("Cluster: RPC accept error: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Printf("Cluster: RPC accept error: %v, no longer accepting RPC connections.", err)
+			return
+		}
+		delay = 0
+
+		s.Lock()
+		if s.stopping {
+			s.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.connWg.Add(1)
+		s.Unlock()
+
+		go func() {
+			defer s.connWg.Done()
+			if rc, ok := s.codec.(RPCCodec); ok {
+				s.srv.ServeCodec(rc.ServerCodec(conn))
+			} else {
+				s.srv.ServeConn(conn)
+			}
+			s.Lock()
+			delete(s.conns, conn)
+			s.Unlock()
+		}()
+	}
+}
+
+// beginCall must be called at the start of every RPC method, which
+// must not proceed if it returns an error. endCall must be called
+// when the method is done. A method that may block must give up once
+// the aborted() channel is closed.
+func (s *rpcServer) beginCall() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopping {
+		return fmt.Errorf("cluster RPC server is shutting down")
+	}
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *rpcServer) endCall() {
+	s.calls.Done()
+}
+
+func (s *rpcServer) aborted() <-chan struct{} {
+	return s.abort
+}
+
+// shutdown stops accepting connections and calls, waits up to
+// timeout for the calls in progress, then closes the connections.
+func (s *rpcServer) shutdown(timeout time.Duration) error {
+	s.Lock()
+	if s.stopping {
+		s.Unlock()
+		return nil
+	}
+	s.stopping = true
+	close(s.stop)
+	s.Unlock()
+
+	err := s.ln.Close()
+
+	done := make(chan bool)
+	go func() {
+		s.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Cluster: RPC calls still in progress after %v, closing connections anyway.", timeout)
+	}
+	close(s.abort)
+
+	s.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+	s.connWg.Wait()
+
+	return err
+}
@@ -0,0 +1,57 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"net"
+	"os"
+)
+
+// SingleNode is a cluster of one, for standalone installs. It behaves
+// exactly like a Cluster which no other node ever joins: data is
+// assigned to the local node, acquired, relinquished and fenced the
+// same way, so the application code path is the same. But there is
+// no gossip, RPC, listening socket or the log messages that come with
+// them, the node's messages to itself are passed via channels as in a
+// FakeNetwork of one.
+type SingleNode struct {
+	*FakeCluster
+}
+
+var _ Clusterer = &SingleNode{}
+
+// NewSingleNode returns a SingleNode named after the host, with the
+// address 127.0.0.1.
+func NewSingleNode() *SingleNode {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = "local"
+	}
+	return NewSingleNodeBind(name, "127.0.0.1")
+}
+
+// NewSingleNodeBind returns a SingleNode with the given name and
+// address. The address is only used to identify the node (e.g. in
+// the internal stats names), nothing listens on it. Use the address a
+// Cluster would advertise to keep names the same when switching
+// between the two.
+func NewSingleNodeBind(name, addr string) *SingleNode {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return &SingleNode{NewFakeNetwork().newCluster(name, ip)}
+}
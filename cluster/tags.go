@@ -0,0 +1,168 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// Tags are arbitrary key/value pairs (e.g. role=ingest) set on a node
+// with SetTags() or ClusterConfig.Tags. They are gossiped as part of
+// the node metadata, which memberlist limits to MetaMaxSize bytes in
+// total, so they should be kept short.
+
+func encodeTags(tags map[string]string) []byte {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	lb := make([]byte, binary.MaxVarintLen64)
+	for _, k := range keys {
+		for _, s := range []string{k, tags[k]} {
+			n := binary.PutUvarint(lb, uint64(len(s)))
+			b = append(b, lb[:n]...)
+			b = append(b, s...)
+		}
+	}
+	return b
+}
+
+func decodeTags(b []byte) (map[string]string, error) {
+	tags := make(map[string]string)
+	for len(b) > 0 {
+		var kv [2]string
+		for i := range kv {
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("truncated tag")
+			}
+			kv[i], b = string(b[n:n+int(l)]), b[n+int(l):]
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// SetTags replaces the tags of the local node and broadcasts an
+// UpdateNode message to the cluster.
+func (c *Cluster) SetTags(tags map[string]string) error {
+	md, err := c.extractMeta()
+	if err != nil {
+		return err
+	}
+	md.tags = tags
+	if err := c.saveMeta(md); err != nil {
+		return err
+	}
+	if err = c.UpdateNode(updateNodeTO); err != nil {
+		log.Printf("Cluster.SetTags(): UpdateNode() failed: %v", err)
+	}
+	return err
+}
+
+// Tags returns the tags of the node, nil if there are none (or the
+// node is running an older version which does not support them).
+func (n *Node) Tags() map[string]string {
+	md, err := n.extractMeta()
+	if err != nil {
+		return nil
+	}
+	return md.tags
+}
+
+// Tag returns the value of a tag and whether it is set.
+func (n *Node) Tag(key string) (string, bool) {
+	v, ok := n.Tags()[key]
+	return v, ok
+}
+
+// TagInt returns the value of a tag as an integer. It returns false
+// if the tag is not set or is not an integer.
+func (n *Node) TagInt(key string) (int64, bool) {
+	v, ok := n.Tag(key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	return i, err == nil
+}
+
+// TagBool returns the value of a tag as a bool (as understood by
+// strconv.ParseBool). It returns false if the tag is not set or is
+// not a bool.
+func (n *Node) TagBool(key string) (value, ok bool) {
+	v, ok := n.Tag(key)
+	if !ok {
+		return false, false
+	}
+	b, err := strconv.ParseBool(v)
+	return b, err == nil
+}
+
+// NodeFilter decides whether a node is eligible, e.g. for DistDatum
+// placement.
+type NodeFilter func(*Node) bool
+
+// TagFilter returns a NodeFilter which accepts nodes on which the tag
+// key is set to one of the values.
+func TagFilter(key string, values ...string) NodeFilter {
+	return func(n *Node) bool {
+		v, ok := n.Tag(key)
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func filterNodes(nodes []*Node, f NodeFilter) []*Node {
+	if f == nil {
+		return nodes
+	}
+	result := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if f(n) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// SetPlacementFilter restricts the nodes DistDatums are assigned to
+// (by LoadDistData() and Transition()) to those accepted by f, nil
+// means all ready nodes. This lets e.g. query-only nodes be part of
+// the cluster without owning any data:
+//
+//	c.SetPlacementFilter(cluster.TagFilter("role", "ingest"))
+//
+// All nodes must use the same filter, otherwise they will not agree
+// on who owns what.
+func (c *Cluster) SetPlacementFilter(f NodeFilter) {
+	c.Lock()
+	defer c.Unlock()
+	c.place = f
+}
@@ -0,0 +1,117 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// relinquishTimeout is how long Transition() waits for a
+// DistDatum.Relinquish() to return before moving the DistDatum away
+// regardless.
+var relinquishTimeout = 30 * time.Second
+
+// unsafeMoves keeps track of the DistDatums which were moved away
+// from this node while their Relinquish() had not yet returned, i.e.
+// their data may not have been saved by the time the new node
+// acquired them.
+type unsafeMoves struct {
+	sync.Mutex
+	ids   map[string]time.Time
+	count uint64
+}
+
+func (u *unsafeMoves) add(key string, now time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	if u.ids == nil {
+		u.ids = make(map[string]time.Time)
+	}
+	u.ids[key] = now
+	u.count++
+}
+
+func (u *unsafeMoves) total() uint64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.count
+}
+
+func (u *unsafeMoves) list() []string {
+	u.Lock()
+	defer u.Unlock()
+	result := make([]string, 0, len(u.ids))
+	for key := range u.ids {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// relinquish calls dd.Relinquish() in a goroutine and waits at most
+// timeout for it to return. If it does not, stuck is true and the
+// call is left running, the watchdog logs it again should it ever
+// return.
+func relinquish(dd DistDatum, timeout time.Duration) (stuck bool, err error) {
+	start := time.Now()
+	done := make(chan error, 1)
+	var (
+		mu       sync.Mutex
+		timedOut bool
+	)
+	go func() {
+		err := dd.Relinquish()
+		mu.Lock()
+		defer mu.Unlock()
+		if timedOut {
+			log.Printf("Transition(): Relinquish() for id %s:%d (%s) returned after %v (err: %v).", dd.Type(), dd.Id(), dd.GetName(), time.Since(start), err)
+		}
+		done <- err
+	}()
+
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	select {
+	case err = <-done:
+		return false, err
+	case <-tmr.C:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case err = <-done: // it returned just now
+		return false, err
+	default:
+	}
+	timedOut = true
+	return true, nil
+}
+
+// UnsafelyMoved returns the ids (as "Type:Id") of DistDatums which
+// Transition() moved away from this node while their Relinquish()
+// was stuck, see relinquishTimeout.
+func (c *Cluster) UnsafelyMoved() []string {
+	return c.unsafe.list()
+}
+
+// UnsafelyMoved is the FakeCluster version of Cluster.UnsafelyMoved().
+func (fc *FakeCluster) UnsafelyMoved() []string {
+	return fc.unsafe.list()
+}
@@ -0,0 +1,119 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// rrd_verify compares the result of tgres RRA consolidation to that
+// of rrdtool. Golden files (see rrd/verify) are checked always, and
+// if rrdtool is installed, the given number of random cases is run
+// through both. With -record, the random cases are saved as golden
+// files instead, with what rrdtool computed as the expected result.
+//
+// The exit status is 1 if there are any mismatches.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/tgres/tgres/rrd/verify"
+)
+
+func main() {
+
+	var (
+		golden, rrdtool, record string
+		n, updates              int
+		seed                    int64
+		tolerance               float64
+	)
+
+	flag.StringVar(&golden, "golden", "rrd/verify/testdata/*.json", "glob of golden files to check")
+	flag.StringVar(&rrdtool, "rrdtool", "rrdtool", "rrdtool binary")
+	flag.IntVar(&n, "n", 100, "number of random cases to compare to rrdtool")
+	flag.IntVar(&updates, "updates", 1000, "number of updates in a random case")
+	flag.Int64Var(&seed, "seed", 0, "random seed, 0 means use current time")
+	flag.StringVar(&record, "record", "", "directory to save random cases to as golden files instead of comparing")
+	flag.Float64Var(&tolerance, "tolerance", 1e-9, "relative tolerance")
+
+	flag.Parse()
+
+	var mismatches []verify.Mismatch
+
+	paths, err := filepath.Glob(golden)
+	if err != nil {
+		fmt.Printf("Bad -golden pattern: %v\n", err)
+		os.Exit(2)
+	}
+	for _, path := range paths {
+		c, expect, err := verify.ReadGolden(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", path, err)
+			os.Exit(2)
+		}
+		got, err := verify.Run(c)
+		if err != nil {
+			fmt.Printf("Error running %s: %v\n", path, err)
+			os.Exit(2)
+		}
+		mismatches = append(mismatches, verify.Compare(c.Name, got, expect, tolerance)...)
+	}
+	fmt.Printf("Checked %d golden files.\n", len(paths))
+
+	path, err := exec.LookPath(rrdtool)
+	if err != nil {
+		fmt.Printf("rrdtool not found, skipping random cases: %v\n", err)
+	} else {
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		fmt.Printf("Running %d random cases with seed %d.\n", n, seed)
+		rt := &verify.Rrdtool{Path: path}
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < n; i++ {
+			c := verify.RandomCase(r, fmt.Sprintf("random-%d-%d", seed, i), updates)
+			expect, err := rt.Run(c)
+			if err != nil {
+				fmt.Printf("Error running %s with rrdtool: %v\n", c.Name, err)
+				os.Exit(2)
+			}
+			if record != "" {
+				if err := verify.WriteGolden(filepath.Join(record, c.Name+".json"), c, expect); err != nil {
+					fmt.Printf("Error saving %s: %v\n", c.Name, err)
+					os.Exit(2)
+				}
+				continue
+			}
+			got, err := verify.Run(c)
+			if err != nil {
+				fmt.Printf("Error running %s: %v\n", c.Name, err)
+				os.Exit(2)
+			}
+			mismatches = append(mismatches, verify.Compare(c.Name, got, expect, tolerance)...)
+		}
+	}
+
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("%d mismatches.\n", len(mismatches))
+		os.Exit(1)
+	}
+	fmt.Printf("No mismatches.\n")
+}
@@ -0,0 +1,124 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// beaconReport is what the beacon sends. It identifies the instance
+// only by Instance, which is empty unless configured.
+type beaconReport struct {
+	Instance    string  `json:"instance,omitempty"`
+	Version     string  `json:"version"`
+	GitRevision string  `json:"gitRevision,omitempty"`
+	GoVersion   string  `json:"goVersion"`
+	Time        int64   `json:"time"`
+	Uptime      float64 `json:"uptime"`     // seconds
+	Series      int     `json:"series"`     // cached DSs
+	IngestRate  float64 `json:"ingestRate"` // points/sec since the previous report
+}
+
+// beacon periodically POSTs a beaconReport as JSON to a URL of the
+// operator's choosing (see beacon-url), so that many instances can be
+// kept track of from a central place. Nothing is sent anywhere unless
+// it is configured.
+type beacon struct {
+	url      string
+	instance string
+	stats    func() receiver.ReceiverStats
+	client   *http.Client
+	started  time.Time
+	last     receiver.ReceiverStats
+	lastTime time.Time
+	stop     chan struct{}
+}
+
+func newBeacon(url, instance string, stats func() receiver.ReceiverStats) *beacon {
+	now := time.Now()
+	return &beacon{
+		url:      url,
+		instance: instance,
+		stats:    stats,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		started:  now,
+		last:     stats(),
+		lastTime: now,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (b *beacon) report(now time.Time) *beaconReport {
+	st := b.stats()
+	rep := &beaconReport{
+		Instance:    b.instance,
+		Version:     Build.Version,
+		GitRevision: Build.GitRevision,
+		GoVersion:   runtime.Version(),
+		Time:        now.Unix(),
+		Uptime:      now.Sub(b.started).Seconds(),
+		Series:      st.Series,
+	}
+	if secs := now.Sub(b.lastTime).Seconds(); secs > 0 {
+		rep.IngestRate = float64(st.DataPoints-b.last.DataPoints) / secs
+	}
+	b.last, b.lastTime = st, now
+	return rep
+}
+
+// send sends a report, a failure is only logged.
+func (b *beacon) send(now time.Time) error {
+	body, err := json.Marshal(b.report(now))
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(b.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", b.url, resp.Status)
+	}
+	return nil
+}
+
+func (b *beacon) run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-tick.C:
+			if err := b.send(now); err != nil {
+				log.Printf("Beacon: %v", err)
+			}
+		}
+	}
+}
+
+func (b *beacon) Stop() {
+	close(b.stop)
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"runtime"
+
+	"github.com/tgres/tgres/cluster"
+	h "github.com/tgres/tgres/http"
+)
+
+// BuildInfo identifies the build, it is set by main (the revision
+// and build time via -ldflags, see the Makefile).
+type BuildInfo struct {
+	Version     string
+	GitRevision string
+	BuildTime   string
+}
+
+// Build is the build of the running binary, it should be set before
+// Init() or Tgres.Start().
+var Build BuildInfo
+
+// The node tags under which the build is gossiped to the other nodes
+// of the cluster, see cluster.Node.Tag().
+const (
+	TagVersion  = "tgres.version"
+	TagRevision = "tgres.revision"
+)
+
+// buildTags returns the node tags describing the build. The revision
+// is shortened, node metadata is limited in size.
+func buildTags() map[string]string {
+	tags := make(map[string]string, 2)
+	if Build.Version != "" {
+		tags[TagVersion] = Build.Version
+	}
+	if rev := Build.GitRevision; rev != "" {
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		tags[TagRevision] = rev
+	}
+	return tags
+}
+
+// features are the capabilities of this build, for /api/info.
+var features = []string{
+	"cluster",
+	"cluster-tags",
+	"cluster-locks",
+	"cluster-single-node",
+	"dsl-compat",
+	"async-query",
+	"export-arrow",
+	"dsspec",
+	"tls-reload",
+	"wal",
+	"spill",
+	"rate-limit",
+	"dsl-metrics",
+	"rewrite",
+	"render-estimate",
+	"aggregation-rules",
+	"series-filter",
+	"beacon",
+	"series-quota",
+	"ingest-auth",
+	"flow-control",
+	"dedup",
+	"series-activity",
+	"decoders",
+	"cluster-config-check",
+	"expvar",
+	"backfill",
+	"ds-types",
+}
+
+// newInfo returns what /api/info reports.
+func newInfo(cfg *Config, serdeName string) *h.Info {
+	return &h.Info{
+		Version:     Build.Version,
+		GitRevision: Build.GitRevision,
+		BuildTime:   Build.BuildTime,
+		GoVersion:   runtime.Version(),
+		Serde:       serdeName,
+		Features:    features,
+		Protocols: map[string]int{
+			"cluster":    cluster.ProtocolVersion,
+			"clusterMin": cluster.MinProtocolVersion,
+		},
+		Ingest: map[string]bool{
+			"graphite-text":           cfg.GraphiteTextListenSpec != "",
+			"graphite-udp":            cfg.GraphiteUdpListenSpec != "",
+			"graphite-unix":           cfg.GraphiteUnixSocket != "",
+			"graphite-pickle":         cfg.GraphitePickleListenSpec != "",
+			"statsd-udp":              cfg.StatsdUdpListenSpec != "",
+			"influx-http":             cfg.HttpListenSpec != "",
+			"influx-udp":              cfg.InfluxUdpListenSpec != "",
+			"opentsdb-http":           cfg.HttpListenSpec != "",
+			"opentsdb-telnet":         cfg.OpenTSDBTelnetListenSpec != "",
+			"prometheus-remote-write": cfg.HttpListenSpec != "",
+			"prometheus-remote-read":  cfg.HttpListenSpec != "",
+			"nats":                    cfg.NatsURL != "",
+			"amqp":                    cfg.AmqpURL != "",
+		},
+	}
+}
@@ -19,6 +19,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -27,28 +30,108 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/tgres/tgres/cluster"
+	h "github.com/tgres/tgres/http"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/ingest"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/opentsdb"
+	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
 type Config struct { // Needs to be exported for TOML to work
-	PidPath                  string   `toml:"pid-file"`
-	LogPath                  string   `toml:"log-file"`
-	LogCycle                 duration `toml:"log-cycle-interval"`
-	DbConnectString          string   `toml:"db-connect-string"`
-	MinStep                  duration `toml:"min-step"`
-	MaxReceiverQueueSize     int      `toml:"max-receiver-queue-size"`
-	GraphiteTextListenSpec   string   `toml:"graphite-text-listen-spec"`
-	GraphiteUdpListenSpec    string   `toml:"graphite-udp-listen-spec"`
-	GraphitePickleListenSpec string   `toml:"graphite-pickle-listen-spec"`
-	StatsdTextListenSpec     string   `toml:"statsd-text-listen-spec"`
-	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
-	HttpListenSpec           string   `toml:"http-listen-spec"`
-	Workers                  int
-	DSs                      []ConfigDSSpec `toml:"ds"`
-	StatFlush                duration       `toml:"stat-flush-interval"`
-	StatsNamePrefix          string         `toml:"stats-name-prefix"`
+	PidPath                   string                  `toml:"pid-file"`
+	LogPath                   string                  `toml:"log-file"`
+	LogCycle                  duration                `toml:"log-cycle-interval"`
+	DbConnectString           string                  `toml:"db-connect-string"`
+	MinStep                   duration                `toml:"min-step"`
+	LateTolerance             duration                `toml:"late-tolerance"`
+	MaxReceiverQueueSize      int                     `toml:"max-receiver-queue-size"`
+	FlowControlHighWatermark  int                     `toml:"flow-control-high-watermark"`
+	FlowControlLowWatermark   int                     `toml:"flow-control-low-watermark"`
+	MaxCachedDSs              int                     `toml:"max-cached-dss"`
+	MaxCachedMB               int                     `toml:"max-cached-mb"`
+	MaxMemoryMB               int                     `toml:"max-memory-mb"`
+	DSCacheShards             int                     `toml:"ds-cache-shards"`
+	WALDir                    string                  `toml:"wal-dir"`
+	WALSegmentSizeMB          int                     `toml:"wal-segment-size-mb"`
+	WALRetention              duration                `toml:"wal-retention"`
+	WALSyncInterval           duration                `toml:"wal-sync-interval"`
+	SpillDir                  string                  `toml:"spill-dir"`
+	SpillMaxSizeMB            int                     `toml:"spill-max-size-mb"`
+	SpillRetryInterval        duration                `toml:"spill-retry-interval"`
+	RateLimitPolicy           string                  `toml:"rate-limit-policy"`
+	RateLimitSeries           float64                 `toml:"rate-limit-series"`
+	RateLimits                []ConfigRateLimitSpec   `toml:"rate-limit"`
+	Rewrites                  []ConfigRewriteSpec     `toml:"rewrite"`
+	RewriteReloadInterval     duration                `toml:"rewrite-reload-interval"`
+	AggregationRulesFile      string                  `toml:"aggregation-rules-file"`
+	AggregationDropInputs     bool                    `toml:"aggregation-drop-inputs"`
+	SeriesAllow               []string                `toml:"series-allow"`
+	SeriesDeny                []string                `toml:"series-deny"`
+	DedupWindow               duration                `toml:"dedup-window"`
+	BeaconURL                 string                  `toml:"beacon-url"`
+	BeaconInterval            duration                `toml:"beacon-interval"`
+	BeaconInstance            string                  `toml:"beacon-instance"`
+	ExpireSeriesAfter         duration                `toml:"expire-series-after"`
+	ExpireSeriesInterval      duration                `toml:"expire-series-interval"`
+	ExpireSeriesDryRun        bool                    `toml:"expire-series-dry-run"`
+	MaxNewSeriesPerMinute     int                     `toml:"max-new-series-per-minute"`
+	MaxSeriesPerTenant        int                     `toml:"max-series-per-tenant"`
+	SeriesQuotaPolicy         string                  `toml:"series-quota-policy"`
+	SeriesQuotas              []ConfigSeriesQuotaSpec `toml:"series-quota"`
+	GraphiteTextListenSpec    string                  `toml:"graphite-text-listen-spec"`
+	GraphiteUdpListenSpec     string                  `toml:"graphite-udp-listen-spec"`
+	GraphiteUdpReadBufferSize int                     `toml:"graphite-udp-read-buffer-size"`
+	GraphiteUnixSocket        string                  `toml:"graphite-unix-socket"`
+	GraphitePickleListenSpec  string                  `toml:"graphite-pickle-listen-spec"`
+	GraphiteProxyProtocol     bool                    `toml:"graphite-proxy-protocol"`
+	GraphiteReadBufferSize    int                     `toml:"graphite-read-buffer-size"`
+	GraphitePickleMaxSize     int                     `toml:"graphite-pickle-max-size"`
+	StatsdTextListenSpec      string                  `toml:"statsd-text-listen-spec"`
+	StatsdUdpListenSpec       string                  `toml:"statsd-udp-listen-spec"`
+	InfluxUdpListenSpec       string                  `toml:"influx-udp-listen-spec"`
+	InfluxTemplate            string                  `toml:"influx-template"`
+	OpenTSDBTelnetListenSpec  string                  `toml:"opentsdb-telnet-listen-spec"`
+	OpenTSDBTagPolicy         string                  `toml:"opentsdb-tag-policy"`
+	NatsURL                   string                  `toml:"nats-url"`
+	NatsSubject               string                  `toml:"nats-subject"`
+	NatsQueueGroup            string                  `toml:"nats-queue-group"`
+	AmqpURL                   string                  `toml:"amqp-url"`
+	AmqpQueue                 string                  `toml:"amqp-queue"`
+	AmqpPrefetch              int                     `toml:"amqp-prefetch"`
+	HttpListenSpec            string                  `toml:"http-listen-spec"`
+	HttpTLSCertFile           string                  `toml:"http-tls-cert-file"`
+	HttpTLSKeyFile            string                  `toml:"http-tls-key-file"`
+	HttpTLSClientCAFile       string                  `toml:"http-tls-client-ca-file"`
+	HttpTLSReloadInterval     duration                `toml:"http-tls-reload-interval"`
+	HttpClientCerts           []ConfigClientCertSpec  `toml:"http-client-cert"`
+	HttpTokens                []ConfigTokenSpec       `toml:"http-token"`
+	GraphiteTLSCertFile       string                  `toml:"graphite-tls-cert-file"`
+	GraphiteTLSKeyFile        string                  `toml:"graphite-tls-key-file"`
+	GraphiteTLSClientCAFile   string                  `toml:"graphite-tls-client-ca-file"`
+	GraphiteAuthTokens        []string                `toml:"graphite-auth-tokens"`
+	Workers                   int
+	DSs                       []ConfigDSSpec       `toml:"ds"`
+	StatFlush                 duration             `toml:"stat-flush-interval"`
+	StatsNamePrefix           string               `toml:"stats-name-prefix"`
+	StatsForwardTo            string               `toml:"stats-forward-to"`
+	StatsForwardOnly          bool                 `toml:"stats-forward-only"`
+	ClusterDiscovery          *ConfigDiscoverySpec `toml:"cluster-discovery"`
+	Decoders                  map[string]string    `toml:"decoders"`
+
+	discoverer     cluster.Discoverer          // from ClusterDiscovery
+	influxTemplate *influx.Template            // from InfluxTemplate
+	opentsdbTags   opentsdb.TagPolicy          // from OpenTSDBTagPolicy
+	ingestSources  []receiver.IngestSource     // from Nats* and Amqp*
+	decoders       map[string]ingest.Decoder   // from Decoders, by listener
+	rateLimits     *receiver.RateLimitConfig   // from RateLimit*
+	rewriteRules   []receiver.RewriteRule      // from Rewrites
+	aggRules       []receiver.AggregationRule  // from AggregationRulesFile
+	seriesFilter   *receiver.SeriesFilter      // from SeriesAllow and SeriesDeny
+	seriesQuotas   *receiver.SeriesQuotaConfig // from MaxNewSeries*, MaxSeries* and SeriesQuota*
 }
 
 type regex struct{ *regexp.Regexp }
@@ -68,21 +151,103 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 // Needs to be exported for TOML
 type ConfigDSSpec struct {
 	Regexp    regex
+	Type      string // gauge (default), counter, derive or absolute
 	Step      duration
 	Heartbeat duration
+	Min, Max  *float64 // values outside are stored as NaN, nil is no limit
+	GapFill   string   `toml:"gap-fill"` // default for the RRAs: nan, zero, previous or linear
 	RRAs      []ConfigRRASpec
 }
+
+// ConfigClientCertSpec maps a client certificate identity (subject
+// CN or a SAN) to a tenant and its scopes. Unless Global, the tenant
+// is confined to the series whose name begins with "<tenant>.".
+type ConfigClientCertSpec struct {
+	Identity string
+	Tenant   string
+	Scopes   []string
+	Global   bool
+}
+
+// ConfigTokenSpec maps a bearer token to a tenant and its scopes,
+// Global as in ConfigClientCertSpec.
+type ConfigTokenSpec struct {
+	Token  string
+	Tenant string
+	Scopes []string
+	Global bool
+}
+
+// ConfigRateLimitSpec limits the points/sec of the series whose name
+// begins with Prefix, Rate for all of them combined and SeriesRate
+// for each (instead of rate-limit-series).
+type ConfigRateLimitSpec struct {
+	Prefix     string
+	Rate       float64
+	SeriesRate float64 `toml:"series-rate"`
+}
+
+// ConfigSeriesQuotaSpec limits the number of series whose name
+// begins with Prefix to MaxSeries.
+type ConfigSeriesQuotaSpec struct {
+	Prefix    string
+	MaxSeries int `toml:"max-series"`
+}
+
+// ConfigRewriteSpec rewrites the names of incoming series matching
+// the Match regular expression. Action is one of "rename" (the
+// matches are replaced with Replacement, which may refer to
+// submatches as $1, etc.), "drop" or "prefix" (Replacement is
+// prepended).
+type ConfigRewriteSpec struct {
+	Match       string
+	Action      string
+	Replacement string
+}
+
+// ConfigDiscoverySpec selects how cluster nodes find each other when
+// no -join list is given. Provider is one of "dns" (Name resolves to
+// the node addresses), "dns-srv" (Name is an SRV record),
+// "kubernetes" (pods matching LabelSelector in Namespace) or "ec2"
+// (instances tagged TagKey=TagValue in Region).
+type ConfigDiscoverySpec struct {
+	Provider      string
+	Name          string
+	Port          int
+	Namespace     string
+	LabelSelector string `toml:"label-selector"`
+	Region        string
+	TagKey        string `toml:"tag-key"`
+	TagValue      string `toml:"tag-value"`
+	Interval      duration
+}
+
 type ConfigRRASpec struct {
 	Function rrd.Consolidation
 	Step     time.Duration
 	Span     time.Duration
 	Xff      float64
+	RoundTo  float64
+	GapFill  *rrd.GapFill // nil is the gap-fill of the DS
 }
 
 func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 	r.Xff = 0.5
-	parts := strings.SplitN(string(text), ":", 4)
-	if len(parts) < 2 || len(parts) > 4 {
+	parts := strings.Split(string(text), ":")
+
+	// The gap fill policy, if any, is the last element. Anything
+	// which is not a gap fill name is left for the span, xff or
+	// roundto, which report their own errors.
+	if len(parts) > 2 {
+		if last := parts[len(parts)-1]; last != "" {
+			if gf, err := rrd.ParseGapFill(last); err == nil {
+				r.GapFill = &gf
+				parts = parts[:len(parts)-1]
+			}
+		}
+	}
+
+	if len(parts) < 2 || len(parts) > 5 {
 		return fmt.Errorf("Invalid RRA specification (not enough or too many elements): %q", string(text))
 	}
 
@@ -91,21 +256,15 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 	if len(parts[0]) > 0 && strings.Contains("0123456789", string(parts[0][0])) {
 		parts = append([]string{"WMEAN"}, parts...)
 	}
-
-	switch strings.ToUpper(parts[0]) {
-	case "WMEAN":
-		r.Function = rrd.WMEAN
-	case "MIN":
-		r.Function = rrd.MIN
-	case "MAX":
-		r.Function = rrd.MAX
-	case "LAST":
-		r.Function = rrd.LAST
-	default:
-		return fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last)", parts[0])
+	if len(parts) > 5 {
+		return fmt.Errorf("Invalid RRA specification (too many elements): %q", string(text))
 	}
 
 	var err error
+	if r.Function, err = rrd.ParseConsolidation(parts[0]); err != nil {
+		return err
+	}
+
 	if r.Step, err = misc.BetterParseDuration(parts[1]); err != nil {
 		return fmt.Errorf("Invalid Step: %q (%v)", parts[1], err)
 	}
@@ -120,11 +279,23 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 			return fmt.Errorf("invalid Size (%v)", newSpan)
 		}
 	}
-	if len(parts) == 4 {
+	if len(parts) >= 4 {
 		var err error
 		if r.Xff, err = strconv.ParseFloat(parts[3], 64); err != nil {
 			return fmt.Errorf("Invalid XFF: %q (%v)", parts[3], err)
 		}
+		if r.Xff < 0 || r.Xff > 1 {
+			return fmt.Errorf("Invalid XFF: %q (must be between 0 and 1)", parts[3])
+		}
+	}
+	if len(parts) == 5 {
+		var err error
+		if r.RoundTo, err = strconv.ParseFloat(parts[4], 64); err != nil {
+			return fmt.Errorf("Invalid RoundTo: %q (%v)", parts[4], err)
+		}
+		if r.RoundTo < 0 {
+			return fmt.Errorf("Invalid RoundTo: %q (must not be negative)", parts[4])
+		}
 	}
 	return nil
 }
@@ -204,12 +375,24 @@ func (c *Config) processDbConnectString() error {
 func (c *Config) processMinStep() error {
 	if c.MinStep.Duration == 0 {
 		return fmt.Errorf("min-step is missing")
+	} else if c.MinStep.Duration%receiver.TimestampResolution != 0 {
+		return fmt.Errorf("min-step (%v) must be a multiple of %v", c.MinStep.Duration, receiver.TimestampResolution)
 	} else {
 		log.Printf("Smallest step allowed: %v (min-step).", c.MinStep.Duration)
 	}
 	return nil
 }
 
+func (c *Config) processLateTolerance() error {
+	if c.LateTolerance.Duration < 0 {
+		return fmt.Errorf("late-tolerance cannot be negative")
+	}
+	if c.LateTolerance.Duration > 0 {
+		log.Printf("Data points up to %v before the last update of a series are placed into past slots (late-tolerance).", c.LateTolerance.Duration)
+	}
+	return nil
+}
+
 func (c *Config) processMaxReceiverQueueSize() error {
 	if c.MaxReceiverQueueSize == 0 {
 		log.Printf("max-receiver-queue-size unspecified, defaults to 0 (unlimited)")
@@ -221,6 +404,258 @@ func (c *Config) processMaxReceiverQueueSize() error {
 	return nil
 }
 
+func (c *Config) processFlowControl() error {
+	high, low := c.FlowControlHighWatermark, c.FlowControlLowWatermark
+	if high < 0 || low < 0 {
+		return fmt.Errorf("flow-control-high-watermark and flow-control-low-watermark cannot be negative")
+	}
+	if high == 0 {
+		if low != 0 {
+			return fmt.Errorf("flow-control-low-watermark requires flow-control-high-watermark")
+		}
+		return nil
+	}
+	if low >= high {
+		return fmt.Errorf("flow-control-low-watermark (%d) must be below flow-control-high-watermark (%d)", low, high)
+	}
+	if c.MaxReceiverQueueSize > 0 && high >= c.MaxReceiverQueueSize {
+		return fmt.Errorf("flow-control-high-watermark (%d) must be below max-receiver-queue-size (%d)", high, c.MaxReceiverQueueSize)
+	}
+	if low == 0 {
+		c.FlowControlLowWatermark = high / 2
+	}
+	log.Printf("Ingestion connections are throttled at receiver queue size %d until it drains to %d (flow-control-high-watermark).", high, c.FlowControlLowWatermark)
+	return nil
+}
+
+func (c *Config) processResourceLimits() error {
+	if c.MaxCachedDSs < 0 {
+		return fmt.Errorf("max-cached-dss cannot be negative")
+	}
+	if c.MaxMemoryMB < 0 {
+		return fmt.Errorf("max-memory-mb cannot be negative")
+	}
+	if c.DSCacheShards < 0 {
+		return fmt.Errorf("ds-cache-shards cannot be negative")
+	}
+	if c.MaxCachedMB < 0 {
+		return fmt.Errorf("max-cached-mb cannot be negative")
+	}
+	if c.MaxCachedDSs > 0 {
+		log.Printf("Number of cached DSs is limited to %d (max-cached-dss).", c.MaxCachedDSs)
+	}
+	if c.MaxCachedMB > 0 {
+		log.Printf("Estimated size of cached DSs is limited to %dMB (max-cached-mb).", c.MaxCachedMB)
+	}
+	if c.MaxMemoryMB > 0 {
+		log.Printf("Memory is limited to %dMB (max-memory-mb).", c.MaxMemoryMB)
+	}
+	return nil
+}
+
+func (c *Config) processWAL() error {
+	if c.WALDir == "" {
+		return nil
+	}
+	if c.WALSegmentSizeMB < 0 || c.WALRetention.Duration < 0 || c.WALSyncInterval.Duration < 0 {
+		return fmt.Errorf("wal-segment-size-mb, wal-retention and wal-sync-interval cannot be negative")
+	}
+	if err := os.MkdirAll(c.WALDir, 0755); err != nil {
+		return fmt.Errorf("wal-dir: %v", err)
+	}
+	log.Printf("Data points are logged to %q before processing (wal-dir).", c.WALDir)
+	return nil
+}
+
+func (c *Config) processSpill() error {
+	if c.SpillDir == "" {
+		return nil
+	}
+	if c.SpillMaxSizeMB < 0 || c.SpillRetryInterval.Duration < 0 {
+		return fmt.Errorf("spill-max-size-mb and spill-retry-interval cannot be negative")
+	}
+	if err := os.MkdirAll(c.SpillDir, 0755); err != nil {
+		return fmt.Errorf("spill-dir: %v", err)
+	}
+	log.Printf("Flushes the database cannot keep up with are queued in %q (spill-dir).", c.SpillDir)
+	return nil
+}
+
+func (c *Config) processRateLimits() error {
+	c.rateLimits = nil
+	if c.RateLimitSeries == 0 && len(c.RateLimits) == 0 {
+		return nil
+	}
+	rlc := &receiver.RateLimitConfig{SeriesRate: c.RateLimitSeries}
+	switch c.RateLimitPolicy {
+	case "", "drop":
+		rlc.Policy = receiver.RateLimitDrop
+	case "clamp":
+		rlc.Policy = receiver.RateLimitClamp
+	default:
+		return fmt.Errorf("rate-limit-policy must be drop or clamp, not %q", c.RateLimitPolicy)
+	}
+	if c.RateLimitSeries < 0 {
+		return fmt.Errorf("rate-limit-series cannot be negative")
+	}
+	for _, rl := range c.RateLimits {
+		if rl.Prefix == "" {
+			return fmt.Errorf("rate-limit: prefix is required")
+		}
+		if rl.Rate < 0 || rl.SeriesRate < 0 {
+			return fmt.Errorf("rate-limit %q: rate and series-rate cannot be negative", rl.Prefix)
+		}
+		rlc.Prefixes = append(rlc.Prefixes, receiver.PrefixRateLimit{Prefix: rl.Prefix, Rate: rl.Rate, SeriesRate: rl.SeriesRate})
+	}
+	c.rateLimits = rlc
+	log.Printf("Ingestion is rate limited (rate-limit-series: %v, %d prefix limit(s), policy: %s).", c.RateLimitSeries, len(c.RateLimits), c.RateLimitPolicy)
+	return nil
+}
+
+func (c *Config) processRewriteRules() error {
+	c.rewriteRules = nil
+	if c.RewriteReloadInterval.Duration < 0 {
+		return fmt.Errorf("rewrite-reload-interval cannot be negative")
+	}
+	if c.RewriteReloadInterval.Duration == 0 {
+		c.RewriteReloadInterval.Duration = 10 * time.Second
+	}
+	for _, rw := range c.Rewrites {
+		rule := receiver.RewriteRule{Match: rw.Match, Replacement: rw.Replacement}
+		switch rw.Action {
+		case "rename":
+			rule.Action = receiver.RewriteRename
+		case "drop":
+			rule.Action = receiver.RewriteDrop
+		case "prefix":
+			rule.Action = receiver.RewritePrefix
+		default:
+			return fmt.Errorf("rewrite %q: action must be rename, drop or prefix, not %q", rw.Match, rw.Action)
+		}
+		if _, err := regexp.Compile(rw.Match); err != nil {
+			return fmt.Errorf("rewrite %q: %v", rw.Match, err)
+		}
+		if rule.Action == receiver.RewritePrefix && rw.Replacement == "" {
+			return fmt.Errorf("rewrite %q: prefix requires a replacement", rw.Match)
+		}
+		c.rewriteRules = append(c.rewriteRules, rule)
+	}
+	if len(c.rewriteRules) > 0 {
+		log.Printf("Incoming series names are rewritten by %d rule(s).", len(c.rewriteRules))
+	}
+	return nil
+}
+
+func (c *Config) processBeacon() error {
+	if c.BeaconURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.BeaconURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("beacon-url must be an http or https URL: %q", c.BeaconURL)
+	}
+	if c.BeaconInterval.Duration < 0 {
+		return fmt.Errorf("beacon-interval cannot be negative")
+	}
+	if c.BeaconInterval.Duration == 0 {
+		c.BeaconInterval.Duration = 5 * time.Minute
+	}
+	log.Printf("A health report is sent to %q every %v (beacon-url).", c.BeaconURL, c.BeaconInterval.Duration)
+	return nil
+}
+
+func (c *Config) processExpireSeries() error {
+	if c.ExpireSeriesAfter.Duration < 0 || c.ExpireSeriesInterval.Duration < 0 {
+		return fmt.Errorf("expire-series-after and expire-series-interval cannot be negative")
+	}
+	if c.ExpireSeriesAfter.Duration == 0 {
+		return nil
+	}
+	if c.ExpireSeriesInterval.Duration == 0 {
+		c.ExpireSeriesInterval.Duration = time.Hour
+	}
+	if c.ExpireSeriesDryRun {
+		log.Printf("Series not updated for %v are listed every %v, but not deleted (expire-series-dry-run).", c.ExpireSeriesAfter.Duration, c.ExpireSeriesInterval.Duration)
+	} else {
+		log.Printf("Series not updated for %v are deleted every %v (expire-series-after).", c.ExpireSeriesAfter.Duration, c.ExpireSeriesInterval.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processSeriesQuotas() error {
+	c.seriesQuotas = nil
+	if c.MaxNewSeriesPerMinute == 0 && c.MaxSeriesPerTenant == 0 && len(c.SeriesQuotas) == 0 {
+		return nil
+	}
+	sqc := &receiver.SeriesQuotaConfig{NewPerMinute: c.MaxNewSeriesPerMinute, MaxPerTenant: c.MaxSeriesPerTenant}
+	switch c.SeriesQuotaPolicy {
+	case "", "drop":
+		sqc.Policy = receiver.SeriesQuotaDrop
+	case "park":
+		sqc.Policy = receiver.SeriesQuotaPark
+	default:
+		return fmt.Errorf("series-quota-policy must be drop or park, not %q", c.SeriesQuotaPolicy)
+	}
+	if c.MaxNewSeriesPerMinute < 0 || c.MaxSeriesPerTenant < 0 {
+		return fmt.Errorf("max-new-series-per-minute and max-series-per-tenant cannot be negative")
+	}
+	for _, sq := range c.SeriesQuotas {
+		if sq.Prefix == "" {
+			return fmt.Errorf("series-quota: prefix is required")
+		}
+		if sq.MaxSeries < 0 {
+			return fmt.Errorf("series-quota %q: max-series cannot be negative", sq.Prefix)
+		}
+		sqc.Prefixes = append(sqc.Prefixes, receiver.PrefixSeriesQuota{Prefix: sq.Prefix, MaxSeries: sq.MaxSeries})
+	}
+	c.seriesQuotas = sqc
+	log.Printf("New series are limited (max-new-series-per-minute: %d, max-series-per-tenant: %d, %d prefix quota(s), policy: %s).",
+		c.MaxNewSeriesPerMinute, c.MaxSeriesPerTenant, len(c.SeriesQuotas), c.SeriesQuotaPolicy)
+	return nil
+}
+
+func (c *Config) processSeriesFilter() error {
+	c.seriesFilter = nil
+	if len(c.SeriesAllow) == 0 && len(c.SeriesDeny) == 0 {
+		return nil
+	}
+	for _, expr := range append(append([]string{}, c.SeriesAllow...), c.SeriesDeny...) {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("series-allow/series-deny %q: %v", expr, err)
+		}
+	}
+	c.seriesFilter = &receiver.SeriesFilter{Allow: c.SeriesAllow, Deny: c.SeriesDeny}
+	log.Printf("Incoming series are filtered by name (%d series-allow, %d series-deny).", len(c.SeriesAllow), len(c.SeriesDeny))
+	return nil
+}
+
+func (c *Config) processDedupWindow() error {
+	if c.DedupWindow.Duration < 0 {
+		return fmt.Errorf("dedup-window cannot be negative")
+	}
+	if c.DedupWindow.Duration > 0 {
+		log.Printf("Duplicate data points arriving within %v are dropped (dedup-window).", c.DedupWindow.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processAggregationRules() error {
+	c.aggRules = nil
+	if c.AggregationRulesFile == "" {
+		return nil
+	}
+	f, err := os.Open(c.AggregationRulesFile)
+	if err != nil {
+		return fmt.Errorf("aggregation-rules-file: %v", err)
+	}
+	defer f.Close()
+	if c.aggRules, err = receiver.ParseAggregationRules(f); err != nil {
+		return fmt.Errorf("aggregation-rules-file %s: %v", c.AggregationRulesFile, err)
+	}
+	log.Printf("Incoming series are aggregated by %d rule(s) from %q (aggregation-rules-file).", len(c.aggRules), c.AggregationRulesFile)
+	return nil
+}
+
 func (c *Config) processStatFlushInterval() error {
 	if c.StatFlush.Duration == 0 {
 		return fmt.Errorf("stat-flush-interval is missing")
@@ -239,6 +674,24 @@ func (c *Config) processStatsNamePrefix() error {
 	return nil
 }
 
+func (c *Config) processStatsForward() error {
+	if c.StatsForwardTo == "" {
+		if c.StatsForwardOnly {
+			return fmt.Errorf("stats-forward-only requires stats-forward-to")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.StatsForwardTo); err != nil {
+		return fmt.Errorf("stats-forward-to: %v", err)
+	}
+	if c.StatsForwardOnly {
+		log.Printf("Stats will be forwarded to %q and not stored (stats-forward-to, stats-forward-only).", c.StatsForwardTo)
+	} else {
+		log.Printf("Stats will also be forwarded to %q (stats-forward-to).", c.StatsForwardTo)
+	}
+	return nil
+}
+
 func (c *Config) processWorkers() error {
 	if c.Workers == 0 {
 		return fmt.Errorf("workers missing, must be an integer")
@@ -247,9 +700,260 @@ func (c *Config) processWorkers() error {
 	return nil
 }
 
+func (c *Config) processHttpTLS() error {
+	if (c.HttpTLSCertFile == "") != (c.HttpTLSKeyFile == "") {
+		return fmt.Errorf("http-tls-cert-file and http-tls-key-file must be specified together")
+	}
+	if c.HttpTLSCertFile != "" {
+		if c.HttpTLSReloadInterval.Duration <= 0 {
+			c.HttpTLSReloadInterval.Duration = time.Minute
+		}
+		log.Printf("HTTP will use TLS with certificate %q (http-tls-cert-file), checked for changes every %v (http-tls-reload-interval). Changes to http-client-cert require a restart.",
+			c.HttpTLSCertFile, c.HttpTLSReloadInterval.Duration)
+	}
+	if c.HttpTLSClientCAFile == "" {
+		if len(c.HttpClientCerts) > 0 {
+			return fmt.Errorf("http-client-cert entries require http-tls-client-ca-file")
+		}
+		return nil
+	}
+	if c.HttpTLSCertFile == "" {
+		return fmt.Errorf("http-tls-client-ca-file requires http-tls-cert-file and http-tls-key-file")
+	}
+	if len(c.HttpClientCerts) == 0 {
+		return fmt.Errorf("http-tls-client-ca-file is set, but there are no http-client-cert entries (all requests would be denied)")
+	}
+	for _, cc := range c.HttpClientCerts {
+		if cc.Identity == "" || cc.Tenant == "" {
+			return fmt.Errorf("http-client-cert: identity and tenant are required")
+		}
+		if err := checkScopes(cc.Scopes); err != nil {
+			return fmt.Errorf("http-client-cert %q: %v", cc.Identity, err)
+		}
+		if err := checkTenant(cc.Tenant, cc.Global); err != nil {
+			return fmt.Errorf("http-client-cert %q: %v", cc.Identity, err)
+		}
+	}
+	log.Printf("HTTP client certificates required, %d identities mapped to tenants (http-tls-client-ca-file).", len(c.HttpClientCerts))
+	return nil
+}
+
+func checkScopes(scopes []string) error {
+	for _, s := range scopes {
+		switch s {
+		case h.ScopeRead, h.ScopeWrite, h.ScopeAdmin:
+		default:
+			return fmt.Errorf("invalid scope %q (valid scopes: read, write, admin)", s)
+		}
+	}
+	return nil
+}
+
+// checkTenant makes sure that the name of a tenant which is not
+// global can be its namespace, i.e. the first component of the names
+// of its series.
+func checkTenant(name string, global bool) error {
+	if global {
+		return nil
+	}
+	if strings.Contains(name, ".") || misc.SanitizeName(name) != name {
+		return fmt.Errorf("invalid tenant %q (a tenant is a series name prefix, it cannot contain dots or characters not allowed in a series name, unless global)", name)
+	}
+	return nil
+}
+
+func (c *Config) processHttpTokens() error {
+	if len(c.HttpTokens) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for i, tk := range c.HttpTokens {
+		if tk.Token == "" || tk.Tenant == "" {
+			return fmt.Errorf("http-token #%d: token and tenant are required", i+1)
+		}
+		if seen[tk.Token] {
+			return fmt.Errorf("http-token #%d (tenant %q): duplicate token", i+1, tk.Tenant)
+		}
+		seen[tk.Token] = true
+		if err := checkScopes(tk.Scopes); err != nil {
+			return fmt.Errorf("http-token #%d (tenant %q): %v", i+1, tk.Tenant, err)
+		}
+		if err := checkTenant(tk.Tenant, tk.Global); err != nil {
+			return fmt.Errorf("http-token #%d: %v", i+1, err)
+		}
+	}
+	if c.HttpTLSCertFile == "" {
+		log.Printf("WARNING: http-token without http-tls-cert-file, tokens will be sent in the clear.")
+	}
+	log.Printf("HTTP requests require a bearer token or client certificate, %d tokens mapped to tenants (http-token).", len(c.HttpTokens))
+	return nil
+}
+
+func (c *Config) processGraphiteTLS() error {
+	if (c.GraphiteTLSCertFile == "") != (c.GraphiteTLSKeyFile == "") {
+		return fmt.Errorf("graphite-tls-cert-file and graphite-tls-key-file must be specified together")
+	}
+	if c.GraphiteTLSClientCAFile != "" && c.GraphiteTLSCertFile == "" {
+		return fmt.Errorf("graphite-tls-client-ca-file requires graphite-tls-cert-file and graphite-tls-key-file")
+	}
+	for _, tk := range c.GraphiteAuthTokens {
+		if tk == "" || strings.ContainsAny(tk, " \t\r\n") {
+			return fmt.Errorf("graphite-auth-tokens: tokens cannot be blank or contain whitespace")
+		}
+	}
+	if c.GraphiteTLSCertFile != "" {
+		if c.HttpTLSReloadInterval.Duration <= 0 {
+			c.HttpTLSReloadInterval.Duration = time.Minute
+		}
+		log.Printf("Graphite text protocol will use TLS with certificate %q (graphite-tls-cert-file).", c.GraphiteTLSCertFile)
+	}
+	if c.GraphiteTLSClientCAFile != "" {
+		orToken := ""
+		if len(c.GraphiteAuthTokens) > 0 {
+			orToken = " or send an auth token"
+		}
+		log.Printf("Graphite text protocol clients must present a certificate signed by %q (graphite-tls-client-ca-file)%s.", c.GraphiteTLSClientCAFile, orToken)
+	} else if len(c.GraphiteAuthTokens) > 0 {
+		log.Printf("Graphite text protocol clients must send an auth token (graphite-auth-tokens).")
+		if c.GraphiteTLSCertFile == "" {
+			log.Printf("WARNING: graphite-auth-tokens without graphite-tls-cert-file, tokens will be sent in the clear.")
+		}
+	}
+	return nil
+}
+
+func (c *Config) processClusterDiscovery() error {
+	d := c.ClusterDiscovery
+	if d == nil {
+		return nil
+	}
+	switch d.Provider {
+	case "dns", "dns-srv":
+		if d.Name == "" {
+			return fmt.Errorf("cluster-discovery: name is required for provider %q", d.Provider)
+		}
+		c.discoverer = &cluster.DNSDiscoverer{Name: d.Name, Port: d.Port, SRV: d.Provider == "dns-srv"}
+	case "kubernetes":
+		if d.LabelSelector == "" {
+			return fmt.Errorf("cluster-discovery: label-selector is required for provider %q", d.Provider)
+		}
+		kd, err := cluster.NewKubernetesDiscoverer(d.Namespace, d.LabelSelector, d.Port)
+		if err != nil {
+			return fmt.Errorf("cluster-discovery: %v", err)
+		}
+		c.discoverer = kd
+	case "ec2":
+		if d.TagKey == "" {
+			return fmt.Errorf("cluster-discovery: tag-key is required for provider %q", d.Provider)
+		}
+		c.discoverer = &cluster.EC2Discoverer{Region: d.Region, TagKey: d.TagKey, TagValue: d.TagValue, Port: d.Port}
+	default:
+		return fmt.Errorf("cluster-discovery: unknown provider %q (valid providers: dns, dns-srv, kubernetes, ec2)", d.Provider)
+	}
+	if d.Interval.Duration == 0 {
+		d.Interval.Duration = 30 * time.Second
+	}
+	log.Printf("Cluster nodes will be discovered via %s every %v (cluster-discovery).", d.Provider, d.Interval.Duration)
+	return nil
+}
+
+func (c *Config) processInfluxTemplate() error {
+	t, err := influx.NewTemplate(c.InfluxTemplate)
+	if err != nil {
+		return fmt.Errorf("influx-template: %v", err)
+	}
+	c.influxTemplate = t
+	return nil
+}
+
+func (c *Config) processOpenTSDBTagPolicy() error {
+	tp, err := opentsdb.ParseTagPolicy(c.OpenTSDBTagPolicy)
+	if err != nil {
+		return fmt.Errorf("opentsdb-tag-policy: %v", err)
+	}
+	c.opentsdbTags = tp
+	return nil
+}
+
+// The listeners whose wire format can be configured in [decoders].
+var decoderListeners = []string{"graphite-text", "graphite-udp", "graphite-unix", "nats", "amqp"}
+
+// processDecoders looks up the decoders configured for the
+// listeners, the ones not configured use the Graphite text format.
+func (c *Config) processDecoders() error {
+	c.decoders = make(map[string]ingest.Decoder)
+	for listener, name := range c.Decoders {
+		known := false
+		for _, l := range decoderListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("decoders: unknown listener %q (valid listeners: %s)", listener, strings.Join(decoderListeners, ", "))
+		}
+		d, ok := ingest.LookupDecoder(name)
+		if !ok {
+			return fmt.Errorf("decoders: %s: unknown decoder %q (registered decoders: %s)", listener, name, strings.Join(ingest.DecoderNames(), ", "))
+		}
+		c.decoders[listener] = d
+		log.Printf("The %s listener uses the %q decoder.", listener, name)
+	}
+	return nil
+}
+
+// decoder returns the decoder of the listener.
+func (c *Config) decoder(listener string) ingest.Decoder {
+	if d := c.decoders[listener]; d != nil {
+		return d
+	}
+	return graphiteDecoder
+}
+
+// processIngestSources creates the message bus ingest sources. The
+// messages are one or more lines, in the Graphite text format unless
+// a decoder is configured.
+func (c *Config) processIngestSources() error {
+	c.ingestSources = nil
+	if c.NatsURL != "" {
+		if c.NatsSubject == "" {
+			return fmt.Errorf("nats-subject is required with nats-url")
+		}
+		if c.NatsQueueGroup == "" {
+			c.NatsQueueGroup = "tgres"
+		}
+		c.ingestSources = append(c.ingestSources, &ingest.NATS{
+			URL: c.NatsURL, Subject: c.NatsSubject, Queue: c.NatsQueueGroup, Decode: c.decoder("nats")})
+	}
+	if c.AmqpURL != "" {
+		if c.AmqpQueue == "" {
+			return fmt.Errorf("amqp-queue is required with amqp-url")
+		}
+		if c.AmqpPrefetch < 0 {
+			return fmt.Errorf("amqp-prefetch cannot be negative")
+		}
+		c.ingestSources = append(c.ingestSources, &ingest.AMQP{
+			URL: c.AmqpURL, Queue: c.AmqpQueue, Prefetch: c.AmqpPrefetch, Decode: c.decoder("amqp")})
+	}
+	return nil
+}
+
 func (c *Config) processDSSpec() error {
 	// TODO validate function, regular expression, all that
 	for _, ds := range c.DSs {
+		if _, err := rrd.ParseDSType(ds.Type); err != nil {
+			return fmt.Errorf("DS %q: %v", ds.Regexp.String(), err)
+		}
+		if _, err := rrd.ParseGapFill(ds.GapFill); err != nil {
+			return fmt.Errorf("DS %q: %v", ds.Regexp.String(), err)
+		}
+		if ds.Step.Duration <= 0 || ds.Step.Duration%receiver.TimestampResolution != 0 {
+			return fmt.Errorf("DS %q: step (%v) must be a positive multiple of %v", ds.Regexp.String(), ds.Step.Duration, receiver.TimestampResolution)
+		}
+		if ds.Heartbeat.Duration < 0 {
+			return fmt.Errorf("DS %q: heartbeat (%v) must not be negative", ds.Regexp.String(), ds.Heartbeat.Duration)
+		}
+		if ds.Min != nil && ds.Max != nil && *ds.Min > *ds.Max {
+			return fmt.Errorf("DS %q: min (%v) is greater than max (%v)", ds.Regexp.String(), *ds.Min, *ds.Max)
+		}
 		for _, rra := range ds.RRAs {
 			if (rra.Step.Nanoseconds() % c.MinStep.Nanoseconds()) != 0 {
 				return fmt.Errorf("DS %q: invalid Step (%v), must be one or multiple min-step (%v).", ds.Regexp.String(), rra.Step, c.MinStep)
@@ -278,33 +982,88 @@ func (c *Config) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
 	return nil
 }
 
+// FindMatchingDSSpecPattern returns the regexp of the [[ds]] section
+// FindMatchingDSSpec() would use, for /api/dsspec.
+func (c *Config) FindMatchingDSSpecPattern(ident serde.Ident) string {
+	for _, dsSpec := range c.DSs {
+		if dsSpec.Regexp.Regexp.MatchString(ident["name"]) {
+			return dsSpec.Regexp.String()
+		}
+	}
+	return ""
+}
+
 func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
+	dsType, _ := rrd.ParseDSType(dsSpec.Type) // validated in processDSSpec
 	serdeDSSpec := &rrd.DSSpec{
+		Type:      dsType,
 		Step:      dsSpec.Step.Duration,
 		Heartbeat: dsSpec.Heartbeat.Duration,
+		Min:       math.NaN(),
+		Max:       math.NaN(),
 		RRAs:      make([]rrd.RRASpec, len(dsSpec.RRAs)),
 	}
+	if dsSpec.Min != nil {
+		serdeDSSpec.Min = *dsSpec.Min
+	}
+	if dsSpec.Max != nil {
+		serdeDSSpec.Max = *dsSpec.Max
+	}
 	for i, r := range dsSpec.RRAs {
 		serdeDSSpec.RRAs[i] = rrd.RRASpec{
 			Function: r.Function,
 			Step:     r.Step,
 			Span:     r.Span,
 			Xff:      float32(r.Xff),
+			RoundTo:  r.RoundTo,
+			GapFill:  dsSpec.gapFill(&r),
 		}
 	}
 	return serdeDSSpec
 }
 
+// gapFill returns the gap fill policy of an RRA of this DS, its own
+// or else the default of the DS.
+func (dsSpec *ConfigDSSpec) gapFill(r *ConfigRRASpec) rrd.GapFill {
+	if r.GapFill != nil {
+		return *r.GapFill
+	}
+	gf, _ := rrd.ParseGapFill(dsSpec.GapFill) // validated in processDSSpec
+	return gf
+}
+
 type configer interface {
 	processConfigPidFile(string) error
 	processConfigLogFile(string) error
 	processConfigLogCycleInterval() error
 	processDbConnectString() error
+	processClusterDiscovery() error
 	processMinStep() error
+	processLateTolerance() error
 	processMaxReceiverQueueSize() error
+	processFlowControl() error
+	processResourceLimits() error
+	processWAL() error
+	processSpill() error
+	processRateLimits() error
+	processRewriteRules() error
+	processSeriesFilter() error
+	processDedupWindow() error
+	processSeriesQuotas() error
+	processBeacon() error
+	processExpireSeries() error
+	processAggregationRules() error
 	processStatFlushInterval() error
 	processStatsNamePrefix() error
+	processStatsForward() error
 	processWorkers() error
+	processHttpTLS() error
+	processHttpTokens() error
+	processGraphiteTLS() error
+	processInfluxTemplate() error
+	processOpenTSDBTagPolicy() error
+	processDecoders() error
+	processIngestSources() error
 	processDSSpec() error
 }
 
@@ -322,21 +1081,94 @@ var processConfig = func(c configer, wd string) error {
 	if err := c.processDbConnectString(); err != nil {
 		return err
 	}
+	if err := c.processClusterDiscovery(); err != nil {
+		return err
+	}
+	return processReceiverConfig(c)
+}
+
+// processReceiverConfig is the part of processConfig which does not
+// concern the daemon process (pid and log files) or the database
+// connection, it is also used by Tgres.Start().
+func processReceiverConfig(c configer) error {
 	if err := c.processMinStep(); err != nil {
 		return err
 	}
+	if err := c.processLateTolerance(); err != nil {
+		return err
+	}
 	if err := c.processMaxReceiverQueueSize(); err != nil {
 		return err
 	}
+	if err := c.processFlowControl(); err != nil {
+		return err
+	}
+	if err := c.processResourceLimits(); err != nil {
+		return err
+	}
+	if err := c.processWAL(); err != nil {
+		return err
+	}
+	if err := c.processSpill(); err != nil {
+		return err
+	}
+	if err := c.processRateLimits(); err != nil {
+		return err
+	}
+	if err := c.processRewriteRules(); err != nil {
+		return err
+	}
+	if err := c.processSeriesFilter(); err != nil {
+		return err
+	}
+	if err := c.processDedupWindow(); err != nil {
+		return err
+	}
+	if err := c.processSeriesQuotas(); err != nil {
+		return err
+	}
+	if err := c.processBeacon(); err != nil {
+		return err
+	}
+	if err := c.processExpireSeries(); err != nil {
+		return err
+	}
+	if err := c.processAggregationRules(); err != nil {
+		return err
+	}
 	if err := c.processStatFlushInterval(); err != nil {
 		return err
 	}
 	if err := c.processStatsNamePrefix(); err != nil {
 		return err
 	}
+	if err := c.processStatsForward(); err != nil {
+		return err
+	}
 	if err := c.processWorkers(); err != nil {
 		return err
 	}
+	if err := c.processHttpTLS(); err != nil {
+		return err
+	}
+	if err := c.processHttpTokens(); err != nil {
+		return err
+	}
+	if err := c.processGraphiteTLS(); err != nil {
+		return err
+	}
+	if err := c.processInfluxTemplate(); err != nil {
+		return err
+	}
+	if err := c.processOpenTSDBTagPolicy(); err != nil {
+		return err
+	}
+	if err := c.processDecoders(); err != nil {
+		return err
+	}
+	if err := c.processIngestSources(); err != nil {
+		return err
+	}
 	if err := c.processDSSpec(); err != nil {
 		return err
 	}
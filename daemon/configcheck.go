@@ -0,0 +1,168 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+	h "github.com/tgres/tgres/http"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// TagConfigHash is the node tag under which the configHash() of a
+// node is gossiped to the other nodes of the cluster.
+const TagConfigHash = "tgres.config"
+
+// How often the configuration hashes of the other nodes are checked.
+const configCheckInterval = 30 * time.Second
+
+// configHash returns a short hash of the parts of the configuration
+// which must be the same on all nodes of a cluster: the [[ds]] specs
+// (in order, the first match wins) and the aggregation rules. A point
+// is processed by whichever node receives it, so nodes which disagree
+// create different series from the same input.
+func configHash(c *Config) string {
+	sum := sha256.New()
+	for _, ds := range c.DSs {
+		fmt.Fprintf(sum, "ds %q %v %v\n", ds.Regexp.String(), ds.Step.Duration, ds.Heartbeat.Duration)
+		if t, _ := rrd.ParseDSType(ds.Type); t != rrd.GAUGE { // so that older hashes stay the same
+			fmt.Fprintf(sum, "type %v\n", t)
+		}
+		if ds.Min != nil {
+			fmt.Fprintf(sum, "min %v\n", *ds.Min)
+		}
+		if ds.Max != nil {
+			fmt.Fprintf(sum, "max %v\n", *ds.Max)
+		}
+		for _, rra := range ds.RRAs {
+			fmt.Fprintf(sum, "rra %d %v %v %v %v\n", int(rra.Function), rra.Step, rra.Span, rra.Xff, rra.RoundTo) // int so that hashes stay the same
+			if gf := ds.gapFill(&rra); gf != rrd.GapNaN {
+				fmt.Fprintf(sum, "gap-fill %v\n", gf)
+			}
+		}
+	}
+	for _, r := range c.aggRules {
+		fmt.Fprintf(sum, "aggregate %q %v %q %q\n", r.Output, r.Frequency, r.Method, r.Input)
+	}
+	fmt.Fprintf(sum, "aggregation-drop-inputs %v\n", c.AggregationDropInputs)
+	return hex.EncodeToString(sum.Sum(nil))[:12]
+}
+
+// configCheck periodically compares the configuration hash of the
+// other nodes to ours and warns (in the log, the internal stats and
+// /api/cluster/config) about the ones which differ. Nodes which do
+// not gossip a hash (older versions) are not compared.
+type configCheck struct {
+	hash string
+
+	sync.Mutex
+	divergent map[string]string // node name -> its hash
+	stop      chan struct{}
+}
+
+func newConfigCheck(hash string) *configCheck {
+	return &configCheck{hash: hash, stop: make(chan struct{})}
+}
+
+// start adds our hash to the tags of the local node, then checks the
+// members of the cluster every interval. The number of divergent
+// nodes is reported to the internal stats of rcvr, if not nil.
+func (cc *configCheck) start(c cluster.Clusterer, rcvr *receiver.Receiver, interval time.Duration) error {
+	tags := map[string]string{TagConfigHash: cc.hash}
+	for k, v := range c.LocalNode().Tags() {
+		if k != TagConfigHash {
+			tags[k] = v
+		}
+	}
+	if err := c.SetTags(tags); err != nil {
+		return err
+	}
+	log.Printf("Configuration hash (DS specs and aggregation rules) is %s.", cc.hash)
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-cc.stop:
+				return
+			case <-tick.C:
+			}
+			n := cc.check(c.Members())
+			if rcvr != nil && rcvr.ReportStats {
+				rcvr.QueueGauge(serde.Ident{"name": rcvr.ReportStatsPrefix + ".cluster.config_divergent"}, float64(n))
+			}
+		}
+	}()
+	return nil
+}
+
+// check compares the hashes of the nodes to ours, logging the
+// changes since the last check, and returns how many differ.
+func (cc *configCheck) check(nodes []*cluster.Node) int {
+	divergent := make(map[string]string)
+	for _, n := range nodes {
+		if hash, ok := n.Tag(TagConfigHash); ok && hash != cc.hash {
+			divergent[n.Name()] = hash
+		}
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+	names := make([]string, 0, len(divergent))
+	for name := range divergent {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if hash := divergent[name]; cc.divergent[name] != hash {
+			log.Printf("WARNING: Cluster node %s has a different configuration (hash %s, ours is %s), the DS specs or aggregation rules differ and series will be inconsistent depending on which node receives a point.", name, hash, cc.hash)
+		}
+	}
+	for name := range cc.divergent {
+		if _, ok := divergent[name]; !ok {
+			log.Printf("Cluster node %s now has the same configuration or has left the cluster.", name)
+		}
+	}
+	cc.divergent = divergent
+	return len(divergent)
+}
+
+// status is what /api/cluster/config reports.
+func (cc *configCheck) status() *h.ClusterConfigStatus {
+	cc.Lock()
+	defer cc.Unlock()
+	st := &h.ClusterConfigStatus{Hash: cc.hash, Consistent: len(cc.divergent) == 0}
+	if len(cc.divergent) > 0 {
+		st.Divergent = make(map[string]string, len(cc.divergent))
+		for name, hash := range cc.divergent {
+			st.Divergent[name] = hash
+		}
+	}
+	return st
+}
+
+func (cc *configCheck) Stop() {
+	close(cc.stop)
+}
@@ -18,6 +18,7 @@ package daemon
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -26,9 +27,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/blaster"
 	"github.com/tgres/tgres/cluster"
 	"github.com/tgres/tgres/dsl"
@@ -38,6 +39,7 @@ import (
 
 var (
 	logFile          *os.File
+	eventLog         io.Writer // Windows event log, if running as a service
 	cycleLogCh       = make(chan int)
 	gracefulChildPid int
 )
@@ -94,27 +96,153 @@ var determineClusterJoinAddress = func(join string, db serde.DbAddresser) (ips [
 	return ips, err
 }
 
-var initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.Cluster, err error) {
-	c, err = cluster.NewClusterBind(bindAddr, 0, advAddr, 0, 0, bindAddr)
+var initCluster = func(bindAddr, advAddr string, joinIps []string) (c cluster.Clusterer, err error) {
+	if os.Getenv("TGRES_CLUSTER_SINGLE_NODE") != "" {
+		// Standalone, no gossip or RPC
+		if len(joinIps) > 0 {
+			return nil, fmt.Errorf("TGRES_CLUSTER_SINGLE_NODE: cannot join %q", strings.Join(joinIps, ","))
+		}
+		log.Printf("Cluster: single node mode, not listening for other nodes.")
+		return cluster.NewSingleNodeBind(bindAddr, advAddr), nil
+	}
+
+	var cfg *cluster.ClusterConfig
+	if os.Getenv("TGRES_CLUSTER_WAN") != "" {
+		// Nodes are in different data centers
+		cfg = cluster.DefaultWANClusterConfig()
+	} else {
+		cfg = cluster.DefaultLANClusterConfig()
+	}
+	cfg.BindAddr, cfg.AdvertiseAddr, cfg.Name = bindAddr, advAddr, bindAddr
+	cfg.Tags = buildTags()
+	if path := os.Getenv("TGRES_CLUSTER_NODE_ID_FILE"); path != "" {
+		// Keep the node's place in the cluster across restarts
+		if cfg.NodeID, err = cluster.LoadNodeID(path); err != nil {
+			return nil, err
+		}
+		cfg.SortBy = cluster.SortByNodeID
+	}
+	if s := os.Getenv("TGRES_CLUSTER_OFFLINE_QUEUE"); s != "" {
+		// Keep up to this many messages for a node which is down
+		if cfg.OfflineQueueSize, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("TGRES_CLUSTER_OFFLINE_QUEUE: %v", err)
+		}
+	}
+	if s := os.Getenv("TGRES_CLUSTER_OFFLINE_TTL"); s != "" {
+		if cfg.OfflineQueueTTL, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("TGRES_CLUSTER_OFFLINE_TTL: %v", err)
+		}
+	}
+	if s := os.Getenv("TGRES_CLUSTER_ACQUIRE_CONCURRENCY"); s != "" {
+		// Load the DSs moving to this node this many at a time
+		if cfg.AcquireConcurrency, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("TGRES_CLUSTER_ACQUIRE_CONCURRENCY: %v", err)
+		}
+	}
+	cc, err := cluster.NewClusterWithConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := c.Join(joinIps); err != nil {
+	if err := cc.Join(joinIps); err != nil {
 		return nil, fmt.Errorf("Unable to join cluster members: %q, %v", strings.Join(joinIps, ","), err)
 	}
 
-	return c, nil
+	return cc, nil
+}
+
+// Find (and repair, if repair is true) data sources left
+// inconsistent by a flush interrupted by a crash.
+var checkFlushConsistency = func(db serde.SerDe, repair bool) {
+	cc, ok := db.(serde.FlushConsistencyChecker)
+	if !ok {
+		return
+	}
+	n, err := cc.CheckFlushConsistency(repair)
+	if err != nil {
+		log.Printf("Error checking data source flush consistency: %v", err)
+		return
+	}
+	if n > 0 {
+		if repair {
+			log.Printf("Repaired %d data source(s) left inconsistent by an interrupted flush.", n)
+		} else {
+			log.Printf("WARNING: %d data source(s) may have been left inconsistent by an interrupted flush, not repairing because other cluster nodes may be flushing.", n)
+		}
+	}
 }
 
+// How many aggregated stats data points can be waiting to be sent
+// to stats-forward-to.
+const statsForwardQueueSize = 100000
+
 var createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) *receiver.Receiver {
 	r := receiver.New(db, receiver.MatchingDSSpecFinder(cfg))
 	r.MinStep = cfg.MinStep.Duration
 	r.StatFlushDuration = cfg.StatFlush.Duration
 	r.StatsNamePrefix = cfg.StatsNamePrefix
+	if cfg.StatsForwardTo != "" {
+		r.StatsForward = aggregator.NewForwarder(cfg.StatsForwardTo, statsForwardQueueSize)
+		r.StatsForwardOnly = cfg.StatsForwardOnly
+	}
 	r.MaxReceiverQueueSize = cfg.MaxReceiverQueueSize
+	r.PublishExpvar()
+	if cfg.FlowControlHighWatermark > 0 {
+		r.SetFlowControl(cfg.FlowControlHighWatermark, cfg.FlowControlLowWatermark)
+	}
+	r.MaxCachedDSs = cfg.MaxCachedDSs
+	r.MaxCachedBytes = uint64(cfg.MaxCachedMB) * 1024 * 1024
+	r.MaxMemory = uint64(cfg.MaxMemoryMB) * 1024 * 1024
+	r.CacheShards = cfg.DSCacheShards
+	r.LateTolerance = cfg.LateTolerance.Duration
+	if cfg.WALDir != "" {
+		err := r.OpenWAL(receiver.WALConfig{
+			Dir:          cfg.WALDir,
+			SegmentSize:  int64(cfg.WALSegmentSizeMB) * 1024 * 1024,
+			Retention:    cfg.WALRetention.Duration,
+			SyncInterval: cfg.WALSyncInterval.Duration,
+		})
+		if err != nil {
+			log.Printf("WARNING: Unable to open the write-ahead log, continuing without it: %v", err)
+		}
+	}
+	if cfg.SpillDir != "" {
+		err := r.OpenSpill(receiver.SpillConfig{
+			Dir:           cfg.SpillDir,
+			MaxSize:       int64(cfg.SpillMaxSizeMB) * 1024 * 1024,
+			RetryInterval: cfg.SpillRetryInterval.Duration,
+		})
+		if err != nil {
+			log.Printf("WARNING: Unable to open the spill queue, continuing without it: %v", err)
+		}
+	}
+	if cfg.rateLimits != nil {
+		r.SetRateLimits(*cfg.rateLimits)
+	}
+	if err := r.SetRewriteRules(cfg.rewriteRules); err != nil {
+		log.Printf("WARNING: Unable to set the rewrite rules, continuing without them: %v", err)
+	}
+	if cfg.seriesFilter != nil {
+		if err := r.SetSeriesFilter(*cfg.seriesFilter); err != nil {
+			log.Printf("WARNING: Unable to set the series filter, continuing without it: %v", err)
+		}
+	}
+	if cfg.DedupWindow.Duration > 0 {
+		r.SetDedupWindow(cfg.DedupWindow.Duration)
+	}
+	if cfg.seriesQuotas != nil {
+		r.SetSeriesQuotas(*cfg.seriesQuotas)
+	}
+	if len(cfg.aggRules) > 0 {
+		if err := r.SetAggregationRules(cfg.aggRules, cfg.AggregationDropInputs); err != nil {
+			log.Printf("WARNING: Unable to set the aggregation rules, continuing without them: %v", err)
+		}
+	}
 	r.ReportStats = true
 	r.NWorkers = cfg.Workers
+	for _, src := range cfg.ingestSources {
+		r.AddIngestSource(src)
+	}
 	r.SetCluster(c)
 	return r
 }
@@ -123,19 +251,20 @@ var startReceiver = func(r *receiver.Receiver) {
 	r.Start()
 }
 
-var waitForSignal = func(r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {
+var waitForSignal = func(lc *Lifecycle, r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {
 	for {
-		// Wait for a SIGINT or SIGTERM.
-		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		// Wait for a SIGINT or SIGTERM (or a service stop request).
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, shutdownSignals...)
+		notifyServiceStop(ch)
 		s := <-ch
 		log.Printf("Got signal: %v", s)
-		if s == syscall.SIGHUP {
+		if isRestartSignal(s) {
 			if gracefulChildPid == 0 {
 				gracefulRestart(r, sm, cfgPath, join)
 			}
 		} else {
-			gracefulExit(r, sm)
+			gracefulExit(lc)
 			break
 		}
 	}
@@ -198,69 +327,152 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		rcvr.Blaster = blaster.New(rcvr)
 	}
 
-	// Create and run the Service Manager
 	rcache := dsl.NewNamedDSFetcher(db.Fetcher())
-	serviceMgr := newServiceManager(rcvr, rcache, cfg)
-	if err := serviceMgr.run(gracefulProtos); err != nil {
-		log.Printf("Could not run the service manager: %v", err)
-		return
-	}
-
-	// Handle graceful file descriptors
-	if gracefulProtos != "" {
-		// Do the graceful dance - tell the parent to die, then
-		// wait for it to signal us back that the data has been
-		// flushed correctly, at which point it is OK for us to
-		// start the receiver.
+	cfgCheck := newConfigCheck(configHash(cfg))
+	serviceMgr := newServiceManager(rcvr, db.Fetcher(), rcache, cfg, newInfo(cfg, "postgres"), cfgCheck.status)
+
+	// The components are stopped in reverse order: first leave the
+	// cluster, then close the listeners, then flush the receiver.
+	lc := NewLifecycle()
+	addReceiverComponents(lc, rcvr, serviceMgr, gracefulProtos, "cluster", "pid")
+	lc.Add(&Component{
+		Name:      "graceful",
+		DependsOn: []string{"services"},
+		Start: func() error {
+			// Handle graceful file descriptors
+			if gracefulProtos != "" {
+				// Do the graceful dance - tell the parent to die, then
+				// wait for it to signal us back that the data has been
+				// flushed correctly, at which point it is OK for us to
+				// start the receiver.
+
+				waitForGracefulParent()
+			} else {
+				log.Printf("start(): Proceeding with initialization.") // i.e. this is not graceful
+			}
 
-		parent := syscall.Getppid()
-		log.Printf("start(): Killing parent pid: %v", parent)
-		syscall.Kill(parent, syscall.SIGTERM)
-		log.Printf("start(): Waiting for the parent to signal that flush is complete...")
-		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGUSR1)
-		s := <-ch
-		log.Printf("start(): Received %v, proceeding to load the data", s)
-	} else {
-		log.Printf("start(): Proceeding with initialization.") // i.e. this is not graceful
-	}
-
-	// Initialize cluster
-	// We had to wait until after graceful, so that the new cluster can bind to sockets
-	var c *cluster.Cluster
-	const (
-		clusterPause = 5 * time.Second
-		attempts     = 10
-	)
-	for i := 0; i < attempts; i++ {
-		c, err = initCluster(bindAddr, advAddr, joinIps)
-		if err != nil {
-			log.Printf("Error initializing cluster, will try again (up to %v times) in %v: %v", attempts, clusterPause, err)
-			time.Sleep(clusterPause)
-			continue
-		}
-		break
+			// Now that the graceful parent (if any) has flushed, look for
+			// torn flushes. If we are joining a cluster, other nodes may be
+			// flushing right now, so only report them.
+			checkFlushConsistency(db, len(joinIps) == 0 && cfg.discoverer == nil)
+			return nil
+		},
+	})
+	lc.Add(&Component{
+		Name:      "cluster",
+		DependsOn: []string{"graceful"},
+		Start: func() error {
+			// We had to wait until after graceful, so that the new cluster can bind to sockets
+			var (
+				c   cluster.Clusterer
+				err error
+			)
+			const (
+				clusterPause = 5 * time.Second
+				attempts     = 10
+			)
+			for i := 0; i < attempts; i++ {
+				c, err = initCluster(bindAddr, advAddr, joinIps)
+				if err != nil {
+					log.Printf("Error initializing cluster, will try again (up to %v times) in %v: %v", attempts, clusterPause, err)
+					time.Sleep(clusterPause)
+					continue
+				}
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if cfg.discoverer != nil {
+				cc, ok := c.(*cluster.Cluster)
+				if !ok {
+					return fmt.Errorf("cluster-discovery cannot be used with TGRES_CLUSTER_SINGLE_NODE")
+				}
+				// Also rejoins should the whole cluster be restarted
+				cc.AutoJoin(cfg.discoverer, cfg.ClusterDiscovery.Interval.Duration)
+			}
+			rcvr.SetCluster(c)
+			// Not fatal, but the nodes may disagree on how to create series
+			if err := cfgCheck.start(c, rcvr, configCheckInterval); err != nil {
+				log.Printf("WARNING: Unable to gossip the configuration hash: %v", err)
+			}
+			return nil
+		},
+		Stop: func() error {
+			cfgCheck.Stop()
+			if gracefulChildPid == 0 {
+				rcvr.ClusterReady(false) // triggers a transition
+				// Allow enough time for a transition to start
+				time.Sleep(500 * time.Millisecond) // TODO This is a hack
+			}
+			return nil
+		},
+	})
+	rewrites := newRewriteReloader(cfgPath, rcvr.SetRewriteRules)
+	lc.Add(&Component{
+		Name:      "rewrite-reload",
+		DependsOn: []string{"workers"},
+		Start: func() error {
+			go rewrites.watch(cfg.RewriteReloadInterval.Duration)
+			return nil
+		},
+		Stop: func() error {
+			rewrites.Stop()
+			return nil
+		},
+	})
+	if cfg.BeaconURL != "" {
+		bcn := newBeacon(cfg.BeaconURL, cfg.BeaconInstance, rcvr.Stats)
+		lc.Add(&Component{
+			Name:      "beacon",
+			DependsOn: []string{"workers"},
+			Start: func() error {
+				go bcn.run(cfg.BeaconInterval.Duration)
+				return nil
+			},
+			Stop: func() error {
+				bcn.Stop()
+				return nil
+			},
+		})
 	}
-	if err != nil {
-		log.Printf("Error initializing cluster, giving up and exiting: %v", err)
-		return
+	if cfg.ExpireSeriesAfter.Duration > 0 {
+		jan := newJanitor(rcvr.ExpireSeries, cfg.ExpireSeriesAfter.Duration, cfg.ExpireSeriesDryRun)
+		lc.Add(&Component{
+			Name:      "janitor",
+			DependsOn: []string{"workers"},
+			Start: func() error {
+				go jan.run(cfg.ExpireSeriesInterval.Duration)
+				return nil
+			},
+			Stop: func() error {
+				jan.Stop()
+				return nil
+			},
+		})
 	}
-	rcvr.SetCluster(c)
+	lc.Add(&Component{
+		Name:      "pid",
+		DependsOn: []string{"cluster"},
+		Start: func() error {
+			// Save PID (by now the graceful parent pid can be overwritten)
+			if err := savePid(cfg.PidPath); err != nil {
+				// This is not good, but isn't fatal
+				log.Printf("WARNING: Unable to create pid file '%s', exiting: (%v)", cfg.PidPath, err)
+			} else {
+				log.Printf("Pid saved in %q.", cfg.PidPath)
+			}
+			return nil
+		},
+	})
 
-	// Save PID (by now the graceful parent pid can be overwritten)
-	if err := savePid(cfg.PidPath); err != nil {
-		// This is not good, but isn't fatal
-		log.Printf("WARNING: Unable to create pid file '%s', exiting: (%v)", cfg.PidPath, err)
-	} else {
-		log.Printf("Pid saved in %q.", cfg.PidPath)
+	if err := lc.Start(); err != nil {
+		log.Printf("Error starting Tgres, exiting: %v", err)
+		return
 	}
 
-	// *finally* start the receiver (because graceful restart, parent must save data first)
-	startReceiver(rcvr)
-	log.Printf("Receiver started, Tgres is ready.")
-
 	// Wait for HUP or TERM, etc.
-	waitForSignal(rcvr, serviceMgr, cfgPath, join)
+	waitForSignal(lc, rcvr, serviceMgr, cfgPath, join)
 
 	return
 }
@@ -343,25 +555,56 @@ func gracefulRestart(rcvr *receiver.Receiver, serviceMgr *serviceManager, cfgPat
 	}
 }
 
-func gracefulExit(rcvr *receiver.Receiver, serviceMgr *serviceManager) {
-
-	log.Printf("Gracefully exiting...")
-
-	if gracefulChildPid == 0 {
-		rcvr.ClusterReady(false) // triggers a transition
-		// Allow enough time for a transition to start
-		time.Sleep(500 * time.Millisecond) // TODO This is a hack
-	}
+// addReceiverComponents adds the receiver, the services feeding it
+// and its workers to lc. The workers are started last, after the
+// components named in after.
+func addReceiverComponents(lc *Lifecycle, rcvr *receiver.Receiver, serviceMgr *serviceManager, gracefulProtos string, after ...string) {
+	var rcvrStarted bool
+	dslStatsStop := make(chan struct{})
+	lc.Add(&Component{
+		Name: "receiver",
+		Stop: func() error {
+			if rcvrStarted {
+				close(dslStatsStop)
+				rcvr.Stop()
+			}
+			if gracefulChildPid != 0 {
+				// let the child know the data is flushed
+				signalGracefulChild(gracefulChildPid)
+			}
+			return nil
+		},
+	})
+	lc.Add(&Component{
+		Name:      "services",
+		DependsOn: []string{"receiver"},
+		Start: func() error {
+			return serviceMgr.run(gracefulProtos)
+		},
+		Stop: func() error {
+			log.Printf("Waiting for all TCP connections to finish...")
+			serviceMgr.closeListeners()
+			log.Printf("TCP connections finished.")
+			return nil
+		},
+	})
+	lc.Add(&Component{
+		Name:      "workers",
+		DependsOn: append([]string{"services"}, after...),
+		Start: func() error {
+			// *finally* start the receiver (because graceful restart, parent must save data first)
+			startReceiver(rcvr)
+			rcvrStarted = true
+			go reportDSLStats(rcvr, 10*time.Second, dslStatsStop)
+			log.Printf("Receiver started, Tgres is ready.")
+			return nil
+		},
+	})
+}
 
-	log.Printf("Waiting for all TCP connections to finish...")
-	serviceMgr.closeListeners()
-	log.Printf("TCP connections finished.")
+func gracefulExit(lc *Lifecycle) {
 
-	// Stop the receiver
-	rcvr.Stop()
+	log.Printf("Gracefully exiting...")
 
-	if gracefulChildPid != 0 {
-		// let the child know the data is flushed
-		syscall.Kill(gracefulChildPid, syscall.SIGUSR1)
-	}
+	lc.Stop()
 }
@@ -16,13 +16,40 @@
 package daemon
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/ingest"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/opentsdb"
 	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/rrdxml"
 	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/series"
 )
@@ -67,8 +94,8 @@ func Test_Init(t *testing.T) {
 
 	// initCluster
 	save_initCluster := initCluster
-	initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.Cluster, err error) {
-		return nil, nil
+	initCluster = func(bindAddr, advAddr string, joinIps []string) (c cluster.Clusterer, err error) {
+		return cluster.NewSingleNode(), nil
 	}
 
 	// createReceiver
@@ -82,7 +109,7 @@ func Test_Init(t *testing.T) {
 
 	// waitForSignal
 	save_waitForSignal := waitForSignal
-	waitForSignal = func(r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {}
+	waitForSignal = func(lc *Lifecycle, r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {}
 
 	Init("", "", "")
 
@@ -100,6 +127,360 @@ func Test_Init(t *testing.T) {
 	waitForSignal = save_waitForSignal
 }
 
+func Test_Config_processClusterDiscovery(t *testing.T) {
+	c := &Config{}
+	if err := c.processClusterDiscovery(); err != nil || c.discoverer != nil {
+		t.Errorf("processClusterDiscovery: no discovery should not be an error: %v", err)
+	}
+	c.ClusterDiscovery = &ConfigDiscoverySpec{Provider: "dns-srv", Name: "_tgres._tcp.example.com"}
+	if err := c.processClusterDiscovery(); err != nil {
+		t.Errorf("processClusterDiscovery: %v", err)
+	}
+	if d, ok := c.discoverer.(*cluster.DNSDiscoverer); !ok || !d.SRV || c.ClusterDiscovery.Interval.Duration == 0 {
+		t.Errorf("processClusterDiscovery: expected an SRV DNSDiscoverer with a default interval, got %#v", c.discoverer)
+	}
+	c.ClusterDiscovery = &ConfigDiscoverySpec{Provider: "ec2"}
+	if err := c.processClusterDiscovery(); err == nil {
+		t.Errorf("processClusterDiscovery: ec2 without tag-key should be an error")
+	}
+	c.ClusterDiscovery = &ConfigDiscoverySpec{Provider: "zookeeper"}
+	if err := c.processClusterDiscovery(); err == nil {
+		t.Errorf("processClusterDiscovery: unknown provider should be an error")
+	}
+}
+
+func Test_Config_processStatsForward(t *testing.T) {
+	c := &Config{StatsForwardOnly: true}
+	if err := c.processStatsForward(); err == nil {
+		t.Errorf("processStatsForward: stats-forward-only without stats-forward-to should be an error")
+	}
+	c.StatsForwardTo = "regional"
+	if err := c.processStatsForward(); err == nil {
+		t.Errorf("processStatsForward: an address without a port should be an error")
+	}
+	c.StatsForwardTo = "regional:2003"
+	if err := c.processStatsForward(); err != nil {
+		t.Errorf("processStatsForward: %v", err)
+	}
+}
+
+func Test_Config_processHttpTLS(t *testing.T) {
+	c := &Config{}
+	if err := c.processHttpTLS(); err != nil {
+		t.Errorf("processHttpTLS: no TLS should not be an error: %v", err)
+	}
+	c = &Config{HttpTLSCertFile: "cert.pem"}
+	if err := c.processHttpTLS(); err == nil {
+		t.Errorf("processHttpTLS: cert without key should be an error")
+	}
+	c = &Config{HttpTLSCertFile: "cert.pem", HttpTLSKeyFile: "key.pem", HttpTLSClientCAFile: "ca.pem"}
+	if err := c.processHttpTLS(); err == nil {
+		t.Errorf("processHttpTLS: client CA without http-client-cert entries should be an error")
+	}
+	c.HttpClientCerts = []ConfigClientCertSpec{{Identity: "foo", Tenant: "bar", Scopes: []string{"read", "bogus"}}}
+	if err := c.processHttpTLS(); err == nil {
+		t.Errorf("processHttpTLS: invalid scope should be an error")
+	}
+	c.HttpClientCerts[0].Scopes = []string{"read", "write"}
+	if err := c.processHttpTLS(); err != nil {
+		t.Errorf("processHttpTLS: unexpected error: %v", err)
+	}
+}
+
+func Test_Config_processHttpTokens(t *testing.T) {
+	c := &Config{HttpTokens: []ConfigTokenSpec{{Token: "t1", Tenant: "ops", Scopes: []string{"write"}},
+		{Token: "t2", Tenant: "ops.admins", Global: true}}}
+	if err := c.processHttpTokens(); err != nil {
+		t.Errorf("processHttpTokens: unexpected error: %v", err)
+	}
+	for _, tokens := range [][]ConfigTokenSpec{
+		{{Token: "t1"}},
+		{{Token: "t1", Tenant: "ops"}, {Token: "t1", Tenant: "dev"}},
+		{{Token: "t1", Tenant: "ops", Scopes: []string{"bogus"}}},
+		{{Token: "t1", Tenant: "ops.admins"}},
+	} {
+		c = &Config{HttpTokens: tokens}
+		if err := c.processHttpTokens(); err == nil {
+			t.Errorf("processHttpTokens: expected an error for %v", tokens)
+		}
+	}
+}
+
+func Test_Config_processGraphiteTLS(t *testing.T) {
+	c := &Config{GraphiteTLSCertFile: "cert.pem", GraphiteTLSKeyFile: "key.pem", GraphiteAuthTokens: []string{"s3cr3t"}}
+	if err := c.processGraphiteTLS(); err != nil {
+		t.Errorf("processGraphiteTLS: unexpected error: %v", err)
+	}
+	for _, c := range []*Config{
+		{GraphiteTLSCertFile: "cert.pem"},
+		{GraphiteTLSClientCAFile: "ca.pem"},
+		{GraphiteAuthTokens: []string{"two words"}},
+	} {
+		if err := c.processGraphiteTLS(); err == nil {
+			t.Errorf("processGraphiteTLS: expected an error for %#v", c)
+		}
+	}
+}
+
+func Test_graphiteAuth(t *testing.T) {
+	// a token, in plain text
+	a, err := newGraphiteAuth("", "", "", []string{"s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		send string
+		ok   bool
+	}{
+		{"auth s3cr3t\na.b 1 1\n", true},
+		{"auth wrong\na.b 1 1\n", false},
+		{"a.b 1 1\n", false},
+	} {
+		client, server := net.Pipe()
+		go func() { client.Write([]byte(c.send)); client.Close() }()
+		conn, err := a.accept(server)
+		if (err == nil) != c.ok {
+			t.Errorf("accept: %q: expected ok %v, got %v", c.send, c.ok, err)
+		}
+		if err == nil {
+			if rest, _ := ioutil.ReadAll(conn); string(rest) != "a.b 1 1\n" {
+				t.Errorf("accept: the data after the auth line should be left, got %q", rest)
+			}
+		}
+		server.Close()
+	}
+
+	// TLS with a client certificate, the certificate is its own CA
+	dir, err := ioutil.TempDir("", "tgres-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "collector")
+	if a, err = newGraphiteAuth(certFile, keyFile, certFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0") // not net.Pipe, TLS alerts would block
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, certs := range [][]tls.Certificate{{cert}, nil} {
+		go func() {
+			tc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+			if err == nil {
+				tc.Write([]byte("a.b 1 1\n"))
+				tc.Close()
+			}
+		}()
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := a.accept(server)
+		if (err == nil) != (len(certs) > 0) {
+			t.Errorf("accept: with %d client certificates, got %v", len(certs), err)
+		}
+		if err == nil {
+			if b, _ := ioutil.ReadAll(conn); string(b) != "a.b 1 1\n" {
+				t.Errorf("accept: expected the data over TLS, got %q", b)
+			}
+		}
+		server.Close()
+	}
+}
+
+func Test_Config_processIngestSources(t *testing.T) {
+	c := &Config{NatsURL: "nats://localhost:4222"}
+	if err := c.processIngestSources(); err == nil {
+		t.Errorf("processIngestSources: nats-url without nats-subject should be an error")
+	}
+	c = &Config{AmqpURL: "amqp://localhost/"}
+	if err := c.processIngestSources(); err == nil {
+		t.Errorf("processIngestSources: amqp-url without amqp-queue should be an error")
+	}
+	c = &Config{NatsURL: "nats://localhost:4222", NatsSubject: "tgres.>", AmqpURL: "amqp://localhost/", AmqpQueue: "tgres"}
+	if err := c.processIngestSources(); err != nil {
+		t.Errorf("processIngestSources: %v", err)
+	}
+	if len(c.ingestSources) != 2 || c.NatsQueueGroup != "tgres" {
+		t.Errorf("processIngestSources: expected 2 sources and queue group tgres, got %d %q", len(c.ingestSources), c.NatsQueueGroup)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key.
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+}
+
+func Test_tlsReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "old")
+	load := func() (*tls.Config, error) {
+		cfg, _, err := httpTLSConfig(certFile, keyFile, "", nil)
+		return cfg, err
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTLSReloader(cfg, load, certFile, keyFile)
+
+	cn := func() string {
+		cfg, _ := r.Config().GetConfigForClient(nil)
+		cert, _ := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		return cert.Subject.CommonName
+	}
+
+	if r.check() {
+		t.Errorf("check: unchanged files should not be reloaded")
+	}
+
+	// a half-written pair keeps the old certificate
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, later, later)
+	if r.check() || cn() != "old" {
+		t.Errorf("check: an invalid key should not be loaded")
+	}
+
+	writeTestCert(t, certFile, keyFile, "new")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if !r.check() {
+		t.Errorf("check: changed files should be reloaded")
+	}
+	if cn() != "new" {
+		t.Errorf("check: expected the new certificate, got %q", cn())
+	}
+}
+
+type fakeConsistencySerde struct {
+	fakeSerde
+	n      int
+	repair bool
+}
+
+func (f *fakeConsistencySerde) CheckFlushConsistency(repair bool) (int, error) {
+	f.repair = repair
+	return f.n, nil
+}
+
+func Test_checkFlushConsistency(t *testing.T) {
+	// must not panic on a serde that cannot check
+	checkFlushConsistency(&fakeSerde{}, true)
+
+	f := &fakeConsistencySerde{n: 2}
+	checkFlushConsistency(f, true)
+	if !f.repair {
+		t.Errorf("checkFlushConsistency: repair not passed through")
+	}
+	checkFlushConsistency(f, false)
+	if f.repair {
+		t.Errorf("checkFlushConsistency: repair should be false")
+	}
+}
+
+type fakeInvariantSerde struct {
+	fakeSerde
+	repair bool
+}
+
+func (f *fakeInvariantSerde) CheckInvariants(now time.Time, repair bool) ([]serde.Violation, error) {
+	f.repair = repair
+	return []serde.Violation{
+		{Invariant: serde.InvariantLatestBounds, DSId: 1, Detail: "latest in the future", Repaired: repair},
+		{Invariant: serde.InvariantNaNOnly, DSId: 1, RRAId: 2, Detail: "no values"},
+	}, nil
+}
+
+func Test_Fsck(t *testing.T) {
+	save_readConfig, save_initDb := readConfig, initDb
+	defer func() { readConfig, initDb = save_readConfig, save_initDb }()
+	readConfig = func(string) (*Config, error) { return &Config{DbConnectString: "foo"}, nil }
+
+	f := &fakeInvariantSerde{}
+	initDb = func(string) (serde.DbSerDe, error) { return f, nil }
+
+	var out bytes.Buffer
+	if err := Fsck("tgres.conf", []string{"-repair"}, &out); err == nil {
+		t.Errorf("Fsck: expected an error for the violation not repaired")
+	}
+	if !f.repair {
+		t.Errorf("Fsck: -repair not passed through")
+	}
+	expect := "latest-bounds: DS 1: latest in the future (repaired)\nnan-only: DS 1 RRA 2: no values\n2 violation(s) found, 1 repaired.\n"
+	if out.String() != expect {
+		t.Errorf("Fsck: expected %q, got %q", expect, out.String())
+	}
+
+	initDb = func(string) (serde.DbSerDe, error) { return &fakeSerde{}, nil }
+	if err := Fsck("tgres.conf", nil, &out); err == nil {
+		t.Errorf("Fsck: expected an error for a serde which cannot check")
+	}
+}
+
+func Test_whisperSeriesName(t *testing.T) {
+	for _, c := range []struct{ root, path, name string }{
+		{"", "foo/bar.wsp", "foo.bar"},
+		{"/var/lib/graphite/whisper", "/var/lib/graphite/whisper/foo/bar/baz.wsp", "foo.bar.baz"},
+		{"", "./foo.wsp", "foo"},
+	} {
+		if name := whisperSeriesName(c.root, c.path); name != c.name {
+			t.Errorf("whisperSeriesName(%q, %q): expected %q, got %q", c.root, c.path, c.name, name)
+		}
+	}
+}
+
+func Test_rrdBackfillBatch(t *testing.T) {
+	x := &rrdxml.RRD{
+		Step:       300,
+		LastUpdate: 1500000000,
+		DSs:        []rrdxml.DS{{Name: "in", Type: "COUNTER"}, {Name: "out", Type: "COUNTER"}},
+		RRAs:       []rrdxml.RRA{{CF: "AVERAGE", PdpPerRow: 1, Rows: []rrdxml.Row{{V: []rrdxml.Float{1, 2}}}}},
+	}
+	batch, err := rrdBackfillBatch(x, "router eth0")
+	if err != nil || len(batch) != 2 {
+		t.Fatalf("rrdBackfillBatch: %v %v", batch, err)
+	}
+	if name := batch[1].Ident["name"]; name != "router_eth0.out" {
+		t.Errorf("rrdBackfillBatch: expected router_eth0.out, got %q", name)
+	}
+	if spec := batch[1].Spec; spec == nil || spec.Type != rrd.COUNTER || len(spec.RRAs) != 1 || spec.RRAs[0].DPs[0] != 2 {
+		t.Errorf("rrdBackfillBatch: unexpected spec: %+v", spec)
+	}
+}
+
 type fakeSerde struct {
 	flushCalled, createCalled, fetchCalled int
 	fakeErr                                bool
@@ -146,3 +527,916 @@ func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpe
 		return serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*receiver.DftDSSPec)), nil
 	}
 }
+
+func Test_Config_processLateTolerance(t *testing.T) {
+	c := &Config{}
+	if err := c.processLateTolerance(); err != nil {
+		t.Errorf("processLateTolerance: zero should not be an error: %v", err)
+	}
+	c.LateTolerance.Duration = -time.Second
+	if err := c.processLateTolerance(); err == nil {
+		t.Errorf("processLateTolerance: negative should be an error")
+	}
+	c.LateTolerance.Duration = 5 * time.Minute
+	if err := c.processLateTolerance(); err != nil {
+		t.Errorf("processLateTolerance: unexpected error: %v", err)
+	}
+}
+
+func Test_Config_processResourceLimits(t *testing.T) {
+	c := &Config{}
+	if err := c.processResourceLimits(); err != nil {
+		t.Errorf("processResourceLimits: no limits should not be an error: %v", err)
+	}
+	c = &Config{MaxCachedDSs: -1}
+	if err := c.processResourceLimits(); err == nil {
+		t.Errorf("processResourceLimits: negative max-cached-dss should be an error")
+	}
+	c = &Config{DSCacheShards: -1}
+	if err := c.processResourceLimits(); err == nil {
+		t.Errorf("processResourceLimits: negative ds-cache-shards should be an error")
+	}
+	c = &Config{MaxCachedMB: -1}
+	if err := c.processResourceLimits(); err == nil {
+		t.Errorf("processResourceLimits: negative max-cached-mb should be an error")
+	}
+	c = &Config{MaxCachedDSs: 1000, MaxCachedMB: 64, MaxMemoryMB: 512, DSCacheShards: 64}
+	if err := c.processResourceLimits(); err != nil {
+		t.Errorf("processResourceLimits: unexpected error: %v", err)
+	}
+}
+
+func Test_Config_processSpill(t *testing.T) {
+	c := &Config{}
+	if err := c.processSpill(); err != nil {
+		t.Errorf("processSpill: no spill-dir should not be an error: %v", err)
+	}
+	c = &Config{SpillDir: "spill", SpillMaxSizeMB: -1}
+	if err := c.processSpill(); err == nil {
+		t.Errorf("processSpill: negative spill-max-size-mb should be an error")
+	}
+}
+
+func Test_Config_processRateLimits(t *testing.T) {
+	c := &Config{}
+	if err := c.processRateLimits(); err != nil || c.rateLimits != nil {
+		t.Errorf("processRateLimits: no limits expected, got %v %v", c.rateLimits, err)
+	}
+	c = &Config{RateLimitSeries: 10, RateLimitPolicy: "clamp", RateLimits: []ConfigRateLimitSpec{{Prefix: "foo.", Rate: 100, SeriesRate: 1}}}
+	if err := c.processRateLimits(); err != nil {
+		t.Errorf("processRateLimits: unexpected error: %v", err)
+	}
+	if c.rateLimits == nil || c.rateLimits.Policy != receiver.RateLimitClamp || len(c.rateLimits.Prefixes) != 1 || c.rateLimits.Prefixes[0].SeriesRate != 1 {
+		t.Errorf("processRateLimits: unexpected result: %#v", c.rateLimits)
+	}
+	c.RateLimitPolicy = "bogus"
+	if err := c.processRateLimits(); err == nil {
+		t.Errorf("processRateLimits: a bad policy should be an error")
+	}
+	c = &Config{RateLimits: []ConfigRateLimitSpec{{Rate: 1}}}
+	if err := c.processRateLimits(); err == nil {
+		t.Errorf("processRateLimits: a missing prefix should be an error")
+	}
+}
+
+func Test_Config_processRewriteRules(t *testing.T) {
+	c := &Config{Rewrites: []ConfigRewriteSpec{
+		{Match: `^a\.(.*)`, Action: "rename", Replacement: "b.$1"},
+		{Match: `^debug\.`, Action: "drop"},
+	}}
+	if err := c.processRewriteRules(); err != nil {
+		t.Errorf("processRewriteRules: unexpected error: %v", err)
+	}
+	if len(c.rewriteRules) != 2 || c.rewriteRules[1].Action != receiver.RewriteDrop || c.RewriteReloadInterval.Duration != 10*time.Second {
+		t.Errorf("processRewriteRules: unexpected result: %#v %v", c.rewriteRules, c.RewriteReloadInterval)
+	}
+	for _, rw := range []ConfigRewriteSpec{
+		{Match: "a", Action: "bogus"},
+		{Match: "(", Action: "drop"},
+		{Match: "a", Action: "prefix"},
+	} {
+		c = &Config{Rewrites: []ConfigRewriteSpec{rw}}
+		if err := c.processRewriteRules(); err == nil {
+			t.Errorf("processRewriteRules: %v should be an error", rw)
+		}
+	}
+}
+
+func Test_Config_processBeacon(t *testing.T) {
+	c := &Config{BeaconURL: "https://fleet.example.com/tgres"}
+	if err := c.processBeacon(); err != nil || c.BeaconInterval.Duration != 5*time.Minute {
+		t.Errorf("processBeacon: unexpected result: %v %v", c.BeaconInterval, err)
+	}
+	c = &Config{BeaconURL: "fleet.example.com"}
+	if err := c.processBeacon(); err == nil {
+		t.Errorf("processBeacon: a URL without a scheme should be an error")
+	}
+}
+
+func Test_Config_processExpireSeries(t *testing.T) {
+	c := &Config{ExpireSeriesAfter: duration{24 * time.Hour}}
+	if err := c.processExpireSeries(); err != nil || c.ExpireSeriesInterval.Duration != time.Hour {
+		t.Errorf("processExpireSeries: unexpected result: %v %v", c.ExpireSeriesInterval, err)
+	}
+	c = &Config{ExpireSeriesAfter: duration{-time.Hour}}
+	if err := c.processExpireSeries(); err == nil {
+		t.Errorf("processExpireSeries: a negative duration should be an error")
+	}
+}
+
+func Test_janitor(t *testing.T) {
+	var (
+		gotBefore time.Time
+		gotDryRun bool
+	)
+	expire := func(before time.Time, dryRun bool) ([]serde.SeriesActivity, error) {
+		gotBefore, gotDryRun = before, dryRun
+		return []serde.SeriesActivity{{Ident: serde.Ident{"name": "foo"}}}, nil
+	}
+	j := newJanitor(expire, time.Hour, true)
+	now := time.Unix(100000, 0)
+	j.sweep(now)
+	if !gotBefore.Equal(now.Add(-time.Hour)) || !gotDryRun {
+		t.Errorf("janitor: expire called with %v %v", gotBefore, gotDryRun)
+	}
+
+	go j.run(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	j.Stop()
+}
+
+func Test_beacon(t *testing.T) {
+	var got beaconReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	st := receiver.ReceiverStats{Series: 3, DataPoints: 100}
+	b := newBeacon(srv.URL, "node1", func() receiver.ReceiverStats { return st })
+	st.DataPoints += 50
+	if err := b.send(b.lastTime.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Instance != "node1" || got.Series != 3 || got.IngestRate != 5 || got.Uptime != 10 {
+		t.Errorf("send: unexpected report: %+v", got)
+	}
+
+	b.url = srv.URL + "/nonexistent\x00"
+	if err := b.send(time.Now()); err == nil {
+		t.Errorf("send: a bad URL should be an error")
+	}
+}
+
+func Test_Config_processSeriesFilter(t *testing.T) {
+	c := &Config{}
+	if err := c.processSeriesFilter(); err != nil || c.seriesFilter != nil {
+		t.Errorf("processSeriesFilter: no filter expected, got %v %v", c.seriesFilter, err)
+	}
+	c = &Config{SeriesAllow: []string{"^app\\."}, SeriesDeny: []string{"tmp"}}
+	if err := c.processSeriesFilter(); err != nil || c.seriesFilter == nil || len(c.seriesFilter.Deny) != 1 {
+		t.Errorf("processSeriesFilter: unexpected result: %v %v", c.seriesFilter, err)
+	}
+	c = &Config{SeriesDeny: []string{"("}}
+	if err := c.processSeriesFilter(); err == nil {
+		t.Errorf("processSeriesFilter: an invalid regular expression should be an error")
+	}
+}
+
+func Test_Config_processSeriesQuotas(t *testing.T) {
+	c := &Config{}
+	if err := c.processSeriesQuotas(); err != nil || c.seriesQuotas != nil {
+		t.Errorf("processSeriesQuotas: no quotas expected, got %v %v", c.seriesQuotas, err)
+	}
+	c = &Config{MaxNewSeriesPerMinute: 100, SeriesQuotaPolicy: "park", SeriesQuotas: []ConfigSeriesQuotaSpec{{Prefix: "k8s.", MaxSeries: 10}}}
+	if err := c.processSeriesQuotas(); err != nil || c.seriesQuotas == nil ||
+		c.seriesQuotas.Policy != receiver.SeriesQuotaPark || len(c.seriesQuotas.Prefixes) != 1 {
+		t.Errorf("processSeriesQuotas: unexpected result: %v %v", c.seriesQuotas, err)
+	}
+	for _, c := range []*Config{
+		{MaxSeriesPerTenant: 1, SeriesQuotaPolicy: "bogus"},
+		{MaxNewSeriesPerMinute: -1},
+		{SeriesQuotas: []ConfigSeriesQuotaSpec{{MaxSeries: 1}}},
+	} {
+		if err := c.processSeriesQuotas(); err == nil {
+			t.Errorf("processSeriesQuotas: expected an error for %#v", c)
+		}
+	}
+}
+
+func Test_Config_processDedupWindow(t *testing.T) {
+	c := &Config{DedupWindow: duration{30 * time.Second}}
+	if err := c.processDedupWindow(); err != nil {
+		t.Errorf("processDedupWindow: unexpected error: %v", err)
+	}
+	c = &Config{DedupWindow: duration{-time.Second}}
+	if err := c.processDedupWindow(); err == nil {
+		t.Errorf("processDedupWindow: expected an error for a negative window")
+	}
+}
+
+func Test_configHash(t *testing.T) {
+	c1 := &Config{DSs: []ConfigDSSpec{{Regexp: regex{regexp.MustCompile(".*")}, Step: duration{10 * time.Second}}}}
+	c2 := &Config{DSs: []ConfigDSSpec{{Regexp: regex{regexp.MustCompile(".*")}, Step: duration{10 * time.Second}}}}
+	if configHash(c1) != configHash(c2) {
+		t.Errorf("configHash: the same configuration should have the same hash")
+	}
+	c2.DSs[0].Type = "gauge"
+	if configHash(c1) != configHash(c2) {
+		t.Errorf("configHash: gauge is the default type")
+	}
+	c2.DSs[0].Type = "counter"
+	if configHash(c1) == configHash(c2) {
+		t.Errorf("configHash: different DS types should have a different hash")
+	}
+	c2.aggRules = []receiver.AggregationRule{{Output: "a", Frequency: time.Minute, Method: "sum", Input: "a.*"}}
+	if configHash(c1) == configHash(c2) {
+		t.Errorf("configHash: different aggregation rules should have a different hash")
+	}
+}
+
+func Test_Config_processMinStep(t *testing.T) {
+	c := &Config{}
+	if err := c.processMinStep(); err == nil {
+		t.Errorf("processMinStep: missing min-step should be an error")
+	}
+	c.MinStep.Duration = 1500 * time.Microsecond
+	if err := c.processMinStep(); err == nil {
+		t.Errorf("processMinStep: sub-millisecond min-step should be an error")
+	}
+	c.MinStep.Duration = 100 * time.Millisecond
+	if err := c.processMinStep(); err != nil {
+		t.Errorf("processMinStep: unexpected error: %v", err)
+	}
+	c.DSs = []ConfigDSSpec{{
+		Regexp: regex{regexp.MustCompile(".*")}, Step: duration{100 * time.Millisecond},
+		RRAs: []ConfigRRASpec{{Step: 100 * time.Millisecond, Span: time.Minute}}}}
+	if err := c.processDSSpec(); err != nil {
+		t.Errorf("processDSSpec: sub-second step should be allowed: %v", err)
+	}
+}
+
+func Test_Config_processDSSpec_type(t *testing.T) {
+	c := &Config{MinStep: duration{10 * time.Second}, DSs: []ConfigDSSpec{{
+		Regexp: regex{regexp.MustCompile(".*")}, Type: "Counter", Step: duration{10 * time.Second},
+		RRAs: []ConfigRRASpec{{Step: 10 * time.Second, Span: time.Hour}}}}}
+	if err := c.processDSSpec(); err != nil {
+		t.Errorf("processDSSpec: %v", err)
+	}
+	if spec := c.FindMatchingDSSpec(serde.Ident{"name": "foo"}); spec == nil || spec.Type != rrd.COUNTER {
+		t.Errorf("FindMatchingDSSpec: expected a COUNTER spec, got %v", spec)
+	}
+	c.DSs[0].Type = "bogus"
+	if err := c.processDSSpec(); err == nil {
+		t.Errorf("processDSSpec: expected an error for an invalid type")
+	}
+}
+
+func Test_Config_processDSSpec_limits(t *testing.T) {
+	c := &Config{MinStep: duration{10 * time.Second}, DSs: []ConfigDSSpec{{
+		Regexp: regex{regexp.MustCompile(".*")}, Step: duration{10 * time.Second},
+		RRAs: []ConfigRRASpec{{Step: 10 * time.Second, Span: time.Hour}}}}}
+	if err := c.processDSSpec(); err != nil {
+		t.Errorf("processDSSpec: %v", err)
+	}
+	if spec := c.FindMatchingDSSpec(serde.Ident{"name": "foo"}); !math.IsNaN(spec.Min) || !math.IsNaN(spec.Max) {
+		t.Errorf("FindMatchingDSSpec: expected no limits, got %v %v", spec.Min, spec.Max)
+	}
+	min, max := 0.0, 100.0
+	c.DSs[0].Min, c.DSs[0].Max = &min, &max
+	if spec := c.FindMatchingDSSpec(serde.Ident{"name": "foo"}); spec.Min != 0 || spec.Max != 100 {
+		t.Errorf("FindMatchingDSSpec: expected limits 0 and 100, got %v %v", spec.Min, spec.Max)
+	}
+	c.DSs[0].Min, c.DSs[0].Max = &max, &min
+	if err := c.processDSSpec(); err == nil {
+		t.Errorf("processDSSpec: expected an error for min > max")
+	}
+	c.DSs[0].Min, c.DSs[0].Max = nil, nil
+	c.DSs[0].GapFill = "sometimes"
+	if err := c.processDSSpec(); err == nil {
+		t.Errorf("processDSSpec: expected an error for an invalid gap-fill")
+	}
+	zero := rrd.GapZero
+	c.DSs[0].GapFill = "previous"
+	c.DSs[0].RRAs = append(c.DSs[0].RRAs, ConfigRRASpec{Step: time.Minute, Span: time.Hour, GapFill: &zero})
+	if spec := c.FindMatchingDSSpec(serde.Ident{"name": "foo"}); spec.RRAs[0].GapFill != rrd.GapPrevious || spec.RRAs[1].GapFill != rrd.GapZero {
+		t.Errorf("FindMatchingDSSpec: expected the DS gap-fill unless the RRA has its own, got %v %v", spec.RRAs[0].GapFill, spec.RRAs[1].GapFill)
+	}
+	c.DSs[0].GapFill = ""
+	c.DSs[0].Heartbeat = duration{-time.Second}
+	if err := c.processDSSpec(); err == nil {
+		t.Errorf("processDSSpec: expected an error for a negative heartbeat")
+	}
+}
+
+func Test_configCheck(t *testing.T) {
+	fn := cluster.NewFakeNetwork()
+	n1, n2 := fn.NewCluster("n1"), fn.NewCluster("n2")
+	cc := newConfigCheck("aaa")
+	if err := cc.start(n1, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+	if hash, _ := n1.LocalNode().Tag(TagConfigHash); hash != "aaa" {
+		t.Errorf("start: expected the hash to be a tag of the local node, got %q", hash)
+	}
+
+	// a node without a hash is not compared
+	if n := cc.check(n1.Members()); n != 0 || !cc.status().Consistent {
+		t.Errorf("check: expected no divergent nodes, got %d", n)
+	}
+	n2.SetTags(map[string]string{TagConfigHash: "bbb"})
+	if n := cc.check(n1.Members()); n != 1 {
+		t.Errorf("check: expected 1 divergent node, got %d", n)
+	}
+	if st := cc.status(); st.Consistent || st.Divergent[n2.LocalNode().Name()] != "bbb" {
+		t.Errorf("status: expected n2 to be divergent, got %#v", st)
+	}
+	n2.SetTags(map[string]string{TagConfigHash: "aaa"})
+	if n := cc.check(n1.Members()); n != 0 || !cc.status().Consistent {
+		t.Errorf("check: expected no divergent nodes, got %d", n)
+	}
+}
+
+func Test_Config_processDecoders(t *testing.T) {
+	c := &Config{Decoders: map[string]string{"graphite-udp": "graphite"}}
+	if err := c.processDecoders(); err != nil {
+		t.Errorf("processDecoders: unexpected error: %v", err)
+	}
+	if c.decoder("graphite-udp") == nil || c.decoder("nats") == nil {
+		t.Errorf("processDecoders: every listener should have a decoder")
+	}
+	for _, c := range []*Config{
+		{Decoders: map[string]string{"bogus": "graphite"}},
+		{Decoders: map[string]string{"nats": "bogus"}},
+	} {
+		if err := c.processDecoders(); err == nil {
+			t.Errorf("processDecoders: expected an error for %v", c.Decoders)
+		}
+	}
+}
+
+func Test_Config_processFlowControl(t *testing.T) {
+	c := &Config{FlowControlHighWatermark: 1000}
+	if err := c.processFlowControl(); err != nil || c.FlowControlLowWatermark != 500 {
+		t.Errorf("processFlowControl: expected low watermark 500, got %d %v", c.FlowControlLowWatermark, err)
+	}
+	for _, c := range []*Config{
+		{FlowControlHighWatermark: -1},
+		{FlowControlLowWatermark: 10},
+		{FlowControlHighWatermark: 10, FlowControlLowWatermark: 10},
+		{FlowControlHighWatermark: 1000, MaxReceiverQueueSize: 1000},
+	} {
+		if err := c.processFlowControl(); err == nil {
+			t.Errorf("processFlowControl: expected an error for %#v", c)
+		}
+	}
+}
+
+func Test_Config_processAggregationRules(t *testing.T) {
+	c := &Config{}
+	if err := c.processAggregationRules(); err != nil || c.aggRules != nil {
+		t.Errorf("processAggregationRules: no rules expected, got %v %v", c.aggRules, err)
+	}
+	f, err := ioutil.TempFile("", "tgres-aggrules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<env>.all.cpu (60) = sum <env>.*.cpu\n")
+	f.Close()
+	c = &Config{AggregationRulesFile: f.Name()}
+	if err := c.processAggregationRules(); err != nil || len(c.aggRules) != 1 {
+		t.Errorf("processAggregationRules: expected 1 rule, got %v %v", c.aggRules, err)
+	}
+	c = &Config{AggregationRulesFile: f.Name() + ".nonexistent"}
+	if err := c.processAggregationRules(); err == nil {
+		t.Errorf("processAggregationRules: a missing file should be an error")
+	}
+}
+
+func Test_rewriteReloader(t *testing.T) {
+	f, err := ioutil.TempFile("", "tgres-rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	var rules []receiver.RewriteRule
+	r := newRewriteReloader(f.Name(), func(rr []receiver.RewriteRule) error {
+		rules = rr
+		return nil
+	})
+	if r.check() {
+		t.Errorf("check: an unchanged file should not be reloaded")
+	}
+
+	write := func(text string, when time.Time) {
+		ioutil.WriteFile(f.Name(), []byte(text), 0644)
+		os.Chtimes(f.Name(), when, when)
+	}
+	write("[[rewrite]]\nmatch = \"^x\"\naction = \"prefix\"\nreplacement = \"y.\"\n", time.Now().Add(time.Minute))
+	if !r.check() || len(rules) != 1 || rules[0].Replacement != "y." {
+		t.Errorf("check: the new rules should be loaded, got %v", rules)
+	}
+	write("[[rewrite]]\nmatch = \"(\"\naction = \"drop\"\n", time.Now().Add(2*time.Minute))
+	if r.check() || len(rules) != 1 {
+		t.Errorf("check: invalid rules should not be loaded, got %v", rules)
+	}
+}
+
+func Test_ConfigRRASpec_UnmarshalText(t *testing.T) {
+	var r ConfigRRASpec
+	if err := r.UnmarshalText([]byte("max:1m:1h:0.5:0.01")); err != nil || r.Function != rrd.MAX || r.Xff != 0.5 || r.RoundTo != 0.01 {
+		t.Errorf("UnmarshalText: unexpected result: %v %v", r, err)
+	}
+	r = ConfigRRASpec{}
+	if err := r.UnmarshalText([]byte("1m:1h:1:1")); err != nil || r.Function != rrd.WMEAN || r.Xff != 1 || r.RoundTo != 1 {
+		t.Errorf("UnmarshalText: unexpected result without cf: %v %v", r, err)
+	}
+	r = ConfigRRASpec{}
+	if err := r.UnmarshalText([]byte("StdDev:1m:1h")); err != nil || r.Function != rrd.STDDEV {
+		t.Errorf("UnmarshalText: unexpected result for stddev: %v %v", r, err)
+	}
+	r = ConfigRRASpec{}
+	if err := r.UnmarshalText([]byte("1h:8760h:Linear")); err != nil || r.GapFill == nil || *r.GapFill != rrd.GapLinear || r.Span != 365*24*time.Hour {
+		t.Errorf("UnmarshalText: unexpected result for a gap fill: %v %v", r, err)
+	}
+	r = ConfigRRASpec{}
+	if err := r.UnmarshalText([]byte("last:1m:1h:0.2:0.01:previous")); err != nil || *r.GapFill != rrd.GapPrevious || r.Xff != 0.2 || r.RoundTo != 0.01 {
+		t.Errorf("UnmarshalText: unexpected result for a gap fill: %v %v", r, err)
+	}
+	r = ConfigRRASpec{}
+	if err := r.UnmarshalText([]byte("max:1m:1h")); err != nil || r.Function != rrd.MAX || r.Span != time.Hour || r.GapFill != nil {
+		t.Errorf("UnmarshalText: unexpected result for cf:step:span: %v %v", r, err)
+	}
+	for _, bad := range []string{"1m:1h:1:1:1", "1m:1h:1:-1", "1m:1h:1:x", "avg:1m:1h", "1m:1h:2", "1m:1h:0.5:0:zero:zero", "max:1m:1x"} {
+		if err := r.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText: expected error for %q", bad)
+		}
+	}
+}
+
+func Test_Lifecycle(t *testing.T) {
+	var events []string
+	comp := func(name string, startErr error, deps ...string) *Component {
+		return &Component{
+			Name:      name,
+			DependsOn: deps,
+			Start:     func() error { events = append(events, "start "+name); return startErr },
+			Stop:      func() error { events = append(events, "stop "+name); return nil },
+		}
+	}
+
+	lc := NewLifecycle()
+	lc.Add(comp("b", nil, "a"))
+	lc.Add(comp("a", nil))
+	lc.Add(comp("c", nil))
+	if err := lc.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	lc.Stop()
+	lc.Stop() // no-op
+	expect := "start a,start b,start c,stop c,stop b,stop a"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("Lifecycle: expected %q, got %q", expect, got)
+	}
+
+	// a failure rolls back what was started
+	events = nil
+	lc = NewLifecycle()
+	lc.Add(comp("a", nil))
+	lc.Add(comp("b", fmt.Errorf("boom")))
+	lc.Add(comp("c", nil))
+	if err := lc.Start(); err == nil {
+		t.Errorf("Start: expected an error")
+	}
+	expect = "start a,start b,stop a"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("Lifecycle: expected %q, got %q", expect, got)
+	}
+
+	// a stuck Stop does not prevent the others from stopping
+	events = nil
+	lc = NewLifecycle()
+	lc.Add(comp("a", nil))
+	lc.Add(&Component{Name: "stuck", Stop: func() error { select {} }, StopTimeout: time.Millisecond})
+	lc.Start()
+	if err := lc.Stop(); err == nil {
+		t.Errorf("Stop: expected a timeout error")
+	}
+	if expect = "start a,stop a"; strings.Join(events, ",") != expect {
+		t.Errorf("Lifecycle: expected %q, got %q", expect, strings.Join(events, ","))
+	}
+
+	for _, bad := range [][]*Component{
+		{comp("a", nil, "b"), comp("b", nil, "a")},
+		{comp("a", nil, "nope")},
+		{comp("a", nil), comp("a", nil)},
+	} {
+		lc = NewLifecycle()
+		for _, c := range bad {
+			lc.Add(c)
+		}
+		if err := lc.Start(); err == nil {
+			t.Errorf("Start: expected an error for %v", bad)
+		}
+	}
+}
+
+func Test_Tgres(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := New(NewConfig())
+	tg.DB = &fakeSerde{}
+	tg.Listeners = map[string]net.Listener{"gt": ln}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tg.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if tg.Receiver() == nil || tg.Fetcher() == nil {
+		t.Errorf("Start: Receiver() and Fetcher() should be set")
+	}
+	if err := tg.Start(ctx); err == nil {
+		t.Errorf("Start: starting twice should be an error")
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: the provided listener is not being served: %v", err)
+	}
+	conn.Close()
+
+	cancel()
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			break
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		t.Errorf("Stop: the listener should be closed once ctx is done")
+	}
+	tg.Stop() // no-op
+
+	// an unknown service is an error
+	tg = New(NewConfig())
+	tg.DB = &fakeSerde{}
+	tg.Listeners = map[string]net.Listener{"nope": ln}
+	if err := tg.Start(context.Background()); err == nil {
+		t.Errorf("Start: expected an error for an unknown service")
+	}
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	proxied := func(hdr []byte) (net.Conn, string, error) {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(hdr, "foo.bar 1 1500000000\n"...))
+			client.Close()
+		}()
+		conn, err := readProxyHeader(server, time.Second)
+		if err != nil {
+			return nil, "", err
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, line, nil
+	}
+
+	conn, line, err := proxied([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 2003\r\n"))
+	if err != nil || conn.RemoteAddr().String() != "192.168.0.1:56324" || line != "foo.bar 1 1500000000\n" {
+		t.Errorf("readProxyHeader: v1: %v %q %v", conn, line, err)
+	}
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0x1f, 0x90, 0x07, 0xd3)
+	conn, line, err = proxied(v2)
+	if err != nil || conn.RemoteAddr().String() != "10.0.0.1:8080" || line != "foo.bar 1 1500000000\n" {
+		t.Errorf("readProxyHeader: v2: %v %q %v", conn, line, err)
+	}
+
+	if _, _, err = proxied(nil); err == nil {
+		t.Errorf("readProxyHeader: a connection without a header should be an error")
+	}
+}
+
+func Test_readGraphiteText(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// several lines per write, a line split across writes, a
+		// line too long for the buffer and no final newline
+		client.Write([]byte("a.b 1 1500000000\nc.d 2.5 1500000001\r\n\ne.f 3 "))
+		client.Write([]byte("1500000002\nbogus\n" + strings.Repeat("x", 100) + " 1 1\ng.h 4 1500000003"))
+		client.Close()
+	}()
+
+	var got []string
+	readGraphiteText(server, 0, newReaderPool(32), graphiteDecoder, func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %v %d", ident["name"], v, ts.Unix()))
+	}, nil)
+	expect := []string{"a.b 1 1500000000", "c.d 2.5 1500000001", "e.f 3 1500000002", "g.h 4 1500000003"}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("readGraphiteText: expected %v, got %v", expect, got)
+	}
+}
+
+func Test_parseGraphitePacket_fractional(t *testing.T) {
+	_, ts, _, err := parseGraphitePacket([]byte("a.b 1 1500000000.125"))
+	if err != nil || ts.UnixNano() != 1500000000125*int64(time.Millisecond) {
+		t.Errorf("parseGraphitePacket: expected 1500000000.125, got %v %v", ts, err)
+	}
+	if _, _, _, err := parseGraphitePacket([]byte("a.b 1 15000x")); err == nil {
+		t.Errorf("parseGraphitePacket: a bad timestamp should be an error")
+	}
+}
+
+func Test_graphiteDecoder(t *testing.T) {
+	var got []string
+	err := ingest.DecodeLines(graphiteDecoder, []byte("a.b 1 1500000000\r\n\nbogus\nc.d 2.5 1500000001\nx y z"), func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %v %d", ident["name"], v, ts.Unix()))
+	})
+	expect := []string{"a.b 1 1500000000", "c.d 2.5 1500000001"}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("graphiteDecoder: expected %v, got %v", expect, got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "1 more bad lines") {
+		t.Errorf("graphiteDecoder: expected an error about 2 bad lines, got %v", err)
+	}
+}
+
+func Test_handleGraphiteUdpProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// one line without a newline, several lines with the last
+		// one split across datagrams
+		client.Write([]byte("a.b 1 1500000000"))
+		client.Write([]byte("c.d 2 1500000001\ne.f 3"))
+		client.Write([]byte(" 1500000002\ng.h 4 1500000003\n"))
+		client.Close()
+	}()
+
+	var got []string
+	handleGraphiteUdpProtocol(server, graphiteDecoder, func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %v %d", ident["name"], v, ts.Unix()))
+	})
+	expect := []string{"a.b 1 1500000000", "c.d 2 1500000001", "e.f 3 1500000002", "g.h 4 1500000003"}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("handleGraphiteUdpProtocol: expected %v, got %v", expect, got)
+	}
+}
+
+func Test_udpReassembler(t *testing.T) {
+	ra := newUdpReassembler(graphiteDecoder)
+	now := time.Now()
+	if b := ra.datagram("x", []byte("a.b 1 1\nc.d"), now); string(b) != "a.b 1 1\n" {
+		t.Errorf("datagram: expected the complete line only, got %q", b)
+	}
+	if b := ra.datagram("y", []byte(" 2 2\n"), now); string(b) != " 2 2\n" {
+		t.Errorf("datagram: another sender's datagram should not be joined, got %q", b)
+	}
+	if b := ra.datagram("x", []byte(" 2 2\n"), now); string(b) != "c.d 2 2\n" {
+		t.Errorf("datagram: expected the line to be joined, got %q", b)
+	}
+
+	// an incomplete line does not wait forever
+	ra.datagram("x", []byte("e.f"), now)
+	if b := ra.datagram("x", []byte(" 3 3\n"), now.Add(2*reassembleTimeout)); string(b) != " 3 3\n" {
+		t.Errorf("datagram: an expired line should not be joined, got %q", b)
+	}
+	ra.datagram("x", []byte("e.f"), now)
+	ra.datagram("y", nil, now.Add(4*reassembleTimeout))
+	if len(ra.partial) != 0 {
+		t.Errorf("purge: expected no incomplete lines, got %d", len(ra.partial))
+	}
+}
+
+func Test_listenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "graphite.sock")
+
+	// a stale socket is replaced
+	for i := 0; i < 2; i++ {
+		ln, err := listenUnix(path)
+		if err != nil {
+			t.Fatalf("listenUnix: %v", err)
+		}
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				conn.Write([]byte("ok"))
+				conn.Close()
+			}
+		}()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if b, _ := ioutil.ReadAll(conn); string(b) != "ok" {
+			t.Errorf("listenUnix: expected ok, got %q", b)
+		}
+		conn.Close()
+		ln.Close()
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("listenUnix: the socket should be kept on close: %v", err)
+	}
+}
+
+func Test_readGraphitePickle(t *testing.T) {
+	queue := func(serde.Ident, time.Time, float64) { t.Errorf("readGraphitePickle: unexpected data point") }
+
+	// a frame which does not unpickle is skipped, EOF ends the
+	// connection
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte{0, 0, 0, 3, 'x', 'y', 'z'})
+		client.Close()
+	}()
+	readGraphitePickle(server, 0, 1024, queue)
+
+	// an oversized frame closes the connection without reading it
+	client, server = net.Pipe()
+	done := make(chan bool)
+	go func() {
+		readGraphitePickle(server, 0, 1024, queue)
+		server.Close()
+		done <- true
+	}()
+	client.Write([]byte{0, 0, 8, 0})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("readGraphitePickle: did not return on an oversized frame")
+	}
+	if _, err := client.Write(make([]byte, 1024)); err == nil {
+		t.Errorf("readGraphitePickle: expected the connection to be closed")
+	}
+}
+
+func Test_handleInfluxUdpProtocol(t *testing.T) {
+	tmpl, err := influx.NewTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("cpu,host=web01,region=us-east usage_user=12.5,usage_system=3i,state=\"ok\" 1500000000000000000\n" +
+			"mem,host=web01 value=42 1500000001000000000\n"))
+		client.Write([]byte("bogus\ndisk,host=web\\ 02,path=var\\,log used=1,full=t 1500000002000000000"))
+		client.Close()
+	}()
+
+	var got []string
+	handleInfluxUdpProtocol(server, tmpl, func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %v %d", ident["name"], v, ts.Unix()))
+	})
+	sort.Strings(got)
+	expect := []string{
+		"web01.us-east.cpu.usage_system 3 1500000000",
+		"web01.us-east.cpu.usage_user 12.5 1500000000",
+		"web01.mem 42 1500000001",
+		"web_02.varlog.disk.full 1 1500000002",
+		"web_02.varlog.disk.used 1 1500000002",
+	}
+	sort.Strings(expect)
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("handleInfluxUdpProtocol: expected %v, got %v", expect, got)
+	}
+
+	if _, err := influx.NewTemplate("host.field"); err == nil {
+		t.Errorf("NewTemplate: expected an error without measurement")
+	}
+}
+
+// benchConn is a connection which reads the same data over and over,
+// counting the reads (i.e. syscalls, were it a socket).
+type benchConn struct {
+	net.Conn
+	r     *bytes.Reader
+	reads int
+}
+
+func (c *benchConn) Read(b []byte) (int, error) { c.reads++; return c.r.Read(b) }
+func (c *benchConn) RemoteAddr() net.Addr       { return &net.TCPAddr{} }
+
+var benchQueue = func(serde.Ident, time.Time, float64) {}
+
+func graphiteBenchData() []byte {
+	var buf bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "servers.host%03d.cpu.user %d.%d 1500000000\n", i%100, i, i%10)
+	}
+	return buf.Bytes()
+}
+
+func Benchmark_readGraphiteText(b *testing.B) {
+	data := graphiteBenchData()
+	rp := newReaderPool(256 * 1024)
+	var reads int
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		c := &benchConn{r: bytes.NewReader(data)}
+		readGraphiteText(c, 0, rp, graphiteDecoder, benchQueue, nil)
+		reads += c.reads
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+}
+
+// The way readGraphiteText used to work, for comparison.
+func Benchmark_readGraphiteText_scanner(b *testing.B) {
+	data := graphiteBenchData()
+	var reads int
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		c := &benchConn{r: bytes.NewReader(data)}
+		sc := bufio.NewScanner(c)
+		for sc.Scan() {
+			var (
+				name   string
+				value  float64
+				tstamp int64
+			)
+			fmt.Sscanf(sc.Text(), "%s %f %d", &name, &value, &tstamp)
+			benchQueue(serde.Ident{"name": misc.SanitizeName(name)}, time.Unix(tstamp, 0), value)
+		}
+		reads += c.reads
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+}
+
+func Test_handleOpenTSDBTelnetProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	var replies []string
+	done := make(chan bool)
+	go func() {
+		br := bufio.NewReader(client)
+		for _, cmd := range []string{
+			"put sys.cpu.user 1500000000 42.5 host=web01 cpu=0\n",
+			"put sys.load 1500000001000 1.5 host=a.b.c\n",
+			"put sys.bad 1500000002 x host=web01\n",
+			"version\n",
+			"stats\n",
+			"exit\n",
+		} {
+			client.Write([]byte(cmd))
+			if strings.HasPrefix(cmd, "put sys.bad") || cmd == "version\n" || cmd == "stats\n" {
+				line, _ := br.ReadString('\n')
+				replies = append(replies, line)
+			}
+		}
+		client.Close()
+		close(done)
+	}()
+
+	var got []string
+	handleOpenTSDBTelnetProtocol(server, 0, opentsdb.TagsPairs, func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %v %d", ident["name"], v, ts.Unix()))
+	})
+	<-done
+
+	expect := []string{
+		"sys.cpu.user.cpu.0.host.web01 42.5 1500000000",
+		"sys.load.host.a_b_c 1.5 1500000001",
+	}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("handleOpenTSDBTelnetProtocol: expected %v, got %v", expect, got)
+	}
+	if len(replies) != 3 || !strings.HasPrefix(replies[0], "put: illegal argument") ||
+		!strings.HasPrefix(replies[1], "tgres") || !strings.HasPrefix(replies[2], "unknown command: stats") {
+		t.Errorf("handleOpenTSDBTelnetProtocol: unexpected replies: %q", replies)
+	}
+
+	p := &opentsdb.Point{Metric: "m", Tags: map[string]string{"b": "2", "a": "1"}}
+	if name := opentsdb.TagsValues.Name(p); name != "m.1.2" {
+		t.Errorf("TagsValues: expected m.1.2, got %q", name)
+	}
+	if name := opentsdb.TagsDrop.Name(p); name != "m" {
+		t.Errorf("TagsDrop: expected m, got %q", name)
+	}
+}
+
+func Test_buildTags(t *testing.T) {
+	defer func(b BuildInfo) { Build = b }(Build)
+
+	Build = BuildInfo{}
+	if tags := buildTags(); len(tags) != 0 {
+		t.Errorf("buildTags: expected no tags for an unknown build, got %v", tags)
+	}
+	Build = BuildInfo{Version: "1.2.3", GitRevision: "0123456789abcdef0123456789abcdef01234567"}
+	tags := buildTags()
+	if tags[TagVersion] != "1.2.3" || tags[TagRevision] != "0123456789ab" {
+		t.Errorf("buildTags: unexpected tags: %v", tags)
+	}
+
+	info := newInfo(&Config{HttpListenSpec: ":8888"}, "postgres")
+	if info.Version != "1.2.3" || !info.Ingest["prometheus-remote-write"] || info.Ingest["graphite-text"] {
+		t.Errorf("newInfo: unexpected info: %+v", info)
+	}
+}
@@ -0,0 +1,211 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// Tgres runs the tgres components (receiver, listeners, HTTP) inside
+// another Go program. The fields must be set before Start():
+//
+//	t := daemon.New(cfg)
+//	t.Listeners = map[string]net.Listener{"www": ln}
+//	if err := t.Start(ctx); err != nil {
+//		...
+//	}
+//
+// Unlike the standalone daemon, Tgres does not write a pid file,
+// redirect the log or handle signals, and the cluster is only joined
+// if one is provided.
+type Tgres struct {
+	Config *Config
+
+	// DB is the storage, nil means connect using the
+	// Config.DbConnectString.
+	DB serde.DbSerDe
+
+	// Cluster, if nil, is a cluster.NewSingleNode(), i.e. this
+	// instance owns all the data.
+	Cluster cluster.Clusterer
+
+	// Listeners and Conns are used by the services instead of
+	// listening as specified in the Config. The keys are "www" (HTTP),
+	// "gt" (Graphite text), "gp" (Graphite pickle) and "ot" (OpenTSDB
+	// telnet) for Listeners, "gu" (Graphite UDP), "su" (Statsd UDP)
+	// and "iu" (InfluxDB line protocol UDP) for Conns. Services
+	// which are not provided here and have a blank listen spec in the
+	// Config are not started.
+	Listeners map[string]net.Listener
+	Conns     map[string]net.Conn
+
+	// Sources are ingest sources (see the ingest package) in
+	// addition to those in the Config.
+	Sources []receiver.IngestSource
+
+	sync.Mutex
+	lc     *Lifecycle
+	rcvr   *receiver.Receiver
+	rcache dsl.NamedDSFetcher
+}
+
+// New returns a Tgres with the given Config (see NewConfig() and
+// ReadConfig()), the pid and log file settings are ignored.
+func New(cfg *Config) *Tgres {
+	return &Tgres{Config: cfg}
+}
+
+// NewConfig returns a Config with the same settings as the sample
+// config file, except that no listeners, pid file, log file or
+// database are configured.
+func NewConfig() *Config {
+	cfg := &Config{
+		MinStep:         duration{10 * time.Second},
+		Workers:         4,
+		StatFlush:       duration{10 * time.Second},
+		StatsNamePrefix: "stats",
+	}
+	ds := ConfigDSSpec{
+		Regexp:    regex{regexp.MustCompile(".*")},
+		Step:      duration{10 * time.Second},
+		Heartbeat: duration{2 * time.Hour},
+	}
+	for _, spec := range []string{"10s:6h", "1m:24h", "10m:93d", "1d:5y:1"} {
+		var rra ConfigRRASpec
+		rra.UnmarshalText([]byte(spec))
+		ds.RRAs = append(ds.RRAs, rra)
+	}
+	cfg.DSs = []ConfigDSSpec{ds}
+	return cfg
+}
+
+// ReadConfig reads a config file in the format of the standalone
+// daemon.
+func ReadConfig(path string) (*Config, error) {
+	return readConfig(path)
+}
+
+// Start validates the config, connects to the database (unless DB is
+// set) and starts all the components. When ctx is done, Tgres is
+// stopped. If any component fails to start, those already started
+// are stopped and the error is returned.
+func (t *Tgres) Start(ctx context.Context) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.lc != nil {
+		return fmt.Errorf("Tgres already started")
+	}
+
+	cfg := t.Config
+	if t.DB == nil {
+		if err := cfg.processDbConnectString(); err != nil {
+			return err
+		}
+	}
+	if err := processReceiverConfig(cfg); err != nil {
+		return err
+	}
+	if err := cfg.processInfluxTemplate(); err != nil {
+		return err
+	}
+	if err := cfg.processOpenTSDBTagPolicy(); err != nil {
+		return err
+	}
+
+	db, serdeName := t.DB, fmt.Sprintf("%T", t.DB)
+	if db == nil {
+		var err error
+		if db, err = initDb(cfg.DbConnectString); err != nil {
+			return fmt.Errorf("connecting to the DB: %v", err)
+		}
+		serdeName = "postgres"
+	}
+
+	clstr := t.Cluster
+	if clstr == nil {
+		clstr = cluster.NewSingleNode()
+	}
+
+	rcvr := createReceiver(cfg, nil, db)
+	for _, src := range t.Sources {
+		rcvr.AddIngestSource(src)
+	}
+	rcvr.SetCluster(clstr)
+	rcache := dsl.NewNamedDSFetcher(db.Fetcher())
+	serviceMgr := newServiceManager(rcvr, db.Fetcher(), rcache, cfg, newInfo(cfg, serdeName), nil)
+	if err := serviceMgr.provide(t.Listeners, t.Conns); err != nil {
+		return err
+	}
+
+	lc := NewLifecycle()
+	addReceiverComponents(lc, rcvr, serviceMgr, "", "cluster")
+	lc.Add(&Component{
+		Name:      "cluster",
+		DependsOn: []string{"services"},
+		Stop: func() error {
+			return clstr.Ready(false)
+		},
+	})
+	if err := lc.Start(); err != nil {
+		return err
+	}
+	t.lc, t.rcvr, t.rcache = lc, rcvr, rcache
+
+	go func() {
+		<-ctx.Done()
+		t.Stop()
+	}()
+	return nil
+}
+
+// Stop stops all the components, flushing the data to the
+// database. It is safe to call more than once.
+func (t *Tgres) Stop() error {
+	t.Lock()
+	lc := t.lc
+	t.Unlock()
+	if lc == nil {
+		return nil
+	}
+	return lc.Stop()
+}
+
+// Receiver returns the receiver, e.g. to send it data points
+// directly. It is nil until Start() succeeds.
+func (t *Tgres) Receiver() *receiver.Receiver {
+	t.Lock()
+	defer t.Unlock()
+	return t.rcvr
+}
+
+// Fetcher returns the series fetcher used by the HTTP handlers, so
+// that the application can run queries directly. It is nil until
+// Start() succeeds.
+func (t *Tgres) Fetcher() dsl.NamedDSFetcher {
+	t.Lock()
+	defer t.Unlock()
+	return t.rcache
+}
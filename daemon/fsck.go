@@ -0,0 +1,71 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// Fsck checks the data stored in the database for violated invariants
+// (see serde.InvariantChecker) and prints them to w, it is what
+// "tgres fsck [-repair]" does. With -repair, what can be repaired is,
+// in which case Tgres must not be running. It returns an error if
+// anything was found which was not repaired.
+func Fsck(cfgPath string, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "Repair what can be repaired (Tgres must not be running)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read config %q: %v", cfgPath, err)
+	}
+	if err := cfg.processDbConnectString(); err != nil {
+		return fmt.Errorf("Error in config file %s: %v", cfgPath, err)
+	}
+	db, err := initDb(cfg.DbConnectString)
+	if err != nil {
+		return fmt.Errorf("Error connecting to the DB: %v", err)
+	}
+	ic, ok := db.(serde.InvariantChecker)
+	if !ok {
+		return fmt.Errorf("This database does not support checking.")
+	}
+
+	vv, err := ic.CheckInvariants(time.Now(), *repair)
+	var repaired int
+	for _, v := range vv {
+		fmt.Fprintln(w, v)
+		if v.Repaired {
+			repaired++
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error checking: %v", err)
+	}
+	fmt.Fprintf(w, "%d violation(s) found, %d repaired.\n", len(vv), repaired)
+	if repaired < len(vv) {
+		return fmt.Errorf("%d violation(s) not repaired", len(vv)-repaired)
+	}
+	return nil
+}
@@ -16,33 +16,87 @@
 package daemon
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/tgres/tgres/dsl"
 	h "github.com/tgres/tgres/http"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/opentsdb"
 	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
 )
 
-func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher) {
+func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, activity serde.SeriesActivityLister, configStatus func() *h.ClusterConfigStatus, auth h.Authenticator, influxTmpl *influx.Template, dsf receiver.MatchingDSSpecFinder, tsdbTags opentsdb.TagPolicy, info *h.Info) {
 
-	http.HandleFunc("/metrics/find", h.GraphiteMetricsFindHandler(rcache))
-	http.HandleFunc("/metrics/find/", h.GraphiteMetricsFindHandler(rcache))
-	http.HandleFunc("/render", h.GraphiteRenderHandler(rcache))
-	http.HandleFunc("/render/", h.GraphiteRenderHandler(rcache))
+	// When client certificates or tokens are required, every handler
+	// (except /ping) requires the tenant to have the appropriate
+	// scope. The handlers taking or listing full series names are
+	// GlobalOnly, the others confine a tenant to its namespace.
+	scoped := func(scope string, f http.HandlerFunc) http.HandlerFunc {
+		if auth == nil {
+			return f
+		}
+		return auth.Handler(scope, f)
+	}
+
+	http.HandleFunc("/metrics/find", scoped(h.ScopeRead, h.GraphiteMetricsFindHandler(rcache)))
+	http.HandleFunc("/metrics/find/", scoped(h.ScopeRead, h.GraphiteMetricsFindHandler(rcache)))
+	http.HandleFunc("/render", scoped(h.ScopeRead, h.GraphiteRenderHandler(rcache)))
+	http.HandleFunc("/render/estimate", scoped(h.ScopeRead, h.GraphiteRenderEstimateHandler(rcache)))
+	http.HandleFunc("/render/", scoped(h.ScopeRead, h.GraphiteRenderHandler(rcache)))
+
+	if async, err := h.NewAsyncQueryManager(rcache, "", time.Hour); err != nil {
+		log.Printf("ERROR: async queries disabled: %v", err)
+	} else {
+		http.HandleFunc("/api/query/async", scoped(h.ScopeRead, async.SubmitHandler()))
+		http.HandleFunc("/api/query/async/", scoped(h.ScopeRead, async.StatusHandler("/api/query/async/")))
+	}
+
+	http.HandleFunc("/api/export", scoped(h.ScopeRead, h.ExportHandler(rcache)))
+	http.HandleFunc("/api/dsspec", scoped(h.ScopeRead, h.DSSpecHandler(dsf)))
+
+	http.HandleFunc("/api/info", scoped(h.ScopeRead, h.InfoHandler(info)))
+	http.HandleFunc("/api/series/check", scoped(h.ScopeAdmin, h.GlobalOnly(h.SeriesCheckHandler(rcvr))))
+	http.HandleFunc("/api/series/rras", scoped(h.ScopeAdmin, h.GlobalOnly(h.SeriesRRAsHandler(rcvr))))
+	http.HandleFunc("/api/series/rename", scoped(h.ScopeAdmin, h.SeriesRenameHandler(rcvr)))
+	http.HandleFunc("/api/series/merge", scoped(h.ScopeAdmin, h.SeriesMergeHandler(rcvr)))
+	http.HandleFunc("/api/series/delete", scoped(h.ScopeAdmin, h.SeriesDeleteHandler(rcvr)))
+	if activity != nil {
+		http.HandleFunc("/api/series/recent", scoped(h.ScopeRead, h.GlobalOnly(h.RecentSeriesHandler(activity))))
+		http.HandleFunc("/api/series/stale", scoped(h.ScopeRead, h.GlobalOnly(h.StaleSeriesHandler(activity))))
+	}
+	if configStatus != nil {
+		http.HandleFunc("/api/cluster/config", scoped(h.ScopeRead, h.ClusterConfigHandler(configStatus)))
+	}
+	http.HandleFunc("/metrics", scoped(h.ScopeRead, h.MetricsHandler()))
 
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
 
-	http.HandleFunc("/pixel", h.PixelHandler(rcvr))
-	http.HandleFunc("/pixel/add", h.PixelAddHandler(rcvr))
-	http.HandleFunc("/pixel/addgauge", h.PixelAddGaugeHandler(rcvr))
-	http.HandleFunc("/pixel/setgauge", h.PixelSetGaugeHandler(rcvr))
-	http.HandleFunc("/pixel/append", h.PixelAppendHandler(rcvr))
+	http.HandleFunc("/pixel", scoped(h.ScopeWrite, h.PixelHandler(rcvr)))
+	http.HandleFunc("/pixel/add", scoped(h.ScopeWrite, h.PixelAddHandler(rcvr)))
+	http.HandleFunc("/pixel/addgauge", scoped(h.ScopeWrite, h.PixelAddGaugeHandler(rcvr)))
+	http.HandleFunc("/pixel/setgauge", scoped(h.ScopeWrite, h.PixelSetGaugeHandler(rcvr)))
+	http.HandleFunc("/pixel/append", scoped(h.ScopeWrite, h.PixelAppendHandler(rcvr)))
+
+	http.HandleFunc("/write", scoped(h.ScopeWrite, h.InfluxWriteHandler(rcvr, influxTmpl)))
+	http.HandleFunc("/api/put", scoped(h.ScopeWrite, h.OpenTSDBPutHandler(rcvr, tsdbTags)))
+	http.HandleFunc("/api/backfill", scoped(h.ScopeAdmin, h.GlobalOnly(h.BackfillHandler(rcvr))))
+	http.HandleFunc("/api/whisper/import", scoped(h.ScopeAdmin, h.GlobalOnly(h.WhisperImportHandler(rcvr))))
+	http.HandleFunc("/api/whisper/export", scoped(h.ScopeRead, h.GlobalOnly(h.WhisperExportHandler(rcvr))))
+	http.HandleFunc("/api/rrdtool/import", scoped(h.ScopeAdmin, h.GlobalOnly(h.RRDToolImportHandler(rcvr))))
+	http.HandleFunc("/api/rrdtool/export", scoped(h.ScopeRead, h.GlobalOnly(h.RRDToolExportHandler(rcvr))))
+	http.HandleFunc("/api/v1/prom/write", scoped(h.ScopeWrite, h.PromWriteHandler(rcvr)))
+	http.HandleFunc("/api/v1/prom/read", scoped(h.ScopeRead, h.PromReadHandler(rcache)))
 
 	if rcvr.Blaster != nil {
-		http.HandleFunc("/blaster/set", h.BlasterSetHandler(rcvr.Blaster))
+		http.HandleFunc("/blaster/set", scoped(h.ScopeAdmin, h.GlobalOnly(h.BlasterSetHandler(rcvr.Blaster))))
 	}
 
 	server := &http.Server{
@@ -52,3 +106,69 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 		MaxHeaderBytes: 1 << 16}
 	server.Serve(l)
 }
+
+// httpTLSConfig returns the TLS configuration for the HTTP listener
+// and, if client certificates are required, the ClientCertAuth
+// mapping certificates to tenants. A nil tls.Config means plain HTTP.
+func httpTLSConfig(certFile, keyFile, clientCAFile string, clientCerts []ConfigClientCertSpec) (*tls.Config, *h.ClientCertAuth, error) {
+	if certFile == "" {
+		return nil, nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile == "" {
+		return cfg, nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("No certificates found in client CA file %q", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	auth := h.NewClientCertAuth()
+	for _, cc := range clientCerts {
+		auth.AddIdentity(cc.Identity, &h.Tenant{Name: cc.Tenant, Scopes: cc.Scopes, Global: cc.Global})
+	}
+	return cfg, auth, nil
+}
+
+// reportDSLStats periodically sends what the DSL functions were
+// called since the last time to the internal stats, so that it ends
+// up as calls (and milliseconds spent) per second.
+func reportDSLStats(rcvr *receiver.Receiver, interval time.Duration, stop <-chan struct{}) {
+	last := make(map[string]dsl.FuncStat)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if !rcvr.ReportStats {
+			continue
+		}
+		for _, st := range dsl.FuncStats() {
+			prev := last[st.Name]
+			if st.Calls == prev.Calls {
+				continue
+			}
+			name := rcvr.ReportStatsPrefix + ".dsl.func." + st.Name
+			rcvr.QueueSum(serde.Ident{"name": name + ".calls"}, float64(st.Calls-prev.Calls))
+			if st.Errors != prev.Errors {
+				rcvr.QueueSum(serde.Ident{"name": name + ".errors"}, float64(st.Errors-prev.Errors))
+			}
+			rcvr.QueueSum(serde.Ident{"name": name + ".duration_ms"}, float64(st.Duration-prev.Duration)/float64(time.Millisecond))
+			last[st.Name] = st
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// How long a graphite text protocol client has to complete the TLS
+// handshake and send its auth token.
+const graphiteAuthTimeout = 10 * time.Second
+
+// graphiteAuth secures graphite text protocol connections with TLS
+// and authenticates them with a client certificate (signed by the
+// client CA) or an auth token, which the client sends as the first
+// line of the connection, e.g. "auth s3cr3t". If both client
+// certificates and tokens are configured, either will do.
+type graphiteAuth struct {
+	tls      *tlsReloader // nil is plain text
+	clientCA bool         // a verified client certificate authenticates
+	tokens   map[[sha256.Size]byte]bool
+}
+
+func newGraphiteAuth(certFile, keyFile, clientCAFile string, tokens []string) (*graphiteAuth, error) {
+	a := &graphiteAuth{clientCA: clientCAFile != "", tokens: make(map[[sha256.Size]byte]bool)}
+	for _, tk := range tokens {
+		a.tokens[sha256.Sum256([]byte(tk))] = true
+	}
+	if certFile == "" {
+		return a, nil
+	}
+	load := func() (*tls.Config, error) {
+		cfg, _, err := httpTLSConfig(certFile, keyFile, clientCAFile, nil)
+		if err == nil && cfg.ClientCAs != nil && len(tokens) > 0 {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven // or a token
+		}
+		return cfg, err
+	}
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	a.tls = newTLSReloader(cfg, load, certFile, keyFile, clientCAFile)
+	return a, nil
+}
+
+// handler wraps handle so that it gets the secured connection, if it
+// is authenticated.
+func (a *graphiteAuth) handler(handle func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		sconn, err := a.accept(conn)
+		if err != nil {
+			log.Printf("graphiteTextServer(): %v, closing connection from %v", err, conn.RemoteAddr())
+			conn.Close() // decrements graceful.TcpWg
+			return
+		}
+		handle(sconn)
+	}
+}
+
+// accept does the TLS handshake and checks the client certificate or
+// the auth token, returning the connection to read from.
+func (a *graphiteAuth) accept(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(graphiteAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if a.tls != nil {
+		tc := tls.Server(conn, a.tls.Config())
+		if err := tc.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake: %v", err)
+		}
+		conn = tc
+		if a.clientCA && len(tc.ConnectionState().PeerCertificates) > 0 {
+			return conn, nil // verified by the handshake
+		}
+	}
+	if len(a.tokens) == 0 {
+		if a.clientCA {
+			return nil, fmt.Errorf("client certificate required")
+		}
+		return conn, nil
+	}
+
+	line, err := readAuthLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "auth" {
+		return nil, fmt.Errorf("expected an auth line")
+	}
+	if !a.tokens[sha256.Sum256([]byte(fields[1]))] {
+		return nil, fmt.Errorf("unknown auth token")
+	}
+	return conn, nil
+}
+
+// readAuthLine reads the first line a byte at a time, so that nothing
+// past it is consumed.
+func readAuthLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err := conn.Read(b); err != nil {
+			return "", fmt.Errorf("reading auth line: %v", err)
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("auth line too long")
+}
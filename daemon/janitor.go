@@ -0,0 +1,84 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// janitor periodically deletes the series which have not been
+// updated for a while (see expire-series-after), so that the ds table
+// does not grow without bound as series come and go. With dryRun it
+// only logs which series it would delete.
+type janitor struct {
+	expire func(before time.Time, dryRun bool) ([]serde.SeriesActivity, error)
+	after  time.Duration
+	dryRun bool
+	stop   chan struct{}
+}
+
+func newJanitor(expire func(time.Time, bool) ([]serde.SeriesActivity, error), after time.Duration, dryRun bool) *janitor {
+	return &janitor{expire: expire, after: after, dryRun: dryRun, stop: make(chan struct{})}
+}
+
+// How many series names a dry run logs.
+const janitorLogNames = 10
+
+func (j *janitor) sweep(now time.Time) {
+	before := now.Add(-j.after)
+	stale, err := j.expire(before, j.dryRun)
+	if err != nil {
+		log.Printf("Janitor: %v", err)
+		return
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if !j.dryRun {
+		log.Printf("Janitor: deleted %d series not updated since %v.", len(stale), before.Format(time.RFC3339))
+		return
+	}
+	names := make([]string, 0, janitorLogNames)
+	for _, sa := range stale {
+		if len(names) == janitorLogNames {
+			names = append(names, "...")
+			break
+		}
+		names = append(names, sa.Ident["name"])
+	}
+	log.Printf("Janitor: %d series not updated since %v would be deleted (dry run): %s", len(stale), before.Format(time.RFC3339), strings.Join(names, ", "))
+}
+
+func (j *janitor) run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case now := <-tick.C:
+			j.sweep(now)
+		}
+	}
+}
+
+func (j *janitor) Stop() {
+	close(j.stop)
+}
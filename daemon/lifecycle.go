@@ -0,0 +1,174 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Component is a part of a tgres process which needs to be started
+// and stopped in a particular order relative to other parts, e.g. the
+// receiver must be stopped (and its data flushed) only after the
+// listeners feeding it are closed.
+type Component struct {
+	Name      string
+	DependsOn []string // names of the components to start before this one
+	Start     func() error
+	Stop      func() error
+	// How long to wait for Stop before giving up on it and moving
+	// on to the next component, zero means no limit.
+	StopTimeout time.Duration
+}
+
+// Lifecycle starts components in dependency order and stops them in
+// reverse. If a component fails to start, the ones already started
+// are stopped, so that there are no half-initialized listeners left
+// behind. It is used by Init(), but can also be used when embedding
+// tgres in another program.
+type Lifecycle struct {
+	sync.Mutex
+	comps   []*Component
+	started []*Component // in the order started
+}
+
+// NewLifecycle returns an empty Lifecycle.
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+// Add adds a component. Components are started in the order added,
+// except that a component is never started before those it depends
+// on. Either of Start or Stop can be nil.
+func (l *Lifecycle) Add(c *Component) {
+	l.Lock()
+	defer l.Unlock()
+	l.comps = append(l.comps, c)
+}
+
+// order returns the components sorted so that every component comes
+// after its dependencies, otherwise preserving the order of Add().
+func (l *Lifecycle) order() ([]*Component, error) {
+	byName := make(map[string]*Component, len(l.comps))
+	for _, c := range l.comps {
+		if byName[c.Name] != nil {
+			return nil, fmt.Errorf("duplicate component: %q", c.Name)
+		}
+		byName[c.Name] = c
+	}
+	for _, c := range l.comps {
+		for _, dep := range c.DependsOn {
+			if byName[dep] == nil {
+				return nil, fmt.Errorf("component %q depends on unknown component %q", c.Name, dep)
+			}
+		}
+	}
+
+	result := make([]*Component, 0, len(l.comps))
+	done := make(map[string]bool, len(l.comps))
+	for len(result) < len(l.comps) {
+		progress := false
+		for _, c := range l.comps {
+			if done[c.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range c.DependsOn {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				result = append(result, c)
+				done[c.Name] = true
+				progress = true
+				break // start over, so that the order of Add() is kept
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("circular dependency among components")
+		}
+	}
+	return result, nil
+}
+
+// Start starts all the components. If one of them fails, those
+// already started are stopped in reverse order and the error is
+// returned.
+func (l *Lifecycle) Start() error {
+	l.Lock()
+	defer l.Unlock()
+
+	comps, err := l.order()
+	if err != nil {
+		return err
+	}
+	for _, c := range comps {
+		if c.Start != nil {
+			if err := c.Start(); err != nil {
+				log.Printf("Lifecycle: %s failed to start, stopping what was started: %v", c.Name, err)
+				l.stop()
+				return fmt.Errorf("starting %s: %v", c.Name, err)
+			}
+		}
+		l.started = append(l.started, c)
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order. Errors (and
+// timeouts) do not prevent the remaining components from being
+// stopped, the first one is returned. Stopping an already stopped
+// Lifecycle does nothing.
+func (l *Lifecycle) Stop() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.stop()
+}
+
+func (l *Lifecycle) stop() error {
+	var first error
+	for i := len(l.started) - 1; i >= 0; i-- {
+		if err := stopComponent(l.started[i]); err != nil {
+			log.Printf("Lifecycle: error stopping %s: %v", l.started[i].Name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	l.started = nil
+	return first
+}
+
+func stopComponent(c *Component) error {
+	if c.Stop == nil {
+		return nil
+	}
+	if c.StopTimeout == 0 {
+		return c.Stop()
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Stop() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(c.StopTimeout):
+		return fmt.Errorf("%s did not stop within %v", c.Name, c.StopTimeout)
+	}
+}
@@ -17,6 +17,7 @@ package daemon
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -55,7 +56,11 @@ var cycleLogFile = func(logPath string) {
 		os.Exit(1)
 	}
 
-	log.SetOutput(file)
+	if eventLog != nil {
+		log.SetOutput(io.MultiWriter(file, eventLog))
+	} else {
+		log.SetOutput(file)
+	}
 	if logFile != nil {
 		logFile.Close()
 	}
@@ -0,0 +1,156 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a client (i.e. a load balancer) has to send the PROXY
+// protocol header.
+var proxyHeaderTimeout = 5 * time.Second
+
+// The signature of a PROXY protocol version 2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection which started with a PROXY protocol
+// header, its RemoteAddr() is the original client address.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// readProxyHeader reads the HAProxy PROXY protocol header (version 1
+// or 2, see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt)
+// from conn and returns a connection whose RemoteAddr() is the
+// address of the original client. A connection without a header is
+// an error, as is customary, so that clients cannot bypass the proxy
+// and claim any address. For the LOCAL command (e.g. health checks)
+// and unknown address families the address is that of conn.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading header: %v", err)
+	}
+	var remote net.Addr
+	if bytes.Equal(sig, proxyV2Sig) {
+		remote, err = readProxyV2(r)
+	} else {
+		remote, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// handleProxied reads the PROXY protocol header from conn, then
+// passes the connection on to handle.
+func handleProxied(conn net.Conn, handle func(net.Conn)) {
+	pconn, err := readProxyHeader(conn, proxyHeaderTimeout)
+	if err != nil {
+		log.Printf("%v, closing connection from %v", err, conn.RemoteAddr())
+		conn.Close() // decrements graceful.TcpWg
+		return
+	}
+	handle(pconn)
+}
+
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // the maximum length of a v1 header
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY protocol: reading header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasPrefix(s, "PROXY ") || !strings.HasSuffix(s, "\r\n") {
+		return nil, fmt.Errorf("PROXY protocol: invalid header: %q", s)
+	}
+	parts := strings.Split(strings.TrimSuffix(s, "\r\n"), " ")
+	if parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("PROXY protocol: invalid header: %q", s)
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("PROXY protocol: invalid source address in header: %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY protocol: unsupported version %d", hdr[12]>>4)
+	}
+	cmd, fam := hdr[12]&0xf, hdr[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading addresses: %v", err)
+	}
+	if cmd == 0 { // LOCAL
+		return nil, nil
+	}
+	if cmd != 1 {
+		return nil, fmt.Errorf("PROXY protocol: unsupported command %d", cmd)
+	}
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("PROXY protocol: short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("PROXY protocol: short IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return nil, nil // UNSPEC, UDP or unix sockets
+}
@@ -0,0 +1,61 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// The default size of the buffer of graphite text protocol readers,
+// see graphite-read-buffer-size.
+const defaultReadBufferSize = 64 * 1024
+
+// readerPool is a pool of bufio.Readers of the same size, so that
+// large buffers can be used without allocating one for every
+// connection. A nil readerPool does not pool and uses the default
+// size.
+type readerPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newReaderPool(size int) *readerPool {
+	if size <= 0 {
+		size = defaultReadBufferSize
+	}
+	return &readerPool{size: size}
+}
+
+func (p *readerPool) get(r io.Reader) *bufio.Reader {
+	if p == nil {
+		return bufio.NewReaderSize(r, defaultReadBufferSize)
+	}
+	if br, ok := p.pool.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, p.size)
+}
+
+func (p *readerPool) put(br *bufio.Reader) {
+	if p == nil {
+		return
+	}
+	br.Reset(nil) // do not keep the connection around
+	p.pool.Put(br)
+}
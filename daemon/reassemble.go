@@ -0,0 +1,103 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/ingest"
+)
+
+// How long the incomplete last line of a graphite UDP datagram is
+// kept waiting for the rest of it, and how many senders at most can
+// have one waiting.
+const (
+	reassembleTimeout    = time.Second
+	reassembleMaxSenders = 1024
+)
+
+// udpReassembler joins graphite lines which a sender split across
+// datagrams: a datagram which does not end in a newline and whose
+// last line does not parse is assumed to continue in the next
+// datagram from the same sender. A datagram which does not end in a
+// newline but whose last line parses (e.g. one line per datagram,
+// as sent by many clients) is complete, which means that a line
+// split within its timestamp cannot be joined. It is not safe for
+// concurrent use, there is one per UDP listener.
+type udpReassembler struct {
+	dec       ingest.Decoder
+	partial   map[string]*partialLine // by sender address
+	lastPurge time.Time
+}
+
+type partialLine struct {
+	b []byte
+	t time.Time
+}
+
+func newUdpReassembler(dec ingest.Decoder) *udpReassembler {
+	return &udpReassembler{dec: dec, partial: make(map[string]*partialLine)}
+}
+
+// datagram returns the complete lines of the datagram b from the
+// sender addr, prepending what was left over of the previous one.
+// The result may share memory with b.
+func (ra *udpReassembler) datagram(addr string, b []byte, now time.Time) []byte {
+	ra.purge(now)
+
+	if p := ra.partial[addr]; p != nil {
+		delete(ra.partial, addr)
+		if now.Sub(p.t) <= reassembleTimeout {
+			b = append(p.b, b...)
+		} else {
+			ra.discard(addr, p)
+		}
+	}
+	if len(b) == 0 || b[len(b)-1] == '\n' {
+		return b
+	}
+
+	i := bytes.LastIndexByte(b, '\n') + 1
+	last := bytes.TrimSpace(b[i:])
+	if len(last) == 0 || len(ra.partial) >= reassembleMaxSenders {
+		return b
+	}
+	if _, _, _, _, err := ra.dec.Decode(last); err == nil {
+		return b
+	}
+	ra.partial[addr] = &partialLine{b: append([]byte{}, b[i:]...), t: now}
+	return b[:i]
+}
+
+// purge discards the incomplete lines which have waited too long.
+func (ra *udpReassembler) purge(now time.Time) {
+	if len(ra.partial) == 0 || now.Sub(ra.lastPurge) < reassembleTimeout {
+		return
+	}
+	ra.lastPurge = now
+	for addr, p := range ra.partial {
+		if now.Sub(p.t) > reassembleTimeout {
+			delete(ra.partial, addr)
+			ra.discard(addr, p)
+		}
+	}
+}
+
+func (ra *udpReassembler) discard(addr string, p *partialLine) {
+	log.Printf("handleGraphiteUdpProtocol(): discarding incomplete line from %v: %q", addr, p.b)
+}
@@ -0,0 +1,82 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// rewriteReloader re-reads the rewrite rules from the config file
+// when it changes, so that the rules can be changed without a
+// restart. Nothing else in the config file is reloaded. If the new
+// rules are invalid the previous ones remain in effect, the file is
+// not read again until it changes again.
+type rewriteReloader struct {
+	cfgPath string
+	set     func([]receiver.RewriteRule) error
+	modTime time.Time // of the config file when last read
+	stop    chan struct{}
+}
+
+func newRewriteReloader(cfgPath string, set func([]receiver.RewriteRule) error) *rewriteReloader {
+	return &rewriteReloader{cfgPath: cfgPath, set: set, modTime: newestModTime([]string{cfgPath}), stop: make(chan struct{})}
+}
+
+// check reloads the rules if the config file changed. It returns
+// true if they were reloaded.
+func (r *rewriteReloader) check() bool {
+	modTime := newestModTime([]string{r.cfgPath})
+	if !modTime.After(r.modTime) {
+		return false
+	}
+	r.modTime = modTime
+	cfg, err := readConfig(r.cfgPath)
+	if err == nil {
+		err = cfg.processRewriteRules()
+	}
+	if err == nil {
+		err = r.set(cfg.rewriteRules)
+	}
+	if err != nil {
+		log.Printf("Rewrite rules: not reloading %q: %v", r.cfgPath, err)
+		return false
+	}
+	log.Printf("Rewrite rules: reloaded %d rule(s) from %q.", len(cfg.rewriteRules), r.cfgPath)
+	return true
+}
+
+func (r *rewriteReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+			r.check()
+		}
+	}
+}
+
+func (r *rewriteReloader) Stop() {
+	close(r.stop)
+}
@@ -0,0 +1,142 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrdxml"
+	"github.com/tgres/tgres/serde"
+)
+
+// RRDTool imports or exports the XML of "rrdtool dump", it is what
+// "tgres rrdtool import|export" does:
+//
+//	tgres rrdtool import [-prefix name] file.xml ...
+//	tgres rrdtool export -name name [-ds name] file.xml
+//
+// Each DS of an imported RRD becomes a series named prefix.ds, where
+// prefix is by default the name of the file without the extension. A
+// series which does not exist is created with the RRAs of the RRD
+// (restoring it as it is, including its last update), an existing
+// one must have the same RRAs. The output of export can be loaded
+// with "rrdtool restore".
+func RRDTool(cfgPath string, args []string, w io.Writer) error {
+	if len(args) == 0 || (args[0] != "import" && args[0] != "export") {
+		return fmt.Errorf("usage: rrdtool import|export ...")
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("rrdtool "+cmd, flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "import: prefix of the series names (default: the file name)")
+	name := fs.String("name", "", "export: name of the series")
+	dsName := fs.String("ds", "value", "export: name of the DS in the RRD")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rcvr, err := commandReceiver(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	if cmd == "import" {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("rrdtool import: no files")
+		}
+		var failed int
+		for _, path := range fs.Args() {
+			p := *prefix
+			if p == "" {
+				p = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			}
+			n, err := importRRDFile(rcvr, p, path)
+			if err != nil {
+				fmt.Fprintf(w, "%s: %v\n", path, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(w, "%s: %d series\n", path, n)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d file(s) failed", failed, fs.NArg())
+		}
+		return nil
+	}
+
+	if *name == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: rrdtool export -name name [-ds name] file.xml")
+	}
+	ds, err := rcvr.ExportDataSource(serde.Ident{"name": *name})
+	if err != nil {
+		return err
+	}
+	x, err := rrdxml.FromDataSource(ds, *dsName)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := rrdxml.Write(f, x); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importRRDFile imports the DSs of an RRD dump as series named
+// prefix.ds, returning the number of series.
+func importRRDFile(rcvr *receiver.Receiver, prefix, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	x, err := rrdxml.Read(f)
+	if err != nil {
+		return 0, err
+	}
+	batch, err := rrdBackfillBatch(x, prefix)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rcvr.Backfill(batch); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+func rrdBackfillBatch(x *rrdxml.RRD, prefix string) ([]receiver.BackfillSeries, error) {
+	batch := make([]receiver.BackfillSeries, 0, len(x.DSs))
+	for n, d := range x.DSs {
+		spec, err := x.DSSpec(n)
+		if err != nil {
+			return nil, err
+		}
+		name := misc.SanitizeName(prefix + "." + d.Name)
+		batch = append(batch, receiver.BackfillSeries{Ident: serde.Ident{"name": name}, Spec: spec})
+	}
+	return batch, nil
+}
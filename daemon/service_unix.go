@@ -0,0 +1,43 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+)
+
+// IsService returns true if the process was started by the Windows
+// service manager, which is never the case here.
+func IsService() bool {
+	return false
+}
+
+// RunService is only supported on Windows.
+func RunService(cfgPath, join string) error {
+	return fmt.Errorf("running as a service is only supported on Windows")
+}
+
+// ServiceCommand is only supported on Windows, elsewhere use the init
+// system (e.g. systemd) to manage Tgres.
+func ServiceCommand(cmd, cfgPath, join string) error {
+	return fmt.Errorf("-service is only supported on Windows")
+}
+
+func notifyServiceStop(ch chan<- os.Signal) {}
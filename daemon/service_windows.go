@@ -0,0 +1,248 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "tgres"
+
+// A service stop request is delivered to waitForSignal as a SIGTERM
+// via this channel. It is buffered so that a stop that arrives
+// before waitForSignal is listening is not lost.
+var serviceStopCh = make(chan os.Signal, 1)
+
+func notifyServiceStop(ch chan<- os.Signal) {
+	go func() { ch <- <-serviceStopCh }()
+}
+
+// IsService returns true if the process was started by the Windows
+// service manager.
+func IsService() bool {
+	is, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("IsService(): unable to determine whether running as a service: %v", err)
+		return false
+	}
+	return is
+}
+
+// eventLogWriter sends log output to the Windows event log. Lines
+// containing WARNING or ERROR are logged at that level, the rest as
+// informational.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(msg, "ERROR") || strings.Contains(msg, "FATAL"):
+		err = w.elog.Error(1, msg)
+	case strings.Contains(msg, "WARNING"):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+type tgresService struct {
+	cfgPath, join string
+}
+
+func (s *tgresService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	var exitCode uint32
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		cfg := Init(s.cfgPath, "", s.join)
+		if cfg == nil {
+			exitCode = 1
+			return
+		}
+		Finish(cfg)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			return false, exitCode
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Printf("Service stop requested.")
+				changes <- svc.Status{State: svc.StopPending}
+				serviceStopCh <- syscall.SIGTERM
+				<-done
+				return false, exitCode
+			default:
+				log.Printf("Service: unexpected control request #%d", c.Cmd)
+			}
+		}
+	}
+}
+
+// RunService runs Tgres under the Windows service manager, logging
+// to the event log (in addition to the log file, once it is
+// open). Relative paths in the config are relative to the directory
+// of the config file.
+func RunService(cfgPath, join string) error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	eventLog = &eventLogWriter{elog}
+	log.SetOutput(eventLog)
+
+	if err := os.Chdir(filepath.Dir(cfgPath)); err != nil {
+		log.Printf("ERROR: Unable to change directory to %q: %v", filepath.Dir(cfgPath), err)
+	}
+
+	if err := svc.Run(serviceName, &tgresService{cfgPath: cfgPath, join: join}); err != nil {
+		log.Printf("ERROR: Service failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ServiceCommand installs, removes, starts or stops the Tgres Windows
+// service. The service is installed to run this executable with the
+// given config (which must be an absolute path or is made so) and
+// join list.
+func ServiceCommand(cmd, cfgPath, join string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Unable to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	switch cmd {
+	case "install":
+		return installService(m, cfgPath, join)
+	case "remove":
+		return removeService(m)
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("Unable to open service %q: %v", serviceName, err)
+		}
+		defer s.Close()
+		return s.Start()
+	case "stop":
+		return stopService(m)
+	}
+	return fmt.Errorf("Unknown service command %q, must be one of install, remove, start or stop", cmd)
+}
+
+func installService(m *mgr.Mgr, cfgPath, join string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if cfgPath, err = filepath.Abs(cfgPath); err != nil {
+		return err
+	}
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %q already exists", serviceName)
+	}
+
+	args := []string{"-c", cfgPath}
+	if join != "" {
+		args = append(args, "-join", join)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Tgres",
+		Description: "Tgres time series server",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Unable to set up event log source: %v", err)
+	}
+	log.Printf("Installed service %q (%s %s).", serviceName, exe, strings.Join(args, " "))
+	return nil
+}
+
+func removeService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Service %q is not installed", serviceName)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	if err = eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("Unable to remove event log source: %v", err)
+	}
+	log.Printf("Removed service %q.", serviceName)
+	return nil
+}
+
+func stopService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Unable to open service %q: %v", serviceName, err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	// Stopping involves flushing data, which can take a while
+	timeout := time.Now().Add(2 * time.Minute)
+	for status.State != svc.Stopped {
+		if time.Now().After(timeout) {
+			return fmt.Errorf("Timed out waiting for service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
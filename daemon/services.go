@@ -17,10 +17,15 @@ package daemon
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,7 +33,11 @@ import (
 	"github.com/tgres/tgres/blaster"
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/graceful"
+	h "github.com/tgres/tgres/http"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/ingest"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/opentsdb"
 	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/statsd"
@@ -46,14 +55,28 @@ type serviceManager struct {
 	services serviceMap
 }
 
-func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *Config) *serviceManager {
+func newServiceManager(rcvr *receiver.Receiver, db serde.Fetcher, rcache dsl.NamedDSFetcher, cfg *Config, info *h.Info, configStatus func() *h.ClusterConfigStatus) *serviceManager {
+	activity, _ := db.(serde.SeriesActivityLister)
 	return &serviceManager{rcvr: rcvr,
 		services: serviceMap{
-			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec},
-			"gu":  &graphiteUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec},
-			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec},
-			"su":  &statsdUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec},
-			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec},
+			"gt": &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, proxyProtocol: cfg.GraphiteProxyProtocol,
+				readers:     newReaderPool(cfg.GraphiteReadBufferSize),
+				tlsCertFile: cfg.GraphiteTLSCertFile, tlsKeyFile: cfg.GraphiteTLSKeyFile, tlsClientCAFile: cfg.GraphiteTLSClientCAFile,
+				tlsReloadInterval: cfg.HttpTLSReloadInterval.Duration, authTokens: cfg.GraphiteAuthTokens,
+				decoder: cfg.decoder("graphite-text")},
+			"gx": &graphiteTextServiceManager{rcvr: rcvr, network: "unix", listenSpec: cfg.GraphiteUnixSocket,
+				readers: newReaderPool(cfg.GraphiteReadBufferSize), decoder: cfg.decoder("graphite-unix")},
+			"gu": &graphiteUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, readBufferSize: cfg.GraphiteUdpReadBufferSize,
+				decoder: cfg.decoder("graphite-udp")},
+			"gp": &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec, proxyProtocol: cfg.GraphiteProxyProtocol,
+				maxSize: cfg.GraphitePickleMaxSize},
+			"su": &statsdUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec},
+			"iu": &influxUdpServiceManager{rcvr: rcvr, listenSpec: cfg.InfluxUdpListenSpec, tmpl: cfg.influxTemplate},
+			"ot": &opentsdbTelnetServiceManager{rcvr: rcvr, listenSpec: cfg.OpenTSDBTelnetListenSpec, tags: cfg.opentsdbTags},
+			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, influxTmpl: cfg.influxTemplate, dsf: cfg, tsdbTags: cfg.opentsdbTags, info: info, activity: activity, configStatus: configStatus,
+				tlsCertFile: cfg.HttpTLSCertFile, tlsKeyFile: cfg.HttpTLSKeyFile,
+				tlsClientCAFile: cfg.HttpTLSClientCAFile, clientCerts: cfg.HttpClientCerts, tokens: cfg.HttpTokens,
+				tlsReloadInterval: cfg.HttpTLSReloadInterval.Duration},
 		},
 	}
 }
@@ -92,6 +115,39 @@ func (r *serviceManager) run(gracefulProtos string) error {
 	return nil
 }
 
+// provide sets the listeners (for the TCP services) and connections
+// (for UDP) to use instead of listening according to the config. The
+// keys are the same as those of the services map.
+func (r *serviceManager) provide(listeners map[string]net.Listener, conns map[string]net.Conn) error {
+	for name, ln := range listeners {
+		switch svc := r.services[name].(type) {
+		case *wwwServer:
+			svc.ln, svc.listenSpec = ln, ln.Addr().String()
+		case *graphitePickleServiceManager:
+			svc.ln, svc.listenSpec = ln, ln.Addr().String()
+		case *graphiteTextServiceManager:
+			svc.ln, svc.listenSpec = ln, ln.Addr().String()
+		case *opentsdbTelnetServiceManager:
+			svc.ln, svc.listenSpec = ln, ln.Addr().String()
+		default:
+			return fmt.Errorf("no TCP service named %q", name)
+		}
+	}
+	for name, conn := range conns {
+		switch svc := r.services[name].(type) {
+		case *graphiteUdpTextServiceManager:
+			svc.conn, svc.listenSpec = conn, conn.LocalAddr().String()
+		case *statsdUdpTextServiceManager:
+			svc.conn, svc.listenSpec = conn, conn.LocalAddr().String()
+		case *influxUdpServiceManager:
+			svc.conn, svc.listenSpec = conn, conn.LocalAddr().String()
+		default:
+			return fmt.Errorf("no UDP service named %q", name)
+		}
+	}
+	return nil
+}
+
 func (r *serviceManager) listenerFilesAndProtocols() ([]*os.File, string) {
 
 	files := []*os.File{}
@@ -118,7 +174,21 @@ type wwwServer struct {
 	rcache     dsl.NamedDSFetcher
 	blstr      *blaster.Blaster
 	listener   *graceful.Listener
+	ln         net.Listener // if provided, see serviceManager.provide()
 	listenSpec string
+
+	tlsCertFile, tlsKeyFile, tlsClientCAFile string
+	clientCerts                              []ConfigClientCertSpec
+	tokens                                   []ConfigTokenSpec
+	tlsReloadInterval                        time.Duration
+	tlsReloader                              *tlsReloader
+
+	influxTmpl   *influx.Template              // for /write
+	dsf          receiver.MatchingDSSpecFinder // for /api/dsspec
+	tsdbTags     opentsdb.TagPolicy            // for /api/put
+	info         *h.Info                       // for /api/info
+	activity     serde.SeriesActivityLister    // for /api/series/recent and /stale, if supported
+	configStatus func() *h.ClusterConfigStatus // for /api/cluster/config, nil when embedded
 }
 
 func (g *wwwServer) File() *os.File {
@@ -132,6 +202,9 @@ func (g *wwwServer) Stop() {
 	if g.listener != nil {
 		g.listener.Close()
 	}
+	if g.tlsReloader != nil {
+		g.tlsReloader.Stop()
+	}
 }
 
 func (g *wwwServer) Start(file *os.File) error {
@@ -140,7 +213,9 @@ func (g *wwwServer) Start(file *os.File) error {
 		err error
 	)
 
-	if g.listenSpec != "" {
+	if g.ln != nil {
+		gl = g.ln
+	} else if g.listenSpec != "" {
 		if file != nil {
 			gl, err = net.FileListener(file)
 		} else {
@@ -156,21 +231,66 @@ func (g *wwwServer) Start(file *os.File) error {
 		return fmt.Errorf("Error starting HTTP protocol: %v", err)
 	}
 
+	tlsCfg, certAuth, err := g.tlsConfig(g.clientCerts)
+	if err != nil {
+		gl.Close()
+		return fmt.Errorf("Error starting HTTP protocol: %v", err)
+	}
+	var auth h.Authenticator
+	if certAuth != nil {
+		auth = certAuth
+	}
+	if len(g.tokens) > 0 {
+		ta := h.NewTokenAuth(auth)
+		for _, tk := range g.tokens {
+			ta.AddToken(tk.Token, &h.Tenant{Name: tk.Tenant, Scopes: tk.Scopes, Global: tk.Global})
+		}
+		auth = ta
+	}
+
 	g.listener = graceful.NewListener(gl)
 
-	fmt.Printf("HTTP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	// The graceful listener must remain the TCP one, so that its
+	// file can be passed on during a graceful restart.
+	var l net.Listener = g.listener
+	if tlsCfg != nil {
+		g.tlsReloader = newTLSReloader(tlsCfg, func() (*tls.Config, error) {
+			// certAuth (the tenant mapping) comes from the
+			// config, not the files, and is kept as is.
+			cfg, _, err := g.tlsConfig(nil)
+			return cfg, err
+		}, g.tlsCertFile, g.tlsKeyFile, g.tlsClientCAFile)
+		go g.tlsReloader.watch(g.tlsReloadInterval)
+		l = tls.NewListener(g.listener, g.tlsReloader.Config())
+		fmt.Printf("HTTPS protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	} else {
+		fmt.Printf("HTTP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	}
 
-	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache)
+	go httpServer(g.listenSpec, l, g.rcvr, g.rcache, g.activity, g.configStatus, auth, g.influxTmpl, g.dsf, g.tsdbTags, g.info)
 
 	return nil
 }
 
+// tlsConfig is httpTLSConfig(), except that with tokens a client
+// certificate is optional, as a token will do.
+func (g *wwwServer) tlsConfig(clientCerts []ConfigClientCertSpec) (*tls.Config, *h.ClientCertAuth, error) {
+	cfg, auth, err := httpTLSConfig(g.tlsCertFile, g.tlsKeyFile, g.tlsClientCAFile, clientCerts)
+	if err == nil && cfg != nil && cfg.ClientCAs != nil && len(g.tokens) > 0 {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, auth, err
+}
+
 // ---
 
 type graphitePickleServiceManager struct {
-	rcvr       *receiver.Receiver
-	listener   *graceful.Listener
-	listenSpec string
+	rcvr          *receiver.Receiver
+	listener      *graceful.Listener
+	ln            net.Listener // if provided, see serviceManager.provide()
+	listenSpec    string
+	proxyProtocol bool // connections start with a PROXY protocol header
+	maxSize       int  // of a pickle frame, see graphite-pickle-max-size
 }
 
 func (g *graphitePickleServiceManager) File() *os.File {
@@ -192,7 +312,9 @@ func (g *graphitePickleServiceManager) Start(file *os.File) error {
 		err error
 	)
 
-	if g.listenSpec != "" {
+	if g.ln != nil {
+		gl = g.ln
+	} else if g.listenSpec != "" {
 		if file != nil {
 			gl, err = net.FileListener(file)
 		} else {
@@ -243,75 +365,143 @@ func (g *graphitePickleServiceManager) graphitePickleServer() error {
 		}
 		tempDelay = 0
 
-		go handleGraphitePickleProtocol(g.rcvr, conn, 10)
+		if g.proxyProtocol {
+			go handleProxied(conn, func(conn net.Conn) { handleGraphitePickleProtocol(g.rcvr, conn, 10, g.maxSize) })
+			continue
+		}
+		go handleGraphitePickleProtocol(g.rcvr, conn, 10, g.maxSize)
 	}
 }
 
-func handleGraphitePickleProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int) {
-
+func handleGraphitePickleProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout, maxSize int) {
 	defer conn.Close() // decrements graceful.TcpWg
+	readGraphitePickle(conn, timeout, maxSize, rcvr.QueueDataPoint)
+}
 
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+// The default maximum size of a graphite pickle frame, same as
+// carbon, see graphite-pickle-max-size.
+const defaultPickleMaxSize = 1 << 20
+
+// readGraphitePickle reads carbon pickle protocol frames (as sent by
+// carbon-relay or carbon-c-relay) until the connection is closed. A
+// frame is a 4 byte big-endian length followed by a pickled list of
+// (name, (timestamp, value)) tuples. A frame which cannot be
+// unpickled is skipped, as are malformed tuples. A frame larger than
+// maxSize closes the connection, there is no way of finding the next
+// one without reading it.
+func readGraphitePickle(conn net.Conn, timeout, maxSize int, queue func(serde.Ident, time.Time, float64)) {
+	if maxSize <= 0 {
+		maxSize = defaultPickleMaxSize
 	}
 
-	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
-
 	var (
-		name                 string
-		tstamp               int64
-		int_value            int64
-		value                float64
-		err                  error
-		item                 interface{}
-		items, itemSlice, dp []interface{}
+		hdr   [4]byte
+		frame []byte
 	)
+	for {
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
 
-	items, err = pickle.ListOrTuple(pickle.Unpickle(conn))
-	if err == nil {
-		for _, item = range items {
-			itemSlice, err = pickle.ListOrTuple(item, err)
-			if len(itemSlice) == 2 {
-				name, err = pickle.String(itemSlice[0], err)
-				dp, err = pickle.ListOrTuple(itemSlice[1], err)
-				if len(dp) == 2 {
-					tstamp, err = pickle.Int(dp[0], err)
-					if value, err = pickle.Float(dp[1], err); err != nil {
-						if _, ok := err.(pickle.WrongTypeError); ok {
-							if int_value, err = pickle.Int(dp[1], nil); err == nil {
-								value = float64(int_value)
-							}
-						}
-					}
-					rcvr.QueueDataPoint(serde.Ident{"name": name}, time.Unix(tstamp, 0), value)
-				} else {
-					err = fmt.Errorf("dp wrong length: %d", len(dp))
-					break
-				}
-			} else {
-				err = fmt.Errorf("item wrong length: %d", len(itemSlice))
-				break
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleGraphitePickleProtocol(): Error reading: %v", err)
 			}
+			return
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > uint32(maxSize) {
+			log.Printf("handleGraphitePickleProtocol(): frame of %d bytes from %v exceeds the maximum of %d, closing connection", size, conn.RemoteAddr(), maxSize)
+			return
+		}
+		if cap(frame) < int(size) {
+			frame = make([]byte, size)
+		}
+		frame = frame[:size]
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			log.Printf("handleGraphitePickleProtocol(): truncated frame from %v: %v", conn.RemoteAddr(), err)
+			return
 		}
-	}
 
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		bad, err := parseGraphitePickle(frame, queue)
+		if err != nil {
+			log.Printf("handleGraphitePickleProtocol(): bad frame from %v, skipping it: %v", conn.RemoteAddr(), err)
+		} else if bad > 0 {
+			log.Printf("handleGraphitePickleProtocol(): skipped %d malformed items in frame from %v", bad, conn.RemoteAddr())
+		}
 	}
+}
 
+// parseGraphitePickle unpickles a frame and queues its data points,
+// returning the number of malformed items, which are skipped.
+func parseGraphitePickle(frame []byte, queue func(serde.Ident, time.Time, float64)) (bad int, err error) {
+	items, err := pickle.ListOrTuple(pickle.Unpickle(bytes.NewReader(frame)))
 	if err != nil {
-		if !strings.Contains(err.Error(), "use of closed") {
-			log.Println("handleGraphitePickleProtocol(): Error reading: %v", err.Error())
+		return 0, err
+	}
+	for _, item := range items {
+		name, ts, value, err := parsePickleItem(item)
+		if err != nil {
+			bad++
+			continue
 		}
+		queue(serde.Ident{"name": name}, ts, value)
+	}
+	return bad, nil
+}
+
+// parsePickleItem parses a (name, (timestamp, value)) tuple.
+func parsePickleItem(item interface{}) (string, time.Time, float64, error) {
+	tuple, err := pickle.ListOrTuple(item, nil)
+	if err == nil && len(tuple) != 2 {
+		err = fmt.Errorf("item wrong length: %d", len(tuple))
+	}
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+	name, err := pickle.String(tuple[0], nil)
+	dp, err := pickle.ListOrTuple(tuple[1], err)
+	if err == nil && len(dp) != 2 {
+		err = fmt.Errorf("dp wrong length: %d", len(dp))
+	}
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+	tstamp, err := pickleNumber(dp[0])
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+	value, err := pickleNumber(dp[1])
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+
+	var t time.Time
+	if tstamp == -1 { // same as the text protocol
+		t = time.Now()
+	} else {
+		t = receiver.EpochTime(tstamp)
 	}
+	return misc.SanitizeName(name), t, value, nil
+}
+
+// pickleNumber returns a pickled int or float as a float64.
+func pickleNumber(v interface{}) (float64, error) {
+	if f, err := pickle.Float(v, nil); err == nil {
+		return f, nil
+	}
+	i, err := pickle.Int(v, nil)
+	return float64(i), err
 }
 
 // --
 
 type graphiteUdpTextServiceManager struct {
-	rcvr       *receiver.Receiver
-	conn       net.Conn
-	listenSpec string
+	rcvr           *receiver.Receiver
+	conn           net.Conn
+	listenSpec     string
+	readBufferSize int // socket receive buffer, 0 is the OS default
+	decoder        ingest.Decoder
 }
 
 func (g *graphiteUdpTextServiceManager) Stop() {
@@ -334,7 +524,9 @@ func (g *graphiteUdpTextServiceManager) Start(file *os.File) error {
 		udpAddr *net.UDPAddr
 	)
 
-	if g.listenSpec != "" {
+	if g.conn != nil {
+		// provided, see serviceManager.provide()
+	} else if g.listenSpec != "" {
 		if file != nil {
 			g.conn, err = net.FileConn(file)
 		} else {
@@ -350,21 +542,74 @@ func (g *graphiteUdpTextServiceManager) Start(file *os.File) error {
 	if err != nil {
 		return fmt.Errorf("Error starting Graphite UDP Text Protocol serviceManager: %v", err)
 	}
+	if uc, ok := g.conn.(*net.UDPConn); ok && g.readBufferSize > 0 {
+		if err := uc.SetReadBuffer(g.readBufferSize); err != nil {
+			log.Printf("Graphite UDP protocol: unable to set the read buffer size to %d: %v", g.readBufferSize, err)
+		}
+	}
 
 	fmt.Printf("Graphite UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	// for UDP timeout must be 0
-	go handleGraphiteTextProtocol(g.rcvr, g.conn, 0)
+	go handleGraphiteUdpProtocol(g.conn, g.decoder, g.rcvr.QueueDataPoint)
 
 	return nil
 }
 
+// handleGraphiteUdpProtocol reads graphite text protocol datagrams
+// (each one or more lines) until conn is closed. Lines split across
+// datagrams are joined, see udpReassembler.
+func handleGraphiteUdpProtocol(conn net.Conn, dec ingest.Decoder, queue func(serde.Ident, time.Time, float64)) {
+	defer conn.Close()
+
+	var (
+		buf = make([]byte, 64*1024) // the largest UDP datagram
+		ra  = newUdpReassembler(dec)
+	)
+	pc, _ := conn.(net.PacketConn)
+	for {
+		var (
+			n    int
+			addr net.Addr
+			err  error
+		)
+		if pc != nil {
+			n, addr, err = pc.ReadFrom(buf)
+		} else {
+			n, err = conn.Read(buf)
+			addr = conn.RemoteAddr()
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") && err != io.EOF {
+				log.Printf("handleGraphiteUdpProtocol(): Error reading: %v", err)
+			}
+			return
+		}
+		from := ""
+		if addr != nil {
+			from = addr.String()
+		}
+		if err := ingest.DecodeLines(dec, ra.datagram(from, buf[:n], time.Now()), queue); err != nil {
+			log.Printf("handleGraphiteUdpProtocol(): bad packet from %v: %v", from, err)
+		}
+	}
+}
+
 // ---
 
 type graphiteTextServiceManager struct {
-	rcvr       *receiver.Receiver
-	listener   *graceful.Listener
-	listenSpec string
+	rcvr          *receiver.Receiver
+	listener      *graceful.Listener
+	ln            net.Listener // if provided, see serviceManager.provide()
+	network       string       // "tcp" if blank, or "unix" (listenSpec is then the socket path)
+	listenSpec    string
+	proxyProtocol bool // connections start with a PROXY protocol header
+	readers       *readerPool
+	decoder       ingest.Decoder
+
+	tlsCertFile, tlsKeyFile, tlsClientCAFile string
+	tlsReloadInterval                        time.Duration
+	authTokens                               []string
+	auth                                     *graphiteAuth // nil if none of the above
 }
 
 func (g *graphiteTextServiceManager) File() *os.File {
@@ -378,6 +623,9 @@ func (g *graphiteTextServiceManager) Stop() {
 	if g.listener != nil {
 		g.listener.Close()
 	}
+	if g.auth != nil && g.auth.tls != nil {
+		g.auth.tls.Stop()
+	}
 }
 
 func (g *graphiteTextServiceManager) Start(file *os.File) error {
@@ -386,12 +634,23 @@ func (g *graphiteTextServiceManager) Start(file *os.File) error {
 		err error
 	)
 
-	if g.listenSpec != "" {
+	if g.ln != nil {
+		gl = g.ln
+	} else if g.network == "unix" && g.listenSpec != "" {
+		if file != nil {
+			gl, err = net.FileListener(file)
+		} else {
+			gl, err = listenUnix(g.listenSpec)
+		}
+	} else if g.listenSpec != "" {
 		if file != nil {
 			gl, err = net.FileListener(file)
 		} else {
 			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
 		}
+	} else if g.network == "unix" {
+		log.Printf("Not starting Graphite Unix socket protocol because graphite-unix-socket is blank")
+		return nil
 	} else {
 		log.Printf("Not starting Graphite Text protocol because graphite-test-listen-spec is blank")
 		return nil
@@ -401,9 +660,25 @@ func (g *graphiteTextServiceManager) Start(file *os.File) error {
 		return fmt.Errorf("Error starting Graphite Text Protocol serviceManager: %v", err)
 	}
 
+	if g.tlsCertFile != "" || len(g.authTokens) > 0 {
+		if g.auth, err = newGraphiteAuth(g.tlsCertFile, g.tlsKeyFile, g.tlsClientCAFile, g.authTokens); err != nil {
+			gl.Close()
+			return fmt.Errorf("Error starting Graphite Text Protocol serviceManager: %v", err)
+		}
+		if g.auth.tls != nil {
+			go g.auth.tls.watch(g.tlsReloadInterval)
+		}
+	}
+
 	g.listener = graceful.NewListener(gl)
 
-	fmt.Println("Graphite text protocol Listening on " + processListenSpec(g.listenSpec))
+	if g.network == "unix" {
+		fmt.Println("Graphite text protocol Listening on unix socket " + g.listenSpec)
+	} else if g.auth != nil && g.auth.tls != nil {
+		fmt.Println("Graphite text protocol (TLS) Listening on " + processListenSpec(g.listenSpec))
+	} else {
+		fmt.Println("Graphite text protocol Listening on " + processListenSpec(g.listenSpec))
+	}
 
 	go g.graphiteTextServer()
 
@@ -435,63 +710,132 @@ func (g *graphiteTextServiceManager) graphiteTextServer() error {
 		}
 		tempDelay = 0
 
-		go handleGraphiteTextProtocol(g.rcvr, conn, 10)
+		handle := func(conn net.Conn) { handleGraphiteTextProtocol(g.rcvr, conn, 10, g.readers, g.decoder) }
+		if g.auth != nil {
+			handle = g.auth.handler(handle)
+		}
+		if g.proxyProtocol {
+			go handleProxied(conn, handle)
+			continue
+		}
+		go handle(conn)
 	}
 }
 
-// Handles incoming requests for both TCP and UDP
-func handleGraphiteTextProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int) {
+// listenUnix listens on a unix socket at path, removing a stale one
+// left behind by a previous process. The socket is not removed on
+// close, so that it can be handed over on a graceful restart.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	return ln, nil
+}
 
+// Handles incoming requests for both TCP and unix sockets. Senders
+// may write thousands of lines at once, so the lines are parsed
+// straight out of a large (pooled) read buffer, see readerPool.
+func handleGraphiteTextProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int, rp *readerPool, dec ingest.Decoder) {
 	defer conn.Close() // decrements graceful.TcpWg
+	readGraphiteText(conn, timeout, rp, dec, rcvr.QueueDataPoint, rcvr.WaitReady)
+}
 
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	}
-
-	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
+// If wait is not nil, it is called before reading more from conn, it
+// blocks while the receiver is backed up (see Receiver.WaitReady).
+func readGraphiteText(conn net.Conn, timeout int, rp *readerPool, dec ingest.Decoder, queue func(serde.Ident, time.Time, float64), wait func()) {
+	br := rp.get(conn)
+	defer rp.put(br)
 
-	connbuf := bufio.NewScanner(conn)
+	for {
+		if wait != nil && br.Buffered() == 0 {
+			wait()
+		}
 
-	for connbuf.Scan() {
-		packetStr := connbuf.Text()
+		// Only extend the deadline when we are about to read from
+		// conn, not for every line in the buffer
+		if timeout != 0 && br.Buffered() == 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
 
-		if name, ts, v, err := parseGraphitePacket(packetStr); err != nil {
-			log.Printf("handleGraphiteTextProtocol(): bad backet: %v")
-		} else {
-			rcvr.QueueDataPoint(serde.Ident{"name": name}, ts, v)
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Printf("handleGraphiteTextProtocol(): line from %v longer than %d bytes, skipping it", conn.RemoteAddr(), br.Size())
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			line = nil
 		}
 
-		if timeout != 0 {
-			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if name, ts, v, tags, perr := dec.Decode(line); perr != nil {
+				log.Printf("handleGraphiteTextProtocol(): bad packet from %v: %v", conn.RemoteAddr(), perr)
+			} else {
+				queue(ingest.NewIdent(name, tags), ts, v)
+			}
 		}
-	}
 
-	if err := connbuf.Err(); err != nil {
-		if !strings.Contains(err.Error(), "use of closed") {
-			log.Println("handleGraphiteTextProtocol(): Error reading: %v", err)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleGraphiteTextProtocol(): Error reading: %v", err)
+			}
+			return
 		}
 	}
 }
 
-func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
+// parseGraphitePacket parses a "name value timestamp" line.
+func parseGraphitePacket(line []byte) (string, time.Time, float64, error) {
 
-	var (
-		name   string
-		tstamp int64
-		value  float64
-	)
+	name, rest := nextField(line)
+	vstr, rest := nextField(rest)
+	tstr, _ := nextField(rest)
+	if len(tstr) == 0 {
+		return "", time.Time{}, 0, fmt.Errorf("not enough fields in input: %q", line)
+	}
 
-	if n, err := fmt.Sscanf(packetStr, "%s %f %d", &name, &value, &tstamp); n != 3 || err != nil {
-		return "", time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, packetStr)
+	value, err := strconv.ParseFloat(string(vstr), 64)
+	if err != nil {
+		return "", time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, line)
 	}
 
 	var t time.Time
-	if tstamp == -1 { // https://github.com/graphite-project/carbon/issues/54
+	if string(tstr) == "-1" { // https://github.com/graphite-project/carbon/issues/54
 		t = time.Now()
-	} else {
-		t = time.Unix(tstamp, 0)
+	} else if t, err = receiver.ParseEpochTime(string(tstr)); err != nil {
+		return "", time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, line)
 	}
-	return misc.SanitizeName(name), t, value, nil
+	return misc.SanitizeName(string(name)), t, value, nil
+}
+
+// graphiteDecoder is the Graphite text protocol decoder, registered
+// as "graphite". It is the default for all the line oriented
+// listeners, see Config.processDecoders().
+var graphiteDecoder = ingest.DecoderFunc(func(line []byte) (string, time.Time, float64, map[string]string, error) {
+	name, ts, v, err := parseGraphitePacket(line)
+	return name, ts, v, nil, err
+})
+
+func init() {
+	ingest.RegisterDecoder("graphite", graphiteDecoder)
+}
+
+// nextField returns the first whitespace separated field of b and
+// the remainder of b after it.
+func nextField(b []byte) (field, rest []byte) {
+	i := 0
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	j := i
+	for j < len(b) && b[j] != ' ' && b[j] != '\t' {
+		j++
+	}
+	return b[i:j], b[j:]
 }
 
 // TODO isn't this identical to handleGraphiteTextProtocol?
@@ -553,7 +897,9 @@ func (g *statsdUdpTextServiceManager) Start(file *os.File) error {
 		udpAddr *net.UDPAddr
 	)
 
-	if g.listenSpec != "" {
+	if g.conn != nil {
+		// provided, see serviceManager.provide()
+	} else if g.listenSpec != "" {
 		if file != nil {
 			g.conn, err = net.FileConn(file)
 		} else {
@@ -577,3 +923,202 @@ func (g *statsdUdpTextServiceManager) Start(file *os.File) error {
 
 	return nil
 }
+
+// --
+
+type influxUdpServiceManager struct {
+	rcvr       *receiver.Receiver
+	conn       net.Conn
+	listenSpec string
+	tmpl       *influx.Template
+}
+
+func (g *influxUdpServiceManager) Stop() {
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+func (g *influxUdpServiceManager) File() *os.File {
+	if g.conn != nil {
+		f, _ := g.conn.(*net.UDPConn).File()
+		return f
+	}
+	return nil
+}
+
+func (g *influxUdpServiceManager) Start(file *os.File) error {
+	var (
+		err     error
+		udpAddr *net.UDPAddr
+	)
+
+	if g.conn != nil {
+		// provided, see serviceManager.provide()
+	} else if g.listenSpec != "" {
+		if file != nil {
+			g.conn, err = net.FileConn(file)
+		} else {
+			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(g.listenSpec))
+			if err == nil {
+				g.conn, err = net.ListenUDP("udp", udpAddr)
+			}
+		}
+	} else {
+		log.Printf("Not starting InfluxDB UDP protocol because influx-udp-listen-spec is blank.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error starting InfluxDB UDP Protocol serviceManager: %v", err)
+	}
+
+	fmt.Printf("InfluxDB UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+
+	go handleInfluxUdpProtocol(g.conn, g.tmpl, g.rcvr.QueueDataPoint)
+
+	return nil
+}
+
+// handleInfluxUdpProtocol reads InfluxDB line protocol datagrams (each
+// one or more lines, with nanosecond timestamps) until conn is
+// closed.
+func handleInfluxUdpProtocol(conn net.Conn, tmpl *influx.Template, queue func(serde.Ident, time.Time, float64)) {
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024) // the largest UDP datagram
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleInfluxUdpProtocol(): Error reading: %v", err)
+			}
+			return
+		}
+		if _, err := influx.Read(bytes.NewReader(buf[:n]), time.Nanosecond, tmpl, queue); err != nil {
+			log.Printf("handleInfluxUdpProtocol(): bad packet from %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// --
+
+type opentsdbTelnetServiceManager struct {
+	rcvr       *receiver.Receiver
+	listener   *graceful.Listener
+	ln         net.Listener // if provided, see serviceManager.provide()
+	listenSpec string
+	tags       opentsdb.TagPolicy
+}
+
+func (g *opentsdbTelnetServiceManager) File() *os.File {
+	if g.listener != nil {
+		return g.listener.File()
+	}
+	return nil
+}
+
+func (g *opentsdbTelnetServiceManager) Stop() {
+	if g.listener != nil {
+		g.listener.Close()
+	}
+}
+
+func (g *opentsdbTelnetServiceManager) Start(file *os.File) error {
+	var (
+		gl  net.Listener
+		err error
+	)
+
+	if g.ln != nil {
+		gl = g.ln
+	} else if g.listenSpec != "" {
+		if file != nil {
+			gl, err = net.FileListener(file)
+		} else {
+			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
+		}
+	} else {
+		log.Printf("Not starting OpenTSDB telnet protocol because opentsdb-telnet-listen-spec is blank.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting OpenTSDB telnet protocol serviceManager: %v", err)
+	}
+
+	g.listener = graceful.NewListener(gl)
+
+	fmt.Println("OpenTSDB telnet protocol Listening on " + processListenSpec(g.listenSpec))
+
+	go g.opentsdbTelnetServer()
+
+	return nil
+}
+
+func (g *opentsdbTelnetServiceManager) opentsdbTelnetServer() error {
+
+	var tempDelay time.Duration
+	for {
+		conn, err := g.listener.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("opentsdbTelnetServer(): Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go handleOpenTSDBTelnetProtocol(conn, 60, g.tags, g.rcvr.QueueDataPoint)
+	}
+}
+
+// handleOpenTSDBTelnetProtocol reads OpenTSDB telnet commands until
+// the connection is closed (or the exit command). Of the commands
+// only put and version are supported, the others are answered the
+// way OpenTSDB answers unknown commands. tcollector uses version to
+// check that the connection is alive, so it has to have a timeout
+// longer than its interval.
+func handleOpenTSDBTelnetProtocol(conn net.Conn, timeout int, tags opentsdb.TagPolicy, queue func(serde.Ident, time.Time, float64)) {
+	defer conn.Close() // decrements graceful.TcpWg
+
+	br := bufio.NewReader(conn)
+	for {
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+		line, err := br.ReadString('\n')
+		if cmd, args := nextField(bytes.TrimSpace([]byte(line))); len(cmd) > 0 {
+			switch string(cmd) {
+			case "put":
+				if p, perr := opentsdb.ParsePut(string(args)); perr != nil {
+					fmt.Fprintf(conn, "put: illegal argument: %v\n", perr)
+				} else {
+					queue(serde.Ident{"name": tags.Name(p)}, p.Time, p.Value)
+				}
+			case "version":
+				fmt.Fprintf(conn, "tgres (OpenTSDB telnet protocol)\n")
+			case "exit":
+				return
+			default:
+				fmt.Fprintf(conn, "unknown command: %s.  Try `help'.\n", cmd)
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleOpenTSDBTelnetProtocol(): Error reading: %v", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGHUP triggers a graceful restart, the rest a graceful exit.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+func isRestartSignal(s os.Signal) bool {
+	return s == syscall.SIGHUP
+}
+
+// waitForGracefulParent tells the parent to die, then waits for it
+// to signal us back that the data has been flushed.
+var waitForGracefulParent = func() {
+	parent := syscall.Getppid()
+	log.Printf("start(): Killing parent pid: %v", parent)
+	syscall.Kill(parent, syscall.SIGTERM)
+	log.Printf("start(): Waiting for the parent to signal that flush is complete...")
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	s := <-ch
+	log.Printf("start(): Received %v, proceeding to load the data", s)
+}
+
+// signalGracefulChild lets the child know the data is flushed.
+func signalGracefulChild(pid int) {
+	syscall.Kill(pid, syscall.SIGUSR1)
+}
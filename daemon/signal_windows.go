@@ -0,0 +1,39 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package daemon
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// There is no SIGHUP on Windows and therefore no graceful restart,
+// any of these signals causes a graceful exit.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+func isRestartSignal(s os.Signal) bool {
+	return false
+}
+
+var waitForGracefulParent = func() {
+	log.Printf("start(): WARNING: Graceful restart is not supported on Windows, proceeding.")
+}
+
+func signalGracefulChild(pid int) {}
@@ -0,0 +1,114 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloader re-reads the TLS configuration of a listener when any
+// of its files (certificate, key, client CA) change, so that a
+// renewed certificate (e.g. from Let's Encrypt) is used for new
+// connections without a restart. Existing connections are not
+// affected. If the new files cannot be loaded (e.g. the certificate
+// was replaced but not yet the key), the previous configuration
+// remains in use and the load is retried at the next check.
+//
+// Only these files are reloaded, not the config: the mapping of
+// client certificates to tenants ([[http-client-cert]]) and the auth
+// tokens stay as they were at startup, a change to them requires a
+// graceful restart. A certificate which is renewed keeps its
+// identity (CN or SAN), and so its tenant.
+type tlsReloader struct {
+	sync.RWMutex
+	cfg     *tls.Config
+	load    func() (*tls.Config, error)
+	files   []string
+	modTime time.Time // newest of files when last loaded
+	stop    chan struct{}
+}
+
+func newTLSReloader(cfg *tls.Config, load func() (*tls.Config, error), files ...string) *tlsReloader {
+	return &tlsReloader{cfg: cfg, load: load, files: files, modTime: newestModTime(files), stop: make(chan struct{})}
+}
+
+// newestModTime returns the modification time of the most recently
+// modified file, files which cannot be stat'ed are ignored.
+func newestModTime(files []string) time.Time {
+	var newest time.Time
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest
+}
+
+// Config returns the configuration to pass to tls.NewListener(),
+// every handshake uses the configuration current at the time.
+func (r *tlsReloader) Config() *tls.Config {
+	return &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.RLock()
+		defer r.RUnlock()
+		return r.cfg, nil
+	}}
+}
+
+// check reloads the configuration if any of the files changed. It
+// returns true if it was reloaded.
+func (r *tlsReloader) check() bool {
+	modTime := newestModTime(r.files)
+	if !modTime.After(r.modTime) {
+		return false
+	}
+	cfg, err := r.load()
+	if err != nil {
+		log.Printf("TLS: not reloading %v: %v", r.files, err)
+		return false
+	}
+	r.Lock()
+	r.cfg, r.modTime = cfg, modTime
+	r.Unlock()
+	log.Printf("TLS: reloaded %v.", r.files)
+	return true
+}
+
+func (r *tlsReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+			r.check()
+		}
+	}
+}
+
+func (r *tlsReloader) Stop() {
+	close(r.stop)
+}
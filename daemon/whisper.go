@@ -0,0 +1,150 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/whisper"
+)
+
+// Whisper imports or exports whisper (Graphite) files, it is what
+// "tgres whisper import|export" does:
+//
+//	tgres whisper import [-root dir] file.wsp ...
+//	tgres whisper export -name name [-cf WMEAN] [-xff 0.5] file.wsp
+//
+// Imported series are named after the path of the file relative to
+// root with dots for slashes, as Graphite does. A series which does
+// not exist is created with the retentions of the file, an existing
+// one must have the same RRAs. Importing can be done while Tgres is
+// running, but not into a series which is receiving data.
+func Whisper(cfgPath string, args []string, w io.Writer) error {
+	if len(args) == 0 || (args[0] != "import" && args[0] != "export") {
+		return fmt.Errorf("usage: whisper import|export ...")
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("whisper "+cmd, flag.ContinueOnError)
+	root := fs.String("root", "", "import: directory the series names are relative to")
+	name := fs.String("name", "", "export: name of the series")
+	cf := fs.String("cf", "WMEAN", "export: consolidation function of the RRAs to export")
+	xff := fs.Float64("xff", 0.5, "export: xFilesFactor of the file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rcvr, err := commandReceiver(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	if cmd == "import" {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("whisper import: no files")
+		}
+		var failed int
+		for _, path := range fs.Args() {
+			n, err := importWhisperFile(rcvr, whisperSeriesName(*root, path), path)
+			if err != nil {
+				fmt.Fprintf(w, "%s: %v\n", path, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(w, "%s: %d points\n", path, n)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d file(s) failed", failed, fs.NArg())
+		}
+		return nil
+	}
+
+	if *name == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: whisper export -name name [-cf WMEAN] [-xff 0.5] file.wsp")
+	}
+	c, err := rrd.ParseConsolidation(*cf)
+	if err != nil {
+		return err
+	}
+	ds, err := rcvr.ExportDataSource(serde.Ident{"name": *name})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := whisper.FromRRAs(f, ds.RRAs(), c, float32(*xff)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// commandReceiver returns a receiver which is not started, for
+// commands which only use the database through it.
+func commandReceiver(cfgPath string) (*receiver.Receiver, error) {
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config %q: %v", cfgPath, err)
+	}
+	if err := cfg.processDbConnectString(); err != nil {
+		return nil, fmt.Errorf("Error in config file %s: %v", cfgPath, err)
+	}
+	db, err := initDb(cfg.DbConnectString)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the DB: %v", err)
+	}
+	return receiver.New(db, receiver.MatchingDSSpecFinder(cfg)), nil
+}
+
+// whisperSeriesName returns the name of the series of a whisper file,
+// e.g. foo.bar for root/foo/bar.wsp.
+func whisperSeriesName(root, path string) string {
+	if root != "" {
+		if rel, err := filepath.Rel(root, path); err == nil {
+			path = rel
+		}
+	}
+	path = strings.TrimSuffix(filepath.ToSlash(path), ".wsp")
+	return misc.SanitizeName(strings.Replace(strings.TrimLeft(path, "./"), "/", ".", -1))
+}
+
+func importWhisperFile(rcvr *receiver.Receiver, name, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	hdr, history, err := whisper.History(f)
+	if err != nil {
+		return 0, err
+	}
+	bs := receiver.BackfillSeries{Ident: serde.Ident{"name": name}, Spec: hdr.DSSpec()}
+	for _, p := range history {
+		bs.Points = append(bs.Points, receiver.BackfillPoint{TimeStamp: p.TimeStamp, Value: p.Value})
+	}
+	return rcvr.Backfill([]receiver.BackfillSeries{bs})
+}
@@ -0,0 +1,37 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func std2DevNull() error {
+	f, e := os.OpenFile("/dev/null", os.O_RDWR, 0)
+	if e == nil {
+		fd := int(f.Fd())
+		syscall.Dup2(fd, int(os.Stdin.Fd()))
+		syscall.Dup2(fd, int(os.Stdout.Fd()))
+		syscall.Dup2(fd, int(os.Stderr.Fd()))
+		return nil
+	} else {
+		return e
+	}
+}
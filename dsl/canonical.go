@@ -0,0 +1,119 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Functions whose result does not depend on the order of the
+// arguments.
+var commutativeFuncs = map[string]bool{
+	"group":         true,
+	"averageSeries": true,
+	"avg":           true,
+	"maxSeries":     true,
+	"max":           true,
+	"minSeries":     true,
+	"min":           true,
+	"sumSeries":     true,
+	"sum":           true,
+	"rangeOfSeries": true,
+	"countSeries":   true,
+}
+
+// Canonical returns the canonical form of a DSL expression, so that
+// trivially different spellings of the same query can be recognized
+// as such, e.g. to be used as a cache key or in a log. Whitespace is
+// removed, series names are always quoted (with double quotes),
+// numbers are formatted consistently, chained calls are converted to
+// nested calls and the arguments of commutative functions (such as
+// sumSeries) are sorted. The result is itself a valid expression
+// which evaluates to the same series, but the series names (which
+// are derived from the query) may differ, so it is not a substitute
+// for the original query.
+func Canonical(src string) (string, error) {
+	escSrc := fixQuotes(escapeBadChars(src))
+	tr, err := parser.ParseExpr(escSrc)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing %q: %v", src, err)
+	}
+	return canonicalExpr(escSrc, tr)
+}
+
+func canonicalExpr(escSrc string, node ast.Expr) (string, error) {
+	switch tok := node.(type) {
+	case *ast.CallExpr:
+		var (
+			name string
+			args []string
+		)
+		switch fn := tok.Fun.(type) {
+		case *ast.Ident:
+			name = fn.Name
+		case *ast.SelectorExpr:
+			// Function chaining, e.g. group("abc").scale(3) is scale(group("abc"), 3)
+			if _, ok := fn.X.(*ast.CallExpr); !ok {
+				return "", fmt.Errorf("Function chaining requires a function call: %v", escSrc[fn.Pos()-1:fn.End()-1])
+			}
+			name = fn.Sel.Name
+			first, err := canonicalExpr(escSrc, fn.X)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, first)
+		default:
+			return "", fmt.Errorf("Unsupported function: %v", escSrc[tok.Fun.Pos()-1:tok.Fun.End()-1])
+		}
+		for _, arg := range tok.Args {
+			s, err := canonicalExpr(escSrc, arg)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, s)
+		}
+		if commutativeFuncs[name] {
+			sort.Strings(args)
+		}
+		return name + "(" + strings.Join(args, ",") + ")", nil
+	case *ast.SelectorExpr, *ast.Ident:
+		return `"` + unEscapeBadChars(escSrc[tok.Pos()-1:tok.End()-1]) + `"`, nil
+	case *ast.BasicLit:
+		if tok.Kind == token.INT || tok.Kind == token.FLOAT {
+			return canonicalNumber(tok.Value)
+		} else if tok.Kind == token.STRING {
+			return `"` + unEscapeBadChars(tok.Value[1:len(tok.Value)-1]) + `"`, nil
+		}
+		return "", fmt.Errorf("unsupported token type: %v", tok.Kind)
+	case *ast.UnaryExpr:
+		return canonicalNumber(escSrc[tok.Pos()-1 : tok.End()-1])
+	}
+	return "", fmt.Errorf("Unsupported expression: %v", escSrc[node.Pos()-1:node.End()-1])
+}
+
+func canonicalNumber(s string) (string, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
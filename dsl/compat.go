@@ -0,0 +1,71 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graphite-web versions whose behavior the DSL can mimic (per
+// request, see ParseDslCompat()), so that dashboards ported from them
+// render the same. CompatNative is the Tgres behavior. The
+// differences are: in 0.9 mostDeviant() takes n before seriesList
+// (1.0 swapped them); in all versions nonNegativeDerivative() of an
+// unchanged value is 0, not None; in 1.1 nonNegativeDerivative()
+// values above maxValue are None.
+const (
+	CompatNative     = ""
+	CompatGraphite09 = "0.9"
+	CompatGraphite10 = "1.0"
+	CompatGraphite11 = "1.1"
+)
+
+// compatArgs are the argument definitions of functions whose
+// signature is different in a graphite-web version.
+var compatArgs = map[string]map[string][]argDef{
+	CompatGraphite09: {
+		"mostDeviant": {
+			argDef{"n", argNumber, nil},
+			argDef{"seriesList", argSeries, nil}},
+	},
+}
+
+// ParseCompat parses a graphite-web version such as "0.9.15" or
+// "1.1" into one of the Compat constants. Only the major and minor
+// numbers matter.
+func ParseCompat(version string) (string, error) {
+	if version == "" {
+		return CompatNative, nil
+	}
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) >= 2 {
+		switch mm := parts[0] + "." + parts[1]; mm {
+		case CompatGraphite09, CompatGraphite10, CompatGraphite11:
+			return mm, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported graphite-web version %q, expecting one of %s, %s or %s", version, CompatGraphite09, CompatGraphite10, CompatGraphite11)
+}
+
+// compatFunc returns fn with its arguments as in the compat version,
+// if they differ.
+func compatFunc(compat, name string, fn dslFuncType) dslFuncType {
+	if args, ok := compatArgs[compat][name]; ok {
+		fn.args = args
+	}
+	return fn
+}
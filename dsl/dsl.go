@@ -55,6 +55,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
 )
 
 type dslCtx struct {
@@ -62,6 +65,8 @@ type dslCtx struct {
 	escSrc    string
 	from, to  time.Time
 	maxPoints int64
+	compat    string         // see ParseDslCompat()
+	nulls     rrd.NullPolicy // see ParseDslNulls()
 	ctxDSFetcher
 }
 
@@ -70,6 +75,39 @@ func ParseDsl(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64)
 	return newDslCtx(db, src, from, to, maxPoints).parse()
 }
 
+// ParseDslCompat is like ParseDsl, but the functions behave as they
+// do in the graphite-web version compat (see ParseCompat()).
+func ParseDslCompat(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, compat string) (SeriesMap, error) {
+	compat, err := ParseCompat(compat)
+	if err != nil {
+		return nil, err
+	}
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	dc.compat = compat
+	return dc.parse()
+}
+
+// ParseDslNulls is like ParseDslCompat, but unknown values are
+// treated according to nulls: as zeros (also when the points of a
+// series are consolidated into fewer) or left out of the result. The
+// nullPolicy() function does the same for a part of an expression.
+func ParseDslNulls(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, compat string, nulls rrd.NullPolicy) (SeriesMap, error) {
+	compat, err := ParseCompat(compat)
+	if err != nil {
+		return nil, err
+	}
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	dc.compat, dc.nulls = compat, nulls
+	sm, err := dc.parse()
+	if err != nil || nulls == rrd.NullAsNull {
+		return sm, err
+	}
+	for name, s := range sm {
+		sm[name] = &seriesNullPolicy{AliasSeries: s, nulls: nulls}
+	}
+	return sm, nil
+}
+
 func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) *dslCtx {
 	return &dslCtx{
 		src:          src,
@@ -124,6 +162,9 @@ func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesM
 		if err != nil {
 			return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
 		}
+		if np, ok := dps.(series.NullPolicer); ok {
+			np.SetNullPolicy(dc.nulls)
+		}
 		result[name] = &aliasSeries{Series: dps}
 	}
 	return result, nil
@@ -0,0 +1,168 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// Estimate is the approximate cost of evaluating a DSL expression.
+type Estimate struct {
+	Series     int   `json:"series"`     // distinct series the patterns resolve to
+	DataPoints int64 `json:"datapoints"` // data points fetched from them
+}
+
+// EstimateDsl resolves the series patterns in src and estimates how
+// many data points evaluating it would fetch, without fetching any
+// data or calling any functions. Only the first series (by name) of
+// every pattern is looked up to determine the resolution, the others
+// are assumed to be the same. Functions which alter the time range
+// (e.g. timeShift()) are not taken into account.
+func EstimateDsl(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) (*Estimate, error) {
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	tr, err := parser.ParseExpr(dc.escSrc)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %q: %v", dc.src, err)
+	}
+
+	var patterns []string
+	ast.Inspect(tr, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || err != nil {
+			return err == nil
+		}
+		var found []string
+		if found, err = dc.seriesPatterns(call); err == nil {
+			patterns = append(patterns, found...)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EstimateDsl(): %v", err)
+	}
+
+	result := &Estimate{}
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		idents := dc.identsFromPattern(pattern)
+		names := make([]string, 0, len(idents))
+		for name := range idents {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		result.Series += len(names)
+		points, err := dc.estimatePoints(idents[names[0]])
+		if err != nil {
+			return nil, fmt.Errorf("EstimateDsl(): %v", err)
+		}
+		result.DataPoints += points * int64(len(names))
+	}
+	return result, nil
+}
+
+// seriesPatterns returns the arguments of a function call which are
+// series patterns (as opposed to e.g. an alias or a nested call).
+func (dc *dslCtx) seriesPatterns(call *ast.CallExpr) ([]string, error) {
+	var name string
+	offset := 0
+	switch fn := call.Fun.(type) {
+	case *ast.SelectorExpr:
+		name = fn.Sel.Name
+		offset = 1 // chained, the first argument is the preceding call
+	case *ast.Ident:
+		name = fn.Name
+	}
+
+	isSeries := func(int) bool { return false }
+	if fn, ok := preprocessArgFuncs[name]; ok {
+		isSeries = func(n int) bool {
+			if n >= len(fn.args) {
+				if !fn.varArg || len(fn.args) == 0 {
+					return false
+				}
+				n = len(fn.args) - 1
+			}
+			tp := fn.args[n].tp
+			return tp == argSeries || tp == argNumberOrSeries
+		}
+	} else if _, ok := dslCtxFuncs[name]; ok {
+		isSeries = func(n int) bool { return n == 0 }
+	} else {
+		return nil, fmt.Errorf("No such function: %v", name)
+	}
+
+	var result []string
+	for n, arg := range call.Args {
+		if !isSeries(n + offset) {
+			continue
+		}
+		var literal string
+		switch tok := arg.(type) {
+		case *ast.SelectorExpr, *ast.Ident:
+			literal = unEscapeBadChars(dc.escSrc[tok.Pos()-1 : tok.End()-1])
+		case *ast.BasicLit:
+			if tok.Kind != token.STRING {
+				continue
+			}
+			literal = unEscapeBadChars(tok.Value[1 : len(tok.Value)-1])
+		default:
+			continue
+		}
+		if _, err := strconv.ParseFloat(literal, 64); err == nil || literal == "None" || literal == "NaN" {
+			continue // a number, see argNumberOrSeries
+		}
+		result = append(result, literal)
+	}
+	return result, nil
+}
+
+// estimatePoints returns how many points fetching the series would
+// return, using the same RRA as FetchSeries().
+func (dc *dslCtx) estimatePoints(ident serde.Ident) (int64, error) {
+	ds, err := dc.FetchOrCreateDataSource(ident, nil)
+	if err != nil {
+		return 0, err
+	}
+	if ds == nil {
+		return 0, nil
+	}
+	rra := ds.BestRRA(dc.from, dc.to, dc.maxPoints)
+	if rra == nil || rra.Step() <= 0 {
+		return 0, nil
+	}
+	points := int64(dc.to.Sub(dc.from) / rra.Step())
+	if size := rra.Size(); points > size {
+		points = size
+	}
+	if dc.maxPoints > 0 && points > dc.maxPoints {
+		points = dc.maxPoints
+	}
+	return points, nil
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/series"
 )
 
@@ -123,6 +124,9 @@ var preprocessArgFuncs = funcMap{
 	"transformNull": dslFuncType{dslTransformNull, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"default", argNumber, 0.0}}},
+	"nullPolicy": dslFuncType{dslNullPolicy, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"policy", argString, nil}}},
 	"diffSeries": dslFuncType{dslDiffSeries, true, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
 	"divideSeries": dslFuncType{dslDivideSeries, true, []argDef{
@@ -197,6 +201,9 @@ var preprocessArgFuncs = funcMap{
 		argDef{"replace", argString, nil}}},
 	"changed": dslFuncType{dslChanged, false, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
+	"consolidateBy": dslFuncType{dslConsolidateBy, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"consolidationFunc", argString, nil}}},
 	"constantLine": dslFuncType{dslConstantLine, false, []argDef{
 		argDef{"value", argNumber, nil}}},
 	"countSeries": dslFuncType{dslCountSeries, true, []argDef{
@@ -294,11 +301,12 @@ var preprocessArgFuncs = funcMap{
 	// ++ aliasSub
 	// ?? cactiStyle // TODO should be easy to do?
 	// ++ changed
-	// ?? consolidateBy // doesn't apply to us, it's always avg?
+	// ++ consolidateBy // selects the RRA, see series.Consolidator
 	// ++ constantLine
 	// ++ countSeries
 	// -- cumulative // == consolidateBy
-	// ?? groupByNode // similar to alias by metric
+	// ++ groupByNode
+	// ++ groupByNodes
 	// ?? keepLastValue // don't really understand this one
 	// ?? randomWalk // later?
 	// ?? sortByMaxima
@@ -465,6 +473,13 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 }
 
 func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap, error) {
+	start := time.Now()
+	series, err := callFunction(dc, name, args)
+	recordFuncCall(name, time.Now().Sub(start), err)
+	return series, err
+}
+
+func callFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap, error) {
 
 	argFunc, ok := preprocessArgFuncs[name]
 	if !ok {
@@ -479,15 +494,17 @@ func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap,
 			}
 		}
 	} else {
+		argFunc = compatFunc(dc.compat, name, argFunc)
 		argMap, argSlice, err := processArgs(dc, &argFunc, args)
 		if err != nil {
 			return nil, fmt.Errorf("seriesFromFunction(): %v() reports an error: %v", name, err)
 		}
-		argMap["_legend_"] = fmt.Sprintf("%s(%s)", name, argsAsString(args)) // only a suggestion
+		argMap["_legend_"] = fmt.Sprintf("%s(%s)", name, argsAsString(args, commutativeFuncs[name])) // only a suggestion
 		argMap["_args_"] = argSlice
 		argMap["_from_"] = dc.from
 		argMap["_to_"] = dc.to
 		argMap["_maxPoints_"] = dc.maxPoints
+		argMap["_compat_"] = dc.compat
 		if series, err := argFunc.call(argMap); err == nil {
 			return series, nil
 		} else {
@@ -517,11 +534,22 @@ func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap,
 // 	return result, nil
 // }
 
-func argsAsString(args []interface{}) string {
+// argsAsString formats args for a legend, a SeriesMap as the names of
+// its series. They are sorted for a commutative function, so that all
+// the spellings with the same Canonical() form name their series the
+// same.
+func argsAsString(args []interface{}, commutative bool) string {
 	sargs := make([]string, 0, len(args))
 	for _, arg := range args {
+		if sm, ok := arg.(SeriesMap); ok {
+			sargs = append(sargs, strings.Join(sm.SortedKeys(), ","))
+			continue
+		}
 		sargs = append(sargs, fmt.Sprintf("%v", arg))
 	}
+	if commutative {
+		sort.Strings(sargs)
+	}
 	return strings.Join(sargs, ",")
 }
 
@@ -680,7 +708,7 @@ func dslAverageSeriesWithWildcards(dc *dslCtx, args []interface{}) (SeriesMap, e
 	}
 	result.Align()
 
-	name = fmt.Sprintf("averageSeriesWithWildcards(%s)", argsAsString(args))
+	name = fmt.Sprintf("averageSeriesWithWildcards(%s)", argsAsString(args, false))
 	return SeriesMap{name: &seriesAverageSeries{result}}, nil
 }
 
@@ -719,7 +747,7 @@ func dslSumSeriesWithWildcards(dc *dslCtx, args []interface{}) (SeriesMap, error
 	}
 	result.Align()
 
-	name = fmt.Sprintf("sumSeriesWithWildcards(%s)", argsAsString(args))
+	name = fmt.Sprintf("sumSeriesWithWildcards(%s)", argsAsString(args, false))
 	return SeriesMap{name: &seriesSumSeries{result}}, nil
 }
 
@@ -1081,12 +1109,17 @@ type seriesNonNegativeDerivative struct {
 	AliasSeries
 	last     float64
 	maxValue float64
+	zero     bool // an unchanged value is 0 (graphite-web)
+	capped   bool // values above maxValue are NaN (graphite-web 1.1)
 }
 
 func (f *seriesNonNegativeDerivative) CurrentValue() float64 {
 	current := f.AliasSeries.CurrentValue()
+	if f.capped && !math.IsNaN(f.maxValue) && current > f.maxValue {
+		return math.NaN()
+	}
 	diff := current - f.last
-	if diff > 0 {
+	if diff > 0 || (f.zero && diff == 0) {
 		return diff
 	} else if !math.IsNaN(f.maxValue) && f.maxValue > current {
 		return (f.maxValue - f.last) + current + 1
@@ -1102,9 +1135,11 @@ func (f *seriesNonNegativeDerivative) Next() bool {
 func dslNonNegativeDerivative(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	maxValue := args["maxValue"].(float64)
+	compat := args["_compat_"].(string)
 	for name, s := range series {
 		s.Alias(fmt.Sprintf("nonNegativeDerivative(%s)", name))
-		series[name] = &seriesNonNegativeDerivative{s, math.NaN(), maxValue}
+		series[name] = &seriesNonNegativeDerivative{AliasSeries: s, last: math.NaN(), maxValue: maxValue,
+			zero: compat != CompatNative, capped: compat == CompatGraphite11}
 	}
 	return series, nil
 }
@@ -1231,6 +1266,54 @@ func dslTransformNull(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// nullPolicy()
+
+type seriesNullPolicy struct {
+	AliasSeries
+	nulls rrd.NullPolicy
+	value float64
+}
+
+func (f *seriesNullPolicy) Next() bool {
+	for f.AliasSeries.Next() {
+		if v, ok := f.nulls.Apply(f.AliasSeries.CurrentValue()); ok {
+			f.value = v
+			return true
+		}
+	}
+	return false
+}
+
+func (f *seriesNullPolicy) CurrentValue() float64 {
+	return f.value
+}
+
+// Unknown values are returned as nulls (policy "null"), zeros
+// ("zero") or left out ("drop"), see rrd.NullPolicy. Unlike
+// transformNull(), with "zero" a series read from an RRA also counts
+// the unknown slots as zeros when its points are consolidated, if
+// this function is applied to it directly. Since "drop" leaves gaps
+// in the timeline, it is best applied last.
+func dslNullPolicy(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	policy := args["policy"].(string)
+
+	nulls, err := rrd.ParseNullPolicy(policy)
+	if err != nil {
+		return nil, fmt.Errorf("nullPolicy(): %v", err)
+	}
+	for name, s := range sm {
+		if as, ok := s.(*aliasSeries); ok {
+			if np, ok := as.Series.(series.NullPolicer); ok {
+				np.SetNullPolicy(nulls)
+			}
+		}
+		s.Alias(fmt.Sprintf("nullPolicy(%v,%q)", name, policy))
+		sm[name] = &seriesNullPolicy{AliasSeries: s, nulls: nulls}
+	}
+	return sm, nil
+}
+
 // nPercentile()
 
 type seriesNPercentile struct {
@@ -1914,6 +1997,39 @@ func dslChanged(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// consolidateBy()
+
+// Unlike in Graphite, where it determines how points are combined
+// when there are too many, here it selects the RRA with the given
+// consolidation function (and the same step), which must exist. The
+// points are also combined by it.
+func dslConsolidateBy(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	name := args["consolidationFunc"].(string)
+
+	var (
+		cf  = rrd.WMEAN
+		err error
+	)
+	if lname := strings.ToLower(name); lname != "average" && lname != "avg" {
+		if cf, err = rrd.ParseConsolidation(name); err != nil {
+			return nil, fmt.Errorf("consolidateBy(): %v", err)
+		}
+	}
+
+	for sname, s := range sm {
+		var c series.Consolidator
+		if as, ok := s.(*aliasSeries); ok {
+			c, _ = as.Series.(series.Consolidator)
+		}
+		if c == nil || !c.ConsolidateBy(cf) {
+			return nil, fmt.Errorf("consolidateBy(): %s has no %v RRA of the same step", sname, cf)
+		}
+		s.Alias(fmt.Sprintf("consolidateBy(%s,%q)", sname, name))
+	}
+	return sm, nil
+}
+
 // constantLine()
 
 type constantLine struct {
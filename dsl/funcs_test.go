@@ -9,6 +9,7 @@ import (
 
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
 )
 
 // TODO: These are happy path tests, need more edge-case testing
@@ -129,6 +130,77 @@ func Test_dsl_averageSeriesWithWildcards(t *testing.T) {
 	}
 }
 
+// groupByNode
+// groupByNodes
+func Test_dsl_groupByNode(t *testing.T) {
+	td := setupTestData()
+
+	rspec := rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     time.Minute,
+		Span:     time.Hour,
+		Latest:   td.when,
+	}
+	size := rspec.Span.Nanoseconds() / rspec.Step.Nanoseconds()
+
+	for name, v := range map[string]float64{"web.host1.cpu": 10, "web.host2.cpu": 20, "db.host3.cpu": 40} {
+		spec := &rrd.DSSpec{
+			Step: time.Second,
+			RRAs: []rrd.RRASpec{rspec},
+		}
+		spec.RRAs[0].DPs = make(map[int64]float64)
+		for i := int64(0); i < size; i++ {
+			spec.RRAs[0].DPs[i] = v
+		}
+		if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, c := range []struct {
+		src    string
+		expect map[string]float64
+	}{
+		{`groupByNode("*.*.cpu", 0)`, map[string]float64{"web": 15, "db": 40}},
+		{`groupByNode("*.*.cpu", 0, "sum")`, map[string]float64{"web": 30, "db": 40}},
+		{`groupByNode("*.*.cpu", -1, "maxSeries")`, map[string]float64{"cpu": 40}},
+		{`groupByNode("*.*.cpu", 0, "sum|scale(2)")`, map[string]float64{"web": 60, "db": 80}},
+		{`group("*.*.cpu").groupByNodes("count", 0, 2)`, map[string]float64{"web.cpu": 2, "db.cpu": 1}},
+	} {
+		sm, err := ParseDsl(td.rcache, c.src, td.from, td.to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if len(sm) != len(c.expect) {
+			t.Errorf("%s: expected %d series, got %d", c.src, len(c.expect), len(sm))
+		}
+		for key, v := range c.expect {
+			s := sm[key]
+			if s == nil {
+				t.Errorf("%s: missing series %q", c.src, key)
+				continue
+			}
+			if s.Alias() != key {
+				t.Errorf("%s: expected alias %q, got %q", c.src, key, s.Alias())
+			}
+			if ok, unexpected := checkEveryValueIs(SeriesMap{key: s}, v); !ok {
+				t.Errorf("%s: %q expected %v, got %v", c.src, key, v, unexpected)
+			}
+		}
+	}
+
+	for _, src := range []string{
+		`groupByNode("*.*.cpu", 5, "sum")`,
+		`groupByNode("*.*.cpu", 0, "bogus")`,
+		`groupByNode("*.*.cpu", 0, "group")`,
+	} {
+		if _, err := ParseDsl(td.rcache, src, td.from, td.to, 100); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
 // group
 func Test_dsl_group(t *testing.T) {
 	td := setupTestData()
@@ -382,6 +454,48 @@ func Test_dsl_timeshift(t *testing.T) {
 	}
 }
 
+// consolidateBy
+type fakeConsolidator struct {
+	series.Series
+	cf rrd.Consolidation
+}
+
+func (f *fakeConsolidator) ConsolidateBy(cf rrd.Consolidation) bool {
+	if cf == rrd.STDDEV {
+		return false
+	}
+	f.cf = cf
+	return true
+}
+
+func Test_dsl_consolidateBy(t *testing.T) {
+	fc := &fakeConsolidator{Series: series.NewRRASeries(rrd.NewRoundRobinArchive(rrd.RRASpec{Step: time.Minute, Span: time.Hour}))}
+	args := map[string]interface{}{
+		"seriesList":        SeriesMap{"foo": &aliasSeries{Series: fc}},
+		"consolidationFunc": "max",
+	}
+	sm, err := dslConsolidateBy(args)
+	if err != nil || fc.cf != rrd.MAX || sm["foo"].Alias() != `consolidateBy(foo,"max")` {
+		t.Errorf("consolidateBy: %v %v %v", fc.cf, sm["foo"].Alias(), err)
+	}
+	args["consolidationFunc"] = "average"
+	if _, err := dslConsolidateBy(args); err != nil || fc.cf != rrd.WMEAN {
+		t.Errorf("consolidateBy: average: %v %v", fc.cf, err)
+	}
+	for _, name := range []string{"stddev", "bogus"} {
+		args["consolidationFunc"] = name
+		if _, err := dslConsolidateBy(args); err == nil {
+			t.Errorf("consolidateBy: expected an error for %q", name)
+		}
+	}
+
+	// a series not from an RRA
+	td := setupTestData()
+	if _, err := ParseDsl(nil, `consolidateBy(constantLine(10), "max")`, td.from, td.to, 100); err == nil {
+		t.Errorf("consolidateBy: expected an error for constantLine")
+	}
+}
+
 // transformNull
 func Test_dsl_transformNull(t *testing.T) {
 	td := setupTestData()
@@ -429,6 +543,61 @@ func Test_dsl_transformNull(t *testing.T) {
 	}
 }
 
+// nullPolicy
+func Test_dsl_nullPolicy(t *testing.T) {
+	td := setupTestData()
+
+	rspec := rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     time.Minute,
+		Span:     10 * time.Minute,
+		Latest:   td.when,
+		DPs:      make(map[int64]float64),
+	}
+	for i := int64(0); i < 10; i++ {
+		if i < 5 {
+			rspec.DPs[i] = 10
+		} else {
+			rspec.DPs[i] = math.NaN()
+		}
+	}
+	if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.nullPolicy"}, &rrd.DSSpec{Step: time.Second, RRAs: []rrd.RRASpec{rspec}}); err != nil {
+		t.Error(err)
+	}
+
+	count := func(sm SeriesMap) (known, zeros, nans int) {
+		for _, s := range sm {
+			for s.Next() {
+				switch v := s.CurrentValue(); {
+				case math.IsNaN(v):
+					nans++
+				case v == 0:
+					zeros++
+				default:
+					known++
+				}
+			}
+		}
+		return
+	}
+
+	sm, err := ParseDsl(td.rcache, `nullPolicy("foo.bar.nullPolicy", "zero")`, td.from, td.to, 60)
+	if known, zeros, nans := count(sm); err != nil || known != 5 || zeros != 5 || nans != 0 {
+		t.Errorf("nullPolicy zero: %v known, %v zeros, %v NaNs, %v", known, zeros, nans, err)
+	}
+	sm, err = ParseDsl(td.rcache, `nullPolicy("foo.bar.nullPolicy", "drop")`, td.from, td.to, 60)
+	if known, zeros, nans := count(sm); err != nil || known != 5 || zeros != 0 || nans != 0 {
+		t.Errorf("nullPolicy drop: %v known, %v zeros, %v NaNs, %v", known, zeros, nans, err)
+	}
+	sm, err = ParseDslNulls(td.rcache, `group("foo.bar.nullPolicy")`, td.from, td.to, 60, CompatNative, rrd.NullDrop)
+	if known, _, nans := count(sm); err != nil || known != 5 || nans != 0 {
+		t.Errorf("ParseDslNulls drop: %v known, %v NaNs, %v", known, nans, err)
+	}
+	if _, err := ParseDsl(td.rcache, `nullPolicy("foo.bar.nullPolicy", "bogus")`, td.from, td.to, 60); err == nil {
+		t.Errorf("nullPolicy: expected an error for a bogus policy")
+	}
+}
+
 // asPercent
 // (this also tests proper slice series restart)
 func Test_dsl_asPercent(t *testing.T) {
@@ -866,3 +1035,213 @@ func Test_dsl_countSeries(t *testing.T) {
 		t.Errorf("Unexpected value: %v", unexpected)
 	}
 }
+
+func Test_Canonical(t *testing.T) {
+	for _, c := range []struct{ a, b string }{
+		{`sumSeries(foo.bar, "baz.*")`, `sumSeries( 'baz.*',"foo.bar" )`},
+		{`group("foo.*").scale(2)`, `scale(group('foo.*'), 2.0)`},
+		{`offset(foo.bar, 1.50)`, `offset( "foo.bar",1.5 )`},
+	} {
+		ca, err := Canonical(c.a)
+		if err != nil {
+			t.Errorf("Canonical(%q): %v", c.a, err)
+			continue
+		}
+		cb, err := Canonical(c.b)
+		if err != nil {
+			t.Errorf("Canonical(%q): %v", c.b, err)
+			continue
+		}
+		if ca != cb {
+			t.Errorf("Canonical: %q and %q should be the same, got %q and %q", c.a, c.b, ca, cb)
+		}
+		if cc, err := Canonical(ca); err != nil || cc != ca {
+			t.Errorf("Canonical: result %q is not canonical: %q %v", ca, cc, err)
+		}
+	}
+	if c, _ := Canonical(`sumSeries( 'baz.*',foo.bar )`); c != `sumSeries("baz.*","foo.bar")` {
+		t.Errorf("Canonical: unexpected result: %q", c)
+	}
+	// The series are named the same, whatever the spelling.
+	td := setupTestData()
+	var names []string
+	for _, src := range []string{"sumSeries(constantLine(2), constantLine(1))", "sumSeries(constantLine(1),constantLine(2))"} {
+		sm, err := ParseDsl(nil, src, td.from, td.to, 100)
+		if err != nil || len(sm) != 1 {
+			t.Fatalf("ParseDsl(%q): %v %v", src, err, sm)
+		}
+		names = append(names, sm.SortedKeys()[0])
+	}
+	if names[0] != names[1] || names[0] != "sumSeries(constantLine(1),constantLine(2))" {
+		t.Errorf("Canonical: spellings named differently: %q", names)
+	}
+	ca, _ := Canonical(`diffSeries(a.b, c.d)`)
+	cb, _ := Canonical(`diffSeries(c.d, a.b)`)
+	if ca == cb {
+		t.Errorf("Canonical: diffSeries is not commutative")
+	}
+	if _, err := Canonical(`scale(foo.bar`); err == nil {
+		t.Errorf("Canonical: expected a parse error")
+	}
+}
+
+func Test_ParseTimeSpec(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tz database: %v", err)
+	}
+	// Monday after the DST change (Sunday, March 12, 2017)
+	now := time.Date(2017, 3, 13, 15, 30, 0, 0, loc)
+	for _, c := range []struct {
+		spec string
+		exp  time.Time
+	}{
+		{"now", now},
+		{"now-1h", now.Add(-time.Hour)},
+		{"now/d", time.Date(2017, 3, 13, 0, 0, 0, 0, loc)},
+		{"now-1d", time.Date(2017, 3, 12, 15, 30, 0, 0, loc)}, // 23 hours ago
+		{"now-1bd/d", time.Date(2017, 3, 10, 0, 0, 0, 0, loc)},
+		{"now+5bd/d", time.Date(2017, 3, 20, 0, 0, 0, 0, loc)},
+		{"now-1d/w", time.Date(2017, 3, 6, 0, 0, 0, 0, loc)},
+		{"now/w", time.Date(2017, 3, 13, 0, 0, 0, 0, loc)},
+		{"now-1mon/mon", time.Date(2017, 2, 1, 0, 0, 0, 0, loc)},
+		{"now/mon-1d", time.Date(2017, 2, 28, 0, 0, 0, 0, loc)},
+		{"now/y", time.Date(2017, 1, 1, 0, 0, 0, 0, loc)},
+		{"now-90s/min", time.Date(2017, 3, 13, 15, 28, 0, 0, loc)},
+		{"now-1500ms/s", time.Date(2017, 3, 13, 15, 29, 58, 0, loc)},
+	} {
+		got, err := ParseTimeSpec(c.spec, now)
+		if err != nil {
+			t.Errorf("ParseTimeSpec(%q): %v", c.spec, err)
+		} else if !got.Equal(c.exp) {
+			t.Errorf("ParseTimeSpec(%q): expected %v, got %v", c.spec, c.exp, got)
+		}
+	}
+	for _, bad := range []string{"yesterday", "now-", "now-d", "now/", "now/1d", "now/q", "now*2d", "now-1q"} {
+		if _, err := ParseTimeSpec(bad, now); err == nil {
+			t.Errorf("ParseTimeSpec(%q): expected an error", bad)
+		}
+	}
+}
+
+func Test_dsl_compat(t *testing.T) {
+	td := setupTestData()
+
+	for version, expect := range map[string]string{"": "", "0.9.15": "0.9", "1.0": "1.0", "1.1.3": "1.1"} {
+		if compat, err := ParseCompat(version); err != nil || compat != expect {
+			t.Errorf("ParseCompat(%q): expected %q, got %q (%v)", version, expect, compat, err)
+		}
+	}
+	for _, version := range []string{"2.0", "1", "foo"} {
+		if _, err := ParseCompat(version); err == nil {
+			t.Errorf("ParseCompat(%q): expected an error", version)
+		}
+	}
+
+	// mostDeviant(n, seriesList) in 0.9
+	expr := "mostDeviant(1, group(constantLine(10), constantLine(20), sinusoid()))"
+	if _, err := ParseDsl(nil, expr, td.from, td.to, 10); err == nil {
+		t.Errorf("mostDeviant: expected an error without compat")
+	}
+	sm, err := ParseDslCompat(nil, expr, td.from, td.to, 10, "0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm) != 1 {
+		t.Errorf("mostDeviant: expected 1 series, got %d", len(sm))
+	}
+
+	// nonNegativeDerivative of an unchanged value
+	last := func(sm SeriesMap) float64 {
+		v := math.NaN()
+		for _, s := range sm {
+			for s.Next() {
+				v = s.CurrentValue()
+			}
+		}
+		return v
+	}
+	for _, c := range []struct {
+		compat, expr string
+		nan          bool
+	}{
+		{"", "nonNegativeDerivative(constantLine(10))", true},
+		{"1.0", "nonNegativeDerivative(constantLine(10))", false},
+		{"1.0", "nonNegativeDerivative(constantLine(10), 5)", false},
+		{"1.1", "nonNegativeDerivative(constantLine(10), 5)", true},
+	} {
+		sm, err := ParseDslCompat(nil, c.expr, td.from, td.to, 10, c.compat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := last(sm); math.IsNaN(v) != c.nan || (!c.nan && v != 0) {
+			t.Errorf("%s (compat %q): unexpected value %v", c.expr, c.compat, v)
+		}
+	}
+}
+
+func Test_dsl_FuncStats(t *testing.T) {
+	td := setupTestData()
+	find := func(name string) FuncStat {
+		for _, st := range FuncStats() {
+			if st.Name == name {
+				return st
+			}
+		}
+		return FuncStat{}
+	}
+
+	before := find("constantLine")
+	if _, err := ParseDsl(nil, "sumSeries(constantLine(1), constantLine(2))", td.from, td.to, 100); err != nil {
+		t.Fatal(err)
+	}
+	after := find("constantLine")
+	if after.Calls-before.Calls != 2 || after.Unknown {
+		t.Errorf("constantLine: calls %d -> %d, unknown %v", before.Calls, after.Calls, after.Unknown)
+	}
+
+	if _, err := ParseDsl(nil, "noSuchFunctionForStats(constantLine(1))", td.from, td.to, 100); err == nil {
+		t.Errorf("no error for an unknown function")
+	}
+	st := find("noSuchFunctionForStats")
+	if st.Calls != 1 || st.Errors != 1 || !st.Unknown {
+		t.Errorf("unknown function stat: %+v", st)
+	}
+}
+
+func Test_dsl_EstimateDsl(t *testing.T) {
+	spec := rrd.DSSpec{Step: 10 * time.Second, RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}}}
+	db := NewNamedDSFetcherMap(map[string]rrd.DataSourcer{
+		"foo.a": rrd.NewDataSource(spec),
+		"foo.b": rrd.NewDataSource(spec),
+		"bar.a": rrd.NewDataSource(spec),
+	})
+	to := time.Unix(1500000000, 0)
+	from := to.Add(-30 * time.Minute)
+
+	for _, c := range []struct {
+		src       string
+		maxPoints int64
+		series    int
+		points    int64
+	}{
+		{`group("foo.*")`, 0, 2, 360},
+		{`group(scale("foo.*", 2), alias("foo.a", "bar.*"))`, 0, 2, 360},
+		{`group("foo.*").scale(2)`, 100, 2, 200},
+		{`asPercent("foo.a", "bar.a")`, 0, 2, 360},
+		{`group("nosuch.*")`, 0, 0, 0},
+	} {
+		est, err := EstimateDsl(db, c.src, from, to, c.maxPoints)
+		if err != nil {
+			t.Errorf("EstimateDsl(%s): %v", c.src, err)
+			continue
+		}
+		if est.Series != c.series || est.DataPoints != c.points {
+			t.Errorf("EstimateDsl(%s): expected %d series and %d points, got %+v", c.src, c.series, c.points, est)
+		}
+	}
+
+	if _, err := EstimateDsl(db, `noSuchFunction("foo.*")`, from, to, 0); err == nil {
+		t.Errorf("EstimateDsl: an unknown function should be an error")
+	}
+}
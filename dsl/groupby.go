@@ -0,0 +1,244 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// The groupBy functions call other functions, so they are registered
+// here to avoid an initialization loop.
+func init() {
+	dslCtxFuncs["groupByNode"] = dslGroupByNode
+	dslCtxFuncs["groupByNodes"] = dslGroupByNodes
+}
+
+// Graphite-web aggregation names accepted as a groupByNode()
+// callback, and the function (with any extra arguments) they stand
+// for. Any other function which takes a seriesList as its first
+// argument can be named directly, e.g. "sumSeries".
+var groupByAggregations = map[string]callbackStep{
+	"average": {name: "averageSeries"},
+	"avg":     {name: "averageSeries"},
+	"sum":     {name: "sumSeries"},
+	"total":   {name: "sumSeries"},
+	"min":     {name: "minSeries"},
+	"max":     {name: "maxSeries"},
+	"diff":    {name: "diffSeries"},
+	"count":   {name: "countSeries"},
+	"range":   {name: "rangeOfSeries"},
+	"rangeOf": {name: "rangeOfSeries"},
+	"median":  {name: "percentileOfSeries", args: []interface{}{50.0}},
+}
+
+// callbackStep is one function of a callback chain, args are the
+// arguments following the seriesList.
+type callbackStep struct {
+	name string
+	args []interface{}
+}
+
+// parseCallback parses a callback such as "sum" or a chain of
+// functions separated by "|", each applied to the result of the
+// previous one, e.g. "sum|scale(0.001)|alias('total')".
+func parseCallback(callback string) ([]callbackStep, error) {
+	var result []callbackStep
+	for _, part := range strings.Split(callback, "|") {
+		part = strings.TrimSpace(part)
+		if step, ok := groupByAggregations[part]; ok {
+			result = append(result, step)
+			continue
+		}
+		expr, err := parser.ParseExpr(fixQuotes(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid callback %q: %v", part, err)
+		}
+		var step callbackStep
+		switch e := expr.(type) {
+		case *ast.Ident:
+			step.name = e.Name
+		case *ast.CallExpr:
+			fn, ok := e.Fun.(*ast.Ident)
+			if !ok {
+				return nil, fmt.Errorf("invalid callback %q", part)
+			}
+			step.name = fn.Name
+			for _, arg := range e.Args {
+				v, err := callbackArg(arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid callback %q: %v", part, err)
+				}
+				step.args = append(step.args, v)
+			}
+		default:
+			return nil, fmt.Errorf("invalid callback %q", part)
+		}
+		result = append(result, step)
+	}
+	return result, nil
+}
+
+// callbackArg is the value of a literal callback argument, which is
+// the same as it would be in an expression.
+func callbackArg(arg ast.Expr) (interface{}, error) {
+	switch tok := arg.(type) {
+	case *ast.BasicLit:
+		switch tok.Kind {
+		case token.INT, token.FLOAT:
+			return strconv.ParseFloat(tok.Value, 64)
+		case token.STRING:
+			return tok.Value[1 : len(tok.Value)-1], nil
+		}
+	case *ast.UnaryExpr:
+		if lit, ok := tok.X.(*ast.BasicLit); ok && tok.Op == token.SUB {
+			v, err := strconv.ParseFloat(lit.Value, 64)
+			return -v, err
+		}
+	case *ast.Ident:
+		return tok.Name, nil
+	}
+	return nil, fmt.Errorf("unsupported argument")
+}
+
+// groupKey is the name of the group a series belongs to, i.e. the
+// given nodes (negative ones count from the end) joined with dots.
+func groupKey(name string, nodes []int) (string, error) {
+	parts := strings.Split(name, ".")
+	keyParts := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		i := n
+		if i < 0 {
+			i += len(parts)
+		}
+		if i < 0 || i >= len(parts) {
+			return "", fmt.Errorf("node index %v out of range for number of nodes: %v", n, len(parts))
+		}
+		keyParts = append(keyParts, parts[i])
+	}
+	return strings.Join(keyParts, "."), nil
+}
+
+// groupByNodes groups series by the given nodes of their names and
+// applies the callback chain to every group. The resulting series
+// are named (and aliased) by the group key.
+func groupByNodes(dc *dslCtx, seriesList interface{}, nodes []int, callback string) (SeriesMap, error) {
+	steps, err := parseCallback(callback)
+	if err != nil {
+		return nil, err
+	}
+	series, err := dc.seriesFromSeriesOrIdent(seriesList)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]SeriesMap)
+	for name, s := range series {
+		key, err := groupKey(name, nodes)
+		if err != nil {
+			return nil, err
+		}
+		if groups[key] == nil {
+			groups[key] = make(SeriesMap)
+		}
+		groups[key][name] = s
+	}
+
+	result := make(SeriesMap, len(groups))
+	for key, group := range groups {
+		sm := group
+		for _, step := range steps {
+			if sm, err = callFunction(dc, step.name, append([]interface{}{sm}, step.args...)); err != nil {
+				return nil, err
+			}
+		}
+		if len(sm) != 1 {
+			return nil, fmt.Errorf("callback %q returned %d series for group %q, expecting 1", callback, len(sm), key)
+		}
+		for _, s := range sm {
+			s.Alias(key)
+			result[key] = s
+		}
+	}
+	return result, nil
+}
+
+// nodeArg converts a node number argument to an int.
+func nodeArg(arg interface{}) (int, error) {
+	switch v := arg.(type) {
+	case float64:
+		return int(v), nil
+	case string:
+		n, err := strconv.Atoi(strings.TrimPrefix(v, "nodeNum="))
+		if err != nil {
+			return 0, fmt.Errorf("%v is not a node number", arg)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%v is not a node number", arg)
+}
+
+// callbackArgString returns the callback argument, which may be given
+// as a keyword.
+func callbackArgString(arg interface{}) (string, error) {
+	s, ok := arg.(string)
+	if !ok {
+		return "", fmt.Errorf("%v is not a string", arg)
+	}
+	return strings.TrimPrefix(s, "callback="), nil
+}
+
+// groupByNode(seriesList, nodeNum, callback="average")
+func dslGroupByNode(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("Expecting 2 or 3 arguments, got %d", len(args))
+	}
+	node, err := nodeArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	callback := "average"
+	if len(args) == 3 {
+		if callback, err = callbackArgString(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	return groupByNodes(dc, args[0], []int{node}, callback)
+}
+
+// groupByNodes(seriesList, callback, *nodes)
+func dslGroupByNodes(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Expecting at least 2 arguments, got %d", len(args))
+	}
+	callback, err := callbackArgString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]int, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		node, err := nodeArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return groupByNodes(dc, args[0], nodes, callback)
+}
@@ -70,6 +70,9 @@ func (mapCache) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints in
 	return series.NewRRASeries(ds.RRAs()[0]), nil
 }
 
-func (mapCache) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+func (m mapCache) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if me := m[ident.String()]; me != nil {
+		return me.ds, nil
+	}
 	return nil, nil
 }
@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// namespacedFetcher confines a NamedDSFetcher to the series whose
+// names begin with prefix, and presents them without it, see
+// NewNamespacedFetcher().
+type namespacedFetcher struct {
+	NamedDSFetcher
+	prefix string
+}
+
+// NewNamespacedFetcher returns a NamedDSFetcher which only sees the
+// series of f whose names begin with prefix (e.g. "tenant."), named
+// without the prefix. A query for "foo.*" is a query for
+// "tenant.foo.*", and the series are named "foo.bar" etc, so that a
+// query does not need to know its namespace, and cannot get out of
+// it. An empty prefix returns f.
+func NewNamespacedFetcher(f NamedDSFetcher, prefix string) NamedDSFetcher {
+	if prefix == "" {
+		return f
+	}
+	return &namespacedFetcher{NamedDSFetcher: f, prefix: prefix}
+}
+
+// strip returns a copy of ident named without the prefix, and false
+// if the name is not in the namespace.
+func (f *namespacedFetcher) strip(ident serde.Ident) (serde.Ident, bool) {
+	name := ident["name"]
+	if !strings.HasPrefix(name, f.prefix) {
+		return nil, false
+	}
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = name[len(f.prefix):]
+	return result, true
+}
+
+func (f *namespacedFetcher) identsFromPattern(pattern string) map[string]serde.Ident {
+	result := make(map[string]serde.Ident)
+	for _, ident := range f.NamedDSFetcher.identsFromPattern(f.prefix + pattern) {
+		if ident, ok := f.strip(ident); ok {
+			result[ident["name"]] = ident
+		}
+	}
+	return result
+}
+
+func (f *namespacedFetcher) FsFind(pattern string) []*FsFindNode {
+	var result []*FsFindNode
+	for _, node := range f.NamedDSFetcher.FsFind(f.prefix + pattern) {
+		if !strings.HasPrefix(node.Name, f.prefix) {
+			continue
+		}
+		n := &FsFindNode{Name: node.Name[len(f.prefix):], Leaf: node.Leaf}
+		if node.ident != nil {
+			n.ident, _ = f.strip(node.ident)
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// Search prefixes the name regexp of the query (see
+// NamespacedRegexp()), the names of the results are without the
+// prefix.
+func (f *namespacedFetcher) Search(query serde.SearchQuery) (serde.SearchResult, error) {
+	q := make(serde.SearchQuery, len(query)+1)
+	for k, v := range query {
+		q[k] = v
+	}
+	q["name"] = NamespacedRegexp(f.prefix, q["name"])
+	sr, err := f.NamedDSFetcher.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	return &namespacedSearchResult{SearchResult: sr, f: f}, nil
+}
+
+// FetchOrCreateDataSource takes an ident as returned by the above,
+// i.e. named without the prefix.
+func (f *namespacedFetcher) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	full := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		full[k] = v
+	}
+	full["name"] = f.prefix + ident["name"]
+	return f.NamedDSFetcher.FetchOrCreateDataSource(full, dsSpec)
+}
+
+type namespacedSearchResult struct {
+	serde.SearchResult
+	f     *namespacedFetcher
+	ident serde.Ident
+}
+
+func (sr *namespacedSearchResult) Next() bool {
+	for sr.SearchResult.Next() {
+		if ident, ok := sr.f.strip(sr.SearchResult.Ident()); ok {
+			sr.ident = ident
+			return true
+		}
+	}
+	return false
+}
+
+func (sr *namespacedSearchResult) Ident() serde.Ident { return sr.ident }
+
+// NamespacedRegexp returns a regular expression matching the names
+// in the namespace prefix which re matches without the prefix. A ^
+// at the beginning of re anchors it at the beginning of the name
+// within the namespace.
+func NamespacedRegexp(prefix, re string) string {
+	if strings.HasPrefix(re, "^") {
+		re = re[1:]
+	} else {
+		re = ".*" + re
+	}
+	return "^" + regexp.QuoteMeta(prefix) + "(?:" + re + ")"
+}
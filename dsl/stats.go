@@ -0,0 +1,86 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FuncStat is how many times a DSL function was called, how many of
+// the calls failed and how long they took altogether. Most functions
+// return series which are computed lazily as they are iterated over,
+// which is not included, the duration is that of the call (e.g. the
+// fetching of the series from the database). Unknown is true if there
+// is no function by that name, i.e. it was requested but is not
+// implemented.
+type FuncStat struct {
+	Name     string
+	Calls    int64
+	Errors   int64
+	Duration time.Duration
+	Unknown  bool
+}
+
+// The most unknown function names kept track of, they come from
+// the users.
+const maxUnknownFuncStats = 1000
+
+var funcStats = struct {
+	sync.Mutex
+	m       map[string]*FuncStat
+	unknown int
+}{m: make(map[string]*FuncStat)}
+
+func recordFuncCall(name string, d time.Duration, err error) {
+	_, known := preprocessArgFuncs[name]
+	if !known {
+		_, known = dslCtxFuncs[name]
+	}
+
+	funcStats.Lock()
+	defer funcStats.Unlock()
+	st := funcStats.m[name]
+	if st == nil {
+		if !known {
+			if funcStats.unknown >= maxUnknownFuncStats {
+				return
+			}
+			funcStats.unknown++
+		}
+		st = &FuncStat{Name: name, Unknown: !known}
+		funcStats.m[name] = st
+	}
+	st.Calls++
+	st.Duration += d
+	if err != nil {
+		st.Errors++
+	}
+}
+
+// FuncStats returns the statistics of the functions called since the
+// start, sorted by name.
+func FuncStats() []FuncStat {
+	funcStats.Lock()
+	result := make([]FuncStat, 0, len(funcStats.m))
+	for _, st := range funcStats.m {
+		result = append(result, *st)
+	}
+	funcStats.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
@@ -0,0 +1,145 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+)
+
+// ParseTimeSpec parses a time relative to now. The syntax is "now"
+// followed by any number of offsets and alignments, applied left to
+// right:
+//
+//	+N<unit> or -N<unit>   add or subtract N units
+//	/<unit>                align to the beginning of the unit
+//
+// Offset units are those of misc.BetterParseDuration (s, min, h,
+// etc.) which are exact durations, and the calendar units d, w, mon
+// and y, which are days, weeks, months and years in the location of
+// now, i.e. a day is not always 24 hours across a DST change. The bd
+// unit is business days, Monday through Friday. Alignment units are
+// s, min, h, d, w (weeks begin on Monday), mon and y. For example:
+//
+//	now/d          midnight today
+//	now-1bd/d      beginning of the previous business day
+//	now/w          beginning of this week
+//	now-1mon/mon   beginning of last month
+//	now/mon-1d     the last day of last month, at midnight
+func ParseTimeSpec(s string, now time.Time) (time.Time, error) {
+	if len(s) < 3 || s[:3] != "now" {
+		return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q must begin with \"now\"", s)
+	}
+	t := now
+	for i := 3; i < len(s); {
+		op := s[i]
+		i++
+		j := i
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		num := s[i:j]
+		k := j
+		for k < len(s) && (s[k] >= 'a' && s[k] <= 'z' || s[k] >= 'A' && s[k] <= 'Z') {
+			k++
+		}
+		unit := s[j:k]
+		i = k
+
+		switch op {
+		case '+', '-':
+			if num == "" || unit == "" {
+				return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: expecting a number and a unit after %q", s, op)
+			}
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: %v", s, err)
+			}
+			if op == '-' {
+				n = -n
+			}
+			if t, err = addTimeUnits(t, n, unit); err != nil {
+				return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: %v", s, err)
+			}
+		case '/':
+			if num != "" || unit == "" {
+				return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: expecting a unit after '/'", s)
+			}
+			var err error
+			if t, err = alignTime(t, unit); err != nil {
+				return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: %v", s, err)
+			}
+		default:
+			return time.Time{}, fmt.Errorf("ParseTimeSpec(): %q: unexpected %q", s, op)
+		}
+	}
+	return t, nil
+}
+
+func addTimeUnits(t time.Time, n int, unit string) (time.Time, error) {
+	switch unit {
+	case "d":
+		return t.AddDate(0, 0, n), nil
+	case "w":
+		return t.AddDate(0, 0, 7*n), nil
+	case "mon":
+		return t.AddDate(0, n, 0), nil
+	case "y":
+		return t.AddDate(n, 0, 0), nil
+	case "bd":
+		step := 1
+		if n < 0 {
+			step, n = -1, -n
+		}
+		for n > 0 {
+			t = t.AddDate(0, 0, step)
+			if wd := t.Weekday(); wd != time.Saturday && wd != time.Sunday {
+				n--
+			}
+		}
+		return t, nil
+	}
+	d, err := misc.BetterParseDuration(strconv.Itoa(n) + unit)
+	if err != nil {
+		return t, err
+	}
+	return t.Add(d), nil
+}
+
+func alignTime(t time.Time, unit string) (time.Time, error) {
+	y, m, d := t.Date()
+	switch unit {
+	case "s":
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location()), nil
+	case "min":
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location()), nil
+	case "h":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()), nil
+	case "d":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location()), nil
+	case "w":
+		back := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, m, d-back, 0, 0, 0, 0, t.Location()), nil
+	case "mon":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), nil
+	case "y":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	return t, fmt.Errorf("unknown alignment unit: %q", unit)
+}
@@ -77,7 +77,12 @@ func (gl *Listener) Accept() (c net.Conn, err error) {
 }
 
 func (gl *Listener) File() *os.File {
-	tl := gl.Listener.(*net.TCPListener)
-	fl, _ := tl.File()
+	var fl *os.File
+	switch l := gl.Listener.(type) {
+	case *net.TCPListener:
+		fl, _ = l.File()
+	case *net.UnixListener:
+		fl, _ = l.File()
+	}
 	return fl
 }
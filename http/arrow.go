@@ -0,0 +1,244 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// A minimal writer of the Apache Arrow IPC streaming format
+// (https://arrow.apache.org/docs/format/Columnar.html), which is what
+// e.g. pyarrow.ipc.open_stream() reads. The schema is fixed:
+//
+//	target     utf8
+//	timestamp  timestamp[ms, tz=UTC]
+//	value      double (null where the value is unknown)
+//
+// The flatbuffer field numbers and enum values below come from the
+// Arrow Message.fbs and Schema.fbs.
+
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble     = 2
+	arrowTimeUnitMillisecond = 1
+
+	arrowContentType = "application/vnd.apache.arrow.stream"
+
+	// maximum number of rows in a record batch
+	arrowMaxBatchRows = 64 * 1024
+)
+
+type arrowWriter struct {
+	w     io.Writer
+	err   error
+	names []string
+	ts    []int64
+	vals  []float64
+}
+
+// newArrowWriter writes the schema and returns an arrowWriter.
+func newArrowWriter(w io.Writer) *arrowWriter {
+	aw := &arrowWriter{w: w}
+	aw.writeMessage(arrowHeaderSchema, arrowSchema, nil)
+	return aw
+}
+
+// append adds a row (ts is in milliseconds since the epoch), rows
+// are written in batches.
+func (aw *arrowWriter) append(name string, ts int64, value float64) error {
+	aw.names = append(aw.names, name)
+	aw.ts = append(aw.ts, ts)
+	aw.vals = append(aw.vals, value)
+	if len(aw.ts) >= arrowMaxBatchRows {
+		aw.flush()
+	}
+	return aw.err
+}
+
+// flush writes the rows appended so far as a record batch.
+func (aw *arrowWriter) flush() error {
+	if len(aw.ts) == 0 || aw.err != nil {
+		return aw.err
+	}
+	n := int64(len(aw.ts))
+
+	var (
+		body    []byte
+		buffers [][2]int64 // offset, length
+	)
+	addBuffer := func(b []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(b))})
+		body = append(body, b...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	// target: validity (none), offsets, data
+	offsets := make([]byte, 4*(n+1))
+	var data []byte
+	for i, name := range aw.names {
+		data = append(data, name...)
+		binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+	}
+	addBuffer(nil)
+	addBuffer(offsets)
+	addBuffer(data)
+
+	// timestamp: validity (none), values
+	tss := make([]byte, 8*n)
+	for i, t := range aw.ts {
+		binary.LittleEndian.PutUint64(tss[8*i:], uint64(t))
+	}
+	addBuffer(nil)
+	addBuffer(tss)
+
+	// value: validity, values
+	var nulls int64
+	validity := make([]byte, (n+7)/8)
+	vals := make([]byte, 8*n)
+	for i, v := range aw.vals {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			nulls++
+		} else {
+			validity[i/8] |= 1 << uint(i%8)
+			binary.LittleEndian.PutUint64(vals[8*i:], math.Float64bits(v))
+		}
+	}
+	if nulls == 0 {
+		validity = nil
+	}
+	addBuffer(validity)
+	addBuffer(vals)
+
+	nodes := [][2]int64{{n, 0}, {n, 0}, {n, nulls}} // length, null count
+	header := func(b *flatbuffers.Builder) flatbuffers.UOffsetT {
+		b.StartVector(16, len(buffers), 8)
+		for i := len(buffers) - 1; i >= 0; i-- {
+			b.Prep(8, 16)
+			b.PrependInt64(buffers[i][1])
+			b.PrependInt64(buffers[i][0])
+		}
+		bufVec := b.EndVector(len(buffers))
+		b.StartVector(16, len(nodes), 8)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			b.Prep(8, 16)
+			b.PrependInt64(nodes[i][1])
+			b.PrependInt64(nodes[i][0])
+		}
+		nodeVec := b.EndVector(len(nodes))
+		b.StartObject(4) // RecordBatch
+		b.PrependUOffsetTSlot(2, bufVec, 0)
+		b.PrependUOffsetTSlot(1, nodeVec, 0)
+		b.PrependInt64Slot(0, n, 0)
+		return b.EndObject()
+	}
+	aw.writeMessage(arrowHeaderRecordBatch, header, body)
+
+	aw.names, aw.ts, aw.vals = aw.names[:0], aw.ts[:0], aw.vals[:0]
+	return aw.err
+}
+
+// close flushes the remaining rows and writes the end of stream
+// marker.
+func (aw *arrowWriter) close() error {
+	if aw.flush(); aw.err == nil {
+		_, aw.err = aw.w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	}
+	return aw.err
+}
+
+// writeMessage writes an encapsulated message: continuation marker,
+// metadata length, metadata (a flatbuffer padded to 8 bytes), body.
+func (aw *arrowWriter) writeMessage(headerType byte, header func(*flatbuffers.Builder) flatbuffers.UOffsetT, body []byte) {
+	if aw.err != nil {
+		return
+	}
+	b := flatbuffers.NewBuilder(512)
+	hdr := header(b)
+	b.StartObject(5) // Message
+	b.PrependInt64Slot(3, int64(len(body)), 0)
+	b.PrependUOffsetTSlot(2, hdr, 0)
+	b.PrependByteSlot(1, headerType, 0)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.Finish(b.EndObject())
+
+	meta := b.FinishedBytes()
+	pad := (8 - len(meta)%8) % 8
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)+pad))
+	for _, p := range [][]byte{prefix, meta, make([]byte, pad), body} {
+		if _, aw.err = aw.w.Write(p); aw.err != nil {
+			return
+		}
+	}
+}
+
+func arrowSchema(b *flatbuffers.Builder) flatbuffers.UOffsetT {
+	fields := []flatbuffers.UOffsetT{
+		arrowField(b, "target", false, arrowTypeUtf8, func() flatbuffers.UOffsetT {
+			b.StartObject(0)
+			return b.EndObject()
+		}),
+		arrowField(b, "timestamp", false, arrowTypeTimestamp, func() flatbuffers.UOffsetT {
+			tz := b.CreateString("UTC")
+			b.StartObject(2)
+			b.PrependUOffsetTSlot(1, tz, 0)
+			b.PrependInt16Slot(0, arrowTimeUnitMillisecond, 0)
+			return b.EndObject()
+		}),
+		arrowField(b, "value", true, arrowTypeFloatingPoint, func() flatbuffers.UOffsetT {
+			b.StartObject(1)
+			b.PrependInt16Slot(0, arrowPrecisionDouble, 0)
+			return b.EndObject()
+		}),
+	}
+	b.StartVector(4, len(fields), 4)
+	for i := len(fields) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(fields[i])
+	}
+	vec := b.EndVector(len(fields))
+	b.StartObject(4) // Schema
+	b.PrependUOffsetTSlot(1, vec, 0)
+	return b.EndObject()
+}
+
+func arrowField(b *flatbuffers.Builder, name string, nullable bool, typeType byte, typ func() flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	nm := b.CreateString(name)
+	tp := typ()
+	b.StartVector(4, 0, 4)
+	children := b.EndVector(0) // some readers require it even if empty
+	b.StartObject(7)           // Field
+	b.PrependUOffsetTSlot(5, children, 0)
+	b.PrependUOffsetTSlot(3, tp, 0)
+	b.PrependByteSlot(2, typeType, 0)
+	b.PrependBoolSlot(1, nullable, false)
+	b.PrependUOffsetTSlot(0, nm, 0)
+	return b.EndObject()
+}
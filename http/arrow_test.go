@@ -0,0 +1,228 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// arrowMessage is an encapsulated message read back from a stream.
+type arrowMessage struct {
+	headerType byte
+	header     flatbuffers.Table
+	body       []byte
+}
+
+// fbField returns the position of field slot of tab, or 0 if it is
+// not present.
+func fbField(tab flatbuffers.Table, slot int) flatbuffers.UOffsetT {
+	if o := tab.Offset(flatbuffers.VOffsetT(4 + 2*slot)); o != 0 {
+		return tab.Pos + flatbuffers.UOffsetT(o)
+	}
+	return 0
+}
+
+// readArrowStream parses an IPC stream, checking the framing and the
+// 8-byte alignment of the messages.
+func readArrowStream(t *testing.T, b []byte) []arrowMessage {
+	var msgs []arrowMessage
+	pos := 0
+	for {
+		if pos%8 != 0 || pos+8 > len(b) {
+			t.Fatalf("arrow: message at %d of %d is not aligned or truncated", pos, len(b))
+		}
+		if cont := binary.LittleEndian.Uint32(b[pos:]); cont != 0xffffffff {
+			t.Fatalf("arrow: no continuation marker at %d: %x", pos, cont)
+		}
+		l := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		pos += 8
+		if l == 0 {
+			break // end of stream
+		}
+		if l%8 != 0 || pos+l > len(b) {
+			t.Fatalf("arrow: metadata length %d is not padded to 8 bytes or is truncated", l)
+		}
+		meta := b[pos : pos+l]
+		pos += l
+
+		msg := flatbuffers.Table{Bytes: meta, Pos: flatbuffers.GetUOffsetT(meta)}
+		if v := msg.GetInt16(fbField(msg, 0)); v != arrowMetadataV5 {
+			t.Errorf("arrow: metadata version %d", v)
+		}
+		var bodyLen int
+		if o := fbField(msg, 3); o != 0 {
+			bodyLen = int(msg.GetInt64(o))
+		}
+		if bodyLen%8 != 0 || pos+bodyLen > len(b) {
+			t.Fatalf("arrow: body length %d is not padded to 8 bytes or is truncated", bodyLen)
+		}
+		msgs = append(msgs, arrowMessage{
+			headerType: msg.GetByte(fbField(msg, 1)),
+			header:     flatbuffers.Table{Bytes: meta, Pos: msg.Indirect(fbField(msg, 2))},
+			body:       b[pos : pos+bodyLen],
+		})
+		pos += bodyLen
+	}
+	if pos != len(b) {
+		t.Errorf("arrow: %d bytes after the end of stream marker", len(b)-pos)
+	}
+	return msgs
+}
+
+// fbStructs returns the pairs of int64 of a vector of 16 byte
+// structs (FieldNode and Buffer).
+func fbStructs(tab flatbuffers.Table, slot int) [][2]int64 {
+	o := fbField(tab, slot)
+	vec, n := tab.Vector(o-tab.Pos), tab.VectorLen(o-tab.Pos)
+	result := make([][2]int64, n)
+	for i := range result {
+		p := vec + flatbuffers.UOffsetT(16*i)
+		result[i] = [2]int64{tab.GetInt64(p), tab.GetInt64(p + 8)}
+	}
+	return result
+}
+
+type arrowRow struct {
+	target string
+	ts     int64
+	value  float64
+	null   bool
+}
+
+// readArrowBatch checks a record batch and returns its rows.
+func readArrowBatch(t *testing.T, msg arrowMessage) []arrowRow {
+	if msg.headerType != arrowHeaderRecordBatch {
+		t.Fatalf("arrow: header type %d, expected a record batch", msg.headerType)
+	}
+	n := msg.header.GetInt64(fbField(msg.header, 0))
+	nodes, buffers := fbStructs(msg.header, 1), fbStructs(msg.header, 2)
+	if len(nodes) != 3 || len(buffers) != 7 {
+		t.Fatalf("arrow: %d nodes and %d buffers", len(nodes), len(buffers))
+	}
+	for _, b := range buffers {
+		if b[0]%8 != 0 || b[0]+b[1] > int64(len(msg.body)) {
+			t.Fatalf("arrow: buffer %v is not aligned or is beyond the body", b)
+		}
+	}
+	buf := func(i int) []byte { return msg.body[buffers[i][0] : buffers[i][0]+buffers[i][1]] }
+
+	offsets, data, tss, validity, vals := buf(1), buf(2), buf(4), buf(5), buf(6)
+	if int64(len(offsets)) != 4*(n+1) || int64(len(tss)) != 8*n || int64(len(vals)) != 8*n {
+		t.Fatalf("arrow: buffer sizes do not match %d rows", n)
+	}
+	var nulls int64
+	rows := make([]arrowRow, n)
+	for i := range rows {
+		r := &rows[i]
+		r.target = string(data[binary.LittleEndian.Uint32(offsets[4*i:]):binary.LittleEndian.Uint32(offsets[4*(i+1):])])
+		r.ts = int64(binary.LittleEndian.Uint64(tss[8*i:]))
+		r.value = math.Float64frombits(binary.LittleEndian.Uint64(vals[8*i:]))
+		if len(validity) > 0 && validity[i/8]&(1<<uint(i%8)) == 0 {
+			r.null = true
+			nulls++
+		}
+	}
+	for i, node := range nodes {
+		if node[0] != n {
+			t.Errorf("arrow: node %d length %d, expected %d", i, node[0], n)
+		}
+	}
+	if nodes[2][1] != nulls {
+		t.Errorf("arrow: null count %d, the bitmap has %d", nodes[2][1], nulls)
+	}
+	return rows
+}
+
+func Test_arrowWriter(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArrowWriter(&buf)
+	in := []arrowRow{
+		{"foo.bar", 1000, 1.5, false},
+		{"foo.bar", 2000, math.NaN(), true},
+		{"baz", 3000, -2, false},
+		{"baz", 4000, math.Inf(1), true},
+	}
+	for _, r := range in {
+		aw.append(r.target, r.ts, r.value)
+	}
+	if err := aw.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	msgs := readArrowStream(t, buf.Bytes())
+	if len(msgs) != 2 || msgs[0].headerType != arrowHeaderSchema {
+		t.Fatalf("arrow: expected a schema and a record batch, got %d messages", len(msgs))
+	}
+
+	schema := msgs[0].header
+	o := fbField(schema, 1)
+	vec, n := schema.Vector(o-schema.Pos), schema.VectorLen(o-schema.Pos)
+	var names []string
+	for i := 0; i < n; i++ {
+		f := flatbuffers.Table{Bytes: schema.Bytes, Pos: schema.Indirect(vec + flatbuffers.UOffsetT(4*i))}
+		names = append(names, string(f.ByteVector(fbField(f, 0))))
+		if nullable := fbField(f, 1) != 0 && f.GetBool(fbField(f, 1)); nullable != (i == 2) {
+			t.Errorf("arrow: field %d nullable: %v", i, nullable)
+		}
+	}
+	if len(names) != 3 || names[0] != "target" || names[1] != "timestamp" || names[2] != "value" {
+		t.Errorf("arrow: schema fields %v", names)
+	}
+
+	rows := readArrowBatch(t, msgs[1])
+	if len(rows) != len(in) {
+		t.Fatalf("arrow: %d rows, expected %d", len(rows), len(in))
+	}
+	for i, r := range rows {
+		exp := in[i]
+		if r.target != exp.target || r.ts != exp.ts || r.null != exp.null || !r.null && r.value != exp.value {
+			t.Errorf("arrow: row %d: expected %v, got %v", i, exp, r)
+		}
+	}
+}
+
+func Test_arrowWriter_batches(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArrowWriter(&buf)
+	for i := 0; i < arrowMaxBatchRows+1; i++ {
+		aw.append("x", int64(i), float64(i))
+	}
+	aw.close()
+
+	msgs := readArrowStream(t, buf.Bytes())
+	if len(msgs) != 3 {
+		t.Fatalf("arrow: expected a schema and two batches, got %d messages", len(msgs))
+	}
+	if n := len(readArrowBatch(t, msgs[1])); n != arrowMaxBatchRows {
+		t.Errorf("arrow: first batch has %d rows", n)
+	}
+	last := readArrowBatch(t, msgs[2])
+	if len(last) != 1 || last[0].ts != arrowMaxBatchRows || last[0].null {
+		t.Errorf("arrow: last batch %v", last)
+	}
+
+	// no rows, only the schema
+	buf.Reset()
+	newArrowWriter(&buf).close()
+	if msgs := readArrowStream(t, buf.Bytes()); len(msgs) != 1 {
+		t.Errorf("arrow: expected only the schema, got %d messages", len(msgs))
+	}
+}
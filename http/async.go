@@ -0,0 +1,358 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+)
+
+// Async query job states
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+type asyncQueryJob struct {
+	sync.Mutex
+	Id          string    `json:"id"`
+	Status      string    `json:"status"`
+	Format      string    `json:"format"`
+	Targets     int       `json:"targets"`
+	TargetsDone int       `json:"targets_done"`
+	Rows        int64     `json:"rows"`
+	Error       string    `json:"error,omitempty"`
+	Submitted   time.Time `json:"submitted"`
+	Finished    time.Time `json:"finished,omitempty"`
+	path        string
+	namespace   string // of the tenant which submitted it
+}
+
+// AsyncQueryManager runs render queries in the background, writing
+// the result to a temporary file, so that large exports do not tie
+// up an HTTP connection (and time out at proxies). A job is submitted
+// with a POST to the submit handler, which returns the job id. The
+// job status can then be polled, and once it is done the result can
+// be downloaded. Finished jobs and their results are removed after
+// the ttl expires. A job still running after the ttl fails, and its
+// result is removed.
+//
+// The only result format currently supported is CSV.
+type AsyncQueryManager struct {
+	sync.Mutex
+	rcache dsl.NamedDSFetcher
+	jobs   map[string]*asyncQueryJob
+	dir    string
+	ttl    time.Duration
+
+	// MaxRunning is how many jobs can be running at once, a submit
+	// beyond it is refused with 429 Too Many Requests.
+	MaxRunning int
+}
+
+// DefaultAsyncMaxRunning is the default AsyncQueryManager.MaxRunning.
+const DefaultAsyncMaxRunning = 8
+
+// NewAsyncQueryManager creates an AsyncQueryManager. Results are
+// stored in dir (blank means the system temporary directory) and
+// kept for ttl after the job finishes, ttl must be positive.
+func NewAsyncQueryManager(rcache dsl.NamedDSFetcher, dir string, ttl time.Duration) (*AsyncQueryManager, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("NewAsyncQueryManager: ttl must be positive, got %v", ttl)
+	}
+	m := &AsyncQueryManager{
+		rcache:     rcache,
+		jobs:       make(map[string]*asyncQueryJob),
+		dir:        dir,
+		ttl:        ttl,
+		MaxRunning: DefaultAsyncMaxRunning,
+	}
+	go m.reaper()
+	return m, nil
+}
+
+func (m *AsyncQueryManager) reaper() {
+	for {
+		time.Sleep(m.ttl / 4)
+		m.reap(time.Now())
+	}
+}
+
+// reap expires the jobs which finished more than the ttl before now,
+// and fails those which are still running after the ttl (the query
+// goroutine cannot be stopped, but its result is discarded, see
+// run()). The result file is removed in both cases.
+func (m *AsyncQueryManager) reap(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for id, job := range m.jobs {
+		job.Lock()
+		switch {
+		case job.Status == jobRunning && job.Submitted.Before(now.Add(-m.ttl)):
+			log.Printf("AsyncQueryManager: job %s still running after %v, failing it", job.Id, m.ttl)
+			job.Status, job.Error, job.Finished = jobFailed, fmt.Sprintf("still running after %v", m.ttl), now
+			os.Remove(job.path)
+		case job.Status != jobRunning && job.Finished.Before(now.Add(-m.ttl)):
+			os.Remove(job.path)
+			delete(m.jobs, id)
+		}
+		job.Unlock()
+	}
+}
+
+// running returns the number of running jobs, m must be locked.
+func (m *AsyncQueryManager) running() int {
+	var n int
+	for _, job := range m.jobs {
+		job.Lock()
+		if job.Status == jobRunning {
+			n++
+		}
+		job.Unlock()
+	}
+	return n
+}
+
+func newJobId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// status returns the job as JSON, along with its status and result
+// path, all taken under the job lock so that they are consistent.
+func (job *asyncQueryJob) status() ([]byte, string, string) {
+	job.Lock()
+	defer job.Unlock()
+	b, _ := json.Marshal(job)
+	return b, job.Status, job.path
+}
+
+func writeJSONBytes(w http.ResponseWriter, status int, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// SubmitHandler accepts a POST with the same parameters as the render
+// handler (target, from, until, maxDataPoints, nulls) plus an
+// optional format, and starts the job.
+func (m *AsyncQueryManager) SubmitHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+
+		format := r.FormValue("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("unsupported format: %q", format), Hint: "supported formats: csv"})
+			return
+		}
+
+		targets := r.Form["target"]
+		if len(targets) == 0 {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "at least one target is required"})
+			return
+		}
+
+		from, to, points, err := parseQueryRange(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
+			return
+		}
+		nulls, err := rrd.ParseNullPolicy(r.FormValue("nulls"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+
+		job := &asyncQueryJob{
+			Id:        newJobId(),
+			Status:    jobRunning,
+			Format:    format,
+			Targets:   len(targets),
+			Submitted: time.Now(),
+			namespace: TenantFromRequest(r).Namespace(),
+		}
+		m.Lock()
+		if m.MaxRunning > 0 && m.running() >= m.MaxRunning {
+			m.Unlock()
+			w.Header().Set("Retry-After", "10")
+			writeError(w, r, http.StatusTooManyRequests, Error{Code: ErrTooMany, Message: fmt.Sprintf("%d jobs are already running", m.MaxRunning),
+				Hint: "try again once a job is done"})
+			return
+		}
+		f, err := ioutil.TempFile(m.dir, "tgres-query-")
+		if err != nil {
+			m.Unlock()
+			log.Printf("AsyncQueryManager: error creating result file: %v", err)
+			writeError(w, r, http.StatusInternalServerError, Error{Code: ErrInternal, Message: "unable to create result file"})
+			return
+		}
+		job.path = f.Name()
+		m.jobs[job.Id] = job
+		m.Unlock()
+
+		b, _, _ := job.status()
+		go m.run(job, f, tenantFetcher(r, m.rcache), targets, from, to, points, nulls)
+
+		writeJSONBytes(w, http.StatusAccepted, b)
+	}
+}
+
+func (m *AsyncQueryManager) run(job *asyncQueryJob, f *os.File, rcache dsl.NamedDSFetcher, targets []string, from, to time.Time, points int64, nulls rrd.NullPolicy) {
+	err := writeCSV(f, rcache, targets, from, to, points, nulls, job)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	job.Lock()
+	defer job.Unlock()
+	if job.Status != jobRunning {
+		return // failed by reap(), the file is already removed
+	}
+	job.Finished = time.Now()
+	if err != nil {
+		log.Printf("AsyncQueryManager: job %s failed: %v", job.Id, err)
+		job.Status, job.Error = jobFailed, err.Error()
+		os.Remove(job.path)
+		return
+	}
+	job.Status = jobDone
+}
+
+func writeCSV(out io.Writer, rcache dsl.NamedDSFetcher, targets []string, from, to time.Time, points int64, nulls rrd.NullPolicy, job *asyncQueryJob) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"target", "timestamp", "value"})
+
+	for _, target := range targets {
+		seriesMap, err := processTarget(rcache, target, from, to, points, dsl.CompatNative, nulls)
+		if err != nil {
+			return err
+		}
+		for _, name := range seriesMap.SortedKeys() {
+			series := seriesMap[name]
+			if alias := series.Alias(); alias != "" {
+				name = alias
+			}
+			var rows int64
+			for series.Next() {
+				begin := series.CurrentTime().Add(-series.Step()) // beginning of the point, like render
+				if begin.Unix() <= 0 {
+					continue
+				}
+				value := series.CurrentValue()
+				v := ""
+				if !math.IsNaN(value) && !math.IsInf(value, 0) {
+					v = strconv.FormatFloat(value, 'f', -1, 64)
+				}
+				w.Write([]string{name, epochString(begin), v})
+				rows++
+			}
+			series.Close()
+			job.Lock()
+			job.Rows += rows
+			job.Unlock()
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		job.Lock()
+		job.TargetsDone++
+		job.Unlock()
+	}
+	return nil
+}
+
+// StatusHandler serves the job status at <prefix><id> and the result
+// at <prefix><id>/result, where prefix is the path this handler is
+// registered with.
+func (m *AsyncQueryManager) StatusHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+		m.Lock()
+		job := m.jobs[parts[0]]
+		m.Unlock()
+		if job != nil && job.namespace != TenantFromRequest(r).Namespace() {
+			job = nil // another tenant's
+		}
+		if job == nil {
+			writeError(w, r, http.StatusNotFound, Error{Code: ErrNotFound, Message: "no such job", Hint: "jobs expire, submit the query again"})
+			return
+		}
+
+		// Do not hold the job lock while writing to the client,
+		// a slow download would block the job and the reaper.
+		b, status, path := job.status()
+
+		if len(parts) == 1 || parts[1] == "" {
+			writeJSONBytes(w, http.StatusOK, b)
+			return
+		}
+		if len(parts) != 2 || parts[1] != "result" {
+			writeError(w, r, http.StatusNotFound, Error{Code: ErrNotFound, Message: "not found"})
+			return
+		}
+		if status != jobDone {
+			writeJSONBytes(w, http.StatusConflict, b)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("AsyncQueryManager: error opening result for job %s: %v", parts[0], err)
+			writeError(w, r, http.StatusGone, Error{Code: ErrGone, Message: "result no longer available"})
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", parts[0]+".csv"))
+		io.Copy(newStreamWriter(w), f)
+	}
+}
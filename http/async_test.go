@@ -0,0 +1,268 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func newTestAsync(t *testing.T, ttl time.Duration) (*AsyncQueryManager, *httptest.Server) {
+	m, err := NewAsyncQueryManager(dsl.NewNamedDSFetcher(serde.NewMemSerDe().Fetcher()), t.TempDir(), ttl)
+	if err != nil {
+		t.Fatalf("NewAsyncQueryManager: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/async", m.SubmitHandler())
+	mux.HandleFunc("/async/", m.StatusHandler("/async/"))
+	return m, httptest.NewServer(mux)
+}
+
+func submitTestJob(t *testing.T, srv *httptest.Server) string {
+	resp, err := http.PostForm(srv.URL+"/async", url.Values{
+		"target": {"constantLine(10)"},
+		"from":   {"-1h"},
+	})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("submit: status %d", resp.StatusCode)
+	}
+	var job struct{ Id, Status string }
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil || job.Id == "" || job.Status != jobRunning {
+		t.Fatalf("submit: %v %+v", err, job)
+	}
+	return job.Id
+}
+
+// waitForJob polls the job until it is no longer running and returns
+// its status.
+func waitForJob(t *testing.T, srv *httptest.Server, id string) string {
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(srv.URL + "/async/" + id)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+		var job struct{ Status string }
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if job.Status != jobRunning {
+			return job.Status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("poll: job %s still running", id)
+	return ""
+}
+
+func Test_AsyncQueryManager(t *testing.T) {
+	if _, err := NewAsyncQueryManager(nil, "", 0); err == nil {
+		t.Errorf("NewAsyncQueryManager: no error on a zero ttl")
+	}
+
+	_, srv := newTestAsync(t, time.Hour)
+	defer srv.Close()
+
+	id := submitTestJob(t, srv)
+	if status := waitForJob(t, srv, id); status != jobDone {
+		t.Fatalf("poll: expected %q, got %q", jobDone, status)
+	}
+
+	resp, err := http.Get(srv.URL + "/async/" + id + "/result")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("download: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) < 2 || lines[0] != "target,timestamp,value" || !strings.HasSuffix(lines[1], ",10") {
+		t.Errorf("download: unexpected result: %q", body)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/async/nosuchjob", http.StatusNotFound},
+		{"/async/nosuchjob/result", http.StatusNotFound},
+		{"/async/" + id + "/bogus", http.StatusNotFound},
+	} {
+		resp, err := http.Get(srv.URL + c.path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.path, c.status, resp.StatusCode)
+		}
+	}
+
+	// submit requires POST and a target
+	if resp, err := http.Get(srv.URL + "/async"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("submit: GET should not be allowed: %v", err)
+	}
+	if resp, err := http.PostForm(srv.URL+"/async", url.Values{}); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("submit: no error without a target: %v", err)
+	}
+}
+
+func Test_AsyncQueryManager_expiry(t *testing.T) {
+	m, srv := newTestAsync(t, 40*time.Millisecond)
+	defer srv.Close()
+
+	id := submitTestJob(t, srv)
+	waitForJob(t, srv, id)
+	m.Lock()
+	path := m.jobs[id].path
+	m.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	resp, err := http.Get(srv.URL + "/async/" + id + "/result")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expiry: expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if _, err := ioutil.ReadFile(path); err == nil {
+		t.Errorf("expiry: the result file %s was not removed", path)
+	}
+}
+
+func Test_AsyncQueryManager_maxRunning(t *testing.T) {
+	m, srv := newTestAsync(t, time.Hour)
+	defer srv.Close()
+
+	m.MaxRunning = 1
+	m.Lock()
+	m.jobs["busy"] = &asyncQueryJob{Id: "busy", Status: jobRunning, Submitted: time.Now()}
+	m.Unlock()
+
+	resp, err := http.PostForm(srv.URL+"/async", url.Values{"target": {"constantLine(10)"}})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("submit: expected status %d beyond MaxRunning, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	m.Lock()
+	m.jobs["busy"].Status = jobDone
+	m.Unlock()
+	submitTestJob(t, srv)
+}
+
+func Test_AsyncQueryManager_reapRunning(t *testing.T) {
+	m, srv := newTestAsync(t, time.Hour)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile(t.TempDir(), "tgres-query-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	now := time.Now()
+	job := &asyncQueryJob{Id: "stuck", Status: jobRunning, Submitted: now.Add(-2 * time.Hour), path: f.Name()}
+	m.Lock()
+	m.jobs[job.Id] = job
+	m.Unlock()
+
+	m.reap(now)
+	if _, status, _ := job.status(); status != jobFailed {
+		t.Errorf("reap: expected a job running past the ttl to be %q, got %q", jobFailed, status)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("reap: the result file of an expired running job was not removed")
+	}
+
+	// The query finishing afterwards does not resurrect it.
+	rf, _ := os.Create(f.Name())
+	m.run(job, rf, m.rcache, nil, now, now, 100, rrd.NullAsNull)
+	if _, status, _ := job.status(); status != jobFailed {
+		t.Errorf("run: a job failed by reap should stay %q, got %q", jobFailed, status)
+	}
+
+	m.reap(now.Add(2 * time.Hour))
+	m.Lock()
+	defer m.Unlock()
+	if len(m.jobs) != 0 {
+		t.Errorf("reap: the failed job was not removed after the ttl")
+	}
+}
+
+func Test_AsyncQueryManager_writeTimeout(t *testing.T) {
+	m, err := NewAsyncQueryManager(dsl.NewNamedDSFetcher(serde.NewMemSerDe().Fetcher()), t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("NewAsyncQueryManager: %v", err)
+	}
+	f, err := ioutil.TempFile(t.TempDir(), "tgres-query-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := bytes.Repeat([]byte("foo.bar,1500000000,1\n"), 1<<20) // 21MB
+	f.Write(result)
+	f.Close()
+	m.jobs["big"] = &asyncQueryJob{Id: "big", Status: jobDone, Finished: time.Now(), path: f.Name()}
+
+	srv := httptest.NewUnstartedServer(m.StatusHandler("/"))
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/big/result")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+	// Read slowly, so that the download takes longer than the
+	// WriteTimeout.
+	var got []byte
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := resp.Body.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("download: %v after %d bytes", err, len(got))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(got) != len(result) {
+		t.Errorf("download: expected %d bytes, got %d", len(result), len(got))
+	}
+}
@@ -0,0 +1,276 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/serde"
+)
+
+// Scopes that handlers can require of a tenant.
+const (
+	ScopeRead  = "read"  // querying: /render, /metrics/find
+	ScopeWrite = "write" // sending data: /pixel
+	ScopeAdmin = "admin" // everything else, e.g. /blaster
+)
+
+// Tenant is what a client certificate identity maps to. A tenant has
+// a name and a list of scopes it is allowed to access.
+//
+// Unless it is Global, a tenant is confined to its namespace: the
+// series it sends are stored as "<name>.<series>", and it can only
+// find, read and delete those, by their names without the prefix.
+// The first component of a series name is also what per-tenant
+// series quotas count.
+type Tenant struct {
+	Name   string
+	Scopes []string
+	Global bool // sees (and sends) all series by their full names
+}
+
+// Namespace returns the prefix of the names of the series of the
+// tenant, or an empty string if it is not confined to one.
+func (t *Tenant) Namespace() string {
+	if t == nil || t.Global || t.Name == "" {
+		return ""
+	}
+	return t.Name + "."
+}
+
+// HasScope returns true if the tenant is allowed the scope. The
+// admin scope implies all others.
+func (t *Tenant) HasScope(scope string) bool {
+	if t == nil {
+		return false
+	}
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCertAuth maps client certificates to tenants. A certificate
+// is matched by its subject common name first, then by its DNS,
+// email and URI SANs, in that order. The certificate itself must
+// already be verified by the TLS layer (i.e. tls.Config.ClientAuth
+// set to tls.RequireAndVerifyClientCert), ClientCertAuth does no
+// verification of its own.
+type ClientCertAuth struct {
+	sync.RWMutex
+	tenants map[string]*Tenant
+}
+
+// NewClientCertAuth returns an empty ClientCertAuth, which rejects
+// every request until identities are added with AddIdentity().
+func NewClientCertAuth() *ClientCertAuth {
+	return &ClientCertAuth{tenants: make(map[string]*Tenant)}
+}
+
+// AddIdentity maps a certificate identity (CN or SAN) to a tenant.
+func (a *ClientCertAuth) AddIdentity(id string, t *Tenant) {
+	a.Lock()
+	defer a.Unlock()
+	a.tenants[id] = t
+}
+
+// TenantForCert returns the tenant for the certificate or nil.
+func (a *ClientCertAuth) TenantForCert(cert *x509.Certificate) *Tenant {
+	if cert == nil {
+		return nil
+	}
+	ids := []string{cert.Subject.CommonName}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	for _, id := range ids {
+		if t := a.tenants[id]; id != "" && t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+type tenantCtxKey struct{}
+
+// tenantName returns the full name of a series named name by the
+// tenant of the request, see Tenant.Namespace().
+func tenantName(r *http.Request, name string) string {
+	return TenantFromRequest(r).Namespace() + name
+}
+
+// tenantIdent is tenantName() for an ident, it returns a copy.
+func tenantIdent(r *http.Request, ident serde.Ident) serde.Ident {
+	ns := TenantFromRequest(r).Namespace()
+	if ns == "" {
+		return ident
+	}
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = ns + ident["name"]
+	return result
+}
+
+// tenantQueue wraps a function queueing data points so that the
+// series are in the namespace of the tenant of the request.
+func tenantQueue(r *http.Request, queue func(serde.Ident, time.Time, float64)) func(serde.Ident, time.Time, float64) {
+	if TenantFromRequest(r).Namespace() == "" {
+		return queue
+	}
+	return func(ident serde.Ident, ts time.Time, v float64) {
+		queue(tenantIdent(r, ident), ts, v)
+	}
+}
+
+// tenantFetcher returns the fetcher as seen by the tenant of the
+// request, i.e. confined to its namespace.
+func tenantFetcher(r *http.Request, rcache dsl.NamedDSFetcher) dsl.NamedDSFetcher {
+	return dsl.NewNamespacedFetcher(rcache, TenantFromRequest(r).Namespace())
+}
+
+// GlobalOnly wraps a handler which takes full series names (e.g. a
+// maintenance endpoint), so that a tenant confined to a namespace
+// cannot use it to get out of it.
+func GlobalOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t := TenantFromRequest(r); t.Namespace() != "" {
+			writeError(w, r, http.StatusForbidden, Error{Code: ErrForbidden, Message: fmt.Sprintf("tenant %q is confined to its namespace", t.Name),
+				Hint: "only a global tenant can use this endpoint"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// TenantFromRequest returns the tenant the request was authenticated
+// as, or nil if the handler was not wrapped with an Authenticator.
+func TenantFromRequest(r *http.Request) *Tenant {
+	t, _ := r.Context().Value(tenantCtxKey{}).(*Tenant)
+	return t
+}
+
+// Authenticator wraps handlers requiring the request to be
+// authenticated as a tenant which has the given scope. It is
+// implemented by ClientCertAuth and TokenAuth.
+type Authenticator interface {
+	Handler(scope string, h http.HandlerFunc) http.HandlerFunc
+}
+
+// Handler wraps a handler requiring that the client certificate maps
+// to a tenant which has the given scope. The tenant is available to
+// the wrapped handler via TenantFromRequest().
+func (a *ClientCertAuth) Handler(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeError(w, r, http.StatusUnauthorized, Error{Code: ErrUnauthorized, Message: "client certificate required"})
+			return
+		}
+		cert := r.TLS.PeerCertificates[0]
+		t := a.TenantForCert(cert)
+		if t == nil {
+			writeError(w, r, http.StatusForbidden, Error{Code: ErrForbidden, Message: fmt.Sprintf("unknown client certificate %q", cert.Subject.CommonName), Hint: "the certificate must map to a tenant, see http-client-cert"})
+			return
+		}
+		authorized(w, r, t, scope, h)
+	}
+}
+
+// authorized calls h if the tenant has the scope.
+func authorized(w http.ResponseWriter, r *http.Request, t *Tenant, scope string, h http.HandlerFunc) {
+	if !t.HasScope(scope) {
+		writeError(w, r, http.StatusForbidden, Error{Code: ErrForbidden, Message: fmt.Sprintf("tenant %q lacks scope %q", t.Name, scope)})
+		return
+	}
+	h(w, r.WithContext(context.WithValue(r.Context(), tenantCtxKey{}, t)))
+}
+
+// TokenAuth maps bearer tokens (sent as "Authorization: Bearer
+// <token>") to tenants. Requests without a token are passed on to
+// Next (e.g. a ClientCertAuth) if it is not nil, or else rejected.
+// Tokens are sent in the clear unless the listener uses TLS.
+type TokenAuth struct {
+	sync.RWMutex
+	tenants map[[sha256.Size]byte]*Tenant // by hash, so that lookups take the same time
+	Next    Authenticator
+}
+
+// NewTokenAuth returns an empty TokenAuth, which rejects every
+// request with a token until tokens are added with AddToken().
+func NewTokenAuth(next Authenticator) *TokenAuth {
+	return &TokenAuth{tenants: make(map[[sha256.Size]byte]*Tenant), Next: next}
+}
+
+// AddToken maps a token to a tenant.
+func (a *TokenAuth) AddToken(token string, t *Tenant) {
+	a.Lock()
+	defer a.Unlock()
+	a.tenants[sha256.Sum256([]byte(token))] = t
+}
+
+// TenantForToken returns the tenant for the token or nil.
+func (a *TokenAuth) TenantForToken(token string) *Tenant {
+	if token == "" {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return a.tenants[sha256.Sum256([]byte(token))]
+}
+
+// Handler wraps a handler requiring that the bearer token maps to a
+// tenant which has the given scope. The tenant is available to the
+// wrapped handler via TenantFromRequest().
+func (a *TokenAuth) Handler(scope string, h http.HandlerFunc) http.HandlerFunc {
+	var next http.HandlerFunc
+	if a.Next != nil {
+		next = a.Next.Handler(scope, h)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth == "" && next != nil {
+			next(w, r)
+			return
+		}
+		const prefix = "Bearer "
+		if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			writeError(w, r, http.StatusUnauthorized, Error{Code: ErrUnauthorized, Message: "bearer token required", Hint: "send Authorization: Bearer <token>, see http-token"})
+			return
+		}
+		t := a.TenantForToken(auth[len(prefix):])
+		if t == nil {
+			writeError(w, r, http.StatusForbidden, Error{Code: ErrForbidden, Message: "unknown token"})
+			return
+		}
+		authorized(w, r, t, scope, h)
+	}
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Tenant_Namespace(t *testing.T) {
+	for _, c := range []struct {
+		t   *Tenant
+		exp string
+	}{
+		{nil, ""},
+		{&Tenant{Name: "a"}, "a."},
+		{&Tenant{Name: "a", Global: true}, ""},
+	} {
+		if got := c.t.Namespace(); got != c.exp {
+			t.Errorf("Namespace: %+v: expected %q, got %q", c.t, c.exp, got)
+		}
+	}
+}
+
+func Test_tenantIsolation(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Minute,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}}}
+	for _, name := range []string{"a.cpu", "b.cpu", "b.secret"} {
+		if _, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatalf("FetchOrCreateDataSource: %v", err)
+		}
+	}
+	rcache := dsl.NewNamedDSFetcher(db.Fetcher())
+
+	auth := NewTokenAuth(nil)
+	auth.AddToken("ta", &Tenant{Name: "a", Scopes: []string{ScopeRead}})
+	auth.AddToken("tb", &Tenant{Name: "b", Scopes: []string{ScopeRead}})
+	auth.AddToken("tg", &Tenant{Name: "ops", Scopes: []string{ScopeAdmin}, Global: true})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/find", auth.Handler(ScopeRead, GraphiteMetricsFindHandler(rcache)))
+	mux.HandleFunc("/render", auth.Handler(ScopeRead, GraphiteRenderHandler(rcache)))
+	mux.HandleFunc("/global", auth.Handler(ScopeRead, GlobalOnly(func(w http.ResponseWriter, r *http.Request) {})))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(token, path string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Tenant a only finds its series, named without the prefix.
+	if _, body := get("ta", "/metrics/find?query=*"); !strings.Contains(body, `"cpu"`) || strings.Contains(body, "secret") || strings.Contains(body, `"b"`) {
+		t.Errorf("find: tenant a sees outside its namespace: %s", body)
+	}
+	if _, body := get("tb", "/metrics/find?query=*"); !strings.Contains(body, "secret") {
+		t.Errorf("find: tenant b does not see its series: %s", body)
+	}
+
+	// Tenant a cannot render the series of tenant b, neither by its
+	// full name nor with a wildcard.
+	for _, target := range []string{"b.secret", "*.secret", "secret"} {
+		if code, body := get("ta", "/render?format=json&from=-1h&maxDataPoints=100&target="+target); code != http.StatusOK || strings.Contains(body, "secret") {
+			t.Errorf("render %s: tenant a sees a series of tenant b: %s", target, body)
+		}
+	}
+	if _, body := get("tb", "/render?format=json&from=-1h&maxDataPoints=100&target=secret"); !strings.Contains(body, `"secret"`) {
+		t.Errorf("render: tenant b does not see its series: %s", body)
+	}
+
+	// A global tenant sees everything, by the full name.
+	if _, body := get("tg", "/metrics/find?query=*"); !strings.Contains(body, `"a"`) || !strings.Contains(body, `"b"`) {
+		t.Errorf("find: the global tenant does not see all: %s", body)
+	}
+
+	if code, _ := get("ta", "/global"); code != http.StatusForbidden {
+		t.Errorf("GlobalOnly: expected 403 for tenant a, got %d", code)
+	}
+	if code, _ := get("tg", "/global"); code != http.StatusOK {
+		t.Errorf("GlobalOnly: expected 200 for the global tenant, got %d", code)
+	}
+}
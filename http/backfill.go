@@ -0,0 +1,78 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// backfillSeries is a series in the body of /api/backfill, points
+// are [unix time, value] pairs.
+type backfillSeries struct {
+	Name   string       `json:"name"`
+	Points [][2]float64 `json:"points"`
+}
+
+// BackfillHandler loads the history of series in bulk, directly into
+// the database (see receiver.Backfill). The body is a JSON array of
+// {"name": ..., "points": [[unix_time, value], ...]}. It responds
+// with the number of points used.
+func BackfillHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body []backfillSeries
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be an array of {"name": ..., "points": [[unix_time, value], ...]}`})
+			return
+		}
+
+		batch := make([]receiver.BackfillSeries, 0, len(body))
+		for _, s := range body {
+			if s.Name == "" {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "series name is required"})
+				return
+			}
+			bs := receiver.BackfillSeries{Ident: serde.Ident{"name": s.Name}}
+			for _, p := range s.Points {
+				ts := time.Unix(0, int64(p[0]*1e9))
+				bs.Points = append(bs.Points, receiver.BackfillPoint{TimeStamp: ts, Value: p[1]})
+			}
+			batch = append(batch, bs)
+		}
+
+		n, err := rcvr.Backfill(batch)
+		if err != nil && n == 0 {
+			writeError(w, r, http.StatusInternalServerError, Error{Code: ErrInternal, Message: err.Error()})
+			return
+		} else if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrPartialWrite,
+				Message: fmt.Sprintf("%d data points used, the first error: %v", n, err)})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"points": n})
+	}
+}
@@ -39,9 +39,7 @@ func BlasterSetHandler(blstr *blaster.Blaster) http.HandlerFunc {
 						var rate int
 						n, _ := fmt.Sscanf(valStr, "%d", &rate)
 						if n < 1 {
-							log.Printf("BlasterSetHandler: error parsing %q", valStr)
-							w.WriteHeader(http.StatusInternalServerError)
-							fmt.Fprintf(w, "Error\n")
+							writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("invalid rate: %q", valStr), Hint: "rate is an integer"})
 							return
 						}
 						blstr.SetRate(rate)
@@ -52,9 +50,7 @@ func BlasterSetHandler(blstr *blaster.Blaster) http.HandlerFunc {
 						var ns int
 						n, _ := fmt.Sscanf(valStr, "%d", &ns)
 						if n < 1 {
-							log.Printf("BlasterSetHandler: error parsing %q", valStr)
-							w.WriteHeader(http.StatusInternalServerError)
-							fmt.Fprintf(w, "Error\n")
+							writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("invalid n: %q", valStr), Hint: "n is an integer"})
 							return
 						}
 						blstr.SetNSeries(ns)
@@ -0,0 +1,40 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import "net/http"
+
+// ClusterConfigStatus tells whether the nodes of the cluster agree on
+// the configuration which determines how series are created (DS specs
+// and aggregation rules). Nodes which disagree create inconsistent
+// series depending on which node a point arrives at.
+type ClusterConfigStatus struct {
+	// The hash of the configuration of this node.
+	Hash string `json:"hash"`
+
+	// False if any other node has a different hash.
+	Consistent bool `json:"consistent"`
+
+	// The hashes of the nodes which differ, by node name.
+	Divergent map[string]string `json:"divergent,omitempty"`
+}
+
+// ClusterConfigHandler returns the ClusterConfigStatus as JSON.
+func ClusterConfigHandler(status func() *ClusterConfigStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, status())
+	}
+}
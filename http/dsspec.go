@@ -0,0 +1,151 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// A DSSpecPatternFinder can tell which pattern (e.g. the regexp of a
+// [[ds]] config section) matches a name. It is optional, if the
+// finder passed to DSSpecHandler implements it, the pattern is
+// included in the response.
+type DSSpecPatternFinder interface {
+	FindMatchingDSSpecPattern(ident serde.Ident) string
+}
+
+type dsSpecRRA struct {
+	Function string  `json:"function"`
+	Step     string  `json:"step"`
+	Span     string  `json:"span"`
+	Points   int64   `json:"points"`
+	Xff      float32 `json:"xff"`
+	RoundTo  float64 `json:"roundTo,omitempty"`
+	GapFill  string  `json:"gapFill,omitempty"`
+}
+
+func newDsSpecRRA(rra rrd.RRASpec) dsSpecRRA {
+	var points int64
+	if rra.Step > 0 {
+		points = int64(rra.Span / rra.Step)
+	}
+	r := dsSpecRRA{
+		Function: rra.Function.String(),
+		Step:     rra.Step.String(),
+		Span:     rra.Span.String(),
+		Points:   points,
+		Xff:      rra.Xff,
+		RoundTo:  rra.RoundTo,
+	}
+	if rra.GapFill != rrd.GapNaN {
+		r.GapFill = rra.GapFill.String()
+	}
+	return r
+}
+
+// rraSpec is the reverse of newDsSpecRRA, Points is ignored.
+func (r dsSpecRRA) rraSpec() (rrd.RRASpec, error) {
+	var (
+		spec rrd.RRASpec
+		err  error
+	)
+	if spec.Function, err = rrd.ParseConsolidation(r.Function); err != nil {
+		return spec, err
+	}
+	if spec.Step, err = misc.BetterParseDuration(r.Step); err != nil {
+		return spec, fmt.Errorf("invalid step %q: %v", r.Step, err)
+	}
+	if spec.Span, err = misc.BetterParseDuration(r.Span); err != nil {
+		return spec, fmt.Errorf("invalid span %q: %v", r.Span, err)
+	}
+	if r.GapFill != "" {
+		if spec.GapFill, err = rrd.ParseGapFill(r.GapFill); err != nil {
+			return spec, err
+		}
+	}
+	spec.Xff, spec.RoundTo = r.Xff, r.RoundTo
+	return spec, nil
+}
+
+type dsSpecResponse struct {
+	Name      string      `json:"name"`
+	Pattern   string      `json:"pattern,omitempty"`
+	Type      string      `json:"type"`
+	Step      string      `json:"step"`
+	Heartbeat string      `json:"heartbeat"`
+	Min       *float64    `json:"min,omitempty"`
+	Max       *float64    `json:"max,omitempty"`
+	Retention string      `json:"retention"` // the longest span
+	RRAs      []dsSpecRRA `json:"rras"`
+}
+
+// DSSpecHandler returns the DS spec (type, step, heartbeat, limits and RRAs) that
+// would be applied to a new series of the given name, so that the
+// retention can be verified before a new metric family is sent. The
+// name is sanitized the same way as incoming names are. Nothing is
+// created.
+func DSSpecHandler(finder receiver.MatchingDSSpecFinder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := misc.SanitizeName(r.FormValue("name"))
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "name is required"})
+			return
+		}
+		ident := serde.Ident{"name": name}
+		spec := finder.FindMatchingDSSpec(ident)
+		if spec == nil {
+			writeError(w, r, http.StatusNotFound, Error{Code: ErrNotFound, Target: name,
+				Message: fmt.Sprintf("no DS spec matches %q", name),
+				Hint:    "series whose name does not match any [[ds]] regexp are not created"})
+			return
+		}
+
+		resp := &dsSpecResponse{
+			Name:      name,
+			Type:      spec.Type.String(),
+			Step:      spec.Step.String(),
+			Heartbeat: spec.Heartbeat.String(),
+			RRAs:      make([]dsSpecRRA, 0, len(spec.RRAs)),
+		}
+		if !math.IsNaN(spec.Min) {
+			resp.Min = &spec.Min
+		}
+		if !math.IsNaN(spec.Max) {
+			resp.Max = &spec.Max
+		}
+		if pf, ok := finder.(DSSpecPatternFinder); ok {
+			resp.Pattern = pf.FindMatchingDSSpecPattern(ident)
+		}
+		var retention time.Duration
+		for _, rra := range spec.RRAs {
+			resp.RRAs = append(resp.RRAs, newDsSpecRRA(rra))
+			if rra.Span > retention {
+				retention = rra.Span
+			}
+		}
+		resp.Retention = retention.String()
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
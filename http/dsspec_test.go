@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// regexpDSFinder works like the [[ds]] sections of the config, the
+// first regexp matching the name wins.
+type regexpDSFinder []struct {
+	re   *regexp.Regexp
+	spec *rrd.DSSpec
+}
+
+func (f regexpDSFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	for _, ds := range f {
+		if ds.re.MatchString(ident["name"]) {
+			return ds.spec
+		}
+	}
+	return nil
+}
+
+func (f regexpDSFinder) FindMatchingDSSpecPattern(ident serde.Ident) string {
+	for _, ds := range f {
+		if ds.re.MatchString(ident["name"]) {
+			return ds.re.String()
+		}
+	}
+	return ""
+}
+
+func Test_DSSpecHandler(t *testing.T) {
+	finder := regexpDSFinder{
+		{regexp.MustCompile(`^stats\.money\.`), &rrd.DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: time.Hour,
+			Min:       0,
+			Max:       math.NaN(),
+			RRAs: []rrd.RRASpec{
+				{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 24 * time.Hour, RoundTo: 0.01},
+				{Function: rrd.MAX, Step: time.Hour, Span: 90 * 24 * time.Hour, Xff: 0.5},
+			},
+		}},
+		{regexp.MustCompile(`^stats\.`), &rrd.DSSpec{
+			Step:      time.Minute,
+			Heartbeat: 2 * time.Hour,
+			Min:       math.NaN(),
+			Max:       math.NaN(),
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour}},
+		}},
+	}
+	h := DSSpecHandler(finder)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/api/dsspec?"+query, nil))
+		return w
+	}
+
+	// The first matching regexp is used, and the name is sanitized.
+	w := get("name=stats.money.in%20flight")
+	if w.Code != http.StatusOK {
+		t.Fatalf("DSSpecHandler: status %d: %s", w.Code, w.Body.Bytes())
+	}
+	var resp dsSpecResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("DSSpecHandler: %v: %s", err, w.Body.Bytes())
+	}
+	if resp.Name != "stats.money.in_flight" || resp.Pattern != `^stats\.money\.` {
+		t.Errorf("DSSpecHandler: name %q, pattern %q", resp.Name, resp.Pattern)
+	}
+	if resp.Type != "GAUGE" || resp.Step != "10s" || resp.Heartbeat != "1h0m0s" || resp.Retention != "2160h0m0s" {
+		t.Errorf("DSSpecHandler: unexpected spec %+v", resp)
+	}
+	if resp.Min == nil || *resp.Min != 0 || resp.Max != nil {
+		t.Errorf("DSSpecHandler: expected min 0 and no max, got %v, %v", resp.Min, resp.Max)
+	}
+	if len(resp.RRAs) != 2 {
+		t.Fatalf("DSSpecHandler: expected 2 RRAs, got %v", resp.RRAs)
+	}
+	if r := resp.RRAs[0]; r.Function != "WMEAN" || r.Points != 8640 || r.RoundTo != 0.01 {
+		t.Errorf("DSSpecHandler: unexpected first RRA %+v", r)
+	}
+	if r := resp.RRAs[1]; r.Function != "MAX" || r.Step != "1h0m0s" || r.Points != 2160 || r.Xff != 0.5 {
+		t.Errorf("DSSpecHandler: unexpected second RRA %+v", r)
+	}
+
+	// A less specific regexp further down.
+	w = get("name=stats.requests")
+	resp = dsSpecResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("DSSpecHandler: status %d, %v: %s", w.Code, err, w.Body.Bytes())
+	}
+	if resp.Pattern != `^stats\.` || resp.Retention != "1h0m0s" || len(resp.RRAs) != 1 {
+		t.Errorf("DSSpecHandler: unexpected spec %+v", resp)
+	}
+
+	// No match and no name.
+	for _, c := range []struct {
+		query, code string
+		status      int
+	}{
+		{"name=other.requests", ErrNotFound, http.StatusNotFound},
+		{"name=", ErrBadRequest, http.StatusBadRequest},
+		{"", ErrBadRequest, http.StatusBadRequest},
+	} {
+		w := get(c.query)
+		var env map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("DSSpecHandler(%q): %v: %s", c.query, err, w.Body.Bytes())
+		}
+		if w.Code != c.status || env["code"] != c.code {
+			t.Errorf("DSSpecHandler(%q): expected %d %s, got %d %v", c.query, c.status, c.code, w.Code, env)
+		}
+		if c.status == http.StatusNotFound && env["target"] != "other.requests" {
+			t.Errorf("DSSpecHandler(%q): expected the name as target, got %v", c.query, env)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Error codes of an Error, so that scripts can act on failures
+// without parsing the message.
+const (
+	ErrBadRequest   = "bad_request"   // a missing or invalid parameter
+	ErrBadTime      = "bad_time"      // from or until cannot be parsed
+	ErrBadTarget    = "bad_target"    // a target cannot be evaluated
+	ErrPartialWrite = "partial_write" // some of the data could not be parsed
+	ErrMethod       = "method_not_allowed"
+	ErrUnauthorized = "unauthorized"
+	ErrForbidden    = "forbidden"
+	ErrNotFound     = "not_found"
+	ErrConflict     = "conflict"
+	ErrGone         = "gone"
+	ErrTooMany      = "too_many_requests"
+	ErrInternal     = "internal"
+)
+
+// Error is the JSON body of all error responses. LegacyError (the
+// "error" key) is the same as Message, it is there for clients of the
+// earlier {"error": "..."} responses and is set by writeError. Target
+// is the offending target, if any. Id is logged along with the error,
+// so that a user reporting a failure can be matched with the server
+// log.
+type Error struct {
+	LegacyError string `json:"error"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Target      string `json:"target,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+	Id          string `json:"id"`
+}
+
+// Hints for common errors.
+const (
+	hintTime   = "times are relative (e.g. -1h), relative to now (e.g. now-1d/d) or Unix timestamps"
+	hintTarget = "check the function names and arguments, quote series names which are not valid identifiers"
+)
+
+func newErrorId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeError logs e with a new id and sends it with status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, e Error) {
+	e.LegacyError, e.Id = e.Message, newErrorId()
+	if e.Target != "" {
+		log.Printf("HTTP error %s: %s %s: %d %s: %s (target: %q)", e.Id, r.Method, r.URL.Path, status, e.Code, e.Message, e.Target)
+	} else {
+		log.Printf("HTTP error %s: %s %s: %d %s: %s", e.Id, r.Method, r.URL.Path, status, e.Code, e.Message)
+	}
+	writeJSON(w, status, &e)
+}
@@ -0,0 +1,53 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_writeError(t *testing.T) {
+	ids := make(map[string]bool)
+	for _, target := range []string{"", "sumSeries(foo.*"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/render", nil)
+		writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTarget, Message: "unbalanced parentheses", Target: target, Hint: hintTarget})
+
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("writeError: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var env map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("writeError: %v: %s", err, w.Body.Bytes())
+		}
+		if env["error"] != "unbalanced parentheses" || env["error"] != env["message"] {
+			t.Errorf("writeError: error %q and message %q should be the same", env["error"], env["message"])
+		}
+		if env["code"] != ErrBadTarget || env["hint"] != hintTarget || env["target"] != target {
+			t.Errorf("writeError: unexpected envelope %v", env)
+		}
+		if _, ok := env["target"]; ok != (target != "") {
+			t.Errorf("writeError: target should only be present if set: %v", env)
+		}
+		if len(env["id"]) != 16 || ids[env["id"]] {
+			t.Errorf("writeError: missing or repeated id %q", env["id"])
+		}
+		ids[env["id"]] = true
+	}
+}
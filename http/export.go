@@ -0,0 +1,128 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+)
+
+// parseQueryRange parses the from, until and maxDataPoints parameters
+// the same way as render does, except that from defaults to 24 hours
+// before until and maxDataPoints is optional.
+func parseQueryRange(r *http.Request) (from, to time.Time, points int64, err error) {
+	f, err := parseTime(r.FormValue("from"))
+	if err != nil {
+		return from, to, 0, err
+	}
+	t, err := parseTime(r.FormValue("until"))
+	if err != nil {
+		return from, to, 0, err
+	}
+	if to = time.Now(); t != nil {
+		to = *t
+	}
+	if from = to.Add(-24 * time.Hour); f != nil {
+		from = *f
+	}
+	if s := r.FormValue("maxDataPoints"); s != "" {
+		if points, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return from, to, 0, err
+		}
+	}
+	return from, to, points, nil
+}
+
+// ExportHandler streams the series of one or more targets (with the
+// same parameters as async queries) as an Apache Arrow IPC stream
+// (format=arrow, the default), a format which pandas (via pyarrow),
+// Spark and other analytics tools read natively. Each row is a
+// target, a timestamp and a value. Parquet is not supported because,
+// unlike an Arrow stream, it cannot be written without buffering the
+// whole result, convert the stream with pyarrow if needed.
+func ExportHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+		if format := r.FormValue("format"); format != "" && format != "arrow" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("unsupported format: %q", format), Hint: "supported formats: arrow"})
+			return
+		}
+		targets := r.Form["target"]
+		if len(targets) == 0 {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "at least one target is required"})
+			return
+		}
+		from, to, points, err := parseQueryRange(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
+			return
+		}
+		nulls, err := rrd.ParseNullPolicy(r.FormValue("nulls"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+
+		// Evaluate all the targets first, so that an error can still
+		// be reported with a proper status.
+		var sms []dsl.SeriesMap
+		fetcher := tenantFetcher(r, rcache)
+		for _, target := range targets {
+			sm, err := processTarget(fetcher, target, from, to, points, dsl.CompatNative, nulls)
+			if err != nil {
+				for _, sm := range sms {
+					for _, s := range sm {
+						s.Close()
+					}
+				}
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTarget, Message: err.Error(), Target: target, Hint: hintTarget})
+				return
+			}
+			sms = append(sms, sm)
+		}
+
+		w.Header().Set("Content-Type", arrowContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="export.arrows"`)
+		aw := newArrowWriter(newStreamWriter(w))
+		for _, seriesMap := range sms {
+			for _, name := range seriesMap.SortedKeys() {
+				series := seriesMap[name]
+				if alias := series.Alias(); alias != "" {
+					name = alias
+				}
+				for series.Next() {
+					begin := series.CurrentTime().Add(-series.Step()) // beginning of the point, like render
+					if begin.Unix() > 0 {
+						aw.append(name, begin.UnixNano()/1e6, series.CurrentValue())
+					}
+				}
+				series.Close()
+			}
+		}
+		if err := aw.close(); err != nil {
+			log.Printf("ExportHandler(): error writing response: %v", err)
+		}
+	}
+}
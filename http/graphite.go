@@ -18,6 +18,7 @@
 package http
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"math"
@@ -29,12 +30,13 @@ import (
 
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
 )
 
 func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "[\n")
-		nodes := rcache.FsFind(r.FormValue("query"))
+		nodes := tenantFetcher(r, rcache).FsFind(r.FormValue("query"))
 		for n, node := range nodes {
 			parts := strings.Split(node.Name, ".")
 			if node.Leaf {
@@ -50,20 +52,25 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	}
 }
 
+// renderSlowLog is how long a render may take before it is logged,
+// with its canonical targets (see dsl.Canonical()).
+var renderSlowLog = 5 * time.Second
+
 func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 
+	cache := newRenderCache()
+
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		start := time.Now()
 		from, err := parseTime(r.FormValue("from"))
 		if err != nil {
-			log.Printf("RenderHandler(): (from) %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
 			return
 		}
 		to, err := parseTime(r.FormValue("until"))
 		if err != nil {
-			log.Printf("RenderHandler(): (unitl) %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
 			return
 		} else if to == nil {
 			tmp := time.Now()
@@ -71,21 +78,69 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 		}
 		points, err := strconv.Atoi(r.FormValue("maxDataPoints"))
 		if err != nil {
-			log.Printf("RenderHandler(): (maxDataPoints) %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("invalid maxDataPoints: %v", err), Hint: "maxDataPoints is a required integer"})
 			return
 		}
 
-		fmt.Fprintf(w, "[")
+		// compat=0.9|1.0|1.1 renders as that graphite-web version
+		// would, see dsl.ParseCompat().
+		compat, err := dsl.ParseCompat(r.FormValue("compat"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
 
-		for tn, target := range r.Form["target"] {
+		// nulls=null|zero|drop is how unknown values are rendered,
+		// see rrd.NullPolicy.
+		nulls, err := rrd.ParseNullPolicy(r.FormValue("nulls"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
 
-			seriesMap, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(points))
+		// A response is cached (in-process, as well as downstream,
+		// see renderCacheControl()) by its canonical targets, so
+		// that e.g. sumSeries(b,a) is the same as sumSeries(a, b).
+		targets := r.Form["target"]
+		canonical, cacheable := canonicalTargets(targets)
+		if !cacheable {
+			canonical = targets // for the log, evaluating will fail
+		}
+		key := renderCacheKey(TenantFromRequest(r).Namespace(), canonical, r.FormValue("from"), r.FormValue("until"),
+			r.FormValue("maxDataPoints"), r.FormValue("compat"), r.FormValue("nulls"))
+		if cacheable {
+			if e := cache.get(key, start); e != nil {
+				w.Header().Set("Cache-Control", e.cacheControl)
+				w.Write(e.body)
+				return
+			}
+		}
 
+		// Evaluate all the targets first, so that an error can still
+		// be reported with a proper status.
+		fetcher := tenantFetcher(r, rcache)
+		sms := make([]dsl.SeriesMap, 0, len(targets))
+		for _, target := range targets {
+			seriesMap, err := processTarget(fetcher, target, *from, *to, int64(points), compat, nulls)
 			if err != nil {
-				log.Printf("RenderHandler(): %v", err)
-				break // Graphite behaviour is empty list
+				for _, sm := range sms {
+					for _, s := range sm {
+						s.Close()
+					}
+				}
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTarget, Message: err.Error(), Target: target, Hint: hintTarget})
+				return
 			}
+			sms = append(sms, seriesMap)
+		}
+
+		cacheControl := renderCacheControl(r.FormValue("from"), r.FormValue("until"), *to, time.Now())
+		w.Header().Set("Cache-Control", cacheControl)
+
+		out := &bytes.Buffer{}
+		fmt.Fprintf(out, "[")
+
+		for tn, seriesMap := range sms {
 
 			nn := 0
 			for _, name := range seriesMap.SortedKeys() {
@@ -96,37 +151,146 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 					name = alias
 				}
 
-				fmt.Fprintf(w, "\n"+`{"target": "%s", "datapoints": [`+"\n", name)
+				fmt.Fprintf(out, "\n"+`{"target": "%s", "datapoints": [`+"\n", name)
 
 				n := 0
 				for series.Next() {
 					if n > 0 {
-						fmt.Fprintf(w, ",")
+						fmt.Fprintf(out, ",")
 					}
 					value := series.CurrentValue()
-					ts := series.CurrentTime().Add(-series.Step()).Unix() // NOTE: Graphite protocol marks the *beginning* of the point
-					if ts > 0 {
+					begin := series.CurrentTime().Add(-series.Step()) // NOTE: Graphite protocol marks the *beginning* of the point
+					if ts := epochString(begin); begin.Unix() > 0 {
 						if math.IsNaN(value) || math.IsInf(value, 0) {
-							fmt.Fprintf(w, "[null, %v]", ts)
+							fmt.Fprintf(out, "[null, %v]", ts)
 						} else {
-							fmt.Fprintf(w, "[%v, %v]", value, ts)
+							fmt.Fprintf(out, "[%v, %v]", value, ts)
 						}
 						n++
 					}
 				}
-				if nn < len(seriesMap)-1 || tn < len(r.Form["target"])-1 {
-					fmt.Fprintf(w, "]},\n")
+				if nn < len(seriesMap)-1 || tn < len(sms)-1 {
+					fmt.Fprintf(out, "]},\n")
 				} else {
-					fmt.Fprintf(w, "]}")
+					fmt.Fprintf(out, "]}")
 				}
 				series.Close()
 				nn++
 			}
 		}
-		fmt.Fprintf(w, "]\n")
+		fmt.Fprintf(out, "]\n")
+		w.Write(out.Bytes())
+
+		if cacheable {
+			cache.set(key, &renderCacheEntry{body: out.Bytes(), cacheControl: cacheControl,
+				expires: start.Add(renderMaxAge(r.FormValue("from"), r.FormValue("until"), *to, start))}, start)
+		}
+		if elapsed := time.Since(start); elapsed > renderSlowLog {
+			log.Printf("GraphiteRenderHandler: slow render (%v, %d bytes): %s", elapsed, out.Len(), strings.Join(canonical, " "))
+		}
+	}
+}
+
+// renderEstimate is the response of /render/estimate.
+type renderEstimate struct {
+	dsl.Estimate
+	Targets []targetEstimate `json:"targets"`
+}
+
+type targetEstimate struct {
+	Target string `json:"target"`
+	dsl.Estimate
+}
+
+// GraphiteRenderEstimateHandler takes the same parameters as
+// /render (maxDataPoints is optional) and reports how many series
+// and (approximately) data points rendering it would fetch, without
+// fetching any data. This way the cost of a query can be assessed
+// before it is made. Series matched by more than one target are
+// counted once in the totals.
+func GraphiteRenderEstimateHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to, err := parseTime(r.FormValue("until"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
+			return
+		} else if to == nil {
+			tmp := time.Now()
+			to = &tmp
+		}
+		from, err := parseTime(r.FormValue("from"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
+			return
+		} else if from == nil {
+			tmp := to.Add(-24 * time.Hour) // as graphite-web
+			from = &tmp
+		}
+		var points int
+		if mdp := r.FormValue("maxDataPoints"); mdp != "" {
+			if points, err = strconv.Atoi(mdp); err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("invalid maxDataPoints: %v", err)})
+				return
+			}
+		}
+
+		// Evaluating all the targets as one gives the totals
+		// without counting a series twice.
+		targets := r.Form["target"]
+		fetcher := tenantFetcher(r, rcache)
+		result := &renderEstimate{Targets: make([]targetEstimate, 0, len(targets))}
+		queries := make([]string, 0, len(targets))
+		for _, target := range targets {
+			query := renderQuery(target)
+			est, err := dsl.EstimateDsl(fetcher, query, *from, *to, int64(points))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTarget, Message: err.Error(), Target: target, Hint: hintTarget})
+				return
+			}
+			result.Targets = append(result.Targets, targetEstimate{Target: target, Estimate: *est})
+			queries = append(queries, query)
+		}
+		if len(queries) > 0 {
+			est, err := dsl.EstimateDsl(fetcher, fmt.Sprintf("group(%s)", strings.Join(queries, ",")), *from, *to, int64(points))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTarget, Message: err.Error(), Hint: hintTarget})
+				return
+			}
+			result.Estimate = *est
+		}
+		writeJSON(w, http.StatusOK, result)
 	}
 }
 
+// Cache lifetimes of render responses, see renderCacheControl().
+var (
+	renderRecentMaxAge     = 10 * time.Second
+	renderHistoricalMaxAge = 7 * 24 * time.Hour
+	renderHistoricalAge    = time.Hour
+)
+
+// renderCacheControl returns the Cache-Control header value for a
+// render request, so that a cache in front of us (a CDN, nginx, etc)
+// can safely cache the response. A range given in absolute times
+// which ends more than renderHistoricalAge ago is historical, its
+// data will not change and it can be cached for a long time. A range
+// which includes the present, or is relative to it (and therefore
+// moves with time) should only be cached very briefly.
+func renderCacheControl(from, until string, to, now time.Time) string {
+	return fmt.Sprintf("public, max-age=%d", int(renderMaxAge(from, until, to, now).Seconds()))
+}
+
+// renderMaxAge is the max-age of renderCacheControl().
+func renderMaxAge(from, until string, to, now time.Time) time.Duration {
+	relative := func(s string) bool {
+		return s == "" || s[0] == '-' || strings.HasPrefix(s, "now")
+	}
+	if relative(from) || relative(until) || to.After(now.Add(-renderHistoricalAge)) {
+		return renderRecentMaxAge
+	}
+	return renderHistoricalMaxAge
+}
+
 func parseTime(s string) (*time.Time, error) {
 
 	if len(s) == 0 {
@@ -141,12 +305,18 @@ func parseTime(s string) (*time.Time, error) {
 			return nil, fmt.Errorf("parseTime(): Error parsing relative time %q: %v", s, err)
 		}
 	} else { // absolute
-		if s == "now" {
-			t := time.Now()
+		if strings.HasPrefix(s, "now") { // e.g. now-1bd/d, see dsl.ParseTimeSpec()
+			t, err := dsl.ParseTimeSpec(s, time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("parseTime(): Error parsing time %q: %v", s, err)
+			}
 			return &t, nil
 		} else if i, err := strconv.ParseInt(s, 10, 64); err == nil {
 			t := time.Unix(i, 0)
 			return &t, nil
+		} else if f, ferr := strconv.ParseFloat(s, 64); ferr == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			t := time.Unix(0, int64(math.Round(f*1e3))*int64(time.Millisecond)) // e.g. 1500000000.25
+			return &t, nil
 		} else {
 			return nil, fmt.Errorf("parseTime(): Error parsing absolute time %q: %v", s, err)
 		}
@@ -170,9 +340,27 @@ func quoteIdentifiers(target string) string {
 	return result
 }
 
-func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64) (dsl.SeriesMap, error) {
+// processTarget evaluates a graphite target, compat is the
+// graphite-web version to mimic, see dsl.ParseDslCompat(), nulls how
+// unknown values are treated, see dsl.ParseDslNulls().
+func processTarget(rcache dsl.NamedDSFetcher, target string, from, to time.Time, maxPoints int64, compat string, nulls rrd.NullPolicy) (dsl.SeriesMap, error) {
+	return dsl.ParseDslNulls(rcache, renderQuery(target), from, to, maxPoints, compat, nulls)
+}
+
+// epochString formats t as seconds since the epoch, with a fraction
+// (to the millisecond) only if t is not on a whole second, which is
+// only the case for series with a sub-second step.
+func epochString(t time.Time) string {
+	ms := t.Round(time.Millisecond).UnixNano() / 1e6
+	if ms%1000 == 0 {
+		return strconv.FormatInt(ms/1000, 10)
+	}
+	return strconv.FormatFloat(float64(ms)/1e3, 'f', -1, 64)
+}
+
+// renderQuery returns the DSL expression of a render target.
+func renderQuery(target string) string {
 	target = quoteIdentifiers(target)
 	// In our DSL everything must be a function call, so we wrap everything in group()
-	query := fmt.Sprintf("group(%s)", target)
-	return dsl.ParseDsl(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints)
+	return fmt.Sprintf("group(%s)", target)
 }
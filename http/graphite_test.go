@@ -0,0 +1,141 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+func Test_renderCacheControl(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	const (
+		recent     = "public, max-age=10"
+		historical = "public, max-age=604800"
+	)
+	for _, c := range []struct {
+		desc, from, until string
+		to                time.Time
+		exp               string
+	}{
+		{"absolute past range", "1499900000", "1499990000", time.Unix(1499990000, 0), historical},
+		{"absolute range ending just over an hour ago", "1499990000", "1499996399", time.Unix(1499996399, 0), historical},
+		{"absolute range ending within the hour", "1499990000", "1499997000", time.Unix(1499997000, 0), recent},
+		{"absolute range ending now", "1499990000", "1500000000", now, recent},
+		{"absolute range ending in the future", "1499990000", "1500003600", now.Add(time.Hour), recent},
+		{"relative from", "-1d", "1499990000", time.Unix(1499990000, 0), recent},
+		{"now-based from", "now-1d", "1499990000", time.Unix(1499990000, 0), recent},
+		{"no until", "1499900000", "", now, recent},
+		{"relative until", "1499900000", "-2d", now.Add(-48 * time.Hour), recent},
+		{"no range", "", "", now, recent},
+	} {
+		if got := renderCacheControl(c.from, c.until, c.to, now); got != c.exp {
+			t.Errorf("renderCacheControl: %s: expected %q, got %q", c.desc, c.exp, got)
+		}
+	}
+}
+
+// countingFetcher counts the series fetched.
+type countingFetcher struct {
+	dsl.NamedDSFetcher
+	n int32
+}
+
+func (f *countingFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	atomic.AddInt32(&f.n, 1)
+	return f.NamedDSFetcher.FetchSeries(ds, from, to, maxPoints)
+}
+
+func Test_GraphiteRenderHandler_cache(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Minute,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}}}
+	for _, name := range []string{"foo.a", "foo.b"} {
+		if _, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatalf("FetchOrCreateDataSource: %v", err)
+		}
+	}
+	rcache := &countingFetcher{NamedDSFetcher: dsl.NewNamedDSFetcher(db.Fetcher())}
+	srv := httptest.NewServer(GraphiteRenderHandler(rcache))
+	defer srv.Close()
+
+	render := func(target, from string) string {
+		resp, err := http.Get(srv.URL + "?" + url.Values{"target": {target}, "from": {from}, "maxDataPoints": {"100"}}.Encode())
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("render %s: status %d: %s", target, resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	exp := render("sumSeries(foo.a,foo.b)", "-1h")
+	fetched := atomic.LoadInt32(&rcache.n)
+	if fetched == 0 {
+		t.Fatalf("render: nothing fetched")
+	}
+	// Another spelling of the same query is the same response, from
+	// the cache.
+	if got := render(`sumSeries( "foo.b", foo.a )`, "-1h"); got != exp {
+		t.Errorf("render: another spelling rendered differently:\n%s\n%s", exp, got)
+	}
+	if n := atomic.LoadInt32(&rcache.n); n != fetched {
+		t.Errorf("render: another spelling was not served from the cache (%d fetches, expected %d)", n, fetched)
+	}
+	// Another range is not.
+	render("sumSeries(foo.a,foo.b)", "-2h")
+	if n := atomic.LoadInt32(&rcache.n); n == fetched {
+		t.Errorf("render: another range was served from the cache")
+	}
+}
+
+func Test_renderCache(t *testing.T) {
+	c := newRenderCache()
+	now := time.Now()
+	c.set("k", &renderCacheEntry{body: []byte("x"), expires: now.Add(time.Second)}, now)
+	if e := c.get("k", now); e == nil || string(e.body) != "x" {
+		t.Errorf("renderCache: get: %v", e)
+	}
+	if e := c.get("k", now.Add(time.Second)); e != nil {
+		t.Errorf("renderCache: expired entry returned")
+	}
+	c.set("big", &renderCacheEntry{body: make([]byte, renderCacheMaxBody+1), expires: now.Add(time.Second)}, now)
+	if e := c.get("big", now); e != nil {
+		t.Errorf("renderCache: a body over renderCacheMaxBody was cached")
+	}
+	for i := 0; i < renderCacheSize*2; i++ {
+		c.set(string(rune(i)), &renderCacheEntry{expires: now.Add(time.Second)}, now)
+	}
+	if len(c.entries) > renderCacheSize {
+		t.Errorf("renderCache: %d entries, more than %d", len(c.entries), renderCacheSize)
+	}
+	if renderCacheKey("a.", []string{"x"}, "-1h") == renderCacheKey("b.", []string{"x"}, "-1h") {
+		t.Errorf("renderCacheKey: tenants share a key")
+	}
+}
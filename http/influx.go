@@ -0,0 +1,63 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/receiver"
+)
+
+// InfluxWriteHandler accepts the InfluxDB line protocol, like the
+// /write endpoint of InfluxDB, so that e.g. Telegraf can write
+// directly to Tgres. The precision parameter is supported, the
+// others (db, rp, etc) are ignored. Series are named according to
+// tmpl.
+func InfluxWriteHandler(rcvr *receiver.Receiver, tmpl *influx.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		precision, err := influx.Precision(r.FormValue("precision"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(), Hint: "precision is one of ns, u, ms, s, m or h"})
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		if _, err := influx.Read(body, precision, tmpl, tenantQueue(r, rcvr.QueueDataPoint)); err != nil {
+			// the lines which could be parsed were written,
+			// which InfluxDB calls a partial write
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrPartialWrite, Message: "partial write: " + err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,50 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import "net/http"
+
+// Info describes the build and capabilities of a Tgres instance, so
+// that client tools (and other nodes) can adapt to its version
+// rather than guess. Fields are only ever added.
+type Info struct {
+	Version     string `json:"version"`
+	GitRevision string `json:"gitRevision,omitempty"`
+	BuildTime   string `json:"buildTime,omitempty"`
+	GoVersion   string `json:"goVersion"`
+
+	// The storage backend, e.g. "postgres".
+	Serde string `json:"serde"`
+
+	// Features this build supports, e.g. "cluster-tags". A feature
+	// which is not listed is not supported.
+	Features []string `json:"features"`
+
+	// Protocol versions, e.g. "cluster" is the cluster protocol
+	// version and "clusterMin" the oldest one it still supports.
+	Protocols map[string]int `json:"protocols"`
+
+	// Ingestion protocols and whether they are enabled (listening)
+	// on this instance.
+	Ingest map[string]bool `json:"ingest"`
+}
+
+// InfoHandler returns info as JSON.
+func InfoHandler(info *Info) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, info)
+	}
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+// MetricsHandler returns the DSL function statistics in the
+// Prometheus text format, so that which functions dominate the cost
+// of rendering (and which unimplemented ones are asked for) can be
+// scraped.
+func MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := dsl.FuncStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintf(w, "# HELP tgres_dsl_function_calls_total DSL function calls.\n")
+		fmt.Fprintf(w, "# TYPE tgres_dsl_function_calls_total counter\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "tgres_dsl_function_calls_total{function=%s,unknown=\"%v\"} %d\n", strconv.Quote(st.Name), st.Unknown, st.Calls)
+		}
+		fmt.Fprintf(w, "# HELP tgres_dsl_function_errors_total DSL function calls which returned an error.\n")
+		fmt.Fprintf(w, "# TYPE tgres_dsl_function_errors_total counter\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "tgres_dsl_function_errors_total{function=%s,unknown=\"%v\"} %d\n", strconv.Quote(st.Name), st.Unknown, st.Errors)
+		}
+		fmt.Fprintf(w, "# HELP tgres_dsl_function_seconds_total Time spent in DSL function calls.\n")
+		fmt.Fprintf(w, "# TYPE tgres_dsl_function_seconds_total counter\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "tgres_dsl_function_seconds_total{function=%s,unknown=\"%v\"} %g\n", strconv.Quote(st.Name), st.Unknown, st.Duration.Seconds())
+		}
+	}
+}
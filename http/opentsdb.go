@@ -0,0 +1,76 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/tgres/tgres/opentsdb"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// OpenTSDBPutHandler accepts the JSON body of the OpenTSDB /api/put
+// endpoint. Tags are flattened into series names according to tags.
+// As in OpenTSDB, with the summary or details parameter the numbers
+// of successful and failed data points are returned.
+func OpenTSDBPutHandler(rcvr *receiver.Receiver, tags opentsdb.TagPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		points, errs, err := opentsdb.DecodePut(body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: "the body must be a JSON data point or an array of them"})
+			return
+		}
+		for _, p := range points {
+			rcvr.QueueDataPoint(serde.Ident{"name": tenantName(r, tags.Name(p))}, p.Time, p.Value)
+		}
+
+		if len(errs) > 0 {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrPartialWrite,
+				Message: fmt.Sprintf("%d data points failed, %d succeeded, the first error: %v", len(errs), len(points), errs[0])})
+			return
+		}
+		if _, ok := r.URL.Query()["summary"]; ok {
+			writeJSON(w, http.StatusOK, map[string]int{"success": len(points), "failed": 0})
+			return
+		}
+		if _, ok := r.URL.Query()["details"]; ok {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"success": len(points), "failed": 0, "errors": []string{}})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
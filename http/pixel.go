@@ -77,7 +77,7 @@ func PixelHandler(rcvr *receiver.Receiver) http.HandlerFunc {
 					ts = time.Unix(int64(ut), nsec)
 				}
 
-				rcvr.QueueDataPoint(serde.Ident{"name": misc.SanitizeName(name)}, ts, val)
+				rcvr.QueueDataPoint(serde.Ident{"name": tenantName(r, misc.SanitizeName(name))}, ts, val)
 			}
 		}
 
@@ -137,7 +137,7 @@ func pixelAggHandler(r *http.Request, w http.ResponseWriter, rcvr *receiver.Rece
 			}
 
 			// TODO Should use Ident
-			rcvr.QueueAggregatorCommand(aggregator.NewCommand(cmd, serde.Ident{"name": misc.SanitizeName(name)}, val))
+			rcvr.QueueAggregatorCommand(aggregator.NewCommand(cmd, serde.Ident{"name": tenantName(r, misc.SanitizeName(name))}, val))
 		}
 	}
 
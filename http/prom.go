@@ -0,0 +1,78 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/prom"
+	"github.com/tgres/tgres/receiver"
+)
+
+// PromWriteHandler accepts the Prometheus remote_write protocol, so
+// that Prometheus can use Tgres as long-term storage. Series are
+// named by prom.Name().
+func PromWriteHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		if _, err := prom.Read(r.Body, tenantQueue(r, rcvr.QueueDataPoint)); err != nil {
+			// nothing was written, a 4xx tells Prometheus not to retry
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: "the body must be a snappy-compressed protobuf WriteRequest"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PromReadHandler implements the Prometheus remote_read protocol.
+// The matchers of a query are applied to the label sets recovered
+// from the series names (see prom.Labels()), so only series written
+// via remote_write (or named the same way) can be read. Every query
+// needs a metric name matcher and may match at most
+// prom.MaxQuerySeries series.
+func PromReadHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		queries, err := prom.ReadQueries(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: "the body must be a snappy-compressed protobuf ReadRequest"})
+			return
+		}
+		results := make([][]prom.TimeSeries, len(queries))
+		fetcher := tenantFetcher(r, rcache)
+		for i, q := range queries {
+			if results[i], err = q.Execute(fetcher); err == prom.ErrTooManySeries {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			} else if err != nil {
+				writeError(w, r, http.StatusInternalServerError, Error{Code: ErrInternal, Message: err.Error()})
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(prom.EncodeReadResponse(results))
+	}
+}
@@ -0,0 +1,107 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+const (
+	// maximum number of responses in a renderCache
+	renderCacheSize = 1024
+	// responses larger than this are not cached
+	renderCacheMaxBody = 1 << 20
+)
+
+// renderCache keeps render responses for as long as the Cache-Control
+// header sent with them allows a cache in front of us to, so that
+// e.g. a dashboard reloaded by several people is only evaluated
+// once. It is keyed by renderCacheKey().
+type renderCache struct {
+	sync.Mutex
+	entries map[string]*renderCacheEntry
+}
+
+type renderCacheEntry struct {
+	body         []byte
+	cacheControl string
+	expires      time.Time
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{entries: make(map[string]*renderCacheEntry)}
+}
+
+func (c *renderCache) get(key string, now time.Time) *renderCacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[key]
+	if e == nil || !now.Before(e.expires) {
+		return nil
+	}
+	return e
+}
+
+func (c *renderCache) set(key string, e *renderCacheEntry, now time.Time) {
+	if len(e.body) > renderCacheMaxBody {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= renderCacheSize {
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full, make room at random.
+		for k := range c.entries {
+			if len(c.entries) < renderCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// canonicalTargets returns the dsl.Canonical() form of the render
+// targets, and false if any cannot be parsed.
+func canonicalTargets(targets []string) ([]string, bool) {
+	result := make([]string, 0, len(targets))
+	for _, target := range targets {
+		c, err := dsl.Canonical(renderQuery(target))
+		if err != nil {
+			return nil, false
+		}
+		result = append(result, c)
+	}
+	return result, true
+}
+
+// renderCacheKey returns the key of a render response: the canonical
+// targets and every other parameter which affects the response, as
+// given (so that a relative range such as from=-1h is the same key,
+// for as long as the response is fresh). The namespace of the tenant
+// is part of it, since the same targets are other series for another
+// tenant.
+func renderCacheKey(namespace string, canonical []string, params ...string) string {
+	return namespace + "\x00" + strings.Join(params, "\x00") + "\x00" + strings.Join(canonical, "\x00")
+}
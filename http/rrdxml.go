@@ -0,0 +1,102 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrdxml"
+	"github.com/tgres/tgres/serde"
+)
+
+// RRDToolImportHandler imports the XML of "rrdtool dump", which is
+// the body. Each DS of the RRD becomes a series named prefix.ds,
+// where prefix is a parameter. Series which do not exist are created
+// with the RRAs of the RRD (see receiver.Backfill). It responds with
+// the names of the series.
+func RRDToolImportHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		prefix := r.FormValue("prefix")
+		if prefix == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "prefix is required"})
+			return
+		}
+
+		x, err := rrdxml.Read(http.MaxBytesReader(w, r.Body, maxImportFileSize))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be the output of "rrdtool dump"`})
+			return
+		}
+		var (
+			batch = make([]receiver.BackfillSeries, 0, len(x.DSs))
+			names = make([]string, 0, len(x.DSs))
+		)
+		for n, d := range x.DSs {
+			spec, err := x.DSSpec(n)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			}
+			name := misc.SanitizeName(prefix + "." + d.Name)
+			batch = append(batch, receiver.BackfillSeries{Ident: serde.Ident{"name": name}, Spec: spec})
+			names = append(names, name)
+		}
+		if _, err := rcvr.Backfill(batch); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"series": names})
+	}
+}
+
+// RRDToolExportHandler responds with the series given by the name
+// parameter as the XML of "rrdtool dump", which "rrdtool restore"
+// can load. The DS is named after the ds parameter (default value).
+func RRDToolExportHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "series name is required"})
+			return
+		}
+		dsName := r.FormValue("ds")
+		if dsName == "" {
+			dsName = "value"
+		}
+
+		ds, err := rcvr.ExportDataSource(serde.Ident{"name": name})
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, Error{Code: ErrNotFound, Target: name, Message: err.Error()})
+			return
+		}
+		x, err := rrdxml.FromDataSource(ds, dsName)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Target: name, Message: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".xml"))
+		rrdxml.Write(w, x)
+	}
+}
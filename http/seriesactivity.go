@@ -0,0 +1,116 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+const (
+	dftActivityLimit = 100
+	maxActivityLimit = 10000
+)
+
+type seriesActivity struct {
+	Name       string      `json:"name"`
+	Ident      serde.Ident `json:"ident"`
+	Created    *time.Time  `json:"created,omitempty"`    // unknown for older series
+	LastUpdate *time.Time  `json:"lastUpdate,omitempty"` // never updated
+}
+
+type seriesActivityPage struct {
+	Series []seriesActivity `json:"series"`
+	Offset int              `json:"offset"`
+	Limit  int              `json:"limit"`
+	Next   *int             `json:"next,omitempty"` // the offset of the next page, if any
+}
+
+// RecentSeriesHandler lists the series created since the since
+// parameter (default -1d), newest first, e.g. to find out what new
+// cardinality appeared today. The results are paginated by the
+// offset and limit (default 100, at most 10000) parameters.
+func RecentSeriesHandler(sal serde.SeriesActivityLister) http.HandlerFunc {
+	return seriesActivityHandler("since", -24*time.Hour, sal.RecentSeries)
+}
+
+// StaleSeriesHandler lists the series which have not been updated
+// since the before parameter (default -1h), stalest first, i.e. the
+// series which stopped reporting. It is paginated like
+// RecentSeriesHandler.
+func StaleSeriesHandler(sal serde.SeriesActivityLister) http.HandlerFunc {
+	return seriesActivityHandler("before", -time.Hour, sal.StaleSeries)
+}
+
+func seriesActivityHandler(param string, dft time.Duration, list func(time.Time, int, int) ([]serde.SeriesActivity, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now().Add(dft)
+		if pt, err := parseTime(r.FormValue(param)); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadTime, Message: err.Error(), Hint: hintTime})
+			return
+		} else if pt != nil {
+			t = *pt
+		}
+
+		offset, limit := 0, dftActivityLimit
+		for _, p := range []struct {
+			name string
+			v    *int
+		}{{"offset", &offset}, {"limit", &limit}} {
+			if s := r.FormValue(p.name); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: p.name + " must be a non-negative integer"})
+					return
+				}
+				*p.v = n
+			}
+		}
+		if limit == 0 || limit > maxActivityLimit {
+			limit = maxActivityLimit
+		}
+
+		// Ask for one more to know whether there is a next page
+		list, err := list(t, offset, limit+1)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, Error{Code: ErrInternal, Message: err.Error()})
+			return
+		}
+
+		page := seriesActivityPage{Series: make([]seriesActivity, 0, len(list)), Offset: offset, Limit: limit}
+		if len(list) > limit {
+			list = list[:limit]
+			next := offset + limit
+			page.Next = &next
+		}
+		for _, sa := range list {
+			item := seriesActivity{Name: sa.Ident["name"], Ident: sa.Ident}
+			if !sa.Created.IsZero() {
+				created := sa.Created
+				item.Created = &created
+			}
+			if !sa.LastUpdate.IsZero() {
+				lu := sa.LastUpdate
+				item.LastUpdate = &lu
+			}
+			page.Series = append(page.Series, item)
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
@@ -0,0 +1,46 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+type seriesCheck struct {
+	Name      string `json:"name"`
+	Rewritten string `json:"rewritten"`
+	Accepted  bool   `json:"accepted"`
+	Rule      string `json:"rule,omitempty"`
+}
+
+// SeriesCheckHandler reports what the receiver would do with a data
+// point for the series given by the name parameter: what the rewrite
+// rules rename it to and whether the series filter accepts it (and
+// by which rule).
+func SeriesCheckHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "name is required"})
+			return
+		}
+		result := seriesCheck{Name: name}
+		result.Rewritten, result.Accepted, result.Rule = rcvr.CheckSeriesName(name)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
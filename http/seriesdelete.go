@@ -0,0 +1,82 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/receiver"
+)
+
+type seriesDelete struct {
+	Match  string `json:"match"`
+	Regex  bool   `json:"regex"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// SeriesDeleteHandler deletes the series whose name matches a glob
+// (e.g. servers.*.cpu, where * does not match a dot) or, if regex is
+// true, a regular expression (see receiver.MatchSeries). The body is
+// {"match": ..., "regex": false, "dry_run": false}. It responds with
+// the names of the series matched and how many were deleted, none
+// with dry_run.
+func SeriesDeleteHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body seriesDelete
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be {"match": ..., "regex": false, "dry_run": false}`})
+			return
+		}
+		if body.Match == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "match is required"})
+			return
+		}
+
+		// A tenant confined to a namespace only matches (and sees) the
+		// series in it.
+		ns := TenantFromRequest(r).Namespace()
+		match := ns + body.Match
+		if body.Regex && ns != "" {
+			match = dsl.NamespacedRegexp(ns, body.Match)
+		}
+		idents, err := rcvr.MatchSeries(match, body.Regex)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+		names := make([]string, 0, len(idents))
+		for _, ident := range idents {
+			names = append(names, strings.TrimPrefix(ident["name"], ns))
+		}
+		var deleted int
+		if !body.DryRun {
+			if deleted, err = rcvr.DeleteSeries(idents); err != nil {
+				writeError(w, r, http.StatusInternalServerError, Error{Code: ErrInternal, Message: err.Error()})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"series": names, "deleted": deleted})
+	}
+}
@@ -0,0 +1,106 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type seriesRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// SeriesRenameHandler renames a series, keeping its history (see
+// receiver.RenameSeries). The body is {"from": ..., "to": ...}.
+func SeriesRenameHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body seriesRename
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be {"from": ..., "to": ...}`})
+			return
+		}
+		from, to := misc.SanitizeName(body.From), misc.SanitizeName(body.To)
+		if from == "" || to == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "from and to are required"})
+			return
+		}
+
+		if _, err := rcvr.RenameSeries(serde.Ident{"name": tenantName(r, from)}, serde.Ident{"name": tenantName(r, to)}); err != nil {
+			writeError(w, r, http.StatusConflict, Error{Code: ErrConflict, Target: from, Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, seriesRename{From: from, To: to})
+	}
+}
+
+type seriesMerge struct {
+	From   string `json:"from"`
+	Into   string `json:"into"`
+	Policy string `json:"policy"`
+	Delete bool   `json:"delete"`
+}
+
+// SeriesMergeHandler merges the history of a series into another
+// (see receiver.MergeSeries). The body is {"from": ..., "into": ...,
+// "policy": ..., "delete": ...}, where policy is what a slot known
+// in both gets: "keep" (that of into, the default), "replace" (that
+// of from), "min", "max", "sum" or "mean". If delete is true, from is
+// deleted afterwards. It responds with the same, as applied.
+func SeriesMergeHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body seriesMerge
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be {"from": ..., "into": ..., "policy": "keep", "delete": false}`})
+			return
+		}
+		from, into := misc.SanitizeName(body.From), misc.SanitizeName(body.Into)
+		if from == "" || into == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "from and into are required"})
+			return
+		}
+		policy, err := rrd.ParseMergePolicy(body.Policy)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+
+		if _, err := rcvr.MergeSeries(serde.Ident{"name": tenantName(r, into)}, serde.Ident{"name": tenantName(r, from)}, policy, body.Delete); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Target: into, Message: err.Error()})
+			return
+		}
+		body.From, body.Into, body.Policy = from, into, policy.String()
+		writeJSON(w, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type seriesRRAs struct {
+	Name string      `json:"name"`
+	RRAs []dsSpecRRA `json:"rras"`
+}
+
+// SeriesRRAsHandler changes the RRAs of an existing series (see
+// receiver.ChangeRRAs), the existing data is resampled into the new
+// RRAs. The body is {"name": ..., "rras": [...]} where the RRAs are
+// in the same format as in the /api/dsspec response, e.g. {"function":
+// "WMEAN", "step": "1min", "span": "30d", "xff": 0.5}, points is
+// ignored. It responds with the same, as applied.
+func SeriesRRAsHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+
+		var body seriesRRAs
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: `the body must be {"name": ..., "rras": [{"function": ..., "step": ..., "span": ...}, ...]}`})
+			return
+		}
+		name := misc.SanitizeName(body.Name)
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "series name is required"})
+			return
+		}
+
+		specs := make([]rrd.RRASpec, 0, len(body.RRAs))
+		for _, rra := range body.RRAs {
+			spec, err := rra.rraSpec()
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			}
+			specs = append(specs, spec)
+		}
+
+		if _, err := rcvr.ChangeRRAs(serde.Ident{"name": name}, specs); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Target: name, Message: err.Error()})
+			return
+		}
+
+		resp := seriesRRAs{Name: name, RRAs: make([]dsSpecRRA, 0, len(specs))}
+		for _, spec := range specs {
+			resp.RRAs = append(resp.RRAs, newDsSpecRRA(spec))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,57 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// streamWriteTimeout is how long a single write of a streamed
+// response may take, see newStreamWriter().
+var streamWriteTimeout = 30 * time.Second
+
+// streamWriter pushes the write deadline of the connection forward
+// before every write.
+type streamWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+// newStreamWriter returns a writer for a response which may take
+// longer than the WriteTimeout of the server (e.g. an export or the
+// download of an async result), which would otherwise cut it off
+// mid-stream. The deadline is extended by streamWriteTimeout on every
+// write, so that a client which stops reading still times out.
+func newStreamWriter(w http.ResponseWriter) io.Writer {
+	sw := &streamWriter{w: w, rc: http.NewResponseController(w)}
+	sw.extend()
+	return sw
+}
+
+func (sw *streamWriter) extend() {
+	if err := sw.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("streamWriter: error setting the write deadline: %v", err)
+	}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.extend()
+	return sw.w.Write(p)
+}
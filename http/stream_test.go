@@ -0,0 +1,82 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// slowFetcher takes delay to fetch a series.
+type slowFetcher struct {
+	dsl.NamedDSFetcher
+	delay time.Duration
+}
+
+func (f *slowFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	time.Sleep(f.delay)
+	return f.NamedDSFetcher.FetchSeries(ds, from, to, maxPoints)
+}
+
+func Test_ExportHandler_writeTimeout(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Minute,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}}}
+	for _, name := range []string{"foo.a", "foo.b", "foo.c"} {
+		if _, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatalf("FetchOrCreateDataSource: %v", err)
+		}
+	}
+	rcache := &slowFetcher{NamedDSFetcher: dsl.NewNamedDSFetcher(db.Fetcher()), delay: 50 * time.Millisecond}
+
+	get := func(writeTimeout time.Duration) ([]byte, error) {
+		srv := httptest.NewUnstartedServer(ExportHandler(rcache))
+		srv.Config.WriteTimeout = writeTimeout
+		srv.Start()
+		defer srv.Close()
+		resp, err := http.Get(srv.URL + "?" + url.Values{"target": {"foo.*"}, "from": {"-1h"}}.Encode())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("export: status %d", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	exp, err := get(0)
+	if err != nil || len(exp) == 0 {
+		t.Fatalf("export without a write timeout: %v (%d bytes)", err, len(exp))
+	}
+	// Fetching takes 150ms, three times the WriteTimeout.
+	got, err := get(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("export past the write timeout: %v", err)
+	}
+	if string(got) != string(exp) {
+		t.Errorf("export past the write timeout: expected %d bytes, got %d", len(exp), len(got))
+	}
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/whisper"
+)
+
+// Imported files (whisper, RRD dumps) can be large, but are read
+// into memory.
+const maxImportFileSize = 256 << 20
+
+// WhisperImportHandler imports a whisper (Graphite) file, which is
+// the body, into the series given by the name parameter (see
+// receiver.Backfill). A series which does not exist is created with
+// the retentions of the file. It responds with the number of points
+// used.
+func WhisperImportHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusMethodNotAllowed, Error{Code: ErrMethod, Message: "POST required"})
+			return
+		}
+		name := misc.SanitizeName(r.FormValue("name"))
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "series name is required"})
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportFileSize))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+			return
+		}
+		hdr, history, err := whisper.History(bytes.NewReader(body))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error(),
+				Hint: "the body must be a whisper (.wsp) file"})
+			return
+		}
+
+		bs := receiver.BackfillSeries{Ident: serde.Ident{"name": name}, Spec: hdr.DSSpec()}
+		for _, p := range history {
+			bs.Points = append(bs.Points, receiver.BackfillPoint{TimeStamp: p.TimeStamp, Value: p.Value})
+		}
+		n, err := rcvr.Backfill([]receiver.BackfillSeries{bs})
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Target: name, Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"points": n})
+	}
+}
+
+// WhisperExportHandler responds with the series given by the name
+// parameter as a whisper (Graphite) file. Whisper has a single
+// aggregation method, so only the RRAs with the consolidation
+// function cf (default WMEAN) are included. The xFilesFactor of the
+// file is xff (default 0.5).
+func WhisperExportHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: "series name is required"})
+			return
+		}
+		cf := rrd.WMEAN
+		if s := r.FormValue("cf"); s != "" {
+			var err error
+			if cf, err = rrd.ParseConsolidation(s); err != nil {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: err.Error()})
+				return
+			}
+		}
+		xff := 0.5
+		if s := r.FormValue("xff"); s != "" {
+			var err error
+			if xff, err = strconv.ParseFloat(s, 32); err != nil || xff < 0 || xff > 1 {
+				writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Message: fmt.Sprintf("invalid xff: %q", s)})
+				return
+			}
+		}
+
+		ds, err := rcvr.ExportDataSource(serde.Ident{"name": name})
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, Error{Code: ErrNotFound, Target: name, Message: err.Error()})
+			return
+		}
+		var buf bytes.Buffer
+		if err := whisper.FromRRAs(&buf, ds.RRAs(), cf, float32(xff)); err != nil {
+			writeError(w, r, http.StatusBadRequest, Error{Code: ErrBadRequest, Target: name, Message: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".wsp"))
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,289 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package influx parses the InfluxDB line protocol (as sent by
+// e.g. Telegraf) and maps its points to series names.
+package influx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+)
+
+// A Point is a line of the line protocol, e.g.:
+//
+//	cpu,host=web01,region=us usage_user=12.5,usage_system=3i 1500000000000000000
+//
+// Only numeric and boolean (as 1 or 0) fields are kept, string
+// fields cannot be stored in a series.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+// ParseLine parses a line. The timestamp, if any, is in units of
+// precision (nanoseconds if zero), if there isn't one the point is
+// at now.
+func ParseLine(line string, precision time.Duration, now time.Time) (*Point, error) {
+	measurement, rest := nextToken(line, ' ', false)
+	if measurement == "" || rest == "" {
+		return nil, fmt.Errorf("no fields in line: %q", line)
+	}
+	fields, ts := nextToken(rest, ' ', true)
+
+	p := &Point{Tags: make(map[string]string), Fields: make(map[string]float64), Time: now}
+
+	name, tags := nextToken(measurement, ',', false)
+	p.Measurement = unescape(name)
+	for tags != "" {
+		var tag string
+		tag, tags = nextToken(tags, ',', false)
+		k, v := nextToken(tag, '=', false)
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid tag %q in line: %q", tag, line)
+		}
+		p.Tags[unescape(k)] = unescape(v)
+	}
+
+	for fields != "" {
+		var field string
+		field, fields = nextToken(fields, ',', true)
+		k, v := nextToken(field, '=', false)
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid field %q in line: %q", field, line)
+		}
+		if v[0] == '"' {
+			continue // a string
+		}
+		value, err := parseValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q in line: %q: %v", field, line, err)
+		}
+		p.Fields[unescape(k)] = value
+	}
+
+	if ts = strings.TrimSpace(ts); ts != "" {
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp in line: %q", line)
+		}
+		if precision == 0 {
+			precision = time.Nanosecond
+		}
+		p.Time = time.Unix(0, n*int64(precision))
+	}
+	return p, nil
+}
+
+// Precision returns the duration of a precision as given to the
+// /write endpoint, e.g. "ms". Blank means nanoseconds.
+func Precision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", s)
+}
+
+func parseValue(v string) (float64, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	if last := v[len(v)-1]; last == 'i' || last == 'u' { // integer
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(n), err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		err = fmt.Errorf("not a number: %s", v)
+	}
+	return f, err
+}
+
+// nextToken returns s up to the first unescaped sep (outside double
+// quotes if quotes, as in string field values) and the remainder of s
+// after it.
+func nextToken(s string, sep byte, quotes bool) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = quotes && !quoted
+		case sep:
+			if !quoted {
+				return s[:i], s[i+1:]
+			}
+		}
+	}
+	return s, ""
+}
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`).Replace(s)
+}
+
+// DefaultTemplate is the same as the default of the Telegraf graphite
+// output.
+const DefaultTemplate = "host.tags.measurement.field"
+
+// A Template maps a point to series names. It is a dot-separated
+// list of parts, each of which is "measurement", "field", "tags"
+// (the values of all the tags not otherwise named in the template,
+// sorted by tag key) or the name of a tag. Parts which are empty for
+// a point are left out, as is a field named "value".
+//
+// For example, with the template "host.tags.measurement.field" the
+// line
+//
+//	cpu,host=web01,region=us usage_user=12.5,usage_system=3
+//
+// becomes the series web01.us.cpu.usage_user and
+// web01.us.cpu.usage_system.
+type Template struct {
+	parts []string
+	named map[string]bool // tags named in parts
+}
+
+// NewTemplate parses a template, blank means DefaultTemplate.
+func NewTemplate(s string) (*Template, error) {
+	if s == "" {
+		s = DefaultTemplate
+	}
+	t := &Template{parts: strings.Split(s, "."), named: make(map[string]bool)}
+	hasMeasurement := false
+	for _, part := range t.parts {
+		switch part {
+		case "":
+			return nil, fmt.Errorf("invalid template %q: empty part", s)
+		case "measurement":
+			hasMeasurement = true
+		case "field", "tags":
+		default:
+			t.named[part] = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("invalid template %q: no measurement", s)
+	}
+	return t, nil
+}
+
+// Names returns the series names and values of the fields of p.
+func (t *Template) Names(p *Point) map[string]float64 {
+	result := make(map[string]float64, len(p.Fields))
+	for field, value := range p.Fields {
+		parts := make([]string, 0, len(t.parts)+len(p.Tags))
+		for _, part := range t.parts {
+			switch part {
+			case "measurement":
+				parts = appendPart(parts, p.Measurement)
+			case "field":
+				if field != "value" {
+					parts = appendPart(parts, field)
+				}
+			case "tags":
+				keys := make([]string, 0, len(p.Tags))
+				for k := range p.Tags {
+					if !t.named[k] {
+						keys = append(keys, k)
+					}
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					parts = appendPart(parts, p.Tags[k])
+				}
+			default:
+				parts = appendPart(parts, p.Tags[part])
+			}
+		}
+		result[strings.Join(parts, ".")] = value
+	}
+	return result
+}
+
+// appendPart appends a sanitized part, in which dots would create
+// extra levels, so they are replaced by underscores.
+func appendPart(parts []string, s string) []string {
+	if s = misc.SanitizeName(strings.Replace(s, ".", "_", -1)); s != "" {
+		parts = append(parts, s)
+	}
+	return parts
+}
+
+// MaxLineSize is the longest line Read() accepts.
+const MaxLineSize = 1024 * 1024
+
+// Read parses the lines of r and passes the value of every field to
+// queue, named according to t. Lines which cannot be parsed are
+// skipped, the first such error is returned along with the number of
+// values queued.
+func Read(r io.Reader, precision time.Duration, t *Template, queue func(serde.Ident, time.Time, float64)) (int, error) {
+	var (
+		n        int
+		firstErr error
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), MaxLineSize)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := ParseLine(line, precision, time.Now())
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for name, value := range t.Names(p) {
+			queue(serde.Ident{"name": name}, p.Time, value)
+			n++
+		}
+	}
+	if err := sc.Err(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return n, firstErr
+}
@@ -0,0 +1,124 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// A Decoder parses one line of a line oriented wire format (e.g. the
+// Graphite text protocol) into a data point. The tags, if any, become
+// part of the ident of the series along with the name. Decoders are
+// used by the line oriented listeners (TCP, UDP, unix socket) and the
+// message bus sources, which are configured with the name of a
+// registered decoder, see RegisterDecoder(). A Decoder must be safe
+// for concurrent use.
+type Decoder interface {
+	Decode(line []byte) (name string, ts time.Time, value float64, tags map[string]string, err error)
+}
+
+// DecoderFunc is a function which is a Decoder.
+type DecoderFunc func(line []byte) (string, time.Time, float64, map[string]string, error)
+
+func (f DecoderFunc) Decode(line []byte) (string, time.Time, float64, map[string]string, error) {
+	return f(line)
+}
+
+var decoders = struct {
+	sync.RWMutex
+	m map[string]Decoder
+}{m: make(map[string]Decoder)}
+
+// RegisterDecoder makes a Decoder available by name, so that a
+// proprietary wire format can be added without modifying tgres. It
+// is meant to be called from an init() function, registering a name
+// again replaces the Decoder.
+func RegisterDecoder(name string, d Decoder) {
+	decoders.Lock()
+	defer decoders.Unlock()
+	decoders.m[name] = d
+}
+
+// LookupDecoder returns the Decoder registered by name.
+func LookupDecoder(name string) (Decoder, bool) {
+	decoders.RLock()
+	defer decoders.RUnlock()
+	d, ok := decoders.m[name]
+	return d, ok
+}
+
+// DecoderNames returns the names of the registered Decoders, sorted.
+func DecoderNames() []string {
+	decoders.RLock()
+	defer decoders.RUnlock()
+	names := make([]string, 0, len(decoders.m))
+	for name := range decoders.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewIdent returns the ident of the series given its name and tags.
+// A tag called "name" is ignored.
+func NewIdent(name string, tags map[string]string) serde.Ident {
+	ident := make(serde.Ident, len(tags)+1)
+	for k, v := range tags {
+		ident[k] = v
+	}
+	ident["name"] = name
+	return ident
+}
+
+// DecodeLines decodes b, one or more lines (e.g. a message or a
+// datagram), and passes the data points to queue. The good lines are
+// queued even if there are bad ones, the error is about the first
+// bad line.
+func DecodeLines(d Decoder, b []byte, queue func(serde.Ident, time.Time, float64)) error {
+	var (
+		bad   int
+		first error
+	)
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		name, ts, v, tags, err := d.Decode(line)
+		if err != nil {
+			if bad++; first == nil {
+				first = err
+			}
+			continue
+		}
+		queue(NewIdent(name, tags), ts, v)
+	}
+	if bad > 1 {
+		return fmt.Errorf("%v (and %d more bad lines)", first, bad-1)
+	}
+	return first
+}
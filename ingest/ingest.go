@@ -0,0 +1,22 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ingest provides receiver.IngestSource implementations which
+// consume data points from a message bus (NATS, AMQP), so that sites
+// already running one do not need a bridge process, as well as the
+// pluggable Decoders which parse the wire formats. The body of a
+// message is one or more lines, each decoded by the Decoder of the
+// source. A bad line is logged, it does not stop the source.
+package ingest
@@ -0,0 +1,101 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tgres/tgres/serde"
+)
+
+// How long Stop() waits for the messages already received to be
+// processed.
+var natsDrainTimeout = 30 * time.Second
+
+// NATS subscribes to a NATS subject, which may contain wildcards.
+// With a Queue group, each message is delivered to only one of the
+// subscribers in the group, which is what a tgres cluster wants:
+// every node subscribes and the receivers forward the data points to
+// the nodes which own them.
+type NATS struct {
+	URL     string // e.g. nats://localhost:4222, may be a comma separated list
+	Subject string
+	Queue   string // queue group, blank means every subscriber gets every message
+	Decode  Decoder
+
+	nc     *nats.Conn
+	closed chan struct{}
+}
+
+func (n *NATS) Name() string {
+	return fmt.Sprintf("nats(%s)", n.Subject)
+}
+
+func (n *NATS) Start(queue func(serde.Ident, time.Time, float64)) error {
+	closed := make(chan struct{})
+	nc, err := nats.Connect(n.URL,
+		nats.Name("tgres"),
+		nats.MaxReconnects(-1), // never give up
+		nats.DrainTimeout(natsDrainTimeout),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("%s: disconnected: %v", n.Name(), err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("%s: reconnected to %s.", n.Name(), nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(_ *nats.Conn) { close(closed) }),
+	)
+	if err != nil {
+		return err
+	}
+
+	handler := func(m *nats.Msg) {
+		if err := DecodeLines(n.Decode, m.Data, queue); err != nil {
+			log.Printf("%s: bad message on %s: %v", n.Name(), m.Subject, err)
+		}
+	}
+	if n.Queue != "" {
+		_, err = nc.QueueSubscribe(n.Subject, n.Queue, handler)
+	} else {
+		_, err = nc.Subscribe(n.Subject, handler)
+	}
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	n.nc, n.closed = nc, closed
+	return nil
+}
+
+// Stop unsubscribes, waits for the messages already received to be
+// processed and closes the connection.
+func (n *NATS) Stop() {
+	if n.nc == nil {
+		return
+	}
+	if err := n.nc.Drain(); err != nil {
+		log.Printf("%s: error draining: %v", n.Name(), err)
+		n.nc.Close()
+	}
+	<-n.closed
+	n.nc = nil
+}
@@ -24,7 +24,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"syscall"
 
 	"github.com/tgres/tgres/daemon"
 )
@@ -33,13 +32,14 @@ var (
 	buildTime, gitRevision string
 )
 
-func parseFlags() (textCfgPath, gracefulProtos, join string, bg bool, version bool) {
+func parseFlags() (textCfgPath, gracefulProtos, join, service string, bg bool, version bool) {
 
 	// Parse the flags, if any
 	flag.StringVar(&textCfgPath, "c", "./etc/tgres.conf", "path to config file")
 	flag.StringVar(&join, "join", "", "List of add:port,addr:port,... of nodes to join")
 	flag.StringVar(&gracefulProtos, "graceful", "", "list of fds (internal use only)")
 	flag.BoolVar(&bg, "bg", false, "Immediately background itself")
+	flag.StringVar(&service, "service", "", "Windows only: install, remove, start or stop the Tgres service")
 	flag.BoolVar(&version, "version", false, "Print version and exit")
 	flag.Parse()
 
@@ -59,13 +59,52 @@ func printVersion() {
 
 func main() {
 
-	textCfgPath, gracefulProtos, join, bg, version := parseFlags()
+	textCfgPath, gracefulProtos, join, service, bg, version := parseFlags()
+	daemon.Build = daemon.BuildInfo{Version: Version, GitRevision: gitRevision, BuildTime: buildTime}
 
 	if version {
 		printVersion()
 		return
 	}
 
+	// tgres [flags] fsck [-repair]
+	if flag.Arg(0) == "fsck" {
+		if err := daemon.Fsck(textCfgPath, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	// tgres [flags] rrdtool import|export ...
+	if flag.Arg(0) == "rrdtool" {
+		if err := daemon.RRDTool(textCfgPath, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	// tgres [flags] whisper import|export ...
+	if flag.Arg(0) == "whisper" {
+		if err := daemon.Whisper(textCfgPath, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if service != "" {
+		if err := daemon.ServiceCommand(service, textCfgPath, join); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if daemon.IsService() {
+		if err := daemon.RunService(textCfgPath, join); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if bg {
 		if !filepath.IsAbs(textCfgPath) {
 			log.Fatalf("ERROR: Background only possible when config path is absolute (cfg path: %q).", textCfgPath)
@@ -102,16 +141,3 @@ func background(cp, join string) {
 		log.Fatalf("Error: %v", err)
 	}
 }
-
-func std2DevNull() error {
-	f, e := os.OpenFile("/dev/null", os.O_RDWR, 0)
-	if e == nil {
-		fd := int(f.Fd())
-		syscall.Dup2(fd, int(os.Stdin.Fd()))
-		syscall.Dup2(fd, int(os.Stdout.Fd()))
-		syscall.Dup2(fd, int(os.Stderr.Fd()))
-		return nil
-	} else {
-		return e
-	}
-}
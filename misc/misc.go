@@ -31,11 +31,25 @@ var (
 )
 
 func SanitizeName(name string) string {
+	if isSaneName(name) { // the common case, spare the regexps
+		return name
+	}
 	name = sanitizeRegexSpace.ReplaceAllString(name, "_")
 	name = sanitizeRegexSlash.ReplaceAllString(name, "-")
 	return sanitizeRegexNonAlphaNum.ReplaceAllString(name, "")
 }
 
+// isSaneName returns true if SanitizeName() would not change name.
+func isSaneName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 func BetterParseDuration(s string) (time.Duration, error) {
 
 	if strings.HasSuffix(s, "min") {
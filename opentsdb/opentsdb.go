@@ -0,0 +1,186 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package opentsdb parses the OpenTSDB telnet "put" command and the
+// JSON body of /api/put (as sent by e.g. tcollector) and flattens
+// their tags into series names.
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+)
+
+// A Point is a data point, e.g.:
+//
+//	put sys.cpu.user 1500000000 42.5 host=web01 cpu=0
+type Point struct {
+	Metric string
+	Tags   map[string]string
+	Time   time.Time
+	Value  float64
+}
+
+// ParsePut parses the arguments of a telnet put command, i.e. the
+// line without the leading "put".
+func ParsePut(args string) (*Point, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("not enough arguments (need at least 3, got %d)", len(fields))
+	}
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %q", fields[1])
+	}
+	value, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value: %q", fields[2])
+	}
+	p := &Point{Metric: fields[0], Tags: make(map[string]string, len(fields)-3), Time: Time(ts), Value: value}
+	for _, tag := range fields[3:] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+		p.Tags[tag[:i]] = tag[i+1:]
+	}
+	return p, nil
+}
+
+// Time converts an OpenTSDB timestamp, which is in seconds, or in
+// milliseconds if it has more than 10 digits.
+func Time(ts int64) time.Time {
+	if ts > 9999999999 {
+		return time.Unix(0, ts*int64(time.Millisecond))
+	}
+	return time.Unix(ts, 0)
+}
+
+// jsonPoint is a data point of the /api/put body. OpenTSDB accepts
+// the value as a number or as a string.
+type jsonPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// DecodePut decodes the JSON body of /api/put, which is a single
+// data point or an array of them. The data points which are valid
+// are returned along with an error for each invalid one.
+func DecodePut(r io.Reader) ([]*Point, []error, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	var jps []jsonPoint
+	if s := strings.TrimSpace(string(raw)); strings.HasPrefix(s, "[") {
+		if err := json.Unmarshal(raw, &jps); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		jps = make([]jsonPoint, 1)
+		if err := json.Unmarshal(raw, &jps[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var (
+		points []*Point
+		errs   []error
+	)
+	for i, jp := range jps {
+		if jp.Metric == "" || jp.Timestamp <= 0 || jp.Value == "" {
+			errs = append(errs, fmt.Errorf("data point %d: metric, timestamp and value are required", i))
+			continue
+		}
+		value, err := strconv.ParseFloat(string(jp.Value), 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("data point %d: invalid value: %q", i, jp.Value))
+			continue
+		}
+		if jp.Tags == nil {
+			jp.Tags = make(map[string]string)
+		}
+		points = append(points, &Point{Metric: jp.Metric, Tags: jp.Tags, Time: Time(jp.Timestamp), Value: value})
+	}
+	return points, errs, nil
+}
+
+// A TagPolicy determines how tags are flattened into a series name.
+type TagPolicy string
+
+// The tag policies. With the tags host=web01 and cpu=0, the metric
+// sys.cpu.user becomes:
+//
+//	TagsPairs:  sys.cpu.user.cpu.0.host.web01
+//	TagsValues: sys.cpu.user.0.web01
+//	TagsDrop:   sys.cpu.user
+//
+// in each case the tags are sorted by key.
+const (
+	TagsPairs  TagPolicy = "pairs"
+	TagsValues TagPolicy = "values"
+	TagsDrop   TagPolicy = "drop"
+)
+
+// ParseTagPolicy validates a policy, blank means TagsPairs.
+func ParseTagPolicy(s string) (TagPolicy, error) {
+	switch TagPolicy(s) {
+	case "":
+		return TagsPairs, nil
+	case TagsPairs, TagsValues, TagsDrop:
+		return TagPolicy(s), nil
+	}
+	return "", fmt.Errorf("invalid tag policy %q (valid policies: pairs, values, drop)", s)
+}
+
+// Name returns the series name of p. The metric is used as is (it is
+// normally dot-separated already), in tag keys and values dots are
+// replaced by underscores so as not to create extra levels.
+func (tp TagPolicy) Name(p *Point) string {
+	name := misc.SanitizeName(p.Metric)
+	if tp == TagsDrop || len(p.Tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, k := range keys {
+		if tp == TagsPairs {
+			parts = appendPart(parts, k)
+		}
+		parts = appendPart(parts, p.Tags[k])
+	}
+	return strings.Join(parts, ".")
+}
+
+func appendPart(parts []string, s string) []string {
+	if s = misc.SanitizeName(strings.Replace(s, ".", "_", -1)); s != "" {
+		parts = append(parts, s)
+	}
+	return parts
+}
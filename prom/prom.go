@@ -0,0 +1,279 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prom implements the Prometheus remote_write and
+// remote_read protocols and maps label sets to series names.
+package prom
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxRequestSize is the largest (compressed or decompressed) request
+// Read() and ReadQueries() accept.
+const MaxRequestSize = 32 * 1024 * 1024
+
+// staleNaN is the value Prometheus uses to mark a series as stale,
+// it is not a measurement.
+const staleNaN = 0x7ff0000000000002
+
+// A Label is a name/value pair of a label set.
+type Label struct {
+	Name, Value string
+}
+
+// A Sample is a value at a time in milliseconds since the epoch.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// A TimeSeries is a label set and its samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// DecodeWriteRequest decodes a (decompressed) protobuf WriteRequest.
+// Only the time series are decoded, metadata is skipped. The message
+// is small enough to not warrant generated code:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func DecodeWriteRequest(b []byte) ([]TimeSeries, error) {
+	var result []TimeSeries
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num == 1 && typ == protowire.BytesType {
+			ts, err := decodeTimeSeries(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, ts)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func decodeTimeSeries(b []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var l Label
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if typ == protowire.BytesType {
+					switch num {
+					case 1:
+						l.Name = string(v)
+					case 2:
+						l.Value = string(v)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			var s Sample
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(n)
+				case num == 2 && typ == protowire.VarintType:
+					s.Timestamp = int64(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// eachField calls fn for every field of a message. Length-delimited
+// values are passed as v, numeric ones as n, groups are skipped.
+func eachField(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		var (
+			v []byte
+			n uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		if typ == protowire.StartGroupType {
+			continue
+		}
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the series name of a label set: the metric name (the
+// __name__ label) followed by the name and value of every other
+// label, sorted by label name, e.g.
+//
+//	http_requests_total{method="GET",code="200"}
+//
+// becomes http_requests_total.code.200.method.GET. Dots in names and
+// values are replaced by underscores so as not to create extra
+// levels, a part which sanitizes to nothing becomes a single
+// underscore so that Labels() can pair names and values. Labels with
+// an empty value are left out, as they are in Prometheus. Without a
+// metric name the result is blank.
+func Name(labels []Label) string {
+	var metric string
+	sorted := make([]Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			metric = l.Value
+		} else if l.Value != "" {
+			sorted = append(sorted, l)
+		}
+	}
+	if metric = sanitizePart(metric); metric == "_" {
+		return ""
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	parts := make([]string, 0, 1+2*len(sorted))
+	parts = append(parts, metric)
+	for _, l := range sorted {
+		parts = append(parts, sanitizePart(l.Name), sanitizePart(l.Value))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sanitizePart returns s as it would appear in a name.
+func sanitizePart(s string) string {
+	if s = misc.SanitizeName(strings.Replace(s, ".", "_", -1)); s == "" {
+		return "_"
+	}
+	return s
+}
+
+// Labels is the inverse of Name(), it returns the label set (sorted
+// by label name) of a series name, or nil if the name cannot have
+// been created by Name().
+func Labels(name string) []Label {
+	parts := strings.Split(name, ".")
+	if parts[0] == "" || len(parts)%2 == 0 {
+		return nil
+	}
+	labels := make([]Label, 0, 1+len(parts)/2)
+	labels = append(labels, Label{Name: "__name__", Value: parts[0]})
+	for i := 1; i < len(parts); i += 2 {
+		labels = append(labels, Label{Name: parts[i], Value: parts[i+1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// Read reads a snappy-compressed WriteRequest from r and passes every
+// sample to queue, named by Name(). Stale markers are skipped. It
+// returns the number of samples queued.
+func Read(r io.Reader, queue func(serde.Ident, time.Time, float64)) (int, error) {
+	b, err := readSnappy(r)
+	if err != nil {
+		return 0, err
+	}
+	series, err := DecodeWriteRequest(b)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, ts := range series {
+		name := Name(ts.Labels)
+		if name == "" {
+			continue
+		}
+		for _, s := range ts.Samples {
+			if math.Float64bits(s.Value) == staleNaN {
+				continue
+			}
+			queue(serde.Ident{"name": name}, time.Unix(0, s.Timestamp*int64(time.Millisecond)), s.Value)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// readSnappy reads and decompresses a snappy-compressed (block
+// format) request body.
+func readSnappy(r io.Reader) ([]byte, error) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(r, MaxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > MaxRequestSize {
+		return nil, fmt.Errorf("request larger than %d bytes", MaxRequestSize)
+	}
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxRequestSize {
+		return nil, fmt.Errorf("decompressed request larger than %d bytes", MaxRequestSize)
+	}
+	return snappy.Decode(nil, compressed)
+}
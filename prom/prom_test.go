@@ -0,0 +1,184 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prom
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/tgres/tgres/serde"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A WriteRequest with one series, up{} 1 at 1000ms, as encoded by
+// Prometheus.
+var upWriteRequest = []byte{
+	0x0a, 0x1e, // timeseries, 30 bytes
+	0x0a, 0x0e, // labels, 14 bytes
+	0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+	0x12, 0x02, 'u', 'p',
+	0x12, 0x0c, // samples, 12 bytes
+	0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, // value 1.0
+	0x10, 0xe8, 0x07, // timestamp 1000
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	var l []byte
+	l = protowire.AppendTag(l, 1, protowire.BytesType)
+	l = protowire.AppendString(l, name)
+	l = protowire.AppendTag(l, 2, protowire.BytesType)
+	l = protowire.AppendString(l, value)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, l)
+}
+
+func appendSample(b []byte, value float64, ts int64) []byte {
+	var s []byte
+	s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+	s = protowire.AppendFixed64(s, math.Float64bits(value))
+	s = protowire.AppendTag(s, 2, protowire.VarintType)
+	s = protowire.AppendVarint(s, uint64(ts))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, s)
+}
+
+// encodeWriteRequest encodes series the way Prometheus does, with a
+// metadata field (which is to be skipped) at the end.
+func encodeWriteRequest(series []TimeSeries) []byte {
+	var b []byte
+	for _, ts := range series {
+		var t []byte
+		for _, l := range ts.Labels {
+			t = appendLabel(t, l.Name, l.Value)
+		}
+		for _, s := range ts.Samples {
+			t = appendSample(t, s.Value, s.Timestamp)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, t)
+	}
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, []byte{0x08, 0x01})
+}
+
+func Test_DecodeWriteRequest(t *testing.T) {
+	series, err := DecodeWriteRequest(upWriteRequest)
+	exp := []TimeSeries{{Labels: []Label{{"__name__", "up"}}, Samples: []Sample{{1, 1000}}}}
+	if err != nil || !reflect.DeepEqual(series, exp) {
+		t.Errorf("DecodeWriteRequest: %v %+v", err, series)
+	}
+
+	exp = []TimeSeries{
+		{
+			Labels:  []Label{{"__name__", "http_requests_total"}, {"method", "GET"}, {"code", "200"}},
+			Samples: []Sample{{1, 1000}, {2.5, 2000}, {-3, 3000}},
+		},
+		{
+			Labels:  []Label{{"__name__", "up"}, {"job", "node"}},
+			Samples: []Sample{{0, 1500000000000}},
+		},
+	}
+	series, err = DecodeWriteRequest(encodeWriteRequest(exp))
+	if err != nil || !reflect.DeepEqual(series, exp) {
+		t.Errorf("DecodeWriteRequest: multiple series: %v %+v", err, series)
+	}
+
+	if series, err := DecodeWriteRequest(nil); err != nil || len(series) != 0 {
+		t.Errorf("DecodeWriteRequest: empty: %v %v", err, series)
+	}
+
+	// truncated varints: the tag, the timestamp and a length
+	for _, b := range [][]byte{
+		{0x80},
+		upWriteRequest[:len(upWriteRequest)-1],
+		{0x0a, 0xff},
+	} {
+		if _, err := DecodeWriteRequest(b); err == nil {
+			t.Errorf("DecodeWriteRequest(% x): no error", b)
+		}
+	}
+	// a length beyond the end
+	if _, err := DecodeWriteRequest(upWriteRequest[:10]); err == nil {
+		t.Errorf("DecodeWriteRequest: no error on a truncated message")
+	}
+}
+
+func Test_Read(t *testing.T) {
+	series := []TimeSeries{
+		{
+			Labels:  []Label{{"__name__", "temp"}, {"room", "a.b"}, {"empty", ""}},
+			Samples: []Sample{{21, 1000}, {math.NaN(), 2000}, {math.Float64frombits(staleNaN), 3000}},
+		},
+		{
+			Labels:  []Label{{"job", "no_name"}}, // skipped
+			Samples: []Sample{{1, 1000}},
+		},
+	}
+
+	type dp struct {
+		name  string
+		ts    time.Time
+		value float64
+	}
+	var got []dp
+	queue := func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, dp{ident["name"], ts, v})
+	}
+
+	n, err := Read(bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))), queue)
+	if err != nil || n != 2 || len(got) != 2 {
+		t.Fatalf("Read: %v %d %v", err, n, got)
+	}
+	if got[0].name != "temp.room.a_b" || !got[0].ts.Equal(time.Unix(1, 0)) || got[0].value != 21 {
+		t.Errorf("Read: unexpected first point: %v", got[0])
+	}
+	// NaN is a value, the stale marker is not
+	if !got[1].ts.Equal(time.Unix(2, 0)) || !math.IsNaN(got[1].value) {
+		t.Errorf("Read: unexpected second point: %v", got[1])
+	}
+
+	// corrupted snappy
+	compressed := snappy.Encode(nil, upWriteRequest)
+	compressed[len(compressed)/2] ^= 0xff
+	if _, err := Read(bytes.NewReader(compressed), queue); err == nil {
+		t.Errorf("Read: no error on corrupted snappy")
+	}
+	if _, err := Read(bytes.NewReader(upWriteRequest), queue); err == nil {
+		t.Errorf("Read: no error on an uncompressed request")
+	}
+	if _, err := Read(bytes.NewReader(snappy.Encode(nil, upWriteRequest[:len(upWriteRequest)-1])), queue); err == nil {
+		t.Errorf("Read: no error on a truncated request")
+	}
+}
+
+func Test_Name_Labels(t *testing.T) {
+	labels := []Label{{"method", "GET"}, {"__name__", "http_requests_total"}, {"code", "200"}}
+	name := Name(labels)
+	if name != "http_requests_total.code.200.method.GET" {
+		t.Errorf("Name: %q", name)
+	}
+	exp := []Label{{"__name__", "http_requests_total"}, {"code", "200"}, {"method", "GET"}}
+	if got := Labels(name); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Labels: %v", got)
+	}
+	if Name([]Label{{"job", "x"}}) != "" || Labels("a.b") != nil {
+		t.Errorf("Name/Labels: expected blank/nil")
+	}
+}
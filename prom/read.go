@@ -0,0 +1,303 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prom
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Types of a Matcher, as in the LabelMatcher message.
+const (
+	MatchEqual = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// A Matcher is a label matcher of a query, e.g. job=~"api.*".
+type Matcher struct {
+	Type        int
+	Name, Value string
+	re          *regexp.Regexp
+}
+
+// Matches returns true if the label set (as returned by Labels())
+// matches. Since the label values in a series name are sanitized,
+// the value of an equality matcher is sanitized the same way, a
+// regular expression is matched against the sanitized value.
+func (m *Matcher) Matches(labels []Label) bool {
+	var value string
+	for _, l := range labels {
+		if l.Name == m.Name {
+			value = l.Value
+			break
+		}
+	}
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		equal := value == m.Value || m.Value != "" && value == sanitizePart(m.Value)
+		return equal == (m.Type == MatchEqual)
+	default:
+		return m.re.MatchString(value) == (m.Type == MatchRegexp)
+	}
+}
+
+// A Query is a time range (in milliseconds since the epoch) and the
+// matchers a series must satisfy.
+type Query struct {
+	Start, End int64
+	Matchers   []*Matcher
+}
+
+// Matches returns true if the label set satisfies all the matchers.
+func (q *Query) Matches(labels []Label) bool {
+	for _, m := range q.Matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxQuerySeries is the most series a query may match, see
+// ErrTooManySeries.
+const MaxQuerySeries = 10000
+
+// ErrTooManySeries is returned by Execute() when the metric name
+// matcher of a query finds more than MaxQuerySeries series.
+var ErrTooManySeries = fmt.Errorf("query matches more than %d series, narrow down the metric name", MaxQuerySeries)
+
+// nameMatcher returns the metric name matcher of the query which can
+// narrow down the search, i.e. __name__ equal to or matching a
+// (non-empty) value, or nil.
+func (q *Query) nameMatcher() *Matcher {
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" && (m.Type == MatchEqual || m.Type == MatchRegexp) && m.Value != "" {
+			return m
+		}
+	}
+	return nil
+}
+
+// searchQuery narrows down the series to consider by the metric name
+// matcher (see nameMatcher), the matchers are applied to every result
+// anyway.
+func (q *Query) searchQuery() serde.SearchQuery {
+	m := q.nameMatcher()
+	if m.Type == MatchEqual {
+		return serde.SearchQuery{"name": "^" + regexp.QuoteMeta(sanitizePart(m.Value)) + `(\.|$)`}
+	}
+	return serde.SearchQuery{"name": "^(?:" + m.Value + `)(\.|$)`}
+}
+
+// A Fetcher is what Execute() needs to find and read series, it is a
+// subset of serde.Fetcher.
+type Fetcher interface {
+	serde.DataSourceSearcher
+	FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
+	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
+}
+
+// Execute returns the series of db which match the query, with the
+// (not NaN) data points within its time range. Series whose names
+// cannot have been created by Name() are ignored. The query must have
+// a metric name matcher (as DecodeReadRequest ensures), and may match
+// at most MaxQuerySeries series.
+func (q *Query) Execute(db Fetcher) ([]TimeSeries, error) {
+	if q.nameMatcher() == nil {
+		return nil, fmt.Errorf("a metric name (__name__) matcher is required")
+	}
+	sr, err := db.Search(q.searchQuery())
+	if err != nil {
+		return nil, err
+	}
+	var idents []serde.Ident
+	for sr.Next() {
+		if len(idents) == MaxQuerySeries {
+			sr.Close()
+			return nil, ErrTooManySeries
+		}
+		idents = append(idents, sr.Ident())
+	}
+	sr.Close()
+
+	from, to := msTime(q.Start), msTime(q.End)
+	var result []TimeSeries
+	for _, ident := range idents {
+		labels := Labels(ident["name"])
+		if labels == nil || !q.Matches(labels) {
+			continue
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ds == nil {
+			continue
+		}
+		s, err := db.FetchSeries(ds, from, to, 0)
+		if err != nil {
+			return nil, err
+		}
+		ts := TimeSeries{Labels: labels}
+		for s.Next() {
+			t, v := s.CurrentTime(), s.CurrentValue()
+			if math.IsNaN(v) || t.Before(from) || t.After(to) {
+				continue
+			}
+			ts.Samples = append(ts.Samples, Sample{Value: v, Timestamp: t.UnixNano() / int64(time.Millisecond)})
+		}
+		s.Close()
+		if len(ts.Samples) > 0 {
+			result = append(result, ts)
+		}
+	}
+	return result, nil
+}
+
+func msTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// DecodeReadRequest decodes a (decompressed) protobuf ReadRequest.
+// Hints and the accepted response types are ignored, the response is
+// always of samples. Every query must have a metric name matcher
+// (__name__ equal to or matching a value), so that it does not have
+// to read every series:
+//
+//	message ReadRequest { repeated Query queries = 1; }
+//	message Query { int64 start_timestamp_ms = 1; int64 end_timestamp_ms = 2; repeated LabelMatcher matchers = 3; }
+//	message LabelMatcher { Type type = 1; string name = 2; string value = 3; }
+func DecodeReadRequest(b []byte) ([]*Query, error) {
+	var result []*Query
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num == 1 && typ == protowire.BytesType {
+			q, err := decodeQuery(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, q)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func decodeQuery(b []byte) (*Query, error) {
+	q := &Query{}
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			q.Start = int64(n)
+		case num == 2 && typ == protowire.VarintType:
+			q.End = int64(n)
+		case num == 3 && typ == protowire.BytesType:
+			m := &Matcher{}
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					m.Type = int(n)
+				case num == 2 && typ == protowire.BytesType:
+					m.Name = string(v)
+				case num == 3 && typ == protowire.BytesType:
+					m.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			switch m.Type {
+			case MatchEqual, MatchNotEqual:
+			case MatchRegexp, MatchNotRegexp:
+				// Prometheus regexps are anchored
+				if m.re, err = regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown matcher type: %d", m.Type)
+			}
+			q.Matchers = append(q.Matchers, m)
+		}
+		return nil
+	})
+	if err == nil && q.nameMatcher() == nil {
+		// without one, every series would have to be read
+		err = fmt.Errorf("a metric name (__name__) matcher is required")
+	}
+	return q, err
+}
+
+// ReadQueries reads a snappy-compressed ReadRequest from r.
+func ReadQueries(r io.Reader) ([]*Query, error) {
+	b, err := readSnappy(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReadRequest(b)
+}
+
+// EncodeReadResponse returns the snappy-compressed protobuf
+// ReadResponse, results are in the order of the queries:
+//
+//	message ReadResponse { repeated QueryResult results = 1; }
+//	message QueryResult { repeated TimeSeries timeseries = 1; }
+func EncodeReadResponse(results [][]TimeSeries) []byte {
+	var b []byte
+	for _, series := range results {
+		var qr []byte
+		for _, ts := range series {
+			qr = protowire.AppendTag(qr, 1, protowire.BytesType)
+			qr = protowire.AppendBytes(qr, encodeTimeSeries(ts))
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, qr)
+	}
+	return snappy.Encode(nil, b)
+}
+
+func encodeTimeSeries(ts TimeSeries) []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
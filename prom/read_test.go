@@ -0,0 +1,215 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prom
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func encodeReadRequest(queries []*Query) []byte {
+	var b []byte
+	for _, q := range queries {
+		var qb []byte
+		qb = protowire.AppendTag(qb, 1, protowire.VarintType)
+		qb = protowire.AppendVarint(qb, uint64(q.Start))
+		qb = protowire.AppendTag(qb, 2, protowire.VarintType)
+		qb = protowire.AppendVarint(qb, uint64(q.End))
+		for _, m := range q.Matchers {
+			var mb []byte
+			mb = protowire.AppendTag(mb, 1, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(m.Type))
+			mb = protowire.AppendTag(mb, 2, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.Name)
+			mb = protowire.AppendTag(mb, 3, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.Value)
+			qb = protowire.AppendTag(qb, 3, protowire.BytesType)
+			qb = protowire.AppendBytes(qb, mb)
+		}
+		// hints, to be ignored
+		qb = protowire.AppendTag(qb, 4, protowire.BytesType)
+		qb = protowire.AppendBytes(qb, []byte{0x08, 0x01})
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, qb)
+	}
+	return b
+}
+
+// decodeReadResponse decodes what EncodeReadResponse returns.
+func decodeReadResponse(b []byte) ([][]TimeSeries, error) {
+	b, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, err
+	}
+	var results [][]TimeSeries
+	err = eachField(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		series := []TimeSeries{}
+		err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+			ts, err := decodeTimeSeries(v)
+			series = append(series, ts)
+			return err
+		})
+		results = append(results, series)
+		return err
+	})
+	return results, err
+}
+
+// searchRecorder records the search queries, and returns extra
+// idents (instead of searching) if it is not zero.
+type searchRecorder struct {
+	Fetcher
+	queries []serde.SearchQuery
+	extra   int
+}
+
+type manyResults struct{ n, i int }
+
+func (r *manyResults) Next() bool   { r.i++; return r.i <= r.n }
+func (r *manyResults) Close() error { return nil }
+func (r *manyResults) Ident() serde.Ident {
+	return serde.Ident{"name": fmt.Sprintf("m.i.%d", r.i)}
+}
+
+func (s *searchRecorder) Search(q serde.SearchQuery) (serde.SearchResult, error) {
+	s.queries = append(s.queries, q)
+	if s.extra > 0 {
+		return &manyResults{n: s.extra}, nil
+	}
+	return s.Fetcher.Search(q)
+}
+
+func Test_DecodeReadRequest(t *testing.T) {
+	queries := []*Query{
+		{Start: 1000, End: 2000, Matchers: []*Matcher{
+			{Type: MatchEqual, Name: "__name__", Value: "temp"},
+			{Type: MatchRegexp, Name: "room", Value: "a|b"},
+		}},
+		{Start: 3000, End: 4000, Matchers: []*Matcher{
+			{Type: MatchRegexp, Name: "__name__", Value: "te.*"},
+			{Type: MatchNotEqual, Name: "room", Value: "c"},
+		}},
+	}
+	got, err := ReadQueries(bytes.NewReader(snappy.Encode(nil, encodeReadRequest(queries))))
+	if err != nil || len(got) != 2 {
+		t.Fatalf("ReadQueries: %v %v", err, got)
+	}
+	for i, q := range got {
+		if q.Start != queries[i].Start || q.End != queries[i].End || len(q.Matchers) != len(queries[i].Matchers) {
+			t.Errorf("ReadQueries: query %d: %+v", i, q)
+			continue
+		}
+		for j, m := range q.Matchers {
+			exp := queries[i].Matchers[j]
+			if m.Type != exp.Type || m.Name != exp.Name || m.Value != exp.Value {
+				t.Errorf("ReadQueries: query %d matcher %d: %+v", i, j, m)
+			}
+		}
+	}
+	// regexps are anchored
+	if m := got[1].Matchers[0]; !m.Matches([]Label{{"__name__", "temp"}}) || m.Matches([]Label{{"__name__", "xtemp"}}) {
+		t.Errorf("ReadQueries: regexp not anchored")
+	}
+
+	for _, c := range []struct {
+		desc     string
+		matchers []*Matcher
+	}{
+		{"no name matcher", []*Matcher{{Type: MatchEqual, Name: "job", Value: "x"}}},
+		{"a negative name matcher", []*Matcher{{Type: MatchNotEqual, Name: "__name__", Value: "x"}}},
+		{"a bad regexp", []*Matcher{{Type: MatchEqual, Name: "__name__", Value: "x"}, {Type: MatchRegexp, Name: "job", Value: "("}}},
+		{"an unknown matcher type", []*Matcher{{Type: 9, Name: "__name__", Value: "x"}}},
+	} {
+		if _, err := DecodeReadRequest(encodeReadRequest([]*Query{{Matchers: c.matchers}})); err == nil {
+			t.Errorf("DecodeReadRequest: no error with %s", c.desc)
+		}
+	}
+	if _, err := DecodeReadRequest([]byte{0x0a, 0x05, 0x08}); err == nil {
+		t.Errorf("DecodeReadRequest: no error on a truncated request")
+	}
+}
+
+func Test_EncodeReadResponse(t *testing.T) {
+	results := [][]TimeSeries{
+		{
+			{Labels: []Label{{"__name__", "temp"}, {"room", "a"}}, Samples: []Sample{{21, 1000}, {22.5, 2000}}},
+			{Labels: []Label{{"__name__", "temp"}, {"room", "b"}}, Samples: []Sample{{-1, 1000}}},
+		},
+		{},
+	}
+	got, err := decodeReadResponse(EncodeReadResponse(results))
+	if err != nil || !reflect.DeepEqual(got, results) {
+		t.Errorf("EncodeReadResponse: %v %+v", err, got)
+	}
+}
+
+func Test_Query_Execute(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{Step: step, RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 100 * step}}}
+	db := &searchRecorder{Fetcher: serde.NewMemSerDe()}
+	for i, name := range []string{"temp.room.a", "temp.room.b", "other.room.a", "not_a_label_set.x"} {
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+		for ts := int64(1000); ts <= 1100; ts += 10 {
+			ds.ProcessDataPoint(float64(i), time.Unix(ts, 0))
+		}
+	}
+
+	q := &Query{Start: 1020 * 1000, End: 1080 * 1000, Matchers: []*Matcher{
+		{Type: MatchEqual, Name: "__name__", Value: "temp"},
+		{Type: MatchNotEqual, Name: "room", Value: "b"},
+	}}
+	series, err := q.Execute(db)
+	if err != nil || len(series) != 1 {
+		t.Fatalf("Execute: %v %+v", err, series)
+	}
+	if exp := []Label{{"__name__", "temp"}, {"room", "a"}}; !reflect.DeepEqual(series[0].Labels, exp) {
+		t.Errorf("Execute: labels %v", series[0].Labels)
+	}
+	// 1020 through 1080
+	if n := len(series[0].Samples); n != 7 || series[0].Samples[0].Timestamp != 1020*1000 {
+		t.Errorf("Execute: samples %v", series[0].Samples)
+	}
+	if exp := (serde.SearchQuery{"name": `^temp(\.|$)`}); !reflect.DeepEqual(db.queries[0], exp) {
+		t.Errorf("Execute: search query %v", db.queries[0])
+	}
+
+	// a regexp name matcher narrows down the search too
+	q.Matchers[0] = &Matcher{Type: MatchRegexp, Name: "__name__", Value: "te.*"}
+	queries, _ := DecodeReadRequest(encodeReadRequest([]*Query{q}))
+	if series, err := queries[0].Execute(db); err != nil || len(series) != 1 {
+		t.Errorf("Execute: regexp: %v %+v", err, series)
+	}
+	if exp := (serde.SearchQuery{"name": `^(?:te.*)(\.|$)`}); !reflect.DeepEqual(db.queries[len(db.queries)-1], exp) {
+		t.Errorf("Execute: search query %v", db.queries[len(db.queries)-1])
+	}
+
+	// no full scans
+	if _, err := (&Query{Matchers: []*Matcher{{Type: MatchEqual, Name: "room", Value: "a"}}}).Execute(db); err == nil {
+		t.Errorf("Execute: no error without a name matcher")
+	}
+	db.extra = MaxQuerySeries + 1
+	if _, err := queries[0].Execute(db); err != ErrTooManySeries {
+		t.Errorf("Execute: expected ErrTooManySeries, got %v", err)
+	}
+}
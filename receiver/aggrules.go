@@ -0,0 +1,369 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// AggregationRule rolls up the incoming series matching Input into
+// the series named by Output, in the manner of carbon-aggregator. The
+// values of all the matching series received within every Frequency
+// period are combined using Method ("sum", "avg", "min", "max" or
+// "count") into a single data point at the end of the period.
+//
+// Input is a dot-separated pattern in which "*" matches any part of a
+// component, "{a,b}" either a or b, "<field>" a whole component and
+// "<<field>>" one or more components. Output may refer to the fields,
+// e.g. Input "<env>.hosts.*.<metric>" with Output
+// "<env>.all.<metric>".
+type AggregationRule struct {
+	Output    string
+	Frequency time.Duration
+	Method    string
+	Input     string
+}
+
+// ParseAggregationRules reads rules in the syntax of carbon's
+// aggregation-rules.conf, one per line:
+//
+//	output_template (frequency) = method input_pattern
+//
+// where frequency is in seconds. Blank lines and lines beginning with
+// "#" are ignored.
+func ParseAggregationRules(rd io.Reader) ([]AggregationRule, error) {
+	var result []AggregationRule
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := aggRuleLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expecting \"output (frequency) = method input\": %q", n, line)
+		}
+		freq, err := strconv.Atoi(m[2])
+		if err != nil || freq <= 0 {
+			return nil, fmt.Errorf("line %d: invalid frequency: %q", n, m[2])
+		}
+		rule := AggregationRule{Output: m[1], Frequency: time.Duration(freq) * time.Second, Method: m[3], Input: m[4]}
+		if _, err := compileAggRule(rule); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		result = append(result, rule)
+	}
+	return result, scanner.Err()
+}
+
+var aggRuleLineRe = regexp.MustCompile(`^(\S+)\s+\((\d+)\)\s*=\s*(\w+)\s+(\S+)$`)
+
+// SetAggregationRules enables aggregation of incoming series. The
+// rules apply to the data points passed to QueueDataPoint() (after
+// the rewrite rules), and the derived series are not subject to
+// the rate limits. A point may match several rules. If dropInputs is
+// true, the points which match a rule are not stored themselves. It
+// must be called before Start().
+func (r *Receiver) SetAggregationRules(rules []AggregationRule, dropInputs bool) error {
+	ra := &ruleAggregator{
+		dropInputs: dropInputs,
+		buckets:    make(map[aggBucketKey]*aggBucket),
+		matches:    make(map[string][]aggMatch),
+		stop:       make(chan struct{}),
+	}
+	for _, rule := range rules {
+		cr, err := compileAggRule(rule)
+		if err != nil {
+			return err
+		}
+		ra.rules = append(ra.rules, cr)
+	}
+	r.aggRules = ra
+	return nil
+}
+
+type aggMethod int
+
+const (
+	aggSum aggMethod = iota
+	aggAvg
+	aggMin
+	aggMax
+	aggCount
+)
+
+var aggMethods = map[string]aggMethod{"sum": aggSum, "avg": aggAvg, "min": aggMin, "max": aggMax, "count": aggCount}
+
+type aggRule struct {
+	AggregationRule
+	method aggMethod
+	re     *regexp.Regexp
+}
+
+var aggFieldRe = regexp.MustCompile(`<<(\w+)>>|<(\w+)>`)
+
+func compileAggRule(rule AggregationRule) (*aggRule, error) {
+	method, ok := aggMethods[rule.Method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported aggregation method %q (must be sum, avg, min, max or count)", rule.Method)
+	}
+	if rule.Frequency <= 0 {
+		return nil, fmt.Errorf("%s: frequency must be positive", rule.Output)
+	}
+
+	// Convert the input pattern into a regular expression
+	var parts []string
+	for _, comp := range strings.Split(rule.Input, ".") {
+		var part string
+		for comp != "" {
+			if loc := aggFieldRe.FindStringSubmatchIndex(comp); loc != nil && loc[0] == 0 {
+				if loc[2] >= 0 {
+					part += fmt.Sprintf("(?P<%s>.+?)", comp[loc[2]:loc[3]])
+				} else {
+					part += fmt.Sprintf("(?P<%s>[^.]+?)", comp[loc[4]:loc[5]])
+				}
+				comp = comp[loc[1]:]
+				continue
+			}
+			switch c := comp[0]; c {
+			case '*':
+				part += "[^.]*"
+			case '{':
+				end := strings.IndexByte(comp, '}')
+				if end < 0 {
+					return nil, fmt.Errorf("%s: unbalanced { in %q", rule.Output, rule.Input)
+				}
+				alts := strings.Split(comp[1:end], ",")
+				for i, alt := range alts {
+					alts[i] = regexp.QuoteMeta(alt)
+				}
+				part += "(?:" + strings.Join(alts, "|") + ")"
+				comp = comp[end:]
+			default:
+				part += regexp.QuoteMeta(string(c))
+			}
+			comp = comp[1:]
+		}
+		parts = append(parts, part)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, `\.`) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rule.Output, err)
+	}
+
+	// Every field in the output must be in the input
+	fields := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		fields[name] = true
+	}
+	for _, m := range aggFieldRe.FindAllStringSubmatch(rule.Output, -1) {
+		if name := m[1] + m[2]; !fields[name] {
+			return nil, fmt.Errorf("%s: field <%s> is not in the input pattern %q", rule.Output, name, rule.Input)
+		}
+	}
+	return &aggRule{AggregationRule: rule, method: method, re: re}, nil
+}
+
+// output returns the name of the derived series for name, or "" if
+// the rule does not match.
+func (ar *aggRule) output(name string) string {
+	m := ar.re.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	names := ar.re.SubexpNames()
+	return aggFieldRe.ReplaceAllStringFunc(ar.Output, func(field string) string {
+		field = strings.Trim(field, "<>")
+		for i, n := range names {
+			if n == field {
+				return m[i]
+			}
+		}
+		return ""
+	})
+}
+
+// How many names the outputs of which are remembered.
+const maxAggMatches = 100000
+
+// How long after the end of a period points for it are still
+// accepted before it is emitted.
+var aggRuleGrace = 5 * time.Second
+
+type ruleAggregator struct {
+	sync.Mutex
+	rules      []*aggRule
+	dropInputs bool
+	matches    map[string][]aggMatch // by input name
+	buckets    map[aggBucketKey]*aggBucket
+	stop       chan struct{}
+	wg         sync.WaitGroup
+
+	emitted, late int // since last reported
+}
+
+type aggMatch struct {
+	rule   *aggRule
+	output string
+}
+
+type aggBucketKey struct {
+	output string
+	end    int64 // unix nanoseconds
+}
+
+type aggBucket struct {
+	rule                 *aggRule
+	sum, min, max, count float64
+}
+
+func (b *aggBucket) add(v float64) {
+	if b.count == 0 || v < b.min {
+		b.min = v
+	}
+	if b.count == 0 || v > b.max {
+		b.max = v
+	}
+	b.sum += v
+	b.count++
+}
+
+func (b *aggBucket) value() float64 {
+	switch b.rule.method {
+	case aggAvg:
+		return b.sum / b.count
+	case aggMin:
+		return b.min
+	case aggMax:
+		return b.max
+	case aggCount:
+		return b.count
+	}
+	return b.sum
+}
+
+func (ra *ruleAggregator) match(name string) []aggMatch {
+	if m, ok := ra.matches[name]; ok {
+		return m
+	}
+	var result []aggMatch
+	for _, rule := range ra.rules {
+		if out := rule.output(name); out != "" {
+			result = append(result, aggMatch{rule, out})
+		}
+	}
+	if len(ra.matches) >= maxAggMatches {
+		ra.matches = make(map[string][]aggMatch)
+	}
+	ra.matches[name] = result
+	return result
+}
+
+// add adds the data point to the periods of the rules it matches. It
+// returns false if the point should not be stored.
+func (ra *ruleAggregator) add(ident serde.Ident, ts time.Time, v float64, now time.Time) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return true
+	}
+	ra.Lock()
+	defer ra.Unlock()
+	matches := ra.match(ident["name"])
+	for _, m := range matches {
+		freq := m.rule.Frequency
+		end := ts.Truncate(freq).Add(freq)
+		if !now.Before(end.Add(aggRuleGrace)) {
+			ra.late++
+			continue
+		}
+		key := aggBucketKey{m.output, end.UnixNano()}
+		b := ra.buckets[key]
+		if b == nil {
+			b = &aggBucket{rule: m.rule}
+			ra.buckets[key] = b
+		}
+		b.add(v)
+	}
+	return len(matches) == 0 || !ra.dropInputs
+}
+
+// emit queues the periods which have ended (or all of them if all
+// is true).
+func (ra *ruleAggregator) emit(now time.Time, all bool, queue func(serde.Ident, time.Time, float64)) {
+	type dp struct {
+		name string
+		ts   time.Time
+		v    float64
+	}
+	var ready []dp
+	ra.Lock()
+	for key, b := range ra.buckets {
+		end := time.Unix(0, key.end)
+		if all || !now.Before(end.Add(aggRuleGrace)) {
+			ready = append(ready, dp{key.output, end, b.value()})
+			delete(ra.buckets, key)
+		}
+	}
+	ra.emitted += len(ready)
+	ra.Unlock()
+	// queue may block, so not while locked
+	for _, p := range ready {
+		queue(serde.Ident{"name": p.name}, p.ts, p.v)
+	}
+}
+
+func (ra *ruleAggregator) start(queue func(serde.Ident, time.Time, float64), sr statReporter) {
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		for {
+			select {
+			case <-ra.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			ra.emit(time.Now(), false, queue)
+			ra.report(sr)
+		}
+	}()
+}
+
+func (ra *ruleAggregator) report(sr statReporter) {
+	ra.Lock()
+	emitted, late, open := ra.emitted, ra.late, len(ra.buckets)
+	ra.emitted, ra.late = 0, 0
+	ra.Unlock()
+	sr.reportStatCount("receiver.aggrules.emitted", float64(emitted))
+	sr.reportStatCount("receiver.aggrules.late", float64(late))
+	sr.reportStatGauge("receiver.aggrules.open", float64(open))
+}
+
+// stopAndEmit stops the emitter and queues all the periods, including
+// those which have not ended yet.
+func (ra *ruleAggregator) stopAndEmit(queue func(serde.Ident, time.Time, float64)) {
+	close(ra.stop)
+	ra.wg.Wait()
+	ra.emit(time.Now(), true, queue)
+}
@@ -0,0 +1,115 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_ParseAggregationRules(t *testing.T) {
+	rules, err := ParseAggregationRules(strings.NewReader(`
+# per-cluster request rates
+<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests
+
+<<prefix>>.all.latency (10) = max <<prefix>>.{web,api}*.latency
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Frequency != time.Minute || rules[1].Method != "max" {
+		t.Fatalf("unexpected rules: %#v", rules)
+	}
+
+	for _, c := range []struct {
+		rule      int
+		name, out string
+	}{
+		{0, "prod.applications.shop.host1.requests", "prod.applications.shop.all.requests"},
+		{0, "prod.applications.shop.host1.x.requests", ""},
+		{1, "a.b.web01.latency", "a.b.all.latency"},
+		{1, "a.api.latency", "a.all.latency"},
+		{1, "a.db01.latency", ""},
+	} {
+		cr, _ := compileAggRule(rules[c.rule])
+		if out := cr.output(c.name); out != c.out {
+			t.Errorf("output(%q): expected %q, got %q", c.name, c.out, out)
+		}
+	}
+
+	for _, bad := range []string{
+		"foo (60) sum bar",
+		"foo (0) = sum bar",
+		"foo (60) = median bar",
+		"<x>.foo (60) = sum <y>.bar",
+		"foo (60) = sum {bar",
+	} {
+		if _, err := ParseAggregationRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseAggregationRules(%q): expected an error", bad)
+		}
+	}
+}
+
+func Test_ruleAggregator(t *testing.T) {
+	r := &Receiver{}
+	err := r.SetAggregationRules([]AggregationRule{
+		{Output: "<env>.all.cpu", Frequency: 10 * time.Second, Method: "sum", Input: "<env>.*.cpu"},
+		{Output: "<env>.avg.cpu", Frequency: 10 * time.Second, Method: "avg", Input: "<env>.*.cpu"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra := r.aggRules
+
+	now := time.Unix(1500000000, 0)
+	if ra.add(serde.Ident{"name": "prod.a.cpu"}, now, 1, now) {
+		t.Errorf("add: a matching input should be dropped")
+	}
+	ra.add(serde.Ident{"name": "prod.b.cpu"}, now.Add(time.Second), 3, now)
+	if !ra.add(serde.Ident{"name": "prod.a.mem"}, now, 1, now) {
+		t.Errorf("add: a point matching no rule should not be dropped")
+	}
+	// too late for its period
+	ra.add(serde.Ident{"name": "prod.c.cpu"}, now.Add(-time.Minute), 5, now)
+	if ra.late != 2 {
+		t.Errorf("add: expected 2 late (one per rule), got %d", ra.late)
+	}
+
+	got := make(map[string]float64)
+	queue := func(ident serde.Ident, ts time.Time, v float64) {
+		if !ts.Equal(now.Add(10 * time.Second)) {
+			t.Errorf("emit: expected the end of the period, got %v", ts)
+		}
+		got[ident["name"]] = v
+	}
+	ra.emit(now.Add(10*time.Second), false, queue)
+	if len(got) != 0 {
+		t.Errorf("emit: nothing should be emitted within the grace period, got %v", got)
+	}
+	ra.emit(now.Add(10*time.Second+aggRuleGrace), false, queue)
+	if len(got) != 2 || got["prod.all.cpu"] != 4 || got["prod.avg.cpu"] != 2 || len(ra.buckets) != 0 {
+		t.Errorf("emit: unexpected result: %v", got)
+	}
+
+	sr := &fakeSr{}
+	ra.report(sr)
+	if sr.called != 3 || ra.emitted != 0 {
+		t.Errorf("report: expected 3 stats and the counts reset, got %d", sr.called)
+	}
+}
@@ -17,6 +17,7 @@ package receiver
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"time"
 
@@ -119,7 +120,16 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 
 	statsd.Prefix = statsNamePrefix
 
-	agg := aggregator.NewAggregator(dpq) // aggregator.dataPointQueuer
+	var out aggregator.DataPointQueuer = dpq
+	if dpq.StatsForward != nil {
+		if dpq.StatsForwardOnly {
+			out = dpq.StatsForward
+		} else {
+			out = aggregator.Tee{dpq, dpq.StatsForward}
+		}
+	}
+
+	agg := aggregator.NewAggregator(out) // aggregator.dataPointQueuer
 	agg.AppendAttr = "name"
 	aggDd := &distDatumAggregator{agg}
 	if clstr != nil {
@@ -147,6 +157,9 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 				log.Printf("%s: channel closed, performing last flush", wc.ident())
 				agg.Flush(time.Now())
 				close(flushCh)
+				if c, ok := dpq.StatsForward.(io.Closer); ok {
+					c.Close()
+				}
 				return
 			}
 
@@ -120,8 +120,7 @@ func Test_aggworkerPeriodicFlushSignal(t *testing.T) {
 	}
 
 	go func() {
-		for {
-			<-flushCh
+		for range flushCh { // until closed below
 			called++
 		}
 	}()
@@ -0,0 +1,233 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// BackfillPoint is a data point of the history of a series, see
+// Backfill.
+type BackfillPoint struct {
+	TimeStamp time.Time
+	Value     float64
+}
+
+// BackfillSeries is the history of one series, see Backfill.
+type BackfillSeries struct {
+	Ident  serde.Ident
+	Points []BackfillPoint
+
+	// Spec, if not nil, is used instead of the matching DS spec if
+	// the series does not exist yet, e.g. to keep the retentions of
+	// imported history. An existing series must have the same RRAs.
+	Spec *rrd.DSSpec
+}
+
+// Backfill writes historical data points directly to the database,
+// bypassing the receiver queue, the DS cache and the workers, and is
+// meant for importing history in bulk. The points of each series are
+// processed in a fresh copy of the DS (so as in any RRD, the first
+// point only marks the beginning) and the resulting RRA slots
+// replace what is stored for them. Slots of all the series in the
+// batch are written together, vertically, so larger batches take
+// fewer database operations.
+//
+// If the series is cached (i.e. it is receiving data on this node),
+// only points before its last update are used and the RRAs are
+// otherwise left alone. If it is not, the series is advanced to the
+// latest point as needed. A series that is not cached must not be
+// receiving data while it is being backfilled, e.g. on another node
+// of a cluster.
+//
+// It returns the number of points used. The series for which there
+// is an error are skipped, the error returned is the first one.
+func (r *Receiver) Backfill(batch []BackfillSeries) (int, error) {
+	if r.serde == nil || r.serde.VerticalFlusher() == nil {
+		return 0, fmt.Errorf("Backfill: not supported by the database")
+	}
+
+	var (
+		rows     = make(map[bundleKey]map[int64]crossRRAPoints)
+		latests  = make(map[bundleKey]map[int64]time.Time)
+		advanced []rrd.DataSourcer
+		used     int
+		errs     []error
+	)
+
+	for _, bs := range batch {
+		n, ds, err := r.backfillSeries(bs, rows, latests)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", bs.Ident, err))
+			continue
+		}
+		if ds != nil {
+			advanced = append(advanced, ds)
+		}
+		used += n
+	}
+
+	vdb := r.serde.VerticalFlusher()
+	for key, segRows := range rows {
+		for i, row := range segRows {
+			if _, err := vdb.VerticalFlushDPs(key.bundleId, key.seg, i, row); err != nil {
+				return 0, fmt.Errorf("Backfill: error writing data points: %v", err)
+			}
+		}
+	}
+	for key, segLatests := range latests {
+		if _, err := vdb.VerticalFlushLatests(key.bundleId, key.seg, segLatests); err != nil {
+			return 0, fmt.Errorf("Backfill: error writing latests: %v", err)
+		}
+	}
+	for _, ds := range advanced {
+		if err := r.serde.Flusher().FlushDataSource(ds); err != nil {
+			return 0, fmt.Errorf("Backfill: error writing data source: %v", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		log.Printf("Backfill: %d of %d series failed, the first error: %v", len(errs), len(batch), errs[0])
+		return used, errs[0]
+	}
+	return used, nil
+}
+
+// backfillSeries processes the points of a series and adds the slots
+// (and latests, if they advance) to rows and latests. If the series
+// advances, the returned DS needs to be flushed.
+func (r *Receiver) backfillSeries(bs BackfillSeries, rows map[bundleKey]map[int64]crossRRAPoints, latests map[bundleKey]map[int64]time.Time) (int, rrd.DataSourcer, error) {
+	spec := bs.Spec
+	if spec == nil {
+		spec = r.dsc.finder.FindMatchingDSSpec(bs.Ident)
+	}
+	if spec == nil {
+		return 0, nil, fmt.Errorf("no matching DS spec")
+	}
+	ds, err := r.serde.Fetcher().FetchOrCreateDataSource(bs.Ident, spec)
+	if err != nil {
+		return 0, nil, err
+	}
+	dbds, ok := ds.(*serde.DbDataSource)
+	if !ok {
+		return 0, nil, fmt.Errorf("ds must be a *serde.DbDataSource")
+	}
+	if len(dbds.RRAs()) != len(spec.RRAs) {
+		return 0, nil, fmt.Errorf("the DS spec has changed since the DS was created")
+	}
+
+	// If cached, the cached DS is ahead of the database.
+	var cutoff time.Time
+	cached := false
+	if cds := r.dsc.getByIdent(newCachedIdent(bs.Ident)); cds != nil {
+		cached = true
+		cutoff = dbds.LastUpdate()
+		cds.mu.Lock()
+		if cds.spec == nil {
+			cutoff = cds.LastUpdate()
+		}
+		cds.mu.Unlock()
+	}
+
+	points := make([]BackfillPoint, 0, len(bs.Points))
+	for _, p := range bs.Points {
+		if !cached || p.TimeStamp.Before(cutoff) {
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].TimeStamp.Before(points[j].TimeStamp) })
+
+	fresh := rrd.NewDataSource(*spec)
+	used := 0
+	for _, p := range points {
+		if err := fresh.ProcessDataPoint(p.Value, p.TimeStamp); err == nil {
+			used++
+		}
+	}
+
+	for n, rra := range fresh.RRAs() {
+		drra, ok := dbds.RRAs()[n].(*serde.DbRoundRobinArchive)
+		if !ok {
+			return 0, nil, fmt.Errorf("rra must be a *serde.DbRoundRobinArchive")
+		}
+		if rra.Step() != drra.Step() || rra.Size() != drra.Size() {
+			return 0, nil, fmt.Errorf("the DS spec has changed since the DS was created")
+		}
+
+		origLatest, latest := drra.Latest(), rra.Latest()
+		if latest.IsZero() {
+			continue // not a single slot
+		}
+		advance := !cached && latest.After(origLatest)
+		newLatest := origLatest
+		if advance {
+			newLatest = latest
+		}
+		begins := rra.Begins(newLatest)
+
+		key := bundleKey{drra.BundleId(), drra.Seg()}
+		if rows[key] == nil {
+			rows[key] = make(map[int64]crossRRAPoints)
+		}
+		set := func(i int64, v float64) {
+			if rows[key][i] == nil {
+				rows[key][i] = make(crossRRAPoints)
+			}
+			rows[key][i][drra.Idx()] = v
+		}
+
+		if advance && !origLatest.IsZero() {
+			// Slots between the stored latest and the backfill
+			// would otherwise keep data from a previous round.
+			for t, k := origLatest.Add(rra.Step()), int64(0); !t.After(latest) && k < rra.Size(); t, k = t.Add(rra.Step()), k+1 {
+				set(rrd.SlotIndex(t, rra.Step(), rra.Size()), math.NaN())
+			}
+		}
+		for i, v := range rra.DPs() {
+			t := rrd.SlotTime(i, latest, rra.Step(), rra.Size())
+			if !t.After(begins) || t.After(newLatest) {
+				continue
+			}
+			set(i, v)
+		}
+
+		if advance {
+			if latests[key] == nil {
+				latests[key] = make(map[int64]time.Time)
+			}
+			latests[key][drra.Idx()] = latest
+		}
+	}
+
+	if !cached && fresh.LastUpdate().After(dbds.LastUpdate()) {
+		// Keep the ids, but the state of the backfill.
+		drras := dbds.RRAs()
+		for n, rra := range fresh.RRAs() {
+			drras[n].(*serde.DbRoundRobinArchive).RoundRobinArchiver = rra
+		}
+		fresh.SetRRAs(drras)
+		dbds.DataSourcer = fresh
+		return used, dbds, nil
+	}
+	return used, nil, nil
+}
@@ -0,0 +1,183 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeBackfillSerde struct {
+	*fakeSerde
+	dss     map[string]*serde.DbDataSource
+	dps     map[int64]crossRRAPoints // by slot
+	latests map[int64]time.Time
+	flushed []rrd.DataSourcer
+}
+
+func newFakeBackfillSerde() *fakeBackfillSerde {
+	return &fakeBackfillSerde{
+		fakeSerde: &fakeSerde{},
+		dss:       make(map[string]*serde.DbDataSource),
+		dps:       make(map[int64]crossRRAPoints),
+		latests:   make(map[int64]time.Time),
+	}
+}
+
+func (f *fakeBackfillSerde) Fetcher() serde.Fetcher                 { return f }
+func (f *fakeBackfillSerde) Flusher() serde.Flusher                 { return f }
+func (f *fakeBackfillSerde) VerticalFlusher() serde.VerticalFlusher { return f }
+
+func (f *fakeBackfillSerde) FetchOrCreateDataSource(ident serde.Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if ds := f.dss[ident.String()]; ds != nil {
+		return ds, nil
+	}
+	ds := serde.NewDbDataSource(int64(len(f.dss)+1), ident, rrd.NewDataSource(rrd.DSSpec{Step: spec.Step}))
+	var rras []rrd.RoundRobinArchiver
+	for i, rspec := range spec.RRAs {
+		rra, err := serde.NewDbRoundRobinArchive(int64(i+1), 10, 1, int64(i+1), rspec)
+		if err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+	ds.SetRRAs(rras)
+	f.dss[ident.String()] = ds
+	return ds, nil
+}
+
+func (f *fakeBackfillSerde) FlushDataSource(ds rrd.DataSourcer) error {
+	f.flushed = append(f.flushed, ds)
+	return nil
+}
+
+func (f *fakeBackfillSerde) VerticalFlushDPs(bundleId, seg, i int64, dps map[int64]float64) (int, error) {
+	if f.dps[i] == nil {
+		f.dps[i] = make(crossRRAPoints)
+	}
+	for idx, v := range dps {
+		f.dps[i][idx] = v
+	}
+	return 1, nil
+}
+
+func (f *fakeBackfillSerde) VerticalFlushLatests(bundleId, seg int64, latests map[int64]time.Time) (int, error) {
+	for idx, l := range latests {
+		f.latests[idx] = l
+	}
+	return 1, nil
+}
+
+func Test_Receiver_Backfill(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	db := newFakeBackfillSerde()
+	r := &Receiver{serde: db, dsc: newDsCache(db, &SimpleDSFinder{spec}, nil)}
+
+	if _, err := (&Receiver{dsc: r.dsc}).Backfill(nil); err == nil {
+		t.Errorf("Backfill: no error without a database")
+	}
+
+	// a new series
+	foo := serde.Ident{"name": "foo"}
+	var points []BackfillPoint
+	for ts := int64(1000); ts <= 1050; ts += 10 {
+		points = append(points, BackfillPoint{time.Unix(ts, 0), float64(ts)})
+	}
+	n, err := r.Backfill([]BackfillSeries{{Ident: foo, Points: points}})
+	if err != nil || n != 6 {
+		t.Errorf("Backfill: %d %v", n, err)
+	}
+	slot := func(ts int64) int64 { return rrd.SlotIndex(time.Unix(ts, 0), step, 10) }
+	for ts := int64(1010); ts <= 1050; ts += 10 {
+		if v := db.dps[slot(ts)][1]; v != float64(ts) {
+			t.Errorf("Backfill: slot %d: expected %v, got %v", ts, ts, v)
+		}
+	}
+	if !db.latests[1].Equal(time.Unix(1050, 0)) {
+		t.Errorf("Backfill: latest not advanced: %v", db.latests[1])
+	}
+	if len(db.flushed) != 1 || !db.flushed[0].LastUpdate().Equal(time.Unix(1050, 0)) {
+		t.Errorf("Backfill: DS not flushed with the new last update")
+	}
+	if ds := db.dss[foo.String()]; len(ds.RRAs()) != 1 {
+		t.Errorf("Backfill: DS lost its RRAs")
+	} else if _, ok := ds.RRAs()[0].(*serde.DbRoundRobinArchive); !ok {
+		t.Errorf("Backfill: RRAs should still be *serde.DbRoundRobinArchive")
+	}
+
+	// a cached series only takes points before its last update
+	cds := &cachedDs{DbDataSourcer: db.dss[foo.String()], mu: &sync.Mutex{}}
+	r.dsc.insert(cds)
+	db.dps = make(map[int64]crossRRAPoints)
+	db.latests = make(map[int64]time.Time)
+	db.flushed = nil
+	points = []BackfillPoint{{time.Unix(1020, 0), 1}, {time.Unix(1040, 0), 2}, {time.Unix(1060, 0), 3}}
+	n, err = r.Backfill([]BackfillSeries{{Ident: foo, Points: points}})
+	if err != nil || n != 2 {
+		t.Errorf("Backfill: cached: %d %v", n, err)
+	}
+	if v := db.dps[slot(1040)][1]; v != 2 {
+		t.Errorf("Backfill: cached: expected 2, got %v", v)
+	}
+	if _, ok := db.dps[slot(1060)]; ok || len(db.latests) > 0 || len(db.flushed) > 0 {
+		t.Errorf("Backfill: cached: a cached series must not advance")
+	}
+
+	// an uncached series advances, the gap after the stored latest is cleared
+	r.dsc.delete(foo)
+	db.dps = make(map[int64]crossRRAPoints)
+	points = []BackfillPoint{{time.Unix(1070, 0), 7}, {time.Unix(1080, 0), 8}}
+	if _, err = r.Backfill([]BackfillSeries{{Ident: foo, Points: points}}); err != nil {
+		t.Errorf("Backfill: %v", err)
+	}
+	if v := db.dps[slot(1060)][1]; !math.IsNaN(v) {
+		t.Errorf("Backfill: the slot between latest and the backfill should be NaN, got %v", v)
+	}
+	if v := db.dps[slot(1080)][1]; v != 8 {
+		t.Errorf("Backfill: expected 8, got %v", v)
+	}
+
+	// no spec
+	r.dsc.finder = &SimpleDSFinder{nil}
+	if _, err := r.Backfill([]BackfillSeries{{Ident: foo}}); err == nil {
+		t.Errorf("Backfill: no error without a DS spec")
+	}
+
+	// a spec of its own
+	bar := serde.Ident{"name": "bar"}
+	own := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: step, Span: 10 * step},
+			{Function: rrd.WMEAN, Step: 2 * step, Span: 10 * step},
+		},
+	}
+	if _, err := r.Backfill([]BackfillSeries{{Ident: bar, Points: points, Spec: own}}); err != nil {
+		t.Errorf("Backfill: with a spec: %v", err)
+	}
+	if ds := db.dss[bar.String()]; ds == nil || len(ds.RRAs()) != 2 {
+		t.Errorf("Backfill: the series should be created with the spec passed")
+	}
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// The most data points remembered per generation. When it is
+// reached, the generations are rotated early, which shortens the
+// window, rather than let the memory grow.
+const maxDedupEntries = 1000000
+
+// SetDedupWindow makes QueueDataPoint() drop a data point which is an
+// exact duplicate (same ident, timestamp and value) of one which
+// arrived less than window ago. This is what happens when relays are
+// configured with redundant routes. Duplicates are detected after the
+// rewrite rules and the series filter. It must be called before
+// Start().
+func (r *Receiver) SetDedupWindow(window time.Duration) {
+	r.dedup = newDeduper(window)
+}
+
+type dedupKey struct {
+	ident string
+	ts    int64
+	value uint64
+}
+
+// deduper remembers the data points seen in two generations of
+// window length each, so that expiring them is just dropping the
+// older generation.
+type deduper struct {
+	dropped int64 // since last reported, first for alignment
+
+	sync.Mutex
+	window    time.Duration
+	cur, prev map[dedupKey]time.Time // arrival time
+	rotated   time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window:  window,
+		cur:     make(map[dedupKey]time.Time),
+		rotated: time.Now(),
+		stop:    make(chan struct{}),
+	}
+}
+
+// accept returns false if the data point is a duplicate.
+func (d *deduper) accept(ident serde.Ident, ts time.Time, v float64, now time.Time) bool {
+	key := dedupKey{ident: ident.String(), ts: ts.UnixNano(), value: math.Float64bits(v)}
+
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(d.rotated) >= d.window || len(d.cur) >= maxDedupEntries {
+		d.prev, d.cur = d.cur, make(map[dedupKey]time.Time, len(d.cur))
+		d.rotated = now
+	}
+	if seen, ok := d.cur[key]; ok && now.Sub(seen) < d.window {
+		atomic.AddInt64(&d.dropped, 1)
+		return false
+	}
+	if seen, ok := d.prev[key]; ok && now.Sub(seen) < d.window {
+		atomic.AddInt64(&d.dropped, 1)
+		return false
+	}
+	d.cur[key] = now
+	return true
+}
+
+func (d *deduper) start(sr statReporter) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			d.report(sr)
+		}
+	}()
+}
+
+func (d *deduper) report(sr statReporter) {
+	d.Lock()
+	entries := len(d.cur) + len(d.prev)
+	d.Unlock()
+	sr.reportStatCount("receiver.dedup.dropped", float64(atomic.SwapInt64(&d.dropped, 0)))
+	sr.reportStatGauge("receiver.dedup.entries", float64(entries))
+}
+
+func (d *deduper) stopReporting() {
+	close(d.stop)
+	d.wg.Wait()
+}
@@ -0,0 +1,67 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_deduper(t *testing.T) {
+	d := newDeduper(10 * time.Second)
+	now := time.Now()
+	ts := time.Unix(1500000000, 0)
+	foo := serde.Ident{"name": "foo"}
+
+	if !d.accept(foo, ts, 1, now) {
+		t.Errorf("accept: first data point should be accepted")
+	}
+	if d.accept(foo, ts, 1, now.Add(time.Second)) {
+		t.Errorf("accept: duplicate should be dropped")
+	}
+	if !d.accept(foo, ts, 2, now.Add(time.Second)) {
+		t.Errorf("accept: different value should be accepted")
+	}
+	if !d.accept(foo, ts.Add(time.Second), 1, now.Add(time.Second)) {
+		t.Errorf("accept: different timestamp should be accepted")
+	}
+	if !d.accept(serde.Ident{"name": "bar"}, ts, 1, now.Add(time.Second)) {
+		t.Errorf("accept: different name should be accepted")
+	}
+
+	// after a rotation the point is still remembered in prev
+	if d.accept(foo, ts, 2, now.Add(10*time.Second)) {
+		t.Errorf("accept: duplicate within the window should be dropped after a rotation")
+	}
+	// but not once it is older than the window
+	if !d.accept(foo, ts, 1, now.Add(15*time.Second)) {
+		t.Errorf("accept: data point older than the window should be accepted")
+	}
+
+	sr := &fakeSr{}
+	d.report(sr)
+	if sr.called == 0 || d.dropped != 0 {
+		t.Errorf("report: expected stats reported and dropped reset, got %d %d", sr.called, d.dropped)
+	}
+
+	r := &Receiver{}
+	r.SetDedupWindow(time.Minute)
+	if r.dedup == nil || r.dedup.window != time.Minute {
+		t.Errorf("SetDedupWindow: dedup not set")
+	}
+}
@@ -0,0 +1,188 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/serde"
+)
+
+// DeleteSeries deletes series along with their history and returns
+// how many there were. Cached series are dropped from the cache
+// without being flushed, a data point which arrives for a series
+// afterwards creates it anew. In a cluster the series are cached by
+// the node which owns them, which may be another one, so the other
+// nodes are told to drop them too (see dsCacheDrop).
+func (r *Receiver) DeleteSeries(idents []serde.Ident) (int, error) {
+	dd, ok := r.serde.(serde.DataSourceDeleter)
+	if !ok {
+		return 0, fmt.Errorf("DeleteSeries: not supported by the database")
+	}
+	if b, ok := r.cluster.(broadcaster); ok && len(idents) > 0 {
+		broadcastDSCacheDrop(b, idents)
+	}
+	var n int
+	for _, ident := range idents {
+		r.dsc.delete(ident)
+		deleted, err := dd.DeleteDataSource(ident)
+		if err != nil {
+			return n, fmt.Errorf("DeleteSeries: %v: %v", ident, err)
+		}
+		if deleted {
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("DeleteSeries: deleted %d series.", n)
+	}
+	return n, nil
+}
+
+// broadcaster is implemented by cluster.Cluster.
+type broadcaster interface {
+	Broadcast(payload interface{}) error
+	Broadcasts() <-chan *cluster.Msg
+}
+
+// dsCacheDrop is broadcast to the cluster by DeleteSeries(), the
+// nodes which receive it drop the series from their cache without
+// flushing them, see dsCacheDropListener(). A broadcast is
+// best-effort: should it be lost, the owner keeps flushing a series
+// which no longer exists (to no effect) until it is evicted.
+type dsCacheDrop struct {
+	Idents []serde.Ident
+}
+
+// broadcastDSCacheDrop broadcasts a dsCacheDrop of idents, in as many
+// broadcasts as it takes to remain under cluster.MaxBroadcastSize.
+func broadcastDSCacheDrop(b broadcaster, idents []serde.Ident) {
+	err := b.Broadcast(&dsCacheDrop{Idents: idents})
+	if err == nil {
+		return
+	}
+	if len(idents) == 1 {
+		log.Printf("DeleteSeries: unable to tell the cluster to drop %v: %v", idents[0], err)
+		return
+	}
+	broadcastDSCacheDrop(b, idents[:len(idents)/2])
+	broadcastDSCacheDrop(b, idents[len(idents)/2:])
+}
+
+// dsCacheDropListener drops the series of the dsCacheDrop broadcasts
+// received from the other nodes from the cache. Other broadcasts are
+// ignored.
+func dsCacheDropListener(dsc *dsCache, ch <-chan *cluster.Msg) {
+	for m := range ch {
+		var drop dsCacheDrop
+		if err := m.Decode(&drop); err != nil {
+			continue
+		}
+		for _, ident := range drop.Idents {
+			dsc.delete(ident)
+		}
+		if len(drop.Idents) > 0 {
+			log.Printf("dsCacheDropListener: %s deleted %d series, dropped from the cache.", m.Src.Name(), len(drop.Idents))
+		}
+	}
+}
+
+// MatchSeries returns the idents of the series whose name matches
+// pattern, which is a glob as in Graphite (i.e. filepath.Match, where
+// * does not match a dot, e.g. servers.*.cpu), or if regex is true a
+// regular expression.
+func (r *Receiver) MatchSeries(pattern string, regex bool) ([]serde.Ident, error) {
+	var match func(name string) bool
+	query := serde.SearchQuery{"name": "."}
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("MatchSeries: %v", err)
+		}
+		match = re.MatchString
+		query["name"] = pattern
+	} else {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("MatchSeries: %v", err)
+		}
+		dots := strings.Count(pattern, ".")
+		match = func(name string) bool {
+			ok, _ := filepath.Match(pattern, name)
+			return ok && strings.Count(name, ".") == dots
+		}
+	}
+
+	sr, err := r.serde.Fetcher().Search(query)
+	if err != nil {
+		return nil, fmt.Errorf("MatchSeries: %v", err)
+	}
+	defer sr.Close()
+	var result []serde.Ident
+	for sr.Next() {
+		// The database may match more loosely (or not at all)
+		if ident := sr.Ident(); match(ident["name"]) {
+			result = append(result, ident)
+		}
+	}
+	return result, nil
+}
+
+// ExpireSeries deletes the series which have not been updated since
+// before (see serde.SeriesActivityLister), unless they are cached
+// and have been updated since, and returns them. With dryRun they are
+// only listed.
+func (r *Receiver) ExpireSeries(before time.Time, dryRun bool) ([]serde.SeriesActivity, error) {
+	lister, ok := r.serde.(serde.SeriesActivityLister)
+	if !ok {
+		return nil, fmt.Errorf("ExpireSeries: not supported by the database")
+	}
+	stale, err := lister.StaleSeries(before, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireSeries: %v", err)
+	}
+
+	// The database lags behind the cache
+	result := stale[:0]
+	for _, sa := range stale {
+		if cds := r.dsc.getByIdent(newCachedIdent(sa.Ident)); cds != nil {
+			cds.mu.Lock()
+			lu := cds.LastUpdate()
+			cds.mu.Unlock()
+			if !lu.Before(before) {
+				continue
+			}
+		}
+		result = append(result, sa)
+	}
+	if dryRun || len(result) == 0 {
+		return result, nil
+	}
+
+	idents := make([]serde.Ident, len(result))
+	for i, sa := range result {
+		idents[i] = sa.Ident
+	}
+	if _, err := r.DeleteSeries(idents); err != nil {
+		return nil, fmt.Errorf("ExpireSeries: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,203 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeSearchResult struct {
+	idents []serde.Ident
+	pos    int
+}
+
+func (sr *fakeSearchResult) Next() bool         { sr.pos++; return sr.pos <= len(sr.idents) }
+func (sr *fakeSearchResult) Ident() serde.Ident { return sr.idents[sr.pos-1] }
+func (sr *fakeSearchResult) Close() error       { return nil }
+
+type fakeDeleteSerde struct {
+	*fakeBackfillSerde
+}
+
+func (f *fakeDeleteSerde) Fetcher() serde.Fetcher { return f }
+
+func (f *fakeDeleteSerde) DeleteDataSource(ident serde.Ident) (bool, error) {
+	if f.dss[ident.String()] == nil {
+		return false, nil
+	}
+	delete(f.dss, ident.String())
+	return true, nil
+}
+
+func (f *fakeDeleteSerde) Search(serde.SearchQuery) (serde.SearchResult, error) {
+	sr := &fakeSearchResult{}
+	for _, ds := range f.dss {
+		sr.idents = append(sr.idents, ds.Ident())
+	}
+	return sr, nil
+}
+
+func (f *fakeDeleteSerde) RecentSeries(since time.Time, offset, limit int) ([]serde.SeriesActivity, error) {
+	return nil, nil
+}
+
+func (f *fakeDeleteSerde) StaleSeries(before time.Time, offset, limit int) ([]serde.SeriesActivity, error) {
+	var result []serde.SeriesActivity
+	for _, ds := range f.dss {
+		if ds.LastUpdate().Before(before) {
+			result = append(result, serde.SeriesActivity{Ident: ds.Ident(), LastUpdate: ds.LastUpdate()})
+		}
+	}
+	return result, nil
+}
+
+func names(idents []serde.Ident) []string {
+	var result []string
+	for _, ident := range idents {
+		result = append(result, ident["name"])
+	}
+	sort.Strings(result)
+	return result
+}
+
+func Test_Receiver_DeleteSeries(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	db := &fakeDeleteSerde{fakeBackfillSerde: newFakeBackfillSerde()}
+	r := &Receiver{serde: db.fakeBackfillSerde, dsc: newDsCache(db, &SimpleDSFinder{spec}, nil)}
+	if _, err := r.DeleteSeries([]serde.Ident{{"name": "foo"}}); err == nil {
+		t.Errorf("DeleteSeries: expected an error if the database cannot delete")
+	}
+	if _, err := r.ExpireSeries(time.Now(), true); err == nil {
+		t.Errorf("ExpireSeries: expected an error if the database cannot list stale series")
+	}
+
+	r.serde = db
+	for _, name := range []string{"a.b.c", "a.x.c", "a.b.c.d", "b.b.c"} {
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+		ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	}
+
+	for _, c := range []struct {
+		pattern string
+		regex   bool
+		expect  []string
+	}{
+		{"a.*.c", false, []string{"a.b.c", "a.x.c"}},
+		{"*.b.c", false, []string{"a.b.c", "b.b.c"}},
+		{`^a\.b`, true, []string{"a.b.c", "a.b.c.d"}},
+	} {
+		idents, err := r.MatchSeries(c.pattern, c.regex)
+		if got := names(idents); err != nil || len(got) != len(c.expect) || (len(got) > 0 && got[0] != c.expect[0]) {
+			t.Errorf("MatchSeries(%q): expected %v, got %v %v", c.pattern, c.expect, got, err)
+		}
+	}
+	if _, err := r.MatchSeries("[", false); err == nil {
+		t.Errorf("MatchSeries: expected an error for a bad glob")
+	}
+	if _, err := r.MatchSeries("(", true); err == nil {
+		t.Errorf("MatchSeries: expected an error for a bad regex")
+	}
+
+	// a cached series which is being updated is not expired
+	abcd := serde.Ident{"name": "a.b.c.d"}
+	cds := &cachedDs{DbDataSourcer: db.dss[abcd.String()].Copy().(*serde.DbDataSource), mu: &sync.Mutex{}}
+	cds.ProcessDataPoint(1, time.Unix(2000, 0))
+	r.dsc.insert(cds)
+
+	stale, err := r.ExpireSeries(time.Unix(1500, 0), true)
+	if err != nil || len(stale) != 3 || len(db.dss) != 4 {
+		t.Errorf("ExpireSeries: dry run: expected 3 stale series and none deleted: %v %v", stale, err)
+	}
+	if _, err := r.ExpireSeries(time.Unix(1500, 0), false); err != nil {
+		t.Errorf("ExpireSeries: %v", err)
+	}
+	if len(db.dss) != 1 || db.dss[abcd.String()] == nil {
+		t.Errorf("ExpireSeries: expected only a.b.c.d to be left, got %v", db.dss)
+	}
+
+	n, err := r.DeleteSeries([]serde.Ident{abcd, {"name": "nonexistent"}})
+	if err != nil || n != 1 || len(db.dss) != 0 {
+		t.Errorf("DeleteSeries: %d %v", n, err)
+	}
+	if r.dsc.getByIdent(newCachedIdent(abcd)) != nil {
+		t.Errorf("DeleteSeries: the series should be dropped from the cache")
+	}
+}
+
+// tinyBroadcaster refuses broadcasts of more than one ident, like a
+// cluster would those over cluster.MaxBroadcastSize.
+type tinyBroadcaster struct {
+	drops []*dsCacheDrop
+}
+
+func (b *tinyBroadcaster) Broadcast(payload interface{}) error {
+	drop := payload.(*dsCacheDrop)
+	if len(drop.Idents) > 1 {
+		return fmt.Errorf("message too large")
+	}
+	b.drops = append(b.drops, drop)
+	return nil
+}
+
+func (b *tinyBroadcaster) Broadcasts() <-chan *cluster.Msg { return nil }
+
+func Test_Receiver_DeleteSeries_cluster(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	fn := cluster.NewFakeNetwork()
+	a, b := fn.NewCluster("a"), fn.NewCluster("b")
+
+	// The series is cached by b, it is deleted via a.
+	db := &fakeDeleteSerde{fakeBackfillSerde: newFakeBackfillSerde()}
+	foo := serde.Ident{"name": "foo"}
+	ds, _ := db.FetchOrCreateDataSource(foo, spec)
+	dscB := newDsCache(db, &SimpleDSFinder{spec}, nil)
+	dscB.insert(&cachedDs{DbDataSourcer: ds.(*serde.DbDataSource).Copy().(*serde.DbDataSource), mu: &sync.Mutex{}})
+	go dsCacheDropListener(dscB, b.Broadcasts())
+
+	r := &Receiver{serde: db, dsc: newDsCache(db, &SimpleDSFinder{spec}, nil), cluster: a}
+	if n, err := r.DeleteSeries([]serde.Ident{foo}); n != 1 || err != nil {
+		t.Fatalf("DeleteSeries: %d %v", n, err)
+	}
+	for i := 0; dscB.getByIdent(newCachedIdent(foo)) != nil; i++ {
+		if i == 100 {
+			t.Fatalf("DeleteSeries: the series is still cached by the other node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Too many idents for one broadcast are split.
+	tb := &tinyBroadcaster{}
+	broadcastDSCacheDrop(tb, []serde.Ident{{"name": "x"}, {"name": "y"}, {"name": "z"}})
+	if len(tb.drops) != 3 {
+		t.Errorf("broadcastDSCacheDrop: expected 3 broadcasts, got %d", len(tb.drops))
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"log"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
@@ -90,13 +91,29 @@ var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) int {
 	return cnt
 }
 
-var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+// staleDSs are DSs whose incoming data points are held back because
+// the cluster changed and their node assignment may no longer be
+// valid. The director processes them again after the Transition().
+type staleDSs map[*cachedDs]bool
+
+// Past this many stale DSs we stop holding data points back and
+// forward them as is (some may be lost if nodes are gone).
+const maxStaleDSs = 100000
+
+var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, stale staleDSs) {
 	if clstr == nil {
 		workerCh <- cds
 		return
 	}
 
-	for _, node := range clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc}) {
+	nodes, isStale := clstr.NodesForDistDatumChecked(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc})
+	if isStale && stale != nil && (stale[cds] || len(stale) < maxStaleDSs) {
+		stale[cds] = true
+		stats.held++
+		return // the data points stay in cds.incoming
+	}
+
+	for _, node := range nodes {
 		if node.Name() == clstr.LocalNode().Name() {
 			workerCh <- cds
 		} else {
@@ -120,7 +137,7 @@ var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *
 	return
 }
 
-var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, stale staleDSs) {
 
 	if math.IsNaN(dp.value) {
 		// NaN is meaningless, e.g. "the thermometer is
@@ -130,8 +147,17 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 		return
 	}
 
-	cds := dsc.getByIdentOrCreateEmpty(dp.cachedIdent)
+	cds, overQuota := dsc.getByIdentOrCreateEmpty(dp.cachedIdent)
 	if cds == nil {
+		if overQuota {
+			stats.overQuota++
+			dsc.quota.reject(dp)
+			return
+		}
+		if dsc.refusing() {
+			stats.refused++
+			return
+		}
 		stats.unknown++
 		if debug {
 			log.Printf("director: No spec matched ident: %#v, ignoring data point", dp.cachedIdent.String())
@@ -142,12 +168,15 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 	cds.appendIncoming(dp)
 
 	if cds.Id() == 0 { // this DS needs to be loaded.
+		stats.cacheMisses++
 		if !cds.sentToLoader {
 			cds.sentToLoader = true
+			atomic.AddInt32(&dsc.loading, 1)
 			loaderCh <- cds
 		}
 	} else {
-		directorProcessOrForward(dsc, cds, workerCh, clstr, snd, stats)
+		stats.cacheHits++
+		directorProcessOrForward(dsc, cds, workerCh, clstr, snd, stats, stale)
 	}
 }
 
@@ -190,6 +219,7 @@ var loader = func(loaderCh, dpCh chan interface{}, dsc *dsCache, sr statReporter
 		if cds.spec != nil { // nil spec means it's been loaded already
 			if err := dsc.fetchOrCreateByIdent(cds); err != nil {
 				log.Printf("loader: database error: %v", err)
+				atomic.AddInt32(&dsc.loading, -1)
 				continue
 			}
 		}
@@ -199,16 +229,18 @@ var loader = func(loaderCh, dpCh chan interface{}, dsc *dsCache, sr statReporter
 		}
 
 		dpCh <- cds
+		atomic.AddInt32(&dsc.loading, -1) // after, see Receiver.drainQueue()
 	}
 }
 
 type dpStats struct {
-	total, forwarded, unknown, dropped int
-	forwarded_to                       map[string]int
-	last                               time.Time
+	total, forwarded, unknown, dropped, refused, overQuota, held int
+	cacheHits, cacheMisses                                       int
+	forwarded_to                                                 map[string]int
+	last                                                         time.Time
 }
 
-var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, maxQLen int) {
+var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, maxQLen int, flow *flowControl, counts *receiverCounts) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -216,6 +248,7 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 		clusterChgCh chan bool
 		snd, rcv     chan *cluster.Msg
 		queue        = &fifoQueue{}
+		stale        = make(staleDSs)
 	)
 
 	if clstr != nil {
@@ -231,6 +264,11 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 	dpOutCh := make(chan interface{}, 128)
 	go elasticCh(dpCh, dpOutCh, queue)
 
+	if flow != nil {
+		log.Printf("director: flow control at queue size %d (resuming at %d).", flow.high, flow.low)
+		flow.start(queue.size, sr)
+	}
+
 	// Experimentation shows that the length of loader channel doesn't
 	// matter much - making it 64K doesn't provide better performance
 	// than 4K.
@@ -239,10 +277,14 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 
 	var workerWg sync.WaitGroup
 	workerCh := make(chan *cachedDs, 128)
+	workerCounts := make([]*workerCounts, nWorkers)
+	if counts != nil {
+		workerCounts = counts.setDirector(queue.size, loaderCh, workerCh, nWorkers)
+	}
 	log.Printf("director: starting %d workers.", nWorkers)
 	for i := 0; i < nWorkers; i++ {
 		workerWg.Add(1)
-		go worker(&workerWg, workerCh, dsf, sr, i)
+		go worker(&workerWg, workerCh, dsf, sr, i, workerCounts[i])
 	}
 
 	wc.onStarted()
@@ -263,6 +305,12 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 				if err := clstr.Transition(45 * time.Second); err != nil {
 					log.Printf("director: Transition error: %v", err)
 				}
+				// Now that nodes are assigned, process the held back data points
+				held := stale
+				stale = make(staleDSs)
+				for cds := range held {
+					directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats, stale)
+				}
 			}
 			continue
 		case x, ok = <-dpOutCh:
@@ -271,6 +319,10 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 				dp = x
 			case *cachedDs:
 				cds = x
+			case *drainRequest:
+				// everything queued before it has been seen
+				x.resp <- atomic.LoadInt32(&dsc.loading) == 0
+				continue
 			case nil:
 				// close signal
 			default:
@@ -292,11 +344,11 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 			// if the dp ident is not found, it will be submitted to
 			// the loader, which will return it to us through the dpCh
 			// as a cachedDs.
-			directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, snd, &stats)
+			directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, snd, &stats, stale)
 			stats.total++
 		} else if cds != nil {
 			// this came from the loader, we do not need to look it up
-			directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats)
+			directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats, stale)
 		} else {
 			// wait for worker and loader channels to empty
 			log.Printf("director: channel closed, waiting for loader and workers to empty...")
@@ -325,7 +377,16 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 			sr.reportStatCount("receiver.datapoints.total", float64(stats.total))
 			sr.reportStatCount("receiver.datapoints.dropped", float64(stats.dropped)) // this too might be dropped...
 			sr.reportStatCount("receiver.datapoints.unknown", float64(stats.unknown))
+			sr.reportStatCount("receiver.datapoints.refused", float64(stats.refused))
+			sr.reportStatCount("receiver.datapoints.over_quota", float64(stats.overQuota))
 			sr.reportStatCount("receiver.datapoints.forwarded", float64(stats.forwarded))
+			sr.reportStatCount("receiver.datapoints.held", float64(stats.held))
+			sr.reportStatCount("receiver.cache.hits", float64(stats.cacheHits))
+			sr.reportStatCount("receiver.cache.misses", float64(stats.cacheMisses))
+			sr.reportStatGauge("receiver.worker_queue_len", float64(len(workerCh)))
+			if counts != nil {
+				counts.addDirectorStats(&stats)
+			}
 			for dest, cnt := range stats.forwarded_to {
 				sr.reportStatCount(fmt.Sprintf("receiver.forwarded_to.%s", dest), float64(cnt))
 			}
@@ -338,7 +399,7 @@ var director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr c
 	}
 }
 
-var worker = func(wg *sync.WaitGroup, workerCh chan *cachedDs, dsf dsFlusherBlocking, sr statReporter, n int) {
+var worker = func(wg *sync.WaitGroup, workerCh chan *cachedDs, dsf dsFlusherBlocking, sr statReporter, n int, wcnt *workerCounts) {
 	log.Printf("worker %d: starting.", n)
 	defer wg.Done()
 	lastStat := time.Now()
@@ -349,11 +410,15 @@ var worker = func(wg *sync.WaitGroup, workerCh chan *cachedDs, dsf dsFlusherBloc
 			log.Printf("worker %d: exiting.", n)
 			return
 		}
-		accepted += directorProcessDataPoint(cds, dsf)
+		cnt := directorProcessDataPoint(cds, dsf)
+		accepted += cnt
+		wcnt.add(cnt)
 
-		if lastStat.Before(time.Now().Add(-time.Second)) {
+		if now := time.Now(); now.Sub(lastStat) > time.Second {
 			sr.reportStatCount("receiver.datapoints.accepted", float64(accepted))
-			lastStat = time.Now()
+			sr.reportStatGauge(fmt.Sprintf("receiver.worker.%d.rate", n), float64(accepted)/now.Sub(lastStat).Seconds())
+			wcnt.setRate(accepted, now.Sub(lastStat), now)
+			lastStat = now
 			accepted = 0
 		}
 	}
@@ -198,8 +198,8 @@ func Test_directorProcessOrForward(t *testing.T) {
 	}()
 
 	// Test if we are LocalNode
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, nil)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, nil)
 	if sent < 1 {
 		t.Errorf("directorProcessOrForward: Nothing sent to workerChs")
 	}
@@ -208,11 +208,30 @@ func Test_directorProcessOrForward(t *testing.T) {
 	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
 	clstr.nodesForDd = []*cluster.Node{remote}
 
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, nil)
 	if forward != 1 {
 		t.Errorf("directorProcessOrForward: directorForwardDPToNode not called")
 	}
 
+	// Assignment is stale, the DS should be held back
+	cds.appendIncoming(dp)
+	clstr.stale = true
+	stale := make(staleDSs)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, stale)
+	if forward != 1 {
+		t.Errorf("directorProcessOrForward: directorForwardDPToNode called with stale assignment")
+	}
+	if !stale[cds] || st.held != 1 {
+		t.Errorf("directorProcessOrForward: stale DS not held back: %v %d", stale, st.held)
+	}
+
+	// No place to hold, forward anyway
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, nil)
+	if forward != 2 {
+		t.Errorf("directorProcessOrForward: directorForwardDPToNode not called with nil stale")
+	}
+	clstr.stale = false
+
 	fl := &fakeLogger{}
 	log.SetOutput(fl)
 	defer func() {
@@ -236,7 +255,7 @@ func Test_directorProcessOrForward(t *testing.T) {
 	ds.ProcessDataPoint(123, time.Unix(3000, 0))
 	cds = &cachedDs{DbDataSourcer: ds}
 
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, nil)
 	if !strings.Contains(string(fl.last), "PointCount") {
 		t.Errorf("directorProcessOrForward: Missing the PointCount warning log")
 	}
@@ -252,7 +271,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 
 	saveFn := directorProcessOrForward
 	dpofCalled := 0
-	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, stale staleDSs) {
 		dpofCalled++
 	}
 
@@ -301,7 +320,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 
 	// NaN
 	dp.value = math.NaN()
-	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a NaN, directorProcessOrForward should not be called")
 	}
@@ -309,7 +328,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	// A value
 	dp.value = 1234
 	lsent, dpofCalled = 0, 0
-	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st, nil)
 	if lsent != 1 {
 		t.Errorf("directorProcessIncomingDP: With a value, should send it to loader")
 	}
@@ -320,7 +339,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	// A blank name should cause a nil rds
 	dp.cachedIdent = newCachedIdent(serde.Ident{"name": ""})
 	dpofCalled = 0
-	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a blank name, directorProcessOrForward should not be called")
 	}
@@ -329,7 +348,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	dp.cachedIdent = newCachedIdent(serde.Ident{"name": "blah"})
 	db.fakeErr = true
 	dpofCalled = 0
-	directorProcessIncomingDP(dp, dsc, loaderCh, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, nil, nil, nil, st, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a db error, directorProcessOrForward should not be called")
 	}
@@ -337,7 +356,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	// nil cluster
 	dp.value = 1234
 	db.fakeErr = false
-	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, nil, nil, st, nil)
 	if dpofCalled != 0 {
 		t.Errorf("directorProcessIncomingDP: With a value and no cluster, directorProcessOrForward should not be called: %v", dpofCalled)
 	}
@@ -352,7 +371,7 @@ func Test_the_director(t *testing.T) {
 	dimCalled := 0
 	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan interface{}) { dimCalled++ }
 	dpidpCalled := 0
-	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, stale staleDSs) {
 		dpidpCalled++
 	}
 
@@ -375,7 +394,7 @@ func Test_the_director(t *testing.T) {
 	dsc := newDsCache(db, df, dsf)
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, 1, clstr, sr, dsc, nil, 0)
+	go director(wc, dpCh, 1, clstr, sr, dsc, nil, 0, nil, nil)
 	wc.startWg.Wait()
 
 	if clstr.nReady == 0 {
@@ -438,7 +457,7 @@ func Test_the_director(t *testing.T) {
 	dpCh <- dp
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, 1, clstr, sr, dsc, nil, 0)
+	go director(wc, dpCh, 1, clstr, sr, dsc, nil, 0, nil, nil)
 	wc.startWg.Wait()
 
 	time.Sleep(100 * time.Millisecond)
@@ -0,0 +1,193 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long Drain() waits before asking the director again whether
+// DSs are still being loaded.
+const drainRetryInterval = 10 * time.Millisecond
+
+// pauseState is what Pause() and Resume() change.
+type pauseState struct {
+	sync.Mutex
+	paused  int32         // atomic, checked by QueueDataPoint()
+	gate    chan struct{} // closed by Resume(), nil when not paused
+	dropped int64         // points dropped while paused, atomic
+}
+
+// Pause makes the receiver stop accepting new data points until
+// Resume() is called: QueueDataPoint() drops them and WaitReady()
+// blocks, so that flow controlled connections (e.g. graphite TCP)
+// stop reading rather than losing data. Points already queued are
+// still processed, as are points forwarded by other cluster nodes.
+func (r *Receiver) Pause() {
+	r.pause.Lock()
+	defer r.pause.Unlock()
+	if r.pause.gate == nil {
+		r.pause.gate = make(chan struct{})
+		atomic.StoreInt32(&r.pause.paused, 1)
+		log.Printf("Receiver: paused, not accepting data points.")
+	}
+}
+
+// Resume undoes Pause().
+func (r *Receiver) Resume() {
+	r.pause.Lock()
+	defer r.pause.Unlock()
+	if r.pause.gate != nil {
+		atomic.StoreInt32(&r.pause.paused, 0)
+		close(r.pause.gate)
+		r.pause.gate = nil
+		log.Printf("Receiver: resumed, %d data point(s) were dropped while paused.", atomic.SwapInt64(&r.pause.dropped, 0))
+	}
+}
+
+// Paused tells whether the receiver is paused.
+func (r *Receiver) Paused() bool {
+	return atomic.LoadInt32(&r.pause.paused) != 0
+}
+
+// dropPaused counts the data point as dropped if the receiver is
+// paused.
+func (r *Receiver) dropPaused() bool {
+	if atomic.LoadInt32(&r.pause.paused) == 0 {
+		return false
+	}
+	atomic.AddInt64(&r.pause.dropped, 1)
+	return true
+}
+
+// waitResumed blocks while the receiver is paused.
+func (r *Receiver) waitResumed() {
+	r.pause.Lock()
+	gate := r.pause.gate
+	r.pause.Unlock()
+	if gate != nil {
+		<-gate
+	}
+}
+
+// releasePaused lets whatever is waiting in WaitReady() go without
+// resuming, so that it can finish when the receiver is stopping.
+func (r *Receiver) releasePaused() {
+	r.pause.Lock()
+	defer r.pause.Unlock()
+	if r.pause.gate != nil {
+		close(r.pause.gate)
+		r.pause.gate = nil
+	}
+}
+
+// drainRequest is sent through the receiver queue by Drain(). The
+// director replies whether all the DSs sent to the loader are back,
+// if not, their data points may be queued behind the request.
+type drainRequest struct {
+	resp chan bool
+}
+
+// Drain pauses the receiver (see Pause()), waits for the data points
+// already queued to be processed and flushes the DSs in the cache
+// and the vertical cache to the database. When it returns nil,
+// everything received so far (except what aggregation rules or rate
+// limits are still holding back) is in the database, e.g. so that
+// another node can take over. The receiver stays paused, it can be
+// Resume()d or Stop()ped. If ctx is done first, its error is
+// returned and the drain is incomplete.
+func (r *Receiver) Drain(ctx context.Context) error {
+	r.Pause()
+	log.Printf("Receiver: draining...")
+	start := time.Now()
+	if err := r.drainQueue(ctx); err != nil {
+		return err
+	}
+	n, err := r.flushCache(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		r.flusher.sync()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	log.Printf("Receiver: drained, flushed %d DS(s) in %v.", n, time.Since(start))
+	return nil
+}
+
+// drainQueue returns once the data points queued so far have been
+// passed on by the director. This takes two requests in a row with
+// nothing being loaded: the points of a DS whose load finished just
+// before the first one can be queued behind it.
+func (r *Receiver) drainQueue(ctx context.Context) error {
+	for clean := 0; clean < 2; {
+		req := &drainRequest{resp: make(chan bool, 1)}
+		select {
+		case r.dpCh <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case loaded := <-req.resp:
+			if loaded {
+				clean++
+			} else {
+				clean = 0
+				time.Sleep(drainRetryInterval)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// flushCache processes the data points waiting in every cached DS
+// and flushes it, returning the number of DSs flushed.
+func (r *Receiver) flushCache(ctx context.Context) (int, error) {
+	n := 0
+	for _, cds := range r.dsc.all() {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if cds.Id() == 0 { // never loaded
+			continue
+		}
+		cds.mu.Lock()
+		if _, err := cds.process(true); err != nil {
+			log.Printf("Receiver.Drain(): [%v] error: %v", cds.Ident(), err)
+		}
+		if r.flusher.enabled() && !cds.LastUpdate().IsZero() {
+			r.flusher.flushToVCache(cds.DbDataSourcer)
+			r.flusher.flushDS(cds.DbDataSourcer, true)
+			cds.lastFlush = time.Now()
+			cds.lastDSFlush = cds.lastFlush
+			n++
+		}
+		cds.mu.Unlock()
+	}
+	return n, nil
+}
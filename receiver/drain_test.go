@@ -0,0 +1,82 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_Pause(t *testing.T) {
+	r := &Receiver{dpCh: make(chan interface{}, 1)}
+	r.Pause()
+	if !r.Paused() {
+		t.Errorf("Pause: expected Paused() to be true")
+	}
+	r.QueueDataPoint(serde.Ident{"name": "a"}, time.Now(), 1)
+	if len(r.dpCh) != 0 || r.pause.dropped != 1 {
+		t.Errorf("QueueDataPoint: expected the point to be dropped while paused")
+	}
+
+	done := make(chan bool)
+	go func() {
+		r.WaitReady()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatalf("WaitReady did not block while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.Resume()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("WaitReady still blocked after Resume")
+	}
+	r.QueueDataPoint(serde.Ident{"name": "a"}, time.Now(), 1)
+	if r.Paused() || len(r.dpCh) != 1 {
+		t.Errorf("Resume: expected the point to be queued")
+	}
+}
+
+func Test_Receiver_drainQueue(t *testing.T) {
+	r := &Receiver{dpCh: make(chan interface{})}
+
+	// the director: a DS is being loaded at first
+	replies := []bool{false, true, false, true, true}
+	go func() {
+		for _, loaded := range replies {
+			(<-r.dpCh).(*drainRequest).resp <- loaded
+		}
+	}()
+	if err := r.drainQueue(context.Background()); err != nil {
+		t.Errorf("drainQueue: %v", err)
+	}
+
+	// nobody replies
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain: expected a deadline exceeded error, got %v", err)
+	}
+	if !r.Paused() {
+		t.Errorf("Drain: expected the receiver to be paused")
+	}
+}
@@ -17,8 +17,10 @@ package receiver
 
 import (
 	"fmt"
+	"log"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
@@ -26,56 +28,131 @@ import (
 	"github.com/tgres/tgres/serde"
 )
 
-// A collection of data sources kept by name (string).
+// DefaultCacheShards is the number of DS cache shards unless
+// Receiver.CacheShards says otherwise.
+const DefaultCacheShards = 32
+
+// A collection of data sources kept by name (string). It is split
+// into shards by a hash of the name, each with its own lock, so that
+// the director, the loader and the workers rarely wait for each
+// other.
 type dsCache struct {
+	shards  []*dsCacheShard
+	size    int64 // DSs in all the shards, atomic
+	db      serde.Fetcher
+	dsf     dsFlusherBlocking
+	finder  MatchingDSSpecFinder
+	clstr   clusterer
+	maxDSs  int          // limit on the number of cached DSs, 0 is unlimited
+	limited int32        // set atomically when a resource limit is exceeded
+	loading int32        // DSs sent to the loader and not back yet, atomic
+	quota   *seriesQuota // see SetSeriesQuotas, nil is unlimited
+
+	lateTolerance time.Duration // see Receiver.LateTolerance
+}
+
+type dsCacheShard struct {
 	sync.RWMutex
 	byIdent  map[string]*cachedDs
-	db       serde.Fetcher
-	dsf      dsFlusherBlocking
-	finder   MatchingDSSpecFinder
-	clstr    clusterer
 	rraCount int
 }
 
 // Returns a new dsCache object.
 func newDsCache(db serde.Fetcher, finder MatchingDSSpecFinder, dsf dsFlusherBlocking) *dsCache {
 	d := &dsCache{
-		byIdent: make(map[string]*cachedDs),
-		db:      db,
-		finder:  finder,
-		dsf:     dsf,
+		db:     db,
+		finder: finder,
+		dsf:    dsf,
 	}
+	d.setShards(DefaultCacheShards)
 	return d
 }
 
+// setShards changes the number of shards, moving the DSs already
+// cached. It must not be called concurrently with anything else.
+func (d *dsCache) setShards(n int) {
+	if n < 1 {
+		n = 1
+	}
+	old := d.shards
+	d.shards = make([]*dsCacheShard, n)
+	for i := range d.shards {
+		d.shards[i] = &dsCacheShard{byIdent: make(map[string]*cachedDs)}
+	}
+	for _, sh := range old {
+		for s, cds := range sh.byIdent {
+			nsh := d.shard(s)
+			nsh.byIdent[s] = cds
+			nsh.rraCount += cds.rraCount()
+		}
+	}
+}
+
+// shard returns the shard of the DS named s (FNV-1a).
+func (d *dsCache) shard(s string) *dsCacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return d.shards[h%uint32(len(d.shards))]
+}
+
 // getByName rlocks and gets a DS pointer.
 func (d *dsCache) getByIdent(ident *cachedIdent) *cachedDs {
-	d.RLock()
-	defer d.RUnlock()
-	return d.byIdent[ident.String()]
+	s := ident.String()
+	sh := d.shard(s)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.byIdent[s]
 }
 
 // Insert locks and inserts a DS.
 func (d *dsCache) insert(cds *cachedDs) {
-	d.Lock()
-	defer d.Unlock()
-	if cds.spec != nil {
-		d.rraCount += len(cds.spec.RRAs)
-	} else if ds, ok := cds.DbDataSourcer.(rrd.DataSourcer); ok && ds != nil {
-		d.rraCount += len(ds.RRAs())
+	s := cds.Ident().String()
+	sh := d.shard(s)
+	sh.Lock()
+	defer sh.Unlock()
+	if old := sh.byIdent[s]; old != nil {
+		sh.rraCount -= old.rraCount()
+	}
+	sh.rraCount += cds.rraCount()
+	if sh.byIdent[s] == nil {
+		atomic.AddInt64(&d.size, 1)
+		if d.quota != nil {
+			d.quota.count(cds.Ident()["name"], 1)
+		}
 	}
-	d.byIdent[cds.Ident().String()] = cds
+	sh.byIdent[s] = cds
 }
 
 // Delete a DS
 func (d *dsCache) delete(ident serde.Ident) {
-	d.Lock()
-	defer d.Unlock()
 	s := ident.String()
-	if cds := d.byIdent[s]; cds != nil {
-		d.rraCount -= len(cds.RRAs())
-		delete(d.byIdent, s)
+	sh := d.shard(s)
+	sh.Lock()
+	defer sh.Unlock()
+	if cds := sh.byIdent[s]; cds != nil {
+		sh.rraCount -= cds.rraCount()
+		delete(sh.byIdent, s)
+		atomic.AddInt64(&d.size, -1)
+		if d.quota != nil {
+			d.quota.count(ident["name"], -1)
+		}
+	}
+}
+
+// all returns the cached DSs.
+func (d *dsCache) all() []*cachedDs {
+	result := make([]*cachedDs, 0, atomic.LoadInt64(&d.size))
+	for _, sh := range d.shards {
+		sh.RLock()
+		for _, cds := range sh.byIdent {
+			result = append(result, cds)
+		}
+		sh.RUnlock()
 	}
+	return result
 }
 
 func (d *dsCache) preLoad() error {
@@ -89,25 +166,29 @@ func (d *dsCache) preLoad() error {
 		if !ok {
 			return fmt.Errorf("preLoad: ds must be a serde.DbDataSourcer")
 		}
-		d.insert(&cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}})
+		d.insert(&cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}, lateTolerance: d.lateTolerance})
 		d.register(dbds)
 	}
 
 	return nil
 }
 
-// get or create and empty cached ds
-func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) *cachedDs {
-	result := d.getByIdent(ident)
-	if result == nil {
+// get or create and empty cached ds, overQuota is true if the ds
+// would be new but creating it would exceed a series quota.
+func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) (result *cachedDs, overQuota bool) {
+	result = d.getByIdent(ident)
+	if result == nil && !d.refusing() {
 		if spec := d.finder.FindMatchingDSSpec(ident.Ident); spec != nil {
+			if d.quota != nil && !d.quota.allow(ident.Ident["name"], time.Now()) {
+				return nil, true
+			}
 			// return a cachedDs with nil DataSourcer
 			dbds := serde.NewDbDataSource(0, ident.Ident, nil)
-			result = &cachedDs{DbDataSourcer: dbds, spec: spec, mu: &sync.Mutex{}}
+			result = &cachedDs{DbDataSourcer: dbds, spec: spec, mu: &sync.Mutex{}, lateTolerance: d.lateTolerance}
 			d.insert(result)
 		}
 	}
-	return result
+	return result, false
 }
 
 // load (or create) via the SerDe given an empty cachedDs with ident and spec
@@ -136,10 +217,119 @@ func (d *dsCache) register(ds serde.DbDataSourcer) {
 	}
 }
 
+// refusing returns true if no new DSs should be created, either
+// because the number of cached DSs is at the limit or because the
+// resource limiter said so (see setLimited()).
+func (d *dsCache) refusing() bool {
+	if atomic.LoadInt32(&d.limited) != 0 {
+		return true
+	}
+	if d.maxDSs <= 0 {
+		return false
+	}
+	return atomic.LoadInt64(&d.size) >= int64(d.maxDSs)
+}
+
+func (d *dsCache) setLimited(limited bool) {
+	var v int32
+	if limited {
+		v = 1
+	}
+	atomic.StoreInt32(&d.limited, v)
+}
+
+// evictLRU flushes and removes from the cache up to n DSs that were
+// least recently updated. Each shard evicts its share of n, in
+// proportion to its size, so that the shards are never all locked at
+// once. DSs that are still being loaded or have points queued are
+// skipped. Returns the number of DSs evicted.
+func (d *dsCache) evictLRU(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	total := int(atomic.LoadInt64(&d.size))
+	if total == 0 {
+		return 0
+	}
+
+	evicted := 0
+	for _, sh := range d.shards {
+		if evicted >= n {
+			break
+		}
+		sh.RLock()
+		share := (n*len(sh.byIdent) + total - 1) / total // rounded up
+		candidates := make([]*cachedDs, 0, len(sh.byIdent))
+		for _, cds := range sh.byIdent {
+			if cds.spec == nil && cds.Id() != 0 {
+				candidates = append(candidates, cds)
+			}
+		}
+		sh.RUnlock()
+		if share > n-evicted {
+			share = n - evicted
+		}
+		evicted += d.evictShardLRU(candidates, share)
+	}
+	if debug {
+		log.Printf("evictLRU: evicted %d of %d requested DSs", evicted, n)
+	}
+	return evicted
+}
+
+// evictShardLRU evicts up to n of the candidates (of one shard), least
+// recently updated first.
+func (d *dsCache) evictShardLRU(candidates []*cachedDs, n int) int {
+	// lastProcess is written by the workers under cds.mu, take a
+	// snapshot to sort on.
+	lastProcess := make(map[*cachedDs]time.Time, len(candidates))
+	for _, cds := range candidates {
+		cds.mu.Lock()
+		lastProcess[cds] = cds.lastProcess
+		cds.mu.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return lastProcess[candidates[i]].Before(lastProcess[candidates[j]])
+	})
+
+	evicted := 0
+	for _, cds := range candidates {
+		if evicted >= n {
+			break
+		}
+		cds.mu.Lock()
+		if len(cds.incoming) > 0 {
+			cds.mu.Unlock()
+			continue
+		}
+		// Move the points to the vcache and take a copy of the DS
+		// under the lock, but do not hold it while waiting for the
+		// DS flush, which can take a while.
+		var ds serde.DbDataSourcer
+		if d.dsf != nil && !cds.LastUpdate().IsZero() {
+			d.dsf.flushToVCache(cds.DbDataSourcer)
+			ds = cds.DbDataSourcer.Copy().(serde.DbDataSourcer)
+		}
+		d.delete(cds.Ident())
+		cds.mu.Unlock()
+		if ds != nil {
+			d.dsf.flushDS(ds, true)
+		}
+		evicted++
+	}
+	return evicted
+}
+
+// stats returns the number of DSs and RRAs in the cache.
 func (d *dsCache) stats() (int, int) {
-	d.RLock()
-	defer d.RUnlock()
-	return len(d.byIdent), d.rraCount
+	var dss, rras int
+	for _, sh := range d.shards {
+		sh.RLock()
+		dss += len(sh.byIdent)
+		rras += sh.rraCount
+		sh.RUnlock()
+	}
+	return dss, rras
 }
 
 // Sortable array of incomingDP
@@ -160,6 +350,21 @@ type cachedDs struct {
 	lastFlush    time.Time
 	lastDSFlush  time.Time
 	mu           *sync.Mutex
+
+	// Points this much before the last update are placed into
+	// the RRAs as late points, see Receiver.LateTolerance.
+	lateTolerance time.Duration
+}
+
+// rraCount is the number of RRAs the DS has, or will have once
+// created.
+func (cds *cachedDs) rraCount() int {
+	if cds.spec != nil {
+		return len(cds.spec.RRAs)
+	} else if ds, ok := cds.DbDataSourcer.(rrd.DataSourcer); ok && ds != nil {
+		return len(ds.RRAs())
+	}
+	return 0
 }
 
 func (cds *cachedDs) appendIncoming(dp *incomingDP) {
@@ -169,11 +374,17 @@ func (cds *cachedDs) appendIncoming(dp *incomingDP) {
 }
 
 func (cds *cachedDs) processIncoming() (int, error) {
+	cds.mu.Lock()
+	defer cds.mu.Unlock()
+	return cds.process(false)
+}
+
+// process is processIncoming() with cds.mu held. Unless force is
+// true, processing may be delayed (see below).
+func (cds *cachedDs) process(force bool) (int, error) {
 
 	const BIG = 32 // this number was chosen rather arbitrarily
 
-	cds.mu.Lock()
-	defer cds.mu.Unlock()
 	var err error
 
 	count := len(cds.incoming)
@@ -185,7 +396,7 @@ func (cds *cachedDs) processIncoming() (int, error) {
 	// is possible for forwarded data points to arrive slightly late,
 	// this (along with the Sort() just below) addresses it.  Unless
 	// there are already a bunch of points queued up
-	if !(cds.lastProcess.Before(time.Now().Add(-cds.Step()/10)) || count > BIG) {
+	if !(force || cds.lastProcess.Before(time.Now().Add(-cds.Step()/10)) || count > BIG) {
 		return 0, nil
 	}
 
@@ -193,7 +404,11 @@ func (cds *cachedDs) processIncoming() (int, error) {
 
 	for _, dp := range cds.incoming {
 		// continue on errors
-		err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		if cds.isLate(dp.timeStamp) {
+			err = cds.ProcessLateDataPoint(dp.value, dp.timeStamp)
+		} else {
+			err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		}
 	}
 
 	cds.lastProcess = time.Now()
@@ -208,6 +423,16 @@ func (cds *cachedDs) processIncoming() (int, error) {
 	return count, err
 }
 
+// isLate is true if a point at ts is before the last update, but
+// within the late tolerance.
+func (cds *cachedDs) isLate(ts time.Time) bool {
+	if cds.lateTolerance <= 0 {
+		return false
+	}
+	lastUpdate := cds.LastUpdate()
+	return ts.Before(lastUpdate) && !ts.Before(lastUpdate.Add(-cds.lateTolerance))
+}
+
 // This is exported so as to be Gob-Encodable
 type cachedIdent struct {
 	serde.Ident
@@ -16,6 +16,7 @@ package receiver
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,7 +36,7 @@ func Test_dscache_getByIdent(t *testing.T) {
 	d := newDsCache(nil, nil, nil)
 	foo := newCachedIdent(serde.Ident{"name": "foo"})
 	bar := newCachedIdent(serde.Ident{"name": "bar"})
-	d.byIdent[foo.String()] = &cachedDs{}
+	d.shard(foo.String()).byIdent[foo.String()] = &cachedDs{}
 	if rds := d.getByIdent(foo); rds == nil {
 		t.Errorf("getByIdent did not return correct value")
 	}
@@ -71,6 +72,17 @@ func Test_dscache_delete(t *testing.T) {
 	if rds = d.getByIdent(newCachedIdent(foo)); rds != nil {
 		t.Errorf("delete: did not delete")
 	}
+
+	// a placeholder (no DataSourcer yet, the spec is pending)
+	bar := serde.Ident{"name": "bar"}
+	d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(0, bar, nil), spec: DftDSSPec})
+	if _, rras := d.stats(); rras != len(DftDSSPec.RRAs) {
+		t.Errorf("insert: expected %d RRAs, got %d", len(DftDSSPec.RRAs), rras)
+	}
+	d.delete(bar)
+	if dss, rras := d.stats(); dss != 0 || rras != 0 {
+		t.Errorf("delete: expected an empty cache, got %d DSs and %d RRAs", dss, rras)
+	}
 }
 
 func Test_dscache_preLoad(t *testing.T) {
@@ -86,8 +98,8 @@ func Test_dscache_preLoad(t *testing.T) {
 	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
 	db.returnDss = []rrd.DataSourcer{ds}
 	d.preLoad()
-	if len(d.byIdent) == 0 {
-		t.Errorf("len(d.byIdent) == 0")
+	if n, _ := d.stats(); n == 0 {
+		t.Errorf("d.stats() == 0")
 	}
 	db.fakeErr = true
 	if err := d.preLoad(); err == nil {
@@ -155,20 +167,20 @@ func Test_dscache_fetchOrCreateByIdent(t *testing.T) {
 	dsf := &dsFlusher{db: db, sr: sr}
 	d := newDsCache(db, df, dsf)
 
-	cds := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
+	cds, _ := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
 	d.fetchOrCreateByIdent(cds)
 	if db.createCalled != 1 {
 		t.Errorf("fetchOrCreateByIdent: CreateOrReturnDataSource should be called once, we got: %d", db.createCalled)
 	}
 
-	cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": ""}))
+	cds, _ = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": ""}))
 	if cds != nil {
 		t.Errorf("getByIdentOrCreateEmpty: for a blank name we should get nil")
 	}
 
 	d = newDsCache(db, df, dsf)
 	db.fakeErr = true
-	cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
+	cds, _ = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
 	if err := d.fetchOrCreateByIdent(cds); err == nil {
 		t.Errorf("fetchOrCreateByIdent: db error should error")
 	}
@@ -179,7 +191,7 @@ func Test_dscache_fetchOrCreateByIdent(t *testing.T) {
 	db.nondb = true
 	db.returnDss = []rrd.DataSourcer{nds}
 	d = newDsCache(db, df, dsf)
-	cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
+	cds, _ = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
 	if err := d.fetchOrCreateByIdent(cds); err == nil {
 		t.Errorf("fetchOrCreateByIdent: non-DbDataSource should error")
 	}
@@ -243,3 +255,196 @@ func Test_dscache_cachedDs_Relinquish(t *testing.T) {
 		t.Errorf("id should be 0")
 	}
 }
+
+func Test_dscache_setShards(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	if len(d.shards) != DefaultCacheShards {
+		t.Errorf("len(d.shards) = %d, expected %d", len(d.shards), DefaultCacheShards)
+	}
+	for i := 1; i <= 100; i++ {
+		ident := serde.Ident{"name": fmt.Sprintf("foo%d", i)}
+		ds := serde.NewDbDataSource(int64(i), ident, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds})
+	}
+	nonEmpty := 0
+	for _, sh := range d.shards {
+		if len(sh.byIdent) > 0 {
+			nonEmpty++
+		}
+	}
+	if nonEmpty < 2 {
+		t.Errorf("DSs should be spread across shards, %d shards used", nonEmpty)
+	}
+
+	_, rras := d.stats()
+	d.setShards(4)
+	if len(d.shards) != 4 {
+		t.Errorf("len(d.shards) = %d, expected 4", len(d.shards))
+	}
+	if n, r := d.stats(); n != 100 || r != rras {
+		t.Errorf("setShards: stats: %d %d, expected 100 %d", n, r, rras)
+	}
+	for i := 1; i <= 100; i++ {
+		if d.getByIdent(newCachedIdent(serde.Ident{"name": fmt.Sprintf("foo%d", i)})) == nil {
+			t.Errorf("setShards: foo%d not found", i)
+		}
+	}
+	if len(d.all()) != 100 {
+		t.Errorf("all: expected 100 DSs")
+	}
+
+	d.setShards(0)
+	if len(d.shards) != 1 {
+		t.Errorf("setShards(0) should make 1 shard")
+	}
+}
+
+func Test_dscache_evictLRU_sharded(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	d.setShards(4)
+	for i := 1; i <= 100; i++ {
+		ident := serde.Ident{"name": fmt.Sprintf("foo%d", i)}
+		ds := serde.NewDbDataSource(int64(i), ident, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Unix(int64(i), 0)})
+	}
+
+	before := make([]int, len(d.shards))
+	for i, sh := range d.shards {
+		before[i] = len(sh.byIdent)
+	}
+
+	if evicted := d.evictLRU(20); evicted != 20 {
+		t.Errorf("evictLRU: evicted %d, expected 20", evicted)
+	}
+	if n, _ := d.stats(); n != 80 {
+		t.Errorf("evictLRU: %d DSs left, expected 80", n)
+	}
+
+	for i, sh := range d.shards {
+		if len(sh.byIdent) == before[i] && before[i] > 0 {
+			t.Errorf("evictLRU: shard %d did not evict anything", i)
+		}
+		// whatever is left in a shard is more recent than what was evicted
+		var oldest time.Time
+		for _, cds := range sh.byIdent {
+			if oldest.IsZero() || cds.lastProcess.Before(oldest) {
+				oldest = cds.lastProcess
+			}
+		}
+		for j := 1; j <= 100; j++ {
+			s := serde.Ident{"name": fmt.Sprintf("foo%d", j)}.String()
+			if d.shard(s) == sh && sh.byIdent[s] == nil && time.Unix(int64(j), 0).After(oldest) {
+				t.Errorf("evictLRU: shard %d evicted foo%d before an older DS", i, j)
+			}
+		}
+	}
+}
+
+func benchmarkDsCacheGet(b *testing.B, shards int) {
+	d := newDsCache(nil, nil, nil)
+	d.setShards(shards)
+	idents := make([]*cachedIdent, 10000)
+	for i := range idents {
+		ident := serde.Ident{"name": fmt.Sprintf("foo.bar.%d", i)}
+		idents[i] = newCachedIdent(ident)
+		d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(int64(i+1), ident, rrd.NewDataSource(*DftDSSPec))})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ident := idents[i%len(idents)]
+			if i%10 == 0 {
+				// an occasional write, as when the loader inserts a DS
+				d.insert(d.getByIdent(ident))
+			} else {
+				d.getByIdent(ident)
+			}
+			i++
+		}
+	})
+}
+
+func Benchmark_dscache_get_1shard(b *testing.B)   { benchmarkDsCacheGet(b, 1) }
+func Benchmark_dscache_get_32shards(b *testing.B) { benchmarkDsCacheGet(b, 32) }
+
+func Test_dscache_cachedDs_isLate(t *testing.T) {
+	ds := rrd.NewDataSource(*DftDSSPec)
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	cds := &cachedDs{DbDataSourcer: serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, ds), mu: &sync.Mutex{}}
+
+	if cds.isLate(time.Unix(999, 0)) {
+		t.Errorf("isLate: without a tolerance nothing is late")
+	}
+	cds.lateTolerance = time.Minute
+	if !cds.isLate(time.Unix(950, 0)) {
+		t.Errorf("isLate: 50s before the last update is within the tolerance")
+	}
+	if cds.isLate(time.Unix(900, 0)) || cds.isLate(time.Unix(1000, 0)) {
+		t.Errorf("isLate: too late or not late")
+	}
+}
+
+func Test_dscache_cachedDs_lateAfterFlush(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: step, Span: 10 * step},
+			{Function: rrd.MAX, Step: step, Span: 10 * step},
+		},
+	}
+	db := newFakeBackfillSerde()
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo"}, spec)
+	cds := &cachedDs{DbDataSourcer: ds.(serde.DbDataSourcer), mu: &sync.Mutex{}, lateTolerance: time.Minute}
+
+	vcache := &verticalCache{Mutex: &sync.Mutex{}, m: make(map[bundleKey]*verticalCacheSegment)}
+	f := &dsFlusher{db: db, vdb: db, vcache: vcache}
+	flush := func() {
+		f.flushToVCache(cds)
+		ch := make(chan *vDpFlushRequest, 100)
+		vcache.flush(ch, true)
+		close(ch)
+		for req := range ch {
+			if req.dps != nil {
+				db.VerticalFlushDPs(req.bundleId, req.seg, req.i, req.dps)
+			}
+		}
+	}
+
+	for _, s := range []int64{1000, 1010, 1020, 1030} {
+		cds.appendIncoming(&incomingDP{value: 1, timeStamp: time.Unix(s, 0)})
+	}
+	cds.process(true)
+	flush()
+
+	i := rrd.SlotIndex(time.Unix(1020, 0), step, 10)
+	if db.dps[i][1] != 1 || db.dps[i][2] != 1 {
+		t.Fatalf("flush: expected 1 in the slot ending at 1020, got %v", db.dps[i])
+	}
+
+	// the slot ending at 1020 is flushed, the late point must not
+	// overwrite it
+	cds.appendIncoming(&incomingDP{value: 5, timeStamp: time.Unix(1015, 0)})
+	if _, err := cds.process(true); err == nil {
+		t.Errorf("process: no error on a late point in a flushed slot")
+	}
+	flush()
+	if db.dps[i][1] != 1 || db.dps[i][2] != 1 {
+		t.Errorf("late point: the stored slot was overwritten: %v", db.dps[i])
+	}
+
+	// a late point in a slot that is not flushed yet is merged
+	cds.appendIncoming(&incomingDP{value: 1, timeStamp: time.Unix(1040, 0)})
+	cds.appendIncoming(&incomingDP{value: 1, timeStamp: time.Unix(1050, 0)})
+	cds.process(true)
+	cds.appendIncoming(&incomingDP{value: 5, timeStamp: time.Unix(1035, 0)})
+	if _, err := cds.process(true); err != nil {
+		t.Errorf("process: %v", err)
+	}
+	flush()
+	j := rrd.SlotIndex(time.Unix(1040, 0), step, 10)
+	if db.dps[j][1] != 1 || db.dps[j][2] != 5 {
+		t.Errorf("late point: expected WMEAN 1 and MAX 5, got %v", db.dps[j])
+	}
+}
@@ -0,0 +1,53 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// ExportDataSource returns a copy of a series whose RRAs have all
+// their data points, e.g. to write it to a file in another format. If
+// the series is cached, it is flushed first so that the export is
+// current.
+func (r *Receiver) ExportDataSource(ident serde.Ident) (rrd.DataSourcer, error) {
+	dpf, ok := r.serde.(serde.DataPointFetcher)
+	if !ok {
+		return nil, fmt.Errorf("ExportDataSource: not supported by the database")
+	}
+
+	if cds := r.dsc.getByIdent(newCachedIdent(ident)); cds != nil {
+		cds.mu.Lock()
+		if cds.spec == nil && !cds.LastUpdate().IsZero() {
+			r.flusher.flushToVCache(cds.DbDataSourcer)
+			r.flusher.flushDS(cds.DbDataSourcer, true)
+		}
+		cds.mu.Unlock()
+	}
+	r.flusher.sync()
+
+	ds, err := dpf.FetchDataPoints(ident)
+	if err != nil {
+		return nil, fmt.Errorf("ExportDataSource: %v", err)
+	}
+	if ds == nil {
+		return nil, fmt.Errorf("ExportDataSource: no such series: %v", ident)
+	}
+	return ds, nil
+}
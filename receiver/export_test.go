@@ -0,0 +1,73 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeExportSerde struct {
+	*fakeBackfillSerde
+}
+
+func (f *fakeExportSerde) FetchDataPoints(ident serde.Ident) (rrd.DataSourcer, error) {
+	ds := f.dss[ident.String()]
+	if ds == nil {
+		return nil, nil
+	}
+	return ds.Copy(), nil
+}
+
+func Test_Receiver_ExportDataSource(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	foo := serde.Ident{"name": "foo"}
+
+	db := &fakeExportSerde{fakeBackfillSerde: newFakeBackfillSerde()}
+	f := &fakeDsFlusher{}
+	r := &Receiver{serde: db.fakeBackfillSerde, flusher: f, dsc: newDsCache(db, &SimpleDSFinder{spec}, f)}
+	if _, err := r.ExportDataSource(foo); err == nil {
+		t.Errorf("ExportDataSource: expected an error if the database cannot fetch data points")
+	}
+
+	r.serde = db
+	if _, err := r.ExportDataSource(foo); err == nil {
+		t.Errorf("ExportDataSource: expected an error for a series that does not exist")
+	}
+
+	// a cached series is flushed, but stays cached
+	ds, _ := db.FetchOrCreateDataSource(foo, spec)
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds.(*serde.DbDataSource), mu: &sync.Mutex{}})
+	exported, err := r.ExportDataSource(foo)
+	if err != nil || len(exported.RRAs()) != 1 {
+		t.Errorf("ExportDataSource: %v %v", exported, err)
+	}
+	if f.called != 1 {
+		t.Errorf("ExportDataSource: expected the cached series to be flushed, flushDS called %d times", f.called)
+	}
+	if r.dsc.getByIdent(newCachedIdent(foo)) == nil {
+		t.Errorf("ExportDataSource: the series should still be cached")
+	}
+}
@@ -0,0 +1,144 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SeriesFilter accepts or rejects incoming series by name, see
+// SetSeriesFilter(). Allow and Deny are regular expressions.
+type SeriesFilter struct {
+	Allow []string // if any, the name must match one of these
+	Deny  []string // the name must not match any of these
+}
+
+// SetSeriesFilter sets the regular expressions which the names of
+// the data points passed to QueueDataPoint() are checked against
+// (after the rewrite rules), to protect against an explosion of junk
+// series. A name matching a Deny expression is rejected, as is one
+// not matching any Allow expression, if there are any. It must be
+// called before Start().
+func (r *Receiver) SetSeriesFilter(f SeriesFilter) error {
+	sf := &seriesFilter{stop: make(chan struct{})}
+	compile := func(exprs []string, kind string) ([]*regexp.Regexp, error) {
+		var result []*regexp.Regexp
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: %v", kind, expr, err)
+			}
+			result = append(result, re)
+		}
+		return result, nil
+	}
+	var err error
+	if sf.allow, err = compile(f.Allow, "allow"); err != nil {
+		return err
+	}
+	if sf.deny, err = compile(f.Deny, "deny"); err != nil {
+		return err
+	}
+	r.filter = sf
+	return nil
+}
+
+// CheckSeriesName returns the name as rewritten by the rewrite rules
+// and whether the series filter accepts it. The rule is the filter
+// expression responsible, prefixed with "allow" or "deny", empty if
+// there is no filter. It is meant for testing the rules, the data
+// point counters are not affected.
+func (r *Receiver) CheckSeriesName(name string) (rewritten string, accepted bool, rule string) {
+	rewritten = name
+	if r.rewrite != nil {
+		ident, ok := r.rewrite.rewrite(name)
+		if !ok {
+			return "", false, "rewrite: dropped"
+		}
+		rewritten = ident
+	}
+	if r.filter == nil {
+		return rewritten, true, ""
+	}
+	accepted, rule = r.filter.check(rewritten)
+	return rewritten, accepted, rule
+}
+
+type seriesFilter struct {
+	rejected int64 // since last reported, first for alignment
+
+	allow, deny []*regexp.Regexp
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// check returns whether the name is accepted and the expression
+// which decided it.
+func (sf *seriesFilter) check(name string) (bool, string) {
+	for _, re := range sf.deny {
+		if re.MatchString(name) {
+			return false, "deny " + re.String()
+		}
+	}
+	if len(sf.allow) == 0 {
+		return true, ""
+	}
+	for _, re := range sf.allow {
+		if re.MatchString(name) {
+			return true, "allow " + re.String()
+		}
+	}
+	return false, "allow: no match"
+}
+
+// accept is check() which counts the rejected names.
+func (sf *seriesFilter) accept(name string) bool {
+	ok, _ := sf.check(name)
+	if !ok {
+		atomic.AddInt64(&sf.rejected, 1)
+	}
+	return ok
+}
+
+func (sf *seriesFilter) start(sr statReporter) {
+	sf.wg.Add(1)
+	go func() {
+		defer sf.wg.Done()
+		for {
+			select {
+			case <-sf.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			sf.report(sr)
+		}
+	}()
+}
+
+func (sf *seriesFilter) report(sr statReporter) {
+	if rejected := atomic.SwapInt64(&sf.rejected, 0); rejected > 0 {
+		sr.reportStatCount("receiver.filter.rejected", float64(rejected))
+	}
+}
+
+func (sf *seriesFilter) stopReporting() {
+	close(sf.stop)
+	sf.wg.Wait()
+}
@@ -0,0 +1,60 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import "testing"
+
+func Test_Receiver_SetSeriesFilter(t *testing.T) {
+	r := &Receiver{rewrite: newRewriter()}
+	if err := r.SetSeriesFilter(SeriesFilter{Allow: []string{`^(app|sys)\.`}, Deny: []string{`\.tmp\.`}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		accept bool
+		rule   string
+	}{
+		{"app.requests", true, `allow ^(app|sys)\.`},
+		{"app.tmp.x", false, `deny \.tmp\.`},
+		{"junk.x", false, "allow: no match"},
+	} {
+		if ok := r.filter.accept(c.name); ok != c.accept {
+			t.Errorf("accept(%q): expected %v", c.name, c.accept)
+		}
+		if _, ok, rule := r.CheckSeriesName(c.name); ok != c.accept || rule != c.rule {
+			t.Errorf("CheckSeriesName(%q): expected %v %q, got %v %q", c.name, c.accept, c.rule, ok, rule)
+		}
+	}
+	if r.filter.rejected != 2 {
+		t.Errorf("accept: expected 2 rejected, got %d", r.filter.rejected)
+	}
+
+	// the filter applies to the rewritten name
+	r.SetRewriteRules([]RewriteRule{{Match: `^junk\.`, Action: RewriteRename, Replacement: "app."}})
+	if name, ok, _ := r.CheckSeriesName("junk.x"); name != "app.x" || !ok {
+		t.Errorf("CheckSeriesName: expected app.x to be accepted, got %q %v", name, ok)
+	}
+
+	if err := r.SetSeriesFilter(SeriesFilter{Deny: []string{"("}}); err == nil {
+		t.Errorf("SetSeriesFilter: an invalid regular expression should be an error")
+	}
+
+	sr := &fakeSr{}
+	r.filter.report(sr)
+	if sr.called != 1 || r.filter.rejected != 0 {
+		t.Errorf("report: expected 1 stat and the count reset, got %d", sr.called)
+	}
+}
@@ -0,0 +1,153 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the receiver queue size is checked against the
+// watermarks. The queue can grow by whatever arrives in this time
+// past the high watermark.
+const flowCheckInterval = 20 * time.Millisecond
+
+// SetFlowControl makes WaitReady() block while the receiver queue is
+// backed up, i.e. from when it reaches the high watermark until it
+// drains down to the low one. Ingestion connections (e.g. graphite
+// TCP) call WaitReady() before reading more data, so that when the
+// workers and flushers cannot keep up, senders are slowed down by TCP
+// flow control instead of the queue growing in memory. Sources which
+// cannot be paused (e.g. UDP) are not affected, MaxReceiverQueueSize
+// still applies to them. It must be called before Start().
+func (r *Receiver) SetFlowControl(high, low int) {
+	if low <= 0 || low > high {
+		low = high / 2
+	}
+	r.flow = &flowControl{high: high, low: low, stop: make(chan struct{})}
+}
+
+// WaitReady blocks while the receiver is throttling ingestion (see
+// SetFlowControl) or is paused (see Pause), and returns immediately
+// otherwise.
+func (r *Receiver) WaitReady() {
+	r.waitResumed()
+	if r.flow != nil {
+		r.flow.wait()
+	}
+}
+
+type flowControl struct {
+	sync.Mutex
+	high, low int
+	gate      chan struct{} // closed when throttling ends, nil when not throttling
+
+	waiting   int64 // connections in wait(), atomic
+	throttles int   // times throttling began, since last reported
+	peak      int   // largest queue size, since last reported
+
+	stop    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// update engages or releases the throttle given the queue size.
+func (fc *flowControl) update(qlen int) {
+	fc.Lock()
+	defer fc.Unlock()
+	if qlen > fc.peak {
+		fc.peak = qlen
+	}
+	if fc.stopped {
+		return
+	}
+	if fc.gate == nil && qlen >= fc.high {
+		fc.gate = make(chan struct{})
+		fc.throttles++
+	} else if fc.gate != nil && qlen <= fc.low {
+		close(fc.gate)
+		fc.gate = nil
+	}
+}
+
+func (fc *flowControl) wait() {
+	fc.Lock()
+	gate := fc.gate
+	fc.Unlock()
+	if gate != nil {
+		atomic.AddInt64(&fc.waiting, 1)
+		<-gate
+		atomic.AddInt64(&fc.waiting, -1)
+	}
+}
+
+// start watches the queue size until stopThrottling() is called.
+func (fc *flowControl) start(qlen func() int, sr statReporter) {
+	fc.wg.Add(1)
+	go func() {
+		defer fc.wg.Done()
+		tick := time.NewTicker(flowCheckInterval)
+		defer tick.Stop()
+		lastReport := time.Now()
+		for {
+			select {
+			case <-fc.stop:
+				return
+			case <-tick.C:
+			}
+			fc.update(qlen())
+			if time.Since(lastReport) >= time.Second {
+				fc.report(sr)
+				lastReport = time.Now()
+			}
+		}
+	}()
+}
+
+func (fc *flowControl) report(sr statReporter) {
+	fc.Lock()
+	throttled, throttles, peak := fc.gate != nil, fc.throttles, fc.peak
+	fc.throttles, fc.peak = 0, 0
+	fc.Unlock()
+
+	if throttled {
+		sr.reportStatGauge("receiver.flow.throttled", 1)
+	} else {
+		sr.reportStatGauge("receiver.flow.throttled", 0)
+	}
+	sr.reportStatCount("receiver.flow.throttles", float64(throttles))
+	sr.reportStatGauge("receiver.flow.waiting", float64(atomic.LoadInt64(&fc.waiting)))
+	sr.reportStatGauge("receiver.flow.queue_peak", float64(peak))
+	sr.reportStatGauge("receiver.flow.high_watermark", float64(fc.high))
+	sr.reportStatGauge("receiver.flow.low_watermark", float64(fc.low))
+}
+
+// stopThrottling stops the watcher and releases any waiting
+// connections for good, so that they can be closed.
+func (fc *flowControl) stopThrottling() {
+	close(fc.stop)
+	fc.wg.Wait()
+	fc.Lock()
+	defer fc.Unlock()
+	fc.stopped = true
+	if fc.gate != nil {
+		log.Printf("flowControl: releasing throttled connections.")
+		close(fc.gate)
+		fc.gate = nil
+	}
+}
@@ -0,0 +1,81 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_flowControl(t *testing.T) {
+	r := &Receiver{}
+	r.WaitReady() // no flow control, must not block
+
+	r.SetFlowControl(100, 0)
+	fc := r.flow
+	if fc.low != 50 {
+		t.Errorf("SetFlowControl: expected low watermark 50, got %d", fc.low)
+	}
+
+	done := make(chan bool)
+	waitReady := func() {
+		go func() {
+			r.WaitReady()
+			done <- true
+		}()
+	}
+
+	fc.update(99)
+	waitReady()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("WaitReady blocked below the high watermark")
+	}
+
+	fc.update(100)
+	waitReady()
+	fc.update(60) // above low, still throttled
+	select {
+	case <-done:
+		t.Fatalf("WaitReady did not block above the low watermark")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fc.update(50)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("WaitReady still blocked at the low watermark")
+	}
+
+	sr := &fakeSr{}
+	fc.report(sr)
+	if sr.called == 0 || fc.throttles != 0 || fc.peak != 0 {
+		t.Errorf("report: expected stats reported and reset, got %d %d %d", sr.called, fc.throttles, fc.peak)
+	}
+
+	// stopping releases connections for good
+	fc.update(1000)
+	waitReady()
+	fc.stopThrottling()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stopThrottling did not release WaitReady")
+	}
+	fc.update(1000)
+	r.WaitReady()
+}
@@ -18,6 +18,7 @@ package receiver
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,12 +34,29 @@ type dsFlusher struct {
 	vcache    *verticalCache
 	sr        statReporter
 	vdbCh     chan *vDpFlushRequest
+	nvdb      int             // number of vdbflushers
+	spill     *spillQueue     // see OpenSpill
+	counts    *receiverCounts // see Receiver.Stats
 }
 
 type vDpFlushRequest struct {
 	bundleId, seg, i int64
 	dps              crossRRAPoints
 	latests          map[int64]time.Time
+	barrier          *flushBarrier // see dsFlusher.sync()
+}
+
+// flushBarrier is sent to every vdbflusher by sync(). Each one waits
+// at it until all have arrived, at which point whatever was sent to
+// them before it has been written.
+type flushBarrier struct {
+	arrived sync.WaitGroup
+	release chan struct{}
+}
+
+func (b *flushBarrier) arrive() {
+	b.arrived.Done()
+	<-b.release
 }
 
 func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int) {
@@ -52,38 +70,79 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 		Mutex:   &sync.Mutex{},
 		m:       make(map[bundleKey]*verticalCacheSegment),
 		minStep: minStep,
+		spill:   f.spill,
+	}
+
+	var dsLat, vdbLat *latencyHistogram
+	if f.counts != nil {
+		dsLat, vdbLat = &f.counts.dsFlush, &f.counts.vdbFlush
 	}
 
 	log.Printf(" -- vertical db flusher...")
+	f.nvdb = n
 	for i := 0; i < n; i++ {
 		startWg.Add(1)
-		go vdbflusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, f.vdb, f.vdbCh, f.sr)
+		go vdbflusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, f.vdb, f.vdbCh, f.spill, f.sr, vdbLat)
 	}
 	go vcacheFlusher(f.vcache, f.vdbCh, f.vdb, minStep, f.sr)
+	if f.spill != nil && f.vdb != nil {
+		log.Printf(" -- spill queue drainer...")
+		f.spill.start(f.vdbCh, f.sr)
+	}
 
 	log.Printf(" -- ds flusher...")
 	startWg.Add(1)
 	f.flusherCh = make(chan *dsFlushRequest, 1024) // TODO why 1024?
-	go dsUpdater(&wrkCtl{wg: flusherWg, startWg: startWg, id: "flusher"}, f, f.flusherCh, f.sr)
+	go dsUpdater(&wrkCtl{wg: flusherWg, startWg: startWg, id: "flusher"}, f, f.flusherCh, f.sr, dsLat)
+
+	if f.counts != nil {
+		f.counts.setFlushers(f.flusherCh, f.vdbCh)
+	}
 
 	if tdb, ok := f.db.(tsTableSizer); ok {
 		log.Printf(" -- ts table size reporter")
 		go reportTsTableSize(tdb, f.sr)
 	}
+	if sdb, ok := f.db.(storageSizer); ok {
+		log.Printf(" -- storage by prefix reporter")
+		go reportStorage(sdb, f.sr, storagePrefixDepth)
+	}
 }
 
 func (f *dsFlusher) stop() {
+	if f.flusherCh == nil { // never started, the serde does not flush
+		return
+	}
 	log.Printf("flusher.stop(): performing full vcache flush...")
 	f.vcache.flush(f.vdbCh, true)
 	log.Printf("flusher.stop(): performing full vcache flush done.")
 
 	if f.vdb != nil {
+		if f.spill != nil {
+			f.spill.stopDrain()
+		}
 		close(f.vdbCh)
 	}
 
 	close(f.flusherCh)
 }
 
+// sync flushes the vcache and waits for it (and anything else
+// already sent to the vdbflushers) to be written to the database.
+func (f *dsFlusher) sync() {
+	if f.flusherCh == nil || f.vdb == nil {
+		return
+	}
+	f.vcache.flush(f.vdbCh, true)
+	b := &flushBarrier{release: make(chan struct{})}
+	b.arrived.Add(f.nvdb)
+	for i := 0; i < f.nvdb; i++ {
+		f.vdbCh <- &vDpFlushRequest{barrier: b}
+	}
+	b.arrived.Wait()
+	close(b.release)
+}
+
 func (f *dsFlusher) verticalFlush(ds serde.DbDataSourcer) {
 	for _, rra := range ds.RRAs() {
 		if _rra, ok := rra.(*serde.DbRoundRobinArchive); ok {
@@ -130,6 +189,7 @@ type dsFlusherBlocking interface {
 	statReporter() statReporter
 	flusher() serde.Flusher
 	start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int)
+	sync()
 	stop()
 }
 
@@ -152,7 +212,7 @@ func (f flusherChannel) queueBlocking(ds serde.DbDataSourcer, block bool) {
 	}
 }
 
-var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequest, sr statReporter) {
+var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequest, sr statReporter, lat *latencyHistogram) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -180,9 +240,10 @@ var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequ
 			ds := fr.ds.(*serde.DbDataSource)
 			if fr.resp != nil { // blocking flush requested
 				var err error
-				start := time.Now()
+				start, dirty := time.Now(), dirtyRRAs(ds)
 				if db := dsf.flusher(); db != nil {
 					err = db.FlushDataSource(ds)
+					lat.observe(time.Now().Sub(start))
 					if err != nil {
 						log.Printf("%s: error flushing data source %v: %v", wc.ident(), ds, err)
 					}
@@ -193,7 +254,7 @@ var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequ
 				if err == nil {
 					sr.reportStatGauge("serde.flush_ds.duration_ms", dur*1000)
 					sr.reportStatCount("serde.flush_ds.count", 1)
-					sr.reportStatCount("serde.flush_ds.sql_ops", float64(1+len(ds.RRAs())))
+					reportFlushDSOps(sr, ds, dirty)
 				}
 			} else {
 				toFlush[ds.Id()] = ds
@@ -207,8 +268,9 @@ var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequ
 			continue
 		}
 		for id, ds := range toFlush { // flush a data source
-			start := time.Now()
+			start, dirty := time.Now(), dirtyRRAs(ds)
 			err := dsf.flusher().FlushDataSource(ds)
+			lat.observe(time.Now().Sub(start))
 			if err != nil {
 				log.Printf("%s: error (background) flushing data source %v: %v", wc.ident(), ds, err)
 			}
@@ -217,14 +279,31 @@ var dsUpdater = func(wc wController, dsf dsFlusherBlocking, ch chan *dsFlushRequ
 			if err == nil {
 				sr.reportStatGauge("serde.flush_ds.duration_ms", dur*1000)
 				sr.reportStatCount("serde.flush_ds.count", 1)
-				sr.reportStatCount("serde.flush_ds.sql_ops", float64(1+len(ds.RRAs())))
+				reportFlushDSOps(sr, ds, dirty)
 			}
 			break
 		}
 	}
 }
 
-var vdbflusher = func(wc wController, db serde.VerticalFlusher, ch chan *vDpFlushRequest, sr statReporter) {
+// dirtyRRAs returns how many RRAs of the DS FlushDataSource() will
+// write, the others have not changed since the last flush.
+func dirtyRRAs(ds *serde.DbDataSource) int {
+	n := 0
+	for _, rra := range ds.RRAs() {
+		if drra, ok := rra.(serde.DbRoundRobinArchiver); !ok || drra.Dirty() {
+			n++
+		}
+	}
+	return n
+}
+
+func reportFlushDSOps(sr statReporter, ds *serde.DbDataSource, dirty int) {
+	sr.reportStatCount("serde.flush_ds.sql_ops", float64(1+dirty))
+	sr.reportStatCount("serde.flush_ds.rras_skipped", float64(len(ds.RRAs())-dirty))
+}
+
+var vdbflusher = func(wc wController, db serde.VerticalFlusher, ch chan *vDpFlushRequest, spill *spillQueue, sr statReporter, lat *latencyHistogram) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -249,6 +328,11 @@ var vdbflusher = func(wc wController, db serde.VerticalFlusher, ch chan *vDpFlus
 			return
 		}
 
+		if dpr.barrier != nil {
+			dpr.barrier.arrive()
+			continue
+		}
+
 		st.chGets += 1
 		if l := len(ch); st.chMaxLen < l {
 			st.chMaxLen = l
@@ -257,8 +341,15 @@ var vdbflusher = func(wc wController, db serde.VerticalFlusher, ch chan *vDpFlus
 		if len(dpr.dps) > 0 {
 			start := time.Now()
 			sqlOps, err := db.VerticalFlushDPs(dpr.bundleId, dpr.seg, dpr.i, dpr.dps)
+			lat.observe(time.Now().Sub(start))
 			if err != nil {
 				log.Printf("vdbflusher: ERROR in VerticalFlushDps: %v", err)
+				if spill != nil && spill.push(&vDpFlushRequest{dpr.bundleId, dpr.seg, dpr.i, dpr.dps, nil, nil}) {
+					log.Printf("vdbflusher: spilled the data points to disk for a retry")
+				}
+			}
+			if spill != nil {
+				spill.flushed(err == nil)
 			}
 			st.dpsDur += time.Now().Sub(start)
 			st.dpsCount += len(dpr.dps)
@@ -269,8 +360,15 @@ var vdbflusher = func(wc wController, db serde.VerticalFlusher, ch chan *vDpFlus
 		if len(dpr.latests) > 0 {
 			start := time.Now()
 			sqlOps, err := db.VerticalFlushLatests(dpr.bundleId, dpr.seg, dpr.latests)
+			lat.observe(time.Now().Sub(start))
 			if err != nil {
 				log.Printf("verticalCache: ERROR in VerticalFlushLatests: %v", err)
+				if spill != nil && spill.push(&vDpFlushRequest{dpr.bundleId, dpr.seg, 0, nil, dpr.latests, nil}) {
+					log.Printf("vdbflusher: spilled the latests to disk for a retry")
+				}
+			}
+			if spill != nil {
+				spill.flushed(err == nil)
 			}
 			st.latDur += time.Now().Sub(start)
 			st.latCount += len(dpr.latests)
@@ -329,8 +427,70 @@ func reportTsTableSize(ts tsTableSizer, sr statReporter) {
 		sz, cnt, _ := ts.TsTableSize()
 		sr.reportStatGauge("serde.ts_table.bytes", float64(sz))
 		sr.reportStatGauge("serde.ts_table.rows", float64(cnt))
-		// 447 bytes overhead per row was determined by way of experimentation, it's probably wrong
-		bloat := float64(sz)/(float64(cnt)*float64(serde.PgSegmentWidth*8+447)) - 1.0
+		bloat := float64(sz)/(float64(cnt)*float64(serde.PgSegmentWidth*8+serde.PgRowOverhead)) - 1.0
 		sr.reportStatGauge("serde.ts_table.bloat_factor", bloat)
 	}
 }
+
+// Periodically report the estimated storage by name prefix and its
+// growth rate as internal series, so that capacity can be planned
+// (and forecast, e.g. with holtWintersForecast) within tgres itself.
+
+type storageSizer interface {
+	StorageByPrefix(depth int) (map[string]int64, error)
+}
+
+var (
+	storageReportInterval = 5 * time.Minute
+	storagePrefixDepth    = 1 // i.e. the tenant
+)
+
+func reportStorage(ss storageSizer, sr statReporter, depth int) {
+	var (
+		prev  map[string]int64
+		prevT time.Time
+	)
+	for {
+		time.Sleep(storageReportInterval)
+		prev, prevT = storageReport(ss, sr, depth, prev, prevT, time.Now())
+	}
+}
+
+// storageReport reports the storage once, computing the growth per
+// day since the previous report. It returns what it reported, to be
+// passed as prev next time.
+func storageReport(ss storageSizer, sr statReporter, depth int, prev map[string]int64, prevT, now time.Time) (map[string]int64, time.Time) {
+	sizes, err := ss.StorageByPrefix(depth)
+	if err != nil {
+		log.Printf("storageReport(): error getting storage size: %v", err)
+		return prev, prevT
+	}
+
+	growth := func(name string, cur, old int64) {
+		perDay := float64(cur-old) / now.Sub(prevT).Seconds() * 86400
+		sr.reportStatGauge(name+".growth_bytes_per_day", perDay)
+	}
+
+	var total, prevTotal int64
+	for prefix, bytes := range sizes {
+		name := prefix
+		if name == "" {
+			name = "_"
+		}
+		name = "serde.storage.prefix." + strings.Replace(name, ".", "_", -1)
+		sr.reportStatGauge(name+".bytes", float64(bytes))
+		if old, ok := prev[prefix]; ok { // no growth for new prefixes
+			growth(name, bytes, old)
+		}
+		total += bytes
+	}
+	for _, bytes := range prev {
+		prevTotal += bytes
+	}
+	sr.reportStatGauge("serde.storage.bytes", float64(total))
+	if prev != nil {
+		growth("serde.storage", total, prevTotal)
+	}
+
+	return sizes, now
+}
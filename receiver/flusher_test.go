@@ -36,6 +36,7 @@ func (f *fakeDsFlusher) enabled() bool                                      { re
 func (f *fakeDsFlusher) flusher() serde.Flusher                             { return f }
 func (f *fakeDsFlusher) statReporter() statReporter                         { return f.sr }
 func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n int) {}
+func (f *fakeDsFlusher) sync()                                              {}
 func (f *fakeDsFlusher) stop()                                              {}
 func (f *fakeDsFlusher) FlushDataSource(ds rrd.DataSourcer) error {
 	f.called++
@@ -45,14 +46,18 @@ func (f *fakeDsFlusher) FlushDataSource(ds rrd.DataSourcer) error {
 // fake stats reporter
 type fakeSr struct {
 	called int
+	gauges map[string]float64 // recorded if not nil
 }
 
 func (f *fakeSr) reportStatCount(string, float64) {
 	f.called++
 }
 
-func (f *fakeSr) reportStatGauge(string, float64) {
+func (f *fakeSr) reportStatGauge(name string, v float64) {
 	f.called++
+	if f.gauges != nil {
+		f.gauges[name] = v
+	}
 }
 
 func Test_flusher_dsFlusher_basicOp(t *testing.T) {
@@ -90,3 +95,40 @@ func Test_flusher_methods(t *testing.T) {
 		t.Errorf("sr != f.statReporter()")
 	}
 }
+
+type fakeStorageSizer map[string]int64
+
+func (f fakeStorageSizer) StorageByPrefix(depth int) (map[string]int64, error) {
+	result := make(map[string]int64, len(f))
+	for k, v := range f {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func Test_flusher_storageReport(t *testing.T) {
+	sr := &fakeSr{gauges: make(map[string]float64)}
+	ss := fakeStorageSizer{"acme": 1000, "foo.bar": 500}
+
+	now := time.Unix(100000, 0)
+	prev, prevT := storageReport(ss, sr, 1, nil, time.Time{}, now)
+	if sr.gauges["serde.storage.prefix.acme.bytes"] != 1000 || sr.gauges["serde.storage.prefix.foo_bar.bytes"] != 500 || sr.gauges["serde.storage.bytes"] != 1500 {
+		t.Errorf("storageReport: unexpected gauges: %v", sr.gauges)
+	}
+	if len(sr.gauges) != 3 {
+		t.Errorf("storageReport: no growth expected on first report: %v", sr.gauges)
+	}
+
+	// half a day later acme grew by 500 bytes, a new prefix appeared
+	ss["acme"], ss["new"] = 1500, 100
+	storageReport(ss, sr, 1, prev, prevT, now.Add(12*time.Hour))
+	if g := sr.gauges["serde.storage.prefix.acme.growth_bytes_per_day"]; g != 1000 {
+		t.Errorf("storageReport: expected acme growth of 1000/day, got %v", g)
+	}
+	if g := sr.gauges["serde.storage.growth_bytes_per_day"]; g != 1200 {
+		t.Errorf("storageReport: expected total growth of 1200/day, got %v", g)
+	}
+	if _, ok := sr.gauges["serde.storage.prefix.new.growth_bytes_per_day"]; ok {
+		t.Errorf("storageReport: no growth expected for a new prefix")
+	}
+}
@@ -0,0 +1,65 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// An IngestSource is a source of data points which does not listen
+// for connections, e.g. a subscription to a message bus. The
+// receiver starts its sources once it is ready for data and stops
+// them before it stops itself, so that nothing is lost.
+type IngestSource interface {
+	// Name identifies the source in the log.
+	Name() string
+	// Start begins passing data points to queue, it must not block.
+	Start(queue func(serde.Ident, time.Time, float64)) error
+	// Stop stops the source, queue must not be called after it
+	// returns.
+	Stop()
+}
+
+// AddIngestSource adds a source of data points to the receiver. It
+// must be called before Start().
+func (r *Receiver) AddIngestSource(src IngestSource) {
+	r.sources = append(r.sources, src)
+}
+
+// startIngestSources starts all the sources, one which fails to
+// start is logged and ignored.
+func startIngestSources(r *Receiver) {
+	for _, src := range r.sources {
+		if err := src.Start(r.QueueDataPoint); err != nil {
+			log.Printf("Receiver: error starting ingest source %s: %v", src.Name(), err)
+			continue
+		}
+		log.Printf("Receiver: started ingest source %s.", src.Name())
+		r.started = append(r.started, src)
+	}
+}
+
+// stopIngestSources stops the sources which were started.
+func stopIngestSources(r *Receiver) {
+	for _, src := range r.started {
+		src.Stop()
+		log.Printf("Receiver: stopped ingest source %s.", src.Name())
+	}
+	r.started = nil
+}
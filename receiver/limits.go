@@ -0,0 +1,149 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// When a limit is exceeded, we evict enough DSs to get this far
+// below it, so as not to be evicting on every check.
+const limitHeadroom = 0.1
+
+var runtimeMemoryUsed = runtimeSysMemory
+
+// Rough resident size of an idle cached DS and of each of its RRAs,
+// used to estimate the size of the DS cache for MaxCachedBytes.
+// Points not yet flushed are not included.
+const (
+	estimatedDSBytes  = 1024
+	estimatedRRABytes = 256
+)
+
+// estimatedCacheBytes is the estimated size of a DS cache holding
+// dss DSs with rras RRAs altogether.
+func estimatedCacheBytes(dss, rras int) uint64 {
+	return uint64(dss)*estimatedDSBytes + uint64(rras)*estimatedRRABytes
+}
+
+// checkLimits is one pass of the resource limiter. Every limit is
+// checked and the least recently updated DSs are evicted (flushing
+// them first) in one go, as many as the strictest limit requires. It
+// returns whether a limit is exceeded and the number of DSs evicted.
+var checkLimits = func(dsc *dsCache, maxDSs int, maxBytes, maxMem uint64) (bool, int) {
+	dsCount, rraCount := dsc.stats()
+
+	toEvict := 0
+	if maxDSs > 0 && dsCount >= maxDSs {
+		toEvict = dsCount - int(float64(maxDSs)*(1-limitHeadroom))
+	}
+	if bytes := estimatedCacheBytes(dsCount, rraCount); maxBytes > 0 && bytes > maxBytes {
+		perDS := float64(bytes) / float64(dsCount)
+		target := float64(maxBytes) * (1 - limitHeadroom)
+		if n := int(math.Ceil((float64(bytes) - target) / perDS)); n > toEvict {
+			toEvict = n
+		}
+	}
+	memExceeded := maxMem > 0 && runtimeMemoryUsed() > maxMem
+	if memExceeded {
+		// We cannot know how much memory a DS takes, evict a
+		// fraction of the cache and see on the next pass.
+		if n := int(float64(dsCount) * limitHeadroom); n > toEvict {
+			toEvict = n
+		}
+	}
+
+	// Stop creating DSs while over the memory limit, the DS count
+	// limit is enforced by the dsCache itself.
+	dsc.setLimited(memExceeded)
+
+	if toEvict == 0 && !memExceeded {
+		return false, 0
+	}
+	return true, dsc.evictLRU(toEvict)
+}
+
+// resourceLimiter periodically checks the DS count, estimated cache
+// size and memory limits, evicting DSs and alerting (via the log and
+// the receiver.limits.* stats) when they are exceeded.
+type resourceLimiter struct {
+	dsc      *dsCache
+	maxDSs   int
+	maxBytes uint64
+	maxMem   uint64
+	nap      time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newResourceLimiter(dsc *dsCache, maxDSs int, maxBytes, maxMem uint64, nap time.Duration) *resourceLimiter {
+	return &resourceLimiter{
+		dsc:      dsc,
+		maxDSs:   maxDSs,
+		maxBytes: maxBytes,
+		maxMem:   maxMem,
+		nap:      nap,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (rl *resourceLimiter) start(sr statReporter) {
+	rl.wg.Add(1)
+	go func() {
+		defer rl.wg.Done()
+		wasExceeded := false
+		for {
+			select {
+			case <-rl.stop:
+				return
+			case <-time.After(rl.nap):
+			}
+			wasExceeded = rl.check(sr, wasExceeded)
+		}
+	}()
+}
+
+// check is one pass of the limiter, it returns whether a limit is
+// exceeded.
+func (rl *resourceLimiter) check(sr statReporter, wasExceeded bool) bool {
+	exceeded, evicted := checkLimits(rl.dsc, rl.maxDSs, rl.maxBytes, rl.maxMem)
+	if exceeded && !wasExceeded {
+		dsCount, rraCount := rl.dsc.stats()
+		log.Printf("resourceLimiter: WARNING: resource limit exceeded (DSs: %d of %d, estimated cache bytes: %d of %d, memory: %d of %d), evicting cached DSs.",
+			dsCount, rl.maxDSs, estimatedCacheBytes(dsCount, rraCount), rl.maxBytes, runtimeMemoryUsed(), rl.maxMem)
+	} else if !exceeded && wasExceeded {
+		log.Printf("resourceLimiter: resource usage back under limits.")
+	}
+
+	if exceeded {
+		sr.reportStatGauge("receiver.limits.exceeded", 1)
+	} else {
+		sr.reportStatGauge("receiver.limits.exceeded", 0)
+	}
+	sr.reportStatCount("receiver.limits.evicted", float64(evicted))
+	return exceeded
+}
+
+// stopLimiting stops the limiter and waits for a check in progress
+// (which may be flushing evicted DSs) to finish. It must be called
+// before the flushers are stopped.
+func (rl *resourceLimiter) stopLimiting() {
+	close(rl.stop)
+	rl.wg.Wait()
+}
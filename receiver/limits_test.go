@@ -0,0 +1,176 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_limits_checkLimits(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	d.setShards(1) // eviction is LRU within a shard
+	for i := 1; i <= 10; i++ {
+		ident := serde.Ident{"name": fmt.Sprintf("foo%d", i)}
+		ds := serde.NewDbDataSource(int64(i), ident, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Unix(int64(i), 0)})
+	}
+
+	// not exceeded
+	if exceeded, evicted := checkLimits(d, 20, 0, 0); exceeded || evicted != 0 {
+		t.Errorf("checkLimits: exceeded: %v evicted: %v", exceeded, evicted)
+	}
+	if d.refusing() {
+		t.Errorf("refusing: should not be refusing below limits")
+	}
+
+	// DS count at limit
+	d.maxDSs = 10
+	if !d.refusing() {
+		t.Errorf("refusing: should be refusing at maxDSs")
+	}
+	if exceeded, evicted := checkLimits(d, 10, 0, 0); !exceeded || evicted != 1 {
+		t.Errorf("checkLimits: exceeded: %v evicted: %v", exceeded, evicted)
+	}
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "foo1"})) != nil {
+		t.Errorf("checkLimits: least recently used DS should have been evicted")
+	}
+	if d.refusing() {
+		t.Errorf("refusing: should not be refusing after evicting")
+	}
+
+	// memory exceeded
+	save := runtimeMemoryUsed
+	defer func() { runtimeMemoryUsed = save }()
+	runtimeMemoryUsed = func() uint64 { return 2000 }
+	if exceeded, _ := checkLimits(d, 0, 0, 1000); !exceeded {
+		t.Errorf("checkLimits: memory limit should be exceeded")
+	}
+	if !d.refusing() {
+		t.Errorf("refusing: should be refusing when over memory limit")
+	}
+	runtimeMemoryUsed = func() uint64 { return 500 }
+	if exceeded, _ := checkLimits(d, 0, 0, 1000); exceeded || d.refusing() {
+		t.Errorf("checkLimits: memory limit should no longer be exceeded")
+	}
+}
+
+func Test_limits_checkLimits_cachedBytes(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	d.setShards(1)
+	for i := 1; i <= 100; i++ {
+		ident := serde.Ident{"name": fmt.Sprintf("foo%d", i)}
+		ds := serde.NewDbDataSource(int64(i), ident, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Unix(int64(i), 0)})
+	}
+
+	dss, rras := d.stats()
+	bytes := estimatedCacheBytes(dss, rras)
+	if exceeded, evicted := checkLimits(d, 0, bytes, 0); exceeded || evicted != 0 {
+		t.Errorf("checkLimits: at the byte limit, exceeded: %v evicted: %d", exceeded, evicted)
+	}
+	if exceeded, evicted := checkLimits(d, 0, bytes/2, 0); !exceeded || evicted != 55 {
+		t.Errorf("checkLimits: exceeded: %v evicted: %d, expected 55", exceeded, evicted)
+	}
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "foo55"})) != nil ||
+		d.getByIdent(newCachedIdent(serde.Ident{"name": "foo56"})) == nil {
+		t.Errorf("checkLimits: least recently used DSs should have been evicted")
+	}
+	if d.refusing() {
+		t.Errorf("checkLimits: the byte limit should not refuse new DSs")
+	}
+
+	// The strictest limit decides how many DSs are evicted.
+	dss, rras = d.stats()
+	bytes = estimatedCacheBytes(dss, rras)
+	if _, evicted := checkLimits(d, 40, bytes/2, 0); evicted != 25 {
+		t.Errorf("checkLimits: evicted %d, expected 25 (byte limit)", evicted)
+	}
+	if _, evicted := checkLimits(d, 10, 1<<40, 0); evicted != 11 {
+		t.Errorf("checkLimits: evicted %d, expected 11 (DS count limit)", evicted)
+	}
+}
+
+// lockCheckingDsFlusher records whether the DS lock was free while
+// a DS was being flushed.
+type lockCheckingDsFlusher struct {
+	fakeDsFlusher
+	mu   *sync.Mutex
+	held bool
+}
+
+func (f *lockCheckingDsFlusher) flushDS(ds serde.DbDataSourcer, block bool) {
+	f.called++
+	done := make(chan struct{})
+	go func() {
+		f.mu.Lock()
+		f.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		f.held = true
+	}
+}
+
+func Test_limits_evictUnlocked(t *testing.T) {
+	mu := &sync.Mutex{}
+	dsf := &lockCheckingDsFlusher{mu: mu}
+	d := newDsCache(nil, nil, dsf)
+	ds := rrd.NewDataSource(*DftDSSPec)
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, ds), mu: mu})
+
+	if evicted := d.evictLRU(1); evicted != 1 || dsf.called != 1 {
+		t.Errorf("evictLRU: evicted %d, flushed %d", evicted, dsf.called)
+	}
+	if dsf.held {
+		t.Errorf("evictLRU: the DS lock was held during the flush")
+	}
+}
+
+func Test_limits_resourceLimiter(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	sr := &fakeSr{}
+	rl := newResourceLimiter(d, 10, 0, 0, time.Millisecond)
+	rl.start(sr)
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		rl.stopLimiting()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stopLimiting: the limiter did not stop")
+	}
+	if sr.called == 0 {
+		t.Errorf("resourceLimiter: nothing was checked")
+	}
+	called := sr.called
+	time.Sleep(10 * time.Millisecond)
+	if sr.called != called {
+		t.Errorf("resourceLimiter: still running after stopLimiting")
+	}
+}
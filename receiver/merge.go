@@ -0,0 +1,69 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// RenameSeries changes the ident of a series, keeping its history
+// (see serde.DataSourceMerger). If the series is cached, it is
+// flushed and evicted first, data points which arrive for the old
+// ident afterwards create a new series. As with ChangeRRAs, the
+// series must not be receiving data on another node of a cluster.
+func (r *Receiver) RenameSeries(from, to serde.Ident) (rrd.DataSourcer, error) {
+	dsm, ok := r.serde.(serde.DataSourceMerger)
+	if !ok {
+		return nil, fmt.Errorf("RenameSeries: not supported by the database")
+	}
+	r.evict(from, to)
+
+	ds, err := dsm.RenameDataSource(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("RenameSeries: %v", err)
+	}
+	if ds == nil {
+		return nil, fmt.Errorf("RenameSeries: no such series: %v", from)
+	}
+	log.Printf("RenameSeries: %v is now %v", from, to)
+	return ds, nil
+}
+
+// MergeSeries merges the history of the series src into dst, e.g.
+// after a host has been renamed. The RRAs of dst stay as they are,
+// those of src are resampled into them, and slots which are known in
+// both are resolved by policy (see rrd.MergeRRA). If deleteSrc is
+// true, src is deleted afterwards. Both series are flushed and
+// evicted from the cache first, and as with ChangeRRAs, must not be
+// receiving data on another node of a cluster.
+func (r *Receiver) MergeSeries(dst, src serde.Ident, policy rrd.MergePolicy, deleteSrc bool) (rrd.DataSourcer, error) {
+	dsm, ok := r.serde.(serde.DataSourceMerger)
+	if !ok {
+		return nil, fmt.Errorf("MergeSeries: not supported by the database")
+	}
+	r.evict(dst, src)
+
+	ds, err := dsm.MergeDataSource(dst, src, policy, deleteSrc)
+	if err != nil {
+		return nil, fmt.Errorf("MergeSeries: %v", err)
+	}
+	log.Printf("MergeSeries: merged %v into %v (%v)", src, dst, policy)
+	return ds, nil
+}
@@ -0,0 +1,105 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeMergeSerde struct {
+	*fakeBackfillSerde
+	policy rrd.MergePolicy
+}
+
+func (f *fakeMergeSerde) RenameDataSource(from, to serde.Ident) (rrd.DataSourcer, error) {
+	ds := f.dss[from.String()]
+	if ds == nil {
+		return nil, nil
+	}
+	if f.dss[to.String()] != nil {
+		return nil, fmt.Errorf("%v exists", to)
+	}
+	delete(f.dss, from.String())
+	f.dss[to.String()] = ds
+	return ds, nil
+}
+
+func (f *fakeMergeSerde) MergeDataSource(dst, src serde.Ident, policy rrd.MergePolicy, deleteSrc bool) (rrd.DataSourcer, error) {
+	ds := f.dss[dst.String()]
+	if ds == nil || f.dss[src.String()] == nil {
+		return nil, fmt.Errorf("both must exist")
+	}
+	f.policy = policy
+	if deleteSrc {
+		delete(f.dss, src.String())
+	}
+	return ds, nil
+}
+
+func Test_Receiver_RenameSeries_MergeSeries(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	foo, bar, baz := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}, serde.Ident{"name": "baz"}
+
+	db := &fakeMergeSerde{fakeBackfillSerde: newFakeBackfillSerde()}
+	f := &fakeDsFlusher{}
+	r := &Receiver{serde: db.fakeBackfillSerde, flusher: f, dsc: newDsCache(db, &SimpleDSFinder{spec}, f)}
+	if _, err := r.RenameSeries(foo, bar); err == nil {
+		t.Errorf("RenameSeries: expected an error if the database cannot rename")
+	}
+	if _, err := r.MergeSeries(foo, bar, rrd.MergeKeep, false); err == nil {
+		t.Errorf("MergeSeries: expected an error if the database cannot merge")
+	}
+
+	r.serde = db
+	if _, err := r.RenameSeries(foo, bar); err == nil {
+		t.Errorf("RenameSeries: expected an error for a series that does not exist")
+	}
+
+	// a cached series is flushed and evicted
+	ds, _ := db.FetchOrCreateDataSource(foo, spec)
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds.(*serde.DbDataSource), mu: &sync.Mutex{}})
+	if _, err := r.RenameSeries(foo, bar); err != nil {
+		t.Errorf("RenameSeries: %v", err)
+	}
+	if f.called != 1 || r.dsc.getByIdent(newCachedIdent(foo)) != nil {
+		t.Errorf("RenameSeries: expected the cached series to be flushed and evicted")
+	}
+	if db.dss[bar.String()] == nil || db.dss[foo.String()] != nil {
+		t.Errorf("RenameSeries: not renamed")
+	}
+
+	db.FetchOrCreateDataSource(baz, spec)
+	if _, err := r.MergeSeries(bar, baz, rrd.MergeMax, true); err != nil {
+		t.Errorf("MergeSeries: %v", err)
+	}
+	if db.policy != rrd.MergeMax || db.dss[baz.String()] != nil {
+		t.Errorf("MergeSeries: the policy and delete were not passed to the database")
+	}
+	if _, err := r.MergeSeries(bar, baz, rrd.MergeMax, true); err == nil {
+		t.Errorf("MergeSeries: expected an error for a series that does not exist")
+	}
+}
@@ -0,0 +1,228 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeriesQuotaPolicy is what happens to a data point for a new series
+// which would exceed a quota.
+type SeriesQuotaPolicy int
+
+const (
+	// SeriesQuotaDrop drops the data point.
+	SeriesQuotaDrop SeriesQuotaPolicy = iota
+
+	// SeriesQuotaPark keeps the data point (up to maxParkedPoints
+	// of them altogether) and tries it again once the per-minute
+	// quota is renewed, dropping it if it is still over a quota.
+	SeriesQuotaPark
+)
+
+// PrefixSeriesQuota limits the number of series whose name begins
+// with Prefix.
+type PrefixSeriesQuota struct {
+	Prefix    string
+	MaxSeries int
+}
+
+// SeriesQuotaConfig limits the creation of new series, see
+// SetSeriesQuotas(). Zero means unlimited.
+type SeriesQuotaConfig struct {
+	NewPerMinute int                 // new series per minute
+	MaxPerTenant int                 // series per tenant, i.e. first component of the name
+	Prefixes     []PrefixSeriesQuota // the longest matching prefix applies
+	Policy       SeriesQuotaPolicy
+}
+
+// SetSeriesQuotas limits how many new series (DSs) are created, to
+// protect the database from a cardinality explosion. Series are
+// counted in the DS cache, i.e. if DSs are evicted (see
+// MaxCachedDSs), they are not counted, and loading them again counts
+// as creating them. It must be called before Start().
+func (r *Receiver) SetSeriesQuotas(cfg SeriesQuotaConfig) {
+	r.dsc.quota = newSeriesQuota(cfg)
+}
+
+// The most data points parked altogether.
+const maxParkedPoints = 100000
+
+type seriesQuota struct {
+	sync.Mutex
+	SeriesQuotaConfig
+	counts map[string]int // by quotaKeys()
+
+	window  time.Time // beginning of the current minute
+	created int       // in the current minute
+
+	parked []*incomingDP
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	dropped, rejected, newCount int // since last reported
+	wasExceeded                 bool
+}
+
+func newSeriesQuota(cfg SeriesQuotaConfig) *seriesQuota {
+	sq := &seriesQuota{SeriesQuotaConfig: cfg, counts: make(map[string]int), stop: make(chan struct{})}
+	sq.Prefixes = append([]PrefixSeriesQuota{}, cfg.Prefixes...)
+	sort.SliceStable(sq.Prefixes, func(i, j int) bool { return len(sq.Prefixes[i].Prefix) > len(sq.Prefixes[j].Prefix) })
+	return sq
+}
+
+type quotaKey struct {
+	key   string
+	limit int
+}
+
+// quotaKeys returns the keys under which series with this name are
+// counted, with their limits.
+func (sq *seriesQuota) quotaKeys(name string) []quotaKey {
+	var result []quotaKey
+	for _, p := range sq.Prefixes {
+		if strings.HasPrefix(name, p.Prefix) {
+			if p.MaxSeries > 0 {
+				result = append(result, quotaKey{"prefix:" + p.Prefix, p.MaxSeries})
+			}
+			break
+		}
+	}
+	if sq.MaxPerTenant > 0 {
+		tenant := name
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			tenant = name[:i]
+		}
+		result = append(result, quotaKey{"tenant:" + tenant, sq.MaxPerTenant})
+	}
+	return result
+}
+
+// count adds n (which may be negative) to the series counts of the
+// name, as it is added to or removed from the DS cache.
+func (sq *seriesQuota) count(name string, n int) {
+	sq.Lock()
+	defer sq.Unlock()
+	for _, k := range sq.quotaKeys(name) {
+		sq.counts[k.key] += n
+	}
+}
+
+// allow returns true if a new series with this name may be created,
+// and if so counts it as created.
+func (sq *seriesQuota) allow(name string, now time.Time) bool {
+	sq.Lock()
+	defer sq.Unlock()
+	if window := now.Truncate(time.Minute); !window.Equal(sq.window) {
+		sq.window, sq.created = window, 0
+	}
+	if sq.NewPerMinute > 0 && sq.created >= sq.NewPerMinute {
+		return false
+	}
+	for _, k := range sq.quotaKeys(name) {
+		if sq.counts[k.key] >= k.limit {
+			return false
+		}
+	}
+	sq.created++
+	sq.newCount++
+	return true
+}
+
+// reject drops or parks a data point which is over quota.
+func (sq *seriesQuota) reject(dp *incomingDP) {
+	sq.Lock()
+	defer sq.Unlock()
+	sq.rejected++
+	if sq.Policy == SeriesQuotaPark && len(sq.parked) < maxParkedPoints && !dp.parked {
+		dp.parked = true // only once
+		sq.parked = append(sq.parked, dp)
+		return
+	}
+	sq.dropped++
+}
+
+// release returns the parked data points if the per-minute quota
+// has been renewed since they were parked.
+func (sq *seriesQuota) release(now time.Time) []*incomingDP {
+	sq.Lock()
+	defer sq.Unlock()
+	if len(sq.parked) == 0 || now.Truncate(time.Minute).Equal(sq.window) {
+		return nil
+	}
+	result := sq.parked
+	sq.parked = nil
+	return result
+}
+
+func (sq *seriesQuota) start(dpCh chan interface{}, sr statReporter) {
+	sq.wg.Add(1)
+	go func() {
+		defer sq.wg.Done()
+		for {
+			select {
+			case <-sq.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			for _, dp := range sq.release(time.Now()) {
+				dpCh <- dp
+			}
+			sq.report(sr)
+		}
+	}()
+}
+
+func (sq *seriesQuota) report(sr statReporter) {
+	sq.Lock()
+	dropped, rejected, created, parked := sq.dropped, sq.rejected, sq.newCount, len(sq.parked)
+	sq.dropped, sq.rejected, sq.newCount = 0, 0, 0
+	exceeded := rejected > 0
+	wasExceeded := sq.wasExceeded
+	sq.wasExceeded = exceeded
+	sq.Unlock()
+
+	if exceeded && !wasExceeded {
+		log.Printf("seriesQuota: WARNING: new series quota exceeded, data points for new series are being %s.", map[SeriesQuotaPolicy]string{SeriesQuotaDrop: "dropped", SeriesQuotaPark: "parked"}[sq.Policy])
+	} else if !exceeded && wasExceeded {
+		log.Printf("seriesQuota: new series back under quota.")
+	}
+	if exceeded {
+		sr.reportStatGauge("receiver.quota.exceeded", 1)
+	} else {
+		sr.reportStatGauge("receiver.quota.exceeded", 0)
+	}
+	sr.reportStatCount("receiver.quota.dropped", float64(dropped))
+	sr.reportStatCount("receiver.quota.created", float64(created))
+	sr.reportStatGauge("receiver.quota.parked", float64(parked))
+}
+
+// stopReleasing stops the releaser, whatever is still parked is
+// dropped.
+func (sq *seriesQuota) stopReleasing() {
+	close(sq.stop)
+	sq.wg.Wait()
+	sq.Lock()
+	defer sq.Unlock()
+	if len(sq.parked) > 0 {
+		log.Printf("seriesQuota: dropping %d parked data points.", len(sq.parked))
+		sq.parked = nil
+	}
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_seriesQuota(t *testing.T) {
+	d := newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, nil)
+	d.quota = newSeriesQuota(SeriesQuotaConfig{
+		NewPerMinute: 3,
+		MaxPerTenant: 2,
+		Prefixes:     []PrefixSeriesQuota{{"app.", 1}, {"app.big.", 10}},
+		Policy:       SeriesQuotaPark,
+	})
+
+	get := func(name string) (*cachedDs, bool) {
+		return d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": name}))
+	}
+
+	if cds, over := get("app.a"); cds == nil || over {
+		t.Fatalf("getByIdentOrCreateEmpty: app.a should be created")
+	}
+	if _, over := get("app.b"); !over {
+		t.Errorf("getByIdentOrCreateEmpty: app.b should exceed the app. prefix quota")
+	}
+	if cds, over := get("app.big.a"); cds == nil || over {
+		t.Errorf("getByIdentOrCreateEmpty: app.big.a is under the longer prefix quota")
+	}
+	if cds, over := get("app.a"); cds == nil || over {
+		t.Errorf("getByIdentOrCreateEmpty: an existing series is never over quota")
+	}
+	if _, over := get("app.big.b"); !over {
+		t.Errorf("getByIdentOrCreateEmpty: app.big.b should exceed the tenant quota")
+	}
+	if cds, over := get("sys.a"); cds == nil || over {
+		t.Errorf("getByIdentOrCreateEmpty: sys.a should be created")
+	}
+	if _, over := get("sys.b"); !over {
+		t.Errorf("getByIdentOrCreateEmpty: sys.b should exceed the per minute quota")
+	}
+
+	// loaded series count, deleting them makes room for others
+	ident := serde.Ident{"name": "sys.loaded"}
+	d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(1, ident, rrd.NewDataSource(*DftDSSPec)), mu: &sync.Mutex{}})
+	if n := d.quota.counts["tenant:sys"]; n != 2 {
+		t.Errorf("insert: expected the sys tenant count to be 2, got %d", n)
+	}
+	d.delete(ident)
+	if n := d.quota.counts["tenant:sys"]; n != 1 {
+		t.Errorf("delete: expected the sys tenant count to be 1, got %d", n)
+	}
+
+	// parking, once
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "app.b"})}
+	d.quota.reject(dp)
+	d.quota.reject(dp)
+	if len(d.quota.parked) != 1 || d.quota.dropped != 1 {
+		t.Errorf("reject: expected 1 parked and 1 dropped, got %d %d", len(d.quota.parked), d.quota.dropped)
+	}
+	if dps := d.quota.release(d.quota.window); dps != nil {
+		t.Errorf("release: nothing should be released in the same minute")
+	}
+	if dps := d.quota.release(d.quota.window.Add(time.Minute)); len(dps) != 1 {
+		t.Errorf("release: expected 1 data point in the next minute, got %d", len(dps))
+	}
+
+	sr := &fakeSr{gauges: make(map[string]float64)}
+	d.quota.report(sr)
+	if sr.gauges["receiver.quota.exceeded"] != 1 {
+		t.Errorf("report: receiver.quota.exceeded should be 1")
+	}
+	d.quota.report(sr)
+	if sr.gauges["receiver.quota.exceeded"] != 0 {
+		t.Errorf("report: receiver.quota.exceeded should be back to 0")
+	}
+}
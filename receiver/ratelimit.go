@@ -0,0 +1,265 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy is what happens to a data point which exceeds a
+// rate limit.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDrop drops the data point.
+	RateLimitDrop RateLimitPolicy = iota
+
+	// RateLimitClamp holds the most recent data point of a series
+	// over its limit and queues it once the limit allows, dropping
+	// any it replaces. The series is thus updated at no more than
+	// the limit, and still ends up with its most recent value.
+	RateLimitClamp
+)
+
+// PrefixRateLimit limits the series whose name begins with Prefix.
+type PrefixRateLimit struct {
+	Prefix     string
+	Rate       float64 // points/sec of all the series combined, zero means unlimited
+	SeriesRate float64 // points/sec of each series, if not zero overrides RateLimitConfig.SeriesRate
+}
+
+// RateLimitConfig configures ingestion rate limiting, see
+// SetRateLimits(). Points are limited by the name of the series.
+type RateLimitConfig struct {
+	SeriesRate float64           // points/sec of each series, zero means unlimited
+	Prefixes   []PrefixRateLimit // the longest matching prefix applies
+	Policy     RateLimitPolicy
+}
+
+// SetRateLimits enables rate limiting of the data points passed to
+// QueueDataPoint(), to protect the database from a runaway client
+// flooding a metric. It must be called before Start().
+func (r *Receiver) SetRateLimits(cfg RateLimitConfig) {
+	r.limiter = newRateLimiter(cfg)
+}
+
+// How long the limiter of a series which receives no data is kept.
+const rateLimitIdle = time.Minute
+
+// How often held (clamped) data points are checked.
+var rateLimitNap = 100 * time.Millisecond
+
+type rateLimiter struct {
+	sync.Mutex
+	policy     RateLimitPolicy
+	seriesRate float64
+	prefixes   []*prefixLimiter // longest first
+	series     map[string]*seriesLimiter
+	stop       chan struct{}
+	wg         sync.WaitGroup
+
+	dropped, clamped int // since last reported
+}
+
+type prefixLimiter struct {
+	PrefixRateLimit
+	lim *rate.Limiter // nil if unlimited
+}
+
+type seriesLimiter struct {
+	lim    *rate.Limiter // nil if unlimited
+	prefix *prefixLimiter
+	held   *heldDP
+	used   time.Time
+}
+
+type heldDP struct {
+	ident serde.Ident
+	ts    time.Time
+	v     float64
+}
+
+// newLimiter returns a limiter allowing a burst of a second's
+// worth of points, or nil if the rate is unlimited.
+func newLimiter(r float64) *rate.Limiter {
+	if r <= 0 {
+		return nil
+	}
+	burst := int(r)
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{
+		policy:     cfg.Policy,
+		seriesRate: cfg.SeriesRate,
+		series:     make(map[string]*seriesLimiter),
+		stop:       make(chan struct{}),
+	}
+	for _, p := range cfg.Prefixes {
+		rl.prefixes = append(rl.prefixes, &prefixLimiter{PrefixRateLimit: p, lim: newLimiter(p.Rate)})
+	}
+	sort.SliceStable(rl.prefixes, func(i, j int) bool { return len(rl.prefixes[i].Prefix) > len(rl.prefixes[j].Prefix) })
+	return rl
+}
+
+func (rl *rateLimiter) match(name string) *prefixLimiter {
+	for _, p := range rl.prefixes {
+		if strings.HasPrefix(name, p.Prefix) {
+			return p
+		}
+	}
+	return nil
+}
+
+// allow returns true if the data point is within the limits. If it
+// is not and the policy is RateLimitClamp, it is held for release().
+func (rl *rateLimiter) allow(ident serde.Ident, ts time.Time, v float64, now time.Time) bool {
+	name := ident["name"]
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	sl := rl.series[name]
+	if sl == nil {
+		p := rl.match(name)
+		sr := rl.seriesRate
+		if p != nil && p.SeriesRate > 0 {
+			sr = p.SeriesRate
+		}
+		if sr <= 0 && (p == nil || p.lim == nil) {
+			return true // unlimited, nothing to keep track of
+		}
+		sl = &seriesLimiter{lim: newLimiter(sr), prefix: p}
+		rl.series[name] = sl
+	}
+	sl.used = now
+
+	if sl.held != nil {
+		// a newer point replaces the held one, it must not
+		// overtake it either
+		sl.held = &heldDP{ident, ts, v}
+		rl.dropped++
+		return false
+	}
+	if sl.take(now) {
+		return true
+	}
+	if rl.policy == RateLimitClamp {
+		sl.held = &heldDP{ident, ts, v}
+		rl.clamped++
+		return false
+	}
+	rl.dropped++
+	return false
+}
+
+// take takes a token from both the series and the prefix limiter, or
+// from neither.
+func (sl *seriesLimiter) take(now time.Time) bool {
+	var sr *rate.Reservation
+	if sl.lim != nil {
+		if sr = sl.lim.ReserveN(now, 1); sr.DelayFrom(now) > 0 {
+			sr.CancelAt(now)
+			return false
+		}
+	}
+	if sl.prefix != nil && sl.prefix.lim != nil {
+		if pr := sl.prefix.lim.ReserveN(now, 1); pr.DelayFrom(now) > 0 {
+			pr.CancelAt(now)
+			if sr != nil {
+				sr.CancelAt(now)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// release passes the held data points which the limits now allow (or
+// all of them if all is true) to queue, and forgets idle series.
+func (rl *rateLimiter) release(now time.Time, all bool, queue func(serde.Ident, time.Time, float64)) {
+	var ready []*heldDP
+	rl.Lock()
+	for name, sl := range rl.series {
+		if sl.held != nil && (all || sl.take(now)) {
+			ready = append(ready, sl.held)
+			sl.held = nil
+		}
+		if sl.held == nil && now.Sub(sl.used) > rateLimitIdle {
+			delete(rl.series, name)
+		}
+	}
+	rl.Unlock()
+
+	for _, h := range ready {
+		queue(h.ident, h.ts, h.v)
+	}
+}
+
+// start starts the releaser, which also reports stats.
+func (rl *rateLimiter) start(queue func(serde.Ident, time.Time, float64), sr statReporter) {
+	rl.wg.Add(1)
+	go func() {
+		defer rl.wg.Done()
+		lastReport := time.Now()
+		for {
+			select {
+			case <-rl.stop:
+				return
+			case <-time.After(rateLimitNap):
+			}
+			now := time.Now()
+			rl.release(now, false, queue)
+			if now.Sub(lastReport) >= time.Second {
+				rl.report(sr)
+				lastReport = now
+			}
+		}
+	}()
+}
+
+func (rl *rateLimiter) report(sr statReporter) {
+	rl.Lock()
+	dropped, clamped, count, held := rl.dropped, rl.clamped, len(rl.series), 0
+	for _, sl := range rl.series {
+		if sl.held != nil {
+			held++
+		}
+	}
+	rl.dropped, rl.clamped = 0, 0
+	rl.Unlock()
+	sr.reportStatCount("receiver.ratelimit.dropped", float64(dropped))
+	sr.reportStatCount("receiver.ratelimit.clamped", float64(clamped))
+	sr.reportStatGauge("receiver.ratelimit.held", float64(held))
+	sr.reportStatGauge("receiver.ratelimit.series", float64(count))
+}
+
+// stopAndRelease stops the releaser and queues whatever is held.
+func (rl *rateLimiter) stopAndRelease(queue func(serde.Ident, time.Time, float64)) {
+	close(rl.stop)
+	rl.wg.Wait()
+	rl.release(time.Now(), true, queue)
+}
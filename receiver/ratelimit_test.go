@@ -0,0 +1,107 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_rateLimiter_drop(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{
+		SeriesRate: 2,
+		Prefixes: []PrefixRateLimit{
+			{Prefix: "a.", Rate: 3},
+			{Prefix: "a.b.", SeriesRate: 10},
+		},
+	})
+	now := time.Unix(1500000000, 0)
+	count := func(name string, n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			if rl.allow(serde.Ident{"name": name}, now, float64(i), now) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	if n := count("foo", 5); n != 2 {
+		t.Errorf("allow: expected 2 allowed by the series limit, got %d", n)
+	}
+	if n := count("a.x", 1) + count("a.y", 5); n != 3 {
+		t.Errorf("allow: expected 3 allowed by the prefix limit, got %d", n)
+	}
+	// the longest prefix applies, it has no combined limit
+	if n := count("a.b.c", 20); n != 10 {
+		t.Errorf("allow: expected 10 allowed by the prefix series limit, got %d", n)
+	}
+	if rl.dropped != 3+3+10 || rl.clamped != 0 {
+		t.Errorf("allow: expected 16 dropped, got %d (clamped %d)", rl.dropped, rl.clamped)
+	}
+	unl := newRateLimiter(RateLimitConfig{Prefixes: []PrefixRateLimit{{Prefix: "a.", Rate: 3}}})
+	if !unl.allow(serde.Ident{"name": "foo"}, now, 0, now) || len(unl.series) != 0 {
+		t.Errorf("allow: an unlimited series should be allowed and not tracked")
+	}
+
+	// a second later there are tokens again
+	now = now.Add(time.Second)
+	if n := count("foo", 5); n != 2 {
+		t.Errorf("allow: expected 2 allowed after a second, got %d", n)
+	}
+
+	// idle series are forgotten
+	rl.release(now.Add(2*rateLimitIdle), false, nil)
+	if len(rl.series) != 0 {
+		t.Errorf("release: expected idle series to be forgotten, got %d", len(rl.series))
+	}
+}
+
+func Test_rateLimiter_clamp(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{SeriesRate: 1, Policy: RateLimitClamp})
+	now := time.Unix(1500000000, 0)
+	var got []float64
+	queue := func(_ serde.Ident, _ time.Time, v float64) { got = append(got, v) }
+
+	for i := 0; i < 4; i++ {
+		if rl.allow(serde.Ident{"name": "foo"}, now, float64(i), now) != (i == 0) {
+			t.Errorf("allow: only the first point expected allowed, not %d", i)
+		}
+	}
+	if rl.clamped != 1 || rl.dropped != 2 {
+		t.Errorf("allow: expected 1 clamped and 2 dropped, got %d %d", rl.clamped, rl.dropped)
+	}
+
+	rl.release(now, false, queue)
+	if len(got) != 0 {
+		t.Errorf("release: nothing expected before a token, got %v", got)
+	}
+	rl.release(now.Add(time.Second), false, queue)
+	if len(got) != 1 || got[0] != 3 {
+		t.Errorf("release: expected the most recent point, got %v", got)
+	}
+
+	// on stop, whatever is held is released regardless
+	now = now.Add(time.Second)
+	rl.allow(serde.Ident{"name": "foo"}, now, 4, now)
+	rl.allow(serde.Ident{"name": "foo"}, now, 5, now)
+	rl.stopAndRelease(queue)
+	if len(got) != 2 || got[1] != 5 {
+		t.Errorf("stopAndRelease: expected the held point, got %v", got)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"encoding/gob"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
@@ -70,9 +71,55 @@ type Receiver struct {
 	// negative value means unlimited.
 	MaxReceiverQueueSize int
 
+	// MaxCachedDSs, MaxCachedBytes and MaxMemory limit the DS
+	// cache. They are checked periodically (so the cache can briefly
+	// exceed them) in a single pass: when any of them is exceeded,
+	// the least recently updated DSs are flushed to the database
+	// and evicted from the cache, to be loaded again if they receive
+	// points, as many as the strictest limit requires. This lets a
+	// large number of mostly idle series be served with bounded
+	// memory. Zero means unlimited.
+	//
+	// MaxCachedDSs is the number of DSs in the cache. While it is
+	// reached, points for new DSs are dropped.
+	MaxCachedDSs int
+
+	// MaxCachedBytes is the estimated size of the cached DSs (not
+	// including points not yet flushed). New DSs are still created
+	// when it is exceeded, only evictions happen.
+	MaxCachedBytes uint64
+
+	// MaxMemory is the limit (in bytes) on the memory obtained from
+	// the OS, as estimated by the Go runtime. Since the memory used
+	// by a DS cannot be known, a fraction of the cache is evicted
+	// on each check while it is exceeded, and points for new DSs
+	// are dropped.
+	MaxMemory uint64
+
+	// LateTolerance is how far before the last update of a series
+	// a data point can be and still be used. Such (out of order)
+	// points are placed into the RRA slots they belong to, see
+	// rrd.DataSource ProcessLateDataPoint, as long as those slots
+	// have not been flushed yet. Points later than this are
+	// dropped, as are all out of order points if it is zero. For
+	// loading history, see Backfill.
+	LateTolerance time.Duration
+
+	// CacheShards is the number of shards (each with its own lock)
+	// of the DS cache. Zero means DefaultCacheShards.
+	CacheShards int
+
 	StatFlushDuration time.Duration // Period after which stats are flushed
 	StatsNamePrefix   string        // Stat names are prefixed with this
 
+	// StatsForward, if not nil, also receives the aggregated stats
+	// series, e.g. an aggregator.Forwarder which sends them to an
+	// upstream tgres. If StatsForwardOnly is true, they are only
+	// forwarded and not stored. It is closed when the receiver stops
+	// if it is an io.Closer.
+	StatsForward     aggregator.DataPointQueuer
+	StatsForwardOnly bool
+
 	ReportStats       bool   // report internal stats?
 	ReportStatsPrefix string // prefix for internal stats
 
@@ -98,6 +145,20 @@ type Receiver struct {
 	directorWg    sync.WaitGroup
 	pacedMetricWg sync.WaitGroup
 
+	wal        *wal             // see OpenWAL
+	spill      *spillQueue      // see OpenSpill
+	limiter    *rateLimiter     // see SetRateLimits
+	flow       *flowControl     // see SetFlowControl
+	rewrite    *rewriter        // see SetRewriteRules
+	filter     *seriesFilter    // see SetSeriesFilter
+	dedup      *deduper         // see SetDedupWindow
+	aggRules   *ruleAggregator  // see SetAggregationRules
+	pause      pauseState       // see Pause
+	sources    []IngestSource   // see AddIngestSource
+	counts     *receiverCounts  // see Stats
+	started    []IngestSource   // sources which started successfully
+	resLimiter *resourceLimiter // see MaxCachedDSs, MaxCachedBytes and MaxMemory
+
 	stopped bool
 }
 
@@ -120,9 +181,11 @@ func New(serde serde.SerDe, finder MatchingDSSpecFinder) *Receiver {
 		ReportStats:       false,
 		ReportStatsPrefix: "tgres",
 		NWorkers:          1,
+		rewrite:           newRewriter(),
+		counts:            &receiverCounts{},
 	}
 
-	r.flusher = &dsFlusher{db: serde.Flusher(), vdb: serde.VerticalFlusher(), sr: r}
+	r.flusher = &dsFlusher{db: serde.Flusher(), vdb: serde.VerticalFlusher(), sr: r, counts: r.counts}
 	r.dsc = newDsCache(serde.Fetcher(), finder, r.flusher)
 	return r
 }
@@ -136,8 +199,40 @@ func (r *Receiver) Start() {
 // Stops processing, waits for everything to finish and shuts down all
 // workers/flushers.
 func (r *Receiver) Stop() {
+	if r.flow != nil {
+		r.flow.stopThrottling() // so that throttled connections can finish
+	}
+	r.releasePaused()
+	stopIngestSources(r) // while their data can still be queued
+	if r.aggRules != nil {
+		r.aggRules.stopAndEmit(r.queueDataPoint)
+	}
+	if r.limiter != nil {
+		r.limiter.stopAndRelease(r.queueDataPoint)
+	}
+	if r.rewrite != nil {
+		r.rewrite.stopReporting()
+	}
+	if r.filter != nil {
+		r.filter.stopReporting()
+	}
+	if r.dedup != nil {
+		r.dedup.stopReporting()
+	}
+	if r.dsc != nil && r.dsc.quota != nil {
+		r.dsc.quota.stopReleasing()
+	}
+	if r.resLimiter != nil {
+		r.resLimiter.stopLimiting() // it flushes, so before doStop
+	}
 	r.stopped = true
 	doStop(r, r.cluster)
+	if r.wal != nil {
+		r.wal.close(true) // everything is flushed by now
+	}
+	if r.spill != nil {
+		r.spill.close()
+	}
 }
 
 // In a clustered set up informes other nodes that we are ready to
@@ -167,9 +262,46 @@ func (r *Receiver) SetCluster(c clusterer) {
 // always treats incoming data as a rate, it is the responsibility of
 // the caller to present non-rate values such as counters as a
 // rate. Consider using the Aggregator (QueueAggregatorCommand) or
-// paced metrics (QueueSum/QueueGauge) for non-rate data.
+// paced metrics (QueueSum/QueueGauge) for non-rate data. The
+// timestamp is rounded to TimestampResolution.
 func (r *Receiver) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
 	if !r.stopped {
+		if r.dropPaused() {
+			return
+		}
+		ts = roundTimestamp(ts)
+		if r.rewrite != nil {
+			var ok bool
+			if ident, ok = r.rewrite.apply(ident); !ok {
+				return
+			}
+		}
+		if r.filter != nil && !r.filter.accept(ident["name"]) {
+			return
+		}
+		if r.dedup != nil && !r.dedup.accept(ident, ts, v, time.Now()) {
+			return
+		}
+		if r.aggRules != nil && !r.aggRules.add(ident, ts, v, time.Now()) {
+			return
+		}
+		if r.limiter != nil && !r.limiter.allow(ident, ts, v, time.Now()) {
+			return
+		}
+		r.queueDataPoint(ident, ts, v)
+	}
+}
+
+// queueDataPoint is QueueDataPoint() past the rate limits.
+func (r *Receiver) queueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	if !r.stopped {
+		if r.counts != nil {
+			atomic.AddInt64(&r.counts.queued, 1)
+		}
+		if r.wal != nil {
+			r.wal.append(ident, ts, v)
+			<-r.wal.ready // replayed points go first
+		}
 		r.dpCh <- &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
 	}
 }
@@ -230,6 +362,7 @@ type clusterer interface {
 	NumMembers() int
 	LoadDistData(func() ([]cluster.DistDatum, error)) error
 	NodesForDistDatum(cluster.DistDatum) []*cluster.Node
+	NodesForDistDatumChecked(cluster.DistDatum) ([]*cluster.Node, bool)
 	LocalNode() *cluster.Node
 	NotifyClusterChanges() chan bool
 	Transition(time.Duration) error
@@ -250,6 +383,7 @@ type incomingDP struct {
 	timeStamp   time.Time
 	value       float64
 	Hops        int
+	parked      bool // see SeriesQuotaPark
 }
 
 func (dp *incomingDP) GobEncode() ([]byte, error) {
@@ -70,6 +70,40 @@ func Test_Receiver_Stop(t *testing.T) {
 	doStop = save
 }
 
+type fakeIngestSource struct {
+	err              error
+	started, stopped int
+}
+
+func (f *fakeIngestSource) Name() string { return "fake" }
+func (f *fakeIngestSource) Stop()        { f.stopped++ }
+func (f *fakeIngestSource) Start(queue func(serde.Ident, time.Time, float64)) error {
+	if f.err == nil {
+		f.started++
+	}
+	return f.err
+}
+
+func Test_Receiver_ingestSources(t *testing.T) {
+	save := doStop
+	doStop = func(_ *Receiver, _ clusterer) {}
+	defer func() { doStop = save }()
+
+	ok, bad := &fakeIngestSource{}, &fakeIngestSource{err: fmt.Errorf("no bus")}
+	r := &Receiver{}
+	r.AddIngestSource(bad)
+	r.AddIngestSource(ok)
+
+	startIngestSources(r)
+	if ok.started != 1 || len(r.started) != 1 {
+		t.Errorf("startIngestSources: ok.started = %d, len(r.started) = %d", ok.started, len(r.started))
+	}
+	r.Stop()
+	if ok.stopped != 1 || bad.stopped != 0 {
+		t.Errorf("Stop: only the started source should be stopped: ok %d, bad %d", ok.stopped, bad.stopped)
+	}
+}
+
 func Test_Receiver_ClusterReady(t *testing.T) {
 	c := &fakeCluster{}
 	r := &Receiver{cluster: c}
@@ -152,7 +186,7 @@ type fakeCluster struct {
 	nodesForDd                   []*cluster.Node
 	ln                           *cluster.Node
 	cChange                      chan bool
-	tErr                         bool
+	tErr, stale                  bool
 }
 
 func (c *fakeCluster) RegisterMsgType() (chan *cluster.Msg, chan *cluster.Msg) {
@@ -162,7 +196,10 @@ func (c *fakeCluster) RegisterMsgType() (chan *cluster.Msg, chan *cluster.Msg) {
 func (_ *fakeCluster) NumMembers() int                                          { return 0 }
 func (_ *fakeCluster) LoadDistData(f func() ([]cluster.DistDatum, error)) error { f(); return nil }
 func (c *fakeCluster) NodesForDistDatum(cluster.DistDatum) []*cluster.Node      { return c.nodesForDd }
-func (c *fakeCluster) LocalNode() *cluster.Node                                 { return c.ln }
+func (c *fakeCluster) NodesForDistDatumChecked(cluster.DistDatum) ([]*cluster.Node, bool) {
+	return c.nodesForDd, c.stale
+}
+func (c *fakeCluster) LocalNode() *cluster.Node { return c.ln }
 func (c *fakeCluster) NotifyClusterChanges() chan bool {
 	return c.cChange
 }
@@ -0,0 +1,75 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// ChangeRRAs changes the RRA layout of an existing series to rras,
+// RRAs can be added, removed or have their span changed. Existing
+// data is resampled into the new RRAs (see
+// serde.RRAReshaper). Unlike the config, which only applies to series
+// as they are created, this changes a series in place.
+//
+// If the series is cached, it is flushed and evicted first, so that
+// it is loaded with its new RRAs by the next data point. Points
+// which are already queued for the series may be lost. As with
+// Backfill, the series must not be receiving data on another node
+// of a cluster.
+//
+// Note that this does not change the config, a matching DS spec
+// with different RRAs does not affect the series.
+func (r *Receiver) ChangeRRAs(ident serde.Ident, rras []rrd.RRASpec) (rrd.DataSourcer, error) {
+	rs, ok := r.serde.(serde.RRAReshaper)
+	if !ok {
+		return nil, fmt.Errorf("ChangeRRAs: not supported by the database")
+	}
+
+	r.evict(ident) // the slots must be in the database to resample
+
+	ds, err := rs.ReshapeDataSource(ident, rras)
+	if err != nil {
+		return nil, fmt.Errorf("ChangeRRAs: %v", err)
+	}
+	if ds == nil {
+		return nil, fmt.Errorf("ChangeRRAs: no such series: %v", ident)
+	}
+	log.Printf("ChangeRRAs: %v now has %d RRAs", ident, len(ds.RRAs()))
+	return ds, nil
+}
+
+// evict flushes and removes the series from the cache, if they are
+// cached, and waits for everything to be written, so that they can
+// be changed in the database.
+func (r *Receiver) evict(idents ...serde.Ident) {
+	for _, ident := range idents {
+		if cds := r.dsc.getByIdent(newCachedIdent(ident)); cds != nil {
+			cds.mu.Lock()
+			if cds.spec == nil && !cds.LastUpdate().IsZero() {
+				r.flusher.flushToVCache(cds.DbDataSourcer)
+				r.flusher.flushDS(cds.DbDataSourcer, true)
+			}
+			cds.mu.Unlock()
+			r.dsc.delete(ident)
+		}
+	}
+	r.flusher.sync()
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeReshapeSerde struct {
+	*fakeBackfillSerde
+	reshaped []rrd.RRASpec
+}
+
+func (f *fakeReshapeSerde) ReshapeDataSource(ident serde.Ident, rras []rrd.RRASpec) (rrd.DataSourcer, error) {
+	ds := f.dss[ident.String()]
+	if ds == nil {
+		return nil, nil
+	}
+	f.reshaped = rras
+	return ds, nil
+}
+
+func Test_Receiver_ChangeRRAs(t *testing.T) {
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 10 * step}},
+	}
+	rras := []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 100 * step}}
+	foo := serde.Ident{"name": "foo"}
+
+	db := &fakeReshapeSerde{fakeBackfillSerde: newFakeBackfillSerde()}
+	f := &fakeDsFlusher{}
+	r := &Receiver{serde: db.fakeBackfillSerde, flusher: f, dsc: newDsCache(db, &SimpleDSFinder{spec}, f)}
+	if _, err := r.ChangeRRAs(foo, rras); err == nil {
+		t.Errorf("ChangeRRAs: expected an error if the database cannot reshape")
+	}
+
+	r.serde = db
+	if _, err := r.ChangeRRAs(foo, rras); err == nil {
+		t.Errorf("ChangeRRAs: expected an error for a series that does not exist")
+	}
+
+	// a cached series is flushed and evicted
+	ds, _ := db.FetchOrCreateDataSource(foo, spec)
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds.(*serde.DbDataSource), mu: &sync.Mutex{}})
+	if _, err := r.ChangeRRAs(foo, rras); err != nil {
+		t.Errorf("ChangeRRAs: %v", err)
+	}
+	if f.called != 1 {
+		t.Errorf("ChangeRRAs: expected the cached series to be flushed, flushDS called %d times", f.called)
+	}
+	if r.dsc.getByIdent(newCachedIdent(foo)) != nil {
+		t.Errorf("ChangeRRAs: expected the cached series to be evicted")
+	}
+	if len(db.reshaped) != 1 || db.reshaped[0].Span != 100*step {
+		t.Errorf("ChangeRRAs: the RRA specs were not passed to the database: %v", db.reshaped)
+	}
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// RewriteAction is what a RewriteRule does to a name it matches.
+type RewriteAction int
+
+const (
+	// RewriteRename replaces the matches of the regular expression
+	// with the Replacement, in which $1 etc. refer to submatches.
+	RewriteRename RewriteAction = iota
+
+	// RewriteDrop drops the data point.
+	RewriteDrop
+
+	// RewritePrefix prepends the Replacement to the name.
+	RewritePrefix
+)
+
+// RewriteRule rewrites the names of incoming series matching a
+// regular expression, see SetRewriteRules().
+type RewriteRule struct {
+	Match       string
+	Action      RewriteAction
+	Replacement string
+}
+
+// SetRewriteRules sets the rules applied to the names of the data
+// points passed to QueueDataPoint() before anything else is done
+// with them (i.e. before the rate limits and the DS lookup). The
+// rules are applied in order, each to the name as rewritten by those
+// before it, a name which is dropped or rewritten to nothing is not
+// processed further. Unlike most settings, the rules can be replaced
+// while the receiver is running. If any rule is invalid, the error
+// is returned and the rules in effect are left alone.
+func (r *Receiver) SetRewriteRules(rules []RewriteRule) error {
+	compiled := make([]rewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("rewrite %q: %v", rule.Match, err)
+		}
+		compiled = append(compiled, rewriteRule{RewriteRule: rule, re: re})
+	}
+	r.rewrite.Lock()
+	r.rewrite.rules = compiled
+	r.rewrite.Unlock()
+	return nil
+}
+
+type rewriter struct {
+	renamed, dropped int64 // since last reported, first for alignment
+
+	sync.RWMutex
+	rules []rewriteRule
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type rewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp
+}
+
+func newRewriter() *rewriter {
+	return &rewriter{stop: make(chan struct{})}
+}
+
+// apply returns the ident with the name rewritten, or false if the
+// data point is to be dropped. The ident passed in is not modified.
+func (rw *rewriter) apply(ident serde.Ident) (serde.Ident, bool) {
+	orig := ident["name"]
+	name, ok := rw.rewrite(orig)
+	if !ok {
+		atomic.AddInt64(&rw.dropped, 1)
+		return nil, false
+	}
+	if name == orig {
+		return ident, true
+	}
+
+	atomic.AddInt64(&rw.renamed, 1)
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = name
+	return result, true
+}
+
+// rewrite returns the name rewritten by the rules, or false if it is
+// dropped.
+func (rw *rewriter) rewrite(name string) (string, bool) {
+	rw.RLock()
+	rules := rw.rules
+	rw.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.re.MatchString(name) {
+			continue
+		}
+		switch rule.Action {
+		case RewriteDrop:
+			name = ""
+		case RewriteRename:
+			name = rule.re.ReplaceAllString(name, rule.Replacement)
+		case RewritePrefix:
+			name = rule.Replacement + name
+		}
+		if name == "" {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func (rw *rewriter) start(sr statReporter) {
+	rw.wg.Add(1)
+	go func() {
+		defer rw.wg.Done()
+		for {
+			select {
+			case <-rw.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			rw.report(sr)
+		}
+	}()
+}
+
+func (rw *rewriter) report(sr statReporter) {
+	renamed, dropped := atomic.SwapInt64(&rw.renamed, 0), atomic.SwapInt64(&rw.dropped, 0)
+	if renamed > 0 || dropped > 0 {
+		sr.reportStatCount("receiver.rewrite.renamed", float64(renamed))
+		sr.reportStatCount("receiver.rewrite.dropped", float64(dropped))
+	}
+}
+
+func (rw *rewriter) stopReporting() {
+	close(rw.stop)
+	rw.wg.Wait()
+}
@@ -0,0 +1,69 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_SetRewriteRules(t *testing.T) {
+	r := &Receiver{rewrite: newRewriter()}
+	rules := []RewriteRule{
+		{Match: `^servers\.(\w+)\.cpu$`, Action: RewriteRename, Replacement: "hosts.$1.cpu"},
+		{Match: `^debug\.`, Action: RewriteDrop},
+		{Match: `^hosts\.`, Action: RewritePrefix, Replacement: "dc1."},
+		{Match: `^tmp$`, Action: RewriteRename, Replacement: ""},
+	}
+	if err := r.SetRewriteRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	ident := serde.Ident{"name": "servers.a.cpu", "host": "a"}
+	result, ok := r.rewrite.apply(ident)
+	if !ok || result["name"] != "dc1.hosts.a.cpu" || result["host"] != "a" {
+		t.Errorf("apply: expected dc1.hosts.a.cpu, got %v (ok %v)", result, ok)
+	}
+	if ident["name"] != "servers.a.cpu" {
+		t.Errorf("apply: the ident passed in was modified: %v", ident)
+	}
+	if result, ok := r.rewrite.apply(serde.Ident{"name": "other"}); !ok || result["name"] != "other" {
+		t.Errorf("apply: a name matching no rule should be unchanged, got %v (ok %v)", result, ok)
+	}
+	for _, name := range []string{"debug.x", "tmp"} {
+		if _, ok := r.rewrite.apply(serde.Ident{"name": name}); ok {
+			t.Errorf("apply: %q should be dropped", name)
+		}
+	}
+	if r.rewrite.renamed != 1 || r.rewrite.dropped != 2 {
+		t.Errorf("apply: expected 1 renamed and 2 dropped, got %d and %d", r.rewrite.renamed, r.rewrite.dropped)
+	}
+
+	// an invalid rule leaves the rules alone
+	if err := r.SetRewriteRules([]RewriteRule{{Match: "("}}); err == nil {
+		t.Errorf("SetRewriteRules: an invalid regular expression should be an error")
+	}
+	if len(r.rewrite.rules) != len(rules) {
+		t.Errorf("SetRewriteRules: the rules changed after an error")
+	}
+
+	sr := &fakeSr{}
+	r.rewrite.report(sr)
+	if sr.called != 2 || r.rewrite.renamed != 0 || r.rewrite.dropped != 0 {
+		t.Errorf("report: expected 2 stats and the counts reset, got %d", sr.called)
+	}
+}
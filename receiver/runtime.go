@@ -17,6 +17,7 @@ package receiver
 
 import (
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -32,6 +33,14 @@ func runtimeMemory() uint64 {
 	return mem.Alloc
 }
 
+// runtimeSysMemory is an estimate of the resident memory: what was
+// obtained from the OS less what was returned to it.
+func runtimeSysMemory() uint64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.Sys - mem.HeapReleased
+}
+
 func runtimeCpuPercent() float64 {
 	ps, _ := cpu.Percent(0, false)
 	if len(ps) > 0 {
@@ -54,5 +63,6 @@ func reportRuntime(sr statReporter) {
 		sr.reportStatGauge("runtime.load.one", avg.Load1)
 		sr.reportStatGauge("runtime.load.five", avg.Load5)
 		sr.reportStatGauge("runtime.load.fifteen", avg.Load15)
+		sr.reportStatCount("receiver.timestamp.rounded", float64(atomic.SwapInt64(&timestampsRounded, 0)))
 	}
 }
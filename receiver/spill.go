@@ -0,0 +1,576 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpillConfig configures the spill queue, see OpenSpill().
+type SpillConfig struct {
+	// Dir is the directory of the queue files, it is created if it
+	// does not exist.
+	Dir string
+
+	// MaxSize is how much (in bytes) can be queued on disk, once it
+	// is reached flushes are kept in memory (or dropped if they
+	// failed) as if there was no queue. Zero means 1GB.
+	MaxSize int64
+
+	// RetryInterval is how often a single queued flush is retried
+	// while the database is failing. Zero means 10 seconds.
+	RetryInterval time.Duration
+}
+
+const (
+	spillSuffix     = ".spill"
+	spillOffsetFile = "offset"
+)
+
+var (
+	spillSegmentSize int64 = 16 * 1024 * 1024
+	spillNap               = time.Second
+)
+
+// spillQueue is a disk-backed FIFO of vertical flush requests. When
+// the database flushers fall behind and their channel is full, or a
+// flush fails, the request is appended to the queue instead of
+// waiting in memory (or being lost), and the drainer feeds the queue
+// back to the flushers as they catch up. While the queue is not
+// empty new requests are queued too, so that the order is kept
+// (except that a request which fails goes to the end).
+//
+// The queue is a series of files with records framed the same way as
+// the write-ahead log. The payload of a record is the bundle id,
+// segment and index as varints, followed by the data points, a
+// uvarint count of varint position and 8 byte (little endian) value
+// pairs, and the latests, a uvarint count of varint position and
+// varint nanoseconds pairs. On stop, how far the oldest file has been
+// read is saved in the offset file, so that the next process resumes
+// from there.
+type spillQueue struct {
+	sync.Mutex
+	cfg     SpillConfig
+	files   []string // oldest first, the last one may be w
+	w       *os.File
+	wsize   int64
+	rf      *os.File // reading files[0]
+	rb      *bufio.Reader
+	roff    int64 // offset in files[0] after the last record read
+	pending int64 // size of the record returned by next() but not yet committed
+	size    int64 // bytes queued
+	count   int   // requests queued
+	buf     []byte
+	healthy bool // whether the last flush succeeded
+	lastTry time.Time
+	full    bool // whether the last push did not fit
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	spilled, drained, dropped int // since last reported
+}
+
+// OpenSpill enables the spill queue, it must be called before the
+// receiver is started and requires a database which supports
+// vertical flushing. Requests queued by a previous process are
+// flushed first.
+func (r *Receiver) OpenSpill(cfg SpillConfig) error {
+	f, ok := r.flusher.(*dsFlusher)
+	if !ok || f.vdb == nil {
+		return fmt.Errorf("the database does not support vertical flushing, there is nothing to spill")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 1024 * 1024 * 1024
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 10 * time.Second
+	}
+	q, err := openSpillQueue(cfg)
+	if err != nil {
+		return err
+	}
+	f.spill, r.spill = q, q
+	return nil
+}
+
+func openSpillQueue(cfg SpillConfig) (*spillQueue, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &spillQueue{cfg: cfg, healthy: true, stop: make(chan struct{})}
+	q.Lock()
+	defer q.Unlock()
+	q.adopt(true)
+	return q, nil
+}
+
+// adopt adds the files of processes which are no longer running (or
+// with our pid, which can only be left over by a previous process
+// when first opening) to the queue. Files of a running process, e.g.
+// the parent during a graceful restart, are adopted later, once it
+// exits. Must be called with q locked.
+func (q *spillQueue) adopt(first bool) {
+	paths, err := filepath.Glob(filepath.Join(q.cfg.Dir, "*"+spillSuffix))
+	if err != nil {
+		log.Printf("Spill: error listing files: %v", err)
+		return
+	}
+	sort.Strings(paths)
+
+	known := make(map[string]bool, len(q.files))
+	for _, path := range q.files {
+		known[path] = true
+	}
+	name, offset := q.readOffset()
+
+	var adopted []string
+	for _, path := range paths {
+		if known[path] {
+			continue
+		}
+		pid := spillFilePid(path)
+		if pid == os.Getpid() && !first {
+			continue
+		}
+		if pid != 0 && pid != os.Getpid() && processAlive(pid) {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		start := int64(0)
+		if filepath.Base(path) == name && offset <= fi.Size() && len(adopted) == 0 && len(q.files) == 0 {
+			// it is going to be read first, resume where the
+			// previous process stopped reading it
+			start, q.roff = offset, offset
+		}
+		n, err := countSpillRecords(path, start)
+		if err != nil {
+			log.Printf("Spill: %s ends with a bad record after %d requests (%v), ignoring the rest.", filepath.Base(path), n, err)
+		}
+		q.count += n
+		q.size += fi.Size() - start
+		adopted = append(adopted, path)
+	}
+	if len(adopted) == 0 {
+		return
+	}
+	log.Printf("Spill: adopting %d file(s), %d requests are queued.", len(adopted), q.count)
+
+	// Adopted files are older than our own, but the one being read
+	// (if any) stays first.
+	at := 0
+	if q.rf != nil {
+		at = 1
+	}
+	files := append([]string{}, q.files[:at]...)
+	files = append(files, adopted...)
+	q.files = append(files, q.files[at:]...)
+}
+
+// spillFilePid returns the pid in the file name, or zero.
+func spillFilePid(path string) int {
+	base := strings.TrimSuffix(filepath.Base(path), spillSuffix)
+	if i := strings.LastIndex(base, "-"); i >= 0 {
+		pid, _ := strconv.Atoi(base[i+1:])
+		return pid
+	}
+	return 0
+}
+
+// readOffset returns the file name and offset saved by a previous
+// process, and removes the offset file.
+func (q *spillQueue) readOffset() (string, int64) {
+	path := filepath.Join(q.cfg.Dir, spillOffsetFile)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0
+	}
+	os.Remove(path)
+	var (
+		name   string
+		offset int64
+	)
+	if _, err := fmt.Sscanf(string(b), "%s %d", &name, &offset); err != nil {
+		log.Printf("Spill: ignoring bad offset file: %v", err)
+		return "", 0
+	}
+	return name, offset
+}
+
+func countSpillRecords(path string, offset int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReaderSize(f, 64*1024)
+	n := 0
+	for {
+		if _, _, err := readFrame(br); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// len returns the number of queued requests.
+func (q *spillQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.count
+}
+
+// push appends the request to the queue. It returns false if the
+// request does not fit (or cannot be written).
+func (q *spillQueue) push(req *vDpFlushRequest) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	q.buf = appendFrame(q.buf[:0], encodeSpillRecord(req))
+	if q.size+int64(len(q.buf)) > q.cfg.MaxSize {
+		if !q.full {
+			log.Printf("Spill: queue is full (%d bytes), no longer spilling.", q.size)
+			q.full = true
+		}
+		q.dropped++
+		return false
+	}
+	if q.w == nil || q.wsize >= spillSegmentSize {
+		if err := q.rotate(); err != nil {
+			log.Printf("Spill: error creating file: %v", err)
+			q.dropped++
+			return false
+		}
+	}
+	if _, err := q.w.Write(q.buf); err != nil {
+		log.Printf("Spill: error writing: %v", err)
+		q.dropped++
+		return false
+	}
+	q.full = false
+	q.wsize += int64(len(q.buf))
+	q.size += int64(len(q.buf))
+	q.count++
+	q.spilled++
+	return true
+}
+
+// rotate starts a new file. Must be called with q locked.
+func (q *spillQueue) rotate() error {
+	if q.w != nil {
+		q.w.Close()
+	}
+	var (
+		path string
+		f    *os.File
+		err  error
+	)
+	for ns := time.Now().UnixNano(); ; ns++ {
+		path = filepath.Join(q.cfg.Dir, fmt.Sprintf("%020d-%d%s", ns, os.Getpid(), spillSuffix))
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		q.w = nil
+		return err
+	}
+	q.w, q.wsize = f, 0
+	q.files = append(q.files, path)
+	return nil
+}
+
+// next returns the oldest request without removing it from the
+// queue, commit() does that once it is handed to the flushers. While
+// the database is failing, a request is only returned once every
+// RetryInterval.
+func (q *spillQueue) next() *vDpFlushRequest {
+	q.Lock()
+	defer q.Unlock()
+	if q.count == 0 {
+		return nil
+	}
+	if !q.healthy {
+		if time.Now().Sub(q.lastTry) < q.cfg.RetryInterval {
+			return nil
+		}
+		q.lastTry = time.Now()
+	}
+	for len(q.files) > 0 {
+		if q.rf == nil {
+			f, err := os.Open(q.files[0])
+			if err == nil {
+				_, err = f.Seek(q.roff, io.SeekStart)
+			}
+			if err != nil {
+				log.Printf("Spill: error opening %s, skipping it: %v", q.files[0], err)
+				q.remove()
+				continue
+			}
+			q.rf, q.rb = f, bufio.NewReaderSize(f, 64*1024)
+		}
+		payload, size, err := readFrame(q.rb)
+		if err == nil {
+			req, err := decodeSpillRecord(payload)
+			q.roff += size
+			if err != nil {
+				log.Printf("Spill: skipping bad record: %v", err)
+				q.count--
+				q.size -= size
+				continue
+			}
+			q.pending = size
+			return req
+		}
+		if err == io.EOF && q.w != nil && q.files[0] == q.w.Name() {
+			break // caught up with the writer
+		}
+		if err != io.EOF {
+			log.Printf("Spill: %s ends with a bad record (%v), ignoring the rest.", filepath.Base(q.files[0]), err)
+		}
+		q.remove()
+	}
+	// nothing left, whatever the counts say
+	q.count, q.size = 0, 0
+	return nil
+}
+
+// remove removes the oldest file. Must be called with q locked.
+func (q *spillQueue) remove() {
+	if q.rf != nil {
+		q.rf.Close()
+		q.rf, q.rb = nil, nil
+	}
+	if q.w != nil && q.files[0] == q.w.Name() {
+		q.w.Close()
+		q.w = nil
+	}
+	if err := os.Remove(q.files[0]); err != nil && !os.IsNotExist(err) {
+		log.Printf("Spill: error removing file: %v", err)
+	}
+	q.files, q.roff = q.files[1:], 0
+}
+
+// commit removes the request returned by next() from the queue.
+func (q *spillQueue) commit() {
+	q.Lock()
+	defer q.Unlock()
+	q.count--
+	q.size -= q.pending
+	q.pending = 0
+	q.drained++
+}
+
+// flushed records whether a flush succeeded, i.e. whether the
+// database is healthy.
+func (q *spillQueue) flushed(ok bool) {
+	q.Lock()
+	q.healthy = ok
+	q.Unlock()
+}
+
+// start starts the drainer.
+func (q *spillQueue) start(ch chan *vDpFlushRequest, sr statReporter) {
+	q.wg.Add(1)
+	go q.drainer(ch, sr)
+}
+
+// drainer passes queued requests to the flushers, it blocks when
+// their channel is full. It also reports stats and adopts files of
+// processes which have exited.
+func (q *spillQueue) drainer(ch chan *vDpFlushRequest, sr statReporter) {
+	defer q.wg.Done()
+	lastReport, lastAdopt := time.Now(), time.Now()
+	for {
+		if req := q.next(); req != nil {
+			select {
+			case <-q.stop:
+				return
+			case ch <- req:
+				q.commit()
+			}
+		} else {
+			select {
+			case <-q.stop:
+				return
+			case <-time.After(spillNap):
+			}
+		}
+
+		now := time.Now()
+		if now.Sub(lastReport) >= time.Second {
+			q.report(sr)
+			lastReport = now
+		}
+		if now.Sub(lastAdopt) >= time.Minute {
+			q.Lock()
+			q.adopt(false)
+			q.Unlock()
+			lastAdopt = now
+		}
+	}
+}
+
+func (q *spillQueue) report(sr statReporter) {
+	q.Lock()
+	count, size, spilled, drained, dropped := q.count, q.size, q.spilled, q.drained, q.dropped
+	q.spilled, q.drained, q.dropped = 0, 0, 0
+	q.Unlock()
+	sr.reportStatGauge("receiver.spill.requests", float64(count))
+	sr.reportStatGauge("receiver.spill.bytes", float64(size))
+	sr.reportStatCount("receiver.spill.spilled", float64(spilled))
+	sr.reportStatCount("receiver.spill.drained", float64(drained))
+	sr.reportStatCount("receiver.spill.dropped", float64(dropped))
+}
+
+// stopDrain stops the drainer, it must be called before the flusher
+// channel is closed.
+func (q *spillQueue) stopDrain() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// close closes the files and saves how far the oldest one has been
+// read. Whatever is still queued is flushed by the next process.
+func (q *spillQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	if q.w != nil {
+		if err := q.w.Sync(); err != nil {
+			log.Printf("Spill: error syncing: %v", err)
+		}
+		q.w.Close()
+		q.w = nil
+	}
+	if q.rf != nil {
+		q.rf.Close()
+		q.rf, q.rb = nil, nil
+	}
+	if q.count == 0 {
+		for len(q.files) > 0 {
+			q.remove()
+		}
+		return
+	}
+	if offset := q.roff - q.pending; len(q.files) > 0 && offset > 0 {
+		path := filepath.Join(q.cfg.Dir, spillOffsetFile)
+		data := fmt.Sprintf("%s %d\n", filepath.Base(q.files[0]), offset)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			log.Printf("Spill: error saving offset, some requests will be flushed twice: %v", err)
+		}
+	}
+	log.Printf("Spill: %d requests remain queued.", q.count)
+}
+
+func encodeSpillRecord(req *vDpFlushRequest) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	b := make([]byte, 0, 32+16*len(req.dps)+16*len(req.latests))
+	for _, n := range []int64{req.bundleId, req.seg, req.i} {
+		b = append(b, tmp[:binary.PutVarint(tmp[:], n)]...)
+	}
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(req.dps)))]...)
+	for idx, v := range req.dps {
+		b = append(b, tmp[:binary.PutVarint(tmp[:], idx)]...)
+		var vb [8]byte
+		binary.LittleEndian.PutUint64(vb[:], math.Float64bits(v))
+		b = append(b, vb[:]...)
+	}
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(req.latests)))]...)
+	for idx, t := range req.latests {
+		b = append(b, tmp[:binary.PutVarint(tmp[:], idx)]...)
+		b = append(b, tmp[:binary.PutVarint(tmp[:], t.UnixNano())]...)
+	}
+	return b
+}
+
+func decodeSpillRecord(b []byte) (*vDpFlushRequest, error) {
+	bad := fmt.Errorf("malformed record")
+	varint := func() (int64, bool) {
+		n, l := binary.Varint(b)
+		if l <= 0 {
+			return 0, false
+		}
+		b = b[l:]
+		return n, true
+	}
+	uvarint := func() (uint64, bool) {
+		n, l := binary.Uvarint(b)
+		if l <= 0 || n > uint64(len(b)) {
+			return 0, false
+		}
+		b = b[l:]
+		return n, true
+	}
+
+	req := &vDpFlushRequest{}
+	for _, p := range []*int64{&req.bundleId, &req.seg, &req.i} {
+		n, ok := varint()
+		if !ok {
+			return nil, bad
+		}
+		*p = n
+	}
+	count, ok := uvarint()
+	if !ok {
+		return nil, bad
+	}
+	if count > 0 {
+		req.dps = make(crossRRAPoints, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		idx, ok := varint()
+		if !ok || len(b) < 8 {
+			return nil, bad
+		}
+		req.dps[idx] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	if count, ok = uvarint(); !ok {
+		return nil, bad
+	}
+	if count > 0 {
+		req.latests = make(map[int64]time.Time, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		idx, ok := varint()
+		ns, ok2 := varint()
+		if !ok || !ok2 {
+			return nil, bad
+		}
+		req.latests[idx] = time.Unix(0, ns)
+	}
+	return req, nil
+}
@@ -0,0 +1,193 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_spillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a tiny file size to force a rotation
+	saveSize := spillSegmentSize
+	spillSegmentSize = 50
+	defer func() { spillSegmentSize = saveSize }()
+
+	q, err := openSpillQueue(SpillConfig{Dir: dir, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("openSpillQueue: %v", err)
+	}
+	reqs := []*vDpFlushRequest{
+		{1, 2, 3, crossRRAPoints{0: 1.5, 7: -2}, nil, nil},
+		{1, 2, 0, nil, map[int64]time.Time{0: time.Unix(1500000000, 0), 7: time.Unix(1500000060, 0)}, nil},
+		{4, 0, 9, crossRRAPoints{3: 0}, nil, nil},
+	}
+	for _, req := range reqs {
+		if !q.push(req) {
+			t.Fatalf("push: unexpected false")
+		}
+	}
+	if n := q.len(); n != 3 {
+		t.Errorf("len: expected 3, got %d", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix)); len(files) < 2 {
+		t.Errorf("push: expected a rotation, got %v", files)
+	}
+
+	got := q.next()
+	if !reflect.DeepEqual(got, reqs[0]) {
+		t.Errorf("next: expected %v, got %v", reqs[0], got)
+	}
+	q.commit()
+
+	// stopped before the second is committed, it is not lost
+	if got = q.next(); !reflect.DeepEqual(got, reqs[1]) {
+		t.Errorf("next: expected %v, got %v", reqs[1], got)
+	}
+	q.close()
+
+	q, err = openSpillQueue(SpillConfig{Dir: dir, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("openSpillQueue: %v", err)
+	}
+	if n := q.len(); n != 2 {
+		t.Errorf("len: after reopen expected 2, got %d", n)
+	}
+	for _, expect := range reqs[1:] {
+		got := q.next()
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("next: after reopen expected %v, got %v", expect, got)
+		}
+		q.commit()
+	}
+	if got := q.next(); got != nil || q.len() != 0 {
+		t.Errorf("next: expected an empty queue, got %v %d", got, q.len())
+	}
+
+	// nothing is left once all is drained
+	q.close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("close: expected no files, got %v", files)
+	}
+}
+
+func Test_spillQueue_limits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(SpillConfig{Dir: dir, MaxSize: 40, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("openSpillQueue: %v", err)
+	}
+	defer q.close()
+
+	req := &vDpFlushRequest{1, 2, 3, crossRRAPoints{0: 1, 1: 2}, nil, nil}
+	if !q.push(req) {
+		t.Errorf("push: unexpected false")
+	}
+	if q.push(req) {
+		t.Errorf("push: expected false beyond MaxSize")
+	}
+	if q.dropped != 1 {
+		t.Errorf("push: expected 1 dropped, got %d", q.dropped)
+	}
+
+	// while failing, once per RetryInterval
+	q.flushed(false)
+	if q.next() == nil {
+		t.Errorf("next: expected the first retry")
+	}
+	q.commit()
+	q.push(req)
+	if q.next() != nil {
+		t.Errorf("next: expected nothing before RetryInterval")
+	}
+	q.flushed(true)
+	if q.next() == nil {
+		t.Errorf("next: expected a request once healthy")
+	}
+}
+
+func Test_verticalCache_send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(SpillConfig{Dir: dir, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("openSpillQueue: %v", err)
+	}
+	defer q.close()
+
+	ch := make(chan *vDpFlushRequest, 1)
+	bc := &verticalCache{spill: q}
+	req := &vDpFlushRequest{1, 2, 3, crossRRAPoints{0: 1}, nil, nil}
+
+	if !bc.send(ch, req, false) || len(ch) != 1 || q.len() != 0 {
+		t.Errorf("send: expected it in the channel")
+	}
+	// full channel
+	if !bc.send(ch, req, true) || q.len() != 1 {
+		t.Errorf("send: expected it spilled")
+	}
+	// room in the channel, but the queue comes first
+	<-ch
+	if !bc.send(ch, req, false) || len(ch) != 0 || q.len() != 2 {
+		t.Errorf("send: expected it spilled behind the queue")
+	}
+
+	// the drainer feeds the channel
+	saveNap := spillNap
+	spillNap = time.Millisecond
+	defer func() { spillNap = saveNap }()
+	q.start(ch, &fakeSr{})
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-ch:
+			if !reflect.DeepEqual(got, req) {
+				t.Errorf("drainer: expected %v, got %v", req, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("drainer: timed out")
+		}
+	}
+	q.stopDrain()
+	if n := q.len(); n != 0 {
+		t.Errorf("drainer: expected an empty queue, got %d", n)
+	}
+
+	// without a queue it is a plain send
+	bc.spill = nil
+	ch <- req
+	if bc.send(ch, req, false) {
+		t.Errorf("send: expected false with a full channel and no queue")
+	}
+}
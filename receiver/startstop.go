@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
 )
 
 type wrkCtl struct {
@@ -47,13 +48,18 @@ var startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) {
 }
 
 var doStart = func(r *Receiver) {
+	if r.CacheShards > 0 {
+		r.dsc.setShards(r.CacheShards)
+	}
+	r.dsc.lateTolerance = r.LateTolerance
 	log.Printf("Receiver: Caching data sources...")
 	start := time.Now()
 	if err := r.dsc.preLoad(); err != nil {
 		log.Printf("Receiver: error caching data sources: %v", err)
 	}
 	dur := time.Now().Sub(start)
-	log.Printf("Receiver: Cached %d data sources in %v.", len(r.dsc.byIdent), dur)
+	n, _ := r.dsc.stats()
+	log.Printf("Receiver: Cached %d data sources in %v.", n, dur)
 
 	log.Printf("Receiver: starting...")
 
@@ -65,12 +71,65 @@ var doStart = func(r *Receiver) {
 	log.Printf("Receiver: All workers running, starting director.")
 
 	startWg.Add(1)
-	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director"}, r.dpCh, r.NWorkers, r.cluster, r, r.dsc, r.flusher, r.MaxReceiverQueueSize)
+	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director"}, r.dpCh, r.NWorkers, r.cluster, r, r.dsc, r.flusher, r.MaxReceiverQueueSize, r.flow, r.counts)
 	startWg.Wait()
 
+	if r.wal != nil {
+		// Before any new data, which waits for this
+		log.Printf("Receiver: Replaying the write-ahead log...")
+		n := r.wal.replay(func(ident serde.Ident, ts time.Time, v float64) {
+			r.dpCh <- &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
+		})
+		log.Printf("Receiver: Replayed %d data points.", n)
+		r.reportStatCount("receiver.wal.replayed", float64(n))
+		r.wal.start(r)
+	}
+
+	if b, ok := r.cluster.(broadcaster); ok {
+		go dsCacheDropListener(r.dsc, b.Broadcasts())
+	}
+
 	log.Printf("Receiver: Starting runtime cpu/mem reporter.")
 	go reportRuntime(r)
 
+	if r.MaxCachedDSs > 0 || r.MaxCachedBytes > 0 || r.MaxMemory > 0 {
+		log.Printf("Receiver: Starting resource limiter (max DSs: %d, max cached bytes: %d, max memory: %d).",
+			r.MaxCachedDSs, r.MaxCachedBytes, r.MaxMemory)
+		r.dsc.maxDSs = r.MaxCachedDSs
+		r.resLimiter = newResourceLimiter(r.dsc, r.MaxCachedDSs, r.MaxCachedBytes, r.MaxMemory, 5*time.Second)
+		r.resLimiter.start(r)
+	}
+
+	if r.rewrite != nil {
+		r.rewrite.start(r)
+	}
+
+	if r.filter != nil {
+		r.filter.start(r)
+	}
+
+	if r.dedup != nil {
+		log.Printf("Receiver: Dropping duplicate data points within %v.", r.dedup.window)
+		r.dedup.start(r)
+	}
+
+	if r.dsc.quota != nil {
+		log.Printf("Receiver: Starting series quotas.")
+		r.dsc.quota.start(r.dpCh, r)
+	}
+
+	if r.aggRules != nil {
+		log.Printf("Receiver: Starting aggregation rules (%d rules).", len(r.aggRules.rules))
+		r.aggRules.start(r.queueDataPoint, r)
+	}
+
+	if r.limiter != nil {
+		log.Printf("Receiver: Starting rate limiter.")
+		r.limiter.start(r.queueDataPoint, r)
+	}
+
+	startIngestSources(r)
+
 	log.Printf("Receiver: Ready.")
 }
 
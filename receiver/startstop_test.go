@@ -60,7 +60,7 @@ func Test_startstop_doStart(t *testing.T) {
 	saveSaw := startAllWorkers
 	called := 0
 	stopped := false
-	director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, maxQLen int) {
+	director = func(wc wController, dpCh chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, maxQLen int, flow *flowControl, counts *receiverCounts) {
 		wc.onEnter()
 		defer wc.onExit()
 		called++
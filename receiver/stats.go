@@ -0,0 +1,261 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"expvar"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReceiverStats is a summary of what the receiver is doing.
+type ReceiverStats struct {
+	Series     int   // DSs in the cache
+	DataPoints int64 // data points queued since it was created
+
+	Queues        QueueStats
+	Workers       []WorkerStats    // by worker number
+	CacheHits     int64            // incoming points whose DS was in the cache
+	CacheMisses   int64            // incoming points whose DS had to be loaded or created
+	Forwarded     map[string]int64 // points forwarded to other cluster nodes, by node address
+	DSFlush       LatencyStats     // serde FlushDataSource() calls
+	VerticalFlush LatencyStats     // serde VerticalFlushDPs() and VerticalFlushLatests() calls
+}
+
+// CacheHitRate is the fraction of incoming points whose DS was in the
+// cache, 0 if there were none.
+func (st *ReceiverStats) CacheHitRate() float64 {
+	if total := st.CacheHits + st.CacheMisses; total > 0 {
+		return float64(st.CacheHits) / float64(total)
+	}
+	return 0
+}
+
+// QueueStats are the current queue depths.
+type QueueStats struct {
+	Incoming      int // data points not yet seen by the director
+	Loader        int // DSs waiting to be loaded from the database
+	Workers       int // DSs waiting for a worker
+	DSFlush       int // DS flush requests
+	VerticalFlush int // vertical cache flush requests
+}
+
+// WorkerStats is what a worker processed.
+type WorkerStats struct {
+	DataPoints int64   // since the receiver started
+	Rate       float64 // data points per second, over about the last second
+}
+
+// LatencyBuckets are the upper bounds of the LatencyStats buckets.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LatencyStats is a histogram of how long calls took. Buckets[i] is
+// the number which took at most LatencyBuckets[i] (and longer than
+// the previous bound), the last bucket is the ones which took longer
+// than all the bounds.
+type LatencyStats struct {
+	Count   int64
+	Total   time.Duration
+	Buckets []int64
+}
+
+type latencyHistogram struct {
+	sync.Mutex
+	count   int64
+	total   time.Duration
+	buckets []int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(LatencyBuckets)+1)
+	}
+	h.count++
+	h.total += d
+	h.buckets[i]++
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	h.Lock()
+	defer h.Unlock()
+	st := LatencyStats{Count: h.count, Total: h.total, Buckets: make([]int64, len(LatencyBuckets)+1)}
+	copy(st.Buckets, h.buckets)
+	return st
+}
+
+// A worker rate older than this is stale, the worker is idle.
+const workerRateTTL = 2 * time.Second
+
+type workerCounts struct {
+	processed int64  // atomic
+	rate      uint64 // math.Float64bits, atomic
+	rateTime  int64  // when rate was set, unix nanoseconds, atomic
+}
+
+func (wc *workerCounts) add(n int) {
+	if wc != nil {
+		atomic.AddInt64(&wc.processed, int64(n))
+	}
+}
+
+// setRate sets the rate given n points processed in elapsed.
+func (wc *workerCounts) setRate(n int, elapsed time.Duration, now time.Time) {
+	if wc != nil {
+		atomic.StoreUint64(&wc.rate, math.Float64bits(float64(n)/elapsed.Seconds()))
+		atomic.StoreInt64(&wc.rateTime, now.UnixNano())
+	}
+}
+
+func (wc *workerCounts) stats(now time.Time) WorkerStats {
+	st := WorkerStats{DataPoints: atomic.LoadInt64(&wc.processed)}
+	if now.UnixNano()-atomic.LoadInt64(&wc.rateTime) < int64(workerRateTTL) {
+		st.Rate = math.Float64frombits(atomic.LoadUint64(&wc.rate))
+	}
+	return st
+}
+
+// receiverCounts is what Stats() reports, other than the DS cache
+// size. The director and the flushers register their queues with it
+// when they start.
+type receiverCounts struct {
+	queued      int64 // allocated separately for 64-bit alignment
+	cacheHits   int64
+	cacheMisses int64
+
+	sync.Mutex
+	incoming  func() int
+	loaderCh  chan interface{}
+	workerCh  chan *cachedDs
+	workers   []*workerCounts
+	forwarded map[string]int64
+	dsFlushCh flusherChannel
+	vdbCh     chan *vDpFlushRequest
+
+	dsFlush, vdbFlush latencyHistogram
+}
+
+// setDirector registers the director queues and returns the counts
+// of its n workers.
+func (c *receiverCounts) setDirector(incoming func() int, loaderCh chan interface{}, workerCh chan *cachedDs, n int) []*workerCounts {
+	c.Lock()
+	defer c.Unlock()
+	c.incoming, c.loaderCh, c.workerCh = incoming, loaderCh, workerCh
+	c.workers = make([]*workerCounts, n)
+	for i := range c.workers {
+		c.workers[i] = &workerCounts{}
+	}
+	return c.workers
+}
+
+func (c *receiverCounts) setFlushers(dsFlushCh flusherChannel, vdbCh chan *vDpFlushRequest) {
+	c.Lock()
+	defer c.Unlock()
+	c.dsFlushCh, c.vdbCh = dsFlushCh, vdbCh
+}
+
+// addDirectorStats adds what the director counted since it last
+// reported.
+func (c *receiverCounts) addDirectorStats(st *dpStats) {
+	atomic.AddInt64(&c.cacheHits, int64(st.cacheHits))
+	atomic.AddInt64(&c.cacheMisses, int64(st.cacheMisses))
+	if len(st.forwarded_to) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.forwarded == nil {
+		c.forwarded = make(map[string]int64)
+	}
+	for dest, n := range st.forwarded_to {
+		c.forwarded[dest] += int64(n)
+	}
+}
+
+// Stats returns a summary of what the receiver is doing.
+func (r *Receiver) Stats() ReceiverStats {
+	var st ReceiverStats
+	st.Queues.Incoming = len(r.dpCh)
+	if r.dsc != nil {
+		st.Series, _ = r.dsc.stats()
+	}
+	c := r.counts
+	if c == nil {
+		return st
+	}
+	st.DataPoints = atomic.LoadInt64(&c.queued)
+	st.CacheHits = atomic.LoadInt64(&c.cacheHits)
+	st.CacheMisses = atomic.LoadInt64(&c.cacheMisses)
+	st.DSFlush = c.dsFlush.snapshot()
+	st.VerticalFlush = c.vdbFlush.snapshot()
+
+	c.Lock()
+	defer c.Unlock()
+	if c.incoming != nil {
+		st.Queues.Incoming += c.incoming()
+	}
+	st.Queues.Loader = len(c.loaderCh)
+	st.Queues.Workers = len(c.workerCh)
+	st.Queues.DSFlush = len(c.dsFlushCh)
+	st.Queues.VerticalFlush = len(c.vdbCh)
+	now := time.Now()
+	for _, wc := range c.workers {
+		st.Workers = append(st.Workers, wc.stats(now))
+	}
+	if len(c.forwarded) > 0 {
+		st.Forwarded = make(map[string]int64, len(c.forwarded))
+		for dest, n := range c.forwarded {
+			st.Forwarded[dest] = n
+		}
+	}
+	return st
+}
+
+var (
+	expvarOnce     sync.Once
+	expvarReceiver atomic.Value // *Receiver
+)
+
+// PublishExpvar makes Stats() available as the "tgres.receiver"
+// expvar (served at /debug/vars by http.DefaultServeMux), replacing
+// the receiver published before, if any.
+func (r *Receiver) PublishExpvar() {
+	expvarReceiver.Store(r)
+	expvarOnce.Do(func() {
+		expvar.Publish("tgres.receiver", expvar.Func(func() interface{} {
+			return expvarReceiver.Load().(*Receiver).Stats()
+		}))
+	})
+}
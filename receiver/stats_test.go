@@ -0,0 +1,65 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_latencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	h.observe(0)
+	h.observe(time.Millisecond)
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Minute)
+	(*latencyHistogram)(nil).observe(time.Second) // must not panic
+
+	st := h.snapshot()
+	if st.Count != 4 || st.Total != time.Minute+3*time.Millisecond {
+		t.Errorf("snapshot: expected 4 calls totalling 1m0.003s, got %d %v", st.Count, st.Total)
+	}
+	last := len(LatencyBuckets)
+	if len(st.Buckets) != last+1 || st.Buckets[0] != 2 || st.Buckets[1] != 1 || st.Buckets[last] != 1 {
+		t.Errorf("snapshot: unexpected buckets %v", st.Buckets)
+	}
+}
+
+func Test_Receiver_Stats(t *testing.T) {
+	r := &Receiver{dpCh: make(chan interface{}, 4), counts: &receiverCounts{}}
+	r.dpCh <- nil
+
+	loaderCh, workerCh := make(chan interface{}, 4), make(chan *cachedDs, 4)
+	loaderCh <- nil
+	wcs := r.counts.setDirector(func() int { return 2 }, loaderCh, workerCh, 2)
+	now := time.Now()
+	wcs[0].add(10)
+	wcs[0].setRate(10, time.Second, now)
+	wcs[1].add(5)
+	wcs[1].setRate(5, time.Second, now.Add(-2*workerRateTTL))
+	r.counts.addDirectorStats(&dpStats{cacheHits: 3, cacheMisses: 1, forwarded_to: map[string]int{"n2": 7}})
+
+	st := r.Stats()
+	if st.Queues.Incoming != 3 || st.Queues.Loader != 1 || st.Queues.Workers != 0 {
+		t.Errorf("Stats: unexpected queues %#v", st.Queues)
+	}
+	if len(st.Workers) != 2 || st.Workers[0].DataPoints != 10 || st.Workers[0].Rate != 10 || st.Workers[1].Rate != 0 {
+		t.Errorf("Stats: unexpected workers %#v (a stale rate should be 0)", st.Workers)
+	}
+	if st.CacheHitRate() != 0.75 || st.Forwarded["n2"] != 7 {
+		t.Errorf("Stats: expected hit rate 0.75 and 7 forwarded, got %v %v", st.CacheHitRate(), st.Forwarded)
+	}
+}
@@ -0,0 +1,94 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TimestampResolution is the finest resolution of data point
+// timestamps which is preserved, that of the DS step and PDP
+// duration as stored by the serde. Finer timestamps are rounded to
+// it (half away from zero) by QueueDataPoint().
+const TimestampResolution = time.Millisecond
+
+// How many timestamps parsed by EpochTime() and ParseEpochTime()
+// lost precision, reported (for the whole process) by
+// reportRuntime().
+var timestampsRounded int64
+
+func roundTimestamp(ts time.Time) time.Time {
+	return ts.Round(TimestampResolution)
+}
+
+// roundCounted rounds the timestamp and counts it if that loses
+// precision.
+func roundCounted(ts time.Time, lost bool) time.Time {
+	rounded := roundTimestamp(ts)
+	if lost || !rounded.Equal(ts) {
+		atomic.AddInt64(&timestampsRounded, 1)
+	}
+	return rounded
+}
+
+// EpochTime returns the time of (possibly fractional) seconds since
+// the epoch, rounded to TimestampResolution. A float64 only has
+// about a microsecond of precision for the present time, the
+// fraction is therefore taken to the microsecond first, so that
+// e.g. 1500000000.123 is exactly 123ms.
+func EpochTime(sec float64) time.Time {
+	whole := math.Floor(sec)
+	us := int64(math.Round((sec - whole) * 1e6))
+	return roundCounted(time.Unix(int64(whole), us*int64(time.Microsecond)), false)
+}
+
+// ParseEpochTime parses (possibly fractional) seconds since the
+// epoch, e.g. "1500000000" or "1500000000.123", rounded to
+// TimestampResolution. A decimal fraction is parsed exactly, any
+// other number (e.g. "1.5e9") is passed to EpochTime().
+func ParseEpochTime(s string) (time.Time, error) {
+	ip, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		ip, frac = s[:i], s[i+1:]
+	}
+	sec, err := strconv.ParseInt(ip, 10, 64)
+	if err != nil || strings.TrimLeft(frac, "0123456789") != "" || (ip == "" || ip == "-") {
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return time.Time{}, fmt.Errorf("invalid timestamp: %q", s)
+		}
+		return EpochTime(f), nil
+	}
+	if frac == "" {
+		return time.Unix(sec, 0), nil
+	}
+
+	// Up to nanoseconds, whatever is beyond is lost
+	lost := len(frac) > 9 && strings.Trim(frac[9:], "0") != ""
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	ns, _ := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if strings.HasPrefix(ip, "-") {
+		ns = -ns
+	}
+	return roundCounted(time.Unix(sec, ns), lost), nil
+}
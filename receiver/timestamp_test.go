@@ -0,0 +1,65 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_ParseEpochTime(t *testing.T) {
+	atomic.StoreInt64(&timestampsRounded, 0)
+	for _, c := range []struct {
+		s     string
+		ms    int64
+		lost  bool
+		isErr bool
+	}{
+		{"1500000000", 1500000000000, false, false},
+		{"1500000000.5", 1500000000500, false, false},
+		{"1500000000.123", 1500000000123, false, false},
+		{"1500000000.1234", 1500000000123, true, false},
+		{"1500000000.1235", 1500000000124, true, false},
+		{"1500000000.1230000000000", 1500000000123, false, false},
+		{"1.5e9", 1500000000000, false, false},
+		{"-1.5", -1500, false, false},
+		{"bogus", 0, false, true},
+		{"1500000000.12x", 0, false, true},
+	} {
+		before := atomic.LoadInt64(&timestampsRounded)
+		ts, err := ParseEpochTime(c.s)
+		if (err != nil) != c.isErr {
+			t.Errorf("ParseEpochTime(%q): unexpected error: %v", c.s, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ms := ts.UnixNano() / int64(time.Millisecond); ms != c.ms || ts.UnixNano()%int64(time.Millisecond) != 0 {
+			t.Errorf("ParseEpochTime(%q): expected %d ms, got %v", c.s, c.ms, ts.UnixNano())
+		}
+		if lost := atomic.LoadInt64(&timestampsRounded) > before; lost != c.lost {
+			t.Errorf("ParseEpochTime(%q): expected precision loss %v, got %v", c.s, c.lost, lost)
+		}
+	}
+
+	// a float cannot represent .123 exactly, it should still be 123ms
+	atomic.StoreInt64(&timestampsRounded, 0)
+	if ts := EpochTime(1500000000.123); ts.UnixNano() != 1500000000123*int64(time.Millisecond) || timestampsRounded != 0 {
+		t.Errorf("EpochTime: expected 1500000000.123 without precision loss, got %v (%d)", ts.UnixNano(), timestampsRounded)
+	}
+}
@@ -58,6 +58,7 @@ type bundleKey struct {
 type verticalCache struct {
 	m       map[bundleKey]*verticalCacheSegment
 	minStep time.Duration
+	spill   *spillQueue // if not nil, used when ch is full
 	*sync.Mutex
 }
 
@@ -176,16 +177,11 @@ func (bc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				continue
 			}
 
-			if full { // insist, even if we block
-				ch <- &vDpFlushRequest{key.bundleId, key.seg, i, dps, nil}
-			} else { // just skip over if channel full
-				select {
-				default:
-					// we're blocked
-					blocked++
-					continue
-				case ch <- &vDpFlushRequest{key.bundleId, key.seg, i, dps, nil}:
-				}
+			// if full, insist, even if we block, otherwise just skip over if channel full
+			if !bc.send(ch, &vDpFlushRequest{key.bundleId, key.seg, i, dps, nil, nil}, full) {
+				// we're blocked
+				blocked++
+				continue
 			}
 
 			// delete the flushed segment row
@@ -204,7 +200,7 @@ func (bc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 		}
 
 		if len(flushLatests) > 0 {
-			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, flushLatests}
+			bc.send(ch, &vDpFlushRequest{key.bundleId, key.seg, 0, nil, flushLatests, nil}, true)
 			lcount += len(flushLatests)
 			flushCount += 1
 		}
@@ -222,3 +218,23 @@ func (bc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 
 	return st
 }
+
+// send passes the request to the flushers. When the channel is full,
+// or requests are already waiting in the spill queue (to keep the
+// order), it is spilled to disk instead, if that fails and block is
+// false, send returns false.
+func (bc *verticalCache) send(ch chan *vDpFlushRequest, req *vDpFlushRequest, block bool) bool {
+	if bc.spill != nil && (len(ch) == cap(ch) || bc.spill.len() > 0) && bc.spill.push(req) {
+		return true
+	}
+	if block {
+		ch <- req
+		return true
+	}
+	select {
+	case ch <- req:
+		return true
+	default:
+		return false
+	}
+}
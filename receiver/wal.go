@@ -0,0 +1,409 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// WALConfig configures the write-ahead log, see OpenWAL().
+type WALConfig struct {
+	// Dir is the directory of the segment files, it is created if
+	// it does not exist.
+	Dir string
+
+	// SegmentSize is the size (in bytes) at which a segment is
+	// closed and a new one started. Zero means 64MB.
+	SegmentSize int64
+
+	// Retention is how long a closed segment is kept. It must be
+	// longer than a data point can stay in memory before it is
+	// flushed to the database. Zero means one hour.
+	Retention time.Duration
+
+	// SyncInterval is how often the log is fsync'ed, i.e. how much
+	// of the most recent data can be lost on a power failure. Zero
+	// means one second.
+	SyncInterval time.Duration
+}
+
+const (
+	walSuffix    = ".wal"
+	walMaxRecord = 1 << 20 // larger is certainly corruption
+)
+
+// wal is the write-ahead log. Data points are appended to the current
+// segment before they are queued, and replayed when the receiver
+// starts, so that after a crash the points which were only in memory
+// are processed again. Replaying points which had been flushed is
+// harmless, a data source ignores points older than its last update.
+//
+// Each record is a uvarint payload length, the IEEE CRC-32 of the
+// payload (little endian) and the payload: the time stamp in
+// nanoseconds (varint), the value (8 bytes, little endian) and the
+// ident as a uvarint count of key/value pairs, each a uvarint length
+// followed by the bytes. A record which is short or fails the CRC ends
+// the segment, it is what a crash while writing leaves behind.
+type wal struct {
+	sync.Mutex
+	cfg     WALConfig
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	buf     []byte
+	owned   map[string]bool // segments written or replayed by this process
+	old     []string        // segments to replay
+	ready   chan struct{}   // closed once replayed
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	err     error // the first write error, the log is disabled after it
+	written int64 // records appended since last reported
+}
+
+// OpenWAL enables the write-ahead log, it must be called before any
+// data points are queued. Segments left over by a previous process
+// are replayed by Start(), and a segment is only deleted once older
+// than cfg.Retention, or when the receiver is stopped (by which time
+// everything has been flushed).
+func (r *Receiver) OpenWAL(cfg WALConfig) error {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 64 * 1024 * 1024
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = time.Hour
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	w := &wal{
+		cfg:   cfg,
+		owned: make(map[string]bool),
+		ready: make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	var err error
+	if w.old, err = w.segments(); err != nil {
+		return err
+	}
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	r.wal = w
+	return nil
+}
+
+// segments returns the paths of the segment files, oldest first.
+func (w *wal) segments() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(w.cfg.Dir, "*"+walSuffix))
+	sort.Strings(paths)
+	return paths, err
+}
+
+// rotate closes the current segment (if any) and starts a new one.
+// The name sorts in the order of creation, the pid keeps names
+// unique during a graceful restart. Must be called with w locked.
+func (w *wal) rotate() error {
+	if w.f != nil {
+		if err := w.sync(); err != nil {
+			return err
+		}
+		w.f.Close()
+	}
+	var (
+		path string
+		f    *os.File
+		err  error
+	)
+	for ns := time.Now().UnixNano(); ; ns++ { // the clock may be coarse
+		path = filepath.Join(w.cfg.Dir, fmt.Sprintf("%020d-%d%s", ns, os.Getpid(), walSuffix))
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	w.f, w.size = f, 0
+	w.owned[path] = true
+	if w.w == nil {
+		w.w = bufio.NewWriterSize(f, 64*1024)
+	} else {
+		w.w.Reset(f)
+	}
+	return nil
+}
+
+func (w *wal) sync() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// append writes a record. An error disables the log (and is logged
+// once), the data point is queued regardless.
+func (w *wal) append(ident serde.Ident, ts time.Time, v float64) {
+	w.Lock()
+	defer w.Unlock()
+	if w.err != nil {
+		return
+	}
+
+	w.buf = encodeWALRecord(w.buf[:0], ident, ts, v)
+	if _, err := w.w.Write(w.buf); err != nil {
+		w.fail(err)
+		return
+	}
+	w.size += int64(len(w.buf))
+	w.written++
+	if w.size >= w.cfg.SegmentSize {
+		if err := w.rotate(); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+func (w *wal) fail(err error) {
+	w.err = err
+	log.Printf("WAL: ERROR: %v, no longer logging data points!", err)
+}
+
+// encodeWALRecord appends the record to b.
+func encodeWALRecord(b []byte, ident serde.Ident, ts time.Time, v float64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	payload := make([]byte, 0, 32+16*len(ident))
+	payload = append(payload, tmp[:binary.PutVarint(tmp[:], ts.UnixNano())]...)
+	var vb [8]byte
+	binary.LittleEndian.PutUint64(vb[:], math.Float64bits(v))
+	payload = append(payload, vb[:]...)
+	payload = append(payload, tmp[:binary.PutUvarint(tmp[:], uint64(len(ident)))]...)
+	for k, val := range ident {
+		for _, s := range []string{k, val} {
+			payload = append(payload, tmp[:binary.PutUvarint(tmp[:], uint64(len(s)))]...)
+			payload = append(payload, s...)
+		}
+	}
+
+	return appendFrame(b, payload)
+}
+
+// appendFrame appends the payload to b, preceded by its length and
+// CRC. This framing is shared with the spill queue.
+func appendFrame(b, payload []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(payload)))]...)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(payload))
+	b = append(b, crc[:]...)
+	return append(b, payload...)
+}
+
+// readFrame reads the payload of the next frame and returns it along
+// with the size of the whole frame. It returns io.EOF at the end of
+// the file, any other error means it is truncated or corrupt.
+func readFrame(r *bufio.Reader) ([]byte, int64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err // io.EOF if exactly at the end
+	}
+	if n > walMaxRecord {
+		return nil, 0, fmt.Errorf("record length %d too large", n)
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	size := int64(binary.PutUvarint(tmp[:], n)) + 4 + int64(n)
+	b := make([]byte, 4+n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, fmt.Errorf("short record: %v", err)
+	}
+	crc, payload := binary.LittleEndian.Uint32(b), b[4:]
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, 0, fmt.Errorf("CRC mismatch")
+	}
+	return payload, size, nil
+}
+
+// readWALRecord reads the next record. It returns io.EOF at the end
+// of the segment, any other error means it is truncated or corrupt.
+func readWALRecord(r *bufio.Reader) (serde.Ident, time.Time, float64, error) {
+	payload, _, err := readFrame(r)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	bad := fmt.Errorf("malformed record")
+	ns, l := binary.Varint(payload)
+	if l <= 0 || len(payload) < l+8 {
+		return nil, time.Time{}, 0, bad
+	}
+	payload = payload[l:]
+	v := math.Float64frombits(binary.LittleEndian.Uint64(payload))
+	payload = payload[8:]
+	count, l := binary.Uvarint(payload)
+	if l <= 0 || count > uint64(len(payload)) {
+		return nil, time.Time{}, 0, bad
+	}
+	payload = payload[l:]
+	ident := make(serde.Ident, count)
+	for i := uint64(0); i < count; i++ {
+		var kv [2]string
+		for j := range kv {
+			sl, l := binary.Uvarint(payload)
+			if l <= 0 || uint64(len(payload)-l) < sl {
+				return nil, time.Time{}, 0, bad
+			}
+			kv[j] = string(payload[l : l+int(sl)])
+			payload = payload[l+int(sl):]
+		}
+		ident[kv[0]] = kv[1]
+	}
+	return ident, time.Unix(0, ns), v, nil
+}
+
+// replay passes the records of the segments which existed when the
+// log was opened to queue, and then lets append() callers through. It
+// returns the number of data points replayed.
+func (w *wal) replay(queue func(serde.Ident, time.Time, float64)) int {
+	defer close(w.ready)
+
+	var total int
+	for _, path := range w.old {
+		f, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) { // a graceful parent may have just removed it
+				log.Printf("WAL: error opening segment: %v", err)
+			}
+			continue
+		}
+		n := 0
+		br := bufio.NewReaderSize(f, 64*1024)
+		for {
+			ident, ts, v, err := readWALRecord(br)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("WAL: segment %s ends with a bad record after %d data points (%v), ignoring the rest.", filepath.Base(path), n, err)
+				break
+			}
+			queue(ident, ts, v)
+			n++
+		}
+		f.Close()
+		w.Lock()
+		w.owned[path] = true
+		w.Unlock()
+		total += n
+	}
+	w.old = nil
+	return total
+}
+
+// start starts the syncer.
+func (w *wal) start(sr statReporter) {
+	w.wg.Add(1)
+	go w.syncer(sr)
+}
+
+// purge removes closed segments older than the retention.
+func (w *wal) purge(now time.Time) {
+	paths, err := w.segments()
+	if err != nil {
+		log.Printf("WAL: error listing segments: %v", err)
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	for _, path := range paths {
+		if w.f != nil && path == w.f.Name() {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && now.Sub(fi.ModTime()) > w.cfg.Retention {
+			if err := os.Remove(path); err != nil {
+				log.Printf("WAL: error removing old segment: %v", err)
+			}
+			delete(w.owned, path)
+		}
+	}
+}
+
+// syncer periodically syncs the log to disk and purges old segments.
+func (w *wal) syncer(sr statReporter) {
+	defer w.wg.Done()
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.cfg.SyncInterval):
+		}
+
+		w.Lock()
+		if w.err == nil {
+			if err := w.sync(); err != nil {
+				w.fail(err)
+			}
+		}
+		written := w.written
+		w.written = 0
+		w.Unlock()
+		sr.reportStatCount("receiver.wal.appended", float64(written))
+
+		if now := time.Now(); now.Sub(lastPurge) > time.Minute {
+			w.purge(now)
+			lastPurge = now
+		}
+	}
+}
+
+// close stops the log. If flushed, everything in the segments this
+// process owns is in the database and they are removed.
+func (w *wal) close(flushed bool) {
+	close(w.stop)
+	w.wg.Wait()
+
+	w.Lock()
+	defer w.Unlock()
+	if w.err == nil {
+		if err := w.sync(); err != nil {
+			log.Printf("WAL: error syncing: %v", err)
+		}
+	}
+	w.f.Close()
+	w.err = fmt.Errorf("closed") // append() is a no-op from now on
+	if !flushed {
+		return
+	}
+	for path := range w.owned {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("WAL: error removing segment: %v", err)
+		}
+	}
+}
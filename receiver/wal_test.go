@@ -0,0 +1,111 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_wal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a tiny segment size to force a rotation
+	r := &Receiver{}
+	if err := r.OpenWAL(WALConfig{Dir: dir, SegmentSize: 100}); err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	if n := r.wal.replay(nil); n != 0 {
+		t.Errorf("replay: nothing to replay expected, got %d", n)
+	}
+	for i := 0; i < 5; i++ {
+		r.wal.append(serde.Ident{"name": fmt.Sprintf("foo.%d", i), "host": "a"}, time.Unix(1500000000+int64(i), 0), float64(i)+0.5)
+	}
+	r.wal.close(false) // a crash
+
+	// a record cut short by the crash
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if len(segs) < 2 {
+		t.Fatalf("append: expected a rotation, got segments %v", segs)
+	}
+	f, _ := os.OpenFile(segs[len(segs)-1], os.O_APPEND|os.O_WRONLY, 0)
+	rec := encodeWALRecord(nil, serde.Ident{"name": "partial"}, time.Now(), 1)
+	f.Write(rec[:len(rec)-1])
+	f.Close()
+
+	r = &Receiver{}
+	if err := r.OpenWAL(WALConfig{Dir: dir}); err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	var got []string
+	n := r.wal.replay(func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%s %s %d %v", ident["name"], ident["host"], ts.Unix(), v))
+	})
+	expect := "foo.0 a 1500000000 0.5,foo.1 a 1500000001 1.5,foo.2 a 1500000002 2.5,foo.3 a 1500000003 3.5,foo.4 a 1500000004 4.5"
+	if n != 5 || strings.Join(got, ",") != expect {
+		t.Errorf("replay: expected %s, got %d %v", expect, n, got)
+	}
+	select {
+	case <-r.wal.ready:
+	default:
+		t.Errorf("replay: ready not closed")
+	}
+
+	// after a clean stop everything is flushed, nothing is left
+	r.wal.close(true)
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*")); len(segs) != 0 {
+		t.Errorf("close: expected no segments, got %v", segs)
+	}
+}
+
+func Test_wal_purge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "00000000000000000001-1"+walSuffix)
+	ioutil.WriteFile(old, nil, 0644)
+	r := &Receiver{}
+	if err := r.OpenWAL(WALConfig{Dir: dir, Retention: time.Minute}); err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	defer r.wal.close(false)
+
+	r.wal.purge(time.Now())
+	if _, err := os.Stat(old); err != nil {
+		t.Errorf("purge: segment removed before the retention: %v", err)
+	}
+	r.wal.purge(time.Now().Add(2 * time.Minute))
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("purge: old segment not removed")
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix)); len(segs) != 1 {
+		t.Errorf("purge: the current segment must stay, got %v", segs)
+	}
+}
@@ -29,6 +29,9 @@ type DataSource struct {
 	heartbeat  time.Duration        // Heartbeat is inactivity period longer than this causes NaN values. 0 -> no heartbeat.
 	lastUpdate time.Time            // Last time we received an update (series time - can be in the past or future)
 	rras       []RoundRobinArchiver // Array of Round Robin Archives
+	dsType     DSType               // How values are interpreted
+	lastRaw    float64              // Last value as received (before conversion according to dsType)
+	min, max   float64              // Values outside of these are NaN, see DSSpec
 }
 
 // DataSourcer is a DataSource as an interface.
@@ -37,6 +40,8 @@ type DataSourcer interface {
 	Step() time.Duration
 	Heartbeat() time.Duration
 	LastUpdate() time.Time
+	Type() DSType
+	LastRaw() float64
 	RRAs() []RoundRobinArchiver
 	SetRRAs(rras []RoundRobinArchiver)
 	Copy() DataSourcer
@@ -44,15 +49,20 @@ type DataSourcer interface {
 	PointCount() int
 	ClearRRAs()
 	ProcessDataPoint(value float64, ts time.Time) error
+	ProcessLateDataPoint(value float64, ts time.Time) error
 }
 
 // NewDataSource returns a new DataSource in accordance with the passed
 // in DSSpec.
 func NewDataSource(spec DSSpec) *DataSource {
 	result := &DataSource{
+		min:        spec.Min,
+		max:        spec.Max,
 		step:       spec.Step,
 		heartbeat:  spec.Heartbeat,
 		lastUpdate: spec.LastUpdate,
+		dsType:     spec.Type,
+		lastRaw:    spec.LastRaw,
 		Pdp: Pdp{
 			value:    spec.Value,
 			duration: spec.Duration,
@@ -78,6 +88,34 @@ func (ds *DataSource) Heartbeat() time.Duration { return ds.heartbeat }
 // LastUpdate returns the timestamp of the last Data Point processed
 func (ds *DataSource) LastUpdate() time.Time { return ds.lastUpdate }
 
+// Type returns the type of the DS, i.e. how the values are
+// interpreted.
+func (ds *DataSource) Type() DSType { return ds.dsType }
+
+// LastRaw returns the last value received (as opposed to the one
+// stored, which depends on the type). It is NaN if unknown.
+func (ds *DataSource) LastRaw() float64 { return ds.lastRaw }
+
+// Limits returns the smallest and the greatest valid value, NaN if
+// there is no such limit. See DSSpec.
+func (ds *DataSource) Limits() (min, max float64) {
+	if ds.min == 0 && ds.max == 0 {
+		return math.NaN(), math.NaN()
+	}
+	return ds.min, ds.max
+}
+
+// limit returns NaN if the value is outside of the limits.
+func (ds *DataSource) limit(value float64) float64 {
+	if ds.min == 0 && ds.max == 0 {
+		return value // no limits
+	}
+	if value < ds.min || value > ds.max { // false if NaN
+		return math.NaN()
+	}
+	return value
+}
+
 // List of Round Robin Archives this Data Source has
 func (ds *DataSource) RRAs() []RoundRobinArchiver { return ds.rras }
 
@@ -94,6 +132,10 @@ func (ds *DataSource) Copy() DataSourcer {
 		step:       ds.step,
 		heartbeat:  ds.heartbeat,
 		lastUpdate: ds.lastUpdate,
+		dsType:     ds.dsType,
+		lastRaw:    ds.lastRaw,
+		min:        ds.min,
+		max:        ds.max,
 		rras:       make([]RoundRobinArchiver, len(ds.rras)),
 	}
 	for n, rra := range ds.rras {
@@ -103,12 +145,17 @@ func (ds *DataSource) Copy() DataSourcer {
 }
 
 // BestRRA examines the RRAs and returns the one that best matches the
-// given start, end and resolution (as number of points).
+// given start, end and resolution (as number of points). Of RRAs with
+// the same step, WMEAN is preferred.
 func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArchiver {
+	return bestRRA(ds.rras, start, end, points)
+}
+
+func bestRRA(rras []RoundRobinArchiver, start, end time.Time, points int64) RoundRobinArchiver {
 	var result []RoundRobinArchiver
 
 	// Any RRA include start?
-	for _, rra := range ds.rras {
+	for _, rra := range rras {
 		// We need to include RRAs that were last updated before start too
 		// or we end up with nothing, then the lowest resolution RRA
 		if rra.includes(start) || rra.Latest().Before(start) {
@@ -118,7 +165,7 @@ func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArch
 
 	if len(result) == 0 { // if we found nothing above, simply select the longest RRA
 		var longest RoundRobinArchiver
-		for _, rra := range ds.rras {
+		for _, rra := range rras {
 			if longest == nil || longest.Size()*int64(longest.Step()) < rra.Size()*int64(rra.Step()) {
 				longest = rra
 			}
@@ -143,7 +190,7 @@ func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArch
 				} else {
 					rraDiff := math.Abs(float64(expectedStep - rra.Step()))
 					bestDiff := math.Abs(float64(expectedStep - best.Step()))
-					if bestDiff > rraDiff {
+					if bestDiff > rraDiff || (bestDiff == rraDiff && preferred(rra, best)) {
 						best = rra
 					}
 				}
@@ -155,7 +202,7 @@ func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArch
 				if best == nil {
 					best = rra
 				} else {
-					if best.Step() > rra.Step() {
+					if best.Step() > rra.Step() || (best.Step() == rra.Step() && preferred(rra, best)) {
 						best = rra
 					}
 				}
@@ -168,6 +215,13 @@ func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArch
 	return nil
 }
 
+// preferred tells whether rra should be chosen over best, which has
+// the same step: an average (WMEAN) is what is expected unless asked
+// otherwise (see series.Consolidator).
+func preferred(rra, best RoundRobinArchiver) bool {
+	return rra.Consolidation() == WMEAN && best.Consolidation() != WMEAN
+}
+
 // PointCount returns the sum of all point counts of every RRA in this
 // DS.
 func (ds *DataSource) PointCount() int {
@@ -276,6 +330,17 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 		return fmt.Errorf("Data point time stamp %v is not greater than data source last update time %v", ts, ds.lastUpdate)
 	}
 
+	if ds.dsType != GAUGE {
+		raw := value
+		if ds.lastUpdate.IsZero() {
+			value = math.NaN()
+		} else {
+			value = ds.dsType.rate(raw, ds.lastRaw, ts.Sub(ds.lastUpdate))
+		}
+		ds.lastRaw = raw
+	}
+	value = ds.limit(value)
+
 	// ds value is NaN if HB is exceeded
 	if ds.heartbeat > 0 && ts.Sub(ds.lastUpdate) > ds.heartbeat {
 		value = math.NaN()
@@ -290,6 +355,41 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 	return nil
 }
 
+// ProcessLateDataPoint places a data point with a time stamp before
+// the last update (i.e. one that arrived out of order) into the RRA
+// slots it belongs to (see RoundRobinArchive updateLate), without
+// changing the PDP or the last update. It is an error if the point is
+// not late, or if there is no RRA in which its slot is complete
+// (e.g. it is less than a step late), not flushed yet (see ClearRRAs)
+// and could take the value.
+func (ds *DataSource) ProcessLateDataPoint(value float64, ts time.Time) error {
+
+	if math.IsInf(value, 0) {
+		return fmt.Errorf("±Inf is not a valid data point value: %v", value)
+	}
+
+	if !ts.Before(ds.lastUpdate) {
+		return fmt.Errorf("Data point time stamp %v is not before data source last update time %v", ts, ds.lastUpdate)
+	}
+
+	if ds.dsType != GAUGE {
+		return fmt.Errorf("Late data points are only supported by GAUGE data sources, not %v", ds.dsType)
+	}
+	value = ds.limit(value)
+
+	placed := false
+	for _, rra := range ds.rras {
+		if rra.updateLate(ts, value) {
+			placed = true
+		}
+	}
+	if !placed {
+		return fmt.Errorf("Late data point time stamp %v (last update %v) could not be placed in a complete, unflushed slot of any RRA", ts, ds.lastUpdate)
+	}
+
+	return nil
+}
+
 func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	// for each of this DS's RRAs
 	for _, rra := range ds.rras {
@@ -326,8 +426,19 @@ type DSSpec struct {
 	Heartbeat time.Duration
 	RRAs      []RRASpec
 
+	// Type is how values are interpreted, the zero value is GAUGE.
+	Type DSType
+
+	// Values (after conversion according to Type, i.e. rates) less
+	// than Min or greater than Max are considered unknown (NaN), as
+	// in RRDTool. This keeps e.g. counter resets from showing as
+	// huge spikes. NaN means no limit, so does the zero value (both
+	// 0).
+	Min, Max float64
+
 	// These can be used to fill the initial value
 	LastUpdate time.Time
+	LastRaw    float64
 	Value      float64
 	Duration   time.Duration
 }
@@ -123,6 +123,23 @@ func Test_DataSource_BestRRA(t *testing.T) {
 		t.Errorf("BestRRA: The % step should have been selected even if start > latest, instead we got %#v", ten, best)
 	}
 
+	// Of the same step, WMEAN is preferred
+	rras = []RoundRobinArchiver{
+		&RoundRobinArchive{latest: latest, step: ten, size: 100, cf: MAX},
+		&RoundRobinArchive{latest: latest, step: ten, size: 100, cf: WMEAN},
+	}
+	ds.SetRRAs(rras)
+	for _, p := range []int64{points, 0} {
+		if best = ds.BestRRA(start, end, p); best == nil || best.Consolidation() != WMEAN {
+			t.Errorf("BestRRA: WMEAN should have been preferred (points %d), instead we got %#v", p, best)
+		}
+	}
+	rras = []RoundRobinArchiver{
+		&RoundRobinArchive{latest: latest, step: ten, size: 100},
+		&RoundRobinArchive{latest: latest, step: twenty, size: 100},
+	}
+	ds.SetRRAs(rras)
+
 	// And now fewer points bigger step
 	start = time.Unix(9500, 0)
 	end = time.Unix(9600, 0)
@@ -258,6 +275,125 @@ func Test_DataSource_ProcessDataPoint(t *testing.T) {
 	}
 }
 
+func Test_DataSource_ProcessDataPoint_counter(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{Type: COUNTER, Step: 10 * time.Second,
+		RRAs: []RRASpec{{Step: 10 * time.Second, Span: 100 * time.Second}}})
+
+	ds.ProcessDataPoint(1000, time.Unix(1000, 0))
+	if ds.LastRaw() != 1000 {
+		t.Errorf("ProcessDataPoint: counter: LastRaw %v", ds.LastRaw())
+	}
+	ds.ProcessDataPoint(1100, time.Unix(1010, 0))
+	if v := ds.rras[0].DPs()[SlotIndex(time.Unix(1010, 0), 10*time.Second, 10)]; v != 10 {
+		t.Errorf("ProcessDataPoint: counter: expected a rate of 10, got %v", v)
+	}
+
+	// 32 bit wrap
+	ds.lastRaw = math.Pow(2, 32) - 50
+	ds.ProcessDataPoint(50, time.Unix(1020, 0))
+	if v := ds.rras[0].DPs()[SlotIndex(time.Unix(1020, 0), 10*time.Second, 10)]; v != 10 {
+		t.Errorf("ProcessDataPoint: counter wrap: expected a rate of 10, got %v", v)
+	}
+
+	if err := ds.ProcessLateDataPoint(1, time.Unix(1015, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: a counter should not accept late points")
+	}
+	if cpy := ds.Copy(); cpy.Type() != COUNTER || cpy.LastRaw() != 50 {
+		t.Errorf("Copy: type and last raw value not copied")
+	}
+}
+
+func Test_DataSource_limits(t *testing.T) {
+
+	// the zero value (both 0) is no limit
+	ds := &DataSource{}
+	if v := ds.limit(-5); v != -5 {
+		t.Errorf("limit: zero value: expected -5, got %v", v)
+	}
+	if min, max := ds.Limits(); !math.IsNaN(min) || !math.IsNaN(max) {
+		t.Errorf("Limits: zero value: expected NaN, got %v %v", min, max)
+	}
+
+	ds = NewDataSource(DSSpec{Type: COUNTER, Step: 10 * time.Second, Min: 0, Max: 100,
+		RRAs: []RRASpec{{Step: 10 * time.Second, Span: 100 * time.Second, Xff: 0.5}}})
+	if v := ds.limit(101); !math.IsNaN(v) {
+		t.Errorf("limit: expected NaN above max, got %v", v)
+	}
+	if v := ds.limit(100); v != 100 {
+		t.Errorf("limit: expected max itself to be valid, got %v", v)
+	}
+
+	// a counter reset is a huge rate, which max turns into NaN
+	ds.ProcessDataPoint(1000, time.Unix(1000, 0))
+	ds.ProcessDataPoint(10, time.Unix(1010, 0))
+	if v := ds.rras[0].DPs()[SlotIndex(time.Unix(1010, 0), 10*time.Second, 10)]; !math.IsNaN(v) {
+		t.Errorf("ProcessDataPoint: expected a counter reset to be NaN, got %v", v)
+	}
+
+	// only a max, NaN min
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Min: math.NaN(), Max: 0,
+		RRAs: []RRASpec{{Step: 10 * time.Second, Span: 100 * time.Second}}})
+	if v := ds.limit(-1); v != -1 {
+		t.Errorf("limit: expected -1 with no min, got %v", v)
+	}
+	if v := ds.limit(1); !math.IsNaN(v) {
+		t.Errorf("limit: expected NaN above a max of 0, got %v", v)
+	}
+	if cpy := ds.Copy(); !math.IsNaN(cpy.(*DataSource).min) || cpy.(*DataSource).max != 0 {
+		t.Errorf("Copy: limits not copied")
+	}
+}
+
+func Test_DataSource_ProcessLateDataPoint(t *testing.T) {
+
+	ds := &DataSource{step: 10 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{cf: MAX, step: 10 * time.Second, size: 10},
+		&RoundRobinArchive{step: 60 * time.Second, size: 10},
+	})
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	ds.ProcessDataPoint(1, time.Unix(1100, 0))
+	ds.ProcessDataPoint(1, time.Unix(1105, 0))
+
+	if err := ds.ProcessLateDataPoint(3, time.Unix(1075, 0)); err != nil {
+		t.Errorf("ProcessLateDataPoint: %v", err)
+	}
+	if v := ds.rras[0].DPs()[SlotIndex(time.Unix(1080, 0), 10*time.Second, 10)]; v != 3 {
+		t.Errorf("ProcessLateDataPoint: expected 3, got %v", v)
+	}
+	// a known WMEAN slot keeps its value
+	if v := ds.rras[1].DPs()[SlotIndex(time.Unix(1080, 0), 60*time.Second, 10)]; v != 1 {
+		t.Errorf("ProcessLateDataPoint: WMEAN: expected 1, got %v", v)
+	}
+	if !ds.lastUpdate.Equal(time.Unix(1105, 0)) || ds.duration != 5*time.Second {
+		t.Errorf("ProcessLateDataPoint: last update and PDP should not change")
+	}
+
+	// the 60s slot ending at 1140 is not complete
+	if err := ds.ProcessLateDataPoint(3, time.Unix(1103, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: no error on a point in an incomplete slot")
+	}
+	if err := ds.ProcessLateDataPoint(3, time.Unix(1105, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: no error on a point that is not late")
+	}
+	if err := ds.ProcessLateDataPoint(math.Inf(1), time.Unix(1075, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: no error on Inf value")
+	}
+	if err := ds.ProcessLateDataPoint(3, time.Unix(100, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: no error on a point beyond all RRAs")
+	}
+
+	// flushed slots are not touched
+	ds.ClearRRAs()
+	if err := ds.ProcessLateDataPoint(5, time.Unix(1075, 0)); err == nil {
+		t.Errorf("ProcessLateDataPoint: no error on a point in a flushed slot")
+	}
+	if len(ds.rras[0].DPs()) != 0 {
+		t.Errorf("ProcessLateDataPoint: a flushed slot should not be written again: %v", ds.rras[0].DPs())
+	}
+}
+
 func Test_DataSource_ClearRRAs(t *testing.T) {
 
 	ds := &DataSource{step: 10 * time.Second}
@@ -303,3 +439,28 @@ func Test_DataSource_Copy(t *testing.T) {
 		t.Errorf("Copy: !reflect.DeepEqual(ds, cpy)")
 	}
 }
+
+func Test_DataSource_subSecond(t *testing.T) {
+	step := 100 * time.Millisecond
+	ds := NewDataSource(DSSpec{Step: step,
+		RRAs: []RRASpec{{Step: step, Span: 10 * step}}})
+
+	// the first data point only sets the last update
+	start := time.Unix(1000, 0)
+	ds.ProcessDataPoint(0, start)
+	for i := 1; i <= 3; i++ {
+		ds.ProcessDataPoint(float64(i), start.Add(time.Duration(i)*step))
+	}
+	ds.ProcessDataPoint(4, start.Add(4*step+5*time.Millisecond))
+
+	rra := ds.rras[0]
+	for i := 1; i <= 4; i++ {
+		ts := start.Add(time.Duration(i) * step)
+		if v := rra.DPs()[SlotIndex(ts, step, 10)]; v != float64(i) {
+			t.Errorf("sub-second slot %d: expected %v, got %v", i, float64(i), v)
+		}
+	}
+	if !rra.Latest().Equal(start.Add(4 * step)) {
+		t.Errorf("Latest: expected %v, got %v", start.Add(4*step), rra.Latest())
+	}
+}
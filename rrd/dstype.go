@@ -0,0 +1,102 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// DSType is how the values given to ProcessDataPoint are
+// interpreted, as in RRDTool.
+type DSType int
+
+const (
+	// The value is stored as is (e.g. temperature).
+	GAUGE DSType = iota
+	// The value is a counter which only increases, the rate of
+	// change (per second) is stored. A decrease is considered a
+	// wrap of a 32 bit counter, or a 64 bit one if the previous
+	// value does not fit in 32 bits.
+	COUNTER
+	// Like COUNTER, but it can decrease (the rate is negative) and
+	// never wraps.
+	DERIVE
+	// The value is a count since the previous data point (i.e. a
+	// counter which is reset every time it is read), the rate
+	// (per second) is stored.
+	ABSOLUTE
+)
+
+func (t DSType) String() string {
+	switch t {
+	case GAUGE:
+		return "GAUGE"
+	case COUNTER:
+		return "COUNTER"
+	case DERIVE:
+		return "DERIVE"
+	case ABSOLUTE:
+		return "ABSOLUTE"
+	}
+	return fmt.Sprintf("DSType(%d)", int(t))
+}
+
+// ParseDSType returns the DSType by its (case insensitive) name. An
+// empty name is GAUGE.
+func ParseDSType(s string) (DSType, error) {
+	switch strings.ToUpper(s) {
+	case "", "GAUGE":
+		return GAUGE, nil
+	case "COUNTER":
+		return COUNTER, nil
+	case "DERIVE":
+		return DERIVE, nil
+	case "ABSOLUTE":
+		return ABSOLUTE, nil
+	}
+	return GAUGE, fmt.Errorf("Invalid DS type: %q (valid types: gauge, counter, derive, absolute)", s)
+}
+
+// rate converts the raw value of a data point to what is stored
+// according to the type, given the previous raw value and the time
+// elapsed since it. The result is NaN if it cannot be known, e.g. the
+// previous value is NaN or no time has elapsed.
+func (t DSType) rate(raw, lastRaw float64, elapsed time.Duration) float64 {
+	if t == GAUGE {
+		return raw
+	}
+	secs := elapsed.Seconds()
+	if secs <= 0 || math.IsNaN(raw) {
+		return math.NaN()
+	}
+	if t == ABSOLUTE {
+		return raw / secs
+	}
+	if math.IsNaN(lastRaw) {
+		return math.NaN()
+	}
+	delta := raw - lastRaw
+	if t == COUNTER && delta < 0 {
+		delta += math.Pow(2, 32) // 32 bit wrap
+		if delta < 0 {
+			delta += math.Pow(2, 64) - math.Pow(2, 32) // 64 bit wrap
+		}
+	}
+	return delta / secs
+}
@@ -0,0 +1,72 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_DSType_ParseDSType(t *testing.T) {
+	for _, typ := range []DSType{GAUGE, COUNTER, DERIVE, ABSOLUTE} {
+		if p, err := ParseDSType(typ.String()); err != nil || p != typ {
+			t.Errorf("ParseDSType(%q): %v %v", typ, p, err)
+		}
+	}
+	if p, err := ParseDSType(""); err != nil || p != GAUGE {
+		t.Errorf("ParseDSType: empty should be GAUGE")
+	}
+	if p, err := ParseDSType("derive"); err != nil || p != DERIVE {
+		t.Errorf("ParseDSType: should not be case sensitive")
+	}
+	if _, err := ParseDSType("bogus"); err == nil {
+		t.Errorf("ParseDSType: no error on an invalid type")
+	}
+	if DSType(9).String() != "DSType(9)" {
+		t.Errorf("String: unexpected %q", DSType(9))
+	}
+}
+
+func Test_DSType_rate(t *testing.T) {
+	sec := 10 * time.Second
+	for _, c := range []struct {
+		typ          DSType
+		raw, lastRaw float64
+		elapsed      time.Duration
+		exp          float64
+	}{
+		{GAUGE, 5, 100, sec, 5},
+		{COUNTER, 200, 100, sec, 10},
+		{COUNTER, 100, math.Pow(2, 32) - 100, sec, 20}, // 32 bit wrap
+		{COUNTER, 100, math.Pow(2, 40), sec, (math.Pow(2, 64) - math.Pow(2, 40)) / 10}, // 64 bit wrap
+		{DERIVE, 100, 200, sec, -10},
+		{ABSOLUTE, 100, 12345, sec, 10},
+	} {
+		if r := c.typ.rate(c.raw, c.lastRaw, c.elapsed); math.Abs(r-c.exp) > 1e-9*math.Abs(c.exp) {
+			t.Errorf("rate(%v, %v, %v, %v): expected %v, got %v", c.typ, c.raw, c.lastRaw, c.elapsed, c.exp, r)
+		}
+	}
+	if r := COUNTER.rate(100, math.NaN(), sec); !math.IsNaN(r) {
+		t.Errorf("rate: unknown last value should be NaN, got %v", r)
+	}
+	if r := DERIVE.rate(100, 10, 0); !math.IsNaN(r) {
+		t.Errorf("rate: no time elapsed should be NaN, got %v", r)
+	}
+	if r := ABSOLUTE.rate(math.NaN(), 10, sec); !math.IsNaN(r) {
+		t.Errorf("rate: NaN should be NaN, got %v", r)
+	}
+}
@@ -0,0 +1,247 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// NullPolicy is how a query treats unknown (NaN) values, which JSON
+// has no representation for, and which consumers of it handle
+// differently. The zero value is NullAsNull.
+type NullPolicy int
+
+const (
+	NullAsNull NullPolicy = iota // unknown values stay NaN, rendered as null
+	NullAsZero                   // unknown values are 0, also when consolidating
+	NullDrop                     // unknown values are left out
+)
+
+func (p NullPolicy) String() string {
+	switch p {
+	case NullAsZero:
+		return "zero"
+	case NullDrop:
+		return "drop"
+	}
+	return "null"
+}
+
+// ParseNullPolicy parses "null", "zero" or "drop", blank means
+// NullAsNull.
+func ParseNullPolicy(s string) (NullPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "null":
+		return NullAsNull, nil
+	case "zero":
+		return NullAsZero, nil
+	case "drop":
+		return NullDrop, nil
+	}
+	return NullAsNull, fmt.Errorf("invalid null policy: %q, expecting null, zero or drop", s)
+}
+
+// Apply returns the value v should be presented as, and false if it
+// should be left out.
+func (p NullPolicy) Apply(v float64) (float64, bool) {
+	if !math.IsNaN(v) {
+		return v, true
+	}
+	switch p {
+	case NullAsZero:
+		return 0, true
+	case NullDrop:
+		return v, false
+	}
+	return v, true
+}
+
+// AlignedSeries is what FetchSeries returns: evenly spaced values,
+// each of which is for the Step long interval that ends on its time
+// (see Time), same as the slots of an RRA. Unknown values are NaN.
+type AlignedSeries struct {
+	Start  time.Time // end of the interval of the first value
+	Step   time.Duration
+	CF     Consolidation
+	Values []float64
+}
+
+// Time returns the time on which the interval of the i-th value ends.
+func (s *AlignedSeries) Time(i int) time.Time {
+	return s.Start.Add(time.Duration(i) * s.Step)
+}
+
+// Len returns the number of values.
+func (s *AlignedSeries) Len() int {
+	return len(s.Values)
+}
+
+// FetchSeries returns the data of ds between from and to (both
+// inclusive, a zero time means as far as there is data) consolidated
+// by cf. Of the RRAs with the cf consolidation function, it uses the
+// one that best matches the time range and maxPoints (see
+// DataSource.BestRRA). If the range has more than maxPoints slots,
+// they are grouped into fewer, longer intervals, aligned on multiples
+// of their step, so that the result does not shift as time goes by,
+// and consolidated by cf, e.g. MAX is the maximum of the group. A
+// maxPoints of 0 means no limit.
+//
+// FetchSeries works with the data points the RRAs hold, which for a
+// DS from a database is only those not yet flushed. To query all of
+// them, load them first, e.g. with serde.DataPointFetcher.
+func FetchSeries(ds DataSourcer, from, to time.Time, maxPoints int64, cf Consolidation) (*AlignedSeries, error) {
+	return FetchSeriesNulls(ds, from, to, maxPoints, cf, NullAsNull)
+}
+
+// FetchSeriesNulls is FetchSeries with unknown slots treated
+// according to nulls: with NullAsZero they are 0, including when
+// slots are grouped, i.e. they lower an average, otherwise they are
+// ignored when grouping and NaN in the result. Since the values of an
+// AlignedSeries are evenly spaced, dropping the NaNs (NullDrop) is up
+// to whatever presents them, see NullPolicy.Apply.
+func FetchSeriesNulls(ds DataSourcer, from, to time.Time, maxPoints int64, cf Consolidation, nulls NullPolicy) (*AlignedSeries, error) {
+	if maxPoints < 0 {
+		return nil, fmt.Errorf("FetchSeries: maxPoints cannot be negative: %d", maxPoints)
+	}
+	var rras []RoundRobinArchiver
+	for _, rra := range ds.RRAs() {
+		if rra.Consolidation() == cf {
+			rras = append(rras, rra)
+		}
+	}
+	end := to
+	if end.IsZero() {
+		end = ds.LastUpdate()
+	}
+	rra := bestRRA(rras, from, end, maxPoints)
+	if rra == nil {
+		return nil, fmt.Errorf("FetchSeries: the DS has no %v RRA", cf)
+	}
+
+	result := &AlignedSeries{Step: rra.Step(), CF: cf}
+	latest := rra.Latest()
+	if latest.IsZero() { // never updated
+		return result, nil
+	}
+
+	// The slots (by their end) from first to last
+	step := rra.Step()
+	first, last := rra.Begins(latest), latest
+	if f := ceilTime(from, step); f.After(first) {
+		first = f
+	}
+	if !to.IsZero() && to.Before(last) {
+		last = to.Truncate(step)
+	}
+	if last.Before(first) {
+		return result, nil
+	}
+
+	// The number of slots per group, if the slots need grouping
+	n := int64(last.Sub(first)/step) + 1
+	k := int64(1)
+	if maxPoints > 0 && n > maxPoints {
+		k = (n + maxPoints - 1) / maxPoints
+		// Aligning the groups can add one at either end
+		for groupCount(first, last, step*time.Duration(k)) > maxPoints {
+			k++
+		}
+	}
+	groupBy := step * time.Duration(k)
+
+	result.Step = groupBy
+	result.Start = ceilTime(first, groupBy)
+	result.Values = make([]float64, groupCount(first, last, groupBy))
+	aggs := make([]aggregate, len(result.Values))
+
+	dps := rra.DPs()
+	for t := first; !t.After(last); t = t.Add(step) {
+		v, ok := dps[SlotIndex(t, step, rra.Size())]
+		if !ok {
+			v = math.NaN()
+		}
+		if nulls == NullAsZero {
+			v, _ = nulls.Apply(v)
+		}
+		i := int(ceilTime(t, groupBy).Sub(result.Start) / groupBy)
+		aggs[i].add(v)
+	}
+	for i := range aggs {
+		result.Values[i] = aggs[i].value(cf)
+	}
+	return result, nil
+}
+
+// ceilTime returns the smallest multiple of d which is not before t.
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	c := t.Truncate(d)
+	if c.Before(t) {
+		c = c.Add(d)
+	}
+	return c
+}
+
+// groupCount returns how many intervals of length d, aligned on
+// multiples of d, cover the slots ending between first and last.
+func groupCount(first, last time.Time, d time.Duration) int64 {
+	return int64(ceilTime(last, d).Sub(ceilTime(first, d))/d) + 1
+}
+
+// aggregate consolidates the data points of a group, the same way
+// the database does (see serde groupByAggregates), NaNs are ignored.
+type aggregate struct {
+	n                    int
+	sum, sumSq, min, max float64
+	last                 float64
+}
+
+func (a *aggregate) add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.n++
+	a.sum += v
+	a.sumSq += v * v
+	a.last = v
+}
+
+func (a *aggregate) value(cf Consolidation) float64 {
+	if a.n == 0 {
+		return math.NaN()
+	}
+	switch cf {
+	case MAX:
+		return a.max
+	case MIN:
+		return a.min
+	case LAST:
+		return a.last
+	case SUM:
+		return a.sum
+	case STDDEV:
+		return math.Sqrt(a.sumSq / float64(a.n))
+	}
+	return a.sum / float64(a.n) // WMEAN
+}
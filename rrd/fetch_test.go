@@ -0,0 +1,134 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_FetchSeries(t *testing.T) {
+	step := 10 * time.Second
+	latest := time.Unix(1100, 0)
+	dps := make(map[int64]float64)
+	for ts := int64(1010); ts <= 1100; ts += 10 {
+		if ts != 1050 { // a gap
+			dps[SlotIndex(time.Unix(ts, 0), step, 10)] = float64(ts - 1000)
+		}
+	}
+	ds := NewDataSource(DSSpec{
+		Step:       step,
+		LastUpdate: latest,
+		RRAs: []RRASpec{
+			{Function: WMEAN, Step: step, Span: 10 * step, Latest: latest, DPs: dps},
+			{Function: MAX, Step: step, Span: 10 * step, Latest: latest, DPs: dps},
+		},
+	})
+
+	// everything
+	s, err := FetchSeries(ds, time.Time{}, time.Time{}, 0, WMEAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 10 || !s.Time(0).Equal(time.Unix(1010, 0)) || s.Step != step || s.Values[0] != 10 || !math.IsNaN(s.Values[4]) || s.Values[9] != 100 {
+		t.Errorf("FetchSeries: unexpected result: %v %v %v", s.Start, s.Step, s.Values)
+	}
+
+	// a range, in the middle of slots
+	s, _ = FetchSeries(ds, time.Unix(1025, 0), time.Unix(1065, 0), 0, WMEAN)
+	if s.Len() != 4 || !s.Time(0).Equal(time.Unix(1030, 0)) || s.Values[0] != 30 || s.Values[3] != 60 {
+		t.Errorf("FetchSeries: unexpected result for a range: %v %v", s.Start, s.Values)
+	}
+
+	// grouped into 30s intervals: 1010..1020 | 1030..1050 | 1060..1080 | 1090..1100
+	s, _ = FetchSeries(ds, time.Time{}, time.Time{}, 4, MAX)
+	expect := []float64{20, 40, 80, 100}
+	if s.Step != 30*time.Second || !s.Start.Equal(time.Unix(1020, 0)) || len(s.Values) != len(expect) {
+		t.Fatalf("FetchSeries: unexpected grouping: %v %v %v", s.Start, s.Step, s.Values)
+	}
+	for i, v := range expect {
+		if s.Values[i] != v {
+			t.Errorf("FetchSeries: MAX of group %d: expected %v, got %v", i, v, s.Values[i])
+		}
+	}
+	s, _ = FetchSeries(ds, time.Time{}, time.Time{}, 4, WMEAN)
+	if s.Values[1] != 35 { // the mean of 30 and 40, the gap is ignored
+		t.Errorf("FetchSeries: WMEAN of group 1: expected 35, got %v", s.Values[1])
+	}
+
+	// errors and empty results
+	if _, err := FetchSeries(ds, time.Time{}, time.Time{}, 0, MIN); err == nil {
+		t.Errorf("FetchSeries: expected an error without a MIN RRA")
+	}
+	if _, err := FetchSeries(ds, time.Time{}, time.Time{}, -1, WMEAN); err == nil {
+		t.Errorf("FetchSeries: expected an error for a negative maxPoints")
+	}
+	if s, err := FetchSeries(ds, time.Unix(2000, 0), time.Time{}, 0, WMEAN); err != nil || s.Len() != 0 {
+		t.Errorf("FetchSeries: expected nothing after latest, got %v %v", s, err)
+	}
+}
+
+func Test_FetchSeriesNulls(t *testing.T) {
+	step := 10 * time.Second
+	latest := time.Unix(1060, 0)
+	slot := func(ts int64) int64 { return SlotIndex(time.Unix(ts, 0), step, 6) }
+	ds := NewDataSource(DSSpec{
+		Step:       step,
+		LastUpdate: latest,
+		RRAs: []RRASpec{{Function: WMEAN, Step: step, Span: 6 * step, Latest: latest,
+			DPs: map[int64]float64{slot(1010): 10, slot(1020): math.NaN(), slot(1040): 40, slot(1060): 60}}},
+	})
+
+	s, _ := FetchSeriesNulls(ds, time.Time{}, time.Time{}, 0, WMEAN, NullAsZero)
+	for i, v := range []float64{10, 0, 0, 40, 0, 60} {
+		if s.Values[i] != v {
+			t.Errorf("FetchSeriesNulls: zero: value %d: expected %v, got %v", i, v, s.Values[i])
+		}
+	}
+	// grouped by 20s: 1010..1020 | 1030..1040 | 1050..1060
+	s, _ = FetchSeriesNulls(ds, time.Time{}, time.Time{}, 3, WMEAN, NullAsZero)
+	if len(s.Values) != 3 || s.Values[0] != 5 || s.Values[1] != 20 || s.Values[2] != 30 {
+		t.Errorf("FetchSeriesNulls: zero: unknowns should count when grouping, got %v", s.Values)
+	}
+	s, _ = FetchSeriesNulls(ds, time.Time{}, time.Time{}, 3, WMEAN, NullDrop)
+	if len(s.Values) != 3 || s.Values[0] != 10 || s.Values[1] != 40 || s.Values[2] != 60 {
+		t.Errorf("FetchSeriesNulls: drop: unknowns should be ignored when grouping, got %v", s.Values)
+	}
+}
+
+func Test_NullPolicy(t *testing.T) {
+	for _, p := range []NullPolicy{NullAsNull, NullAsZero, NullDrop} {
+		if pp, err := ParseNullPolicy(p.String()); err != nil || pp != p {
+			t.Errorf("ParseNullPolicy(%q): %v %v", p.String(), pp, err)
+		}
+	}
+	if _, err := ParseNullPolicy("none"); err == nil {
+		t.Errorf("ParseNullPolicy: expected an error")
+	}
+	if v, ok := NullAsNull.Apply(math.NaN()); !ok || !math.IsNaN(v) {
+		t.Errorf("Apply: null should keep NaN")
+	}
+	if v, ok := NullAsZero.Apply(math.NaN()); !ok || v != 0 {
+		t.Errorf("Apply: zero should make NaN 0")
+	}
+	if _, ok := NullDrop.Apply(math.NaN()); ok {
+		t.Errorf("Apply: drop should leave NaN out")
+	}
+	if v, ok := NullDrop.Apply(1); !ok || v != 1 {
+		t.Errorf("Apply: known values should be unchanged")
+	}
+}
@@ -0,0 +1,203 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// MergePolicy is which value a slot gets when it is known in both of
+// the RRAs being merged, see MergeRRA.
+type MergePolicy int
+
+const (
+	MergeKeep    MergePolicy = iota // The value of the destination (the default)
+	MergeReplace                    // The value of the source
+	MergeMin                        // The lesser of the two
+	MergeMax                        // The greater of the two
+	MergeSum                        // The sum of the two
+	MergeMean                       // The mean of the two
+)
+
+func (p MergePolicy) String() string {
+	switch p {
+	case MergeKeep:
+		return "KEEP"
+	case MergeReplace:
+		return "REPLACE"
+	case MergeMin:
+		return "MIN"
+	case MergeMax:
+		return "MAX"
+	case MergeSum:
+		return "SUM"
+	case MergeMean:
+		return "MEAN"
+	}
+	return fmt.Sprintf("MergePolicy(%d)", int(p))
+}
+
+// ParseMergePolicy returns the MergePolicy by its (case insensitive)
+// name. An empty name is MergeKeep.
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	switch strings.ToUpper(s) {
+	case "", "KEEP":
+		return MergeKeep, nil
+	case "REPLACE":
+		return MergeReplace, nil
+	case "MIN":
+		return MergeMin, nil
+	case "MAX":
+		return MergeMax, nil
+	case "SUM":
+		return MergeSum, nil
+	case "MEAN":
+		return MergeMean, nil
+	}
+	return MergeKeep, fmt.Errorf("Invalid merge policy: %q (valid: keep, replace, min, max, sum, mean)", s)
+}
+
+func (p MergePolicy) merge(dst, src float64) float64 {
+	switch p {
+	case MergeReplace:
+		return src
+	case MergeMin:
+		return math.Min(dst, src)
+	case MergeMax:
+		return math.Max(dst, src)
+	case MergeSum:
+		return dst + src
+	case MergeMean:
+		return (dst + src) / 2
+	}
+	return dst
+}
+
+// MergeRRA returns a copy of dst with the slots of src (typically
+// all the RRAs of another DS, which need not have the same steps)
+// merged in. The slots of src are resampled into those of dst first
+// (see Resample). A slot which is known in only one of them gets that
+// value, one which is known in both is resolved by policy. The result
+// ends at the later of the two, and takes its PDP state if it is dst
+// or a src RRA with the same step and consolidation function.
+func MergeRRA(dst RoundRobinArchiver, src []RoundRobinArchiver, policy MergePolicy) *RoundRobinArchive {
+	spec := RRASpec{
+		Function: dst.Consolidation(),
+		Step:     dst.Step(),
+		Span:     dst.Step() * time.Duration(dst.Size()),
+		Xff:      dst.Xff(),
+		RoundTo:  dst.RoundTo(),
+		GapFill:  dst.GapFill(),
+	}
+	// Slots which src does not know must not be filled (with 0 for
+	// an xff of 0, or according to the gap fill), or they would be
+	// merged as if they were known.
+	rspec := spec
+	rspec.GapFill = GapNaN
+	if rspec.Xff == 0 {
+		rspec.Xff = math.SmallestNonzeroFloat32
+	}
+	other := Resample(rspec, src)
+
+	// Resample leaves the PDP out, but a src RRA like dst has one
+	state := dst
+	if other.Latest().After(dst.Latest()) {
+		state = other
+		for _, rra := range src {
+			if rra.Step() == dst.Step() && rra.Consolidation() == dst.Consolidation() && rra.Latest().Equal(other.Latest()) {
+				state = rra
+				break
+			}
+		}
+	}
+	spec.Latest, spec.Value, spec.Variance, spec.Duration = state.Latest(), state.Value(), state.Variance(), state.Duration()
+	spec.LastKnownAt, spec.LastKnown = state.LastKnown()
+	if spec.Latest.IsZero() || dst.Size() == 0 {
+		return NewRoundRobinArchive(spec)
+	}
+
+	known := func(rra RoundRobinArchiver) map[int64]float64 {
+		result := make(map[int64]float64, rra.PointCount())
+		it := NewSlotIterator(rra)
+		for it.Next() {
+			if v := it.Value(); !math.IsNaN(v) {
+				result[it.Time().UnixNano()] = v
+			}
+		}
+		return result
+	}
+	dv, sv := known(dst), known(other)
+
+	spec.DPs = make(map[int64]float64, len(dv)+len(sv))
+	oldest := spec.Latest.Add(-time.Duration(dst.Size()-1) * spec.Step)
+	for t := oldest; !t.After(spec.Latest); t = t.Add(spec.Step) {
+		d, dok := dv[t.UnixNano()]
+		s, sok := sv[t.UnixNano()]
+		var v float64
+		switch {
+		case dok && sok:
+			v = policy.merge(d, s)
+		case dok:
+			v = d
+		case sok:
+			v = s
+		default:
+			continue
+		}
+		spec.DPs[SlotIndex(t, spec.Step, dst.Size())] = v
+	}
+	return NewRoundRobinArchive(spec)
+}
+
+// MergeDataSource returns a new DS like dst, with the RRAs of src
+// merged into its RRAs (see MergeRRA). If src was updated last, the
+// result takes its last update, and its PDP if the steps are the
+// same.
+func MergeDataSource(dst, src DataSourcer, policy MergePolicy) *DataSource {
+	spec := DSSpec{
+		Step:       dst.Step(),
+		Heartbeat:  dst.Heartbeat(),
+		Type:       dst.Type(),
+		Min:        math.NaN(),
+		Max:        math.NaN(),
+		LastUpdate: dst.LastUpdate(),
+		LastRaw:    dst.LastRaw(),
+		Value:      dst.Value(),
+		Duration:   dst.Duration(),
+	}
+	if l, ok := dst.(interface {
+		Limits() (float64, float64)
+	}); ok {
+		spec.Min, spec.Max = l.Limits()
+	}
+	if src.LastUpdate().After(dst.LastUpdate()) {
+		spec.LastUpdate, spec.LastRaw = src.LastUpdate(), src.LastRaw()
+		spec.Value, spec.Duration = 0, 0
+		if src.Step() == dst.Step() {
+			spec.Value, spec.Duration = src.Value(), src.Duration()
+		}
+	}
+	result := NewDataSource(spec)
+	rras := make([]RoundRobinArchiver, len(dst.RRAs()))
+	for n, rra := range dst.RRAs() {
+		rras[n] = MergeRRA(rra, src.RRAs(), policy)
+	}
+	result.SetRRAs(rras)
+	return result
+}
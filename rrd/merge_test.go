@@ -0,0 +1,113 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_ParseMergePolicy(t *testing.T) {
+	for _, p := range []MergePolicy{MergeKeep, MergeReplace, MergeMin, MergeMax, MergeSum, MergeMean} {
+		if pp, err := ParseMergePolicy(p.String()); err != nil || pp != p {
+			t.Errorf("ParseMergePolicy(%q): %v %v", p.String(), pp, err)
+		}
+	}
+	if p, err := ParseMergePolicy(""); err != nil || p != MergeKeep {
+		t.Errorf("ParseMergePolicy: empty should be KEEP")
+	}
+	if _, err := ParseMergePolicy("foo"); err == nil {
+		t.Errorf("ParseMergePolicy: expected an error")
+	}
+}
+
+func Test_MergeRRA(t *testing.T) {
+	step := 10 * time.Second
+	slot := func(ts int64) int64 { return SlotIndex(time.Unix(ts, 0), step, 10) }
+	dst := NewRoundRobinArchive(RRASpec{
+		Function: WMEAN, Step: step, Span: 10 * step, Latest: time.Unix(1050, 0),
+		DPs: map[int64]float64{slot(1030): 3, slot(1040): 4, slot(1050): 5},
+	})
+	// src overlaps at 1040 and 1050, and is ahead
+	src := NewRoundRobinArchive(RRASpec{
+		Function: WMEAN, Step: step, Span: 10 * step, Latest: time.Unix(1070, 0), Value: 8, Duration: step / 2,
+		DPs: map[int64]float64{slot(1010): 1, slot(1040): 40, slot(1050): 50, slot(1060): 60, slot(1070): 70},
+	})
+
+	for policy, expect := range map[MergePolicy]map[int64]float64{
+		MergeKeep:    {1010: 1, 1030: 3, 1040: 4, 1050: 5, 1060: 60, 1070: 70},
+		MergeReplace: {1010: 1, 1030: 3, 1040: 40, 1050: 50, 1060: 60, 1070: 70},
+		MergeMax:     {1010: 1, 1030: 3, 1040: 40, 1050: 50, 1060: 60, 1070: 70},
+		MergeSum:     {1010: 1, 1030: 3, 1040: 44, 1050: 55, 1060: 60, 1070: 70},
+		MergeMean:    {1010: 1, 1030: 3, 1040: 22, 1050: 27.5, 1060: 60, 1070: 70},
+	} {
+		rra := MergeRRA(dst, []RoundRobinArchiver{src}, policy)
+		if !rra.Latest().Equal(time.Unix(1070, 0)) || rra.Value() != 8 || rra.Duration() != step/2 {
+			t.Errorf("MergeRRA %v: expected the latest and PDP of src, got %v %v %v", policy, rra.Latest(), rra.Value(), rra.Duration())
+		}
+		if len(rra.DPs()) != len(expect) {
+			t.Errorf("MergeRRA %v: expected %d slots, got %d: %v", policy, len(expect), len(rra.DPs()), rra.DPs())
+		}
+		for ts, v := range expect {
+			if got := rra.DPs()[slot(ts)]; got != v {
+				t.Errorf("MergeRRA %v: slot %d: expected %v, got %v", policy, ts, v, got)
+			}
+		}
+	}
+
+	// nothing to merge
+	empty := NewRoundRobinArchive(RRASpec{Function: WMEAN, Step: step, Span: 10 * step})
+	if rra := MergeRRA(dst, []RoundRobinArchiver{empty}, MergeKeep); len(rra.DPs()) != 3 || !rra.Latest().Equal(dst.Latest()) {
+		t.Errorf("MergeRRA: merging nothing should be a copy: %v", rra.DPs())
+	}
+}
+
+func Test_MergeDataSource(t *testing.T) {
+	step := 10 * time.Second
+	spec := DSSpec{
+		Step: step,
+		Min:  0,
+		Max:  100,
+		RRAs: []RRASpec{{Function: WMEAN, Step: step, Span: 10 * step}},
+	}
+	dst, src := NewDataSource(spec), NewDataSource(spec)
+	for ts := int64(1000); ts <= 1030; ts += 10 {
+		dst.ProcessDataPoint(1, time.Unix(ts, 0))
+	}
+	for ts := int64(1020); ts <= 1055; ts += 5 {
+		src.ProcessDataPoint(2, time.Unix(ts, 0))
+	}
+
+	ds := MergeDataSource(dst, src, MergeKeep)
+	if !ds.LastUpdate().Equal(time.Unix(1055, 0)) || ds.Value() != 2 || ds.Duration() != 5*time.Second {
+		t.Errorf("MergeDataSource: expected the last update and PDP of src: %v %v %v", ds.LastUpdate(), ds.Value(), ds.Duration())
+	}
+	if min, max := ds.Limits(); min != 0 || max != 100 {
+		t.Errorf("MergeDataSource: limits not kept: %v %v", min, max)
+	}
+	it := NewSlotIterator(ds.RRAs()[0])
+	expect := map[int64]float64{1010: 1, 1020: 1, 1030: 1, 1040: 2, 1050: 2}
+	for it.Next() {
+		v, ok := expect[it.Time().Unix()]
+		if !ok {
+			v = math.NaN()
+		}
+		if it.Value() != v && !(math.IsNaN(v) && math.IsNaN(it.Value())) {
+			t.Errorf("MergeDataSource: slot %d: expected %v, got %v", it.Time().Unix(), v, it.Value())
+		}
+	}
+}
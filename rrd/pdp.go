@@ -140,6 +140,21 @@ func (p *Pdp) AddValueLast(val float64, dur time.Duration) {
 	}
 }
 
+// AddValueSum adds val multiplied by the number of seconds in span,
+// i.e. the integral of val over span, which for a rate is the total
+// (e.g. bytes/s becomes bytes). dur is the known duration, as in the
+// other functions; the value is assumed to be the same over the
+// unknown part of span.
+func (p *Pdp) AddValueSum(val float64, span, dur time.Duration) {
+	if !math.IsNaN(val) && dur > 0 {
+		if math.IsNaN(p.value) || p.duration == 0 {
+			p.value = 0
+		}
+		p.value += val * span.Seconds()
+		p.duration = p.duration + dur
+	}
+}
+
 // Reset sets the value to zero value and returns the value of
 // the PDP before Reset.
 func (p *Pdp) Reset() float64 {
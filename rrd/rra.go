@@ -16,26 +16,113 @@
 package rrd
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Consolidation int
 
 const (
-	WMEAN Consolidation = iota // Time-weighted average
-	MAX                        // Max
-	MIN                        // Min
-	LAST                       // Last
+	WMEAN  Consolidation = iota // Time-weighted average
+	MAX                         // Max
+	MIN                         // Min
+	LAST                        // Last
+	SUM                         // Sum of value × seconds, i.e. the total of a rate
+	STDDEV                      // Time-weighted (population) standard deviation
 )
 
+func (c Consolidation) String() string {
+	switch c {
+	case WMEAN:
+		return "WMEAN"
+	case MAX:
+		return "MAX"
+	case MIN:
+		return "MIN"
+	case LAST:
+		return "LAST"
+	case SUM:
+		return "SUM"
+	case STDDEV:
+		return "STDDEV"
+	}
+	return fmt.Sprintf("Consolidation(%d)", int(c))
+}
+
+// ParseConsolidation returns the Consolidation by its (case
+// insensitive) name.
+func ParseConsolidation(s string) (Consolidation, error) {
+	switch strings.ToUpper(s) {
+	case "WMEAN":
+		return WMEAN, nil
+	case "MAX":
+		return MAX, nil
+	case "MIN":
+		return MIN, nil
+	case "LAST":
+		return LAST, nil
+	case "SUM":
+		return SUM, nil
+	case "STDDEV":
+		return STDDEV, nil
+	}
+	return WMEAN, fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last, sum, stddev)", s)
+}
+
+// GapFill is what an RRA stores in a slot which is unknown, i.e. for
+// which there was no data or not enough of it (see xff).
+type GapFill int
+
+const (
+	GapNaN      GapFill = iota // NaN, i.e. unknown (the default)
+	GapZero                    // 0
+	GapPrevious                // The last known value
+	GapLinear                  // Linear interpolation between the known values on either side
+)
+
+func (g GapFill) String() string {
+	switch g {
+	case GapNaN:
+		return "NAN"
+	case GapZero:
+		return "ZERO"
+	case GapPrevious:
+		return "PREVIOUS"
+	case GapLinear:
+		return "LINEAR"
+	}
+	return fmt.Sprintf("GapFill(%d)", int(g))
+}
+
+// ParseGapFill returns the GapFill by its (case insensitive) name. An
+// empty name is GapNaN.
+func ParseGapFill(s string) (GapFill, error) {
+	switch strings.ToUpper(s) {
+	case "", "NAN":
+		return GapNaN, nil
+	case "ZERO":
+		return GapZero, nil
+	case "PREVIOUS":
+		return GapPrevious, nil
+	case "LINEAR":
+		return GapLinear, nil
+	}
+	return GapNaN, fmt.Errorf("Invalid gap fill: %q (valid: nan, zero, previous, linear)", s)
+}
+
 // A Round Robin Archive and all its parameters.
 type RoundRobinArchive struct {
 	Pdp
 	// Consolidation function (CF). How data points from a
 	// higher-resolution RRA are aggregated into a lower-resolution
-	// one. Must be WMEAN, MAX, MIN, LAST.
+	// one. Must be WMEAN, MAX, MIN, LAST, SUM or STDDEV.
 	cf Consolidation
+	// For STDDEV, the variance of the PDP (whose value is then the
+	// mean).
+	variance float64
 	// The RRA step
 	step time.Duration
 	// Number of data points in the RRA.
@@ -57,6 +144,15 @@ type RoundRobinArchive struct {
 	// then NaN a 0 weight, and thus simply ignores it, not
 	// contradicting any rules.
 	xff float32
+	// What to store in a slot which is unknown.
+	gapFill GapFill
+	// The most recent known slot (value and end time). This is what
+	// GapPrevious fills with, and where GapLinear interpolates from.
+	lastKnown   float64
+	lastKnownAt time.Time
+	// If not zero, consolidated values are rounded to the nearest
+	// multiple of roundTo, e.g. 0.01 to keep cents. See RRASpec.
+	roundTo float64
 
 	// The list of data points (as a map so that it's sparse). Slots in
 	// dps are time-aligned starting at zero time. This means that if
@@ -82,8 +178,14 @@ type RoundRobinArchiver interface {
 	Size() int64
 	Start() int64
 	End() int64
+	RoundTo() float64
+	Xff() float32
 	PointCount() int
 	DPs() map[int64]float64
+	Consolidation() Consolidation
+	Variance() float64
+	GapFill() GapFill
+	LastKnown() (time.Time, float64)
 	Copy() RoundRobinArchiver
 	Begins(now time.Time) time.Time
 
@@ -92,6 +194,7 @@ type RoundRobinArchiver interface {
 	clear()
 	includes(t time.Time) bool
 	update(periodBegin, periodEnd time.Time, value float64, duration time.Duration)
+	updateLate(t time.Time, value float64) bool
 }
 
 // Latest returns the time on which the last slot ends.
@@ -110,23 +213,54 @@ func (rra *RoundRobinArchive) Start() int64 { return rra.start }
 // end to be less than start when the RRD wraps around.
 func (rra *RoundRobinArchive) End() int64 { return rra.end }
 
+// RoundTo returns the rounding quantum of this RRA, 0 means no
+// rounding.
+func (rra *RoundRobinArchive) RoundTo() float64 { return rra.roundTo }
+
+// Xff returns the fraction of a slot which must be known for it to
+// be known.
+func (rra *RoundRobinArchive) Xff() float32 { return rra.xff }
+
 // Dps returns data points as a map of floats. It's a map rather than
 // a slice to be more space-efficient for sparse series.
 func (rra *RoundRobinArchive) DPs() map[int64]float64 { return rra.dps }
 
+// Consolidation function of this RRA.
+func (rra *RoundRobinArchive) Consolidation() Consolidation { return rra.cf }
+
+// Variance of the current (partial) PDP of a STDDEV RRA, 0 for other
+// functions.
+func (rra *RoundRobinArchive) Variance() float64 { return rra.variance }
+
+// GapFill policy of this RRA.
+func (rra *RoundRobinArchive) GapFill() GapFill { return rra.gapFill }
+
+// LastKnown returns the end time and the value of the most recent
+// known slot. The time is zero if there has not been one.
+func (rra *RoundRobinArchive) LastKnown() (time.Time, float64) { return rra.lastKnownAt, rra.lastKnown }
+
 // Returns a new RRA in accordance with the provided RRASpec.
 func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 	result := &RoundRobinArchive{
-		step:   spec.Step,
-		size:   spec.Span.Nanoseconds() / spec.Step.Nanoseconds(),
-		xff:    spec.Xff,
-		latest: spec.Latest,
+		step:    spec.Step,
+		size:    spec.Span.Nanoseconds() / spec.Step.Nanoseconds(),
+		cf:      spec.Function,
+		xff:     spec.Xff,
+		roundTo: spec.RoundTo,
+		gapFill: spec.GapFill,
+		latest:  spec.Latest,
 		Pdp: Pdp{
 			value:    spec.Value,
 			duration: spec.Duration,
 		},
 		dps: make(map[int64]float64),
 	}
+	if !spec.LastKnownAt.IsZero() {
+		result.lastKnown, result.lastKnownAt = spec.LastKnown, spec.LastKnownAt
+	}
+	if spec.Function == STDDEV && !math.IsNaN(spec.Variance) {
+		result.variance = spec.Variance
+	}
 	if len(spec.DPs) > 0 {
 		result.dps = spec.DPs
 		result.start, result.end = computeStartEnd(result.dps, result.latest, result.step, result.size)
@@ -137,15 +271,20 @@ func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 // Returns a complete copy of the RRA.
 func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 	new_rra := &RoundRobinArchive{
-		Pdp:    Pdp{value: rra.value, duration: rra.duration},
-		cf:     rra.cf,
-		step:   rra.step,
-		size:   rra.size,
-		latest: rra.latest,
-		xff:    rra.xff,
-		start:  rra.start,
-		end:    rra.end,
-		dps:    make(map[int64]float64, len(rra.dps)),
+		Pdp:         Pdp{value: rra.value, duration: rra.duration},
+		cf:          rra.cf,
+		variance:    rra.variance,
+		step:        rra.step,
+		size:        rra.size,
+		latest:      rra.latest,
+		xff:         rra.xff,
+		roundTo:     rra.roundTo,
+		gapFill:     rra.gapFill,
+		lastKnown:   rra.lastKnown,
+		lastKnownAt: rra.lastKnownAt,
+		start:       rra.start,
+		end:         rra.end,
+		dps:         make(map[int64]float64, len(rra.dps)),
 	}
 	for k, v := range rra.dps {
 		new_rra.dps[k] = v
@@ -209,6 +348,10 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 			rra.AddValueMin(value, duration)
 		case LAST:
 			rra.AddValueLast(value, duration)
+		case SUM:
+			rra.AddValueSum(value, currentEnd.Sub(currentBegin), duration)
+		case STDDEV:
+			rra.addValueStddev(value, duration)
 		}
 
 		// if end of slot, move PDP into its place in dps.
@@ -221,8 +364,71 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 	}
 }
 
+// updateLate puts a value for time t, which is before latest, into
+// the slot which t belongs to. Only slots still in dps (i.e. not
+// flushed yet) can be updated, because a flushed slot is not here to
+// be combined with and writing it again would overwrite the stored
+// value. The value is combined with what is in the slot according to
+// the consolidation function: MAX and MIN as usual, LAST keeps the
+// (later) value that is there. A WMEAN slot only takes a late value
+// if it is unknown (NaN), since the weight of the existing value is
+// not known, a known mean is left as is. It returns false if the
+// value was not placed, because the slot is not complete yet, is no
+// longer within the RRA, has been flushed or (WMEAN) is known, or if
+// the RRA is SUM or STDDEV, which cannot be corrected without the
+// weight of the value.
+func (rra *RoundRobinArchive) updateLate(t time.Time, value float64) bool {
+	if rra.cf == SUM || rra.cf == STDDEV {
+		return false
+	}
+	endOfSlot := t.Truncate(rra.step)
+	if !endOfSlot.Equal(t) {
+		endOfSlot = endOfSlot.Add(rra.step)
+	}
+	if rra.size == 0 || !rra.includes(endOfSlot) {
+		return false
+	}
+
+	slotN := SlotIndex(endOfSlot, rra.step, rra.size)
+	old, ok := rra.dps[slotN]
+	if !ok {
+		return false // flushed (or never there)
+	}
+	if math.IsNaN(value) {
+		return true // NaN does not replace anything
+	}
+	if !math.IsNaN(old) {
+		switch rra.cf {
+		case WMEAN:
+			return false
+		case MAX:
+			value = math.Max(old, value)
+		case MIN:
+			value = math.Min(old, value)
+		case LAST:
+			value = old
+		}
+	}
+
+	rra.dps[slotN] = roundValue(value, rra.roundTo)
+
+	return true
+}
+
+// putEarlier stores value in slot slotN, which is before latest,
+// moving start if the slot is before it.
+func (rra *RoundRobinArchive) putEarlier(slotN int64, value float64) {
+	if len(rra.dps) == 0 {
+		rra.start = slotN
+		rra.end = SlotIndex(rra.latest, rra.step, rra.size)
+	} else if IndexDistance(slotN, rra.end, rra.size) > IndexDistance(rra.start, rra.end, rra.size) {
+		rra.start = slotN
+	}
+	rra.dps[slotN] = roundValue(value, rra.roundTo)
+}
+
 // movePdpToDps moves the PDP into its proper slot in the dps map and
-// resets the PDP.
+// resets the PDP. An unknown slot is filled according to gapFill.
 func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
 	// Check XFF
 	known := float64(rra.duration) / float64(rra.step)
@@ -234,9 +440,18 @@ func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
 		rra.dps = make(map[int64]float64)
 	}
 
+	value := rra.value
+	if rra.cf == STDDEV && rra.duration > 0 {
+		value = math.Sqrt(rra.variance)
+	}
+	unknown := rra.duration == 0 || math.IsNaN(value)
+	if unknown {
+		value = rra.gapValue(value)
+	}
+
 	slotN := SlotIndex(endOfSlot, rra.step, rra.size)
 	rra.latest = endOfSlot
-	rra.dps[slotN] = rra.value
+	rra.dps[slotN] = roundValue(value, rra.roundTo)
 
 	if len(rra.dps) == 1 {
 		rra.start = slotN
@@ -245,7 +460,70 @@ func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
 	}
 	rra.end = slotN
 
+	if !unknown {
+		if rra.gapFill == GapLinear {
+			rra.interpolate(endOfSlot, value)
+		}
+		rra.lastKnown, rra.lastKnownAt = value, endOfSlot
+	}
+
 	rra.Reset()
+	rra.variance = 0
+}
+
+// gapValue returns what an unknown slot is filled with. For GapNaN
+// this is value itself. GapLinear leaves the slot NaN, it is filled
+// once the next known slot is (see interpolate).
+func (rra *RoundRobinArchive) gapValue(value float64) float64 {
+	switch rra.gapFill {
+	case GapZero:
+		return 0
+	case GapPrevious:
+		if !rra.lastKnownAt.IsZero() {
+			return rra.lastKnown
+		}
+		return math.NaN()
+	case GapLinear:
+		return math.NaN()
+	}
+	return value
+}
+
+// interpolate fills the slots between lastKnownAt and t (which is
+// known and has value) which are still in the RRA with values on the
+// line between the two.
+func (rra *RoundRobinArchive) interpolate(t time.Time, value float64) {
+	if rra.lastKnownAt.IsZero() {
+		return
+	}
+	begin := rra.lastKnownAt.Add(rra.step)
+	if b := rra.Begins(rra.latest).Add(rra.step); b.After(begin) {
+		begin = b
+	}
+	span := float64(t.Sub(rra.lastKnownAt))
+	for slot := begin; slot.Before(t); slot = slot.Add(rra.step) {
+		v := rra.lastKnown + (value-rra.lastKnown)*float64(slot.Sub(rra.lastKnownAt))/span
+		rra.putEarlier(SlotIndex(slot, rra.step, rra.size), v)
+	}
+}
+
+// addValueStddev adds a value using weighted mean (like AddValue)
+// and updates the weighted variance (West's incremental algorithm).
+func (rra *RoundRobinArchive) addValueStddev(val float64, dur time.Duration) {
+	if math.IsNaN(val) || dur <= 0 {
+		return
+	}
+	if math.IsNaN(rra.value) || rra.duration == 0 {
+		rra.value, rra.variance = val, 0
+		rra.duration = dur
+		return
+	}
+	total := float64(rra.duration + dur)
+	delta := val - rra.value
+	mean := rra.value + delta*float64(dur)/total
+	rra.variance = (rra.variance*float64(rra.duration) + float64(dur)*delta*(val-mean)) / total
+	rra.value = mean
+	rra.duration += dur
 }
 
 // clears the data in dps
@@ -278,6 +556,105 @@ func SlotTime(n int64, latest time.Time, step time.Duration, size int64) time.Ti
 	return latest.Add(time.Duration(distance*-1) * step)
 }
 
+// SlotIterator walks the slots of an RRA from the oldest (Start) to
+// the latest (End), taking care of the wraparound, so that callers
+// do not need to do their own index arithmetic. Slots for which
+// there is no data point are still visited, their value is NaN.
+//
+//	it := rrd.NewSlotIterator(rra)
+//	for it.Next() {
+//		fmt.Println(it.Time(), it.Value())
+//	}
+type SlotIterator struct {
+	dps    map[int64]float64
+	start  int64
+	size   int64
+	step   time.Duration
+	latest time.Time
+	count  int64 // total number of slots to visit
+	n      int64 // slots visited so far
+}
+
+// NewSlotIterator returns a SlotIterator for the RRA. The iterator
+// captures the RRA parameters at the time of the call, but not its
+// data points, the RRA should not be modified while iterating.
+func NewSlotIterator(rra RoundRobinArchiver) *SlotIterator {
+	it := &SlotIterator{
+		dps:    rra.DPs(),
+		start:  rra.Start(),
+		size:   rra.Size(),
+		step:   rra.Step(),
+		latest: rra.Latest(),
+	}
+	if len(it.dps) > 0 && it.size > 0 {
+		it.count = IndexDistance(it.start, rra.End(), it.size) + 1
+	}
+	return it
+}
+
+// Next advances the iterator to the next slot, it must be called
+// before the first slot can be accessed. Returns false when there
+// are no more slots.
+func (it *SlotIterator) Next() bool {
+	if it.n >= it.count {
+		return false
+	}
+	it.n++
+	return true
+}
+
+// Index of the current slot in the data points map, or -1 if Next()
+// has not been called yet.
+func (it *SlotIterator) Index() int64 {
+	if it.n == 0 {
+		return -1
+	}
+	return (it.start + it.n - 1) % it.size
+}
+
+// Time on which the current slot ends, or zero time if Next() has not
+// been called yet.
+func (it *SlotIterator) Time() time.Time {
+	if it.n == 0 {
+		return time.Time{}
+	}
+	return it.latest.Add(-time.Duration(it.count-it.n) * it.step)
+}
+
+// Value of the current slot, NaN if there is no data point.
+func (it *SlotIterator) Value() float64 {
+	if v, ok := it.dps[it.Index()]; ok {
+		return v
+	}
+	return math.NaN()
+}
+
+// Reset rewinds the iterator to before the first slot.
+func (it *SlotIterator) Reset() {
+	it.n = 0
+}
+
+// roundValue rounds v to the nearest multiple of q (half away from
+// zero). A q of 0 means no rounding. For q less than 1 the value is
+// scaled by 1/q rather than divided by q, because e.g. 1001 / 100 is
+// exactly the float64 nearest to 10.01, whereas 1001 * 0.01 is not.
+func roundValue(v, q float64) float64 {
+	if q <= 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	round := func(x float64) float64 {
+		if x < 0 {
+			return -math.Floor(-x + 0.5)
+		}
+		return math.Floor(x + 0.5)
+	}
+	if q < 1 {
+		inv := round(1 / q)
+		return round(v*inv) / inv
+	}
+	return round(v/q) * q
+}
+
 // Given a bunch of DPs and RRA params, compute the correct start, end
 func computeStartEnd(DPs map[int64]float64, latest time.Time, step time.Duration, size int64) (int64, int64) {
 	end := SlotIndex(latest, step, size)
@@ -293,6 +670,117 @@ func computeStartEnd(DPs map[int64]float64, latest time.Time, step time.Duration
 	return start, end
 }
 
+// Resample returns a new RRA as described by spec, with its slots
+// computed from the slots of src, typically the RRAs of a DS whose
+// RRA layout is being changed. Every period is taken from the finest
+// src RRA which covers it, preferring those with the same
+// consolidation function as spec, and is consolidated into (or, if
+// the src is coarser, spread across) the new slots the same way data
+// points are, i.e. according to the function, xff and gap fill of
+// spec. SUM slots are converted back to a rate first. STDDEV is the
+// deviation of the src slots rather than of the original data
+// points, thus an approximation, as is anything resampled to a finer
+// step than that of its src. The Latest, PDP and DPs of spec are
+// ignored.
+//
+// The new RRA ends at the latest src slot, any known part of the
+// slot after it remains in the PDP.
+func Resample(spec RRASpec, src []RoundRobinArchiver) *RoundRobinArchive {
+	spec.Latest, spec.Value, spec.Variance, spec.Duration = time.Time{}, 0, 0, 0
+	spec.LastKnown, spec.LastKnownAt, spec.DPs = 0, time.Time{}, nil
+	result := NewRoundRobinArchive(spec)
+
+	var (
+		srcs []RoundRobinArchiver
+		end  time.Time
+	)
+	for _, rra := range src {
+		if rra.Size() == 0 || rra.Latest().IsZero() {
+			continue
+		}
+		srcs = append(srcs, rra)
+		if rra.Latest().After(end) {
+			end = rra.Latest()
+		}
+	}
+	if len(srcs) == 0 || result.size == 0 {
+		return result
+	}
+	sort.SliceStable(srcs, func(i, j int) bool {
+		si, sj := srcs[i].Consolidation() == spec.Function, srcs[j].Consolidation() == spec.Function
+		if si != sj {
+			return si
+		}
+		return srcs[i].Step() < srcs[j].Step()
+	})
+
+	type period struct {
+		begin, end time.Time
+		value      float64
+	}
+
+	// Begins is the end of the oldest slot. Periods after covered
+	// have been taken from a preferred src.
+	var (
+		periods []period
+		begin   = result.Begins(end).Add(-result.step)
+		covered = end
+	)
+	for _, rra := range srcs {
+		step, dps := rra.Step(), rra.DPs()
+		first := rra.Begins(rra.Latest())
+		for t := first; !t.After(rra.Latest()); t = t.Add(step) {
+			pb, pe := t.Add(-step), t
+			if pe.After(covered) {
+				pe = covered
+			}
+			if pb.Before(begin) {
+				pb = begin
+			}
+			if !pb.Before(pe) {
+				continue
+			}
+			v, ok := dps[SlotIndex(t, step, rra.Size())]
+			if !ok {
+				v = math.NaN()
+			} else if rra.Consolidation() == SUM {
+				v = v / step.Seconds()
+			}
+			periods = append(periods, period{pb, pe, v})
+		}
+		if first = first.Add(-step); first.Before(covered) {
+			covered = first
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].begin.Before(periods[j].begin) })
+
+	// update() expects a period to be within a slot, or its value
+	// to be that of a whole DS step, so split at slot boundaries.
+	feed := func(b, e time.Time, value float64) {
+		for b.Before(e) {
+			pe := b.Truncate(result.step).Add(result.step)
+			if pe.After(e) {
+				pe = e
+			}
+			var dur time.Duration
+			if !math.IsNaN(value) {
+				dur = pe.Sub(b)
+			}
+			result.update(b, pe, value, dur)
+			b = pe
+		}
+	}
+	var last time.Time
+	for _, p := range periods {
+		if !last.IsZero() && p.begin.After(last) {
+			feed(last, p.begin, math.NaN()) // a gap between srcs
+		}
+		feed(p.begin, p.end, p.value)
+		last = p.end
+	}
+	return result
+}
+
 // RRASpec is the RRA definition for NewRoundRobinArchive.
 type RRASpec struct {
 	Function Consolidation
@@ -300,9 +788,25 @@ type RRASpec struct {
 	Span     time.Duration // duration of the whole series (should be multiple of step)
 	Xff      float32
 
+	// RoundTo, if not zero, causes consolidated values to be rounded
+	// to the nearest multiple of it, e.g. 0.01 for cents or 1 for
+	// whole numbers. This is meant for series (such as money) where
+	// the binary floating point drift of long averages is not
+	// acceptable. Only the value stored in the slot is rounded, not
+	// the intermediate (partial) value.
+	RoundTo float64
+
 	// These can be used to fill the initial value
 	Latest   time.Time
 	Value    float64
+	Variance float64 // STDDEV only
 	Duration time.Duration
-	DPs      map[int64]float64 // Careful, these are round-robin
+
+	// GapFill is what is stored in a slot which is unknown.
+	GapFill GapFill
+	// The most recent known slot, for GapPrevious and GapLinear (see
+	// RoundRobinArchiver LastKnown).
+	LastKnown   float64
+	LastKnownAt time.Time
+	DPs         map[int64]float64 // Careful, these are round-robin
 }
@@ -18,6 +18,7 @@ package rrd
 import (
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -330,3 +331,298 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 	}
 
 }
+
+func Test_SlotIterator(t *testing.T) {
+	step, size := 10*time.Second, int64(4)
+	latest := time.Unix(1000, 0) // slot 100 => index 0
+
+	// the RRA wraps around: start is 2, end is 0, slot 3 is missing
+	rra := NewRoundRobinArchive(RRASpec{Step: step, Span: time.Duration(size) * step,
+		Latest: latest, DPs: map[int64]float64{0: 3, 1: 99, 2: 1}})
+	rra.start, rra.end = 2, 0
+
+	it := NewSlotIterator(rra)
+	if it.Index() != -1 || !it.Time().IsZero() || !math.IsNaN(it.Value()) {
+		t.Errorf("SlotIterator: expected no current slot before Next()")
+	}
+	var (
+		idxs  []int64
+		times []int64
+		vals  []float64
+	)
+	for it.Next() {
+		idxs = append(idxs, it.Index())
+		times = append(times, it.Time().Unix())
+		vals = append(vals, it.Value())
+	}
+	if !reflect.DeepEqual(idxs, []int64{2, 3, 0}) {
+		t.Errorf("SlotIterator: unexpected indexes: %v", idxs)
+	}
+	if !reflect.DeepEqual(times, []int64{980, 990, 1000}) {
+		t.Errorf("SlotIterator: unexpected times: %v", times)
+	}
+	if vals[0] != 1 || !math.IsNaN(vals[1]) || vals[2] != 3 {
+		t.Errorf("SlotIterator: unexpected values: %v", vals)
+	}
+	for i, idx := range idxs {
+		if st := SlotTime(idx, latest, step, size).Unix(); st != times[i] {
+			t.Errorf("SlotIterator: time %d disagrees with SlotTime %d", times[i], st)
+		}
+	}
+
+	it.Reset()
+	if !it.Next() || it.Index() != 2 {
+		t.Errorf("SlotIterator: Reset did not rewind")
+	}
+
+	if NewSlotIterator(NewRoundRobinArchive(RRASpec{Step: step, Span: time.Duration(size) * step})).Next() {
+		t.Errorf("SlotIterator: empty RRA should have no slots")
+	}
+}
+
+func Test_RoundRobinArchive_roundTo(t *testing.T) {
+	for _, c := range []struct{ v, q, exp float64 }{
+		{10.006666666666666, 0.01, 10.01},
+		{-10.005, 0.01, -10.01},
+		{0.1 + 0.2, 0.1, 0.3},
+		{1234.5, 1, 1235},
+		{1234.5, 0, 1234.5},
+		{17, 5, 15},
+	} {
+		if r := roundValue(c.v, c.q); r != c.exp {
+			t.Errorf("roundValue(%v, %v): expected %v, got %v", c.v, c.q, c.exp, r)
+		}
+	}
+	if !math.IsNaN(roundValue(math.NaN(), 0.01)) {
+		t.Errorf("roundValue: NaN should stay NaN")
+	}
+
+	// average of 10.00, 10.01 and 10.01 is 10.00666...
+	step := 10 * time.Second
+	rra := NewRoundRobinArchive(RRASpec{Step: step, Span: 4 * step, RoundTo: 0.01})
+	begin := time.Unix(1000, 0)
+	for i, v := range []float64{10.00, 10.01, 10.01} {
+		b := begin.Add(time.Duration(i) * step / 3)
+		rra.update(b, b.Add(step/3+time.Duration(i/2)), v, step/3+time.Duration(i/2))
+	}
+	if v := rra.dps[SlotIndex(begin.Add(step), step, 4)]; v != 10.01 {
+		t.Errorf("roundTo: expected 10.01, got %v", v)
+	}
+	if rra.Copy().RoundTo() != 0.01 {
+		t.Errorf("Copy: roundTo not copied")
+	}
+}
+
+func Test_Consolidation(t *testing.T) {
+	for _, cf := range []Consolidation{WMEAN, MAX, MIN, LAST, SUM, STDDEV} {
+		if c, err := ParseConsolidation(strings.ToLower(cf.String())); err != nil || c != cf {
+			t.Errorf("ParseConsolidation(%q): %v %v", cf, c, err)
+		}
+	}
+	if _, err := ParseConsolidation("avg"); err == nil {
+		t.Errorf("ParseConsolidation: expected an error")
+	}
+}
+
+func Test_RoundRobinArchive_sumStddev(t *testing.T) {
+	step := 10 * time.Second
+	begin := time.Unix(1000, 0)
+	slot := SlotIndex(begin.Add(step), step, 4)
+
+	// 2 and 4 for 5s each
+	for _, c := range []struct {
+		cf  Consolidation
+		exp float64
+	}{{SUM, 30}, {STDDEV, 1}} {
+		rra := NewRoundRobinArchive(RRASpec{Function: c.cf, Step: step, Span: 4 * step})
+		rra.update(begin, begin.Add(step/2), 2, step/2)
+		if c.cf == STDDEV {
+			if cpy := rra.Copy(); cpy.Value() != 2 || cpy.Variance() != 0 {
+				t.Errorf("Copy: stddev: %v %v", cpy.Value(), cpy.Variance())
+			}
+		}
+		rra.update(begin.Add(step/2), begin.Add(step), 4, step/2)
+		if v := rra.dps[slot]; v != c.exp {
+			t.Errorf("update: cf %v: expected %v, got %v", c.cf, c.exp, v)
+		}
+		if rra.Variance() != 0 || rra.Duration() != 0 {
+			t.Errorf("update: cf %v: PDP not reset", c.cf)
+		}
+		if rra.updateLate(begin.Add(time.Second), 1) {
+			t.Errorf("updateLate: cf %v: late points should be refused", c.cf)
+		}
+	}
+
+	// a partial STDDEV PDP can be restored
+	rra := NewRoundRobinArchive(RRASpec{Function: STDDEV, Step: step, Span: 4 * step, Value: 3, Variance: 1, Duration: step / 2})
+	rra.update(begin.Add(step/2), begin.Add(step), 3, step/2)
+	if v := rra.dps[slot]; v != math.Sqrt(0.5) {
+		t.Errorf("update: restored stddev: expected %v, got %v", math.Sqrt(0.5), v)
+	}
+}
+
+func Test_RoundRobinArchive_gapFill(t *testing.T) {
+	for _, g := range []GapFill{GapNaN, GapZero, GapPrevious, GapLinear} {
+		if gf, err := ParseGapFill(strings.ToLower(g.String())); err != nil || gf != g {
+			t.Errorf("ParseGapFill(%q): %v %v", g, gf, err)
+		}
+	}
+	if _, err := ParseGapFill("bogus"); err == nil {
+		t.Errorf("ParseGapFill: expected an error")
+	}
+
+	step := 10 * time.Second
+	slot := func(t time.Time) int64 { return SlotIndex(t, step, 10) }
+	nan := math.NaN()
+
+	// 2, two unknown slots, 8
+	for _, c := range []struct {
+		gf         GapFill
+		gap1, gap2 float64
+	}{{GapNaN, nan, nan}, {GapZero, 0, 0}, {GapPrevious, 2, 2}, {GapLinear, 4, 6}} {
+		rra := NewRoundRobinArchive(RRASpec{Step: step, Span: 10 * step, Xff: 0.5, GapFill: c.gf})
+		rra.update(time.Unix(1000, 0), time.Unix(1010, 0), 2, step)
+		rra.update(time.Unix(1010, 0), time.Unix(1030, 0), nan, step)
+		if c.gf == GapLinear {
+			if cpy := rra.Copy(); cpy.GapFill() != GapLinear {
+				t.Errorf("Copy: gap fill not copied")
+			} else if at, v := cpy.LastKnown(); !at.Equal(time.Unix(1010, 0)) || v != 2 {
+				t.Errorf("Copy: last known not copied: %v %v", at, v)
+			}
+		}
+		rra.update(time.Unix(1030, 0), time.Unix(1040, 0), 8, step)
+
+		for i, exp := range []float64{c.gap1, c.gap2} {
+			v := rra.dps[slot(time.Unix(int64(1020+10*i), 0))]
+			if v != exp && !(math.IsNaN(v) && math.IsNaN(exp)) {
+				t.Errorf("gap fill %v: slot %d: expected %v, got %v", c.gf, i, exp, v)
+			}
+		}
+		if rra.dps[slot(time.Unix(1040, 0))] != 8 {
+			t.Errorf("gap fill %v: the known value should be 8", c.gf)
+		}
+	}
+
+	// the last known slot is restored, e.g. after the DS was loaded
+	rra := NewRoundRobinArchive(RRASpec{Step: step, Span: 10 * step, Xff: 0.5, GapFill: GapLinear,
+		Latest: time.Unix(1010, 0), LastKnown: 2, LastKnownAt: time.Unix(1010, 0)})
+	rra.update(time.Unix(1010, 0), time.Unix(1020, 0), nan, step)
+	rra.update(time.Unix(1020, 0), time.Unix(1030, 0), 6, step)
+	if v := rra.dps[slot(time.Unix(1020, 0))]; v != 4 {
+		t.Errorf("gap fill: expected 4 after restore, got %v", v)
+	}
+	if rra.start != slot(time.Unix(1020, 0)) || rra.end != slot(time.Unix(1030, 0)) {
+		t.Errorf("gap fill: start/end: %v %v", rra.start, rra.end)
+	}
+}
+
+func Test_RoundRobinArchive_updateLate(t *testing.T) {
+	step := 10 * time.Second
+	latest := time.Unix(1000, 0)
+	slot := func(t time.Time) int64 { return SlotIndex(t, step, 10) }
+
+	// not complete yet and no longer in the RRA
+	rra := &RoundRobinArchive{step: step, size: 10, latest: latest}
+	if rra.updateLate(latest.Add(time.Second), 1) {
+		t.Errorf("updateLate: a slot after latest is not complete")
+	}
+	if rra.updateLate(latest.Add(-10*step), 1) {
+		t.Errorf("updateLate: a slot before the RRA begins should be refused")
+	}
+
+	// a slot not in dps has been flushed (or was never there)
+	if rra.updateLate(time.Unix(975, 0), 5) || len(rra.dps) != 0 {
+		t.Errorf("updateLate: a slot not in dps should be refused")
+	}
+
+	// an unknown slot is filled
+	nan := math.NaN()
+	rra.dps = map[int64]float64{slot(time.Unix(980, 0)): nan, slot(latest): 1}
+	if !rra.updateLate(time.Unix(975, 0), 5) {
+		t.Errorf("updateLate: point not placed")
+	}
+	if v := rra.dps[slot(time.Unix(980, 0))]; v != 5 {
+		t.Errorf("updateLate: expected 5, got %v", v)
+	}
+
+	// combining with what is in the slot
+	for _, c := range []struct {
+		cf  Consolidation
+		exp float64
+		ok  bool
+	}{{WMEAN, 5, false}, {MAX, 5, true}, {MIN, 1, true}, {LAST, 5, true}} {
+		rra := &RoundRobinArchive{cf: c.cf, step: step, size: 10, latest: latest,
+			dps: map[int64]float64{slot(latest): 5}}
+		ok := rra.updateLate(latest.Add(-time.Second), 1)
+		if v := rra.dps[slot(latest)]; v != c.exp || ok != c.ok {
+			t.Errorf("updateLate: cf %v: expected %v, got %v", c.cf, c.exp, v)
+		}
+	}
+
+	// NaN does not replace a value
+	rra = &RoundRobinArchive{step: step, size: 10, latest: latest, dps: map[int64]float64{slot(latest): 5}}
+	rra.updateLate(latest, nan)
+	if v := rra.dps[slot(latest)]; v != 5 {
+		t.Errorf("updateLate: NaN should not replace 5, got %v", v)
+	}
+}
+
+func Test_Resample(t *testing.T) {
+	latest := time.Unix(1000*3600, 0)
+	step := 10 * time.Second
+
+	// 10s slots with values 1 through 60 (the last 10 minutes)
+	dps := make(map[int64]float64)
+	for i := 0; i < 60; i++ {
+		dps[SlotIndex(latest.Add(-time.Duration(59-i)*step), step, 60)] = float64(i + 1)
+	}
+	fine := NewRoundRobinArchive(RRASpec{Function: WMEAN, Step: step, Span: 10 * time.Minute, Latest: latest, DPs: dps})
+
+	// consolidated into minutes
+	rra := Resample(RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour}, []RoundRobinArchiver{fine})
+	if !rra.Latest().Equal(latest) {
+		t.Errorf("Resample: latest %v, expected %v", rra.Latest(), latest)
+	}
+	if v := rra.DPs()[SlotIndex(latest, time.Minute, 60)]; v != 57.5 {
+		t.Errorf("Resample: last minute %v, expected 57.5", v)
+	}
+	if v := rra.DPs()[SlotIndex(latest.Add(-9*time.Minute), time.Minute, 60)]; v != 3.5 {
+		t.Errorf("Resample: first minute %v, expected 3.5", v)
+	}
+	if len(rra.DPs()) != 10 {
+		t.Errorf("Resample: %d slots, expected 10", len(rra.DPs()))
+	}
+
+	// SUM, MAX and a finer step
+	if rra := Resample(RRASpec{Function: SUM, Step: time.Minute, Span: time.Hour}, []RoundRobinArchiver{fine}); rra.DPs()[SlotIndex(latest, time.Minute, 60)] != 57.5*60 {
+		t.Errorf("Resample: SUM %v, expected %v", rra.DPs()[SlotIndex(latest, time.Minute, 60)], 57.5*60)
+	}
+	if rra := Resample(RRASpec{Function: MAX, Step: time.Minute, Span: time.Hour}, []RoundRobinArchiver{fine}); rra.DPs()[SlotIndex(latest, time.Minute, 60)] != 60 {
+		t.Errorf("Resample: MAX %v, expected 60", rra.DPs()[SlotIndex(latest, time.Minute, 60)])
+	}
+	if rra := Resample(RRASpec{Function: WMEAN, Step: 5 * time.Second, Span: time.Minute}, []RoundRobinArchiver{fine}); rra.DPs()[SlotIndex(latest.Add(-5*time.Second), 5*time.Second, 12)] != 60 {
+		t.Errorf("Resample: finer step %v, expected 60", rra.DPs()[SlotIndex(latest.Add(-5*time.Second), 5*time.Second, 12)])
+	}
+
+	// a coarse RRA with an hour of 100s fills what the fine one does not cover
+	cdps := make(map[int64]float64)
+	for i := 0; i < 60; i++ {
+		cdps[int64(i)] = 100
+	}
+	coarse := NewRoundRobinArchive(RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour, Latest: latest, DPs: cdps})
+	rra = Resample(RRASpec{Function: WMEAN, Step: 5 * time.Minute, Span: 2 * time.Hour, Xff: 0.5}, []RoundRobinArchiver{coarse, fine})
+	if v := rra.DPs()[SlotIndex(latest, 5*time.Minute, 24)]; v != 45.5 {
+		t.Errorf("Resample: expected the fine RRA to be preferred, got %v", v)
+	}
+	if v := rra.DPs()[SlotIndex(latest.Add(-15*time.Minute), 5*time.Minute, 24)]; v != 100 {
+		t.Errorf("Resample: expected the coarse RRA before the fine one, got %v", v)
+	}
+	if len(rra.DPs()) != 12 {
+		t.Errorf("Resample: %d slots, expected 12", len(rra.DPs()))
+	}
+
+	// nothing to resample
+	if rra := Resample(RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour}, nil); !rra.Latest().IsZero() || len(rra.DPs()) != 0 {
+		t.Errorf("Resample: expected an empty RRA")
+	}
+}
@@ -51,5 +51,12 @@
 // gap in data which exceeds HB is filled with NaNs.
 //
 // Note that this package does not concern itself with loading a series
-// from storage for analysis.
+// from storage for analysis. Once a DS with its data points is in
+// memory, however, FetchSeries returns its data for a time range,
+// without the DSL, e.g. for programs which embed tgres as a library:
+//
+//	s, err := rrd.FetchSeries(ds, from, to, 100, rrd.WMEAN)
+//	for i, v := range s.Values {
+//		fmt.Println(s.Time(i), v)
+//	}
 package rrd
@@ -0,0 +1,153 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// Golden files describe a case in rrdtool terms along with the
+// points rrdtool produced for it, so that the rrd package can be
+// verified where rrdtool is not installed. For example:
+//
+//	{
+//	  "name": "unaligned",
+//	  "start": 1500000000, "step": 10, "heartbeat": 60,
+//	  "rras": [{"cf": "AVERAGE", "xff": 0.5, "steps": 1, "rows": 10}],
+//	  "updates": [[1500000005, 1], [1500000015, 3]],
+//	  "expect": [{"1500000010": 2, "1500000020": null}]
+//	}
+//
+// Times are unix seconds, step and heartbeat are seconds, the xff is
+// that of rrdtool (the fraction which may be unknown) and null is an
+// unknown value.
+type golden struct {
+	Name      string                `json:"name"`
+	Start     int64                 `json:"start"`
+	Step      int64                 `json:"step"`
+	Heartbeat int64                 `json:"heartbeat"`
+	RRAs      []goldenRRA           `json:"rras"`
+	Updates   [][2]float64          `json:"updates"`
+	Expect    []map[string]*float64 `json:"expect"`
+}
+
+type goldenRRA struct {
+	CF    string  `json:"cf"`
+	Xff   float64 `json:"xff"`
+	Steps int64   `json:"steps"`
+	Rows  int64   `json:"rows"`
+}
+
+var (
+	cfNames = map[rrd.Consolidation]string{rrd.WMEAN: "AVERAGE", rrd.MAX: "MAX", rrd.MIN: "MIN", rrd.LAST: "LAST"}
+	cfs     = map[string]rrd.Consolidation{"AVERAGE": rrd.WMEAN, "MAX": rrd.MAX, "MIN": rrd.MIN, "LAST": rrd.LAST}
+)
+
+// rrdXff converts an RRASpec Xff (the fraction which must be known)
+// to that of rrdtool, which must be less than 1.
+func rrdXff(xff float32) float64 {
+	return math.Min(1-float64(xff), 0.999)
+}
+
+// ReadGolden reads a golden file.
+func ReadGolden(path string) (*Case, []Points, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var g golden
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	step := time.Duration(g.Step) * time.Second
+	c := &Case{
+		Name:      g.Name,
+		Start:     time.Unix(g.Start, 0),
+		Step:      step,
+		Heartbeat: time.Duration(g.Heartbeat) * time.Second,
+	}
+	for _, r := range g.RRAs {
+		cf, ok := cfs[r.CF]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: unknown consolidation function %q", path, r.CF)
+		}
+		rraStep := time.Duration(r.Steps) * step
+		c.RRAs = append(c.RRAs, rrd.RRASpec{Function: cf, Step: rraStep, Span: time.Duration(r.Rows) * rraStep, Xff: float32(1 - r.Xff)})
+	}
+	for _, u := range g.Updates {
+		c.Updates = append(c.Updates, Update{Time: time.Unix(int64(u[0]), 0), Value: u[1]})
+	}
+
+	var expect []Points
+	for _, e := range g.Expect {
+		pts := make(Points, len(e))
+		for k, v := range e {
+			t, err := strconv.ParseInt(k, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: bad time %q", path, k)
+			}
+			pts[t] = math.NaN()
+			if v != nil {
+				pts[t] = *v
+			}
+		}
+		expect = append(expect, pts)
+	}
+	return c, expect, nil
+}
+
+// WriteGolden writes a golden file of a case and the points rrdtool
+// produced for it.
+func WriteGolden(path string, c *Case, expect []Points) error {
+	g := golden{
+		Name:      c.Name,
+		Start:     c.Start.Unix(),
+		Step:      int64(c.Step / time.Second),
+		Heartbeat: int64(c.Heartbeat / time.Second),
+	}
+	for _, r := range c.RRAs {
+		steps := int64(r.Step / c.Step)
+		g.RRAs = append(g.RRAs, goldenRRA{CF: cfNames[r.Function], Xff: rrdXff(r.Xff), Steps: steps, Rows: int64(r.Span / r.Step)})
+	}
+	for _, u := range c.Updates {
+		g.Updates = append(g.Updates, [2]float64{float64(u.Time.Unix()), u.Value})
+	}
+	for _, pts := range expect {
+		e := make(map[string]*float64, len(pts))
+		for t, v := range pts {
+			e[strconv.FormatInt(t, 10)] = nil
+			if !math.IsNaN(v) {
+				v := v
+				e[strconv.FormatInt(t, 10)] = &v
+			}
+		}
+		g.Expect = append(g.Expect, e)
+	}
+
+	b, err := json.MarshalIndent(&g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
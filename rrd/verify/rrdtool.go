@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The most updates passed to a single rrdtool update command.
+const rrdtoolUpdateBatch = 500
+
+// Rrdtool computes the expected results of a case with the rrdtool
+// command.
+type Rrdtool struct {
+	Path string // the rrdtool binary, blank means look it up in PATH
+}
+
+// Run creates an RRD file (in a temporary directory) for the case,
+// performs the updates and fetches the points of every RRA. The RRAs
+// must differ in consolidation function or steps, as that is how
+// rrdtool fetch selects them.
+func (rt *Rrdtool) Run(c *Case) ([]Points, error) {
+	dir, err := ioutil.TempDir("", "tgres-verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "verify.rrd")
+
+	step, hb := int64(c.Step/time.Second), int64(c.Heartbeat/time.Second)
+	args := []string{"create", file, "--start", strconv.FormatInt(c.Start.Unix(), 10), "--step", strconv.FormatInt(step, 10),
+		fmt.Sprintf("DS:v:GAUGE:%d:U:U", hb)}
+	for _, r := range c.RRAs {
+		args = append(args, fmt.Sprintf("RRA:%s:%v:%d:%d", cfNames[r.Function], rrdXff(r.Xff), int64(r.Step/c.Step), int64(r.Span/r.Step)))
+	}
+	if _, err := rt.run(args...); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(c.Updates); i += rrdtoolUpdateBatch {
+		args := []string{"update", file}
+		for j := i; j < len(c.Updates) && j < i+rrdtoolUpdateBatch; j++ {
+			u := c.Updates[j]
+			args = append(args, fmt.Sprintf("%d:%s", u.Time.Unix(), strconv.FormatFloat(u.Value, 'g', -1, 64)))
+		}
+		if _, err := rt.run(args...); err != nil {
+			return nil, err
+		}
+	}
+
+	var last int64
+	if n := len(c.Updates); n > 0 {
+		last = c.Updates[n-1].Time.Unix()
+	}
+	var result []Points
+	for _, r := range c.RRAs {
+		res := int64(r.Step / time.Second)
+		end := last - last%res
+		start := end - int64(r.Span/time.Second)
+		out, err := rt.run("fetch", file, cfNames[r.Function], "-r", strconv.FormatInt(res, 10),
+			"-s", strconv.FormatInt(start, 10), "-e", strconv.FormatInt(end, 10))
+		if err != nil {
+			return nil, err
+		}
+		pts, err := parseFetch(out)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pts)
+	}
+	return result, nil
+}
+
+func (rt *Rrdtool) run(args ...string) ([]byte, error) {
+	path := rt.Path
+	if path == "" {
+		path = "rrdtool"
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("rrdtool %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// parseFetch parses the output of rrdtool fetch, a header line with
+// the DS names followed by "time: value" lines. The time is that of
+// the end of the slot, as in the rrd package.
+func parseFetch(out []byte) (Points, error) {
+	pts := make(Points)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue // the header or a blank line
+		}
+		t, err := strconv.ParseInt(line[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad rrdtool fetch line: %q", line)
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("bad rrdtool fetch line: %q", line)
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			// nan, -nan, NaN depending on the platform
+			if !strings.Contains(strings.ToLower(fields[0]), "nan") {
+				return nil, fmt.Errorf("bad rrdtool fetch value: %q", line)
+			}
+			v = math.NaN()
+		}
+		pts[t] = v
+	}
+	return pts, sc.Err()
+}
@@ -0,0 +1,170 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify feeds identical update streams to the rrd package
+// and to rrdtool (or to golden files recorded from it) and compares
+// the consolidated results, so that regressions in the alignment and
+// weighting math are caught before a release.
+//
+// Data sources behave like rrdtool GAUGE data sources: a value
+// applies to the time since the previous update. The data source
+// starts out last updated at Case.Start, as an rrdtool file created
+// with --start does.
+package verify
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// An Update is a value received at a time.
+type Update struct {
+	Time  time.Time
+	Value float64
+}
+
+// A Case is a data source definition and the updates to feed it.
+type Case struct {
+	Name      string
+	Start     time.Time
+	Step      time.Duration
+	Heartbeat time.Duration
+	RRAs      []rrd.RRASpec // Function, Step, Span and Xff are used
+	Updates   []Update
+}
+
+// Points are the values of an RRA by the (unix) time of the end of
+// the slot. NaN is unknown.
+type Points map[int64]float64
+
+// Run feeds the updates of the case to a DataSource and returns the
+// points of each of its RRAs. Updates the data source rejects are an
+// error, as rrdtool would reject them too.
+func Run(c *Case) ([]Points, error) {
+	ds := rrd.NewDataSource(rrd.DSSpec{
+		Step:       c.Step,
+		Heartbeat:  c.Heartbeat,
+		RRAs:       c.RRAs,
+		LastUpdate: c.Start,
+	})
+	for _, u := range c.Updates {
+		if err := ds.ProcessDataPoint(u.Value, u.Time); err != nil {
+			return nil, fmt.Errorf("%s: update at %v: %v", c.Name, u.Time.Unix(), err)
+		}
+	}
+
+	result := make([]Points, 0, len(c.RRAs))
+	for _, rra := range ds.RRAs() {
+		pts := make(Points)
+		if rra.PointCount() > 0 {
+			it := rrd.NewSlotIterator(rra)
+			for it.Next() {
+				pts[it.Time().Unix()] = it.Value()
+			}
+		}
+		result = append(result, pts)
+	}
+	return result, nil
+}
+
+// A Mismatch is a point where the rrd package disagrees with the
+// expected result.
+type Mismatch struct {
+	Case        string
+	RRA         int
+	Time        int64
+	Got, Expect float64
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: rra %d at %d: got %v, expected %v", m.Case, m.RRA, m.Time, m.Got, m.Expect)
+}
+
+// Compare compares every expected point with the one in got, a point
+// missing from got is unknown. Values must be within tolerance of
+// each other (relative to the expected value when it is larger than
+// 1), NaN only matches NaN.
+func Compare(name string, got, expect []Points, tolerance float64) []Mismatch {
+	var result []Mismatch
+	for i, exp := range expect {
+		var pts Points
+		if i < len(got) {
+			pts = got[i]
+		}
+		times := make([]int64, 0, len(exp))
+		for t := range exp {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(a, b int) bool { return times[a] < times[b] })
+
+		for _, t := range times {
+			e := exp[t]
+			g, ok := pts[t]
+			if !ok {
+				g = math.NaN()
+			}
+			if !equal(g, e, tolerance) {
+				result = append(result, Mismatch{Case: name, RRA: i, Time: t, Got: g, Expect: e})
+			}
+		}
+	}
+	return result
+}
+
+func equal(a, b, tolerance float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	diff := math.Abs(a - b)
+	if m := math.Abs(b); m > 1 {
+		diff /= m
+	}
+	return diff <= tolerance
+}
+
+// RandomCase returns a case of n updates with random values at random
+// (whole second) intervals no longer than the heartbeat, so that no
+// data is unknown. The RRAs are one of each consolidation function
+// over 6 steps plus a WMEAN of single steps, enough rows to hold all
+// the updates.
+func RandomCase(r *rand.Rand, name string, n int) *Case {
+	steps := []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute}
+	step := steps[r.Intn(len(steps))]
+	c := &Case{
+		Name:      name,
+		Start:     time.Unix(1500000000+r.Int63n(86400), 0),
+		Step:      step,
+		Heartbeat: 2 * step,
+	}
+
+	t := c.Start
+	for i := 0; i < n; i++ {
+		t = t.Add(time.Duration(1+r.Int63n(int64(c.Heartbeat/time.Second))) * time.Second)
+		c.Updates = append(c.Updates, Update{Time: t, Value: math.Floor(r.Float64()*100000) / 100})
+	}
+
+	rows := int64(t.Sub(c.Start)/step) + 2
+	c.RRAs = append(c.RRAs, rrd.RRASpec{Function: rrd.WMEAN, Step: step, Span: time.Duration(rows) * step})
+	for _, cf := range []rrd.Consolidation{rrd.WMEAN, rrd.MAX, rrd.MIN, rrd.LAST} {
+		rraStep := 6 * step
+		c.RRAs = append(c.RRAs, rrd.RRASpec{Function: cf, Step: rraStep, Span: time.Duration(rows/6+1) * rraStep, Xff: 0.5})
+	}
+	return c
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"math"
+	"math/rand"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGolden(t *testing.T) {
+	paths, _ := filepath.Glob("testdata/*.json")
+	if len(paths) == 0 {
+		t.Fatalf("no golden files")
+	}
+	for _, path := range paths {
+		c, expect, err := ReadGolden(path)
+		if err != nil {
+			t.Errorf("ReadGolden: %v", err)
+			continue
+		}
+		got, err := Run(c)
+		if err != nil {
+			t.Errorf("Run: %v", err)
+			continue
+		}
+		for _, m := range Compare(c.Name, got, expect, 1e-9) {
+			t.Errorf("%v", m)
+		}
+	}
+}
+
+func Test_parseFetch(t *testing.T) {
+	out := []byte("                    v\n\n1500000010: 2.0000000000e+00\n1500000020: -nan\n1500000030: NaN\n")
+	pts, err := parseFetch(out)
+	if err != nil {
+		t.Fatalf("parseFetch: %v", err)
+	}
+	if len(pts) != 3 || pts[1500000010] != 2 || !math.IsNaN(pts[1500000020]) || !math.IsNaN(pts[1500000030]) {
+		t.Errorf("parseFetch: unexpected %v", pts)
+	}
+	if _, err := parseFetch([]byte("1500000010: bogus\n")); err == nil {
+		t.Errorf("parseFetch: expected an error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	got := []Points{{10: 1, 20: math.NaN(), 30: 1000.0000001}}
+	expect := []Points{{10: 1, 20: math.NaN(), 30: 1000, 40: math.NaN(), 50: 5}}
+	m := Compare("test", got, expect, 1e-9)
+	if len(m) != 1 || m[0].Time != 50 || !math.IsNaN(m[0].Got) {
+		t.Errorf("Compare: expected only a missing point at 50, got %v", m)
+	}
+}
+
+// Against rrdtool itself, if it is installed.
+func TestRrdtool(t *testing.T) {
+	if _, err := exec.LookPath("rrdtool"); err != nil {
+		t.Skip("rrdtool not installed")
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		c := RandomCase(r, "random", 500)
+		expect, err := (&Rrdtool{}).Run(c)
+		if err != nil {
+			t.Fatalf("Rrdtool.Run: %v", err)
+		}
+		got, err := Run(c)
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		for _, m := range Compare(c.Name, got, expect, 1e-9) {
+			t.Errorf("%v", m)
+		}
+	}
+}
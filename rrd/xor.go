@@ -0,0 +1,262 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// This is the value compression of the Facebook Gorilla paper
+// ("Gorilla: A Fast, Scalable, In-Memory Time Series Database",
+// section 4.1.2). Since the slots of an RRA are evenly spaced, the
+// timestamps are implied and only the values are encoded. Each value
+// is XOR'ed with the previous one, and:
+//
+//	0                   the XOR is zero (same value)
+//	10 <bits>           the meaningful bits of the XOR fit within
+//	                    the leading and trailing zeros of the previous
+//	                    XOR, only those bits follow
+//	11 <5> <6> <bits>   otherwise, the number of leading zeros (5
+//	                    bits), the number of meaningful bits (6 bits,
+//	                    where 0 means 64) and the bits follow
+//
+// The first value is stored as is (64 bits). Typical monitoring data
+// (slowly changing, often repeated values, NaN for unknown) takes
+// only a few bits per value instead of 64.
+//
+// The in-memory serde keeps flushed data points this way (see
+// CompressDPs). The PostgreSQL ts table is not compressed, its rows
+// hold one slot across many RRAs, whereas XOR compression works along
+// time within one RRA.
+
+// XOREncoder compresses a sequence of float64 values, see
+// XORDecoder.
+type XOREncoder struct {
+	buf      []byte
+	nbits    uint8 // bits used of the last byte of buf
+	n        int   // number of values
+	prev     uint64
+	leading  uint8
+	trailing uint8
+}
+
+// Write appends a value.
+func (e *XOREncoder) Write(v float64) {
+	u := math.Float64bits(v)
+	if e.n == 0 {
+		e.writeBits(u, 64)
+		e.prev, e.n, e.leading = u, 1, 0xff
+		return
+	}
+	xor := u ^ e.prev
+	e.prev = u
+	e.n++
+	if xor == 0 {
+		e.writeBit(false)
+		return
+	}
+	e.writeBit(true)
+
+	leading, trailing := uint8(bits.LeadingZeros64(xor)), uint8(bits.TrailingZeros64(xor))
+	if leading >= 32 {
+		leading = 31 // it has to fit in 5 bits
+	}
+	if e.leading != 0xff && leading >= e.leading && trailing >= e.trailing {
+		e.writeBit(false)
+		e.writeBits(xor>>e.trailing, 64-int(e.leading)-int(e.trailing))
+		return
+	}
+	e.writeBit(true)
+	e.leading, e.trailing = leading, trailing
+	sigbits := 64 - int(leading) - int(trailing)
+	e.writeBits(uint64(leading), 5)
+	e.writeBits(uint64(sigbits&63), 6) // 64 is stored as 0
+	e.writeBits(xor>>trailing, sigbits)
+}
+
+// Len returns the number of values written.
+func (e *XOREncoder) Len() int { return e.n }
+
+// Bytes returns the encoded values. The encoder can still be
+// written to, but the returned slice may be modified by it.
+func (e *XOREncoder) Bytes() []byte { return e.buf }
+
+func (e *XOREncoder) writeBit(bit bool) {
+	if e.nbits == 0 || e.nbits == 8 {
+		e.buf = append(e.buf, 0)
+		e.nbits = 0
+	}
+	if bit {
+		e.buf[len(e.buf)-1] |= 1 << (7 - e.nbits)
+	}
+	e.nbits++
+}
+
+func (e *XOREncoder) writeBits(u uint64, nbits int) {
+	for i := nbits - 1; i >= 0; i-- {
+		e.writeBit(u&(1<<uint(i)) != 0)
+	}
+}
+
+// XORDecoder decompresses values written by XOREncoder.
+//
+//	dec := rrd.NewXORDecoder(b, n)
+//	for dec.Next() {
+//		fmt.Println(dec.Value())
+//	}
+//	if err := dec.Err(); err != nil { ...
+type XORDecoder struct {
+	buf      []byte
+	pos      int // in bits
+	n, count int
+	value    uint64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+// NewXORDecoder returns a decoder of n values encoded in b.
+func NewXORDecoder(b []byte, n int) *XORDecoder {
+	return &XORDecoder{buf: b, count: n}
+}
+
+// Next decodes the next value, it returns false when there are no
+// more values or on error (see Err).
+func (d *XORDecoder) Next() bool {
+	if d.err != nil || d.n >= d.count {
+		return false
+	}
+	if d.n == 0 {
+		if d.value, d.err = d.readBits(64); d.err != nil {
+			return false
+		}
+		d.n++
+		return true
+	}
+	d.n++
+	if bit, err := d.readBit(); err != nil || !bit {
+		d.err = err
+		return err == nil // same value
+	}
+	newWindow, err := d.readBit()
+	if err != nil {
+		d.err = err
+		return false
+	}
+	if newWindow {
+		leading, err := d.readBits(5)
+		if err != nil {
+			d.err = err
+			return false
+		}
+		sigbits, err := d.readBits(6)
+		if err != nil {
+			d.err = err
+			return false
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		if leading+sigbits > 64 {
+			d.err = fmt.Errorf("XORDecoder: invalid header at bit %d", d.pos)
+			return false
+		}
+		d.leading, d.trailing = uint8(leading), uint8(64-leading-sigbits)
+	}
+	xor, err := d.readBits(64 - int(d.leading) - int(d.trailing))
+	if err != nil {
+		d.err = err
+		return false
+	}
+	d.value ^= xor << d.trailing
+	return true
+}
+
+// Value returns the current value.
+func (d *XORDecoder) Value() float64 { return math.Float64frombits(d.value) }
+
+// Err returns the error, if any, which stopped Next.
+func (d *XORDecoder) Err() error { return d.err }
+
+func (d *XORDecoder) readBit() (bool, error) {
+	if d.pos >= len(d.buf)*8 {
+		return false, fmt.Errorf("XORDecoder: unexpected end of data")
+	}
+	bit := d.buf[d.pos/8]&(1<<uint(7-d.pos%8)) != 0
+	d.pos++
+	return bit, nil
+}
+
+func (d *XORDecoder) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for i := 0; i < nbits; i++ {
+		bit, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// CompressDPs returns the data points of the RRA, from the oldest
+// slot to the latest (see SlotIterator), XOR-compressed and preceded
+// by their number (as a uvarint). Missing slots are stored as NaN.
+// The RRA latest, step and size are not included, they are needed to
+// decompress, see DecompressDPs.
+func CompressDPs(rra RoundRobinArchiver) []byte {
+	var enc XOREncoder
+	it := NewSlotIterator(rra)
+	for it.Next() {
+		enc.Write(it.Value())
+	}
+	hdr := make([]byte, binary.MaxVarintLen64)
+	hdr = hdr[:binary.PutUvarint(hdr, uint64(enc.Len()))]
+	return append(hdr, enc.Bytes()...)
+}
+
+// DecompressDPs is the reverse of CompressDPs, given the RRA latest,
+// step and size it returns the data points (e.g. for RRASpec DPs).
+func DecompressDPs(b []byte, latest time.Time, step time.Duration, size int64) (map[int64]float64, error) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("DecompressDPs: invalid header")
+	}
+	if int64(count) > size {
+		return nil, fmt.Errorf("DecompressDPs: %d data points is more than the RRA size %d", count, size)
+	}
+	dps := make(map[int64]float64, count)
+	if count == 0 {
+		return dps, nil
+	}
+	i := (SlotIndex(latest, step, size) - int64(count) + 1 + size) % size
+	dec := NewXORDecoder(b[n:], int(count))
+	for dec.Next() {
+		dps[i] = dec.Value()
+		i = (i + 1) % size
+	}
+	if err := dec.Err(); err != nil {
+		return nil, fmt.Errorf("DecompressDPs: %v", err)
+	}
+	return dps, nil
+}
@@ -0,0 +1,95 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_XOREncoder(t *testing.T) {
+	values := []float64{12, 12, 12.5, 13, math.NaN(), math.NaN(), 0, -1e300, math.Inf(1),
+		math.SmallestNonzeroFloat64, 1, 2, 3, 1e-3, 1e-3}
+	var enc XOREncoder
+	for _, v := range values {
+		enc.Write(v)
+	}
+	if enc.Len() != len(values) {
+		t.Errorf("Len: expected %d, got %d", len(values), enc.Len())
+	}
+
+	dec := NewXORDecoder(enc.Bytes(), enc.Len())
+	n := 0
+	for dec.Next() {
+		if got := dec.Value(); math.Float64bits(got) != math.Float64bits(values[n]) {
+			t.Errorf("XORDecoder: value %d: expected %v, got %v", n, values[n], got)
+		}
+		n++
+	}
+	if n != len(values) || dec.Err() != nil {
+		t.Errorf("XORDecoder: decoded %d of %d values: %v", n, len(values), dec.Err())
+	}
+
+	// truncated
+	dec = NewXORDecoder(enc.Bytes()[:5], enc.Len())
+	for dec.Next() {
+	}
+	if dec.Err() == nil {
+		t.Errorf("XORDecoder: expected an error for truncated data")
+	}
+
+	// a repeated value takes a bit
+	enc = XOREncoder{}
+	for i := 0; i < 1000; i++ {
+		enc.Write(42)
+	}
+	if l := len(enc.Bytes()); l > 8+1000/8+1 {
+		t.Errorf("XOREncoder: 1000 repeated values take %d bytes", l)
+	}
+}
+
+func Test_CompressDPs(t *testing.T) {
+	step, size := 10*time.Second, int64(10)
+	latest := time.Unix(1010, 0)
+
+	// wraps around: slots 7, 8, 9, 0, 1 (latest)
+	dps := map[int64]float64{7: 1, 8: 1.5, 0: 2, 1: math.NaN()}
+	rra := NewRoundRobinArchive(RRASpec{Step: step, Span: time.Duration(size) * step, Latest: latest, DPs: dps})
+	if rra.Start() != 7 || rra.End() != 1 {
+		t.Fatalf("unexpected start/end: %d %d", rra.Start(), rra.End())
+	}
+
+	b := CompressDPs(rra)
+	got, err := DecompressDPs(b, latest, step, size)
+	if err != nil {
+		t.Fatalf("DecompressDPs: %v", err)
+	}
+	if len(got) != 5 || got[7] != 1 || got[8] != 1.5 || !math.IsNaN(got[9]) || got[0] != 2 || !math.IsNaN(got[1]) {
+		t.Errorf("DecompressDPs: unexpected %v", got)
+	}
+
+	if _, err := DecompressDPs(b, latest, step, 3); err == nil {
+		t.Errorf("DecompressDPs: expected an error if size is too small")
+	}
+	if _, err := DecompressDPs(nil, latest, step, size); err == nil {
+		t.Errorf("DecompressDPs: expected an error for no data")
+	}
+	empty := NewRoundRobinArchive(RRASpec{Step: step, Span: time.Duration(size) * step})
+	if got, err := DecompressDPs(CompressDPs(empty), latest, step, size); err != nil || len(got) != 0 {
+		t.Errorf("DecompressDPs: expected no data points, got %v %v", got, err)
+	}
+}
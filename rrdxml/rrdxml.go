@@ -0,0 +1,319 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rrdxml reads and writes the XML of "rrdtool dump" (which
+// "rrdtool restore" reads back), and maps it to and from Tgres data
+// sources, so that the history of RRDTool based installations (such
+// as Cacti or Munin) can be migrated to Tgres and back.
+//
+// An RRD file can have several DSs, each of which becomes a series in
+// Tgres. The RRAs of an RRD have a row of values (one per DS) for
+// every slot, oldest first, the last of which ends at the last update
+// rounded down to the step of the RRA.
+package rrdxml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// Float is a value as it appears in the XML, where unknown is "NaN"
+// (or "U" for the last raw value).
+type Float float64
+
+func (f Float) MarshalText() ([]byte, error) {
+	if math.IsNaN(float64(f)) {
+		return []byte("NaN"), nil
+	}
+	return []byte(strconv.FormatFloat(float64(f), 'e', 10, 64)), nil
+}
+
+func (f *Float) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "" || s == "U" {
+		*f = Float(math.NaN())
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f = Float(v)
+	return nil
+}
+
+// RRD is the root element of the XML.
+type RRD struct {
+	XMLName    xml.Name `xml:"rrd"`
+	Version    string   `xml:"version"`
+	Step       int64    `xml:"step"`       // seconds
+	LastUpdate int64    `xml:"lastupdate"` // unix time
+	DSs        []DS     `xml:"ds"`
+	RRAs       []RRA    `xml:"rra"`
+}
+
+// DS is a data source of an RRD along with its PDP state, i.e. Value
+// is the sum of the known rates times their duration since the
+// beginning of the current step.
+type DS struct {
+	Name             string `xml:"name"`
+	Type             string `xml:"type"`
+	MinimalHeartbeat int64  `xml:"minimal_heartbeat"` // seconds
+	Min              Float  `xml:"min"`
+	Max              Float  `xml:"max"`
+	LastDS           Float  `xml:"last_ds"`
+	Value            Float  `xml:"value"`
+	UnknownSec       int64  `xml:"unknown_sec"`
+}
+
+// RRA is an archive of an RRD. Its xff, unlike in Tgres, is the
+// fraction of a slot which can be unknown.
+type RRA struct {
+	CF        string `xml:"cf"`
+	PdpPerRow int64  `xml:"pdp_per_row"`
+	XFF       Float  `xml:"params>xff"`
+	CDPPrep   []CDP  `xml:"cdp_prep>ds"`
+	Rows      []Row  `xml:"database>row"`
+}
+
+// CDP is the state of the current slot of an RRA for a DS. For
+// AVERAGE, Value is the sum of the known PDPs.
+type CDP struct {
+	PrimaryValue      Float `xml:"primary_value"`
+	SecondaryValue    Float `xml:"secondary_value"`
+	Value             Float `xml:"value"`
+	UnknownDatapoints int64 `xml:"unknown_datapoints"`
+}
+
+// Row is a slot of an RRA, with a value for each DS.
+type Row struct {
+	V []Float `xml:"v"`
+}
+
+var (
+	rrdCFs = map[string]rrd.Consolidation{
+		"AVERAGE": rrd.WMEAN,
+		"MIN":     rrd.MIN,
+		"MAX":     rrd.MAX,
+		"LAST":    rrd.LAST,
+	}
+	tgresCFs = map[rrd.Consolidation]string{
+		rrd.WMEAN: "AVERAGE",
+		rrd.MIN:   "MIN",
+		rrd.MAX:   "MAX",
+		rrd.LAST:  "LAST",
+	}
+)
+
+// Read reads the XML of "rrdtool dump".
+func Read(r io.Reader) (*RRD, error) {
+	var x RRD
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, err
+	}
+	if x.Step <= 0 {
+		return nil, fmt.Errorf("rrdxml: invalid step: %d", x.Step)
+	}
+	if len(x.DSs) == 0 {
+		return nil, fmt.Errorf("rrdxml: no DSs")
+	}
+	for i := range x.DSs {
+		x.DSs[i].Name = strings.TrimSpace(x.DSs[i].Name)
+		x.DSs[i].Type = strings.TrimSpace(x.DSs[i].Type)
+	}
+	for i := range x.RRAs {
+		x.RRAs[i].CF = strings.TrimSpace(x.RRAs[i].CF)
+		if x.RRAs[i].PdpPerRow <= 0 {
+			return nil, fmt.Errorf("rrdxml: invalid pdp_per_row: %d", x.RRAs[i].PdpPerRow)
+		}
+	}
+	return &x, nil
+}
+
+// Write writes x as XML which "rrdtool restore" can read.
+func Write(w io.Writer, x *RRD) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(x); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// DSSpec returns a DS spec for the DS n of x, with its state and the
+// data points of its RRAs, i.e. creating a DS from it restores the
+// DS as it is in the RRD. RRAs whose consolidation function is not
+// supported by Tgres (e.g. HWPREDICT) are left out.
+func (x *RRD) DSSpec(n int) (*rrd.DSSpec, error) {
+	if n < 0 || n >= len(x.DSs) {
+		return nil, fmt.Errorf("rrdxml: no DS %d, there are %d", n, len(x.DSs))
+	}
+	d := x.DSs[n]
+	typ, err := rrd.ParseDSType(d.Type)
+	if err != nil {
+		return nil, fmt.Errorf("rrdxml: DS %q: %v", d.Name, err)
+	}
+	step := time.Duration(x.Step) * time.Second
+	spec := &rrd.DSSpec{
+		Step:       step,
+		Heartbeat:  time.Duration(d.MinimalHeartbeat) * time.Second,
+		Type:       typ,
+		Min:        float64(d.Min),
+		Max:        float64(d.Max),
+		LastUpdate: time.Unix(x.LastUpdate, 0),
+		LastRaw:    float64(d.LastDS),
+	}
+	if known := x.LastUpdate%x.Step - d.UnknownSec; known > 0 && !math.IsNaN(float64(d.Value)) {
+		spec.Value = float64(d.Value) / float64(known)
+		spec.Duration = time.Duration(known) * time.Second
+	}
+
+	for _, a := range x.RRAs {
+		cf, ok := rrdCFs[a.CF]
+		if !ok || len(a.Rows) == 0 {
+			continue
+		}
+		rstep := x.Step * a.PdpPerRow
+		size := int64(len(a.Rows))
+		end := x.LastUpdate / rstep * rstep
+		rs := rrd.RRASpec{
+			Function: cf,
+			Step:     time.Duration(rstep) * time.Second,
+			Span:     time.Duration(rstep*size) * time.Second,
+			Xff:      float32(1 - a.XFF),
+			Latest:   time.Unix(end, 0),
+			DPs:      make(map[int64]float64),
+		}
+		for j, row := range a.Rows {
+			if n >= len(row.V) {
+				return nil, fmt.Errorf("rrdxml: a row of a %s RRA has %d values, expected %d", a.CF, len(row.V), len(x.DSs))
+			}
+			if v := float64(row.V[n]); !math.IsNaN(v) {
+				t := time.Unix(end-(size-1-int64(j))*rstep, 0)
+				rs.DPs[rrd.SlotIndex(t, rs.Step, size)] = v
+			}
+		}
+		if n < len(a.CDPPrep) {
+			c := a.CDPPrep[n]
+			elapsed := x.LastUpdate / x.Step % a.PdpPerRow
+			if known := elapsed - c.UnknownDatapoints; known > 0 && !math.IsNaN(float64(c.Value)) {
+				rs.Value = float64(c.Value)
+				if cf == rrd.WMEAN {
+					rs.Value /= float64(known)
+				}
+				rs.Duration = time.Duration(known) * step
+			}
+		}
+		spec.RRAs = append(spec.RRAs, rs)
+	}
+	if len(spec.RRAs) == 0 {
+		return nil, fmt.Errorf("rrdxml: no RRAs with a consolidation function supported by Tgres")
+	}
+	return spec, nil
+}
+
+// FromDataSource returns an RRD with the DS ds named name, whose RRAs
+// must have their data points. RRAs whose consolidation function
+// RRDTool does not have (SUM, STDDEV) are left out. A DS with no
+// heartbeat gets one as long as its longest RRA, since RRDTool
+// requires one.
+func FromDataSource(ds rrd.DataSourcer, name string) (*RRD, error) {
+	if ds.Step()%time.Second != 0 {
+		return nil, fmt.Errorf("rrdxml: the step must be whole seconds, not %v", ds.Step())
+	}
+	step := int64(ds.Step() / time.Second)
+	lastUpdate := ds.LastUpdate().Unix()
+	x := &RRD{Version: "0003", Step: step, LastUpdate: lastUpdate}
+
+	d := DS{
+		Name:             name,
+		Type:             ds.Type().String(),
+		MinimalHeartbeat: int64(ds.Heartbeat() / time.Second),
+		Min:              Float(math.NaN()),
+		Max:              Float(math.NaN()),
+		LastDS:           Float(ds.LastRaw()),
+		UnknownSec:       lastUpdate % step,
+	}
+	if l, ok := ds.(interface {
+		Limits() (float64, float64)
+	}); ok {
+		min, max := l.Limits()
+		d.Min, d.Max = Float(min), Float(max)
+	}
+	if known := int64(ds.Duration() / time.Second); known > 0 {
+		d.Value = Float(ds.Value() * float64(known))
+		if d.UnknownSec -= known; d.UnknownSec < 0 {
+			d.UnknownSec = 0
+		}
+	}
+
+	for _, rra := range ds.RRAs() {
+		cf, ok := tgresCFs[rra.Consolidation()]
+		if !ok {
+			continue
+		}
+		ppr := int64(rra.Step() / ds.Step())
+		rstep := step * ppr
+		if span := rstep * rra.Size(); span > d.MinimalHeartbeat && ds.Heartbeat() == 0 {
+			d.MinimalHeartbeat = span
+		}
+
+		values := make(map[int64]float64)
+		it := rrd.NewSlotIterator(rra)
+		for it.Next() {
+			values[it.Time().Unix()] = it.Value()
+		}
+		a := RRA{CF: cf, PdpPerRow: ppr, XFF: Float(1 - rra.Xff())}
+		end := lastUpdate / rstep * rstep
+		for j := int64(0); j < rra.Size(); j++ {
+			v, ok := values[end-(rra.Size()-1-j)*rstep]
+			if !ok {
+				v = math.NaN()
+			}
+			a.Rows = append(a.Rows, Row{V: []Float{Float(v)}})
+		}
+
+		c := CDP{PrimaryValue: Float(math.NaN()), SecondaryValue: Float(math.NaN()), Value: Float(math.NaN())}
+		elapsed := lastUpdate / step % ppr
+		c.UnknownDatapoints = elapsed
+		if known := int64(rra.Duration() / ds.Step()); known > 0 {
+			c.Value = Float(rra.Value())
+			if rra.Consolidation() == rrd.WMEAN {
+				c.Value *= Float(known)
+			}
+			if c.UnknownDatapoints -= known; c.UnknownDatapoints < 0 {
+				c.UnknownDatapoints = 0
+			}
+		}
+		a.CDPPrep = []CDP{c}
+		x.RRAs = append(x.RRAs, a)
+	}
+	if len(x.RRAs) == 0 {
+		return nil, fmt.Errorf("rrdxml: no RRAs with a consolidation function supported by RRDTool")
+	}
+	x.DSs = []DS{d}
+	return x, nil
+}
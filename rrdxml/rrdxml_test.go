@@ -0,0 +1,237 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrdxml
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// As "rrdtool dump" writes it, abridged.
+const dump = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE rrd SYSTEM "http://oss.oetiker.ch/rrdtool/rrdtool.dtd">
+<!-- Round Robin Database Dump -->
+<rrd>
+	<version>0003</version>
+	<step>300</step> <!-- Seconds -->
+	<lastupdate>1500000100</lastupdate> <!-- 2017-07-14 02:41:40 UTC -->
+
+	<ds>
+		<name> load </name>
+		<type> GAUGE </type>
+		<minimal_heartbeat>600</minimal_heartbeat>
+		<min>0.0000000000e+00</min>
+		<max>NaN</max>
+
+		<!-- PDP Status -->
+		<last_ds>2</last_ds>
+		<value>2.0000000000e+02</value>
+		<unknown_sec> 0 </unknown_sec>
+	</ds>
+
+	<ds>
+		<name> octets </name>
+		<type> COUNTER </type>
+		<minimal_heartbeat>600</minimal_heartbeat>
+		<min>NaN</min>
+		<max>NaN</max>
+		<last_ds>U</last_ds>
+		<value>NaN</value>
+		<unknown_sec> 100 </unknown_sec>
+	</ds>
+
+	<!-- Round Robin Archives -->
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>1</pdp_per_row> <!-- 300 seconds -->
+
+		<params>
+		<xff>5.0000000000e-01</xff>
+		</params>
+		<cdp_prep>
+			<ds>
+			<primary_value>1.0000000000e+00</primary_value>
+			<secondary_value>NaN</secondary_value>
+			<value>NaN</value>
+			<unknown_datapoints>0</unknown_datapoints>
+			</ds>
+			<ds>
+			<primary_value>NaN</primary_value>
+			<secondary_value>NaN</secondary_value>
+			<value>NaN</value>
+			<unknown_datapoints>0</unknown_datapoints>
+			</ds>
+		</cdp_prep>
+		<database>
+			<!-- 2017-07-14 02:25:00 UTC / 1499999100 --> <row><v>NaN</v><v>NaN</v></row>
+			<!-- 2017-07-14 02:30:00 UTC / 1499999400 --> <row><v>1.0000000000e+00</v><v>1.0000000000e+01</v></row>
+			<!-- 2017-07-14 02:35:00 UTC / 1499999700 --> <row><v>3.0000000000e+00</v><v>NaN</v></row>
+			<!-- 2017-07-14 02:40:00 UTC / 1500000000 --> <row><v>2.0000000000e+00</v><v>3.0000000000e+01</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>MAX</cf>
+		<pdp_per_row>3</pdp_per_row> <!-- 900 seconds -->
+		<params>
+		<xff>5.0000000000e-01</xff>
+		</params>
+		<cdp_prep>
+			<ds>
+			<primary_value>2.0000000000e+00</primary_value>
+			<secondary_value>NaN</secondary_value>
+			<value>2.0000000000e+00</value>
+			<unknown_datapoints>0</unknown_datapoints>
+			</ds>
+			<ds>
+			<primary_value>NaN</primary_value>
+			<secondary_value>NaN</secondary_value>
+			<value>NaN</value>
+			<unknown_datapoints>1</unknown_datapoints>
+			</ds>
+		</cdp_prep>
+		<database>
+			<!-- 2017-07-14 02:15:00 UTC / 1499998500 --> <row><v>5.0000000000e+00</v><v>NaN</v></row>
+			<!-- 2017-07-14 02:30:00 UTC / 1499999400 --> <row><v>3.0000000000e+00</v><v>1.0000000000e+01</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>HWPREDICT</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<database>
+			<row><v>NaN</v><v>NaN</v></row>
+		</database>
+	</rra>
+</rrd>
+`
+
+func Test_Read_DSSpec(t *testing.T) {
+	x, err := Read(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if x.Step != 300 || x.LastUpdate != 1500000100 || len(x.DSs) != 2 || len(x.RRAs) != 3 {
+		t.Fatalf("Read: unexpected %+v", x)
+	}
+	if x.DSs[1].Name != "octets" || !math.IsNaN(float64(x.DSs[1].LastDS)) {
+		t.Errorf("Read: unexpected DS: %+v", x.DSs[1])
+	}
+
+	spec, err := x.DSSpec(0)
+	if err != nil {
+		t.Fatalf("DSSpec: %v", err)
+	}
+	if spec.Step != 5*time.Minute || spec.Heartbeat != 10*time.Minute || spec.Type != rrd.GAUGE || spec.LastRaw != 2 {
+		t.Errorf("DSSpec: unexpected spec: %+v", spec)
+	}
+	// 200 over the 100s of the current step which are known
+	if spec.Value != 2 || spec.Duration != 100*time.Second {
+		t.Errorf("DSSpec: PDP: expected 2 for 100s, got %v for %v", spec.Value, spec.Duration)
+	}
+	if len(spec.RRAs) != 2 {
+		t.Fatalf("DSSpec: HWPREDICT should be left out, got %d RRAs", len(spec.RRAs))
+	}
+	avg, max := spec.RRAs[0], spec.RRAs[1]
+	if avg.Function != rrd.WMEAN || avg.Span != 20*time.Minute || avg.Xff != 0.5 || !avg.Latest.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("DSSpec: unexpected RRA: %+v", avg)
+	}
+	if max.Function != rrd.MAX || max.Step != 15*time.Minute || !max.Latest.Equal(time.Unix(1499999400, 0)) {
+		t.Errorf("DSSpec: unexpected RRA: %+v", max)
+	}
+	// two PDPs of the current slot are in, 2 is the MAX so far
+	if max.Value != 2 || max.Duration != 10*time.Minute {
+		t.Errorf("DSSpec: CDP: expected 2 for 10m, got %v for %v", max.Value, max.Duration)
+	}
+
+	ds := rrd.NewDataSource(*spec)
+	expect := map[int64]float64{1499999400: 1, 1499999700: 3, 1500000000: 2}
+	it := rrd.NewSlotIterator(ds.RRAs()[0])
+	for it.Next() {
+		v, ok := expect[it.Time().Unix()]
+		if !ok {
+			v = math.NaN()
+		}
+		if it.Value() != v && !(math.IsNaN(v) && math.IsNaN(it.Value())) {
+			t.Errorf("DSSpec: slot %v: expected %v, got %v", it.Time().Unix(), v, it.Value())
+		}
+	}
+
+	if spec, err := x.DSSpec(1); err != nil || spec.Type != rrd.COUNTER || spec.Duration != 0 {
+		t.Errorf("DSSpec: %+v %v", spec, err)
+	}
+	if _, err := x.DSSpec(2); err == nil {
+		t.Errorf("DSSpec: expected an error for a DS that does not exist")
+	}
+	if _, err := Read(strings.NewReader("<rrd><step>0</step></rrd>")); err == nil {
+		t.Errorf("Read: expected an error for a zero step")
+	}
+}
+
+func Test_FromDataSource(t *testing.T) {
+	x, err := Read(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	spec, _ := x.DSSpec(0)
+	ds := rrd.NewDataSource(*spec)
+
+	// and back, through the XML
+	y, err := FromDataSource(ds, "load")
+	if err != nil {
+		t.Fatalf("FromDataSource: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, y); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	z, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read: %v\n%s", err, buf.String())
+	}
+	if z.Step != x.Step || z.LastUpdate != x.LastUpdate || len(z.DSs) != 1 || len(z.RRAs) != 2 {
+		t.Fatalf("FromDataSource: unexpected %+v", z)
+	}
+	d := z.DSs[0]
+	if d.Name != "load" || d.Type != "GAUGE" || d.MinimalHeartbeat != 600 || d.Value != 200 || d.UnknownSec != 0 || d.LastDS != 2 {
+		t.Errorf("FromDataSource: unexpected DS: %+v", d)
+	}
+	for n, a := range z.RRAs {
+		orig := x.RRAs[n]
+		if a.CF != orig.CF || a.PdpPerRow != orig.PdpPerRow || a.XFF != orig.XFF || len(a.Rows) != len(orig.Rows) {
+			t.Errorf("FromDataSource: RRA %d: unexpected %+v", n, a)
+			continue
+		}
+		for j, row := range a.Rows {
+			v, e := row.V[0], orig.Rows[j].V[0]
+			if v != e && !(math.IsNaN(float64(v)) && math.IsNaN(float64(e))) {
+				t.Errorf("FromDataSource: RRA %d row %d: expected %v, got %v", n, j, e, v)
+			}
+		}
+		if c, e := a.CDPPrep[0], orig.CDPPrep[0]; c.UnknownDatapoints != e.UnknownDatapoints ||
+			(c.Value != e.Value && !(math.IsNaN(float64(c.Value)) && math.IsNaN(float64(e.Value)))) {
+			t.Errorf("FromDataSource: RRA %d: CDP expected %+v, got %+v", n, e, c)
+		}
+	}
+
+	sub := rrd.NewDataSource(rrd.DSSpec{Step: 100 * time.Millisecond})
+	if _, err := FromDataSource(sub, "foo"); err == nil {
+		t.Errorf("FromDataSource: expected an error for a sub-second step")
+	}
+}
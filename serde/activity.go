@@ -0,0 +1,89 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"sort"
+	"time"
+)
+
+// SeriesActivity is when a DS was created and last updated. Either
+// can be zero: Created if the DS was created before creation times
+// were recorded, LastUpdate if it was never updated.
+type SeriesActivity struct {
+	Ident      Ident
+	Created    time.Time
+	LastUpdate time.Time
+}
+
+// SeriesActivityLister is implemented by serdes that can list DSs
+// by when they were created or last updated, so that new
+// cardinality and series which stopped reporting can be found. The
+// results are paginated by offset and limit.
+type SeriesActivityLister interface {
+	// RecentSeries lists the DSs created at or after since, newest
+	// first.
+	RecentSeries(since time.Time, offset, limit int) ([]SeriesActivity, error)
+	// StaleSeries lists the DSs not updated since before (including
+	// those never updated and created before it), stalest first.
+	StaleSeries(before time.Time, offset, limit int) ([]SeriesActivity, error)
+}
+
+// pageActivity sorts the list by less and returns the requested page
+// of it.
+func pageActivity(list []SeriesActivity, less func(a, b *SeriesActivity) bool, offset, limit int) []SeriesActivity {
+	sort.Slice(list, func(i, j int) bool {
+		if less(&list[i], &list[j]) {
+			return true
+		} else if less(&list[j], &list[i]) {
+			return false
+		}
+		return list[i].Ident.String() < list[j].Ident.String()
+	})
+	if offset >= len(list) {
+		return nil
+	}
+	list = list[offset:]
+	if limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
+
+func (m *memSerDe) RecentSeries(since time.Time, offset, limit int) ([]SeriesActivity, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var result []SeriesActivity
+	for key, ds := range m.byIdent {
+		if created := m.created[key]; !created.Before(since) {
+			result = append(result, SeriesActivity{Ident: ds.Ident(), Created: created, LastUpdate: ds.LastUpdate()})
+		}
+	}
+	return pageActivity(result, func(a, b *SeriesActivity) bool { return a.Created.After(b.Created) }, offset, limit), nil
+}
+
+func (m *memSerDe) StaleSeries(before time.Time, offset, limit int) ([]SeriesActivity, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var result []SeriesActivity
+	for key, ds := range m.byIdent {
+		lu, created := ds.LastUpdate(), m.created[key]
+		if (!lu.IsZero() && lu.Before(before)) || (lu.IsZero() && created.Before(before)) {
+			result = append(result, SeriesActivity{Ident: ds.Ident(), Created: created, LastUpdate: lu})
+		}
+	}
+	return pageActivity(result, func(a, b *SeriesActivity) bool { return a.LastUpdate.Before(b.LastUpdate) }, offset, limit), nil
+}
@@ -0,0 +1,77 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func TestMemSerDe_SeriesActivity(t *testing.T) {
+	m := NewMemSerDe()
+	var _ SeriesActivityLister = m
+
+	now := time.Now()
+	spec := &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 10 * time.Minute}},
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if _, err := m.FetchOrCreateDataSource(Ident{"name": name}, spec); err != nil {
+			t.Fatal(err)
+		}
+		// pretend they were created an hour apart, "a" first
+		m.created[Ident{"name": name}.String()] = now.Add(time.Duration(i-3) * time.Hour)
+	}
+	ds := m.byIdent[Ident{"name": "b"}.String()]
+	ds.ProcessDataPoint(1, now.Add(-10*time.Minute))
+
+	names := func(list []SeriesActivity) (result []string) {
+		for _, sa := range list {
+			result = append(result, sa.Ident["name"])
+		}
+		return result
+	}
+	check := func(what string, list []SeriesActivity, err error, expect ...string) {
+		got := names(list)
+		if err != nil || len(got) != len(expect) {
+			t.Errorf("%s: expected %v, got %v (%v)", what, expect, got, err)
+			return
+		}
+		for i := range expect {
+			if got[i] != expect[i] {
+				t.Errorf("%s: expected %v, got %v", what, expect, got)
+				return
+			}
+		}
+	}
+
+	list, err := m.RecentSeries(now.Add(-150*time.Minute), 0, 0)
+	check("RecentSeries", list, err, "c", "b")
+	list, err = m.RecentSeries(now.Add(-5*time.Hour), 1, 1)
+	check("RecentSeries page", list, err, "b")
+	list, err = m.RecentSeries(now.Add(-5*time.Hour), 5, 1)
+	check("RecentSeries past the end", list, err)
+
+	// never updated first, then by last update
+	list, err = m.StaleSeries(now, 0, 0)
+	check("StaleSeries", list, err, "a", "c", "b")
+	list, err = m.StaleSeries(now.Add(-20*time.Minute), 0, 0)
+	check("StaleSeries before the update", list, err, "a", "c")
+}
@@ -66,7 +66,10 @@ type dsRecord struct {
 	identJson  []byte
 	stepMs     int64
 	hbMs       int64
+	dsType     string
+	min, max   float64
 	lastupdate *time.Time
+	lastRaw    float64
 	value      float64
 	durationMs int64
 	created    bool
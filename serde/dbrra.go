@@ -18,7 +18,9 @@ package serde
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
@@ -34,6 +36,8 @@ type DbRoundRobinArchiver interface {
 	Seg() int64
 	Idx() int64
 	BundleId() int64
+	Dirty() bool
+	Checkpoint()
 }
 
 type DbRoundRobinArchive struct {
@@ -44,6 +48,45 @@ type DbRoundRobinArchive struct {
 	pos      int64 // absolute bundle position (seg and idx can be inferred from pos)
 	seg      int64 // segment
 	idx      int64 // array index
+	ckpt     *rraCheckpoint
+}
+
+// rraState is the partially consolidated state of an RRA, i.e. what
+// is stored in its row of the rra table, as opposed to its slots.
+type rraState struct {
+	value, variance, lastKnown float64
+	duration                   time.Duration
+	lastKnownAt                time.Time
+}
+
+func rraStateOf(rra rrd.RoundRobinArchiver) rraState {
+	lkAt, lk := rra.LastKnown()
+	return rraState{
+		value:       rra.Value(),
+		variance:    rra.Variance(),
+		lastKnown:   lk,
+		duration:    rra.Duration(),
+		lastKnownAt: lkAt,
+	}
+}
+
+func sameFloat(a, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+func (s rraState) equal(o rraState) bool {
+	return sameFloat(s.value, o.value) && sameFloat(s.variance, o.variance) && sameFloat(s.lastKnown, o.lastKnown) &&
+		s.duration == o.duration && s.lastKnownAt.Equal(o.lastKnownAt)
+}
+
+// rraCheckpoint is the state of an RRA as it was last loaded from or
+// written to the database. It is shared by the RRA and its copies,
+// because the flusher works on a copy, but it is the original that
+// keeps changing.
+type rraCheckpoint struct {
+	sync.Mutex
+	state rraState
+	valid bool
 }
 
 func (rra *DbRoundRobinArchive) Id() int64       { return rra.id }
@@ -54,6 +97,34 @@ func (rra *DbRoundRobinArchive) Idx() int64      { return rra.idx }
 
 //func (rra *DbRoundRobinArchive) Pos() int64      { return rra.pos }
 
+// Dirty reports whether the partially consolidated state of the RRA
+// (its value, duration, variance and last known value) differs from
+// what was last loaded from or flushed to the database, i.e. whether
+// its row in the rra table needs to be written. An RRA which has
+// never been checkpointed is always dirty. The slots are tracked
+// separately, only those in DPs() have changed.
+func (rra *DbRoundRobinArchive) Dirty() bool {
+	if rra.ckpt == nil {
+		return true
+	}
+	rra.ckpt.Lock()
+	defer rra.ckpt.Unlock()
+	return !rra.ckpt.valid || !rra.ckpt.state.equal(rraStateOf(rra))
+}
+
+// Checkpoint records the current state of the RRA as the one stored
+// in the database, it is called by serde implementations once it has
+// been loaded or written. Since the checkpoint is shared with copies
+// of the RRA, checkpointing a copy also checkpoints the original.
+func (rra *DbRoundRobinArchive) Checkpoint() {
+	if rra.ckpt == nil {
+		rra.ckpt = &rraCheckpoint{}
+	}
+	rra.ckpt.Lock()
+	defer rra.ckpt.Unlock()
+	rra.ckpt.state, rra.ckpt.valid = rraStateOf(rra), true
+}
+
 func segIdxFromPosWidth(pos, width int64) (seg, idx int64) {
 	// Careful: pos is 1-based. but to get a proper 1-based offset
 	// into a segment (idx), we need to start out with a 0-based
@@ -61,6 +132,13 @@ func segIdxFromPosWidth(pos, width int64) (seg, idx int64) {
 	return (pos - 1) / width, (pos-1)%width + 1
 }
 
+// NewDbRoundRobinArchive returns a DbRoundRobinArchive at (1-based)
+// position pos of the RRA bundle bundleId, whose rows are width slots
+// wide. This is mostly useful in serde implementations and tests.
+func NewDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*DbRoundRobinArchive, error) {
+	return newDbRoundRobinArchive(id, width, bundleId, pos, spec)
+}
+
 func newDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*DbRoundRobinArchive, error) {
 	if spec.Span == 0 {
 		return nil, fmt.Errorf("Invalid span: Span cannot be 0.")
@@ -82,6 +160,7 @@ func newDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*
 		pos:                pos,
 		seg:                seg,
 		idx:                idx,
+		ckpt:               &rraCheckpoint{},
 	}
 	return rra, nil
 }
@@ -118,6 +197,7 @@ func (rra *DbRoundRobinArchive) Copy() rrd.RoundRobinArchiver {
 		width:              rra.width,
 		bundleId:           rra.bundleId,
 		pos:                rra.pos,
+		ckpt:               rra.ckpt,
 	}
 }
 
@@ -131,14 +211,19 @@ type rraBundleRecord struct {
 // Representation of a row in the rra table - there is not enough
 // information here to create a proper DbRoundRobinArchive in it.
 type rraRecord struct {
-	id         int64
-	dsId       int64
-	bundleId   int64
-	pos        int64
-	seg        int64
-	idx        int64
-	cf         string
-	xff        float32
-	value      float64
-	durationMs int64
+	id          int64
+	dsId        int64
+	bundleId    int64
+	pos         int64
+	seg         int64
+	idx         int64
+	cf          string
+	xff         float32
+	roundTo     float64
+	gapFill     string
+	value       float64
+	variance    float64
+	durationMs  int64
+	lastKnown   float64
+	lastKnownAt *time.Time
 }
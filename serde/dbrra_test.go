@@ -15,6 +15,13 @@
 
 package serde
 
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
 // // SlotRow()
 // var slot int64
 // rra.width, slot = 10, 20
@@ -31,3 +38,31 @@ package serde
 // if rra.DpsAsPGString(1, 2) != expect {
 // 	t.Errorf("DpsAsPGString() didn't return %q", expect)
 // }
+
+func TestDbRoundRobinArchive_Dirty(t *testing.T) {
+	spec := rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Minute}
+	rra, err := NewDbRoundRobinArchive(1, 10, 1, 1, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rra.Dirty() {
+		t.Errorf("Dirty: an RRA never checkpointed should be dirty")
+	}
+	rra.Checkpoint()
+	if rra.Dirty() {
+		t.Errorf("Dirty: should not be dirty right after Checkpoint")
+	}
+
+	spec.Value, spec.Duration = 1, 5*time.Second
+	rra.RoundRobinArchiver = rrd.NewRoundRobinArchive(spec)
+	if !rra.Dirty() {
+		t.Errorf("Dirty: should be dirty after the value changed")
+	}
+
+	// The flusher checkpoints a copy, which counts for the original
+	cp := rra.Copy().(*DbRoundRobinArchive)
+	cp.Checkpoint()
+	if rra.Dirty() || cp.Dirty() {
+		t.Errorf("Dirty: checkpointing a copy should checkpoint the original")
+	}
+}
@@ -21,8 +21,23 @@ import (
 	"log"
 	"math"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
 )
 
+// groupByAggregates are the SQL aggregates used to group the rows of
+// an RRA into fewer (see series.Series GroupBy) according to its
+// consolidation function. Grouping STDDEV is exact only if the means
+// are the same.
+var groupByAggregates = map[rrd.Consolidation]string{
+	rrd.WMEAN:  "avg(r)",
+	rrd.MAX:    "max(r)",
+	rrd.MIN:    "min(r)",
+	rrd.LAST:   "(array_agg(r ORDER BY tg DESC) FILTER (WHERE r IS NOT NULL))[1]",
+	rrd.SUM:    "sum(r)",
+	rrd.STDDEV: "sqrt(avg(r*r))",
+}
+
 type dbSeriesV2 struct {
 	ds  DbDataSourcer
 	rra DbRoundRobinArchiver
@@ -46,6 +61,9 @@ type dbSeriesV2 struct {
 
 	latest time.Time
 
+	// How unknown slots are consolidated
+	nulls rrd.NullPolicy
+
 	// Alias
 	alias string
 }
@@ -86,6 +104,12 @@ func (dps *dbSeriesV2) MaxPoints(n ...int64) int64 {
 
 func (dps *dbSeriesV2) Align() {}
 
+// SetNullPolicy makes unknown slots count as zeros when they are
+// grouped if nulls is rrd.NullAsZero, see series.NullPolicer.
+func (dps *dbSeriesV2) SetNullPolicy(nulls rrd.NullPolicy) {
+	dps.nulls = nulls
+}
+
 func (dps *dbSeriesV2) Alias(s ...string) string {
 	if len(s) > 0 {
 		dps.alias = s[0]
@@ -110,7 +134,7 @@ func (dps *dbSeriesV2) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 		finalGroupByMs = finalGroupByMs/groupByMs*groupByMs + groupByMs
 	} else if dps.maxPoints != 0 {
 		// If maxPoints was specified, then calculate group by interval
-		finalGroupByMs = (dps.to.Unix() - dps.from.Unix()) * 1000 / dps.maxPoints
+		finalGroupByMs = dps.to.Sub(dps.from).Nanoseconds() / 1e6 / dps.maxPoints
 		finalGroupByMs = finalGroupByMs/rraStepMs*rraStepMs + rraStepMs
 	} else {
 		// Otherwise, group by will equal the rrastep
@@ -118,7 +142,7 @@ func (dps *dbSeriesV2) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 	}
 
 	if finalGroupByMs == 0 {
-		finalGroupByMs = 1000 // TODO Why would this happen (it did)?
+		finalGroupByMs = rraStepMs // TODO Why would this happen (it did)?
 	}
 
 	// Ensure that the true group by interval is reflected in the series.
@@ -141,7 +165,11 @@ func (dps *dbSeriesV2) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 		log.Printf("seriesQuerySqlUsingViewAndSeries() sql3 %v %v %v %v %v %v %v %v", aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs),
 			dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
 	}
-	rows, err = dps.db.sql3.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
+	sql3 := dps.db.sql3
+	if dps.nulls == rrd.NullAsZero {
+		sql3 = dps.db.sql3Zero
+	}
+	rows, err = sql3[dps.rra.Consolidation()].Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
 
 	if err != nil {
 		log.Printf("seriesQuery(): error %v", err)
@@ -151,6 +179,25 @@ func (dps *dbSeriesV2) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 	return rows, nil
 }
 
+// ConsolidateBy switches the series to the RRA of the same DS with
+// the same step and the cf consolidation function, see
+// series.Consolidator.
+func (dps *dbSeriesV2) ConsolidateBy(cf rrd.Consolidation) bool {
+	if dps.rra.Consolidation() == cf {
+		return true
+	}
+	for _, rra := range dps.ds.RRAs() {
+		if drra, ok := rra.(DbRoundRobinArchiver); ok && rra.Step() == dps.rra.Step() && rra.Consolidation() == cf {
+			if dps.rows != nil {
+				dps.Close()
+			}
+			dps.rra = drra
+			return true
+		}
+	}
+	return false
+}
+
 func (dps *dbSeriesV2) Next() bool {
 
 	if dps.rows == nil { // First Next()
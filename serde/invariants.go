@@ -0,0 +1,174 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// The invariants checked by an InvariantChecker.
+const (
+	// The latest of an RRA (and the lastupdate of its DS) is not in
+	// the future and the latest is on a step boundary.
+	InvariantLatestBounds = "latest-bounds"
+
+	// There is no slot beyond the size of the RRA, and no more
+	// points in a row than the width of the bundle.
+	InvariantSlotCount = "slot-count"
+
+	// An RRA which has a latest, i.e. has been written to, has at
+	// least one value which is not NaN. Only RRAs which cannot
+	// store NaN, i.e. with a zero xff and a gap fill, are checked,
+	// for the others all NaN is a valid state. This one cannot be
+	// repaired, the data is gone.
+	InvariantNaNOnly = "nan-only"
+)
+
+// A Violation is a broken invariant.
+type Violation struct {
+	Invariant string // one of the Invariant* constants
+	DSId      int64  // zero if it concerns a bundle segment
+	RRAId     int64  // zero if it concerns the whole DS
+	BundleId  int64
+	Seg       int64
+	Detail    string
+	Repaired  bool
+}
+
+func (v Violation) String() string {
+	var what string
+	switch {
+	case v.RRAId != 0:
+		what = fmt.Sprintf("DS %d RRA %d", v.DSId, v.RRAId)
+	case v.DSId != 0:
+		what = fmt.Sprintf("DS %d", v.DSId)
+	default:
+		what = fmt.Sprintf("bundle %d segment %d", v.BundleId, v.Seg)
+	}
+	s := fmt.Sprintf("%s: %s: %s", v.Invariant, what, v.Detail)
+	if v.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// InvariantChecker is implemented by serdes that can scan the stored
+// data sources for violated invariants, which are otherwise only
+// noticed as odd looking graphs. If repair is true, what can be
+// repaired is. Repairing must not be done while data sources are
+// being flushed.
+type InvariantChecker interface {
+	CheckInvariants(now time.Time, repair bool) ([]Violation, error)
+}
+
+// CheckLatest returns an error if latest (which may be zero) is after
+// now (give or take a step) or not on a step boundary.
+func CheckLatest(latest time.Time, step time.Duration, now time.Time) error {
+	if latest.IsZero() || step <= 0 {
+		return nil
+	}
+	if latest.After(now.Add(step)) {
+		return fmt.Errorf("latest %v is in the future", latest)
+	}
+	if latest.UnixNano()%step.Nanoseconds() != 0 {
+		return fmt.Errorf("latest %v is not a multiple of step %v", latest, step)
+	}
+	return nil
+}
+
+// CheckDSInvariants checks a DS and all its RRAs in memory, see
+// CheckRRAInvariants.
+func CheckDSInvariants(ds rrd.DataSourcer, now time.Time) []Violation {
+	var (
+		result []Violation
+		id     int64
+	)
+	if dbds, ok := ds.(DbDataSourcer); ok {
+		id = dbds.Id()
+	}
+	if lu := ds.LastUpdate(); lu.After(now.Add(ds.Step())) {
+		result = append(result, Violation{Invariant: InvariantLatestBounds, DSId: id, Detail: fmt.Sprintf("lastupdate %v is in the future", lu)})
+	}
+	for _, rra := range ds.RRAs() {
+		for _, v := range CheckRRAInvariants(rra, now) {
+			v.DSId = id
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// CheckRRAInvariants checks an RRA in memory, e.g. after random
+// updates in a property-based test or one fetched from a
+// database. Since the points of a DbRoundRobinArchive are only those
+// not yet flushed, InvariantNaNOnly is only checked for others.
+func CheckRRAInvariants(rra rrd.RoundRobinArchiver, now time.Time) []Violation {
+	var (
+		result []Violation
+		v      Violation
+	)
+	if drra, ok := rra.(DbRoundRobinArchiver); ok {
+		v = Violation{RRAId: drra.Id(), BundleId: drra.BundleId(), Seg: drra.Seg()}
+		if drra.Idx() < 1 || drra.Idx() > drra.Width() {
+			v.Invariant, v.Detail = InvariantSlotCount, fmt.Sprintf("index %d is outside of width %d", drra.Idx(), drra.Width())
+			result = append(result, v)
+		}
+	}
+
+	if err := CheckLatest(rra.Latest(), rra.Step(), now); err != nil {
+		v.Invariant, v.Detail = InvariantLatestBounds, err.Error()
+		result = append(result, v)
+	}
+
+	dps := rra.DPs()
+	if int64(len(dps)) > rra.Size() {
+		v.Invariant, v.Detail = InvariantSlotCount, fmt.Sprintf("%d slots exceed size %d", len(dps), rra.Size())
+		result = append(result, v)
+	}
+	for i := range dps {
+		if i < 0 || i >= rra.Size() {
+			v.Invariant, v.Detail = InvariantSlotCount, fmt.Sprintf("slot %d is outside of size %d", i, rra.Size())
+			result = append(result, v)
+			break
+		}
+	}
+
+	if _, ok := rra.(DbRoundRobinArchiver); !ok && !rra.Latest().IsZero() && len(dps) > 0 && !mayBeNaNOnly(rra) {
+		nan := true
+		for _, val := range dps {
+			if !math.IsNaN(val) {
+				nan = false
+				break
+			}
+		}
+		if nan {
+			v.Invariant, v.Detail = InvariantNaNOnly, fmt.Sprintf("all %d slots are NaN", len(dps))
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// mayBeNaNOnly returns true if the RRA can legitimately hold nothing
+// but NaNs: a slot is NaN when less than xff of it is known, and a
+// gap is NaN unless it is filled.
+func mayBeNaNOnly(rra rrd.RoundRobinArchiver) bool {
+	return rra.Xff() > 0 || rra.GapFill() == rrd.GapNaN
+}
@@ -0,0 +1,125 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// Any sequence of data points, as long as they arrive in time, leaves
+// a DS which satisfies all the invariants.
+func TestCheckDSInvariants_quick(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		ds := NewDbDataSource(1, Ident{"name": "foo"}, rrd.NewDataSource(rrd.DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: time.Hour,
+			RRAs: []rrd.RRASpec{
+				{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 10 * time.Minute},
+				{Function: rrd.MAX, Step: time.Minute, Span: time.Hour, Xff: 0.5},
+				// checked for nan-only, it can never be all NaN
+				{Function: rrd.LAST, Step: time.Minute, Span: time.Hour, GapFill: rrd.GapZero},
+			},
+		}))
+		ts := start
+		for i := r.Intn(500); i > 0; i-- {
+			ts = ts.Add(time.Duration(r.Int63n(int64(30 * time.Second))))
+			ds.ProcessDataPoint(r.NormFloat64()*100, ts)
+		}
+		if vv := CheckDSInvariants(ds, ts); len(vv) > 0 {
+			t.Logf("seed %d: %v", seed, vv)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{Rand: rand.New(rand.NewSource(1))}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckInvariants_mem(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	m := NewMemSerDe()
+	ds, _ := m.FetchOrCreateDataSource(Ident{"name": "foo"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Minute}},
+	})
+	ds.ProcessDataPoint(1, now.Add(-20*time.Second))
+	ds.ProcessDataPoint(2, now.Add(-5*time.Second))
+
+	var ic InvariantChecker = m
+	if vv, err := ic.CheckInvariants(now, false); err != nil || len(vv) > 0 {
+		t.Errorf("CheckInvariants: expected no violations, got %v %v", vv, err)
+	}
+	// as if the clock had been set back
+	vv, _ := ic.CheckInvariants(now.Add(-time.Hour), false)
+	if len(vv) != 2 || vv[0].Invariant != InvariantLatestBounds || vv[1].Invariant != InvariantLatestBounds {
+		t.Errorf("CheckInvariants: expected lastupdate and latest in the future, got %v", vv)
+	}
+}
+
+func TestCheckRRAInvariants(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	rra := rrd.NewRoundRobinArchive(rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     10 * time.Second,
+		Span:     time.Minute,
+		Latest:   now.Add(-5 * time.Second), // not on a boundary
+		DPs:      map[int64]float64{1: 0, 9: 0},
+	})
+	vv := CheckRRAInvariants(rra, now)
+	if len(vv) != 2 || vv[0].Invariant != InvariantLatestBounds || vv[1].Invariant != InvariantSlotCount {
+		t.Errorf("CheckRRAInvariants: expected latest and slot violations, got %v", vv)
+	}
+
+	rra = rrd.NewRoundRobinArchive(rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     10 * time.Second,
+		Span:     time.Minute,
+		Latest:   now,
+		DPs:      map[int64]float64{1: math.NaN(), 2: math.NaN()},
+	})
+	vv = CheckRRAInvariants(rra, now)
+	if len(vv) != 0 {
+		t.Errorf("CheckRRAInvariants: all NaN is valid without a gap fill, got %v", vv)
+	}
+
+	for _, xff := range []float32{0, 0.5} {
+		rra = rrd.NewRoundRobinArchive(rrd.RRASpec{
+			Function: rrd.WMEAN,
+			Step:     10 * time.Second,
+			Span:     time.Minute,
+			Xff:      xff,
+			GapFill:  rrd.GapZero,
+			Latest:   now,
+			DPs:      map[int64]float64{1: math.NaN(), 2: math.NaN()},
+		})
+		vv = CheckRRAInvariants(rra, now)
+		if xff == 0 && (len(vv) != 1 || vv[0].Invariant != InvariantNaNOnly) {
+			t.Errorf("CheckRRAInvariants: expected nan-only, got %v", vv)
+		} else if xff > 0 && len(vv) != 0 {
+			t.Errorf("CheckRRAInvariants: all NaN is valid with xff %v, got %v", xff, vv)
+		}
+	}
+}
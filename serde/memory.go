@@ -16,6 +16,7 @@
 package serde
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,21 +26,155 @@ import (
 
 type memSerDe struct {
 	*sync.RWMutex
-	byIdent map[string]*DbDataSource
-	lastId  int64
+	byIdent  map[string]*DbDataSource
+	created  map[string]time.Time     // see RecentSeries
+	archived map[string][]*memArchive // see FlushDataSource
+	lastId   int64
+}
+
+// memArchive is the flushed data points of an RRA, XOR-compressed
+// (see rrd.CompressDPs).
+type memArchive struct {
+	latest time.Time
+	data   []byte
 }
 
 // Returns a SerDe which keeps everything in memory.
 func NewMemSerDe() *memSerDe {
 	return &memSerDe{
-		RWMutex: &sync.RWMutex{},
-		byIdent: make(map[string]*DbDataSource),
+		RWMutex:  &sync.RWMutex{},
+		byIdent:  make(map[string]*DbDataSource),
+		created:  make(map[string]time.Time),
+		archived: make(map[string][]*memArchive),
+	}
+}
+
+func (m *memSerDe) Fetcher() Fetcher { return m }
+func (m *memSerDe) Flusher() Flusher { return m }
+
+// FlushDataSource compresses the data points of the RRAs of ds into
+// the archive of the DS, on top of what was flushed before. Once
+// flushed, the DS RRAs can be cleared (see rrd.DataSource ClearRRAs)
+// to free the memory, FetchSeries and FetchDataPoints decompress the
+// archive as needed.
+func (m *memSerDe) FlushDataSource(ds rrd.DataSourcer) error {
+	dbds, ok := ds.(DbDataSourcer)
+	if !ok {
+		return fmt.Errorf("FlushDataSource: ds must be a DbDataSourcer")
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	key := dbds.Ident().String()
+	rras := ds.RRAs()
+	arcs := m.archived[key]
+	if len(arcs) != len(rras) {
+		arcs = make([]*memArchive, len(rras))
+	}
+	for i, rra := range rras {
+		if rra.PointCount() == 0 {
+			continue
+		}
+		dps, err := archivedDPs(arcs[i], rra)
+		if err != nil {
+			return fmt.Errorf("FlushDataSource: %v", err)
+		}
+		latest := rra.Latest()
+		if arcs[i] != nil && arcs[i].latest.After(latest) {
+			latest = arcs[i].latest
+		}
+		merged := rrd.NewRoundRobinArchive(rrd.RRASpec{
+			Step:   rra.Step(),
+			Span:   time.Duration(rra.Size()) * rra.Step(),
+			Latest: latest,
+			DPs:    dps,
+		})
+		arcs[i] = &memArchive{latest: latest, data: rrd.CompressDPs(merged)}
+	}
+	m.archived[key] = arcs
+	return nil
+}
+
+// archivedDPs returns the data points of arc (which may be nil) which
+// are still within rra, overlaid with the (newer) data points of rra.
+func archivedDPs(arc *memArchive, rra rrd.RoundRobinArchiver) (map[int64]float64, error) {
+	dps := make(map[int64]float64, len(rra.DPs()))
+	if arc != nil {
+		old, err := rrd.DecompressDPs(arc.data, arc.latest, rra.Step(), rra.Size())
+		if err != nil {
+			return nil, err
+		}
+		latest := rra.Latest()
+		if arc.latest.After(latest) {
+			latest = arc.latest
+		}
+		begins := latest.Add(-time.Duration(rra.Size()) * rra.Step())
+		for i, v := range old {
+			if rrd.SlotTime(i, arc.latest, rra.Step(), rra.Size()).After(begins) {
+				dps[i] = v
+			}
+		}
+	}
+	for i, v := range rra.DPs() {
+		dps[i] = v
+	}
+	return dps, nil
+}
+
+// withArchive returns a copy of rra with the archived data points
+// added to it, or rra itself if there is no archive.
+func withArchive(arc *memArchive, rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	if arc == nil {
+		return rra, nil
+	}
+	dps, err := archivedDPs(arc, rra)
+	if err != nil {
+		return nil, err
+	}
+	spec := rrd.RRASpec{
+		Function: rra.Consolidation(),
+		Step:     rra.Step(),
+		Span:     time.Duration(rra.Size()) * rra.Step(),
+		Xff:      rra.Xff(),
+		RoundTo:  rra.RoundTo(),
+		GapFill:  rra.GapFill(),
+		Latest:   rra.Latest(),
+		Value:    rra.Value(),
+		Duration: rra.Duration(),
+		Variance: rra.Variance(),
+		DPs:      dps,
 	}
+	if arc.latest.After(spec.Latest) {
+		spec.Latest = arc.latest
+	}
+	spec.LastKnownAt, spec.LastKnown = rra.LastKnown()
+	return rrd.NewRoundRobinArchive(spec), nil
 }
 
-func (m *memSerDe) Fetcher() Fetcher                         { return m }
-func (m *memSerDe) Flusher() Flusher                         { return nil } // Flushing not supported
-func (m *memSerDe) FlushDataSource(ds rrd.DataSourcer) error { return nil }
+// FetchDataPoints returns a copy of the DS with the flushed data
+// points of its RRAs, see DataPointFetcher.
+func (m *memSerDe) FetchDataPoints(ident Ident) (rrd.DataSourcer, error) {
+	m.RLock()
+	defer m.RUnlock()
+	ds, ok := m.byIdent[ident.String()]
+	if !ok {
+		return nil, nil
+	}
+	cpy := ds.Copy().(*DbDataSource)
+	arcs := m.archived[ident.String()]
+	if len(arcs) != len(cpy.RRAs()) {
+		return cpy.DataSourcer, nil
+	}
+	rras := make([]rrd.RoundRobinArchiver, len(arcs))
+	for i, rra := range cpy.RRAs() {
+		var err error
+		if rras[i], err = withArchive(arcs[i], rra); err != nil {
+			return nil, fmt.Errorf("FetchDataPoints: %v", err)
+		}
+	}
+	cpy.SetRRAs(rras)
+	return cpy.DataSourcer, nil
+}
 
 type srRow struct {
 	ident Ident
@@ -70,8 +205,20 @@ func (m *memSerDe) Search(_ SearchQuery) (SearchResult, error) {
 	return sr, nil
 }
 
-func (*memSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
-	return series.NewRRASeries(ds.RRAs()[0]), nil
+func (m *memSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	rra := ds.RRAs()[0]
+	if dbds, ok := ds.(DbDataSourcer); ok {
+		m.RLock()
+		arcs := m.archived[dbds.Ident().String()]
+		m.RUnlock()
+		if len(arcs) > 0 {
+			var err error
+			if rra, err = withArchive(arcs[0], rra); err != nil {
+				return nil, fmt.Errorf("FetchSeries: %v", err)
+			}
+		}
+	}
+	return series.NewRRASeries(rra), nil
 }
 
 func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
@@ -84,6 +231,18 @@ func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 	return result, nil
 }
 
+// CheckInvariants checks all the DSs, see CheckDSInvariants. There
+// is nothing to repair in memory, repair is ignored.
+func (m *memSerDe) CheckInvariants(now time.Time, _ bool) ([]Violation, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var result []Violation
+	for _, ds := range m.byIdent {
+		result = append(result, CheckDSInvariants(ds, now)...)
+	}
+	return result, nil
+}
+
 func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -94,5 +253,19 @@ func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	m.lastId++
 	ds := NewDbDataSource(m.lastId, ident, rrd.NewDataSource(*dsSpec))
 	m.byIdent[ident.String()] = ds
+	m.created[ident.String()] = time.Now()
 	return ds, nil
 }
+
+func (m *memSerDe) DeleteDataSource(ident Ident) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := ident.String()
+	if _, ok := m.byIdent[key]; !ok {
+		return false, nil
+	}
+	delete(m.byIdent, key)
+	delete(m.created, key)
+	delete(m.archived, key)
+	return true, nil
+}
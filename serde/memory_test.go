@@ -0,0 +1,98 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_memSerDe_DeleteDataSource(t *testing.T) {
+	m := NewMemSerDe()
+	foo := Ident{"name": "foo"}
+	m.FetchOrCreateDataSource(foo, &rrd.DSSpec{Step: time.Second})
+	if ok, err := m.DeleteDataSource(foo); !ok || err != nil {
+		t.Errorf("DeleteDataSource: %v %v", ok, err)
+	}
+	if len(m.byIdent) != 0 || len(m.created) != 0 {
+		t.Errorf("DeleteDataSource: the DS is still there")
+	}
+	if ok, _ := m.DeleteDataSource(foo); ok {
+		t.Errorf("DeleteDataSource: expected false for a DS that does not exist")
+	}
+}
+
+func Test_memSerDe_FlushDataSource(t *testing.T) {
+	m := NewMemSerDe()
+	foo := Ident{"name": "foo"}
+	step := 10 * time.Second
+	spec := &rrd.DSSpec{Step: step, RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: 5 * step}}}
+	ds, _ := m.FetchOrCreateDataSource(foo, spec)
+
+	// 1, 2, 3 flushed and cleared, then 4, 5, 6 flushed and
+	// cleared, the first one is no longer within the RRA
+	for i := 0; i <= 6; i++ {
+		ds.ProcessDataPoint(float64(i), time.Unix(1000+int64(i)*10, 0))
+		if i == 3 || i == 6 {
+			if err := m.FlushDataSource(ds); err != nil {
+				t.Fatalf("FlushDataSource: %v", err)
+			}
+			ds.ClearRRAs()
+		}
+	}
+	if ds.RRAs()[0].PointCount() != 0 {
+		t.Errorf("ClearRRAs: points left in memory")
+	}
+
+	dpds, err := m.FetchDataPoints(foo)
+	if err != nil {
+		t.Fatalf("FetchDataPoints: %v", err)
+	}
+	rra := dpds.RRAs()[0]
+	var got []float64
+	for it := rrd.NewSlotIterator(rra); it.Next(); {
+		got = append(got, it.Value())
+	}
+	if exp := []float64{2, 3, 4, 5, 6}; fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Errorf("FetchDataPoints: expected %v, got %v", exp, got)
+	}
+	if !rra.Latest().Equal(time.Unix(1060, 0)) {
+		t.Errorf("FetchDataPoints: latest %v", rra.Latest())
+	}
+
+	s, err := m.FetchSeries(ds, time.Unix(1000, 0), time.Unix(1060, 0), 0)
+	if err != nil {
+		t.Fatalf("FetchSeries: %v", err)
+	}
+	n := 0
+	for s.Next() {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("FetchSeries: expected 5 points, got %d", n)
+	}
+
+	if err := m.FlushDataSource(rrd.NewDataSource(*spec)); err == nil {
+		t.Errorf("FlushDataSource: no error on a DS without an ident")
+	}
+	m.DeleteDataSource(foo)
+	if len(m.archived) != 0 {
+		t.Errorf("DeleteDataSource: the archive is still there")
+	}
+}
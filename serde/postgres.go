@@ -21,8 +21,10 @@ package serde
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"strings"
@@ -37,7 +39,9 @@ type pgvSerDe struct {
 	dbConn *sql.DB
 	prefix string
 
-	sql3, sql6                   *sql.Stmt
+	sql3                         map[rrd.Consolidation]*sql.Stmt
+	sql3Zero                     map[rrd.Consolidation]*sql.Stmt // sql3 with unknown slots as 0
+	sql6                         *sql.Stmt
 	sqlSelectDSByIdent           *sql.Stmt
 	sqlInsertDS                  *sql.Stmt
 	sqlUpdateDS                  *sql.Stmt
@@ -147,39 +151,53 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 
-	if p.sqlUpdateRRA, err = p.dbConn.Prepare(fmt.Sprintf("UPDATE %[1]srra rra SET value = $1, duration_ms = $2 WHERE id = $3", p.prefix)); err != nil {
+	if p.sqlUpdateRRA, err = p.dbConn.Prepare(fmt.Sprintf("UPDATE %[1]srra rra SET value = $1, duration_ms = $2, variance = $3, last_known = $4, last_known_at = $5 WHERE id = $6", p.prefix)); err != nil {
 		return err
 	}
-	if p.sql3, err = p.dbConn.Prepare(fmt.Sprintf("SELECT max(tg) mt, avg(r) ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
-		"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
-		" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
-		p.prefix)); err != nil {
-		return err
+	p.sql3 = make(map[rrd.Consolidation]*sql.Stmt, len(groupByAggregates))
+	p.sql3Zero = make(map[rrd.Consolidation]*sql.Stmt, len(groupByAggregates))
+	for cf, agg := range groupByAggregates {
+		if p.sql3[cf], err = p.dbConn.Prepare(fmt.Sprintf("SELECT max(tg) mt, %[2]s ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
+			"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
+			" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
+			p.prefix, agg)); err != nil {
+			return err
+		}
+		// Same, but an unknown slot (a NaN or no row at all) is
+		// consolidated as a 0. Slots before $6 are not part of the
+		// series, they only align the first group.
+		if p.sql3Zero[cf], err = p.dbConn.Prepare(fmt.Sprintf("SELECT max(tg) mt, %[2]s ar FROM (SELECT tg, coalesce(nullif(s.r, 'NaN'), 0) AS r "+
+			"FROM generate_series($1, $2, ($3)::interval) AS tg "+
+			"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
+			" AND t >= $6 AND t <= $7) s ON tg = s.t WHERE tg >= $6) z GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
+			p.prefix, agg)); err != nil {
+			return err
+		}
 	}
 	if p.sqlSelectDSByIdent, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT id, ident, step_ms, heartbeat_ms, lastupdate, value, duration_ms, false AS created FROM  %[1]sds WHERE ident = $1",
+		"SELECT id, ident, step_ms, heartbeat_ms, ds_type, min_value, max_value, lastupdate, last_raw, value, duration_ms, false AS created FROM  %[1]sds WHERE ident = $1",
 		p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlInsertDS, err = p.dbConn.Prepare(fmt.Sprintf(
 		// Here created is a trick to determine whether this was an INSERT or an UPDATE
-		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms) VALUES ($1, $2, $3) "+
+		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms, ds_type, min_value, max_value) VALUES ($1, $2, $3, $4, $5, $6) "+
 			"ON CONFLICT (ident) DO UPDATE SET created = false "+
-			"RETURNING id, ident, step_ms, heartbeat_ms, lastupdate, value, duration_ms, created", p.prefix)); err != nil {
+			"RETURNING id, ident, step_ms, heartbeat_ms, ds_type, min_value, max_value, lastupdate, last_raw, value, duration_ms, created", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlInsertRRA, err = p.dbConn.Prepare(fmt.Sprintf(
-		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff) VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff, round_to, gap_fill) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) "+
 			"ON CONFLICT (ds_id, rra_bundle_id, cf) DO UPDATE SET ds_id = rra.ds_id "+
-			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, value, duration_ms", p.prefix)); err != nil {
+			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, round_to, gap_fill, value, variance, duration_ms, last_known, last_known_at", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlSelectRRAsByDsId, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, value, duration_ms FROM %[1]srra rra WHERE ds_id = $1 ",
+		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, round_to, gap_fill, value, variance, duration_ms, last_known, last_known_at FROM %[1]srra rra WHERE ds_id = $1 ",
 		p.prefix)); err != nil {
 		return err
 	}
-	if p.sqlUpdateDS, err = p.dbConn.Prepare(fmt.Sprintf("UPDATE %[1]sds SET lastupdate = $1, value = $2, duration_ms = $3 WHERE id = $4", p.prefix)); err != nil {
+	if p.sqlUpdateDS, err = p.dbConn.Prepare(fmt.Sprintf("UPDATE %[1]sds SET lastupdate = $1, value = $2, duration_ms = $3, last_raw = $4 WHERE id = $5", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlSelectRRABundleByStepSize, err = p.dbConn.Prepare(fmt.Sprintf(
@@ -213,6 +231,10 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 
 const PgSegmentWidth = 200 // TODO Make me configurable
 
+// Approximate per row overhead of the ts table in bytes. This was
+// determined by way of experimentation, it's probably wrong.
+const PgRowOverhead = 447
+
 func (p *pgvSerDe) createTablesIfNotExist() error {
 	create_sql := `
        CREATE TABLE IF NOT EXISTS %[1]sds (
@@ -220,13 +242,43 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        ident JSONB NOT NULL DEFAULT '{}' CONSTRAINT nonempty_ident CHECK (ident <> '{}'),
        step_ms BIGINT NOT NULL,
        heartbeat_ms BIGINT NOT NULL,
+       ds_type TEXT NOT NULL DEFAULT 'GAUGE',
+       min_value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
+       max_value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        lastupdate TIMESTAMPTZ,
+       last_raw DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        duration_ms BIGINT NOT NULL DEFAULT 0,
-       created BOOL NOT NULL DEFAULT true);
+       created BOOL NOT NULL DEFAULT true,
+       created_at TIMESTAMPTZ DEFAULT now());
+
+       -- created_at was added later, in existing tables it is NULL
+       -- (i.e. unknown) for the DSs created before
+       DO $$ BEGIN
+         ALTER TABLE %[1]sds ADD COLUMN created_at TIMESTAMPTZ;
+         ALTER TABLE %[1]sds ALTER COLUMN created_at SET DEFAULT now();
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
+
+       -- ds_type and last_raw were added later, existing DSs are GAUGE
+       DO $$ BEGIN
+         ALTER TABLE %[1]sds ADD COLUMN ds_type TEXT NOT NULL DEFAULT 'GAUGE';
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
+       DO $$ BEGIN
+         ALTER TABLE %[1]sds ADD COLUMN last_raw DOUBLE PRECISION NOT NULL DEFAULT 'NaN';
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
+       -- so were min_value and max_value, NaN is no limit
+       DO $$ BEGIN
+         ALTER TABLE %[1]sds ADD COLUMN min_value DOUBLE PRECISION NOT NULL DEFAULT 'NaN';
+         ALTER TABLE %[1]sds ADD COLUMN max_value DOUBLE PRECISION NOT NULL DEFAULT 'NaN';
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_ds_ident_uniq ON %[1]sds (ident);
        CREATE INDEX IF NOT EXISTS %[1]sidx_ds_ident ON %[1]sds USING gin(ident);
+       CREATE INDEX IF NOT EXISTS %[1]sidx_ds_created_at ON %[1]sds (created_at);
 
        CREATE TABLE IF NOT EXISTS %[1]srra_bundle (
        id SERIAL NOT NULL PRIMARY KEY,
@@ -253,8 +305,32 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL,
        idx INT NOT NULL,
        xff REAL NOT NULL DEFAULT 0,
+       round_to DOUBLE PRECISION NOT NULL DEFAULT 0,
+       gap_fill TEXT NOT NULL DEFAULT 'NAN',
        value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
-       duration_ms BIGINT NOT NULL DEFAULT 0);
+       variance DOUBLE PRECISION NOT NULL DEFAULT 0,
+       duration_ms BIGINT NOT NULL DEFAULT 0,
+       last_known DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
+       last_known_at TIMESTAMPTZ);
+
+       -- round_to was added later, existing tables need the column
+       -- (ADD COLUMN IF NOT EXISTS requires 9.6)
+       DO $$ BEGIN
+         ALTER TABLE %[1]srra ADD COLUMN round_to DOUBLE PRECISION NOT NULL DEFAULT 0;
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
+       -- so was variance (of the partial value of a STDDEV RRA)
+       DO $$ BEGIN
+         ALTER TABLE %[1]srra ADD COLUMN variance DOUBLE PRECISION NOT NULL DEFAULT 0;
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
+       -- and gap_fill with the last known slot it needs
+       DO $$ BEGIN
+         ALTER TABLE %[1]srra ADD COLUMN gap_fill TEXT NOT NULL DEFAULT 'NAN';
+         ALTER TABLE %[1]srra ADD COLUMN last_known DOUBLE PRECISION NOT NULL DEFAULT 'NaN';
+         ALTER TABLE %[1]srra ADD COLUMN last_known_at TIMESTAMPTZ;
+       EXCEPTION WHEN duplicate_column THEN NULL;
+       END $$;
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_rra_bundle_id ON %[1]srra (ds_id, rra_bundle_id, cf);
 
@@ -272,19 +348,22 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
 	} else {
 		rows.Close()
 	}
+	// The views are replaced, so that existing ones get the millisecond
+	// (rather than whole second) epoch of latest needed by sub-second
+	// steps.
 	create_sql = `
 -- normal view
-CREATE VIEW %[1]stv AS
+CREATE OR REPLACE VIEW %[1]stv AS
   SELECT rra.ds_id AS ds_id, rra.id AS rra_id, rra_bundle.step_ms AS step_ms,
          rra_latest.latest[rra.idx] - INTERVAL '1 MILLISECOND' * rra_bundle.step_ms *
-           MOD(rra_bundle.size + MOD(EXTRACT(EPOCH FROM rra_latest.latest[rra.idx])::BIGINT*1000/rra_bundle.step_ms, rra_bundle.size) - i, rra_bundle.size) AS t,
+           MOD(rra_bundle.size + MOD(ROUND(EXTRACT(EPOCH FROM rra_latest.latest[rra.idx])*1000)::BIGINT/rra_bundle.step_ms, rra_bundle.size) - i, rra_bundle.size) AS t,
          dp[rra.idx] AS r
    FROM %[1]srra AS rra
    JOIN %[1]srra_bundle AS rra_bundle ON rra_bundle.id = rra.rra_bundle_id
    JOIN %[1]srra_latest AS rra_latest ON rra_latest.rra_bundle_id = rra_bundle.id AND rra_latest.seg = rra.seg
    JOIN %[1]sts AS ts ON ts.rra_bundle_id = rra_bundle.id AND ts.seg = rra.seg;
 -- debug view
-CREATE VIEW %[1]stvd AS
+CREATE OR REPLACE VIEW %[1]stvd AS
   SELECT
       ds_id
     , rra_id
@@ -303,14 +382,14 @@ CREATE VIEW %[1]stvd AS
         rra.ds_id AS ds_id
        ,rra.id AS rra_id
        ,rra_latest.latest[rra.idx] - '00:00:00.001'::interval * rra_bundle.step_ms::double precision *
-          mod(rra_bundle.size + mod(date_part('epoch'::text, rra_latest.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) -
+          mod(rra_bundle.size + mod(round(date_part('epoch'::text, rra_latest.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) -
           ts.i, rra_bundle.size::bigint)::double precision AS t
        ,ts.dp[rra.idx] AS r
        ,'00:00:00.001'::interval * rra_bundle.step_ms::double precision AS step
        ,i AS i
-       ,mod(date_part('epoch'::text, rra_latest.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) AS last_i
-       ,date_part('epoch'::text, rra_latest.latest[rra.idx])::bigint * 1000 AS last_t
-       ,mod(rra_bundle.size + mod(date_part('epoch'::text, rra_latest.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) -
+       ,mod(round(date_part('epoch'::text, rra_latest.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) AS last_i
+       ,round(date_part('epoch'::text, rra_latest.latest[rra.idx]) * 1000)::bigint AS last_t
+       ,mod(rra_bundle.size + mod(round(date_part('epoch'::text, rra_latest.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) -
                    ts.i, rra_bundle.size::bigint)::double precision AS slot_distance
        ,rra.seg AS seg
        ,rra.idx AS idx
@@ -330,6 +409,24 @@ CREATE VIEW %[1]stvd AS
 		rows.Close()
 	}
 
+	// Estimated storage per DS (see StorageByPrefix). This is a
+	// separate statement so that it is created in existing databases.
+	create_sql = `
+CREATE OR REPLACE VIEW %[1]sstorage AS
+  SELECT ds.id AS ds_id, ds.ident AS ident,
+         SUM(rra_bundle.size * (8 + %[2]d.0 / rra_bundle.width))::BIGINT AS bytes
+    FROM %[1]sds ds
+    JOIN %[1]srra rra ON rra.ds_id = ds.id
+    JOIN %[1]srra_bundle rra_bundle ON rra_bundle.id = rra.rra_bundle_id
+   GROUP BY ds.id, ds.ident;
+`
+	if rows, err := p.dbConn.Query(fmt.Sprintf(create_sql, p.prefix, PgRowOverhead)); err != nil {
+		log.Printf("ERROR: CREATE VIEW storage failed: %v", err)
+		return err
+	} else {
+		rows.Close()
+	}
+
 	return nil
 }
 
@@ -347,7 +444,7 @@ func rraBundleRecordFromRow(rows *sql.Rows) (*rraBundleRecord, error) {
 func rraRecordFromRow(rows *sql.Rows) (*rraRecord, error) {
 
 	var rra rraRecord
-	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff, &rra.value, &rra.durationMs)
+	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff, &rra.roundTo, &rra.gapFill, &rra.value, &rra.variance, &rra.durationMs, &rra.lastKnown, &rra.lastKnownAt)
 	if err != nil {
 		log.Printf("rraRecordFromRow(): error scanning row: %v", err)
 		return nil, err
@@ -362,22 +459,24 @@ func rraFromRRARecordAndBundle(rraRec *rraRecord, bundle *rraBundleRecord, lates
 		Step:     time.Duration(bundle.stepMs) * time.Millisecond,
 		Span:     time.Duration(bundle.stepMs*bundle.size) * time.Millisecond,
 		Xff:      rraRec.xff,
+		RoundTo:  rraRec.roundTo,
 		Latest:   latest,
 		Value:    rraRec.value,
+		Variance: rraRec.variance,
 		Duration: time.Duration(rraRec.durationMs) * time.Millisecond,
 	}
 
-	switch strings.ToUpper(rraRec.cf) {
-	case "WMEAN":
-		spec.Function = rrd.WMEAN
-	case "MIN":
-		spec.Function = rrd.MIN
-	case "MAX":
-		spec.Function = rrd.MAX
-	case "LAST":
-		spec.Function = rrd.LAST
-	default:
-		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): Invalid cf: %q (valid funcs: wmean, min, max, last)", rraRec.cf)
+	cf, err := rrd.ParseConsolidation(rraRec.cf)
+	if err != nil {
+		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+	}
+	spec.Function = cf
+
+	if spec.GapFill, err = rrd.ParseGapFill(rraRec.gapFill); err != nil {
+		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+	}
+	if rraRec.lastKnownAt != nil {
+		spec.LastKnown, spec.LastKnownAt = rraRec.lastKnown, *rraRec.lastKnownAt
 	}
 
 	rra, err := newDbRoundRobinArchive(rraRec.id, bundle.width, bundle.id, rraRec.pos, spec)
@@ -385,6 +484,7 @@ func rraFromRRARecordAndBundle(rraRec *rraRecord, bundle *rraBundleRecord, lates
 		log.Printf("rraFromRRARecordAndBundle(): error creating rra: %v", err)
 		return nil, err
 	}
+	rra.Checkpoint() // this is what is in the rra table
 	return rra, nil
 }
 
@@ -414,8 +514,8 @@ func (p *pgvSerDe) Search(query SearchQuery) (SearchResult, error) {
 func (p *pgvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 
 	const sql = `
-	SELECT ds.id, ds.ident, ds.step_ms, ds.heartbeat_ms, ds.lastupdate, ds.value, ds.duration_ms,
-	       rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.value, rra.duration_ms,
+	SELECT ds.id, ds.ident, ds.step_ms, ds.heartbeat_ms, ds.ds_type, ds.min_value, ds.max_value, ds.lastupdate, ds.last_raw, ds.value, ds.duration_ms,
+	       rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.round_to, rra.gap_fill, rra.value, rra.variance, rra.duration_ms, rra.last_known, rra.last_known_at,
 	       b.id, b.step_ms, b.size, b.width, rl.latest[rra.idx] AS latest
 	FROM %[1]sds ds
 	JOIN %[1]srra rra ON rra.ds_id = ds.id
@@ -443,8 +543,8 @@ func (p *pgvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 		)
 
 		err = rows.Scan(
-			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.lastupdate, &dsr.value, &dsr.durationMs, // DS
-			&rrar.id, &rrar.dsId, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, &rrar.value, &rrar.durationMs, // RRA
+			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.dsType, &dsr.min, &dsr.max, &dsr.lastupdate, &dsr.lastRaw, &dsr.value, &dsr.durationMs, // DS
+			&rrar.id, &rrar.dsId, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, &rrar.roundTo, &rrar.gapFill, &rrar.value, &rrar.variance, &rrar.durationMs, &rrar.lastKnown, &rrar.lastKnownAt, // RRA
 			&bundle.id, &bundle.stepMs, &bundle.size, &bundle.width, // Bundle
 			&latest) // latest
 		if err != nil {
@@ -592,6 +692,21 @@ func (p *pgvSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinAr
 }
 
 // Unlike the "horizontal" version, this does NOT flush the RRAs.
+//
+// The DS row and all of its RRA rows are updated in a single
+// transaction, so that the partially consolidated values of the RRAs
+// always correspond to the DS lastupdate, i.e. a flush of a DS is
+// all-or-nothing. The RRA slots and latest pointers are flushed
+// separately (vertically, in bulk across many DSs), which means that
+// after a crash the following may not hold:
+//
+//	latest <= lastupdate < latest + step, for every RRA of the DS
+//
+// CheckFlushConsistency finds and repairs DSs for which it doesn't.
+//
+// Only the RRA rows whose state changed since they were last loaded
+// or flushed are written (see DbRoundRobinArchive.Dirty), the rest
+// already hold it.
 func (p *pgvSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 	dbds, ok := ds.(DbDataSourcer)
 	if !ok {
@@ -600,29 +715,133 @@ func (p *pgvSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 	if debug {
 		log.Printf("FlushDataSource(): Id %d: LastUpdate: %v, Value: %v, Duration: %v", dbds.Id(), ds.LastUpdate(), ds.Value(), ds.Duration())
 	}
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+
 	durationMs := ds.Duration().Nanoseconds() / 1e6
-	if rows, err := p.sqlUpdateDS.Query(ds.LastUpdate(), ds.Value(), durationMs, dbds.Id()); err != nil {
+	if _, err := tx.Stmt(p.sqlUpdateDS).Exec(ds.LastUpdate(), ds.Value(), durationMs, ds.LastRaw(), dbds.Id()); err != nil {
 		// TODO Check number of rows updated - what if this DS does not exist in the DB?
 		log.Printf("FlushDataSource(): database error: %v flushing data source %#v", err, ds)
+		tx.Rollback()
 		return err
-	} else {
-		rows.Close()
 	}
 
+	var flushed []DbRoundRobinArchiver
 	for _, rra := range ds.RRAs() {
 		drra, ok := rra.(DbRoundRobinArchiver)
 		if !ok { // If this is not a DbRoundRobinArchive, we cannot flush
+			tx.Rollback()
 			return fmt.Errorf("rra must be a DbRoundRobinArchiver to flush.")
 		}
+		if !drra.Dirty() {
+			// Nothing changed since the last flush, which for a
+			// DS with many RRAs (or a wide one that only
+			// consolidates every so often) is most of them.
+			continue
+		}
 
-		if _, err := p.sqlUpdateRRA.Exec(rra.Value(), rra.Duration().Nanoseconds()/1e6, drra.Id()); err != nil {
+		var lastKnownAt *time.Time
+		lkAt, lastKnown := rra.LastKnown()
+		if !lkAt.IsZero() {
+			lastKnownAt = &lkAt
+		}
+		if _, err := tx.Stmt(p.sqlUpdateRRA).Exec(rra.Value(), rra.Duration().Nanoseconds()/1e6, rra.Variance(), lastKnown, lastKnownAt, drra.Id()); err != nil {
+			tx.Rollback()
 			return err
 		}
+		flushed = append(flushed, drra)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, drra := range flushed {
+		drra.Checkpoint()
+	}
 	return nil
 }
 
+// CheckFlushConsistency finds DSs whose lastupdate is not consistent
+// with the latest pointers of their RRAs (see FlushDataSource), which
+// is the result of a flush interrupted by a crash. If repair is true,
+// the lastupdate of such a DS is set to the greatest RRA latest and
+// the partially consolidated values of the DS and its RRAs are
+// discarded, same as what a DS does when it is loaded (see
+// rrd.DataSource checkLastUpdate), but stored. It returns the number
+// of inconsistent DSs found.
+//
+// This must not be used while the DSs are being flushed by another
+// process, e.g. another node of the cluster, because between flushes
+// the DS and its RRA latests can be legitimately out of sync.
+func (p *pgvSerDe) CheckFlushConsistency(repair bool) (int, error) {
+	stmt := fmt.Sprintf(`
+SELECT ds_id, lastupdate, MAX(latest)
+  FROM (SELECT ds.id AS ds_id, ds.lastupdate AS lastupdate,
+               rra_latest.latest[rra.idx] AS latest, rra_bundle.step_ms AS step_ms
+          FROM %[1]sds ds
+          JOIN %[1]srra rra ON rra.ds_id = ds.id
+          JOIN %[1]srra_bundle rra_bundle ON rra_bundle.id = rra.rra_bundle_id
+          JOIN %[1]srra_latest rra_latest ON rra_latest.rra_bundle_id = rra.rra_bundle_id AND rra_latest.seg = rra.seg
+         WHERE ds.lastupdate IS NOT NULL) r
+ WHERE latest IS NOT NULL
+ GROUP BY ds_id, lastupdate
+HAVING bool_or(latest > lastupdate OR lastupdate >= latest + INTERVAL '1 MILLISECOND' * step_ms)`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt)
+	if err != nil {
+		return 0, err
+	}
+	type torn struct {
+		id                 int64
+		lastUpdate, latest time.Time
+	}
+	var tt []torn
+	for rows.Next() {
+		var t torn
+		if err := rows.Scan(&t.id, &t.lastUpdate, &t.latest); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tt = append(tt, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, t := range tt {
+		log.Printf("CheckFlushConsistency(): DS id %d: lastupdate %v does not agree with RRA latest %v", t.id, t.lastUpdate, t.latest)
+		if !repair {
+			continue
+		}
+		if err := p.repairTornFlush(t.id, t.lastUpdate, t.latest); err != nil {
+			return len(tt), err
+		}
+	}
+	return len(tt), nil
+}
+
+func (p *pgvSerDe) repairTornFlush(dsId int64, lastUpdate, latest time.Time) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	// lastupdate is in the WHERE in case it changed since we looked
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]sds SET lastupdate = $1, value = 'NaN', duration_ms = 0, last_raw = 'NaN' WHERE id = $2 AND lastupdate = $3", p.prefix),
+		latest, dsId, lastUpdate); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]srra SET value = 'NaN', duration_ms = 0, variance = 0 WHERE ds_id = $1", p.prefix), dsId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func (p *pgvSerDe) VerticalFlushDPs(bundle_id, seg, i int64, dps map[int64]float64) (sqlOps int, err error) {
 
 	chunks := arrayUpdateChunks(dps)
@@ -765,7 +984,7 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	}
 
 	// Now try INSERT
-	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000)
+	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000, dsSpec.Type.String(), dsSpec.Min, dsSpec.Max)
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error querying database: %v", err)
 		return nil, err
@@ -785,75 +1004,371 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	// RRAs
 	var rras []rrd.RoundRobinArchiver
 	for _, rraSpec := range dsSpec.RRAs {
-		stepMs := rraSpec.Step.Nanoseconds() / 1000000
-		size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
-		var cf string
-		switch rraSpec.Function {
-		case rrd.WMEAN:
-			cf = "WMEAN"
-		case rrd.MIN:
-			cf = "MIN"
-		case rrd.MAX:
-			cf = "MAX"
-		case rrd.LAST:
-			cf = "LAST"
-		}
-
-		// rra_bundle
-		var bundle *rraBundleRecord
-		bundle, err = p.fetchOrCreateRRABundle(stepMs, size)
+		rra, err := p.createRRA(ds.Id(), rraSpec)
 		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error creating RRA bundle: %v", err)
+			log.Printf("FetchOrCreateDataSource(): %v", err)
 			return nil, err
 		}
+		rras = append(rras, rra)
+	}
+	ds.SetRRAs(rras)
 
-		// Get the next position for this bundle TODO: If the DS was
-		// not created (upsert), there is a possibity that we're
-		// incrementing this in vain, the position will be wasted if
-		// the rra already exists.
-		pos, err := p.rraBundleIncrPos(bundle.id)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error incrementing last_pos in RRA bundle: %v", err)
-			return nil, err
-		}
+	if debug {
+		log.Printf("FetchOrCreateDataSource(): returning ds.id %d: LastUpdate: %v, %#v", ds.Id(), ds.LastUpdate(), ds)
+	}
+	return ds, nil
+}
 
-		// rra
-		var rraRows *sql.Rows
-		seg, idx := segIdxFromPosWidth(pos, bundle.width)
-		rraRows, err = p.sqlInsertRRA.Query(ds.Id(), bundle.id, pos, seg, idx, cf, rraSpec.Xff)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error creating RRAs: %v", err)
+// createRRA creates an RRA of the DS dsId as described by rraSpec
+// (or returns the existing one, if any).
+func (p *pgvSerDe) createRRA(dsId int64, rraSpec rrd.RRASpec) (*DbRoundRobinArchive, error) {
+	stepMs := rraSpec.Step.Nanoseconds() / 1000000
+	size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
+	cf := rraSpec.Function.String()
+
+	// rra_bundle
+	bundle, err := p.fetchOrCreateRRABundle(stepMs, size)
+	if err != nil {
+		return nil, fmt.Errorf("error creating RRA bundle: %v", err)
+	}
+
+	// Get the next position for this bundle TODO: If the DS was
+	// not created (upsert), there is a possibity that we're
+	// incrementing this in vain, the position will be wasted if
+	// the rra already exists.
+	pos, err := p.rraBundleIncrPos(bundle.id)
+	if err != nil {
+		return nil, fmt.Errorf("error incrementing last_pos in RRA bundle: %v", err)
+	}
+
+	// rra
+	seg, idx := segIdxFromPosWidth(pos, bundle.width)
+	rraRows, err := p.sqlInsertRRA.Query(dsId, bundle.id, pos, seg, idx, cf, rraSpec.Xff, rraSpec.RoundTo, rraSpec.GapFill.String())
+	if err != nil {
+		return nil, fmt.Errorf("error creating RRAs: %v", err)
+	}
+	rraRows.Next()
+
+	rraRec, err := rraRecordFromRow(rraRows)
+	rraRows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error2: %v", err)
+	}
+
+	rra, err := rraFromRRARecordAndBundle(rraRec, bundle, rraSpec.Latest)
+	if err != nil {
+		return nil, fmt.Errorf("error3: %v", err)
+	}
+	return rra, nil
+}
+
+// fetchRRADPs returns the data points of the RRA stored in the ts
+// table.
+func (p *pgvSerDe) fetchRRADPs(rra DbRoundRobinArchiver) (map[int64]float64, error) {
+	stmt := fmt.Sprintf("SELECT i, dp[$3] FROM %[1]sts WHERE rra_bundle_id = $1 AND seg = $2 AND dp[$3] IS NOT NULL", p.prefix)
+	rows, err := p.dbConn.Query(stmt, rra.BundleId(), rra.Seg(), rra.Idx())
+	if err != nil {
+		log.Printf("fetchRRADPs(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	dps := make(map[int64]float64)
+	for rows.Next() {
+		var (
+			i int64
+			v float64
+		)
+		if err := rows.Scan(&i, &v); err != nil {
+			log.Printf("fetchRRADPs(): error scanning row: %v", err)
 			return nil, err
 		}
-		rraRows.Next()
+		dps[i] = v
+	}
+	return dps, rows.Err()
+}
 
-		var rraRec *rraRecord
-		rraRec, err = rraRecordFromRow(rraRows)
-		rraRows.Close()
+// loadRRAs returns copies of the RRAs of ds along with their data
+// points and PDP state.
+func (p *pgvSerDe) loadRRAs(ds rrd.DataSourcer) ([]rrd.RoundRobinArchiver, error) {
+	result := make([]rrd.RoundRobinArchiver, len(ds.RRAs()))
+	for n, rra := range ds.RRAs() {
+		drra, ok := rra.(*DbRoundRobinArchive)
+		if !ok {
+			return nil, fmt.Errorf("rra must be a *DbRoundRobinArchive")
+		}
+		dps, err := p.fetchRRADPs(drra)
 		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error2: %v", err)
 			return nil, err
 		}
+		lastKnownAt, lastKnown := drra.LastKnown()
+		result[n] = rrd.NewRoundRobinArchive(rrd.RRASpec{
+			Function:    drra.Consolidation(),
+			Step:        drra.Step(),
+			Span:        drra.Step() * time.Duration(drra.Size()),
+			Xff:         drra.Xff(),
+			RoundTo:     drra.RoundTo(),
+			GapFill:     drra.GapFill(),
+			Latest:      drra.Latest(),
+			Value:       drra.Value(),
+			Variance:    drra.Variance(),
+			Duration:    drra.Duration(),
+			LastKnown:   lastKnown,
+			LastKnownAt: lastKnownAt,
+			DPs:         dps,
+		})
+	}
+	return result, nil
+}
 
-		latest := rraSpec.Latest
+// FetchDataPoints returns a DS with the data points of its RRAs, see
+// DataPointFetcher.
+func (p *pgvSerDe) FetchDataPoints(ident Ident) (rrd.DataSourcer, error) {
+	ds, err := p.fetchDataSource(ident)
+	if err != nil || ds == nil {
+		return nil, err
+	}
+	rras, err := p.loadRRAs(ds)
+	if err != nil {
+		return nil, err
+	}
+	ds.SetRRAs(rras)
+	return ds.DataSourcer, nil
+}
 
-		var rra *DbRoundRobinArchive
-		rra, err = rraFromRRARecordAndBundle(rraRec, bundle, latest)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error3: %v", err)
+// ReshapeDataSource changes the RRAs of a DS, see RRAReshaper. The new
+// RRAs are created and their data points written before the ones no
+// longer needed are deleted, if this is interrupted the DS has them
+// all, and reshaping it again finishes the job.
+//
+// This must not be used while the DS is being flushed, i.e. it must
+// not be in the cache of any receiver.
+func (p *pgvSerDe) ReshapeDataSource(ident Ident, specs []rrd.RRASpec) (rrd.DataSourcer, error) {
+	ds, err := p.fetchDataSource(ident)
+	if err != nil || ds == nil {
+		return nil, err
+	}
+	if err := CheckRRASpecs(ds.Step(), specs); err != nil {
+		return nil, err
+	}
+
+	// The data points of all the RRAs are needed to resample
+	old := ds.RRAs()
+	srcs, err := p.loadRRAs(ds)
+	if err != nil {
+		return nil, fmt.Errorf("ReshapeDataSource: %v", err)
+	}
+
+	type segKey struct{ bundleId, seg int64 }
+	var (
+		rras    = make([]rrd.RoundRobinArchiver, len(specs))
+		rows    = make(map[segKey]map[int64]map[int64]float64)
+		latests = make(map[segKey]map[int64]time.Time)
+	)
+	reshaped, kept := reshapeRRAs(srcs, specs)
+	for i, n := range keptRRAs(srcs, specs) {
+		var drra *DbRoundRobinArchive
+		if n >= 0 {
+			// The data points are in the database already
+			drra = old[n].(*DbRoundRobinArchive)
+			stmt := fmt.Sprintf("UPDATE %[1]srra SET xff = $1, round_to = $2, gap_fill = $3 WHERE id = $4", p.prefix)
+			if _, err := p.dbConn.Exec(stmt, specs[i].Xff, specs[i].RoundTo, specs[i].GapFill.String(), drra.Id()); err != nil {
+				log.Printf("ReshapeDataSource(): error updating RRA: %v", err)
+				return nil, err
+			}
+			drra.RoundRobinArchiver = reshaped[i]
+			rras[i] = drra
+			continue
+		}
+
+		if drra, err = p.createRRA(ds.Id(), specs[i]); err != nil {
+			log.Printf("ReshapeDataSource(): %v", err)
 			return nil, err
 		}
+		drra.RoundRobinArchiver = reshaped[i]
+		rras[i] = drra
 
-		rras = append(rras, rra)
+		key := segKey{drra.BundleId(), drra.Seg()}
+		if rows[key] == nil {
+			rows[key] = make(map[int64]map[int64]float64)
+			latests[key] = make(map[int64]time.Time)
+		}
+		for slot, v := range drra.DPs() {
+			if rows[key][slot] == nil {
+				rows[key][slot] = make(map[int64]float64)
+			}
+			rows[key][slot][drra.Idx()] = v
+		}
+		if !drra.Latest().IsZero() {
+			latests[key][drra.Idx()] = drra.Latest()
+		}
 	}
+
+	for key, segRows := range rows {
+		for slot, row := range segRows {
+			if _, err := p.VerticalFlushDPs(key.bundleId, key.seg, slot, row); err != nil {
+				log.Printf("ReshapeDataSource(): error writing data points: %v", err)
+				return nil, err
+			}
+		}
+		if len(latests[key]) > 0 {
+			if _, err := p.VerticalFlushLatests(key.bundleId, key.seg, latests[key]); err != nil {
+				log.Printf("ReshapeDataSource(): error writing latests: %v", err)
+				return nil, err
+			}
+		}
+	}
+
 	ds.SetRRAs(rras)
+	ds.ClearRRAs()
+	if err := p.FlushDataSource(ds); err != nil {
+		return nil, err
+	}
 
-	if debug {
-		log.Printf("FetchOrCreateDataSource(): returning ds.id %d: LastUpdate: %v, %#v", ds.Id(), ds.LastUpdate(), ds)
+	stmt := fmt.Sprintf("DELETE FROM %[1]srra WHERE id = $1", p.prefix)
+	for n, rra := range old {
+		if kept[n] {
+			continue
+		}
+		if _, err := p.dbConn.Exec(stmt, rra.(*DbRoundRobinArchive).Id()); err != nil {
+			log.Printf("ReshapeDataSource(): error deleting RRA: %v", err)
+			return nil, err
+		}
 	}
 	return ds, nil
 }
 
+// RenameDataSource changes the ident of a DS, see DataSourceMerger.
+// This must not be used while the DS is being flushed, i.e. it must
+// not be in the cache of any receiver.
+func (p *pgvSerDe) RenameDataSource(from, to Ident) (rrd.DataSourcer, error) {
+	if ds, err := p.fetchDataSource(to); err != nil {
+		return nil, err
+	} else if ds != nil {
+		return nil, fmt.Errorf("RenameDataSource: %v exists", to)
+	}
+	stmt := fmt.Sprintf("UPDATE %[1]sds SET ident = $2 WHERE ident = $1", p.prefix)
+	res, err := p.dbConn.Exec(stmt, from.String(), to.String())
+	if err != nil {
+		log.Printf("RenameDataSource(): error updating DS: %v", err)
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	return p.fetchDataSource(to)
+}
+
+// MergeDataSource merges the data of one DS into another, see
+// DataSourceMerger. Only the slots which change are written. This
+// must not be used while either DS is being flushed, i.e. they must
+// not be in the cache of any receiver.
+func (p *pgvSerDe) MergeDataSource(dstIdent, srcIdent Ident, policy rrd.MergePolicy, deleteSrc bool) (rrd.DataSourcer, error) {
+	if dstIdent.String() == srcIdent.String() {
+		return nil, fmt.Errorf("MergeDataSource: cannot merge %v into itself", dstIdent)
+	}
+	dst, err := p.fetchDataSource(dstIdent)
+	if err != nil {
+		return nil, err
+	}
+	src, err := p.fetchDataSource(srcIdent)
+	if err != nil {
+		return nil, err
+	}
+	if dst == nil || src == nil {
+		return nil, fmt.Errorf("MergeDataSource: both %v and %v must exist", dstIdent, srcIdent)
+	}
+
+	old := dst.RRAs()
+	dstRRAs, err := p.loadRRAs(dst)
+	if err != nil {
+		return nil, fmt.Errorf("MergeDataSource: %v", err)
+	}
+	srcRRAs, err := p.loadRRAs(src)
+	if err != nil {
+		return nil, fmt.Errorf("MergeDataSource: %v", err)
+	}
+	dst.SetRRAs(dstRRAs)
+	src.SetRRAs(srcRRAs)
+	merged := rrd.MergeDataSource(dst.DataSourcer, src.DataSourcer, policy)
+
+	type segKey struct{ bundleId, seg int64 }
+	var (
+		rows    = make(map[segKey]map[int64]map[int64]float64)
+		latests = make(map[segKey]map[int64]time.Time)
+	)
+	for n, rra := range merged.RRAs() {
+		drra := old[n].(*DbRoundRobinArchive)
+		key := segKey{drra.BundleId(), drra.Seg()}
+		if rows[key] == nil {
+			rows[key] = make(map[int64]map[int64]float64)
+			latests[key] = make(map[int64]time.Time)
+		}
+		stored := dstRRAs[n].DPs()
+		for slot := int64(0); slot < rra.Size(); slot++ {
+			nv, nok := rra.DPs()[slot]
+			ov, ook := stored[slot]
+			if nok == ook && (nv == ov || (math.IsNaN(nv) && math.IsNaN(ov))) {
+				continue
+			}
+			if !nok {
+				nv = math.NaN() // a slot from a previous round
+			}
+			if rows[key][slot] == nil {
+				rows[key][slot] = make(map[int64]float64)
+			}
+			rows[key][slot][drra.Idx()] = nv
+		}
+		if !rra.Latest().Equal(drra.Latest()) {
+			latests[key][drra.Idx()] = rra.Latest()
+		}
+		drra.RoundRobinArchiver = rra
+	}
+
+	for key, segRows := range rows {
+		for slot, row := range segRows {
+			if _, err := p.VerticalFlushDPs(key.bundleId, key.seg, slot, row); err != nil {
+				log.Printf("MergeDataSource(): error writing data points: %v", err)
+				return nil, err
+			}
+		}
+		if len(latests[key]) > 0 {
+			if _, err := p.VerticalFlushLatests(key.bundleId, key.seg, latests[key]); err != nil {
+				log.Printf("MergeDataSource(): error writing latests: %v", err)
+				return nil, err
+			}
+		}
+	}
+
+	merged.SetRRAs(old)
+	dst.DataSourcer = merged
+	dst.ClearRRAs()
+	if err := p.FlushDataSource(dst); err != nil {
+		return nil, err
+	}
+
+	if deleteSrc {
+		if _, err := p.DeleteDataSource(srcIdent); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// DeleteDataSource deletes a DS, see DataSourceDeleter. The slots of
+// its RRAs are left in the ts table, positions in a bundle are not
+// reused.
+func (p *pgvSerDe) DeleteDataSource(ident Ident) (bool, error) {
+	stmt := fmt.Sprintf("DELETE FROM %[1]sds WHERE ident = $1", p.prefix)
+	res, err := p.dbConn.Exec(stmt, ident.String())
+	if err != nil {
+		log.Printf("DeleteDataSource(): error deleting DS: %v", err)
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
 func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
 
 	dbds, ok := ds.(DbDataSourcer)
@@ -907,6 +1422,102 @@ func (p *pgvSerDe) TsTableSize() (size, count int64, err error) {
 	return 0, 0, nil
 }
 
+// StorageByPrefix returns the estimated number of bytes taken up by
+// data points, grouped by the prefix of the DS name consisting of
+// its first depth dot-separated elements. (A tenant name is typically
+// the first element). The estimate is based on the RRA sizes, it does
+// not include table bloat, see TsTableSize for that.
+func (p *pgvSerDe) StorageByPrefix(depth int) (map[string]int64, error) {
+	const stmt = `
+  SELECT array_to_string((string_to_array(ident->>'name', '.'))[1:$1], '.') AS prefix,
+         SUM(bytes)::BIGINT
+    FROM %[1]sstorage
+  GROUP BY 1`
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), depth)
+	if err != nil {
+		log.Printf("StorageByPrefix(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]int64)
+	for rows.Next() {
+		var (
+			prefix sql.NullString
+			bytes  int64
+		)
+		if err := rows.Scan(&prefix, &bytes); err != nil {
+			log.Printf("StorageByPrefix(): error scanning row: %v", err)
+			return nil, err
+		}
+		result[prefix.String] += bytes
+	}
+	return result, rows.Err()
+}
+
+// RecentSeries lists the DSs created at or after since, newest
+// first, see SeriesActivityLister.
+func (p *pgvSerDe) RecentSeries(since time.Time, offset, limit int) ([]SeriesActivity, error) {
+	const stmt = `
+  SELECT ident, created_at, lastupdate
+    FROM %[1]sds
+   WHERE created_at >= $1
+   ORDER BY created_at DESC, id DESC
+  OFFSET $2 LIMIT $3`
+	return p.seriesActivity("RecentSeries", fmt.Sprintf(stmt, p.prefix), since, offset, limit)
+}
+
+// StaleSeries lists the DSs not updated since before, stalest
+// first, see SeriesActivityLister. There is no index on lastupdate
+// (it would slow down every flush), so this is a sequential scan.
+func (p *pgvSerDe) StaleSeries(before time.Time, offset, limit int) ([]SeriesActivity, error) {
+	const stmt = `
+  SELECT ident, created_at, lastupdate
+    FROM %[1]sds
+   WHERE lastupdate < $1 OR (lastupdate IS NULL AND (created_at IS NULL OR created_at < $1))
+   ORDER BY lastupdate ASC NULLS FIRST, id
+  OFFSET $2 LIMIT $3`
+	return p.seriesActivity("StaleSeries", fmt.Sprintf(stmt, p.prefix), before, offset, limit)
+}
+
+func (p *pgvSerDe) seriesActivity(caller, stmt string, t time.Time, offset, limit int) ([]SeriesActivity, error) {
+	var lim interface{} // NULL is no limit
+	if limit > 0 {
+		lim = limit
+	}
+	rows, err := p.dbConn.Query(stmt, t, offset, lim)
+	if err != nil {
+		log.Printf("%s(): error querying database: %v", caller, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []SeriesActivity
+	for rows.Next() {
+		var (
+			identJson           []byte
+			created, lastupdate *time.Time
+			sa                  SeriesActivity
+		)
+		if err := rows.Scan(&identJson, &created, &lastupdate); err != nil {
+			log.Printf("%s(): error scanning row: %v", caller, err)
+			return nil, err
+		}
+		if err := json.Unmarshal(identJson, &sa.Ident); err != nil {
+			log.Printf("%s(): error unmarshalling ident %q: %v", caller, string(identJson), err)
+			return nil, err
+		}
+		if created != nil {
+			sa.Created = *created
+		}
+		if lastupdate != nil {
+			sa.LastUpdate = *lastupdate
+		}
+		result = append(result, sa)
+	}
+	return result, rows.Err()
+}
+
 func (p *pgvSerDe) rraBundleIncrPos(id int64) (int64, error) {
 	stmt := fmt.Sprintf("UPDATE %[1]srra_bundle SET last_pos = last_pos + 1 WHERE id = $1 RETURNING last_pos", p.prefix)
 	rows, err := p.dbConn.Query(stmt, id)
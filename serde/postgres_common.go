@@ -40,12 +40,22 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 		return nil, err
 	}
 
+	dsType, err := rrd.ParseDSType(dsr.dsType)
+	if err != nil {
+		log.Printf("dataSourceFromRow(): %v", err)
+		return nil, err
+	}
+
 	ds := NewDbDataSource(dsr.id, ident,
 		rrd.NewDataSource(
 			rrd.DSSpec{
 				Step:       time.Duration(dsr.stepMs) * time.Millisecond,
 				Heartbeat:  time.Duration(dsr.hbMs) * time.Millisecond,
+				Type:       dsType,
+				Min:        dsr.min,
+				Max:        dsr.max,
 				LastUpdate: *dsr.lastupdate,
+				LastRaw:    dsr.lastRaw,
 				Value:      dsr.value,
 				Duration:   time.Duration(dsr.durationMs) * time.Millisecond,
 			},
@@ -59,7 +69,7 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 
 func dsRecordFromRow(rows *sql.Rows) (*dsRecord, error) {
 	var dsr dsRecord
-	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.lastupdate, &dsr.value, &dsr.durationMs, &dsr.created)
+	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.dsType, &dsr.min, &dsr.max, &dsr.lastupdate, &dsr.lastRaw, &dsr.value, &dsr.durationMs, &dsr.created)
 	return &dsr, err
 }
 
@@ -0,0 +1,285 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"time"
+)
+
+// CheckInvariants scans the database for violations of the
+// Invariant* invariants, repairing them if repair is true:
+//
+//   - a latest in the future is cleared, which makes the RRA look
+//     empty until it is written to next, a latest which is not on a
+//     step boundary is rounded down to it
+//   - a DS lastupdate in the future (which makes the DS ignore all
+//     new data points until then) is cleared along with the
+//     partially consolidated values, same as repairTornFlush()
+//   - rows of slots beyond the size are deleted, arrays longer than
+//     the width are truncated
+//
+// RRAs which are all NaN, and RRAs whose index does not fit the
+// width, are only reported.
+func (p *pgvSerDe) CheckInvariants(now time.Time, repair bool) ([]Violation, error) {
+	var result []Violation
+	for _, check := range []func(time.Time, bool) ([]Violation, error){
+		p.checkLatestBounds,
+		p.checkDSLastUpdate,
+		p.checkSlotCount,
+		p.checkRRAIndex,
+		p.checkNaNOnly,
+	} {
+		vv, err := check(now, repair)
+		result = append(result, vv...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (p *pgvSerDe) checkLatestBounds(now time.Time, repair bool) ([]Violation, error) {
+	stmt := fmt.Sprintf(`
+SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.seg, rra.idx, rra_latest.latest[rra.idx], rra_bundle.step_ms
+  FROM %[1]srra rra
+  JOIN %[1]srra_bundle rra_bundle ON rra_bundle.id = rra.rra_bundle_id
+  JOIN %[1]srra_latest rra_latest ON rra_latest.rra_bundle_id = rra.rra_bundle_id AND rra_latest.seg = rra.seg
+ WHERE rra_latest.latest[rra.idx] IS NOT NULL
+   AND (rra_latest.latest[rra.idx] > $1::TIMESTAMPTZ + INTERVAL '1 MILLISECOND' * rra_bundle.step_ms
+        OR MOD(ROUND(EXTRACT(EPOCH FROM rra_latest.latest[rra.idx]) * 1000)::BIGINT, rra_bundle.step_ms) <> 0)`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt, now)
+	if err != nil {
+		return nil, err
+	}
+	type bad struct {
+		v      Violation
+		idx    int64
+		latest time.Time
+		step   time.Duration
+	}
+	var bb []bad
+	for rows.Next() {
+		var (
+			b      bad
+			stepMs int64
+		)
+		if err := rows.Scan(&b.v.RRAId, &b.v.DSId, &b.v.BundleId, &b.v.Seg, &b.idx, &b.latest, &stepMs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.step = time.Duration(stepMs) * time.Millisecond
+		b.v.Invariant = InvariantLatestBounds
+		if err := CheckLatest(b.latest, b.step, now); err != nil {
+			b.v.Detail = err.Error()
+		} else { // off by less than what Go and PostgreSQL agree on
+			b.v.Detail = fmt.Sprintf("latest %v is out of bounds", b.latest)
+		}
+		bb = append(bb, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]Violation, 0, len(bb))
+	for _, b := range bb {
+		if repair {
+			var latest interface{} // NULL
+			if !b.latest.After(now.Add(b.step)) {
+				ns := b.latest.UnixNano()
+				latest = time.Unix(0, ns-ns%b.step.Nanoseconds())
+			}
+			if _, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]srra_latest SET latest[$3] = $4 WHERE rra_bundle_id = $1 AND seg = $2", p.prefix),
+				b.v.BundleId, b.v.Seg, b.idx, latest); err != nil {
+				return result, err
+			}
+			b.v.Repaired = true
+		}
+		result = append(result, b.v)
+	}
+	return result, nil
+}
+
+func (p *pgvSerDe) checkDSLastUpdate(now time.Time, repair bool) ([]Violation, error) {
+	stmt := fmt.Sprintf(`
+SELECT id, lastupdate FROM %[1]sds
+ WHERE lastupdate > $1::TIMESTAMPTZ + INTERVAL '1 MILLISECOND' * step_ms`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt, now)
+	if err != nil {
+		return nil, err
+	}
+	type bad struct {
+		v          Violation
+		lastUpdate time.Time
+	}
+	var bb []bad
+	for rows.Next() {
+		var b bad
+		if err := rows.Scan(&b.v.DSId, &b.lastUpdate); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.v.Invariant = InvariantLatestBounds
+		b.v.Detail = fmt.Sprintf("lastupdate %v is in the future", b.lastUpdate)
+		bb = append(bb, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]Violation, 0, len(bb))
+	for _, b := range bb {
+		if repair {
+			if err := p.clearLastUpdate(b.v.DSId, b.lastUpdate); err != nil {
+				return result, err
+			}
+			b.v.Repaired = true
+		}
+		result = append(result, b.v)
+	}
+	return result, nil
+}
+
+// clearLastUpdate is like repairTornFlush(), except the lastupdate
+// becomes NULL.
+func (p *pgvSerDe) clearLastUpdate(dsId int64, lastUpdate time.Time) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]sds SET lastupdate = NULL, value = 'NaN', duration_ms = 0, last_raw = 'NaN' WHERE id = $1 AND lastupdate = $2", p.prefix),
+		dsId, lastUpdate); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]srra SET value = 'NaN', duration_ms = 0, variance = 0 WHERE ds_id = $1", p.prefix), dsId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *pgvSerDe) checkSlotCount(_ time.Time, repair bool) ([]Violation, error) {
+	stmt := fmt.Sprintf(`
+SELECT ts.rra_bundle_id, ts.seg, rra_bundle.size, rra_bundle.width,
+       COUNT(*) FILTER (WHERE ts.i < 0 OR ts.i >= rra_bundle.size),
+       COUNT(*) FILTER (WHERE array_length(ts.dp, 1) > rra_bundle.width)
+  FROM %[1]sts ts
+  JOIN %[1]srra_bundle rra_bundle ON rra_bundle.id = ts.rra_bundle_id
+ GROUP BY ts.rra_bundle_id, ts.seg, rra_bundle.size, rra_bundle.width
+HAVING COUNT(*) FILTER (WHERE ts.i < 0 OR ts.i >= rra_bundle.size) > 0
+    OR COUNT(*) FILTER (WHERE array_length(ts.dp, 1) > rra_bundle.width) > 0`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	type bad struct {
+		v                          Violation
+		size, width, outside, wide int64
+	}
+	var bb []bad
+	for rows.Next() {
+		var b bad
+		if err := rows.Scan(&b.v.BundleId, &b.v.Seg, &b.size, &b.width, &b.outside, &b.wide); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.v.Invariant = InvariantSlotCount
+		b.v.Detail = fmt.Sprintf("%d rows beyond size %d, %d rows wider than width %d", b.outside, b.size, b.wide, b.width)
+		bb = append(bb, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]Violation, 0, len(bb))
+	for _, b := range bb {
+		if repair {
+			if _, err := p.dbConn.Exec(fmt.Sprintf("DELETE FROM %[1]sts WHERE rra_bundle_id = $1 AND seg = $2 AND (i < 0 OR i >= $3)", p.prefix),
+				b.v.BundleId, b.v.Seg, b.size); err != nil {
+				return result, err
+			}
+			if _, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]sts SET dp = dp[1:$3] WHERE rra_bundle_id = $1 AND seg = $2 AND array_length(dp, 1) > $3", p.prefix),
+				b.v.BundleId, b.v.Seg, b.width); err != nil {
+				return result, err
+			}
+			b.v.Repaired = true
+		}
+		result = append(result, b.v)
+	}
+	return result, nil
+}
+
+func (p *pgvSerDe) checkRRAIndex(time.Time, bool) ([]Violation, error) {
+	stmt := fmt.Sprintf(`
+SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.seg, rra.idx, rra_bundle.width
+  FROM %[1]srra rra
+  JOIN %[1]srra_bundle rra_bundle ON rra_bundle.id = rra.rra_bundle_id
+ WHERE rra.idx < 1 OR rra.idx > rra_bundle.width`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Violation
+	for rows.Next() {
+		var (
+			v          Violation
+			idx, width int64
+		)
+		if err := rows.Scan(&v.RRAId, &v.DSId, &v.BundleId, &v.Seg, &idx, &width); err != nil {
+			return result, err
+		}
+		v.Invariant = InvariantSlotCount
+		v.Detail = fmt.Sprintf("index %d is outside of width %d", idx, width)
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
+
+func (p *pgvSerDe) checkNaNOnly(time.Time, bool) ([]Violation, error) {
+	stmt := fmt.Sprintf(`
+SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.seg
+  FROM %[1]srra rra
+  JOIN %[1]srra_latest rra_latest ON rra_latest.rra_bundle_id = rra.rra_bundle_id AND rra_latest.seg = rra.seg
+ WHERE rra_latest.latest[rra.idx] IS NOT NULL
+   AND rra.xff = 0 AND rra.gap_fill <> 'NAN' -- see mayBeNaNOnly()
+   AND NOT EXISTS (SELECT 1 FROM %[1]sts ts
+                    WHERE ts.rra_bundle_id = rra.rra_bundle_id AND ts.seg = rra.seg
+                      AND ts.dp[rra.idx] IS NOT NULL AND ts.dp[rra.idx] <> 'NaN')`, p.prefix)
+
+	rows, err := p.dbConn.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Violation
+	for rows.Next() {
+		v := Violation{Invariant: InvariantNaNOnly, Detail: "has a latest but no values"}
+		if err := rows.Scan(&v.RRAId, &v.DSId, &v.BundleId, &v.Seg); err != nil {
+			return result, err
+		}
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
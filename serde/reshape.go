@@ -0,0 +1,95 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// CheckRRASpecs returns an error if any of rras is not valid for a DS
+// with the given step, or if two of them describe the same RRA
+// (i.e. the same step, span and consolidation function).
+func CheckRRASpecs(step time.Duration, rras []rrd.RRASpec) error {
+	if len(rras) == 0 {
+		return fmt.Errorf("at least one RRA is required")
+	}
+	for i, r := range rras {
+		if r.Step <= 0 || (step > 0 && r.Step%step != 0) {
+			return fmt.Errorf("RRA step (%v) must be a multiple of the DS step (%v)", r.Step, step)
+		}
+		if r.Span < r.Step || r.Span%r.Step != 0 {
+			return fmt.Errorf("RRA span (%v) must be a multiple of its step (%v)", r.Span, r.Step)
+		}
+		if r.Xff < 0 || r.Xff > 1 {
+			return fmt.Errorf("RRA xff (%v) must be between 0 and 1", r.Xff)
+		}
+		for _, prev := range rras[:i] {
+			if prev.Step == r.Step && prev.Span == r.Span && prev.Function == r.Function {
+				return fmt.Errorf("duplicate RRA: %v %v:%v", r.Function, r.Step, r.Span)
+			}
+		}
+	}
+	return nil
+}
+
+// keptRRAs returns, for each of specs, the index of the RRA in rras
+// which it describes, or -1 if there is none and the RRA is new.
+func keptRRAs(rras []rrd.RoundRobinArchiver, specs []rrd.RRASpec) []int {
+	result := make([]int, len(specs))
+	for i, spec := range specs {
+		result[i] = -1
+		for n, rra := range rras {
+			if rra.Step() == spec.Step && rra.Size() == int64(spec.Span/spec.Step) && rra.Consolidation() == spec.Function {
+				result[i] = n
+				break
+			}
+		}
+	}
+	return result
+}
+
+// respecRRA returns a copy of rra (including its PDP and data points)
+// with the xff, round-to and gap fill of spec, which must describe
+// the same RRA.
+func respecRRA(rra rrd.RoundRobinArchiver, spec rrd.RRASpec) *rrd.RoundRobinArchive {
+	spec.Latest, spec.Value, spec.Duration, spec.Variance = rra.Latest(), rra.Value(), rra.Duration(), rra.Variance()
+	spec.LastKnownAt, spec.LastKnown = rra.LastKnown()
+	spec.DPs = make(map[int64]float64, len(rra.DPs()))
+	for k, v := range rra.DPs() {
+		spec.DPs[k] = v
+	}
+	return rrd.NewRoundRobinArchive(spec)
+}
+
+// reshapeRRAs returns the RRAs described by specs, the existing ones
+// from rras as they are (see respecRRA) and the new ones resampled
+// from rras, which must contain their data points. It also returns
+// which of rras are kept.
+func reshapeRRAs(rras []rrd.RoundRobinArchiver, specs []rrd.RRASpec) ([]rrd.RoundRobinArchiver, []bool) {
+	result := make([]rrd.RoundRobinArchiver, len(specs))
+	kept := make([]bool, len(rras))
+	for i, n := range keptRRAs(rras, specs) {
+		if n >= 0 {
+			result[i], kept[n] = respecRRA(rras[n], specs[i]), true
+		} else {
+			result[i] = rrd.Resample(specs[i], rras)
+		}
+	}
+	return result, kept
+}
@@ -0,0 +1,74 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_CheckRRASpecs(t *testing.T) {
+	good := []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour},
+		{Function: rrd.MAX, Step: 10 * time.Second, Span: time.Hour},
+	}
+	if err := CheckRRASpecs(10*time.Second, good); err != nil {
+		t.Errorf("CheckRRASpecs: unexpected error: %v", err)
+	}
+	for _, bad := range [][]rrd.RRASpec{
+		nil,
+		{{Step: 15 * time.Second, Span: time.Hour}},
+		{{Step: 10 * time.Second, Span: 5 * time.Second}},
+		{{Step: 10 * time.Second, Span: time.Hour, Xff: 2}},
+		{good[0], good[0]},
+	} {
+		if err := CheckRRASpecs(10*time.Second, bad); err == nil {
+			t.Errorf("CheckRRASpecs: expected an error for %v", bad)
+		}
+	}
+}
+
+func Test_reshapeRRAs(t *testing.T) {
+	latest := time.Unix(3600*1000, 0)
+	dps := map[int64]float64{}
+	for i := int64(0); i < 360; i++ {
+		dps[i] = 2
+	}
+	old := []rrd.RoundRobinArchiver{
+		rrd.NewRoundRobinArchive(rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour,
+			Latest: latest, Value: 3, Duration: 5 * time.Second, DPs: dps}),
+		rrd.NewRoundRobinArchive(rrd.RRASpec{Function: rrd.MAX, Step: time.Minute, Span: 24 * time.Hour, Latest: latest}),
+	}
+	specs := []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Hour, Span: 24 * time.Hour},
+		{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Xff: 0.5},
+	}
+	rras, kept := reshapeRRAs(old, specs)
+	if len(rras) != 2 || !kept[0] || kept[1] {
+		t.Fatalf("reshapeRRAs: expected the first RRA to be kept, the second removed: %v", kept)
+	}
+	if v := rras[0].DPs()[rrd.SlotIndex(latest, time.Hour, 24)]; v != 2 {
+		t.Errorf("reshapeRRAs: expected the new RRA to be resampled, got %v", v)
+	}
+	if rras[1].Value() != 3 || rras[1].Duration() != 5*time.Second || len(rras[1].DPs()) != 360 {
+		t.Errorf("reshapeRRAs: expected the kept RRA to keep its PDP and data points")
+	}
+	if v := old[0].DPs()[0]; v != 2 {
+		t.Errorf("reshapeRRAs: the old RRA should not be modified")
+	}
+}
@@ -75,6 +75,56 @@ type VerticalFlusher interface {
 	VerticalFlushLatests(bundle_id, seg int64, latests map[int64]time.Time) (int, error)
 }
 
+// FlushConsistencyChecker is implemented by serdes that can detect
+// (and repair) data sources left inconsistent by an interrupted
+// flush. It is meant to be used at startup, before any flushing.
+type FlushConsistencyChecker interface {
+	CheckFlushConsistency(repair bool) (int, error)
+}
+
+// RRAReshaper is implemented by serdes that can change the RRAs of
+// an existing DS.
+type RRAReshaper interface {
+	// ReshapeDataSource replaces the RRAs of the DS identified by
+	// ident with ones described by rras. An existing RRA with the
+	// same step, span and consolidation function is kept along with
+	// its data, the other RRAs are created and their slots are
+	// resampled from all of the existing ones (see rrd.Resample).
+	// Existing RRAs not in rras are removed. It returns the DS as it
+	// is now stored, or nil if it does not exist.
+	ReshapeDataSource(ident Ident, rras []rrd.RRASpec) (rrd.DataSourcer, error)
+}
+
+// DataPointFetcher is implemented by serdes that can load all of the
+// data points of a DS, e.g. to export it.
+type DataPointFetcher interface {
+	// FetchDataPoints returns a copy of the DS identified by ident
+	// whose RRAs have all their data points, or nil if there is no
+	// such DS.
+	FetchDataPoints(ident Ident) (rrd.DataSourcer, error)
+}
+
+// DataSourceMerger is implemented by serdes that can rename and merge
+// DSs.
+type DataSourceMerger interface {
+	// RenameDataSource changes the ident of a DS, keeping its data.
+	// It is an error if a DS identified by to exists. It returns
+	// the DS, or nil if there is no DS identified by from.
+	RenameDataSource(from, to Ident) (rrd.DataSourcer, error)
+	// MergeDataSource merges the data of the DS identified by src
+	// into the one identified by dst (see rrd.MergeDataSource),
+	// whose RRAs stay as they are. If deleteSrc is true, src is
+	// deleted afterwards. It returns dst as merged.
+	MergeDataSource(dst, src Ident, policy rrd.MergePolicy, deleteSrc bool) (rrd.DataSourcer, error)
+}
+
+// DataSourceDeleter is implemented by serdes that can delete DSs.
+type DataSourceDeleter interface {
+	// DeleteDataSource deletes the DS identified by ident along
+	// with its RRAs. It returns false if there is no such DS.
+	DeleteDataSource(ident Ident) (bool, error)
+}
+
 type SerDe interface {
 	Fetcher() Fetcher
 	Flusher() Flusher
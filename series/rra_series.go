@@ -16,7 +16,6 @@
 package series
 
 import (
-	"math"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
@@ -24,11 +23,7 @@ import (
 
 // RRASeries transforms a rrd.RoundRobinArchiver into a Series.
 type RRASeries struct {
-	data   map[int64]float64
-	start  int64
-	end    int64
-	size   int64
-	pos    int64
+	it     *rrd.SlotIterator
 	step   time.Duration
 	latest time.Time
 	alias  string
@@ -36,73 +31,26 @@ type RRASeries struct {
 
 func NewRRASeries(rra rrd.RoundRobinArchiver) *RRASeries {
 	return &RRASeries{
-		data:   rra.DPs(),
-		start:  rra.Start(),
-		size:   rra.Size(),
-		end:    rra.End(),
-		pos:    -1,
+		it:     rrd.NewSlotIterator(rra),
 		step:   rra.Step(),
 		latest: rra.Latest(),
 	}
 }
 
-func (s *RRASeries) posValid() bool {
-	if s.pos < 0 || s.pos >= s.size || len(s.data) == 0 || s.start == s.end {
-		return false
-	}
-	if s.start < s.end {
-		return s.pos >= s.start && s.pos <= s.end
-	}
-	return s.pos >= s.start || s.pos <= s.end
-}
-
 func (s *RRASeries) Next() bool {
-	if len(s.data) == 0 {
-		return false
-	}
-	if s.pos == -1 {
-		s.pos = s.start
-		return true
-	}
-	if s.start < s.end {
-		if s.pos < s.end {
-			s.pos++
-			return true
-		}
-	} else {
-		if s.pos == s.size-1 {
-			s.pos = 0
-			return true
-		}
-		if s.pos > s.end {
-			s.pos++
-			return true
-		} else {
-			s.pos++
-			return s.pos <= s.end
-		}
-	}
-	return false
+	return s.it.Next()
 }
 
 func (s *RRASeries) CurrentValue() float64 {
-	if s.posValid() {
-		if result, ok := s.data[s.pos]; ok {
-			return result
-		}
-	}
-	return math.NaN()
+	return s.it.Value()
 }
 
 func (s *RRASeries) CurrentTime() time.Time {
-	if s.posValid() {
-		return rrd.SlotTime(s.pos, s.latest, s.step, s.size)
-	}
-	return time.Time{}
+	return s.it.Time()
 }
 
 func (s *RRASeries) Close() error {
-	s.pos = -1
+	s.it.Reset()
 	return nil
 }
 
@@ -20,7 +20,11 @@
 // database or some other storage.
 package series
 
-import "time"
+import (
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
 
 type Series interface {
 	// Advance to the next data point in the series. Returns false if
@@ -44,7 +48,8 @@ type Series interface {
 
 	// Signals the underlying storage to group rows by this interval,
 	// resulting in fewer (and longer) data points. The values are
-	// aggregated using average. By default it is equal to Step.
+	// aggregated using average (or, for a database series, according
+	// to the consolidation function). By default it is equal to Step.
 	// Without arguments returns the value, with an argument sets and
 	// returns the previous value.
 	GroupBy(...time.Duration) time.Duration
@@ -64,3 +69,24 @@ type Series interface {
 	// returns the previous value.
 	MaxPoints(...int64) int64
 }
+
+// A Consolidator is a Series read from an RRA of a data source which
+// may have other RRAs of the same step but a different consolidation
+// function (e.g. MAX alongside WMEAN).
+type Consolidator interface {
+	Series
+	// ConsolidateBy switches to the RRA with the same step and the
+	// given consolidation function. It returns false (and changes
+	// nothing) if there is no such RRA.
+	ConsolidateBy(cf rrd.Consolidation) bool
+}
+
+// A NullPolicer is a Series which consolidates the slots of an RRA
+// (see GroupBy) and can count the unknown ones as zeros while doing
+// so, see rrd.NullPolicy.
+type NullPolicer interface {
+	Series
+	// SetNullPolicy sets how unknown slots are consolidated, it must
+	// be called before the first Next().
+	SetNullPolicy(nulls rrd.NullPolicy)
+}
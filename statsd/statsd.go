@@ -18,6 +18,7 @@ package statsd
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/tgres/tgres/aggregator"
@@ -52,6 +53,18 @@ func (st *Stat) AggregatorCmd() *aggregator.Command {
 			aggregator.CmdAppend,
 			serde.Ident{"name": Prefix + ".timers." + st.Name},
 			st.Value)
+	} else if st.Metric == "e" {
+		// An event (e.g. a deploy marker) is counted, so that it
+		// shows up as a spike in the series.
+		return aggregator.NewCommand(
+			aggregator.CmdAdd,
+			serde.Ident{"name": Prefix + ".events." + st.Name},
+			st.Value)
+	} else if st.Metric == "sc" {
+		return aggregator.NewCommand(
+			aggregator.CmdSetGauge,
+			serde.Ident{"name": Prefix + ".service_checks." + st.Name},
+			st.Value)
 	}
 	return nil
 }
@@ -59,7 +72,7 @@ func (st *Stat) AggregatorCmd() *aggregator.Command {
 type Stat struct {
 	Name   string
 	Value  float64
-	Metric string
+	Metric string // "c", "g", "ms", or DogStatsD "e" (event) and "sc" (service check)
 	Sample float64
 	Delta  bool
 }
@@ -71,6 +84,13 @@ type Stat struct {
 // would take care of it.
 func ParseStatsdPacket(packet string) (*Stat, error) {
 
+	if strings.HasPrefix(packet, "_e{") {
+		return parseEvent(packet)
+	}
+	if strings.HasPrefix(packet, "_sc|") {
+		return parseServiceCheck(packet)
+	}
+
 	var (
 		result = &Stat{Sample: 1}
 		parts  []string
@@ -116,3 +136,44 @@ func ParseStatsdPacket(packet string) (*Stat, error) {
 
 	return result, nil
 }
+
+// parseEvent parses a DogStatsD event, e.g.
+// "_e{6,13}:deploy|version 1.2.3|t:info|#env:prod", into a Stat with
+// the title as name and a value of 1. See
+// https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+// The text and the optional fields are ignored.
+func parseEvent(packet string) (*Stat, error) {
+	end := strings.Index(packet, "}:")
+	if end < 0 {
+		return nil, fmt.Errorf("invalid event: %q", packet)
+	}
+	lens := strings.Split(packet[len("_e{"):end], ",")
+	if len(lens) != 2 {
+		return nil, fmt.Errorf("invalid event (bad lengths): %q", packet)
+	}
+	tlen, err1 := strconv.Atoi(lens[0])
+	xlen, err2 := strconv.Atoi(lens[1])
+	rest := packet[end+2:]
+	// the title and text are followed by the optional fields, if any
+	if err1 != nil || err2 != nil || tlen <= 0 || xlen < 0 || len(rest) < tlen+1+xlen || rest[tlen] != '|' ||
+		len(rest) > tlen+1+xlen && rest[tlen+1+xlen] != '|' {
+		return nil, fmt.Errorf("invalid event (bad lengths): %q", packet)
+	}
+	return &Stat{Name: misc.SanitizeName(rest[:tlen]), Value: 1, Metric: "e", Sample: 1}, nil
+}
+
+// parseServiceCheck parses a DogStatsD service check, e.g.
+// "_sc|db.replication|2|m:lagging", into a Stat with the status (0 -
+// OK, 1 - WARNING, 2 - CRITICAL, 3 - UNKNOWN) as the value. The
+// optional fields are ignored.
+func parseServiceCheck(packet string) (*Stat, error) {
+	parts := strings.Split(packet, "|")
+	if len(parts) < 3 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid service check: %q", packet)
+	}
+	status, err := strconv.Atoi(parts[2])
+	if err != nil || status < 0 || status > 3 {
+		return nil, fmt.Errorf("invalid service check status: %q (must be 0 to 3)", parts[2])
+	}
+	return &Stat{Name: misc.SanitizeName(parts[1]), Value: float64(status), Metric: "sc", Sample: 1}, nil
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsd
+
+import "testing"
+
+func Test_ParseStatsdPacket(t *testing.T) {
+	for _, c := range []struct {
+		packet string
+		exp    Stat
+	}{
+		{"gorets:1|c", Stat{Name: "gorets", Value: 1, Metric: "c", Sample: 1}},
+		{"gorets:1|c|@0.1", Stat{Name: "gorets", Value: 1, Metric: "c", Sample: 0.1}},
+		{"gaugor:+10|g", Stat{Name: "gaugor", Value: 10, Metric: "g", Sample: 1, Delta: true}},
+		{"glork:320|ms", Stat{Name: "glork", Value: 320, Metric: "ms", Sample: 1}},
+		{"gorets", Stat{Name: "gorets", Value: 1, Metric: "c", Sample: 1}},
+	} {
+		st, err := ParseStatsdPacket(c.packet)
+		if err != nil || *st != c.exp {
+			t.Errorf("ParseStatsdPacket(%q): %v %+v", c.packet, err, st)
+		}
+	}
+	for _, packet := range []string{"gorets:1", "gorets:x|c", "gorets:1|h", "gorets:1|c|@2", "gorets:1|c|0.1"} {
+		if _, err := ParseStatsdPacket(packet); err == nil {
+			t.Errorf("ParseStatsdPacket(%q): expected an error", packet)
+		}
+	}
+}
+
+func Test_ParseStatsdPacket_event(t *testing.T) {
+	for _, c := range []struct {
+		packet, name string
+	}{
+		{"_e{6,13}:deploy|version 1.2.3", "deploy"},
+		{"_e{6,13}:deploy|version 1.2.3|t:info|#env:prod", "deploy"},
+		{"_e{6,0}:deploy|", "deploy"},
+		{"_e{6,0}:deploy||d:1500000000|h:web1|p:low|s:ci|k:key|#env:prod,role:web", "deploy"},
+		// an escaped newline is two characters of the text
+		{`_e{6,7}:deploy|a\nb\nc|#env:prod`, "deploy"},
+		// the lengths, not the pipes, delimit the title and text
+		{"_e{7,3}:de|ploy|a|b|t:info", "deploy"},
+		{"_e{10,0}:disk full!|", "disk_full"},
+	} {
+		st, err := ParseStatsdPacket(c.packet)
+		if err != nil {
+			t.Errorf("ParseStatsdPacket(%q): %v", c.packet, err)
+			continue
+		}
+		if exp := (Stat{Name: c.name, Value: 1, Metric: "e", Sample: 1}); *st != exp {
+			t.Errorf("ParseStatsdPacket(%q): expected %+v, got %+v", c.packet, exp, *st)
+		}
+	}
+
+	for _, packet := range []string{
+		"_e{6,13}deploy|version 1.2.3", // no colon
+		"_e{6}:deploy|version 1.2.3",   // one length
+		"_e{6,13,1}:deploy|version 1.2.3",
+		"_e{x,13}:deploy|version 1.2.3", // not a number
+		"_e{0,13}:|version 1.2.3",       // empty title
+		"_e{6,-1}:deploy|",
+		"_e{6,14}:deploy|version 1.2.3", // text too short
+		"_e{6,12}:deploy|version 1.2.3", // text too long
+		"_e{5,13}:deploy|version 1.2.3", // no pipe after the title
+		"_e{7,13}:deploy|version 1.2.3",
+	} {
+		if _, err := ParseStatsdPacket(packet); err == nil {
+			t.Errorf("ParseStatsdPacket(%q): expected an error", packet)
+		}
+	}
+}
+
+func Test_ParseStatsdPacket_serviceCheck(t *testing.T) {
+	for _, c := range []struct {
+		packet string
+		name   string
+		status float64
+	}{
+		{"_sc|db.replication|0", "db.replication", 0},
+		{"_sc|db.replication|2|m:lagging", "db.replication", 2},
+		{"_sc|db.replication|3|d:1500000000|h:db1|#env:prod,role:db|m:unknown", "db.replication", 3},
+	} {
+		st, err := ParseStatsdPacket(c.packet)
+		if err != nil {
+			t.Errorf("ParseStatsdPacket(%q): %v", c.packet, err)
+			continue
+		}
+		if exp := (Stat{Name: c.name, Value: c.status, Metric: "sc", Sample: 1}); *st != exp {
+			t.Errorf("ParseStatsdPacket(%q): expected %+v, got %+v", c.packet, exp, *st)
+		}
+	}
+
+	for _, packet := range []string{"_sc|db", "_sc||0", "_sc|db|4", "_sc|db|-1", "_sc|db|ok"} {
+		if _, err := ParseStatsdPacket(packet); err == nil {
+			t.Errorf("ParseStatsdPacket(%q): expected an error", packet)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package whisper reads and writes the files of Graphite's whisper
+// database (.wsp), and maps them to and from RRAs, so that history
+// can be migrated between Graphite and Tgres in both directions.
+//
+// A whisper file is a header followed by its archives, in order of
+// precision. Each archive is a round-robin array of (timestamp,
+// value) points, where the timestamp marks the beginning of the
+// slot. (Tgres marks the end.) A slot whose timestamp is not the
+// one expected for its position is empty, which is how whisper
+// tells a stale point from the previous round apart.
+package whisper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// AggregationMethod is how whisper consolidates an archive into the
+// next one.
+type AggregationMethod uint32
+
+const (
+	Average AggregationMethod = iota + 1
+	Sum
+	Last
+	Max
+	Min
+)
+
+// Consolidation returns the rrd consolidation function corresponding
+// to m, unknown methods are WMEAN.
+func (m AggregationMethod) Consolidation() rrd.Consolidation {
+	switch m {
+	case Sum:
+		return rrd.SUM
+	case Last:
+		return rrd.LAST
+	case Max:
+		return rrd.MAX
+	case Min:
+		return rrd.MIN
+	}
+	return rrd.WMEAN
+}
+
+// aggregationMethod is the reverse of Consolidation, there is no
+// whisper equivalent of STDDEV.
+func aggregationMethod(cf rrd.Consolidation) (AggregationMethod, error) {
+	switch cf {
+	case rrd.WMEAN:
+		return Average, nil
+	case rrd.SUM:
+		return Sum, nil
+	case rrd.LAST:
+		return Last, nil
+	case rrd.MAX:
+		return Max, nil
+	case rrd.MIN:
+		return Min, nil
+	}
+	return 0, fmt.Errorf("whisper has no equivalent of %v", cf)
+}
+
+type metadata struct {
+	AggregationMethod AggregationMethod
+	MaxRetention      uint32  // seconds
+	XFilesFactor      float32 // as in Tgres, how much must be known
+	ArchiveCount      uint32
+}
+
+// ArchiveInfo describes an archive, Offset is in bytes from the
+// beginning of the file.
+type ArchiveInfo struct {
+	Offset          uint32
+	SecondsPerPoint uint32
+	Points          uint32
+}
+
+// Step is the duration of a slot.
+func (a ArchiveInfo) Step() time.Duration {
+	return time.Duration(a.SecondsPerPoint) * time.Second
+}
+
+// Header is the beginning of a whisper file.
+type Header struct {
+	AggregationMethod AggregationMethod
+	MaxRetention      uint32
+	XFilesFactor      float32
+	Archives          []ArchiveInfo
+}
+
+// Point is a slot of an archive, TimeStamp is the Unix time of the
+// beginning of the slot.
+type Point struct {
+	TimeStamp uint32
+	Value     float64
+}
+
+const (
+	metadataSize = 16
+	archiveSize  = 12
+	pointSize    = 12
+)
+
+// ReadHeader reads the header of a whisper file.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var md metadata
+	if err := binary.Read(r, binary.BigEndian, &md); err != nil {
+		return nil, err
+	}
+	if md.ArchiveCount == 0 || md.ArchiveCount > 64 {
+		return nil, fmt.Errorf("whisper: invalid number of archives: %d", md.ArchiveCount)
+	}
+	h := &Header{
+		AggregationMethod: md.AggregationMethod,
+		MaxRetention:      md.MaxRetention,
+		XFilesFactor:      md.XFilesFactor,
+		Archives:          make([]ArchiveInfo, md.ArchiveCount),
+	}
+	if err := binary.Read(r, binary.BigEndian, h.Archives); err != nil {
+		return nil, err
+	}
+	for _, a := range h.Archives {
+		if a.SecondsPerPoint == 0 || a.Points == 0 {
+			return nil, fmt.Errorf("whisper: invalid archive: %+v", a)
+		}
+	}
+	return h, nil
+}
+
+// ReadArchive reads the points of archive n, as they are stored
+// (i.e. in round-robin order, including empty and stale slots).
+func ReadArchive(r io.ReadSeeker, h *Header, n int) ([]Point, error) {
+	if n < 0 || n >= len(h.Archives) {
+		return nil, fmt.Errorf("whisper: no archive %d, there are %d", n, len(h.Archives))
+	}
+	a := h.Archives[n]
+	if _, err := r.Seek(int64(a.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	points := make([]Point, a.Points)
+	if err := binary.Read(r, binary.BigEndian, points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// validPoints returns the points of an archive which are within its
+// retention ending at the latest point, sorted by time. Empty and
+// stale slots are left out.
+func validPoints(a ArchiveInfo, points []Point) []Point {
+	var latest uint32
+	for _, p := range points {
+		if p.TimeStamp > latest {
+			latest = p.TimeStamp
+		}
+	}
+	if latest == 0 {
+		return nil
+	}
+	retention := a.SecondsPerPoint * a.Points
+	var result []Point
+	for _, p := range points {
+		if p.TimeStamp == 0 || p.TimeStamp%a.SecondsPerPoint != 0 || p.TimeStamp+retention <= latest {
+			continue
+		}
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].TimeStamp < result[j].TimeStamp })
+	return result
+}
+
+// Write writes a whisper file with the given aggregation method and
+// xff whose archives are described by infos (only SecondsPerPoint
+// and Points are used, Offset is computed), with the points of each
+// archive from archives (same order). Archives must be in order of
+// precision and each step must be a multiple of the previous one.
+// The points must be sorted by time and aligned on the step of their
+// archive, if there are more points than fit, the oldest are left
+// out.
+func Write(w io.Writer, method AggregationMethod, xff float32, infos []ArchiveInfo, archives [][]Point) error {
+	if len(infos) == 0 || len(infos) != len(archives) {
+		return fmt.Errorf("whisper: %d archives but %d sets of points", len(infos), len(archives))
+	}
+	md := metadata{AggregationMethod: method, XFilesFactor: xff, ArchiveCount: uint32(len(infos))}
+	offset := uint32(metadataSize + archiveSize*len(infos))
+	hdr := make([]ArchiveInfo, len(infos))
+	for i, a := range infos {
+		if a.SecondsPerPoint == 0 || a.Points == 0 {
+			return fmt.Errorf("whisper: invalid archive: %+v", a)
+		}
+		if i > 0 {
+			prev := infos[i-1]
+			if a.SecondsPerPoint <= prev.SecondsPerPoint || a.SecondsPerPoint%prev.SecondsPerPoint != 0 {
+				return fmt.Errorf("whisper: archive step %ds must be a multiple of the previous %ds", a.SecondsPerPoint, prev.SecondsPerPoint)
+			}
+		}
+		hdr[i] = ArchiveInfo{Offset: offset, SecondsPerPoint: a.SecondsPerPoint, Points: a.Points}
+		offset += pointSize * a.Points
+		if r := a.SecondsPerPoint * a.Points; r > md.MaxRetention {
+			md.MaxRetention = r
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, md); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+
+	// Whisper finds the slot of a timestamp relative to the first
+	// point of the archive (its "base interval"), so the points are
+	// written in order starting at the first slot, with any gaps
+	// left empty.
+	for i, a := range hdr {
+		slots := make([]Point, a.Points)
+		points := archives[i]
+		if len(points) > 0 {
+			latest := points[len(points)-1].TimeStamp
+			base := uint32(0)
+			if span := a.SecondsPerPoint * (a.Points - 1); latest > span {
+				base = latest - span
+			}
+			if base < points[0].TimeStamp {
+				base = points[0].TimeStamp
+			}
+			for _, p := range points {
+				if p.TimeStamp < base || p.TimeStamp%a.SecondsPerPoint != 0 {
+					continue
+				}
+				slots[(p.TimeStamp-base)/a.SecondsPerPoint] = p
+			}
+		}
+		if err := binary.Write(w, binary.BigEndian, slots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DSSpec returns a DS spec with an RRA for each archive of h. The DS
+// step is that of the first (most precise) archive. The heartbeat is
+// the step of the last archive, because points from coarser archives
+// (see History) are that far apart.
+func (h *Header) DSSpec() *rrd.DSSpec {
+	spec := &rrd.DSSpec{
+		Step:      h.Archives[0].Step(),
+		Heartbeat: h.Archives[len(h.Archives)-1].Step(),
+		Min:       math.NaN(),
+		Max:       math.NaN(),
+	}
+	for _, a := range h.Archives {
+		spec.RRAs = append(spec.RRAs, rrd.RRASpec{
+			Function: h.AggregationMethod.Consolidation(),
+			Step:     a.Step(),
+			Span:     a.Step() * time.Duration(a.Points),
+			Xff:      h.XFilesFactor,
+		})
+	}
+	return spec
+}
+
+// TimedValue is a value at a time, see History.
+type TimedValue struct {
+	TimeStamp time.Time
+	Value     float64
+}
+
+// History reads all the archives of a whisper file and returns its
+// points as a single series, from the most precise archive where
+// it is available and coarser ones before that. The time stamps are
+// those of the end of the slots, as in Tgres, so that processing
+// them as data points (with the DS spec of the header) recreates the
+// archives. Since the first data point of a DS only marks the
+// beginning, the first point returned is a NaN at the beginning of
+// the first slot.
+func History(r io.ReadSeeker) (*Header, []TimedValue, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		result []TimedValue
+		begin  uint32 // of what is covered by more precise archives
+	)
+	for n, a := range h.Archives {
+		points, err := ReadArchive(r, h, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		var older []TimedValue
+		first := uint32(0)
+		for _, p := range validPoints(a, points) {
+			end := p.TimeStamp + a.SecondsPerPoint
+			if begin != 0 && end > begin {
+				break
+			}
+			if first == 0 {
+				first = p.TimeStamp
+			}
+			older = append(older, TimedValue{time.Unix(int64(end), 0), p.Value})
+		}
+		if len(older) > 0 {
+			result = append(older, result...)
+			begin = first
+		}
+	}
+	if len(result) > 0 {
+		result = append([]TimedValue{{time.Unix(int64(begin), 0), math.NaN()}}, result...)
+	}
+	return h, result, nil
+}
+
+// FromRRAs writes a whisper file with the data of rras, which must
+// have their data points. Whisper files have a single aggregation
+// method, so only the RRAs with the consolidation function cf are
+// included, in order of precision, as long as each step is a
+// multiple of the previous one and whole seconds. It is an error if
+// none are left.
+func FromRRAs(w io.Writer, rras []rrd.RoundRobinArchiver, cf rrd.Consolidation, xff float32) error {
+	method, err := aggregationMethod(cf)
+	if err != nil {
+		return err
+	}
+	var sorted []rrd.RoundRobinArchiver
+	for _, rra := range rras {
+		if rra.Consolidation() == cf && rra.Step()%time.Second == 0 && rra.Size() > 0 {
+			sorted = append(sorted, rra)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Step() < sorted[j].Step() })
+
+	var (
+		infos    []ArchiveInfo
+		archives [][]Point
+	)
+	for _, rra := range sorted {
+		step := uint32(rra.Step() / time.Second)
+		if n := len(infos); n > 0 && (step <= infos[n-1].SecondsPerPoint || step%infos[n-1].SecondsPerPoint != 0) {
+			continue
+		}
+		var points []Point
+		it := rrd.NewSlotIterator(rra)
+		for it.Next() {
+			if v := it.Value(); !math.IsNaN(v) {
+				begin := it.Time().Add(-rra.Step()).Unix()
+				points = append(points, Point{TimeStamp: uint32(begin), Value: v})
+			}
+		}
+		infos = append(infos, ArchiveInfo{SecondsPerPoint: step, Points: uint32(rra.Size())})
+		archives = append(archives, points)
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("whisper: no %v RRA with a whole second step", cf)
+	}
+	return Write(w, method, xff, infos, archives)
+}
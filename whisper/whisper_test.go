@@ -0,0 +1,175 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whisper
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_Write_ReadHeader(t *testing.T) {
+	infos := []ArchiveInfo{{SecondsPerPoint: 10, Points: 6}, {SecondsPerPoint: 60, Points: 10}}
+	archives := [][]Point{
+		{{1000, 1}, {1010, 2}, {1020, 3}},
+		{{960, 10}},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, Max, 0.5, infos, archives); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if expect := metadataSize + 2*archiveSize + 16*pointSize; buf.Len() != expect {
+		t.Errorf("Write: expected %d bytes, got %d", expect, buf.Len())
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if h.AggregationMethod != Max || h.XFilesFactor != 0.5 || h.MaxRetention != 600 || len(h.Archives) != 2 {
+		t.Errorf("ReadHeader: unexpected header: %+v", h)
+	}
+	if h.Archives[0].Offset != metadataSize+2*archiveSize || h.Archives[1].Offset != h.Archives[0].Offset+6*pointSize {
+		t.Errorf("ReadHeader: wrong offsets: %+v", h.Archives)
+	}
+	points, err := ReadArchive(r, h, 0)
+	if err != nil || len(points) != 6 || points[2] != (Point{1020, 3}) {
+		t.Errorf("ReadArchive: %v %v", points, err)
+	}
+	if _, err := ReadArchive(r, h, 2); err == nil {
+		t.Errorf("ReadArchive: expected an error for an archive that does not exist")
+	}
+
+	// steps must be increasing multiples
+	bad := []ArchiveInfo{{SecondsPerPoint: 10, Points: 6}, {SecondsPerPoint: 15, Points: 10}}
+	if err := Write(&buf, Max, 0.5, bad, archives); err == nil {
+		t.Errorf("Write: expected an error for a step that is not a multiple")
+	}
+	if _, err := ReadHeader(bytes.NewReader(make([]byte, metadataSize))); err == nil {
+		t.Errorf("ReadHeader: expected an error for no archives")
+	}
+}
+
+func Test_validPoints(t *testing.T) {
+	a := ArchiveInfo{SecondsPerPoint: 10, Points: 3}
+	// 1000 is from the previous round, 0 is empty, 1025 is misaligned
+	points := []Point{{1030, 3}, {1000, 9}, {1020, 2}, {0, 0}, {1025, 1}}
+	vp := validPoints(a, points)
+	if len(vp) != 2 || vp[0] != (Point{1020, 2}) || vp[1] != (Point{1030, 3}) {
+		t.Errorf("validPoints: %v", vp)
+	}
+	if vp := validPoints(a, make([]Point, 3)); vp != nil {
+		t.Errorf("validPoints: expected nil for an empty archive, got %v", vp)
+	}
+}
+
+func Test_History(t *testing.T) {
+	infos := []ArchiveInfo{{SecondsPerPoint: 10, Points: 3}, {SecondsPerPoint: 30, Points: 4}}
+	archives := [][]Point{
+		{{1050, 5}, {1060, 6}, {1070, 7}},
+		{{960, 1}, {990, 2}, {1020, 3}, {1050, 6}},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, Average, 0, infos, archives); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	h, history, err := History(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+
+	// the coarse archive only up to where the fine one begins,
+	// slot ends, and a NaN marking the beginning
+	expect := []TimedValue{
+		{time.Unix(960, 0), math.NaN()},
+		{time.Unix(990, 0), 1},
+		{time.Unix(1020, 0), 2},
+		{time.Unix(1050, 0), 3},
+		{time.Unix(1060, 0), 5},
+		{time.Unix(1070, 0), 6},
+		{time.Unix(1080, 0), 7},
+	}
+	if len(history) != len(expect) {
+		t.Fatalf("History: expected %d points, got %d: %v", len(expect), len(history), history)
+	}
+	for i, p := range history {
+		e := expect[i]
+		if !p.TimeStamp.Equal(e.TimeStamp) || (p.Value != e.Value && !(math.IsNaN(p.Value) && math.IsNaN(e.Value))) {
+			t.Errorf("History: point %d: expected %v, got %v", i, e, p)
+		}
+	}
+
+	spec := h.DSSpec()
+	if spec.Step != 10*time.Second || spec.Heartbeat != 30*time.Second || len(spec.RRAs) != 2 {
+		t.Errorf("DSSpec: unexpected spec: %+v", spec)
+	}
+	if r := spec.RRAs[1]; r.Function != rrd.WMEAN || r.Step != 30*time.Second || r.Span != 2*time.Minute {
+		t.Errorf("DSSpec: unexpected RRA: %+v", r)
+	}
+}
+
+func Test_FromRRAs(t *testing.T) {
+	step := 10 * time.Second
+	ds := rrd.NewDataSource(rrd.DSSpec{
+		Step: step,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: step, Span: 6 * step},
+			{Function: rrd.MAX, Step: step, Span: 6 * step},
+			{Function: rrd.WMEAN, Step: 3 * step, Span: 12 * step},
+		},
+	})
+	for ts := int64(1000); ts <= 1060; ts += 10 {
+		ds.ProcessDataPoint(float64(ts), time.Unix(ts, 0))
+	}
+
+	var buf bytes.Buffer
+	if err := FromRRAs(&buf, ds.RRAs(), rrd.STDDEV, 0.5); err == nil {
+		t.Errorf("FromRRAs: expected an error for STDDEV")
+	}
+	if err := FromRRAs(&buf, ds.RRAs(), rrd.LAST, 0.5); err == nil {
+		t.Errorf("FromRRAs: expected an error when no RRA has the function")
+	}
+	if err := FromRRAs(&buf, ds.RRAs(), rrd.WMEAN, 0.5); err != nil {
+		t.Fatalf("FromRRAs: %v", err)
+	}
+
+	// and back, the DS recreates the same RRAs
+	h, history, err := History(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(h.Archives) != 2 || h.AggregationMethod != Average {
+		t.Fatalf("FromRRAs: unexpected header: %+v", h)
+	}
+	imported := rrd.NewDataSource(*h.DSSpec())
+	for _, p := range history {
+		imported.ProcessDataPoint(p.Value, p.TimeStamp)
+	}
+	orig := ds.RRAs()[0]
+	rra := imported.RRAs()[0]
+	if !rra.Latest().Equal(orig.Latest()) {
+		t.Errorf("FromRRAs: latest %v, expected %v", rra.Latest(), orig.Latest())
+	}
+	for i, v := range orig.DPs() {
+		if rra.DPs()[i] != v {
+			t.Errorf("FromRRAs: slot %d: expected %v, got %v", i, v, rra.DPs()[i])
+		}
+	}
+}